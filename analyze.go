@@ -0,0 +1,288 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(analyzeCmd)
+
+	analyzeCmd.Flags().String("addr", ":6379", "address of a Valthree server")
+	analyzeCmd.Flags().String("password", "", "password to authenticate with (default none)")
+	analyzeCmd.Flags().String("match", "*", "only analyze keys matching this glob-style pattern")
+	analyzeCmd.Flags().Int("samples", 1000, "number of keys to read and measure (0 measures every key)")
+	analyzeCmd.Flags().String("delimiter", ":", "separator between the parts of key names")
+	analyzeCmd.Flags().Int("depth", 1, "number of delimited parts of key names that make up a prefix")
+	analyzeCmd.Flags().Int("top", 10, "number of prefixes and keys to report")
+}
+
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Estimate how a Valthree database's keys and bytes are distributed",
+	Long: `Scan a Valthree database's keys and estimate how its size is distributed
+across key prefixes, to help plan sharding or splitting up large keys.
+
+Every key is counted, but only a random sample of keys are read, so sizes
+are estimates. A key's size is the length of its name and its contents,
+which approximates its share of the stored database.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		addr := orFatal(net.ResolveTCPAddr("tcp", orFatal(flags.GetString("addr"))))
+		var opts []client.Option
+		if password := orFatal(flags.GetString("password")); password != "" {
+			opts = append(opts, client.WithPassword(password))
+		}
+		c := orFatal(client.New(addr, opts...))
+		defer c.Close()
+
+		a := analysis{
+			delimiter: orFatal(flags.GetString("delimiter")),
+			depth:     orFatal(flags.GetInt("depth")),
+			samples:   orFatal(flags.GetInt("samples")),
+		}
+		report := orFatal(a.run(c, orFatal(flags.GetString("match"))))
+		report.truncate(orFatal(flags.GetInt("top")))
+		if orFatal(flags.GetBool("json")) {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			orFatal(0, enc.Encode(report))
+			return
+		}
+		report.print()
+	},
+}
+
+// analysis configures how analyze groups and samples keys.
+type analysis struct {
+	delimiter string
+	depth     int
+	samples   int // zero measures every key
+}
+
+// An analysisReport is analyze's output. Sizes are in bytes.
+type analysisReport struct {
+	Keys          int              `json:"keys"`
+	Sampled       int              `json:"sampled"`
+	EstimatedSize int64            `json:"estimated_size"`
+	Prefixes      []prefixEstimate `json:"prefixes"`
+	LargestKeys   []keySize        `json:"largest_keys"` // among the sampled keys
+}
+
+// A prefixEstimate describes the keys sharing a prefix. Keys is exact; the
+// size is extrapolated from the prefix's sampled keys.
+type prefixEstimate struct {
+	Prefix        string  `json:"prefix"`
+	Keys          int     `json:"keys"`
+	Sampled       int     `json:"sampled"`
+	EstimatedSize int64   `json:"estimated_size"`
+	Share         float64 `json:"share"` // of the database's estimated size
+}
+
+type keySize struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// prefix returns the group a key belongs to: its first depth parts, or the
+// whole key if it has no more parts than that.
+func (a analysis) prefix(key string) string {
+	if a.delimiter == "" || a.depth <= 0 {
+		return ""
+	}
+	parts := strings.SplitN(key, a.delimiter, a.depth+1)
+	if len(parts) <= a.depth {
+		return key
+	}
+	return strings.Join(parts[:a.depth], a.delimiter) + a.delimiter
+}
+
+func (a analysis) run(c *client.Client, match string) (*analysisReport, error) {
+	// Counting every key only needs SCAN, so counts are exact. Reading keys
+	// is more expensive, so a uniform random sample of them (chosen by
+	// reservoir sampling, in one pass) is measured.
+	counts := make(map[string]int)
+	var (
+		total  int
+		sample []string
+	)
+	for key, err := range c.Scan(match) {
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		counts[a.prefix(key)]++
+		total++
+		switch {
+		case a.samples <= 0 || len(sample) < a.samples:
+			sample = append(sample, key)
+		default:
+			if i := rand.IntN(total); i < a.samples {
+				sample[i] = key
+			}
+		}
+	}
+
+	report := &analysisReport{Keys: total}
+	sizes := make(map[string]int64)
+	sampled := make(map[string]int)
+	for _, key := range sample {
+		typ, size, err := measureKey(c, key)
+		if err != nil {
+			return nil, fmt.Errorf("measure %q: %w", key, err)
+		}
+		if typ == "none" {
+			continue // deleted since the scan
+		}
+		prefix := a.prefix(key)
+		sizes[prefix] += size
+		sampled[prefix]++
+		report.Sampled++
+		report.LargestKeys = append(report.LargestKeys, keySize{key, typ, size})
+	}
+
+	// Each measured key stands for total/sampled keys. Prefixes too small
+	// to be sampled are estimated at zero bytes.
+	scale := 1.0
+	if report.Sampled > 0 {
+		scale = float64(total) / float64(report.Sampled)
+	}
+	for prefix, n := range counts {
+		est := int64(math.Round(float64(sizes[prefix]) * scale))
+		report.EstimatedSize += est
+		report.Prefixes = append(report.Prefixes, prefixEstimate{
+			Prefix:        prefix,
+			Keys:          n,
+			Sampled:       sampled[prefix],
+			EstimatedSize: est,
+		})
+	}
+	for i := range report.Prefixes {
+		if report.EstimatedSize > 0 {
+			report.Prefixes[i].Share = float64(report.Prefixes[i].EstimatedSize) / float64(report.EstimatedSize)
+		}
+	}
+	slices.SortFunc(report.Prefixes, func(p, q prefixEstimate) int {
+		return cmp.Or(
+			cmp.Compare(q.EstimatedSize, p.EstimatedSize),
+			cmp.Compare(q.Keys, p.Keys),
+			cmp.Compare(p.Prefix, q.Prefix),
+		)
+	})
+	slices.SortFunc(report.LargestKeys, func(p, q keySize) int {
+		return cmp.Or(cmp.Compare(q.Size, p.Size), cmp.Compare(p.Key, q.Key))
+	})
+	return report, nil
+}
+
+// measureKey returns the type of a key and the number of bytes in its name
+// and contents. Sorted set scores count as eight bytes each.
+func measureKey(c *client.Client, key string) (string, int64, error) {
+	typ, err := c.Type(key)
+	if err != nil {
+		return "", 0, err
+	}
+	size := int64(len(key))
+	switch typ {
+	case "string":
+		val, err := c.Get(key)
+		if errors.Is(err, client.ErrNotFound) {
+			return "none", 0, nil
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		size += int64(len(val))
+	case "hash":
+		fields, err := c.HGetAll(key)
+		if err != nil {
+			return "", 0, err
+		}
+		for f, v := range fields {
+			size += int64(len(f) + len(v))
+		}
+	case "list":
+		vals, err := c.LRange(key, 0, -1)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, v := range vals {
+			size += int64(len(v))
+		}
+	case "set":
+		members, err := c.SMembers(key)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, m := range members {
+			size += int64(len(m))
+		}
+	case "zset":
+		members, err := c.ZRangeByScore(key, math.Inf(-1), math.Inf(1))
+		if err != nil {
+			return "", 0, err
+		}
+		for _, m := range members {
+			size += int64(len(m.Member) + 8)
+		}
+	}
+	return typ, size, nil
+}
+
+// truncate keeps only the top n prefixes and keys.
+func (r *analysisReport) truncate(n int) {
+	n = max(n, 0)
+	r.Prefixes = r.Prefixes[:min(n, len(r.Prefixes))]
+	r.LargestKeys = r.LargestKeys[:min(n, len(r.LargestKeys))]
+}
+
+func (r *analysisReport) print() {
+	fmt.Printf("keys: %d (%d sampled)\n", r.Keys, r.Sampled)
+	fmt.Printf("estimated size: %s\n", formatBytes(r.EstimatedSize))
+
+	fmt.Println("\nlargest prefixes:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  PREFIX\tKEYS\tSAMPLED\tEST. SIZE\tSHARE")
+	for _, p := range r.Prefixes {
+		prefix := p.Prefix
+		if prefix == "" {
+			prefix = "(all)"
+		}
+		fmt.Fprintf(w, "  %q\t%d\t%d\t%s\t%.1f%%\n", prefix, p.Keys, p.Sampled, formatBytes(p.EstimatedSize), 100*p.Share)
+	}
+	w.Flush()
+
+	fmt.Println("\nlargest sampled keys:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  KEY\tTYPE\tSIZE")
+	for _, k := range r.LargestKeys {
+		fmt.Fprintf(w, "  %q\t%s\t%s\n", k.Key, k.Type, formatBytes(k.Size))
+	}
+	w.Flush()
+}
+
+// formatBytes formats a size with a binary unit, like 1.5 KiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/server"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(backupCmd, restoreCmd)
+	backupCmd.AddCommand(backupListCmd, backupCreateCmd)
+
+	addStorageFlags(backupCmd.PersistentFlags())
+	addStorageFlags(restoreCmd.Flags())
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "List and take snapshots of a Valthree database",
+	Long: `List and take snapshots of a Valthree database, directly in object storage.
+
+Snapshots are the same objects that servers take on their --backup-schedule
+or when a client sends BGSAVE. They include every logical database, so use
+the same storage flags as the servers, including --databases.`,
+}
+
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the database's snapshots, oldest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		snapshots := orFatal(server.ListSnapshots(storageConfig(cmd.Flags())))
+		if orFatal(cmd.Flags().GetBool("json")) {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			orFatal(0, enc.Encode(snapshots))
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tTIME\tSIZE")
+		for _, snap := range snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", snap.Key, snap.Time.Format(time.RFC3339), formatBytes(snap.Size))
+		}
+		w.Flush()
+	},
+}
+
+var backupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Take a snapshot of the database now",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		key := orFatal(server.TakeSnapshot(storageConfig(cmd.Flags())))
+		fmt.Println(key)
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore SNAPSHOT",
+	Short: "Replace a Valthree database with one of its snapshots",
+	Long: `Replace a Valthree database with one of its snapshots, directly in object
+storage. SNAPSHOT is a key listed by "valthree backup list", or "latest".
+
+Running servers needn't be stopped: they notice the restore within a second.
+Writes that race with the restore may be overwritten by it. Locks aren't
+restored.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := storageConfig(cmd.Flags())
+		key := args[0]
+		if key == "latest" {
+			snapshots := orFatal(server.ListSnapshots(cfg))
+			if len(snapshots) == 0 {
+				orFatal(0, errors.New("no snapshots to restore"))
+			}
+			key = snapshots[len(snapshots)-1].Key
+		}
+		orFatal(0, server.Restore(cfg, key))
+		fmt.Println("restored", key)
+	},
+}
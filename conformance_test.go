@@ -0,0 +1,22 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/antithesishq/valthree/internal/conformance"
+	"github.com/antithesishq/valthree/internal/servertest"
+	"go.akshayshah.org/attest"
+)
+
+func TestConformance(t *testing.T) {
+	// Each script in the corpus is a conversation in raw RESP, checked byte
+	// for byte (see package conformance).
+	scripts, err := conformance.Load("testdata/conformance")
+	attest.Ok(t, err)
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	for _, script := range scripts {
+		t.Run(script.Name, func(t *testing.T) {
+			script.Run(t, addr)
+		})
+	}
+}
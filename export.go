@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/server"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd, importCmd)
+
+	formats := strings.Join(server.ExportFormats, ", ")
+	exportCmd.Flags().String("format", "json", "output format: "+formats)
+	exportCmd.Flags().StringP("output", "o", "-", "file to write, or - for standard output")
+	exportCmd.Flags().Int("db", 0, "logical database to write")
+	addStorageFlags(exportCmd.Flags())
+
+	importCmd.Flags().String("format", "", "input format: "+formats+" (default from the file's extension)")
+	importCmd.Flags().Bool("replace", false, "overwrite a database that already has keys")
+	importCmd.Flags().Int("db", 0, "logical database to replace")
+	addStorageFlags(importCmd.Flags())
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write a Valthree database to a file",
+	Long: `Write a Valthree database to a file, directly from object storage.
+
+The json format is Valthree's own, the same as a snapshot's. The rdb format
+is a Redis RDB file, which Redis and Valkey load at startup, and the resp
+format is a stream of commands, which "valkey-cli --pipe" sends to a running
+server. Locks are only included in the json format.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		format := orFatal(flags.GetString("format"))
+		if !slices.Contains(server.ExportFormats, format) {
+			orFatal(0, fmt.Errorf("unknown format %q", format))
+		}
+		var w io.Writer = os.Stdout
+		if path := orFatal(flags.GetString("output")); path != "-" {
+			f := orFatal(os.Create(path))
+			defer func() { orFatal(0, f.Close()) }()
+			w = f
+		}
+		orFatal(0, server.Export(storageConfig(flags), orFatal(flags.GetInt("db")), format, w))
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Replace a Valthree database with the contents of a file",
+	Long: `Replace a Valthree database with the contents of a file, directly in
+object storage. FILE may be - to read standard input.
+
+Import reads the formats export writes. RDB files may come from any version
+of Redis or Valkey, and resp files may be their append-only files, as long
+as they only hold the types Valthree supports, all in one database. Keys
+that have already expired are skipped.
+
+Running servers needn't be stopped: they notice the import within a second.
+Locks are left as they are.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		path := args[0]
+		format := orFatal(flags.GetString("format"))
+		if format == "" {
+			format = formatFromExt(path)
+		}
+		if !slices.Contains(server.ExportFormats, format) {
+			orFatal(0, fmt.Errorf("unknown format %q; use --format", format))
+		}
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			f := orFatal(os.Open(path))
+			defer f.Close()
+			r = f
+		}
+		replace := orFatal(flags.GetBool("replace"))
+		orFatal(0, server.Import(storageConfig(flags), orFatal(flags.GetInt("db")), format, r, replace))
+		fmt.Println("imported", path)
+	},
+}
+
+// formatFromExt guesses a file's format from its extension.
+func formatFromExt(path string) string {
+	switch ext := strings.TrimPrefix(filepath.Ext(path), "."); ext {
+	case "aof":
+		return "resp"
+	default:
+		return ext
+	}
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// A BulkOption configures BulkSet.
+type BulkOption func(*bulkOptions)
+
+type bulkOptions struct {
+	batchSize int
+	window    int
+	progress  func(done, total int)
+}
+
+// WithBatchSize sets the number of keys BulkSet writes with each MSET. The
+// default is 1,000.
+func WithBatchSize(n int) BulkOption {
+	return func(o *bulkOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithWindow sets the number of MSETs BulkSet sends before waiting for their
+// replies. The default is 8.
+func WithWindow(n int) BulkOption {
+	return func(o *bulkOptions) {
+		o.window = n
+	}
+}
+
+// WithProgress calls f each time BulkSet gets replies, with the number of
+// keys it has tried to set so far, successfully or not, and the total.
+func WithProgress(f func(done, total int)) BulkOption {
+	return func(o *bulkOptions) {
+		o.progress = f
+	}
+}
+
+// A BulkError reports the keys that BulkSet failed to set. Every other key
+// was set.
+type BulkError struct {
+	// Failed maps each key that wasn't set to the reason. Keys whose batch
+	// was sent but never acknowledged, because the connection failed, may
+	// have been set anyway.
+	Failed map[string]error
+}
+
+func (e *BulkError) Error() string {
+	errs := e.Unwrap()
+	msg := fmt.Sprintf("failed to set %d keys: %v", len(e.Failed), errs[0])
+	if len(errs) > 1 {
+		msg += fmt.Sprintf(" (and %d other errors)", len(errs)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the distinct reasons keys weren't set, so that errors.Is
+// and errors.As see them.
+func (e *BulkError) Unwrap() []error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(e.Failed)) {
+		if err := e.Failed[key]; !slices.Contains(errs, err) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// BulkSet sets many keys, splitting them into MSETs of a manageable size and
+// pipelining those, so that loading a large data set takes a few round trips
+// rather than one per key. Each MSET is atomic, but BulkSet as a whole isn't:
+// other clients may see some batches before others, and if some batches
+// fail, the rest still apply. Failures are reported with a *BulkError.
+func (c *Client) BulkSet(items map[string]string, opts ...BulkOption) error {
+	o := bulkOptions{batchSize: 1000, window: 8}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize < 1 || o.window < 1 {
+		return fmt.Errorf("invalid batch size %d or window %d", o.batchSize, o.window)
+	}
+	// Sorting makes the batches, and so any failures, reproducible.
+	keys := slices.Sorted(maps.Keys(items))
+	batches := slices.Collect(slices.Chunk(keys, o.batchSize))
+	failed := make(map[string]error)
+	done := 0
+	for window := range slices.Chunk(batches, o.window) {
+		cmds := make([]Command, len(window))
+		for i, batch := range window {
+			args := make([]any, 0, 2*len(batch))
+			for _, key := range batch {
+				args = append(args, key, items[key])
+			}
+			cmds[i] = Command{Name: "MSET", Args: args}
+		}
+		replies, err := c.Pipeline(cmds...)
+		for i, batch := range window {
+			berr := err
+			if i < len(replies) {
+				berr = msetError(replies[i])
+			}
+			if berr != nil {
+				for _, key := range batch {
+					failed[key] = berr
+				}
+			}
+			done += len(batch)
+		}
+		if o.progress != nil {
+			o.progress(done, len(keys))
+		}
+		if err != nil {
+			// The connection is unusable, so nothing else will be set.
+			for _, key := range keys[done:] {
+				failed[key] = err
+			}
+			break
+		}
+	}
+	if len(failed) > 0 {
+		return &BulkError{Failed: failed}
+	}
+	return nil
+}
+
+// msetError returns the error in a pipelined MSET's reply, if any.
+func msetError(reply any) error {
+	switch r := reply.(type) {
+	case redis.Error:
+		return typedError(r)
+	case string:
+		if r == "OK" {
+			return nil
+		}
+		return fmt.Errorf("unexpected mset response: %s", r)
+	}
+	return fmt.Errorf("unexpected mset response type: %T", reply)
+}
@@ -2,10 +2,15 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
@@ -14,6 +19,53 @@ import (
 // not present in the database.
 var ErrNotFound = errors.New("key not found")
 
+// ErrVersionMismatch signals that a VSET command didn't apply because the
+// key's version had changed.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrLocked signals that a LOCK command failed because another owner holds an
+// unexpired lease on the lock.
+var ErrLocked = errors.New("lock held by another owner")
+
+// ErrAborted signals that EXEC didn't run a transaction because a watched
+// key changed after WATCH.
+var ErrAborted = errors.New("transaction aborted")
+
+// ErrContention signals that a write conflicted with concurrent writes to
+// object storage and wasn't applied. Retrying may succeed.
+var ErrContention = errors.New("write contention")
+
+// ErrStorageUnavailable signals that the server couldn't reach object
+// storage. The command may or may not have taken effect.
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// ErrCapacity signals that a write would exceed the server's key limit or a
+// quota.
+var ErrCapacity = errors.New("capacity exceeded")
+
+// ErrWrongType signals that a command was used on a key holding another type
+// of value.
+var ErrWrongType = errors.New("wrong type")
+
+// ErrTimeout signals that a command passed its deadline on the server. The
+// command may or may not have taken effect.
+var ErrTimeout = errors.New("timeout")
+
+// ErrReadOnly signals that a write was refused because the server is a read
+// replica, or because the connection is pinned to a snapshot.
+var ErrReadOnly = errors.New("read only")
+
+// errorCodes maps the error codes the server uses in place of ERR to the
+// corresponding errors.
+var errorCodes = map[string]error{
+	"TRYAGAIN":    ErrContention,
+	"STORAGEDOWN": ErrStorageUnavailable,
+	"OOM":         ErrCapacity,
+	"WRONGTYPE":   ErrWrongType,
+	"BUSY":        ErrTimeout,
+	"READONLY":    ErrReadOnly,
+}
+
 // Client is a type-safe, lower-boilerplate wrapper around the redigo client. It
 // doesn't have all the flexibility of a plain redigo connection, but it
 // introduces less noise in tests.
@@ -24,13 +76,170 @@ type Client struct {
 	connErr error
 }
 
+// An Option configures a Client.
+type Option func(*options)
+
+type options struct {
+	dial     []redis.DialOption
+	user     string
+	password string
+	name     string
+	stale    bool
+	db       int
+}
+
+// WithTLS connects to the server over TLS.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.dial = append(o.dial, redis.DialUseTLS(true), redis.DialTLSConfig(cfg))
+	}
+}
+
+// WithPassword authenticates with the supplied password after connecting.
+func WithPassword(password string) Option {
+	return func(o *options) {
+		o.password = password
+	}
+}
+
+// WithUser authenticates as an ACL user after connecting.
+func WithUser(user, password string) Option {
+	return func(o *options) {
+		o.user, o.password = user, password
+	}
+}
+
+// WithName names the connection, as CLIENT SETNAME would.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithStaleReads sends READONLY after connecting, so that a read replica may
+// serve the client's reads from its periodically refreshed copy of the
+// database. Other servers ignore it.
+func WithStaleReads() Option {
+	return func(o *options) {
+		o.stale = true
+	}
+}
+
+// WithDatabase switches the connection to logical database n after
+// connecting, with SELECT.
+func WithDatabase(n int) Option {
+	return func(o *options) {
+		o.db = n
+	}
+}
+
 // New creates a new Client.
-func New(addr net.Addr) (*Client, error) {
-	conn, err := redis.Dial("tcp", addr.String())
+func New(addr net.Addr, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	conn, err := redis.Dial("tcp", addr.String(), o.dial...)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
-	return &Client{conn: conn}, nil
+	if err := handshake(conn, o); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake: %w", typedError(err))
+	}
+	if o.stale {
+		if _, err := conn.Do("READONLY"); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("readonly: %w", typedError(err))
+		}
+	}
+	if o.db != 0 {
+		if _, err := conn.Do("SELECT", o.db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("select: %w", typedError(err))
+		}
+	}
+	return &Client{conn: errorConn{conn}}, nil
+}
+
+// handshake authenticates and names a new connection. It does both in one
+// round trip with HELLO, which also settles on RESP2, the only protocol
+// redigo speaks. Servers that don't know HELLO reject it, and then handshake
+// falls back to AUTH and CLIENT SETNAME.
+func handshake(conn redis.Conn, o options) error {
+	if o.password == "" && o.name == "" {
+		return nil
+	}
+	user := o.user
+	if user == "" {
+		user = "default"
+	}
+	args := []any{2}
+	if o.password != "" {
+		args = append(args, "AUTH", user, o.password)
+	}
+	if o.name != "" {
+		args = append(args, "SETNAME", o.name)
+	}
+	_, err := conn.Do("HELLO", args...)
+	var rerr redis.Error
+	if !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "ERR unknown command") {
+		return err
+	}
+	if o.password != "" {
+		auth := []any{o.password}
+		if o.user != "" {
+			auth = []any{o.user, o.password}
+		}
+		if _, err := conn.Do("AUTH", auth...); err != nil {
+			return err
+		}
+	}
+	if o.name != "" {
+		if _, err := conn.Do("CLIENT", "SETNAME", o.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorConn translates error replies with known codes into errors that
+// callers can match with errors.Is. The original redis.Error is still in the
+// chain.
+type errorConn struct {
+	redis.Conn
+}
+
+func (c errorConn) Do(cmd string, args ...any) (any, error) {
+	res, err := c.Conn.Do(cmd, args...)
+	return res, typedError(err)
+}
+
+func (c errorConn) Receive() (any, error) {
+	res, err := c.Conn.Receive()
+	return res, typedError(err)
+}
+
+func (c errorConn) DoWithTimeout(timeout time.Duration, cmd string, args ...any) (any, error) {
+	res, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	return res, typedError(err)
+}
+
+func (c errorConn) ReceiveWithTimeout(timeout time.Duration) (any, error) {
+	res, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	return res, typedError(err)
+}
+
+func typedError(err error) error {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return err
+	}
+	code, _, _ := strings.Cut(string(rerr), " ")
+	if typed, ok := errorCodes[code]; ok {
+		return fmt.Errorf("%w: %w", typed, err)
+	}
+	return err
 }
 
 // Ping the database.
@@ -81,6 +290,52 @@ func (c *Client) Get(key string) (string, error) {
 	return string(r), nil
 }
 
+// GetDel deletes a single key and returns the value it had. If the key didn't
+// exist, it returns ErrNotFound.
+func (c *Client) GetDel(key string) (string, error) {
+	return c.doBulk("GETDEL", key)
+}
+
+// GetEx returns the value of a single key and sets its TTL, rounded to the
+// nearest millisecond. A zero TTL removes any expiration instead. If the key
+// doesn't exist, it returns ErrNotFound.
+func (c *Client) GetEx(key string, ttl time.Duration) (string, error) {
+	if ttl == 0 {
+		return c.doBulk("GETEX", key, "PERSIST")
+	}
+	return c.doBulk("GETEX", key, "PX", ttl.Round(time.Millisecond).Milliseconds())
+}
+
+// GetSet sets a single key and returns the value it had. If the key didn't
+// exist, it returns ErrNotFound, but the value is still set.
+func (c *Client) GetSet(key, value string) (string, error) {
+	return c.doBulk("GETSET", key, value)
+}
+
+// Append appends value to the string stored at key, creating it if needed,
+// and returns the string's new length.
+func (c *Client) Append(key, value string) (int, error) {
+	return c.doInt("APPEND", key, value)
+}
+
+// Strlen returns the length of the string stored at key, or zero if the key
+// doesn't exist.
+func (c *Client) Strlen(key string) (int, error) {
+	return c.doInt("STRLEN", key)
+}
+
+// SetRange overwrites the string stored at key from offset onwards, padding
+// it with zero bytes if needed, and returns the string's new length.
+func (c *Client) SetRange(key string, offset int, value string) (int, error) {
+	return c.doInt("SETRANGE", key, offset, value)
+}
+
+// GetRange returns the bytes of the string stored at key from start to end,
+// inclusive. Negative offsets count back from the end of the string.
+func (c *Client) GetRange(key string, start, end int) (string, error) {
+	return c.doBulk("GETRANGE", key, start, end)
+}
+
 // Set the value of a single key.
 func (c *Client) Set(key, value string) error {
 	if c.connErr != nil {
@@ -105,6 +360,139 @@ func (c *Client) Set(key, value string) error {
 	return nil
 }
 
+// SetNX sets the value of a key only if it doesn't already exist, reporting
+// whether the key was set.
+func (c *Client) SetNX(key, value string) (bool, error) {
+	return c.setCond(key, value, "NX")
+}
+
+// SetXX sets the value of a key only if it already exists, reporting whether
+// the key was set.
+func (c *Client) SetXX(key, value string) (bool, error) {
+	return c.setCond(key, value, "XX")
+}
+
+// SetEx sets a single key with a TTL, rounded to the nearest millisecond.
+func (c *Client) SetEx(key, value string, ttl time.Duration) error {
+	return c.doOK("PSETEX", key, ttl.Round(time.Millisecond).Milliseconds(), value)
+}
+
+func (c *Client) setCond(key, value, cond string) (bool, error) {
+	if c.connErr != nil {
+		return false, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("SET", key, value, cond)
+	if err != nil {
+		return false, err
+	}
+	var set bool
+	switch r := res.(type) {
+	case nil:
+	case string:
+		if r != "OK" {
+			return false, fmt.Errorf("unexpected set response: %s", r)
+		}
+		set = true
+	default:
+		return false, fmt.Errorf("unexpected set response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return false, fmt.Errorf("conn unusable: %w", err)
+	}
+	return set, nil
+}
+
+// IncrBy adds delta to the integer stored at key, treating missing keys as
+// zero, and returns the result.
+func (c *Client) IncrBy(key string, delta int64) (int64, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("INCRBY", key, delta)
+	if err != nil {
+		return 0, err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected incrby response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return r, nil
+}
+
+// MGet reads several keys from a single version of the database. Missing
+// keys are returned as empty strings, which Valthree never stores.
+func (c *Client) MGet(keys ...string) ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	res, err := c.conn.Do("MGET", args...)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected mget response type: %T", res)
+	}
+	if len(rs) != len(keys) {
+		return nil, fmt.Errorf("unexpected mget response length: got %d, want %d", len(rs), len(keys))
+	}
+	vals := make([]string, len(rs))
+	for i, r := range rs {
+		switch r := r.(type) {
+		case nil:
+		case []byte:
+			vals[i] = string(r)
+		default:
+			return nil, fmt.Errorf("unexpected mget element type: %T", r)
+		}
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return vals, nil
+}
+
+// MSet sets several keys in a single atomic write.
+func (c *Client) MSet(items map[string]string) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 2*len(items))
+	for key, val := range items {
+		args = append(args, key, val)
+	}
+	res, err := c.conn.Do("MSET", args...)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(string)
+	if !ok {
+		return fmt.Errorf("unexpected mset response type: %T", res)
+	}
+	if r != "OK" {
+		return fmt.Errorf("unexpected mset response: %s", r)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
 // Del deletes a key.
 func (c *Client) Del(key string) error {
 	if c.connErr != nil {
@@ -132,7 +520,7 @@ func (c *Client) Del(key string) error {
 	return nil
 }
 
-// FlushAll deletes all keys in the database.
+// FlushAll deletes all keys in every logical database.
 func (c *Client) FlushAll() error {
 	if c.connErr != nil {
 		return fmt.Errorf("conn unusable: %w", c.connErr)
@@ -156,6 +544,1395 @@ func (c *Client) FlushAll() error {
 	return nil
 }
 
+// FlushDB deletes all keys in the connection's logical database.
+func (c *Client) FlushDB() error {
+	return c.doOK("FLUSHDB")
+}
+
+// FlushAllAsync is FlushAll with the ASYNC option, which empties the
+// databases without reading them first.
+func (c *Client) FlushAllAsync() error {
+	return c.doOK("FLUSHALL", "ASYNC")
+}
+
+// FlushDBAsync is FlushDB with the ASYNC option.
+func (c *Client) FlushDBAsync() error {
+	return c.doOK("FLUSHDB", "ASYNC")
+}
+
+// Rename moves a key, replacing any value at the destination.
+func (c *Client) Rename(src, dst string) error {
+	return c.doOK("RENAME", src, dst)
+}
+
+// RenameNX moves a key, unless the destination exists. It reports whether it
+// moved the key.
+func (c *Client) RenameNX(src, dst string) (bool, error) {
+	n, err := c.doInt("RENAMENX", src, dst)
+	return n == 1, err
+}
+
+// Copy copies a key, replacing the destination only if replace is set. It
+// reports whether it copied the key.
+func (c *Client) Copy(src, dst string, replace bool) (bool, error) {
+	args := []any{src, dst}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	n, err := c.doInt("COPY", args...)
+	return n == 1, err
+}
+
+// Eval runs a Lua script with the given keys and arguments, returning its
+// reply as decoded by the connection: integers are int64, strings are
+// []byte, arrays are []any, and null is nil.
+func (c *Client) Eval(script string, keys []string, args ...any) (any, error) {
+	return c.eval("EVAL", script, keys, args)
+}
+
+// EvalSha runs a script loaded with ScriptLoad (or run before with Eval) by
+// its SHA1 digest.
+func (c *Client) EvalSha(sha string, keys []string, args ...any) (any, error) {
+	return c.eval("EVALSHA", sha, keys, args)
+}
+
+func (c *Client) eval(cmd, script string, keys []string, args []any) (any, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	all := make([]any, 0, 2+len(keys)+len(args))
+	all = append(all, script, len(keys))
+	for _, key := range keys {
+		all = append(all, key)
+	}
+	all = append(all, args...)
+	return c.conn.Do(cmd, all...)
+}
+
+// ScriptLoad caches a script for EvalSha without running it, and returns its
+// SHA1 digest.
+func (c *Client) ScriptLoad(script string) (string, error) {
+	return c.doBulk("SCRIPT", "LOAD", script)
+}
+
+// FunctionLoad loads a function library, replacing any library with the same
+// name only if replace is set, and returns the library's name.
+func (c *Client) FunctionLoad(code string, replace bool) (string, error) {
+	if replace {
+		return c.doBulk("FUNCTION", "LOAD", "REPLACE", code)
+	}
+	return c.doBulk("FUNCTION", "LOAD", code)
+}
+
+// FCall calls a function loaded with FunctionLoad. Its reply is decoded like
+// Eval's.
+func (c *Client) FCall(function string, keys []string, args ...any) (any, error) {
+	return c.eval("FCALL", function, keys, args)
+}
+
+// FunctionDump returns a serialized copy of every function library, for
+// FunctionRestore.
+func (c *Client) FunctionDump() (string, error) {
+	return c.doBulk("FUNCTION", "DUMP")
+}
+
+// FunctionRestore loads the libraries in a FunctionDump payload. It fails if
+// any of them are already loaded.
+func (c *Client) FunctionRestore(payload string) error {
+	return c.doOK("FUNCTION", "RESTORE", payload)
+}
+
+// ObjectEncoding returns the encoding Valkey would use for a key's value. It
+// returns ErrNotFound if the key doesn't exist.
+func (c *Client) ObjectEncoding(key string) (string, error) {
+	return c.doBulk("OBJECT", "ENCODING", key)
+}
+
+// ObjectIdleTime returns how long ago the server last used a key, to the
+// second.
+func (c *Client) ObjectIdleTime(key string) (time.Duration, error) {
+	n, err := c.doInt("OBJECT", "IDLETIME", key)
+	return time.Duration(n) * time.Second, err
+}
+
+// ObjectFreq returns a key's logarithmic access counter.
+func (c *Client) ObjectFreq(key string) (int, error) {
+	return c.doInt("OBJECT", "FREQ", key)
+}
+
+// Select switches the connection to another logical database.
+func (c *Client) Select(n int) error {
+	return c.doOK("SELECT", n)
+}
+
+// Exists returns how many of the keys exist. Keys mentioned more than once
+// are counted each time.
+func (c *Client) Exists(keys ...string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	res, err := c.conn.Do("EXISTS", args...)
+	if err != nil {
+		return 0, err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected exists response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return int(r), nil
+}
+
+// Type returns the type of a key's value, or "none" if the key doesn't
+// exist.
+func (c *Client) Type(key string) (string, error) {
+	if c.connErr != nil {
+		return "", fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("TYPE", key)
+	if err != nil {
+		return "", err
+	}
+	r, ok := res.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected type response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return "", fmt.Errorf("conn unusable: %w", err)
+	}
+	return r, nil
+}
+
+// Dump returns a key's value serialized by DUMP, which Restore accepts.
+func (c *Client) Dump(key string) ([]byte, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("DUMP", key)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrNotFound
+	}
+	r, ok := res.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected dump response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return r, nil
+}
+
+// Restore creates a key from a value serialized by Dump, with a TTL unless
+// ttl is zero. With replace, it overwrites an existing key.
+func (c *Client) Restore(key string, ttl time.Duration, payload []byte, replace bool) error {
+	args := []any{key, ttl.Milliseconds(), payload}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	return c.doOK("RESTORE", args...)
+}
+
+// DBSize returns the number of keys in the database.
+func (c *Client) DBSize() (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("DBSIZE")
+	if err != nil {
+		return 0, err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected dbsize response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return int(r), nil
+}
+
+// Info returns the fields reported by INFO, optionally limited to some
+// sections, keyed by field name.
+func (c *Client) Info(sections ...string) (map[string]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, len(sections))
+	for i, section := range sections {
+		args[i] = section
+	}
+	res, err := c.conn.Do("INFO", args...)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := res.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected info response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	fields := make(map[string]string)
+	for line := range strings.Lines(string(r)) {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, val, ok := strings.Cut(line, ":"); ok {
+			fields[name] = val
+		}
+	}
+	return fields, nil
+}
+
+// ClientID returns the server's ID for this connection.
+func (c *Client) ClientID() (int, error) {
+	return c.doInt("CLIENT", "ID")
+}
+
+// ClientList returns the server's description of its open connections, one
+// per line.
+func (c *Client) ClientList() (string, error) {
+	return c.doBulk("CLIENT", "LIST")
+}
+
+// ClientKill closes the connection with the given ID, returning the number
+// of connections closed.
+func (c *Client) ClientKill(id int) (int, error) {
+	return c.doInt("CLIENT", "KILL", "ID", id)
+}
+
+// SessionToken returns a token describing the connection's state, which
+// Resume restores on another connection.
+func (c *Client) SessionToken() (string, error) {
+	return c.doBulk("RESUME")
+}
+
+// Resume restores the connection state described by a token from
+// SessionToken, which may have come from a connection to another node.
+func (c *Client) Resume(token string) error {
+	return c.doOK("RESUME", token)
+}
+
+// HSet sets fields in the hash stored at key, creating it if necessary, and
+// returns the number of fields that were added rather than updated.
+func (c *Client) HSet(key string, fields map[string]string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 1+2*len(fields))
+	args = append(args, key)
+	for field, val := range fields {
+		args = append(args, field, val)
+	}
+	return c.doInt("HSET", args...)
+}
+
+// HGet returns the value of a field in the hash stored at key. If the key or
+// field doesn't exist, it returns ErrNotFound.
+func (c *Client) HGet(key, field string) (string, error) {
+	if c.connErr != nil {
+		return "", fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("HGET", key, field)
+	if err != nil {
+		return "", err
+	}
+	if res == nil {
+		return "", ErrNotFound
+	}
+	r, ok := res.([]byte)
+	if !ok {
+		return "", fmt.Errorf("unexpected hget response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return "", fmt.Errorf("conn unusable: %w", err)
+	}
+	return string(r), nil
+}
+
+// HDel removes fields from the hash stored at key and returns the number
+// removed.
+func (c *Client) HDel(key string, fields ...string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 1+len(fields))
+	args = append(args, key)
+	for _, field := range fields {
+		args = append(args, field)
+	}
+	return c.doInt("HDEL", args...)
+}
+
+// HGetAll returns every field in the hash stored at key. Missing keys are
+// empty hashes.
+func (c *Client) HGetAll(key string) (map[string]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs)%2 != 0 {
+		return nil, fmt.Errorf("unexpected hgetall response: %v", res)
+	}
+	hash := make(map[string]string, len(rs)/2)
+	for i := 0; i < len(rs); i += 2 {
+		field, ok1 := rs[i].([]byte)
+		val, ok2 := rs[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("unexpected hgetall element types: %T, %T", rs[i], rs[i+1])
+		}
+		hash[string(field)] = string(val)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return hash, nil
+}
+
+// HExists reports whether a field exists in the hash stored at key.
+func (c *Client) HExists(key, field string) (bool, error) {
+	if c.connErr != nil {
+		return false, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	n, err := c.doInt("HEXISTS", key, field)
+	return n == 1, err
+}
+
+// HLen returns the number of fields in the hash stored at key.
+func (c *Client) HLen(key string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("HLEN", key)
+}
+
+// LPush inserts values at the head of the list stored at key, creating it if
+// necessary, and returns the list's new length. The values are inserted one
+// after another, so the last ends up first.
+func (c *Client) LPush(key string, values ...string) (int, error) {
+	return c.push("LPUSH", key, values)
+}
+
+// RPush appends values to the list stored at key, creating it if necessary,
+// and returns the list's new length.
+func (c *Client) RPush(key string, values ...string) (int, error) {
+	return c.push("RPUSH", key, values)
+}
+
+func (c *Client) push(cmd, key string, values []string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt(cmd, keyArgs(key, values)...)
+}
+
+// LPop removes and returns the first element of the list stored at key. If the
+// list is empty, it returns ErrNotFound.
+func (c *Client) LPop(key string) (string, error) {
+	return c.doBulk("LPOP", key)
+}
+
+// RPop removes and returns the last element of the list stored at key. If the
+// list is empty, it returns ErrNotFound.
+func (c *Client) RPop(key string) (string, error) {
+	return c.doBulk("RPOP", key)
+}
+
+// LLen returns the length of the list stored at key.
+func (c *Client) LLen(key string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("LLEN", key)
+}
+
+// LRange returns the elements of the list stored at key between the inclusive
+// offsets start and stop. Negative offsets count from the end of the list, so
+// LRange(key, 0, -1) returns the whole list.
+func (c *Client) LRange(key string, start, stop int) ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("LRANGE", key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected lrange response type: %T", res)
+	}
+	vals := make([]string, len(rs))
+	for i, r := range rs {
+		b, ok := r.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected lrange element type: %T", r)
+		}
+		vals[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return vals, nil
+}
+
+// SAdd adds members to the set stored at key, creating it if necessary, and
+// returns the number of members that weren't already in the set.
+func (c *Client) SAdd(key string, members ...string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("SADD", keyArgs(key, members)...)
+}
+
+// SRem removes members from the set stored at key and returns the number of
+// members removed.
+func (c *Client) SRem(key string, members ...string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("SREM", keyArgs(key, members)...)
+}
+
+// SMembers returns the members of the set stored at key, sorted.
+func (c *Client) SMembers(key string) ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected smembers response type: %T", res)
+	}
+	members := make([]string, len(rs))
+	for i, r := range rs {
+		b, ok := r.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected smembers element type: %T", r)
+		}
+		members[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return members, nil
+}
+
+// SIsMember reports whether member is in the set stored at key.
+func (c *Client) SIsMember(key, member string) (bool, error) {
+	if c.connErr != nil {
+		return false, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	n, err := c.doInt("SISMEMBER", key, member)
+	return n == 1, err
+}
+
+// SCard returns the number of members in the set stored at key.
+func (c *Client) SCard(key string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("SCARD", key)
+}
+
+// ZMember is a member of a sorted set and its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd adds members to the sorted set stored at key, creating it if
+// necessary, and returns the number of members that weren't already in the
+// set. The scores of existing members are updated.
+func (c *Client) ZAdd(key string, members ...ZMember) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 1+2*len(members))
+	args = append(args, key)
+	for _, m := range members {
+		args = append(args, strconv.FormatFloat(m.Score, 'g', -1, 64), m.Member)
+	}
+	return c.doInt("ZADD", args...)
+}
+
+// ZRem removes members from the sorted set stored at key and returns the
+// number of members removed.
+func (c *Client) ZRem(key string, members ...string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("ZREM", keyArgs(key, members)...)
+}
+
+// ZScore returns the score of a member of the sorted set stored at key. If
+// the member isn't in the set, it returns ErrNotFound.
+func (c *Client) ZScore(key, member string) (float64, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("ZSCORE", key, member)
+	if err != nil {
+		return 0, err
+	}
+	if res == nil {
+		return 0, ErrNotFound
+	}
+	r, ok := res.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("unexpected zscore response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return strconv.ParseFloat(string(r), 64)
+}
+
+// ZCard returns the number of members in the sorted set stored at key.
+func (c *Client) ZCard(key string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("ZCARD", key)
+}
+
+// ZRange returns the members of the sorted set stored at key between the
+// inclusive offsets start and stop, ordered by score. Negative offsets count
+// from the end of the set, so ZRange(key, 0, -1) returns the whole set.
+func (c *Client) ZRange(key string, start, stop int) ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("ZRANGE", key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected zrange response type: %T", res)
+	}
+	members := make([]string, len(rs))
+	for i, r := range rs {
+		b, ok := r.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected zrange element type: %T", r)
+		}
+		members[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return members, nil
+}
+
+// ZRangeByScore returns the members of the sorted set stored at key with
+// scores between min and max, inclusive, ordered by score. Either bound may
+// be infinite.
+func (c *Client) ZRangeByScore(key string, min, max float64) ([]ZMember, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("ZRANGE", key,
+		strconv.FormatFloat(min, 'g', -1, 64),
+		strconv.FormatFloat(max, 'g', -1, 64),
+		"BYSCORE", "WITHSCORES",
+	)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs)%2 != 0 {
+		return nil, fmt.Errorf("unexpected zrange response: %v", res)
+	}
+	members := make([]ZMember, 0, len(rs)/2)
+	for i := 0; i < len(rs); i += 2 {
+		member, ok1 := rs[i].([]byte)
+		score, ok2 := rs[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("unexpected zrange element types: %T, %T", rs[i], rs[i+1])
+		}
+		f, err := strconv.ParseFloat(string(score), 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected zrange score: %v", err)
+		}
+		members = append(members, ZMember{string(member), f})
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return members, nil
+}
+
+// keyArgs returns a key followed by values as command arguments.
+func keyArgs(key string, values []string) []any {
+	args := make([]any, 0, 1+len(values))
+	args = append(args, key)
+	for _, val := range values {
+		args = append(args, val)
+	}
+	return args
+}
+
+// doOK runs a command that replies with OK.
+func (c *Client) doOK(cmd string, args ...any) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do(cmd, args...)
+	if err != nil {
+		return err
+	}
+	if r, ok := res.(string); !ok || r != "OK" {
+		return fmt.Errorf("unexpected %s response: %v", strings.ToLower(cmd), res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// doInt runs a command that replies with an integer.
+func (c *Client) doInt(cmd string, args ...any) (int, error) {
+	res, err := c.conn.Do(cmd, args...)
+	if err != nil {
+		return 0, err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected %s response type: %T", strings.ToLower(cmd), res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return int(r), nil
+}
+
+// doBulk runs a command that replies with a bulk string or, if there's
+// nothing to return, null.
+func (c *Client) doBulk(cmd string, args ...any) (string, error) {
+	if c.connErr != nil {
+		return "", fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do(cmd, args...)
+	if err != nil {
+		return "", err
+	}
+	if res == nil {
+		return "", ErrNotFound
+	}
+	r, ok := res.([]byte)
+	if !ok {
+		return "", fmt.Errorf("unexpected %s response type: %T", strings.ToLower(cmd), res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return "", fmt.Errorf("conn unusable: %w", err)
+	}
+	return string(r), nil
+}
+
+// Keys returns every key matching a glob-style pattern, sorted. It reads the
+// whole database at once, so Scan is a better fit for large databases.
+func (c *Client) Keys(pattern string) ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("KEYS", pattern)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected keys response type: %T", res)
+	}
+	keys := make([]string, len(rs))
+	for i, r := range rs {
+		b, ok := r.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected keys element type: %T", r)
+		}
+		keys[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return keys, nil
+}
+
+// A KeyValue is a key and its string value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Range returns the string keys from start (inclusive) to end (exclusive),
+// and their values, in lexicographic order of the keys. An empty end is
+// unbounded. If limit is positive, Range returns at most that many keys.
+func (c *Client) Range(start, end string, limit int) ([]KeyValue, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := []any{start, end}
+	if limit > 0 {
+		args = append(args, "LIMIT", limit)
+	}
+	res, err := c.conn.Do("RANGE", args...)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs)%2 != 0 {
+		return nil, fmt.Errorf("unexpected range response: %v", res)
+	}
+	kvs := make([]KeyValue, 0, len(rs)/2)
+	for i := 0; i < len(rs); i += 2 {
+		key, ok1 := rs[i].([]byte)
+		val, ok2 := rs[i+1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("unexpected range element types: %T, %T", rs[i], rs[i+1])
+		}
+		kvs = append(kvs, KeyValue{string(key), string(val)})
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return kvs, nil
+}
+
+// Scan iterates over the keys matching a glob-style pattern, fetching them
+// from the server a page at a time. Keys that exist for the whole scan are
+// yielded exactly once. Iteration stops after the first error.
+func (c *Client) Scan(match string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		var cursor uint64
+		for {
+			keys, next, err := c.scanPage(cursor, match)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, key := range keys {
+				if !yield(key, nil) {
+					return
+				}
+			}
+			if next == 0 {
+				return
+			}
+			cursor = next
+		}
+	}
+}
+
+func (c *Client) scanPage(cursor uint64, match string) ([]string, uint64, error) {
+	if c.connErr != nil {
+		return nil, 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("SCAN", cursor, "MATCH", match)
+	if err != nil {
+		return nil, 0, err
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs) != 2 {
+		return nil, 0, fmt.Errorf("unexpected scan response: %v", res)
+	}
+	raw, ok := rs[0].([]byte)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected scan cursor type: %T", rs[0])
+	}
+	next, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected scan cursor: %w", err)
+	}
+	ks, ok := rs[1].([]any)
+	if !ok {
+		return nil, 0, fmt.Errorf("unexpected scan keys type: %T", rs[1])
+	}
+	keys := make([]string, len(ks))
+	for i, k := range ks {
+		b, ok := k.([]byte)
+		if !ok {
+			return nil, 0, fmt.Errorf("unexpected scan key type: %T", k)
+		}
+		keys[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return keys, next, nil
+}
+
+// Generation returns the database's generation, which increases with every
+// write.
+func (c *Client) Generation() (uint64, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("GENERATION")
+	if err != nil {
+		return 0, err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected generation response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return uint64(r), nil
+}
+
+// Wait blocks until the client's earlier writes have reached the given
+// number of replicas, or until the timeout passes, and returns the number
+// that acknowledged them. A timeout of zero waits forever. Valthree
+// acknowledges writes only once they're durable, but primaries don't know
+// which replicas have seen them, so it never waits and always returns 0.
+func (c *Client) Wait(replicas int, timeout time.Duration) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("WAIT", replicas, timeout.Milliseconds())
+}
+
+// ConfigSet changes a server setting on the node the client is connected
+// to.
+func (c *Client) ConfigSet(param, value string) error {
+	return c.doOK("CONFIG", "SET", param, value)
+}
+
+// Invalidate makes every node in the cluster drop its caches, which is
+// necessary after something other than Valthree modifies the bucket.
+func (c *Client) Invalidate() error {
+	return c.doOK("INVALIDATE")
+}
+
+// BgSave makes the server snapshot the database in the background.
+func (c *Client) BgSave() error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("BGSAVE")
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(string); !ok {
+		return fmt.Errorf("unexpected bgsave response: %v", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// LastSave returns the time of the last snapshot the server took, or the
+// zero time if it hasn't taken one.
+func (c *Client) LastSave() (time.Time, error) {
+	if c.connErr != nil {
+		return time.Time{}, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	n, err := c.doInt("LASTSAVE")
+	if err != nil || n == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(n), 0), nil
+}
+
+// Snapshots returns the IDs of the database's snapshots, oldest first.
+func (c *Client) Snapshots() ([]string, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("SNAPSHOT", "LIST")
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected snapshot list response type: %T", res)
+	}
+	ids := make([]string, len(rs))
+	for i, r := range rs {
+		b, ok := r.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected snapshot list element type: %T", r)
+		}
+		ids[i] = string(b)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return ids, nil
+}
+
+// GetAt returns the value a key held in a snapshot. If the key didn't exist
+// then, GetAt returns ErrNotFound.
+func (c *Client) GetAt(key, snapshot string) (string, error) {
+	return c.doBulk("GETAT", key, snapshot)
+}
+
+// PinSnapshot makes the connection's reads see a snapshot rather than the
+// live database, until UnpinSnapshot. Writes fail while it's pinned.
+func (c *Client) PinSnapshot(snapshot string) error {
+	return c.doOK("SNAPSHOT", "PIN", snapshot)
+}
+
+// UnpinSnapshot returns the connection to the live database.
+func (c *Client) UnpinSnapshot() error {
+	return c.doOK("SNAPSHOT", "UNPIN")
+}
+
+// VGet returns the value of a single key along with its version, which
+// changes whenever the value does.
+func (c *Client) VGet(key string) (string, uint64, error) {
+	if c.connErr != nil {
+		return "", 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("VGET", key)
+	if err != nil {
+		return "", 0, err
+	}
+	if res == nil {
+		return "", 0, ErrNotFound
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs) != 2 {
+		return "", 0, fmt.Errorf("unexpected vget response: %v", res)
+	}
+	val, ok := rs[0].([]byte)
+	if !ok {
+		return "", 0, fmt.Errorf("unexpected vget value type: %T", rs[0])
+	}
+	version, ok := rs[1].(int64)
+	if !ok {
+		return "", 0, fmt.Errorf("unexpected vget version type: %T", rs[1])
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return "", 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return string(val), uint64(version), nil
+}
+
+// VSet sets a key only if its version matches the supplied one, returning the
+// new version. Version 0 sets the key only if it doesn't exist. If the version
+// doesn't match, VSet returns ErrVersionMismatch.
+func (c *Client) VSet(key string, version uint64, value string) (uint64, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("VSET", key, version, value)
+	if err != nil {
+		return 0, err
+	}
+	if res == nil {
+		return 0, ErrVersionMismatch
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected vset response type: %T", res)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return uint64(r), nil
+}
+
+// Lock acquires or extends a lease on the named lock, returning the lease's
+// fencing token.
+func (c *Client) Lock(name, owner string, ttl time.Duration) (uint64, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("LOCK", name, owner, ttl.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	if res == nil {
+		return 0, ErrLocked
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected lock response type: %T", res)
+	}
+	if r <= 0 {
+		return 0, fmt.Errorf("unexpected fencing token: %d", r)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return 0, fmt.Errorf("conn unusable: %w", err)
+	}
+	return uint64(r), nil
+}
+
+// Unlock releases a lease on the named lock. If the owner doesn't hold an
+// unexpired lease, it returns ErrNotFound.
+func (c *Client) Unlock(name, owner string) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	res, err := c.conn.Do("UNLOCK", name, owner)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(int64)
+	if !ok {
+		return fmt.Errorf("unexpected unlock response type: %T", res)
+	}
+	if r == 0 {
+		return ErrNotFound
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// Load populates an empty database with the supplied items in a single
+// write. It fails if the database already exists.
+func (c *Client) Load(items map[string]string) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 2*len(items))
+	for key, val := range items {
+		args = append(args, key, val)
+	}
+	res, err := c.conn.Do("LOAD", args...)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(string)
+	if !ok {
+		return fmt.Errorf("unexpected load response type: %T", res)
+	}
+	if r != "OK" {
+		return fmt.Errorf("unexpected load response: %s", r)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// A LoadItem is a key for LoadIf to set, if its current version is Version.
+// Version 0 means that the key must not exist.
+type LoadItem struct {
+	Key     string
+	Version uint64
+	Value   string
+}
+
+// LoadIf sets each key whose current version matches, skipping the others,
+// and returns the current versions of the skipped keys. Unlike Load, it works
+// on databases that already have keys, so migrations that use it can safely
+// run again.
+func (c *Client) LoadIf(items ...LoadItem) (map[string]uint64, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, 0, 3*len(items))
+	for _, item := range items {
+		args = append(args, item.Key, item.Version, item.Value)
+	}
+	res, err := c.conn.Do("LOADIF", args...)
+	if err != nil {
+		return nil, err
+	}
+	rs, ok := res.([]any)
+	if !ok || len(rs)%2 != 0 {
+		return nil, fmt.Errorf("unexpected loadif response: %v", res)
+	}
+	conflicts := make(map[string]uint64, len(rs)/2)
+	for i := 0; i < len(rs); i += 2 {
+		key, ok1 := rs[i].([]byte)
+		version, ok2 := rs[i+1].(int64)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("unexpected loadif element types: %T, %T", rs[i], rs[i+1])
+		}
+		conflicts[string(key)] = uint64(version)
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return conflicts, nil
+}
+
+// Watch makes the next Exec fail with ErrAborted if any of the keys is
+// written in the meantime.
+func (c *Client) Watch(keys ...string) error {
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	return c.doOK("WATCH", args...)
+}
+
+// Unwatch forgets every watched key.
+func (c *Client) Unwatch() error {
+	return c.doOK("UNWATCH")
+}
+
+// A Command is a command to run in a transaction.
+type Command struct {
+	Name string
+	Args []any
+}
+
+// Exec runs the commands atomically, between MULTI and EXEC, and returns
+// their replies. Commands that fail don't stop the others, so their replies
+// are redis.Errors. If a watched key changed, Exec runs nothing and returns
+// ErrAborted. Either way, every key is unwatched afterwards.
+func (c *Client) Exec(cmds ...Command) ([]any, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	if err := c.conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := c.conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return nil, err
+		}
+	}
+	// Do reads the replies to MULTI and the queued commands too, returning
+	// the first error among them.
+	res, err := c.conn.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, ErrAborted
+	}
+	r, ok := res.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected exec response type: %T", res)
+	}
+	if len(r) != len(cmds) {
+		return nil, fmt.Errorf("unexpected exec response length: %d", len(r))
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return nil, fmt.Errorf("conn unusable: %w", err)
+	}
+	return r, nil
+}
+
+// Pipeline sends all the commands before reading any replies, saving a round
+// trip per command. Unlike Exec, the commands aren't atomic: other clients'
+// commands may run in between. Commands that fail don't stop the others, so
+// their replies are redis.Errors. If the connection fails partway, Pipeline
+// returns the replies it read before the error.
+func (c *Client) Pipeline(cmds ...Command) ([]any, error) {
+	if c.connErr != nil {
+		return nil, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	for _, cmd := range cmds {
+		if err := c.conn.Send(cmd.Name, cmd.Args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, 0, len(cmds))
+	var err error
+	for range cmds {
+		var res any
+		res, err = c.conn.Receive()
+		var rerr redis.Error
+		if errors.As(err, &rerr) {
+			res, err = rerr, nil
+		}
+		if err != nil {
+			break
+		}
+		replies = append(replies, res)
+	}
+	if cerr := c.conn.Err(); cerr != nil {
+		c.connErr = cerr
+		_ = c.conn.Close()
+		return replies, fmt.Errorf("conn unusable: %w", cerr)
+	}
+	return replies, err
+}
+
+// Publish sends a message to a channel, returning the number of subscribers
+// on the server's node that received it. Subscribers on other nodes receive
+// it too, but they aren't counted.
+func (c *Client) Publish(channel, message string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("PUBLISH", channel, message)
+}
+
+// Subscribe subscribes to channels. Afterwards, the client can only receive
+// messages with Receive; other commands fail.
+func (c *Client) Subscribe(channels ...string) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, len(channels))
+	for i, channel := range channels {
+		args[i] = channel
+	}
+	psc := redis.PubSubConn{Conn: c.conn}
+	if err := psc.Subscribe(args...); err != nil {
+		return err
+	}
+	for range channels {
+		switch r := psc.Receive().(type) {
+		case redis.Subscription:
+		case error:
+			return r
+		default:
+			return fmt.Errorf("unexpected subscribe response type: %T", r)
+		}
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// SPublish sends a message to a shard channel, returning the number of
+// subscribers that received it. In cluster mode, the server's node must own
+// the channel's hash slot.
+func (c *Client) SPublish(channel, message string) (int, error) {
+	if c.connErr != nil {
+		return 0, fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	return c.doInt("SPUBLISH", channel, message)
+}
+
+// SSubscribe subscribes to shard channels, which must share a hash slot.
+// Afterwards, the client can only receive messages with Receive; other
+// commands fail.
+func (c *Client) SSubscribe(channels ...string) error {
+	if c.connErr != nil {
+		return fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	args := make([]any, len(channels))
+	for i, channel := range channels {
+		args[i] = channel
+	}
+	// redigo's PubSubConn doesn't know sharded pub/sub, so the replies are
+	// read directly.
+	if err := c.conn.Send("SSUBSCRIBE", args...); err != nil {
+		return err
+	}
+	if err := c.conn.Flush(); err != nil {
+		return err
+	}
+	for range channels {
+		reply, err := redis.Values(c.conn.Receive())
+		if err != nil {
+			return err
+		}
+		var kind, channel string
+		var count int
+		if _, err := redis.Scan(reply, &kind, &channel, &count); err != nil || len(reply) != 3 || kind != "ssubscribe" {
+			return fmt.Errorf("unexpected ssubscribe response: %v", reply)
+		}
+	}
+	if err := c.conn.Err(); err != nil {
+		c.connErr = err
+		_ = c.conn.Close()
+		return fmt.Errorf("conn unusable: %w", err)
+	}
+	return nil
+}
+
+// Receive waits up to timeout for a message on a subscribed channel or shard
+// channel, returning the channel and the message.
+func (c *Client) Receive(timeout time.Duration) (string, string, error) {
+	if c.connErr != nil {
+		return "", "", fmt.Errorf("conn unusable: %w", c.connErr)
+	}
+	reply, err := redis.Strings(redis.ReceiveWithTimeout(c.conn, timeout))
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case len(reply) == 3 && (reply[0] == "message" || reply[0] == "smessage"):
+		return reply[1], reply[2], nil
+	case len(reply) == 4 && reply[0] == "pmessage":
+		return reply[2], reply[3], nil
+	default:
+		return "", "", fmt.Errorf("unexpected receive response: %v", reply)
+	}
+}
+
 // Close the underlying connection.
 func (c *Client) Close() error {
 	if c.connErr != nil {
@@ -0,0 +1,176 @@
+// Package conformance checks that a server speaks RESP byte for byte the way
+// Valkey clients expect. A corpus of scripts, one conversation per file, sends
+// raw bytes over a real socket and asserts on the exact bytes of the replies,
+// so that it catches regressions in framing, error messages, and connection
+// handling that tests using a client library would paper over.
+//
+// Scripts are text files with one step per line:
+//
+//	# Comments and blank lines are ignored.
+//	send "*1\r\n$4\r\nPING\r\n"
+//	want "+PONG\r\n"
+//	send "$1048576\r\n" 1048576*"x" "\r\n"
+//	eof
+//	want closed
+//
+// send writes bytes to the server, and want reads exactly the given bytes
+// back. Both take one or more Go string literals, which are concatenated; a
+// literal prefixed with N* is repeated N times. eof closes the client's side
+// of the connection, and "want closed" expects the server to close its side.
+// Once a script finishes, the server must have nothing more to say.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+// timeout bounds each read, so that a server that doesn't reply fails the
+// script rather than hanging it.
+const timeout = 5 * time.Second
+
+// quiet is how long the server must stay silent at the end of a script.
+const quiet = 50 * time.Millisecond
+
+// A Script is one conversation with the server.
+type Script struct {
+	Name  string
+	Steps []Step
+}
+
+// A Step is one line of a Script.
+type Step struct {
+	Line int
+	Op   string // "send", "want", "eof", or "closed"
+	Data []byte // for send and want
+}
+
+// Load parses every script in dir, in lexical order of their file names.
+func Load(dir string) ([]Script, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.resp"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no scripts in %s", dir)
+	}
+	scripts := make([]Script, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		script, err := Parse(strings.TrimSuffix(filepath.Base(path), ".resp"), f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// Parse parses a script.
+func Parse(name string, r io.Reader) (Script, error) {
+	script := Script{Name: name}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		op, rest, _ := strings.Cut(line, " ")
+		step := Step{Line: n, Op: op}
+		switch {
+		case op == "eof" && rest == "":
+		case op == "want" && rest == "closed":
+			step.Op = "closed"
+		case op == "send" || op == "want":
+			data, err := parseData(rest)
+			if err != nil {
+				return Script{}, fmt.Errorf("%s:%d: %v", name, n, err)
+			}
+			step.Data = data
+		default:
+			return Script{}, fmt.Errorf("%s:%d: invalid step %q", name, n, line)
+		}
+		script.Steps = append(script.Steps, step)
+	}
+	if err := sc.Err(); err != nil {
+		return Script{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return script, nil
+}
+
+// parseData parses the arguments of send and want: Go string literals, each
+// optionally prefixed with a repeat count like 1024*.
+func parseData(s string) ([]byte, error) {
+	var b bytes.Buffer
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		repeat := 1
+		if count, rest, ok := strings.Cut(s, "*"); ok && !strings.ContainsAny(count, `"`+"`") {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid repeat count %q", count)
+			}
+			repeat, s = n, rest
+		}
+		lit, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string literal at %q", s)
+		}
+		str, _ := strconv.Unquote(lit) // valid, since QuotedPrefix found it
+		b.WriteString(strings.Repeat(str, repeat))
+		s = s[len(lit):]
+	}
+	if b.Len() == 0 {
+		return nil, errors.New("no data")
+	}
+	return b.Bytes(), nil
+}
+
+// Run plays the script against the server at addr on a new connection.
+func (s Script) Run(tb testing.TB, addr net.Addr) {
+	tb.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	attest.Ok(tb, err, attest.Sprint("dial server"))
+	defer conn.Close()
+
+	for _, step := range s.Steps {
+		at := attest.Sprintf("%s:%d", s.Name, step.Line)
+		switch step.Op {
+		case "send":
+			_, err := conn.Write(step.Data)
+			attest.Ok(tb, err, at)
+		case "eof":
+			attest.Ok(tb, conn.(*net.TCPConn).CloseWrite(), at)
+		case "want":
+			got := make([]byte, len(step.Data))
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := io.ReadFull(conn, got)
+			attest.Ok(tb, err, attest.Sprintf("%s:%d: read %q so far", s.Name, step.Line, got[:n]))
+			attest.Equal(tb, string(got), string(step.Data), at)
+		case "closed":
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			extra, err := io.ReadAll(conn)
+			attest.Ok(tb, err, attest.Sprintf("%s:%d: want closed", s.Name, step.Line))
+			attest.Equal(tb, string(extra), "", at)
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(quiet))
+	extra, _ := io.ReadAll(conn)
+	attest.Equal(tb, string(extra), "", attest.Sprintf("%s: unexpected bytes after the last step", s.Name))
+}
@@ -0,0 +1,40 @@
+package conformance
+
+import (
+	"strings"
+	"testing"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestParse(t *testing.T) {
+	script, err := Parse("test", strings.NewReader(`# comment
+
+send "*1\r\n" "$4\r\nPING\r\n"
+want 3*"ab" "\r\n"
+eof
+want closed
+`))
+	attest.Ok(t, err)
+	attest.Equal(t, script, Script{
+		Name: "test",
+		Steps: []Step{
+			{Line: 3, Op: "send", Data: []byte("*1\r\n$4\r\nPING\r\n")},
+			{Line: 4, Op: "want", Data: []byte("ababab\r\n")},
+			{Line: 5, Op: "eof"},
+			{Line: 6, Op: "closed"},
+		},
+	})
+
+	for _, bad := range []string{
+		`send`,
+		`send PING`,
+		`send "unterminated`,
+		`want x*"a"`,
+		`recv "a"`,
+		`eof now`,
+	} {
+		_, err := Parse("test", strings.NewReader(bad))
+		attest.Error(t, err, attest.Sprintf("parse %q", bad))
+	}
+}
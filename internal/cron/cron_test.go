@@ -0,0 +1,47 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestNext(t *testing.T) {
+	start := time.Date(2025, time.January, 31, 23, 59, 30, 0, time.UTC) // a Friday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2025, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"*/15 9-17 * * 1-5", time.Date(2025, time.February, 3, 9, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)}, // day of month OR day of week
+		{"@every 10m", time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			attest.Ok(t, err)
+			attest.Equal(t, s.Next(start), tt.want)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* * 0 * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@every 1ms",
+		"@every soon",
+	} {
+		_, err := Parse(expr)
+		attest.Error(t, err, attest.Sprintf("parse %q", expr))
+	}
+}
@@ -0,0 +1,82 @@
+// Package dump reads and writes the data formats of Redis and Valkey, so
+// that data can move between them and Valthree: RDB files, which are their
+// snapshots, and streams of RESP commands, like append-only files.
+//
+// Only the data types Valthree supports can be converted. Keys are always in
+// database 0.
+package dump
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/set"
+)
+
+// Value types, as TYPE reports them.
+const (
+	TypeString = "string"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+	TypeHash   = "hash"
+)
+
+var errCorrupt = errors.New("corrupt or truncated data")
+
+// An Entry is a key and its value. Only the field for the entry's type is
+// set.
+type Entry struct {
+	Key    string
+	Type   string
+	String string
+	List   []string
+	Set    set.Set[string]
+	ZSet   map[string]float64 // members and their scores
+	Hash   map[string]string
+	// ExpireAt is when the key expires, or the zero time if it doesn't.
+	ExpireAt time.Time
+}
+
+// A ZMember is a member of a sorted set and its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// SortedZSet returns the members of a sorted set in order, by score and then
+// by member.
+func (e Entry) SortedZSet() []ZMember {
+	members := make([]ZMember, 0, len(e.ZSet))
+	for m, score := range e.ZSet {
+		members = append(members, ZMember{m, score})
+	}
+	slices.SortFunc(members, func(a, b ZMember) int {
+		return cmp.Or(cmp.Compare(a.Score, b.Score), cmp.Compare(a.Member, b.Member))
+	})
+	return members
+}
+
+// formatScore formats a score the way Valkey does.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a score, which may be infinite but not NaN.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("score is not a valid float")
+	}
+	return score, nil
+}
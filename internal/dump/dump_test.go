@@ -0,0 +1,102 @@
+package dump
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/set"
+	"go.akshayshah.org/attest"
+)
+
+func testEntries() []Entry {
+	return []Entry{
+		{Key: "hash", Type: TypeHash, Hash: map[string]string{"f": "v", "g": ""}},
+		{Key: "list", Type: TypeList, List: []string{"b", "a", "b"}},
+		{Key: "set", Type: TypeSet, Set: set.New("x", "y")},
+		{Key: "str", Type: TypeString, String: "hello\r\n\x00", ExpireAt: time.UnixMilli(4102444800123)},
+		{Key: "zset", Type: TypeZSet, ZSet: map[string]float64{"lo": math.Inf(-1), "mid": 1.5, "hi": math.Inf(1)}},
+	}
+}
+
+func TestRDB(t *testing.T) {
+	var buf bytes.Buffer
+	attest.Ok(t, WriteRDB(&buf, testEntries()))
+	entries, err := ReadRDB(bytes.NewReader(buf.Bytes()))
+	attest.Ok(t, err)
+	attest.Equal(t, entries, testEntries())
+
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[20] ^= 1
+	_, err = ReadRDB(bytes.NewReader(corrupt))
+	attest.Error(t, err)
+	_, err = ReadRDB(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	attest.Error(t, err)
+}
+
+func TestRESP(t *testing.T) {
+	var buf bytes.Buffer
+	attest.Ok(t, WriteRESP(&buf, testEntries()))
+	entries, err := ReadRESP(bytes.NewReader(buf.Bytes()))
+	attest.Ok(t, err)
+	attest.Equal(t, entries, testEntries())
+
+	// An append-only file may start with an RDB preamble.
+	buf.Reset()
+	attest.Ok(t, WriteRDB(&buf, testEntries()))
+	buf.WriteString("*2\r\n$3\r\nDEL\r\n$4\r\nhash\r\n*3\r\n$5\r\nLPUSH\r\n$4\r\nlist\r\n$1\r\nc\r\n")
+	entries, err = ReadRESP(&buf)
+	attest.Ok(t, err)
+	want := testEntries()[1:]
+	want[0].List = []string{"c", "b", "a", "b"}
+	attest.Equal(t, entries, want)
+
+	_, err = ReadRESP(bytes.NewBufferString("*1\r\n$4\r\nPING\r\n"))
+	attest.Error(t, err)
+	_, err = ReadRESP(bytes.NewBufferString("*2\r\n$3\r\nGET\r\n"))
+	attest.Error(t, err)
+}
+
+func TestEncodings(t *testing.T) {
+	attest.Equal(t, crcUpdate(0, []byte("123456789")), uint64(0xe9c6d914c4b8d9ca))
+
+	header := make([]byte, 10)
+	vals, err := ziplist(append(header, 0, 2, 'a', 'b', 4, 0xf6, 2, 0xc0, 0xd4, 0xfe, 0xff))
+	attest.Ok(t, err)
+	attest.Equal(t, vals, []string{"ab", "5", "-300"})
+
+	vals, err = listpack(append(header[:6], 0x81, 'a', 2, 0x01, 1, 0xdf, 0xff, 2, 0xff))
+	attest.Ok(t, err)
+	attest.Equal(t, vals, []string{"a", "1", "-1"})
+	_, err = listpack(append(header[:6], 0x81, 'a'))
+	attest.Error(t, err)
+
+	vals, err = intset([]byte{2, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0xfe, 0xff})
+	attest.Ok(t, err)
+	attest.Equal(t, vals, []string{"1", "-2"})
+
+	out, err := lzfDecompress([]byte{0, 'a', 0xa0, 0}, 8)
+	attest.Ok(t, err)
+	attest.Equal(t, string(out), "aaaaaaaa")
+}
+
+func TestSerialize(t *testing.T) {
+	for _, want := range testEntries() {
+		want.Key, want.ExpireAt = "", time.Time{}
+		payload, err := Serialize(want)
+		attest.Ok(t, err)
+		got, err := Deserialize(payload)
+		attest.Ok(t, err)
+		attest.Equal(t, got, want)
+
+		payload[0] ^= 1
+		_, err = Deserialize(payload)
+		attest.Error(t, err)
+	}
+
+	// DUMP's output for the string "10", from the Redis documentation.
+	got, err := Deserialize([]byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb"))
+	attest.Ok(t, err)
+	attest.Equal(t, got, Entry{Type: TypeString, String: "10"})
+}
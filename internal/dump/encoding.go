@@ -0,0 +1,242 @@
+package dump
+
+import "strconv"
+
+// Redis and Valkey store small values in compact encodings: ziplists,
+// listpacks (which replaced ziplists in Redis 7.0), and intsets. RDB files
+// contain them verbatim, so reading an RDB file means decoding them.
+
+// ziplist decodes a ziplist's entries.
+func ziplist(b []byte) ([]string, error) {
+	c := cursor{b: b}
+	c.take(10) // total bytes, offset of the last entry, and number of entries
+	var vals []string
+	for c.err == nil {
+		if c.peek() == 0xff {
+			return vals, nil
+		}
+		// Each entry starts with the length of the previous one, in one or
+		// five bytes.
+		if prev := c.take(1); c.err == nil && prev[0] == 0xfe {
+			c.take(4)
+		}
+		enc := c.take(1)
+		if c.err != nil {
+			break
+		}
+		var n int
+		switch enc[0] >> 6 {
+		case 0:
+			n = int(enc[0] & 0x3f)
+		case 1:
+			n = int(enc[0]&0x3f)<<8 | int(c.byte())
+		case 2:
+			n = int(beUint(c.take(4)))
+		default:
+			vals = append(vals, ziplistInt(&c, enc[0]))
+			continue
+		}
+		vals = append(vals, string(c.take(n)))
+	}
+	return nil, errCorrupt
+}
+
+func ziplistInt(c *cursor, enc byte) string {
+	var size int
+	switch enc {
+	case 0xc0:
+		size = 2
+	case 0xd0:
+		size = 4
+	case 0xe0:
+		size = 8
+	case 0xf0:
+		size = 3
+	case 0xfe:
+		size = 1
+	default:
+		if enc < 0xf1 || enc > 0xfd {
+			c.err = errCorrupt
+			return ""
+		}
+		// The integers 0 to 12 are part of the encoding.
+		return strconv.Itoa(int(enc&0x0f) - 1)
+	}
+	return strconv.FormatInt(leInt(c.take(size)), 10)
+}
+
+// listpack decodes a listpack's entries.
+func listpack(b []byte) ([]string, error) {
+	c := cursor{b: b}
+	c.take(6) // total bytes and number of entries
+	var vals []string
+	for c.err == nil {
+		start := c.pos
+		enc := c.byte()
+		if c.err != nil {
+			break
+		}
+		var val string
+		switch {
+		case enc == 0xff:
+			return vals, nil
+		case enc&0x80 == 0:
+			val = strconv.Itoa(int(enc))
+		case enc&0xc0 == 0x80:
+			val = string(c.take(int(enc & 0x3f)))
+		case enc&0xe0 == 0xc0:
+			// A 13-bit signed integer.
+			n := int(enc&0x1f)<<8 | int(c.byte())
+			if n >= 1<<12 {
+				n -= 1 << 13
+			}
+			val = strconv.Itoa(n)
+		case enc&0xf0 == 0xe0:
+			val = string(c.take(int(enc&0x0f)<<8 | int(c.byte())))
+		case enc == 0xf0:
+			val = string(c.take(int(leUint(c.take(4)))))
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := []int{2, 3, 4, 8}[enc-0xf1]
+			val = strconv.FormatInt(leInt(c.take(size)), 10)
+		default:
+			c.err = errCorrupt
+		}
+		// Each entry ends with its own length, for iterating backwards.
+		c.take(backlenSize(c.pos - start))
+		vals = append(vals, val)
+	}
+	return nil, errCorrupt
+}
+
+// backlenSize returns the number of bytes a listpack uses to store the
+// length of an n-byte entry.
+func backlenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intset decodes an intset's integers.
+func intset(b []byte) ([]string, error) {
+	c := cursor{b: b}
+	size := int(leUint(c.take(4)))
+	n := int(leUint(c.take(4)))
+	if size != 2 && size != 4 && size != 8 {
+		return nil, errCorrupt
+	}
+	var vals []string
+	for range n {
+		i := leInt(c.take(size))
+		if c.err != nil {
+			return nil, c.err
+		}
+		vals = append(vals, strconv.FormatInt(i, 10))
+	}
+	return vals, c.err
+}
+
+// lzfDecompress decompresses LZF-compressed data, which decompresses to size
+// bytes.
+func lzfDecompress(in []byte, size uint64) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// A run of ctrl+1 literal bytes.
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// A back reference: copy n bytes, starting some distance back in
+		// the output. They may overlap the bytes being copied.
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupt
+		}
+		for range n + 2 {
+			out = append(out, out[ref])
+			ref++
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+// A cursor reads an encoded value. After the first read past the end, every
+// read returns zeros and err is errCorrupt.
+type cursor struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil || n < 0 || n > len(c.b)-c.pos {
+		c.err = errCorrupt
+		return make([]byte, 8) // enough for any integer
+	}
+	b := c.b[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *cursor) byte() byte {
+	return c.take(1)[0]
+}
+
+func (c *cursor) peek() byte {
+	if c.err != nil || c.pos >= len(c.b) {
+		c.err = errCorrupt
+		return 0
+	}
+	return c.b[c.pos]
+}
+
+// leInt decodes a little-endian, two's complement integer of up to 8 bytes.
+func leInt(b []byte) int64 {
+	shift := 64 - 8*len(b)
+	return int64(leUint(b)<<shift) >> shift
+}
+
+func leUint(b []byte) uint64 {
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	return n
+}
+
+func beUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
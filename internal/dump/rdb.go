@@ -0,0 +1,667 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/set"
+)
+
+// rdbVersion is the version of the RDB files WriteRDB writes. Version 9
+// (Redis 5.0) is the oldest with every type WriteRDB uses, and every later
+// Redis and Valkey loads it.
+const rdbVersion = 9
+
+// RDB opcodes, which precede everything in the file but keys and values.
+const (
+	rdbSlotInfo     = 0xf4
+	rdbFunction2    = 0xf5
+	rdbFunction     = 0xf6
+	rdbModuleAux    = 0xf7
+	rdbIdle         = 0xf8
+	rdbFreq         = 0xf9
+	rdbAux          = 0xfa
+	rdbResizeDB     = 0xfb
+	rdbExpireTimeMS = 0xfc
+	rdbExpireTime   = 0xfd
+	rdbSelectDB     = 0xfe
+	rdbEOF          = 0xff
+)
+
+// Special encodings of strings, which take the place of their lengths.
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// RDB value types. The encoded types are compact forms of the plain ones,
+// which Redis and Valkey use for small values.
+const (
+	rdbTypeString          = 0
+	rdbTypeList            = 1
+	rdbTypeSet             = 2
+	rdbTypeZSet            = 3
+	rdbTypeHash            = 4
+	rdbTypeZSet2           = 5 // like rdbTypeZSet, with binary scores
+	rdbTypeModule          = 7
+	rdbTypeListZiplist     = 10
+	rdbTypeSetIntset       = 11
+	rdbTypeZSetZiplist     = 12
+	rdbTypeHashZiplist     = 13
+	rdbTypeListQuicklist   = 14
+	rdbTypeStreamListpacks = 15
+	rdbTypeHashListpack    = 16
+	rdbTypeZSetListpack    = 17
+	rdbTypeListQuicklist2  = 18
+	rdbTypeSetListpack     = 20
+)
+
+// rdbQuicklistPlain marks a quicklist node that holds a single, large
+// element, rather than a listpack.
+const rdbQuicklistPlain = 1
+
+// crcTable computes RDB checksums, which are CRC-64/Jones.
+var crcTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// crcUpdate returns the RDB checksum crc updated with p. Unlike package
+// crc64, RDB checksums don't invert the CRC before and after.
+func crcUpdate(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// rdbTypes are the RDB types WriteRDB and Serialize write each type of value
+// as.
+var rdbTypes = map[string]byte{
+	TypeString: rdbTypeString,
+	TypeList:   rdbTypeList,
+	TypeSet:    rdbTypeSet,
+	TypeZSet:   rdbTypeZSet2,
+	TypeHash:   rdbTypeHash,
+}
+
+// WriteRDB writes entries to w as an RDB file. Values are written in their
+// plain, unencoded forms, which are larger than what Redis or Valkey would
+// write, but simpler; they re-encode values as they load them.
+func WriteRDB(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	rw := &rdbWriter{w: bw}
+	rw.write(fmt.Appendf(nil, "REDIS%04d", rdbVersion))
+	var expires int
+	for _, e := range entries {
+		if !e.ExpireAt.IsZero() {
+			expires++
+		}
+	}
+	rw.byte(rdbSelectDB)
+	rw.length(0)
+	rw.byte(rdbResizeDB)
+	rw.length(uint64(len(entries)))
+	rw.length(uint64(expires))
+	for _, e := range entries {
+		if err := rw.entry(e); err != nil {
+			return err
+		}
+	}
+	rw.byte(rdbEOF)
+	sum := rw.crc
+	rw.write(binary.LittleEndian.AppendUint64(nil, sum))
+	if rw.err != nil {
+		return rw.err
+	}
+	return bw.Flush()
+}
+
+// Serialize encodes a value the way DUMP does: its type and contents, as in
+// an RDB file, followed by the RDB version and a checksum. The entry's key
+// and expiration time aren't included.
+func Serialize(e Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := &rdbWriter{w: &buf}
+	typ, ok := rdbTypes[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported type %q", e.Type)
+	}
+	w.byte(typ)
+	w.value(e)
+	w.write(binary.LittleEndian.AppendUint16(nil, rdbVersion))
+	w.write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	return buf.Bytes(), w.err
+}
+
+// Deserialize decodes a value encoded by Serialize, or by DUMP in any version
+// of Redis or Valkey. The returned entry has no key.
+func Deserialize(payload []byte) (Entry, error) {
+	if len(payload) < 10 {
+		return Entry{}, errCorrupt
+	}
+	body := payload[:len(payload)-10]
+	sum := binary.LittleEndian.Uint64(payload[len(payload)-8:])
+	if crcUpdate(0, payload[:len(payload)-8]) != sum {
+		return Entry{}, errors.New("checksum mismatch")
+	}
+	r := &rdbReader{r: bufio.NewReader(bytes.NewReader(body))}
+	typ, err := r.byte()
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := r.value(typ)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return Entry{}, errCorrupt // trailing data
+	}
+	return e, nil
+}
+
+// rdbWriter writes the parts of an RDB file, keeping a running checksum. The
+// first error stops all further writes.
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = crcUpdate(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) byte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *rdbWriter) length(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.byte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		w.write(binary.BigEndian.AppendUint32([]byte{0x80}, uint32(n)))
+	default:
+		w.write(binary.BigEndian.AppendUint64([]byte{0x81}, n))
+	}
+}
+
+func (w *rdbWriter) string(s string) {
+	w.length(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func (w *rdbWriter) entry(e Entry) error {
+	typ, ok := rdbTypes[e.Type]
+	if !ok {
+		return fmt.Errorf("key %q: unsupported type %q", e.Key, e.Type)
+	}
+	if !e.ExpireAt.IsZero() {
+		w.byte(rdbExpireTimeMS)
+		w.write(binary.LittleEndian.AppendUint64(nil, uint64(e.ExpireAt.UnixMilli())))
+	}
+	w.byte(typ)
+	w.string(e.Key)
+	w.value(e)
+	return nil
+}
+
+// value writes the contents of a value in the form rdbTypes gives its type.
+func (w *rdbWriter) value(e Entry) {
+	switch e.Type {
+	case TypeString:
+		w.string(e.String)
+	case TypeList:
+		w.length(uint64(len(e.List)))
+		for _, val := range e.List {
+			w.string(val)
+		}
+	case TypeSet:
+		w.length(uint64(e.Set.Len()))
+		for _, m := range e.Set.Sorted() {
+			w.string(m)
+		}
+	case TypeZSet:
+		w.length(uint64(len(e.ZSet)))
+		for _, m := range e.SortedZSet() {
+			w.string(m.Member)
+			w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(m.Score)))
+		}
+	case TypeHash:
+		w.length(uint64(len(e.Hash)))
+		for _, field := range slices.Sorted(maps.Keys(e.Hash)) {
+			w.string(field)
+			w.string(e.Hash[field])
+		}
+	}
+}
+
+// ReadRDB reads the keys in an RDB file written by any version of Redis or
+// Valkey. Keys of types Valthree doesn't support, like streams, and keys in
+// databases other than 0 are errors. So are Redis modules' data and
+// functions, which Valthree couldn't use.
+func ReadRDB(r io.Reader) ([]Entry, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	header, err := rr.read(9)
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	var version int
+	switch {
+	case string(header[:5]) == "REDIS":
+		version, err = strconv.Atoi(string(header[5:]))
+	case string(header[:6]) == "VALKEY":
+		version, err = strconv.Atoi(string(header[6:]))
+	default:
+		err = errCorrupt
+	}
+	if err != nil {
+		return nil, errors.New("not an RDB file")
+	}
+
+	var (
+		entries  []Entry
+		db       uint64
+		expireAt time.Time
+	)
+	for {
+		op, err := rr.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case rdbAux:
+			_, err = rr.string() // the field's name
+			if err == nil {
+				_, err = rr.string()
+			}
+		case rdbResizeDB:
+			_, err = rr.lengths(2)
+		case rdbSlotInfo:
+			_, err = rr.lengths(3)
+		case rdbSelectDB:
+			db, err = rr.count()
+		case rdbExpireTimeMS:
+			var b []byte
+			b, err = rr.read(8)
+			if err == nil {
+				expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+			}
+		case rdbExpireTime:
+			var b []byte
+			b, err = rr.read(4)
+			if err == nil {
+				expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			}
+		case rdbFreq:
+			_, err = rr.byte()
+		case rdbIdle:
+			_, err = rr.count()
+		case rdbFunction2, rdbFunction:
+			return nil, errors.New("functions aren't supported")
+		case rdbModuleAux:
+			return nil, errors.New("module data isn't supported")
+		case rdbEOF:
+			if version < 5 {
+				return entries, nil // no checksum
+			}
+			sum := rr.crc
+			b, err := rr.read(8)
+			if err != nil {
+				return nil, fmt.Errorf("read checksum: %w", err)
+			}
+			// A zero checksum means the writer didn't compute one.
+			if want := binary.LittleEndian.Uint64(b); want != 0 && want != sum {
+				return nil, errors.New("checksum mismatch")
+			}
+			return entries, nil
+		default:
+			key, err := rr.string()
+			if err != nil {
+				return nil, err
+			}
+			if db != 0 {
+				return nil, fmt.Errorf("key %q: keys in database %d aren't supported", key, db)
+			}
+			e, err := rr.value(op)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", key, err)
+			}
+			e.Key, e.ExpireAt = key, expireAt
+			entries = append(entries, e)
+			expireAt = time.Time{}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rdbReader reads the parts of an RDB file, keeping a running checksum.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (r *rdbReader) read(n uint64) ([]byte, error) {
+	// Lengths come from the file, so a corrupt one may be huge. Reading
+	// through a LimitReader only allocates as much as the file holds.
+	b, err := io.ReadAll(io.LimitReader(r.r, int64(min(n, math.MaxInt64))))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != n {
+		return nil, errCorrupt
+	}
+	r.crc = crcUpdate(r.crc, b)
+	return b, nil
+}
+
+func (r *rdbReader) byte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// length reads a length, or the special encoding of a string that follows.
+func (r *rdbReader) length() (n uint64, encoded bool, err error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b), false, nil
+	case 1:
+		next, err := r.byte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 2:
+		var size uint64
+		switch b {
+		case 0x80:
+			size = 4
+		case 0x81:
+			size = 8
+		default:
+			return 0, false, errCorrupt
+		}
+		buf, err := r.read(size)
+		if err != nil {
+			return 0, false, err
+		}
+		return beUint(buf), false, nil
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+// count reads a length that can't be a special encoding.
+func (r *rdbReader) count() (uint64, error) {
+	n, encoded, err := r.length()
+	if err == nil && encoded {
+		err = errCorrupt
+	}
+	return n, err
+}
+
+func (r *rdbReader) lengths(n int) ([]uint64, error) {
+	var ns []uint64
+	for range n {
+		c, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, c)
+	}
+	return ns, nil
+}
+
+func (r *rdbReader) string() (string, error) {
+	n, encoded, err := r.length()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		b, err := r.read(n)
+		return string(b), err
+	}
+	switch n {
+	case rdbEncInt8, rdbEncInt16, rdbEncInt32:
+		b, err := r.read(1 << n)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(leInt(b), 10), nil
+	case rdbEncLZF:
+		compressed, err := r.count()
+		if err != nil {
+			return "", err
+		}
+		size, err := r.count()
+		if err != nil {
+			return "", err
+		}
+		b, err := r.read(compressed)
+		if err != nil {
+			return "", err
+		}
+		b, err = lzfDecompress(b, size)
+		return string(b), err
+	}
+	return "", errCorrupt
+}
+
+func (r *rdbReader) strings() ([]string, error) {
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	var vals []string
+	for range n {
+		s, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, s)
+	}
+	return vals, nil
+}
+
+// blob reads one of the encoded types, which are stored as a single string.
+func (r *rdbReader) blob(decode func([]byte) ([]string, error)) ([]string, error) {
+	s, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+	return decode([]byte(s))
+}
+
+func (r *rdbReader) value(typ byte) (Entry, error) {
+	var (
+		vals []string
+		err  error
+	)
+	switch typ {
+	case rdbTypeString:
+		s, err := r.string()
+		return Entry{Type: TypeString, String: s}, err
+	case rdbTypeList:
+		vals, err = r.strings()
+		return Entry{Type: TypeList, List: vals}, err
+	case rdbTypeListZiplist:
+		vals, err = r.blob(ziplist)
+		return Entry{Type: TypeList, List: vals}, err
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		vals, err = r.quicklist(typ)
+		return Entry{Type: TypeList, List: vals}, err
+	case rdbTypeSet:
+		vals, err = r.strings()
+	case rdbTypeSetIntset:
+		vals, err = r.blob(intset)
+	case rdbTypeSetListpack:
+		vals, err = r.blob(listpack)
+	case rdbTypeZSet, rdbTypeZSet2:
+		return r.zset(typ == rdbTypeZSet2)
+	case rdbTypeZSetZiplist:
+		vals, err = r.blob(ziplist)
+	case rdbTypeZSetListpack:
+		vals, err = r.blob(listpack)
+	case rdbTypeHash:
+		vals, err = r.pairs()
+	case rdbTypeHashZiplist:
+		vals, err = r.blob(ziplist)
+	case rdbTypeHashListpack:
+		vals, err = r.blob(listpack)
+	case rdbTypeModule:
+		return Entry{}, errors.New("module types aren't supported")
+	case rdbTypeStreamListpacks:
+		return Entry{}, errors.New("streams aren't supported")
+	default:
+		return Entry{}, fmt.Errorf("unsupported value type %d", typ)
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+
+	switch typ {
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		return Entry{Type: TypeSet, Set: set.New(vals...)}, nil
+	case rdbTypeHash, rdbTypeHashZiplist, rdbTypeHashListpack:
+		if len(vals)%2 != 0 {
+			return Entry{}, errCorrupt
+		}
+		e := Entry{Type: TypeHash, Hash: make(map[string]string)}
+		for i := 0; i < len(vals); i += 2 {
+			e.Hash[vals[i]] = vals[i+1]
+		}
+		return e, nil
+	default: // sorted sets, encoded as members followed by their scores
+		if len(vals)%2 != 0 {
+			return Entry{}, errCorrupt
+		}
+		e := Entry{Type: TypeZSet, ZSet: make(map[string]float64)}
+		for i := 0; i < len(vals); i += 2 {
+			score, err := parseScore(vals[i+1])
+			if err != nil {
+				return Entry{}, err
+			}
+			e.ZSet[vals[i]] = score
+		}
+		return e, nil
+	}
+}
+
+// pairs reads a hash's fields and values, alternating.
+func (r *rdbReader) pairs() ([]string, error) {
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	var vals []string
+	for range 2 * n {
+		s, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, s)
+	}
+	return vals, nil
+}
+
+func (r *rdbReader) zset(binaryScores bool) (Entry, error) {
+	n, err := r.count()
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Type: TypeZSet, ZSet: make(map[string]float64)}
+	for range n {
+		member, err := r.string()
+		if err != nil {
+			return Entry{}, err
+		}
+		var score float64
+		if binaryScores {
+			b, err := r.read(8)
+			if err != nil {
+				return Entry{}, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		} else {
+			// Scores are strings with a one-byte length, which has three
+			// special values.
+			size, err := r.byte()
+			if err != nil {
+				return Entry{}, err
+			}
+			switch size {
+			case 253:
+				return Entry{}, fmt.Errorf("member %q: score is NaN", member)
+			case 254:
+				score = math.Inf(1)
+			case 255:
+				score = math.Inf(-1)
+			default:
+				b, err := r.read(uint64(size))
+				if err != nil {
+					return Entry{}, err
+				}
+				if score, err = parseScore(string(b)); err != nil {
+					return Entry{}, err
+				}
+			}
+		}
+		e.ZSet[member] = score
+	}
+	return e, nil
+}
+
+// quicklist reads a list stored as a sequence of ziplists or, in the newer
+// format, of listpacks and plain elements.
+func (r *rdbReader) quicklist(typ byte) ([]string, error) {
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	var vals []string
+	for range n {
+		container := uint64(0)
+		if typ == rdbTypeListQuicklist2 {
+			if container, err = r.count(); err != nil {
+				return nil, err
+			}
+		}
+		s, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		var node []string
+		switch {
+		case container == rdbQuicklistPlain:
+			node = []string{s}
+		case typ == rdbTypeListQuicklist2:
+			node, err = listpack([]byte(s))
+		default:
+			node, err = ziplist([]byte(s))
+		}
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, node...)
+	}
+	return vals, nil
+}
@@ -0,0 +1,366 @@
+package dump
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/set"
+)
+
+// respBatch is the most elements WriteRESP adds to a collection per command,
+// as in an append-only file rewritten by Redis or Valkey.
+const respBatch = 64
+
+// WriteRESP writes entries to w as the commands that recreate them, encoded
+// in RESP, like an append-only file. Piping the output into valkey-cli --pipe
+// loads it into a server.
+func WriteRESP(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		cmds, err := e.commands()
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			fmt.Fprintf(bw, "*%d\r\n", len(cmd))
+			for _, arg := range cmd {
+				fmt.Fprintf(bw, "$%d\r\n%s\r\n", len(arg), arg)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// commands returns the commands that recreate the entry.
+func (e Entry) commands() ([][]string, error) {
+	var args []string
+	var name string
+	switch e.Type {
+	case TypeString:
+		return append([][]string{{"SET", e.Key, e.String}}, e.expireCommands()...), nil
+	case TypeList:
+		name, args = "RPUSH", e.List
+	case TypeSet:
+		name, args = "SADD", e.Set.Sorted()
+	case TypeZSet:
+		name = "ZADD"
+		for _, m := range e.SortedZSet() {
+			args = append(args, formatScore(m.Score), m.Member)
+		}
+	case TypeHash:
+		name = "HSET"
+		for _, field := range slices.Sorted(maps.Keys(e.Hash)) {
+			args = append(args, field, e.Hash[field])
+		}
+	default:
+		return nil, fmt.Errorf("key %q: unsupported type %q", e.Key, e.Type)
+	}
+	// Hashes and sorted sets take pairs of arguments, so batches are pairs
+	// too.
+	batch := respBatch
+	if name == "ZADD" || name == "HSET" {
+		batch *= 2
+	}
+	var cmds [][]string
+	for chunk := range slices.Chunk(args, batch) {
+		cmds = append(cmds, append([]string{name, e.Key}, chunk...))
+	}
+	return append(cmds, e.expireCommands()...), nil
+}
+
+func (e Entry) expireCommands() [][]string {
+	if e.ExpireAt.IsZero() {
+		return nil
+	}
+	return [][]string{{"PEXPIREAT", e.Key, strconv.FormatInt(e.ExpireAt.UnixMilli(), 10)}}
+}
+
+// ReadRESP reads a stream of RESP commands, like an append-only file, and
+// returns the keys they leave behind. It understands the commands that
+// append-only files and WriteRESP use to write strings, lists, sets, sorted
+// sets, hashes, and TTLs; any other command is an error. Like Redis and
+// Valkey, it accepts an append-only file that starts with an RDB preamble.
+func ReadRESP(r io.Reader) ([]Entry, error) {
+	br := bufio.NewReader(r)
+	l := loader{keys: make(map[string]*Entry)}
+	if magic, _ := br.Peek(5); string(magic) == "REDIS" {
+		entries, err := ReadRDB(br)
+		if err != nil {
+			return nil, fmt.Errorf("RDB preamble: %w", err)
+		}
+		for _, e := range entries {
+			l.keys[e.Key] = &e
+		}
+	}
+	for n := 1; ; n++ {
+		args, err := readCommand(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("command %d: %w", n, err)
+		}
+		if err := l.apply(args); err != nil {
+			return nil, fmt.Errorf("command %d (%s): %w", n, args[0], err)
+		}
+	}
+	entries := make([]Entry, 0, len(l.keys))
+	for _, key := range slices.Sorted(maps.Keys(l.keys)) {
+		entries = append(entries, *l.keys[key])
+	}
+	return entries, nil
+}
+
+// readCommand reads a command, which is an array of bulk strings. At the
+// end of the stream, it returns io.EOF.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readHeader(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.New("empty command")
+	}
+	var args []string
+	for range n {
+		size, err := readHeader(r, '$')
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		arg, err := io.ReadAll(io.LimitReader(r, int64(size)+2))
+		if err != nil {
+			return nil, err
+		}
+		if len(arg) != size+2 || !strings.HasSuffix(string(arg), "\r\n") {
+			return nil, io.ErrUnexpectedEOF
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+// readHeader reads a line holding a length, like "*3" or "$5".
+func readHeader(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if errors.Is(err, io.EOF) && line != "" {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" || line[0] != prefix {
+		return 0, fmt.Errorf("expected '%c', got %q", prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid length %q", line[1:])
+	}
+	return n, nil
+}
+
+// noEOF turns io.EOF, which means the stream ended cleanly between
+// commands, into io.ErrUnexpectedEOF, for when it ended in the middle of one.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// loader applies commands to the keys they write.
+type loader struct {
+	keys map[string]*Entry
+}
+
+func (l *loader) apply(args []string) error {
+	name, args := strings.ToUpper(args[0]), args[1:]
+	switch name {
+	case "MULTI", "EXEC":
+		// Append-only files wrap transactions in MULTI and EXEC. Loading
+		// is all or nothing anyway.
+		return nil
+	case "SELECT":
+		if len(args) != 1 || args[0] != "0" {
+			return errors.New("only database 0 is supported")
+		}
+		return nil
+	case "DEL", "UNLINK":
+		for _, key := range args {
+			delete(l.keys, key)
+		}
+		return nil
+	case "SET":
+		return l.set(args)
+	case "RPUSH", "LPUSH":
+		return l.push(name == "LPUSH", args)
+	case "SADD":
+		return l.sadd(args)
+	case "ZADD":
+		return l.zadd(args)
+	case "HSET", "HMSET":
+		return l.hset(args)
+	case "PEXPIREAT", "EXPIREAT", "PEXPIRE", "EXPIRE":
+		return l.expire(name, args)
+	}
+	return errors.New("unsupported command")
+}
+
+// entry returns the key's entry, creating it with the wanted type if the key
+// doesn't exist.
+func (l *loader) entry(key, typ string) (*Entry, error) {
+	e, ok := l.keys[key]
+	if !ok {
+		e = &Entry{Key: key, Type: typ}
+		l.keys[key] = e
+	}
+	if e.Type != typ {
+		return nil, fmt.Errorf("key %q holds a %s, not a %s", key, e.Type, typ)
+	}
+	return e, nil
+}
+
+func (l *loader) set(args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments")
+	}
+	key, val := args[0], args[1]
+	var expireAt time.Time
+	keepTTL := false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt == "KEEPTTL" {
+			keepTTL = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return fmt.Errorf("unsupported option %s", opt)
+		}
+		i++
+		at, err := parseExpiry(opt, args[i])
+		if err != nil {
+			return err
+		}
+		expireAt = at
+	}
+	if old, ok := l.keys[key]; ok && keepTTL {
+		expireAt = old.ExpireAt
+	}
+	l.keys[key] = &Entry{Key: key, Type: TypeString, String: val, ExpireAt: expireAt}
+	return nil
+}
+
+func (l *loader) push(head bool, args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments")
+	}
+	e, err := l.entry(args[0], TypeList)
+	if err != nil {
+		return err
+	}
+	for _, val := range args[1:] {
+		if head {
+			e.List = slices.Insert(e.List, 0, val)
+		} else {
+			e.List = append(e.List, val)
+		}
+	}
+	return nil
+}
+
+func (l *loader) sadd(args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments")
+	}
+	e, err := l.entry(args[0], TypeSet)
+	if err != nil {
+		return err
+	}
+	if e.Set == nil {
+		e.Set = set.New[string]()
+	}
+	for _, m := range args[1:] {
+		e.Set.Add(m)
+	}
+	return nil
+}
+
+func (l *loader) zadd(args []string) error {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	e, err := l.entry(args[0], TypeZSet)
+	if err != nil {
+		return err
+	}
+	if e.ZSet == nil {
+		e.ZSet = make(map[string]float64)
+	}
+	for i := 1; i < len(args); i += 2 {
+		score, err := parseScore(args[i])
+		if err != nil {
+			return err
+		}
+		e.ZSet[args[i+1]] = score
+	}
+	return nil
+}
+
+func (l *loader) hset(args []string) error {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return errors.New("wrong number of arguments")
+	}
+	e, err := l.entry(args[0], TypeHash)
+	if err != nil {
+		return err
+	}
+	if e.Hash == nil {
+		e.Hash = make(map[string]string)
+	}
+	for i := 1; i < len(args); i += 2 {
+		e.Hash[args[i]] = args[i+1]
+	}
+	return nil
+}
+
+func (l *loader) expire(name string, args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+	at, err := parseExpiry(name, args[1])
+	if err != nil {
+		return err
+	}
+	if e, ok := l.keys[args[0]]; ok {
+		e.ExpireAt = at
+	}
+	return nil
+}
+
+// parseExpiry parses a TTL given as a command or a SET option: EX, PX,
+// EXAT, or PXAT, or the equivalent EXPIRE commands. Relative TTLs are
+// relative to now.
+func parseExpiry(kind, arg string) (time.Time, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expire time %q", arg)
+	}
+	switch kind {
+	case "EX", "EXPIRE":
+		return time.Now().Add(time.Duration(n) * time.Second), nil
+	case "PX", "PEXPIRE":
+		return time.Now().Add(time.Duration(n) * time.Millisecond), nil
+	case "EXAT", "EXPIREAT":
+		return time.Unix(n, 0), nil
+	case "PXAT", "PEXPIREAT":
+		return time.UnixMilli(n), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported option %s", kind)
+}
@@ -8,12 +8,128 @@ import "strings"
 type Op string
 
 const (
-	Get      Op = "get"
-	Set      Op = "set"
-	Del      Op = "del"
-	FlushAll Op = "flushall"
-	Ping     Op = "ping"
-	Quit     Op = "quit"
+	Get       Op = "get"
+	GetDel    Op = "getdel"
+	GetEx     Op = "getex"
+	GetSet    Op = "getset"
+	Append    Op = "append"
+	Strlen    Op = "strlen"
+	SetRange  Op = "setrange"
+	GetRange  Op = "getrange"
+	SetEx     Op = "setex"
+	PSetEx    Op = "psetex"
+	SetNX     Op = "setnx"
+	Rename    Op = "rename"
+	RenameNX  Op = "renamenx"
+	Copy      Op = "copy"
+	Eval      Op = "eval"
+	EvalSha   Op = "evalsha"
+	Script    Op = "script"
+	FCall     Op = "fcall"
+	FCallRO   Op = "fcall_ro"
+	Function  Op = "function"
+	Object    Op = "object"
+	Set       Op = "set"
+	Del       Op = "del"
+	Incr      Op = "incr"
+	Decr      Op = "decr"
+	IncrBy    Op = "incrby"
+	DecrBy    Op = "decrby"
+	FlushAll  Op = "flushall"
+	FlushDB   Op = "flushdb"
+	Ping      Op = "ping"
+	Quit      Op = "quit"
+	Reset     Op = "reset"
+	Select    Op = "select"
+	Lock      Op = "lock"
+	Unlock    Op = "unlock"
+	Info      Op = "info"
+	Hello     Op = "hello"
+	Auth      Op = "auth"
+	ACL       Op = "acl"
+	Stats     Op = "stats"
+	BitField  Op = "bitfield"
+	Debug     Op = "debug"
+	Config    Op = "config"
+	Cluster   Op = "cluster"
+	Client    Op = "client"
+	BgSave    Op = "bgsave"
+	LastSave  Op = "lastsave"
+	Load      Op = "load"
+	LoadIf    Op = "loadif"
+	Expire    Op = "expire"
+	PExpire   Op = "pexpire"
+	TTL       Op = "ttl"
+	PTTL      Op = "pttl"
+	Persist   Op = "persist"
+	Dump      Op = "dump"
+	Restore   Op = "restore"
+	MGet      Op = "mget"
+	MSet      Op = "mset"
+	HotKeys   Op = "hotkeys"
+	HSet      Op = "hset"
+	HGet      Op = "hget"
+	HDel      Op = "hdel"
+	HGetAll   Op = "hgetall"
+	HExists   Op = "hexists"
+	HLen      Op = "hlen"
+	LPush     Op = "lpush"
+	RPush     Op = "rpush"
+	LPop      Op = "lpop"
+	RPop      Op = "rpop"
+	LLen      Op = "llen"
+	LRange    Op = "lrange"
+	SAdd      Op = "sadd"
+	SRem      Op = "srem"
+	SMembers  Op = "smembers"
+	SIsMember Op = "sismember"
+	SCard     Op = "scard"
+	ZAdd      Op = "zadd"
+	ZRem      Op = "zrem"
+	ZScore    Op = "zscore"
+	ZCard     Op = "zcard"
+	ZRange    Op = "zrange"
+	ZPopMin   Op = "zpopmin"
+	ZPopMax   Op = "zpopmax"
+	Exists    Op = "exists"
+	Type      Op = "type"
+	DBSize    Op = "dbsize"
+	Keys      Op = "keys"
+	Scan      Op = "scan"
+	Range     Op = "range"
+	Multi     Op = "multi"
+	Exec      Op = "exec"
+	Discard   Op = "discard"
+	Watch     Op = "watch"
+	Unwatch   Op = "unwatch"
+	ReadOnly  Op = "readonly"
+	ReadWrite Op = "readwrite"
+	Wait      Op = "wait"
+	// BitFieldRO is BITFIELD limited to GET subcommands, so it only reads.
+	BitFieldRO Op = "bitfield_ro"
+	// HRandField and SRandMember pick members at random.
+	HRandField  Op = "hrandfield"
+	SRandMember Op = "srandmember"
+	// Pub/sub commands aren't tied to keys.
+	Subscribe    Op = "subscribe"
+	Unsubscribe  Op = "unsubscribe"
+	PSubscribe   Op = "psubscribe"
+	PUnsubscribe Op = "punsubscribe"
+	Publish      Op = "publish"
+	// SSubscribe, SUnsubscribe, and SPublish are their sharded variants,
+	// whose channels belong to hash slots.
+	SSubscribe   Op = "ssubscribe"
+	SUnsubscribe Op = "sunsubscribe"
+	SPublish     Op = "spublish"
+	// Generation, VGet, VSet, Invalidate, Resume, GetAt, and Snapshot are
+	// specific to Valthree.
+	Generation Op = "generation"
+	VGet       Op = "vget"
+	VSet       Op = "vset"
+	Invalidate Op = "invalidate"
+	Resume     Op = "resume"
+	GetAt      Op = "getat"
+	Snapshot   Op = "snapshot"
 )
 
 // New creates an Op from wire data. It does not validate that the operation is
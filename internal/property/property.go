@@ -0,0 +1,110 @@
+// Package property declares the properties Antithesis checks in Valthree,
+// grouped by severity:
+//
+//   - Safety properties are Valthree's guarantees. Violating one means that
+//     data was lost or corrupted.
+//   - Liveness properties check that the cluster makes progress despite
+//     faults.
+//   - Coverage properties check that testing reaches the code paths that
+//     matter most. Failing one doesn't mean Valthree is broken, only that the
+//     workload isn't thorough enough to tell.
+//
+// Antithesis catalogs assertions by their messages when it instruments the
+// build, so every message is a literal in this file. Code elsewhere asserts a
+// property by calling its function, rather than using the SDK directly. Each
+// message starts with its severity, which groups related properties in
+// Antithesis reports; the rest is phrased for readers who aren't database
+// experts, since it appears directly in the Antithesis UI.
+package property
+
+import "github.com/antithesishq/antithesis-sdk-go/assert"
+
+// Safety properties.
+
+// NoLostUpdates asserts that a workload's history was linearizable: every
+// acknowledged write was visible to later reads until overwritten.
+func NoLostUpdates(linearizable bool, details map[string]any) {
+	assert.Always(linearizable, "Safety: clients can always read their own writes", details)
+}
+
+// NoDirtyReads asserts that no read saw only part of a multi-key write.
+func NoDirtyReads(consistent bool, details map[string]any) {
+	assert.Always(consistent, "Safety: clients never see half-finished writes", details)
+}
+
+// FencingTokensIncrease asserts that the fencing tokens issued for a lock
+// always increased.
+func FencingTokensIncrease(increasing bool, details map[string]any) {
+	assert.Always(increasing, "Safety: fencing tokens always increase", details)
+}
+
+// ETagMissing reports that object storage returned a database without an
+// ETag, which conditional writes depend on.
+func ETagMissing() {
+	assert.Unreachable("Safety: database always has an ETag", nil)
+}
+
+// StoredDatabaseInvalid reports that the database in object storage couldn't
+// be decoded, so the write path is broken.
+func StoredDatabaseInvalid(details map[string]any) {
+	assert.Unreachable("Safety: database in object storage is always valid JSON", details)
+}
+
+// DatabaseUnencodable reports that the database in memory couldn't be
+// encoded for writing.
+func DatabaseUnencodable(details map[string]any) {
+	assert.Unreachable("Safety: database in memory is always valid JSON", details)
+}
+
+// LogMatchesSnapshot asserts that a shard's write-ahead log carried on from
+// its snapshot when a server started. If it didn't, writes were lost or
+// rolled back.
+func LogMatchesSnapshot(matches bool, details map[string]any) {
+	assert.Always(matches, "Safety: saved changes always follow on from the saved database", details)
+}
+
+// Liveness properties.
+
+// WorkloadProgress asserts that some of a workload's operations succeeded.
+// Faults may make every operation in a single iteration fail, so it only
+// needs to hold sometimes.
+func WorkloadProgress(succeeded float64, details map[string]any) {
+	assert.Sometimes(succeeded > 0, "Liveness: clients' commands eventually succeed", details)
+}
+
+// Coverage properties.
+
+// ConflictReached reports that a conditional write lost a race and was
+// rolled back, the most critical path in the server.
+func ConflictReached() {
+	assert.Reachable("Coverage: exercised optimistic concurrency control rollback", nil)
+}
+
+// MissingDatabaseReached reports that a command read the database before it
+// was created, so object storage replied NoSuchKey.
+func MissingDatabaseReached() {
+	assert.Reachable("Coverage: exercised GET or DEL before database creation", nil)
+}
+
+// ReadFailureReached reports that a read from object storage failed.
+func ReadFailureReached() {
+	assert.Reachable("Coverage: exercised failures reading from object storage", nil)
+}
+
+// WriteFailureReached reports that a write to object storage failed.
+func WriteFailureReached() {
+	assert.Reachable("Coverage: exercised failures writing to object storage", nil)
+}
+
+// ConcurrentSnapshotsReached reports that two nodes took the same scheduled
+// snapshot at once.
+func ConcurrentSnapshotsReached() {
+	assert.Reachable("Coverage: exercised concurrent scheduled snapshots", nil)
+}
+
+// LockContention asserts that clients sometimes failed to acquire a lock
+// because another client held it. Without contention, the lock workload
+// doesn't exercise anything interesting.
+func LockContention(contended bool, details map[string]any) {
+	assert.Sometimes(contended, "Coverage: clients sometimes contend for locks", details)
+}
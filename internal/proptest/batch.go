@@ -0,0 +1,181 @@
+package proptest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxBatch is the most operations a client sends in one batch. The
+// operations in a pipeline all overlap, and every overlapping operation
+// multiplies the orderings the checker has to consider, so batches are small.
+const maxBatch = 4
+
+// batch assigns a client's operations to batches, which RunWorkload sends
+// together: pipelined or, if atomic, in MULTI/EXEC transactions. Check-and-set
+// increments use transactions of their own, so they're always sent alone. So
+// is KEYS in transactions, since it reads every shard and a transaction can
+// only see one.
+func batch(r *rand.Rand, workload []porcupine.Operation, atomic bool) {
+	var id, left int
+	for i := range workload {
+		in := workload[i].Input.(*args)
+		if in.Op == op.Exec || (atomic && in.Op == op.Keys) {
+			left = 0
+			continue
+		}
+		if left == 0 {
+			id, left = id+1, r.IntN(maxBatch)+1
+		}
+		in.Batch, in.Atomic = id, atomic
+		left--
+	}
+}
+
+// runBatch sends a batch of operations at once and stores their results.
+// Every operation is recorded as spanning the whole batch, since the client
+// can't tell when each one took effect.
+func runBatch(c *client.Client, batch []porcupine.Operation) {
+	cmds := make([]client.Command, len(batch))
+	for i := range batch {
+		cmd := command(batch[i].Input.(*args))
+		cmdArgs := make([]any, len(cmd)-1)
+		for j, arg := range cmd[1:] {
+			cmdArgs[j] = arg
+		}
+		cmds[i] = client.Command{Name: cmd[0], Args: cmdArgs}
+	}
+	send := c.Pipeline
+	if batch[0].Input.(*args).Atomic {
+		send = c.Exec
+	}
+	start := time.Now().UnixNano()
+	replies, err := send(cmds...)
+	end := time.Now().UnixNano()
+	for i := range batch {
+		batch[i].Call, batch[i].Return = start, end
+		out := batch[i].Output.(*rets)
+		if i < len(replies) {
+			decode(batch[i].Input.(*args), replies[i], out)
+		} else {
+			out.Err = err
+		}
+	}
+}
+
+// decode stores the reply to a batched operation in out, just as call would
+// for an operation sent alone.
+func decode(in *args, reply any, out *rets) {
+	if rerr, ok := reply.(redis.Error); ok {
+		out.Err = rerr
+		return
+	}
+	var err error
+	switch in.Op {
+	case op.Get, op.GetDel, op.GetEx, op.GetSet, op.LPop, op.RPop, op.ZScore:
+		if reply == nil {
+			out.Err = client.ErrNotFound
+			return
+		}
+		out.Value, err = redis.String(reply, nil)
+		if err == nil && in.Op == op.ZScore {
+			var score float64
+			score, err = strconv.ParseFloat(out.Value, 64)
+			out.Value = formatScore(score)
+		}
+	case op.Set, op.MSet:
+		if (reply == nil && in.Cond == "") || (reply != nil && reply != "OK") {
+			err = fmt.Errorf("unexpected %s response: %v", in.Op, reply)
+		}
+		out.Applied = in.Cond != "" && reply != nil
+	case op.Del:
+		_, err = redis.Int(reply, nil)
+	case op.IncrBy:
+		var n int64
+		n, err = redis.Int64(reply, nil)
+		out.Value = strconv.FormatInt(n, 10)
+	case op.MGet, op.Keys, op.LRange, op.SMembers, op.ZRange:
+		// Missing keys in an MGET are nil, which become empty strings.
+		out.Values, err = redis.Strings(reply, nil)
+	case op.Exists, op.Append, op.Strlen, op.LPush, op.RPush, op.LLen, op.SAdd, op.SRem, op.SIsMember, op.SCard,
+		op.ZAdd, op.ZRem, op.ZCard:
+		var n int
+		n, err = redis.Int(reply, nil)
+		out.Value = strconv.Itoa(n)
+	default:
+		panic(fmt.Sprintf("decode: unexpected operation %v", in.Op))
+	}
+	if err != nil {
+		out.Err = err
+	}
+}
+
+// A transaction is the operations on a single key from one MULTI/EXEC
+// transaction. EXEC applies them all at once, so the checker treats them as
+// one operation, stepping the model through each in turn.
+type transaction []porcupine.Operation
+
+// groupTransactions replaces the operations in a key's history that ran in
+// the same transaction with a single operation.
+func groupTransactions(history []porcupine.Operation) []porcupine.Operation {
+	type id struct{ client, batch int }
+	grouped := make([]porcupine.Operation, 0, len(history))
+	index := make(map[id]int)
+	for _, operation := range history {
+		in := operation.Input.(*args)
+		if !in.Atomic {
+			grouped = append(grouped, operation)
+			continue
+		}
+		txn := id{operation.ClientId, in.Batch}
+		if i, ok := index[txn]; ok {
+			grouped[i].Input = append(grouped[i].Input.(transaction), operation)
+			continue
+		}
+		index[txn] = len(grouped)
+		grouped = append(grouped, porcupine.Operation{
+			ClientId: operation.ClientId,
+			Input:    transaction{operation},
+			Call:     operation.Call,
+			Return:   operation.Return,
+		})
+	}
+	return grouped
+}
+
+// withTransactions extends a model to step through transactions.
+func withTransactions(model porcupine.Model) porcupine.Model {
+	step, describeOperation := model.Step, model.DescribeOperation
+	model.Step = func(state, input, output any) (bool, any) {
+		txn, ok := input.(transaction)
+		if !ok {
+			return step(state, input, output)
+		}
+		for _, operation := range txn {
+			var legal bool
+			if legal, state = step(state, operation.Input, operation.Output); !legal {
+				return false, state
+			}
+		}
+		return true, state
+	}
+	model.DescribeOperation = func(input, output any) string {
+		txn, ok := input.(transaction)
+		if !ok {
+			return describeOperation(input, output)
+		}
+		descs := []string{"MULTI"}
+		for _, operation := range txn {
+			descs = append(descs, describeOperation(operation.Input, operation.Output))
+		}
+		return strings.Join(append(descs, "EXEC"), "; ")
+	}
+	return model
+}
@@ -0,0 +1,111 @@
+package proptest
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// isListOp reports whether an operation works on lists. Keys hold either
+// strings or lists for a whole workload, so each key's history is checked
+// against one model or the other.
+func isListOp(o op.Op) bool {
+	switch o {
+	case op.LPush, op.RPush, op.LPop, op.RPop, op.LRange, op.LLen:
+		return true
+	}
+	return false
+}
+
+func newListModel() porcupine.Model {
+	// Models the state of a single list as a []string, with a missing key
+	// represented by an empty list. Steps never modify a state in place,
+	// because porcupine may explore several successors of the same state.
+	nondeterministic := &porcupine.NondeterministicModel{
+		Init: func() []any { return []any{[]string(nil)} },
+		Step: func(state, input, output any) []any {
+			in := input.(*args)
+			out := output.(*rets)
+			list := state.([]string)
+			switch in.Op {
+			case op.LPush, op.RPush:
+				next := append([]string{in.Value}, list...)
+				if in.Op == op.RPush {
+					next = append(slices.Clone(list), in.Value)
+				}
+				if out.Err != nil {
+					// Push may have succeeded.
+					return []any{list, next}
+				}
+				if out.Value != strconv.Itoa(len(next)) {
+					// Push returned an unexpected length.
+					return nil
+				}
+				return []any{next}
+			case op.LPop, op.RPop:
+				if out.Err != nil && !errors.Is(out.Err, client.ErrNotFound) {
+					// Pop may have succeeded.
+					if len(list) == 0 {
+						return []any{list}
+					}
+					return []any{list, popped(in.Op, list)}
+				}
+				if len(list) == 0 {
+					if errors.Is(out.Err, client.ErrNotFound) {
+						return []any{list}
+					}
+					// Pop returned an element from an empty list.
+					return nil
+				}
+				if errors.Is(out.Err, client.ErrNotFound) {
+					// Pop found no elements, but we expected some.
+					return nil
+				}
+				want := list[0]
+				if in.Op == op.RPop {
+					want = list[len(list)-1]
+				}
+				if out.Value != want {
+					return nil
+				}
+				return []any{popped(in.Op, list)}
+			case op.LRange:
+				if out.Err != nil || slices.Equal(out.Values, list) {
+					return []any{list}
+				}
+				return nil
+			case op.LLen:
+				if out.Err != nil || out.Value == strconv.Itoa(len(list)) {
+					return []any{list}
+				}
+				return nil
+			default:
+				panic(fmt.Sprintf("step list model: unexpected operation %v", in.Op))
+			}
+		},
+		DescribeOperation: func(input, output any) string {
+			return describe(input.(*args), output.(*rets))
+		},
+		DescribeState: func(state any) string {
+			return "[" + strings.Join(state.([]string), " ") + "]"
+		},
+		Equal: func(left, right any) bool {
+			return slices.Equal(left.([]string), right.([]string))
+		},
+	}
+	return nondeterministic.ToModel()
+}
+
+// popped returns the list without the element LPOP or RPOP removes.
+func popped(o op.Op, list []string) []string {
+	if o == op.LPop {
+		return list[1:]
+	}
+	return list[:len(list)-1]
+}
@@ -0,0 +1,148 @@
+package proptest
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/client"
+)
+
+// LockError is returned from CheckLocks when the fencing tokens issued by the
+// cluster violate the safety property of a distributed lock.
+type LockError struct {
+	Lock          string
+	First, Second LockOperation
+	Reason        string
+}
+
+// Error implements error.
+func (e *LockError) Error() string {
+	return fmt.Sprintf(
+		"%s: %s (owner %s got token %d, then owner %s got token %d)",
+		e.Lock, e.Reason,
+		e.First.Owner, e.First.Token,
+		e.Second.Owner, e.Second.Token,
+	)
+}
+
+// A LockOperation is a single attempt to acquire a lease on a lock. Owners
+// are unique to each attempt.
+type LockOperation struct {
+	ClientId int
+	Lock     string
+	Owner    string
+	TTL      time.Duration
+	Hold     time.Duration // how long to hold the lock if acquired
+
+	// Populated by RunLockWorkload.
+	Call, Return int64
+	Token        uint64
+	Err          error
+}
+
+// GenLockWorkloads generates a lock workload for a variable number of
+// clients, all contending for a handful of locks.
+func GenLockWorkloads(r *rand.Rand) [][]LockOperation {
+	locks := make([]string, r.IntN(2)+1) // 1-2 locks
+	for i := range locks {
+		locks[i] = fmt.Sprintf("lock%d", i)
+	}
+	numClients := r.IntN(5) + 2     // 2-6 clients
+	opsPerClient := r.IntN(32) + 32 // 32-63 operations per client
+	workloads := make([][]LockOperation, numClients)
+	for clientId := range workloads {
+		workload := make([]LockOperation, opsPerClient)
+		for i := range workload {
+			workload[i] = LockOperation{
+				ClientId: clientId,
+				Lock:     locks[r.IntN(len(locks))],
+				Owner:    fmt.Sprintf("client%d-%d-%s", clientId, i, genString(r)),
+				// Short leases ensure that some expire while they're still held,
+				// which is exactly when fencing tokens matter.
+				TTL:  time.Duration(r.IntN(200)+10) * time.Millisecond,
+				Hold: time.Duration(r.IntN(50)) * time.Millisecond,
+			}
+		}
+		workloads[clientId] = workload
+	}
+	return workloads
+}
+
+// RunLockWorkload runs a lock workload on a client. After acquiring a lock,
+// the client holds it for the operation's Hold duration and then releases it.
+func RunLockWorkload(logger *slog.Logger, c *client.Client, workload []LockOperation) {
+	for i := range workload {
+		o := &workload[i]
+		o.Call = time.Now().UnixNano()
+		o.Token, o.Err = c.Lock(o.Lock, o.Owner, o.TTL)
+		o.Return = time.Now().UnixNano()
+		if o.Err != nil {
+			continue
+		}
+		time.Sleep(o.Hold)
+		if err := c.Unlock(o.Lock, o.Owner); err != nil && !errors.Is(err, client.ErrNotFound) {
+			logger.Debug("unlock failed", "lock", o.Lock, "owner", o.Owner, "err", err)
+		}
+	}
+}
+
+// CheckLocks verifies that the fencing tokens observed by RunLockWorkload are
+// safe: tokens for each lock are unique, and an acquisition that begins after
+// another has completed always receives a larger token. It also returns the
+// fraction of acquisition attempts that succeeded.
+//
+// Failed attempts don't constrain the check, since the cluster may have
+// granted the lease even if the client saw an error.
+func CheckLocks(workloads [][]LockOperation) (float64, error) {
+	byLock := make(map[string][]LockOperation)
+	var acquired, total float64
+	for _, workload := range workloads {
+		for _, o := range workload {
+			total++
+			if o.Err != nil {
+				continue
+			}
+			acquired++
+			byLock[o.Lock] = append(byLock[o.Lock], o)
+		}
+	}
+
+	for lock, ops := range byLock {
+		slices.SortFunc(ops, func(a, b LockOperation) int {
+			return cmp.Compare(a.Token, b.Token)
+		})
+		for i := 1; i < len(ops); i++ {
+			if ops[i-1].Token == ops[i].Token {
+				return 0, &LockError{
+					Lock:   lock,
+					First:  ops[i-1],
+					Second: ops[i],
+					Reason: "duplicate fencing token",
+				}
+			}
+		}
+		// Sorted by token, so any operation that completed strictly before an
+		// earlier-sorted operation started was issued a token out of order.
+		for i := range ops {
+			for j := i + 1; j < len(ops); j++ {
+				if ops[j].Return < ops[i].Call {
+					return 0, &LockError{
+						Lock:   lock,
+						First:  ops[j],
+						Second: ops[i],
+						Reason: "fencing token decreased",
+					}
+				}
+			}
+		}
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return acquired / total, nil
+}
@@ -0,0 +1,109 @@
+package proptest
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// minimizeBudget bounds the time spent shrinking a failing history.
+const minimizeBudget = time.Minute
+
+// minimize shrinks a non-linearizable history for a single key, returning a
+// smaller history that still fails to linearize. Visualizations of the whole
+// history are often too large to read, but the violation usually involves
+// only a few operations.
+//
+// Only operations that leave the key unchanged are removed: reads,
+// conditional SETs and transactions that didn't apply, pops from empty lists,
+// and set updates that changed nothing. Removing a
+// write could produce a spurious failure, like a read of a value that was
+// never written. Removing a read can't, because any valid linearization of the full history is still
+// valid without it, so every minimized history is a genuine witness of the
+// original violation.
+//
+// Minimization works like delta debugging: it tries to remove large chunks of
+// operations first, then progressively smaller ones. It stops early if it
+// runs out of time.
+func minimize(model porcupine.Model, history []porcupine.Operation) []porcupine.Operation {
+	deadline := time.Now().Add(minimizeBudget)
+	fails := func(candidate []porcupine.Operation) bool {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		// Timeouts don't demonstrate a violation, so they keep the operations.
+		return porcupine.CheckOperationsTimeout(model, candidate, remaining) == porcupine.Illegal
+	}
+
+	var removable int
+	for _, operation := range history {
+		if readOnly(operation) {
+			removable++
+		}
+	}
+	for chunk := removable / 2; chunk > 0 && time.Now().Before(deadline); chunk /= 2 {
+		// Each pass removes chunks of up to chunk read-only operations,
+		// keeping each removal only if the history still fails.
+		for start := 0; start < len(history); {
+			candidate, next := withoutReadOnly(history, start, chunk)
+			if len(candidate) == len(history) {
+				break
+			}
+			if fails(candidate) {
+				history = candidate
+				continue // retry from the same position
+			}
+			start = next
+		}
+	}
+	return history
+}
+
+// withoutReadOnly returns the history without the first n read-only
+// operations at or after index start, along with the index just past the
+// last one removed.
+func withoutReadOnly(history []porcupine.Operation, start, n int) ([]porcupine.Operation, int) {
+	candidate := make([]porcupine.Operation, 0, len(history))
+	candidate = append(candidate, history[:start]...)
+	i := start
+	for ; i < len(history) && n > 0; i++ {
+		if readOnly(history[i]) {
+			n--
+			continue
+		}
+		candidate = append(candidate, history[i])
+	}
+	next := i
+	candidate = append(candidate, history[i:]...)
+	return candidate, next
+}
+
+// readOnly reports whether an operation certainly left its key unchanged.
+func readOnly(operation porcupine.Operation) bool {
+	if txn, ok := operation.Input.(transaction); ok {
+		return !slices.ContainsFunc(txn, func(operation porcupine.Operation) bool {
+			return !readOnly(operation)
+		})
+	}
+	in := operation.Input.(*args)
+	out := operation.Output.(*rets)
+	switch in.Op {
+	case op.Get, op.GetEx, op.Strlen, op.Exists, op.LRange, op.LLen, op.SMembers, op.SIsMember, op.SCard,
+		op.ZScore, op.ZCard, op.ZRange:
+		return true
+	case op.SAdd, op.SRem, op.ZRem:
+		return out.Err == nil && out.Value == "0"
+	case op.GetDel, op.LPop, op.RPop:
+		return errors.Is(out.Err, client.ErrNotFound)
+	case op.Set:
+		return in.Cond != "" && out.Err == nil && !out.Applied
+	case op.Exec:
+		return out.Err == nil && !out.Applied
+	}
+	return false
+}
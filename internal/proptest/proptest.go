@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anishathalye/porcupine"
@@ -20,7 +23,9 @@ import (
 // violations.
 //
 // If the Error indicates a consistency violation, Visualization will be an
-// interactive, self-contained HTML document demonstrating the violation.
+// interactive, self-contained HTML document demonstrating the violation. To
+// keep it readable, the visualized history is minimized: reads that aren't
+// needed to demonstrate the violation are left out.
 type Error struct {
 	Key           string
 	TimedOut      bool
@@ -35,17 +40,38 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%s: history not linearizable", e.Key)
 }
 
+// ErrPartialWrite is returned from CheckWorkloads, wrapped, when a read
+// observed some but not all of the keys written by an MSET.
+var ErrPartialWrite = errors.New("observed a partial MSET")
+
 // Arguments for calling a client; used in the porcupine model below.
 type args struct {
 	Op    op.Op
 	Key   string
 	Value string
+	// Cond is "NX" or "XX" for conditional SETs.
+	Cond string
+	// Keys are the keys used by MGET, MSET, and multi-key EXISTS. MSET sets
+	// them all to Value. For KEYS, Value is the pattern and Keys are all the
+	// keys it could match.
+	Keys []string
+	// Score is the score ZADD gives the member in Value.
+	Score float64
+	// Batch numbers the batches a client sends several operations in, counting
+	// from one. Zero means the operation is sent alone. Batches are pipelined,
+	// or run in MULTI/EXEC transactions if Atomic is set.
+	Batch  int
+	Atomic bool
 }
 
 // Results from calling a client; used in the porcupine model below.
 type rets struct {
-	Value string
-	Err   error
+	Value  string   // from GET or ZSCORE, or a count from EXISTS, INCRBY, and collection commands
+	Values []string // from MGET, with missing keys represented by "", LRANGE, SMEMBERS, ZRANGE, or KEYS
+	// Applied reports whether a conditional SET wrote its value, or whether
+	// a transaction was committed.
+	Applied bool
+	Err     error
 }
 
 // GenWorkloads generates a workload for a variable number of clients.
@@ -59,8 +85,11 @@ func GenWorkloads(r *rand.Rand) [][]porcupine.Operation {
 	numClientsPerKey := r.IntN(3) + 2 // 2-4 clients per key
 	opsPerClient := r.IntN(128) + 128 // 128-255 operations per client
 	workloads := make([][]porcupine.Operation, len(keys)*numClientsPerKey)
-	// Bias the workload towards GETs, which makes checking for linearizability
-	// faster.
+	// Bias the workload towards reads, which makes checking for
+	// linearizability faster. EXISTS and KEYS observe whether keys exist
+	// without reading their values, and KEYS observes all the keys at once.
+	// GETDEL, GETEX, GETSET, and APPEND all read and write the key in one
+	// command, and STRLEN reads it without returning the value.
 	ops := []op.Op{
 		op.Get,
 		op.Get,
@@ -68,78 +97,429 @@ func GenWorkloads(r *rand.Rand) [][]porcupine.Operation {
 		op.Set,
 		op.Set,
 		op.Del,
+		op.GetDel,
+		op.GetEx,
+		op.GetSet,
+		op.Append,
+		op.Strlen,
+		op.Exists,
+		op.Keys,
 	}
 	for clientId := range workloads {
 		key := keys[clientId%len(keys)]
 		workload := make([]porcupine.Operation, opsPerClient)
+		for i := range workload {
+			in := &args{
+				Op:    ops[r.IntN(len(ops))],
+				Key:   key,
+				Value: genString(r),
+			}
+			switch in.Op {
+			case op.Set:
+				// Half of SETs are conditional.
+				in.Cond = []string{"", "", "NX", "XX"}[r.IntN(4)]
+			case op.Keys:
+				in.Key, in.Value, in.Keys = "", "key*", keys
+			}
+			workload[i] = porcupine.Operation{
+				ClientId: clientId,
+				Input:    in,
+				Output:   &rets{},
+			}
+		}
+		workloads[clientId] = workload
+	}
+
+	// A few more clients use MGET and MSET on a separate group of keys. MSET
+	// always writes the same value to every key in the group, so any MGET
+	// that sees different values, or EXISTS that counts only some of the keys,
+	// has observed a partial write. The hash tag keeps the group in one shard.
+	group := []string{"{group}0", "{group}1"}
+	multiOps := []op.Op{op.MGet, op.MGet, op.MSet, op.Exists}
+	for range r.IntN(2) + 2 { // 2-3 clients
+		clientId := len(workloads)
+		workload := make([]porcupine.Operation, opsPerClient)
 		for i := range workload {
 			workload[i] = porcupine.Operation{
 				ClientId: clientId,
 				Input: &args{
-					Op:    ops[r.IntN(len(ops))],
-					Key:   key,
+					Op:    multiOps[r.IntN(len(multiOps))],
+					Keys:  group,
 					Value: genString(r),
 				},
 				Output: &rets{},
 			}
 		}
-		workloads[clientId] = workload
+		workloads = append(workloads, workload)
+	}
+
+	// Finally, a few clients race read-modify-write INCRBYs on a counter,
+	// occasionally resetting it. Some increments read the counter and write
+	// it back in a WATCH transaction instead, which must abort if the counter
+	// changes in between.
+	counterOps := []op.Op{op.Get, op.IncrBy, op.IncrBy, op.Exec, op.Exec, op.Set, op.Del}
+	for range r.IntN(2) + 2 { // 2-3 clients
+		clientId := len(workloads)
+		workload := make([]porcupine.Operation, opsPerClient)
+		for i := range workload {
+			o := counterOps[r.IntN(len(counterOps))]
+			val := strconv.Itoa(r.IntN(100))
+			if o == op.IncrBy || o == op.Exec {
+				val = strconv.Itoa(r.IntN(11) - 5)
+			}
+			workload[i] = porcupine.Operation{
+				ClientId: clientId,
+				Input:    &args{Op: o, Key: "counter", Value: val},
+				Output:   &rets{},
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	// A few more clients push onto and pop from both ends of a list, reading
+	// the whole list with LRANGE.
+	listOps := []op.Op{op.LPush, op.RPush, op.LPop, op.RPop, op.LRange, op.LLen}
+	for range r.IntN(2) + 2 { // 2-3 clients
+		clientId := len(workloads)
+		workload := make([]porcupine.Operation, opsPerClient)
+		for i := range workload {
+			workload[i] = porcupine.Operation{
+				ClientId: clientId,
+				Input:    &args{Op: listOps[r.IntN(len(listOps))], Key: "list", Value: genString(r)},
+				Output:   &rets{},
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	// A few more clients add and remove members of a set. Members come from a
+	// small pool, so that clients often add members that already exist and
+	// remove members that don't.
+	setOps := []op.Op{op.SAdd, op.SRem, op.SMembers, op.SIsMember, op.SCard}
+	members := make([]string, r.IntN(3)+2) // 2-4 members
+	for i := range members {
+		members[i] = genString(r)
+	}
+	for range r.IntN(2) + 2 { // 2-3 clients
+		clientId := len(workloads)
+		workload := make([]porcupine.Operation, opsPerClient)
+		for i := range workload {
+			workload[i] = porcupine.Operation{
+				ClientId: clientId,
+				Input:    &args{Op: setOps[r.IntN(len(setOps))], Key: "set", Value: members[r.IntN(len(members))]},
+				Output:   &rets{},
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	// Finally, a few clients keep a leaderboard in a sorted set. Scores come
+	// from a small range, so members often tie and are ordered by name.
+	zsetOps := []op.Op{op.ZAdd, op.ZRem, op.ZScore, op.ZCard, op.ZRange}
+	for range r.IntN(2) + 2 { // 2-3 clients
+		clientId := len(workloads)
+		workload := make([]porcupine.Operation, opsPerClient)
+		for i := range workload {
+			workload[i] = porcupine.Operation{
+				ClientId: clientId,
+				Input: &args{
+					Op:    zsetOps[r.IntN(len(zsetOps))],
+					Key:   "zset",
+					Value: members[r.IntN(len(members))],
+					Score: float64(r.IntN(5)),
+				},
+				Output: &rets{},
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	// Each client sends its operations one at a time, pipelines them, or runs
+	// them in transactions, so that batched commands face the same checks as
+	// single ones.
+	for _, workload := range workloads {
+		switch r.IntN(3) {
+		case 1:
+			batch(r, workload, false)
+		case 2:
+			batch(r, workload, true)
+		}
 	}
 	return workloads
 }
 
 // RunWorkload runs a workload on a client.
 func RunWorkload(logger *slog.Logger, client *client.Client, workload []porcupine.Operation) {
-	for i := range workload {
-		if i%100 == 0 {
+	var logged int
+	for i := 0; i < len(workload); {
+		if i >= logged {
 			logger.Debug("running workload", "ops_complete", i, "ops_left", len(workload)-i)
+			logged += 100
 		}
 		in := workload[i].Input.(*args)
+		if in.Batch != 0 {
+			end := i + 1
+			for end < len(workload) && workload[end].Input.(*args).Batch == in.Batch {
+				end++
+			}
+			runBatch(client, workload[i:end])
+			i = end
+			continue
+		}
 		out := workload[i].Output.(*rets)
 		workload[i].Call = time.Now().UnixNano()
-		switch in.Op {
-		case op.Get:
-			out.Value, out.Err = client.Get(in.Key)
-		case op.Set:
-			out.Err = client.Set(in.Key, in.Value)
-		case op.Del:
-			out.Err = client.Del(in.Key)
+		call(client, in, out)
+		workload[i].Return = time.Now().UnixNano()
+		i++
+	}
+}
+
+// call executes a single operation, storing its result in out.
+func call(c *client.Client, in *args, out *rets) {
+	switch in.Op {
+	case op.Get:
+		out.Value, out.Err = c.Get(in.Key)
+	case op.GetDel:
+		out.Value, out.Err = c.GetDel(in.Key)
+	case op.GetEx:
+		// The model doesn't track TTLs, so GETEX only removes them.
+		out.Value, out.Err = c.GetEx(in.Key, 0)
+	case op.GetSet:
+		out.Value, out.Err = c.GetSet(in.Key, in.Value)
+	case op.Append:
+		var n int
+		n, out.Err = c.Append(in.Key, in.Value)
+		out.Value = strconv.Itoa(n)
+	case op.Strlen:
+		var n int
+		n, out.Err = c.Strlen(in.Key)
+		out.Value = strconv.Itoa(n)
+	case op.Set:
+		switch in.Cond {
+		case "NX":
+			out.Applied, out.Err = c.SetNX(in.Key, in.Value)
+		case "XX":
+			out.Applied, out.Err = c.SetXX(in.Key, in.Value)
 		default:
-			panic(fmt.Sprintf("run workload: unexpected operation %v", in.Op))
+			out.Err = c.Set(in.Key, in.Value)
 		}
-		workload[i].Return = time.Now().UnixNano()
+	case op.Del:
+		out.Err = c.Del(in.Key)
+	case op.IncrBy:
+		delta, err := strconv.ParseInt(in.Value, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("call: invalid delta %q", in.Value))
+		}
+		var n int64
+		n, out.Err = c.IncrBy(in.Key, delta)
+		out.Value = strconv.FormatInt(n, 10)
+	case op.Exec:
+		delta, err := strconv.ParseInt(in.Value, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("call: invalid delta %q", in.Value))
+		}
+		out.Value, out.Applied, out.Err = checkAndIncr(c, in.Key, delta)
+	case op.MGet:
+		out.Values, out.Err = c.MGet(in.Keys...)
+	case op.MSet:
+		items := make(map[string]string, len(in.Keys))
+		for _, key := range in.Keys {
+			items[key] = in.Value
+		}
+		out.Err = c.MSet(items)
+	case op.Exists:
+		keys := in.Keys
+		if keys == nil {
+			keys = []string{in.Key}
+		}
+		var n int
+		n, out.Err = c.Exists(keys...)
+		out.Value = strconv.Itoa(n)
+	case op.Keys:
+		out.Values, out.Err = c.Keys(in.Value)
+	case op.LPush, op.RPush:
+		push := c.LPush
+		if in.Op == op.RPush {
+			push = c.RPush
+		}
+		var n int
+		n, out.Err = push(in.Key, in.Value)
+		out.Value = strconv.Itoa(n)
+	case op.LPop:
+		out.Value, out.Err = c.LPop(in.Key)
+	case op.RPop:
+		out.Value, out.Err = c.RPop(in.Key)
+	case op.LRange:
+		out.Values, out.Err = c.LRange(in.Key, 0, -1)
+	case op.LLen:
+		var n int
+		n, out.Err = c.LLen(in.Key)
+		out.Value = strconv.Itoa(n)
+	case op.SAdd, op.SRem:
+		update := c.SAdd
+		if in.Op == op.SRem {
+			update = c.SRem
+		}
+		var n int
+		n, out.Err = update(in.Key, in.Value)
+		out.Value = strconv.Itoa(n)
+	case op.SMembers:
+		out.Values, out.Err = c.SMembers(in.Key)
+	case op.SIsMember:
+		var ok bool
+		ok, out.Err = c.SIsMember(in.Key, in.Value)
+		out.Value = boolInt(ok)
+	case op.SCard:
+		var n int
+		n, out.Err = c.SCard(in.Key)
+		out.Value = strconv.Itoa(n)
+	case op.ZAdd:
+		var n int
+		n, out.Err = c.ZAdd(in.Key, client.ZMember{Member: in.Value, Score: in.Score})
+		out.Value = strconv.Itoa(n)
+	case op.ZRem:
+		var n int
+		n, out.Err = c.ZRem(in.Key, in.Value)
+		out.Value = strconv.Itoa(n)
+	case op.ZScore:
+		var score float64
+		score, out.Err = c.ZScore(in.Key, in.Value)
+		if out.Err == nil {
+			out.Value = formatScore(score)
+		}
+	case op.ZCard:
+		var n int
+		n, out.Err = c.ZCard(in.Key)
+		out.Value = strconv.Itoa(n)
+	case op.ZRange:
+		out.Values, out.Err = c.ZRange(in.Key, 0, -1)
+	default:
+		panic(fmt.Sprintf("call: unexpected operation %v", in.Op))
 	}
 }
 
+// checkAndIncr increments the integer stored at key with a check-and-set
+// transaction: it watches the key, reads it, and writes the sum in MULTI and
+// EXEC. It returns the value it tried to write and whether EXEC applied it.
+func checkAndIncr(c *client.Client, key string, delta int64) (string, bool, error) {
+	if err := c.Watch(key); err != nil {
+		return "", false, err
+	}
+	var current int64
+	val, err := c.Get(key)
+	if err == nil {
+		current, err = strconv.ParseInt(val, 10, 64)
+	}
+	if err != nil && !errors.Is(err, client.ErrNotFound) {
+		_ = c.Unwatch()
+		return "", false, err
+	}
+	next := strconv.FormatInt(current+delta, 10)
+	res, err := c.Exec(client.Command{Name: "SET", Args: []any{key, next}})
+	if errors.Is(err, client.ErrAborted) {
+		return next, false, nil
+	}
+	if err != nil {
+		return next, false, err
+	}
+	if res[0] != "OK" {
+		return next, false, fmt.Errorf("unexpected set response in transaction: %v", res[0])
+	}
+	return next, true, nil
+}
+
+// Stats counts the operations in workloads that have been run.
+type Stats struct {
+	Ops       map[string]int // by command, like "get" or "lpush"
+	Total     int
+	Succeeded int
+}
+
+// SuccessRate returns the fraction of operations that succeeded.
+func (s Stats) SuccessRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Succeeded) / float64(s.Total)
+}
+
+// CountOps summarizes workloads that have been run by RunWorkload.
+func CountOps(workloads [][]porcupine.Operation) Stats {
+	stats := Stats{Ops: make(map[string]int)}
+	for _, history := range workloads {
+		for _, operation := range history {
+			stats.Ops[string(operation.Input.(*args).Op)]++
+			stats.Total++
+			if operation.Output.(*rets).Err == nil {
+				stats.Succeeded++
+			}
+		}
+	}
+	return stats
+}
+
 // CheckWorkloads verifies that the real-world behavior of the Valthree server,
 // as seen by RunWorkload, satisfies strong serializable consistency. When no
 // consistency anomalies are found, CheckWorkloads also returns the percentage
 // of operations that succeeded (as a measure of liveness).
 //
 // Verification is NP-hard, so it may time out. If verification fails or times
-// out, the returned error will be an *Error.
+// out, the returned error will be an *Error, unless a read observed a partial
+// MSET, in which case it wraps ErrPartialWrite.
 func CheckWorkloads(deadline time.Duration, workloads [][]porcupine.Operation) (float64, error) {
 	// Valthree keys are linearizable. If we've broken something, it's painful to
 	// debug the whole workload. Instead, partition the execution history by key
 	// and check each partition individually. (Porcupine supports this via
 	// Model.Partition, but we have to do it ourselves if we also want to
 	// restrict the visualization to a single key.)
+	//
+	// Multi-key operations are split into one operation per key, so each key
+	// is still checked for linearizability. Separately, we check that every
+	// MGET saw all or none of each MSET. Then, within each key's history, the
+	// operations from a transaction are grouped back into one, which must
+	// take effect all at once.
 	partitioned := make(map[string][]porcupine.Operation)
 	var successes, total float64
 	for _, history := range workloads {
-		for _, op := range history {
+		for _, operation := range history {
 			total++
-			if op.Output.(*rets).Err == nil {
+			in := operation.Input.(*args)
+			out := operation.Output.(*rets)
+			if out.Err == nil {
 				successes++
 			}
-			in := op.Input.(*args)
-			partitioned[in.Key] = append(partitioned[in.Key], op)
+			if in.Op == op.MGet && out.Err == nil {
+				for _, val := range out.Values {
+					if val != out.Values[0] {
+						return 0, fmt.Errorf("MGET %v %w: %q", in.Keys, ErrPartialWrite, out.Values)
+					}
+				}
+			}
+			if in.Op == op.Exists && in.Keys != nil && out.Err == nil {
+				if n := out.Value; n != "0" && n != strconv.Itoa(len(in.Keys)) {
+					return 0, fmt.Errorf("EXISTS %v %w: %s keys exist", in.Keys, ErrPartialWrite, n)
+				}
+			}
+			for _, single := range split(operation) {
+				key := single.Input.(*args).Key
+				partitioned[key] = append(partitioned[key], single)
+			}
 		}
 	}
 	progress := successes / total
 
 	for key, history := range partitioned {
 		model := newModel()
+		switch o := history[0].Input.(*args).Op; {
+		case isListOp(o):
+			model = newListModel()
+		case isSetOp(o):
+			model = newSetModel()
+		case isZSetOp(o):
+			model = newZSetModel()
+		}
+		model = withTransactions(model)
+		history = groupTransactions(history)
 		cr, info := porcupine.CheckOperationsVerbose(model, history, deadline)
 		if cr == porcupine.Ok {
 			continue
@@ -147,6 +527,12 @@ func CheckWorkloads(deadline time.Duration, workloads [][]porcupine.Operation) (
 		if cr == porcupine.Unknown {
 			return 0, &Error{Key: key, TimedOut: true}
 		}
+		// Visualize a smaller history that still fails, if there is one.
+		if shrunk := minimize(model, history); len(shrunk) < len(history) {
+			if cr, shrunkInfo := porcupine.CheckOperationsVerbose(model, shrunk, deadline); cr == porcupine.Illegal {
+				info = shrunkInfo
+			}
+		}
 		var buf bytes.Buffer
 		if err := porcupine.Visualize(model, info, &buf); err != nil {
 			return 0, err
@@ -156,6 +542,58 @@ func CheckWorkloads(deadline time.Duration, workloads [][]porcupine.Operation) (
 	return progress, nil
 }
 
+// split turns a multi-key operation into equivalent single-key operations.
+// Single-key operations are returned unchanged.
+func split(operation porcupine.Operation) []porcupine.Operation {
+	in := operation.Input.(*args)
+	out := operation.Output.(*rets)
+	switch {
+	case in.Op == op.MGet, in.Op == op.MSet:
+	case in.Op == op.Exists && in.Keys != nil:
+	case in.Op == op.Keys:
+	default:
+		return []porcupine.Operation{operation}
+	}
+	ops := make([]porcupine.Operation, len(in.Keys))
+	for i, key := range in.Keys {
+		single := operation
+		switch in.Op {
+		case op.MGet:
+			single.Input = &args{Op: op.Get, Key: key}
+			r := &rets{Err: out.Err}
+			if out.Err == nil {
+				r.Value = out.Values[i]
+				if r.Value == "" {
+					r.Err = client.ErrNotFound
+				}
+			}
+			single.Output = r
+		case op.MSet:
+			single.Input = &args{Op: op.Set, Key: key, Value: in.Value}
+			single.Output = &rets{Err: out.Err}
+		case op.Exists:
+			// The count is all or nothing, which CheckWorkloads verifies.
+			exists := "0"
+			if out.Value != "0" {
+				exists = "1"
+			}
+			single.Input = &args{Op: op.Exists, Key: key}
+			single.Output = &rets{Value: exists, Err: out.Err}
+		case op.Keys:
+			exists := "0"
+			if slices.Contains(out.Values, key) {
+				exists = "1"
+			}
+			single.Input = &args{Op: op.Exists, Key: key}
+			single.Output = &rets{Value: exists, Err: out.Err}
+		}
+		single.Input.(*args).Batch = in.Batch
+		single.Input.(*args).Atomic = in.Atomic
+		ops[i] = single
+	}
+	return ops
+}
+
 func newModel() porcupine.Model {
 	// Models the state of a single value in the DB as a *string, with nil
 	// representing a missing key.
@@ -166,41 +604,94 @@ func newModel() porcupine.Model {
 			out := output.(*rets)
 			db := state.(*string)
 			switch in.Op {
-			case op.Get:
-				if out.Err != nil {
-					if !errors.Is(out.Err, client.ErrNotFound) {
-						// Errors apart from ErrNotFound are acceptable regardless of DB
-						// state. Expected DB state is unchanged.
-						return []any{db}
-					}
-					if db == nil {
-						// GET returned ErrNotFound and we expected the key to be missing.
-						// Expected DB state is unchanged.
-						return []any{db}
-					}
-					// GET returned ErrNotFound but we expected the key to be present.
-					// After this anomaly, no subsequent states are valid.
+			case op.Get, op.GetEx:
+				// GETEX only changes the key's TTL, which the model ignores, so
+				// it's just a GET.
+				return stepGet(db, out)
+			case op.GetDel:
+				if out.Err != nil && !errors.Is(out.Err, client.ErrNotFound) {
+					// GETDEL may have deleted the key, whatever it held.
+					return []any{db, (*string)(nil)}
+				}
+				// Otherwise GETDEL must have read the key like GET, and it's
+				// now certainly missing.
+				if stepGet(db, out) == nil {
 					return nil
 				}
-				if db == nil {
-					// GET returned a value, but we expected the key to be missing.
+				return []any{(*string)(nil)}
+			case op.GetSet:
+				newValue := in.Value
+				if out.Err != nil && !errors.Is(out.Err, client.ErrNotFound) {
+					// GETSET may have written, whatever the key held.
+					return []any{db, &newValue}
+				}
+				// Otherwise GETSET must have read the key like GET before
+				// replacing it.
+				if stepGet(db, out) == nil {
 					return nil
 				}
-				if *db == out.Value {
-					// GET returned the expected value. Expected DB state is unchanged.
+				return []any{&newValue}
+			case op.Append:
+				var newValue string
+				if db != nil {
+					newValue = *db
+				}
+				newValue += in.Value
+				if out.Err != nil {
+					// Append may have succeeded.
+					return []any{db, &newValue}
+				}
+				if out.Value != strconv.Itoa(len(newValue)) {
+					// APPEND returned the wrong length.
+					return nil
+				}
+				return []any{&newValue}
+			case op.Strlen:
+				length := "0"
+				if db != nil {
+					length = strconv.Itoa(len(*db))
+				}
+				if out.Err != nil || out.Value == length {
 					return []any{db}
 				}
-				// GET returned a value that doesn't match expectations. No further
-				// states are valid.
 				return nil
 			case op.Set:
 				newValue := in.Value
+				if in.Cond != "" {
+					// NX writes only if the key is missing, and XX only if it's
+					// present.
+					applies := (db == nil) == (in.Cond == "NX")
+					if out.Err != nil {
+						if applies {
+							return []any{db, &newValue}
+						}
+						return []any{db}
+					}
+					if out.Applied != applies {
+						// SET wrote when it shouldn't have, or vice versa.
+						return nil
+					}
+					if applies {
+						return []any{&newValue}
+					}
+					return []any{db}
+				}
 				if out.Err != nil {
 					// Write may have succeeded, so we expand the set of valid values.
 					return []any{db, &newValue}
 				}
 				// Write definitely succeeded, so there's only one valid value.
 				return []any{&newValue}
+			case op.Exists:
+				exists := "0"
+				if db != nil {
+					exists = "1"
+				}
+				if out.Err != nil || out.Value == exists {
+					// EXISTS doesn't change the expected DB state.
+					return []any{db}
+				}
+				return nil
 			case op.Del:
 				if out.Err != nil {
 					// Delete may have succeeded.
@@ -208,6 +699,59 @@ func newModel() porcupine.Model {
 				}
 				// Delete definitely succeeded, so the key must be missing.
 				return []any{(*string)(nil)}
+			case op.IncrBy:
+				// Missing keys count as zero, and non-integer values can't be
+				// incremented.
+				var current int64
+				if db != nil {
+					var err error
+					current, err = strconv.ParseInt(*db, 10, 64)
+					if err != nil {
+						if out.Err != nil {
+							return []any{db}
+						}
+						return nil
+					}
+				}
+				delta, _ := strconv.ParseInt(in.Value, 10, 64)
+				newValue := strconv.FormatInt(current+delta, 10)
+				if out.Err != nil {
+					// Increment may have succeeded.
+					return []any{db, &newValue}
+				}
+				if out.Value != newValue {
+					// INCRBY returned an unexpected result.
+					return nil
+				}
+				return []any{&newValue}
+			case op.Exec:
+				// A committed check-and-set increment behaves like INCRBY,
+				// since the counter can't have changed since it was read. An
+				// aborted one writes nothing.
+				newValue := out.Value
+				if out.Err != nil {
+					if newValue == "" {
+						// The transaction failed before EXEC.
+						return []any{db}
+					}
+					return []any{db, &newValue}
+				}
+				if !out.Applied {
+					return []any{db}
+				}
+				var current int64
+				if db != nil {
+					var err error
+					if current, err = strconv.ParseInt(*db, 10, 64); err != nil {
+						return nil
+					}
+				}
+				delta, _ := strconv.ParseInt(in.Value, 10, 64)
+				if strconv.FormatInt(current+delta, 10) != newValue {
+					// EXEC applied a write based on a stale read.
+					return nil
+				}
+				return []any{&newValue}
 			default:
 				panic(fmt.Sprintf("step model: unexpected operation %v", in.Op))
 			}
@@ -234,11 +778,45 @@ func newModel() porcupine.Model {
 	return nondeterministic.ToModel()
 }
 
+// stepGet steps the model through a GET, returning the possible states after
+// it or nil if its result is impossible.
+func stepGet(db *string, out *rets) []any {
+	if out.Err != nil {
+		if !errors.Is(out.Err, client.ErrNotFound) {
+			// Errors apart from ErrNotFound are acceptable regardless of DB
+			// state. Expected DB state is unchanged.
+			return []any{db}
+		}
+		if db == nil {
+			// GET returned ErrNotFound and we expected the key to be missing.
+			// Expected DB state is unchanged.
+			return []any{db}
+		}
+		// GET returned ErrNotFound but we expected the key to be present.
+		// After this anomaly, no subsequent states are valid.
+		return nil
+	}
+	if db == nil {
+		// GET returned a value, but we expected the key to be missing.
+		return nil
+	}
+	if *db == out.Value {
+		// GET returned the expected value. Expected DB state is unchanged.
+		return []any{db}
+	}
+	// GET returned a value that doesn't match expectations. No further
+	// states are valid.
+	return nil
+}
+
 func describe(in *args, out *rets) string {
 	result := out.Value
 	if result == "" {
 		result = "OK"
 	}
+	if (in.Cond != "" || in.Op == op.Exec) && !out.Applied {
+		result = "nil"
+	}
 	if out.Err != nil {
 		// Extreme brevity improves the visualization.
 		result = "ERR"
@@ -247,10 +825,72 @@ func describe(in *args, out *rets) string {
 	switch in.Op {
 	case op.Get:
 		return fmt.Sprintf("GET %s = %s", in.Key, result)
+	case op.GetDel, op.GetEx:
+		if errors.Is(out.Err, client.ErrNotFound) {
+			result = "nil"
+		}
+		return fmt.Sprintf("%s %s = %s", strings.ToUpper(string(in.Op)), in.Key, result)
+	case op.GetSet:
+		if errors.Is(out.Err, client.ErrNotFound) {
+			result = "nil"
+		}
+		return fmt.Sprintf("GETSET %s %s = %s", in.Key, in.Value, result)
+	case op.Append:
+		return fmt.Sprintf("APPEND %s %s = %s", in.Key, in.Value, result)
+	case op.Strlen:
+		return fmt.Sprintf("STRLEN %s = %s", in.Key, result)
 	case op.Set:
+		if in.Cond != "" {
+			return fmt.Sprintf("SET %s %s %s = %s", in.Key, in.Value, in.Cond, result)
+		}
 		return fmt.Sprintf("SET %s %s = %s", in.Key, in.Value, result)
 	case op.Del:
 		return fmt.Sprintf("DEL %s = %s", in.Key, result)
+	case op.Exists:
+		return fmt.Sprintf("EXISTS %s = %s", in.Key, result)
+	case op.IncrBy:
+		return fmt.Sprintf("INCRBY %s %s = %s", in.Key, in.Value, result)
+	case op.Exec:
+		return fmt.Sprintf("WATCH+SET %s +%s = %s", in.Key, in.Value, result)
+	case op.LPush, op.RPush:
+		return fmt.Sprintf("%s %s %s = %s", strings.ToUpper(string(in.Op)), in.Key, in.Value, result)
+	case op.LPop, op.RPop:
+		if errors.Is(out.Err, client.ErrNotFound) {
+			result = "nil"
+		}
+		return fmt.Sprintf("%s %s = %s", strings.ToUpper(string(in.Op)), in.Key, result)
+	case op.LRange:
+		if out.Err == nil {
+			result = "[" + strings.Join(out.Values, " ") + "]"
+		}
+		return fmt.Sprintf("LRANGE %s 0 -1 = %s", in.Key, result)
+	case op.LLen:
+		return fmt.Sprintf("LLEN %s = %s", in.Key, result)
+	case op.SAdd, op.SRem, op.SIsMember:
+		return fmt.Sprintf("%s %s %s = %s", strings.ToUpper(string(in.Op)), in.Key, in.Value, result)
+	case op.SMembers:
+		if out.Err == nil {
+			result = "{" + strings.Join(out.Values, " ") + "}"
+		}
+		return fmt.Sprintf("SMEMBERS %s = %s", in.Key, result)
+	case op.SCard:
+		return fmt.Sprintf("SCARD %s = %s", in.Key, result)
+	case op.ZAdd:
+		return fmt.Sprintf("ZADD %s %s %s = %s", in.Key, formatScore(in.Score), in.Value, result)
+	case op.ZRem:
+		return fmt.Sprintf("ZREM %s %s = %s", in.Key, in.Value, result)
+	case op.ZScore:
+		if errors.Is(out.Err, client.ErrNotFound) {
+			result = "nil"
+		}
+		return fmt.Sprintf("ZSCORE %s %s = %s", in.Key, in.Value, result)
+	case op.ZCard:
+		return fmt.Sprintf("ZCARD %s = %s", in.Key, result)
+	case op.ZRange:
+		if out.Err == nil {
+			result = "[" + strings.Join(out.Values, " ") + "]"
+		}
+		return fmt.Sprintf("ZRANGE %s 0 -1 = %s", in.Key, result)
 	default:
 		panic(fmt.Sprintf("describe: unexpected operation %v", in.Op))
 	}
@@ -0,0 +1,126 @@
+package proptest
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// Recorder wraps a client, recording the timing and result of every command
+// so that ordinary application tests can verify their own traffic with
+// CheckWorkloads:
+//
+//	a, b := proptest.NewRecorder(c1, 0), proptest.NewRecorder(c2, 1)
+//	// ... exercise the application using a and b ...
+//	_, err := proptest.CheckWorkloads(time.Minute, [][]porcupine.Operation{
+//		a.History(),
+//		b.History(),
+//	})
+//
+// Unlike generated workloads, recorded traffic may MSET different values to
+// each key, so multi-key commands are recorded as one operation per key. Each
+// key is still checked for linearizability, but MGETs aren't checked for
+// partial MSETs.
+//
+// Like clients, Recorders are not safe for concurrent use.
+type Recorder struct {
+	client   *client.Client
+	clientID int
+	history  []porcupine.Operation
+}
+
+// NewRecorder wraps a client. The client ID identifies the client's
+// operations in visualizations, so each Recorder should have a different one.
+func NewRecorder(c *client.Client, clientID int) *Recorder {
+	return &Recorder{client: c, clientID: clientID}
+}
+
+// History returns the operations recorded so far.
+func (r *Recorder) History() []porcupine.Operation {
+	return append([]porcupine.Operation(nil), r.history...)
+}
+
+// Get calls Client.Get and records the result.
+func (r *Recorder) Get(key string) (string, error) {
+	out := r.record(&args{Op: op.Get, Key: key})
+	return out.Value, out.Err
+}
+
+// Set calls Client.Set and records the result.
+func (r *Recorder) Set(key, value string) error {
+	return r.record(&args{Op: op.Set, Key: key, Value: value}).Err
+}
+
+// SetNX calls Client.SetNX and records the result.
+func (r *Recorder) SetNX(key, value string) (bool, error) {
+	out := r.record(&args{Op: op.Set, Key: key, Value: value, Cond: "NX"})
+	return out.Applied, out.Err
+}
+
+// SetXX calls Client.SetXX and records the result.
+func (r *Recorder) SetXX(key, value string) (bool, error) {
+	out := r.record(&args{Op: op.Set, Key: key, Value: value, Cond: "XX"})
+	return out.Applied, out.Err
+}
+
+// Del calls Client.Del and records the result.
+func (r *Recorder) Del(key string) error {
+	return r.record(&args{Op: op.Del, Key: key}).Err
+}
+
+// GetDel calls Client.GetDel and records the result.
+func (r *Recorder) GetDel(key string) (string, error) {
+	out := r.record(&args{Op: op.GetDel, Key: key})
+	return out.Value, out.Err
+}
+
+// IncrBy calls Client.IncrBy and records the result.
+func (r *Recorder) IncrBy(key string, delta int64) (int64, error) {
+	out := r.record(&args{Op: op.IncrBy, Key: key, Value: strconv.FormatInt(delta, 10)})
+	n, _ := strconv.ParseInt(out.Value, 10, 64)
+	return n, out.Err
+}
+
+// MGet calls Client.MGet and records a GET for each key.
+func (r *Recorder) MGet(keys ...string) ([]string, error) {
+	operation := r.run(&args{Op: op.MGet, Keys: keys})
+	r.history = append(r.history, split(operation)...)
+	out := operation.Output.(*rets)
+	return out.Values, out.Err
+}
+
+// MSet calls Client.MSet and records a SET for each key.
+func (r *Recorder) MSet(items map[string]string) error {
+	start := time.Now().UnixNano()
+	err := r.client.MSet(items)
+	end := time.Now().UnixNano()
+	for key, value := range items {
+		r.history = append(r.history, porcupine.Operation{
+			ClientId: r.clientID,
+			Input:    &args{Op: op.Set, Key: key, Value: value},
+			Call:     start,
+			Output:   &rets{Err: err},
+			Return:   end,
+		})
+	}
+	return err
+}
+
+func (r *Recorder) record(in *args) *rets {
+	operation := r.run(in)
+	r.history = append(r.history, operation)
+	return operation.Output.(*rets)
+}
+
+// run executes a single operation without recording it.
+func (r *Recorder) run(in *args) porcupine.Operation {
+	out := &rets{}
+	operation := porcupine.Operation{ClientId: r.clientID, Input: in, Output: out}
+	operation.Call = time.Now().UnixNano()
+	call(r.client, in, out)
+	operation.Return = time.Now().UnixNano()
+	return operation
+}
@@ -0,0 +1,92 @@
+package proptest
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// isSetOp reports whether an operation works on sets.
+func isSetOp(o op.Op) bool {
+	switch o {
+	case op.SAdd, op.SRem, op.SMembers, op.SIsMember, op.SCard:
+		return true
+	}
+	return false
+}
+
+func newSetModel() porcupine.Model {
+	// Models the state of a single set as a sorted []string, with a missing
+	// key represented by an empty set. Like the list model, steps never modify
+	// a state in place.
+	nondeterministic := &porcupine.NondeterministicModel{
+		Init: func() []any { return []any{[]string(nil)} },
+		Step: func(state, input, output any) []any {
+			in := input.(*args)
+			out := output.(*rets)
+			members := state.([]string)
+			i, found := slices.BinarySearch(members, in.Value)
+			switch in.Op {
+			case op.SAdd, op.SRem:
+				next := members
+				if in.Op == op.SAdd && !found {
+					next = slices.Insert(slices.Clone(members), i, in.Value)
+				} else if in.Op == op.SRem && found {
+					next = slices.Delete(slices.Clone(members), i, i+1)
+				}
+				changed := len(next) != len(members)
+				if out.Err != nil {
+					// The command may have succeeded.
+					if changed {
+						return []any{members, next}
+					}
+					return []any{members}
+				}
+				if out.Value != boolInt(changed) {
+					// The command reported the wrong count.
+					return nil
+				}
+				return []any{next}
+			case op.SMembers:
+				if out.Err != nil || slices.Equal(out.Values, members) {
+					return []any{members}
+				}
+				return nil
+			case op.SIsMember:
+				if out.Err != nil || out.Value == boolInt(found) {
+					return []any{members}
+				}
+				return nil
+			case op.SCard:
+				if out.Err != nil || out.Value == strconv.Itoa(len(members)) {
+					return []any{members}
+				}
+				return nil
+			default:
+				panic(fmt.Sprintf("step set model: unexpected operation %v", in.Op))
+			}
+		},
+		DescribeOperation: func(input, output any) string {
+			return describe(input.(*args), output.(*rets))
+		},
+		DescribeState: func(state any) string {
+			return "{" + strings.Join(state.([]string), " ") + "}"
+		},
+		Equal: func(left, right any) bool {
+			return slices.Equal(left.([]string), right.([]string))
+		},
+	}
+	return nondeterministic.ToModel()
+}
+
+// boolInt formats a boolean the way Valkey replies with one.
+func boolInt(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
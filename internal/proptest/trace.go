@@ -0,0 +1,116 @@
+package proptest
+
+import (
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// A traceEntry is one command sent by a workload client.
+type traceEntry struct {
+	Client  int      `json:"client"`
+	Node    string   `json:"node"`
+	Call    int64    `json:"call"`   // Unix nanoseconds
+	Return  int64    `json:"return"` // Unix nanoseconds
+	Command []string `json:"command"`
+	Result  any      `json:"result,omitempty"`
+	Err     string   `json:"err,omitempty"`
+}
+
+// WriteTrace writes every command in the workloads, ordered by the time it
+// was sent, as gzip-compressed JSON lines. Each line records the client, the
+// node it was connected to (as reported by node), the command's arguments,
+// and its result. Alongside a porcupine visualization, the trace shows the
+// exact sequence of interactions that led to a consistency violation.
+func WriteTrace(w io.Writer, workloads [][]porcupine.Operation, node func(clientID int) string) error {
+	var entries []traceEntry
+	for _, history := range workloads {
+		for _, operation := range history {
+			in := operation.Input.(*args)
+			out := operation.Output.(*rets)
+			entry := traceEntry{
+				Client:  operation.ClientId,
+				Node:    node(operation.ClientId),
+				Call:    operation.Call,
+				Return:  operation.Return,
+				Command: command(in),
+			}
+			if out.Err != nil {
+				entry.Err = out.Err.Error()
+			} else {
+				entry.Result = result(in, out)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b traceEntry) int {
+		return cmp.Compare(a.Call, b.Call)
+	})
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("encode trace: %v", err)
+		}
+	}
+	return gz.Close()
+}
+
+// command returns the arguments a client sends for an operation.
+func command(in *args) []string {
+	name := strings.ToUpper(string(in.Op))
+	switch in.Op {
+	case op.Set:
+		if in.Cond != "" {
+			return []string{name, in.Key, in.Value, in.Cond}
+		}
+		return []string{name, in.Key, in.Value}
+	case op.IncrBy, op.Exec, op.GetSet, op.Append, op.LPush, op.RPush, op.SAdd, op.SRem, op.SIsMember, op.ZRem, op.ZScore:
+		return []string{name, in.Key, in.Value}
+	case op.ZAdd:
+		return []string{name, in.Key, formatScore(in.Score), in.Value}
+	case op.GetEx:
+		return []string{name, in.Key, "PERSIST"}
+	case op.LRange, op.ZRange:
+		return []string{name, in.Key, "0", "-1"}
+	case op.MGet:
+		return append([]string{name}, in.Keys...)
+	case op.Exists:
+		if in.Keys != nil {
+			return append([]string{name}, in.Keys...)
+		}
+		return []string{name, in.Key}
+	case op.Keys:
+		return []string{name, in.Value}
+	case op.MSet:
+		cmd := []string{name}
+		for _, key := range in.Keys {
+			cmd = append(cmd, key, in.Value)
+		}
+		return cmd
+	default:
+		return []string{name, in.Key}
+	}
+}
+
+// result returns the outcome of a successful operation.
+func result(in *args, out *rets) any {
+	switch {
+	case in.Op == op.MGet, in.Op == op.LRange, in.Op == op.SMembers, in.Op == op.ZRange, in.Op == op.Keys:
+		return out.Values
+	case in.Op == op.Set && in.Cond != "", in.Op == op.Exec:
+		return out.Applied
+	case out.Value != "":
+		return out.Value
+	default:
+		return "OK"
+	}
+}
@@ -0,0 +1,118 @@
+package proptest
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// isZSetOp reports whether an operation works on sorted sets.
+func isZSetOp(o op.Op) bool {
+	switch o {
+	case op.ZAdd, op.ZRem, op.ZScore, op.ZCard, op.ZRange:
+		return true
+	}
+	return false
+}
+
+// scored is a member of a sorted set and its score.
+type scored struct {
+	member string
+	score  float64
+}
+
+func compareScored(a, b scored) int {
+	return cmp.Or(cmp.Compare(a.score, b.score), strings.Compare(a.member, b.member))
+}
+
+func newZSetModel() porcupine.Model {
+	// Models the state of a single sorted set as a []scored, ordered the way
+	// ZRANGE orders members. As in the other models, a missing key is an
+	// empty set and steps never modify a state in place.
+	nondeterministic := &porcupine.NondeterministicModel{
+		Init: func() []any { return []any{[]scored(nil)} },
+		Step: func(state, input, output any) []any {
+			in := input.(*args)
+			out := output.(*rets)
+			members := state.([]scored)
+			i := slices.IndexFunc(members, func(m scored) bool { return m.member == in.Value })
+			switch in.Op {
+			case op.ZAdd, op.ZRem:
+				next := members
+				if i >= 0 {
+					next = slices.Delete(slices.Clone(members), i, i+1)
+				}
+				if in.Op == op.ZAdd {
+					m := scored{in.Value, in.Score}
+					j, _ := slices.BinarySearchFunc(next, m, compareScored)
+					next = slices.Insert(slices.Clone(next), j, m)
+				}
+				if out.Err != nil {
+					// The command may have succeeded.
+					return []any{members, next}
+				}
+				// ZADD counts added members and ZREM counts removed ones.
+				if out.Value != boolInt((in.Op == op.ZAdd) == (i < 0)) {
+					return nil
+				}
+				return []any{next}
+			case op.ZScore:
+				switch {
+				case out.Err != nil && !errors.Is(out.Err, client.ErrNotFound):
+					return []any{members}
+				case i < 0 && errors.Is(out.Err, client.ErrNotFound):
+					return []any{members}
+				case i >= 0 && out.Err == nil && out.Value == formatScore(members[i].score):
+					return []any{members}
+				}
+				return nil
+			case op.ZRange:
+				if out.Err != nil || slices.Equal(out.Values, memberNames(members)) {
+					return []any{members}
+				}
+				return nil
+			case op.ZCard:
+				if out.Err != nil || out.Value == strconv.Itoa(len(members)) {
+					return []any{members}
+				}
+				return nil
+			default:
+				panic(fmt.Sprintf("step zset model: unexpected operation %v", in.Op))
+			}
+		},
+		DescribeOperation: func(input, output any) string {
+			return describe(input.(*args), output.(*rets))
+		},
+		DescribeState: func(state any) string {
+			var parts []string
+			for _, m := range state.([]scored) {
+				parts = append(parts, m.member+":"+formatScore(m.score))
+			}
+			return "{" + strings.Join(parts, " ") + "}"
+		},
+		Equal: func(left, right any) bool {
+			return slices.Equal(left.([]scored), right.([]scored))
+		},
+	}
+	return nondeterministic.ToModel()
+}
+
+func memberNames(members []scored) []string {
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.member
+	}
+	return names
+}
+
+// formatScore formats a score for comparison and display.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
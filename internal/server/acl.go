@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tidwall/redcon"
+)
+
+// Access control lists restrict the commands and keys available to each
+// user. Users are stored in their own object next to the database, so every
+// node in the cluster shares them. Nodes cache the users and revalidate the
+// cache at most once per aclRefreshInterval, so changes made on other nodes
+// take effect within about that long.
+//
+// The "default" user is special: until it's configured with ACL SETUSER, it
+// may run any command on any key, and it authenticates with the server's
+// password (if any).
+const aclRefreshInterval = time.Second
+
+// An aclUser is a single user's permissions.
+type aclUser struct {
+	Enabled   bool     `json:"enabled"`
+	NoPass    bool     `json:"nopass,omitempty"`
+	Passwords []string `json:"passwords,omitempty"` // hex-encoded SHA-256
+	// Commands are allowed if AllCommands is set or they're in Allowed, and
+	// they aren't in Denied.
+	AllCommands bool     `json:"allcommands,omitempty"`
+	Allowed     []string `json:"allowed,omitempty"`
+	Denied      []string `json:"denied,omitempty"`
+	// Keys are accessible if AllKeys is set or they match one of the glob
+	// patterns in Keys.
+	AllKeys bool     `json:"allkeys,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	// Namespace, if set, confines the user's keys to a namespace (see
+	// namespace.go). Key patterns match the keys as the user names them.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.Passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) canRun(name op.Op) bool {
+	if slices.Contains(u.Denied, string(name)) {
+		return false
+	}
+	return u.AllCommands || slices.Contains(u.Allowed, string(name))
+}
+
+func (u *aclUser) canAccess(key string) bool {
+	if u.AllKeys {
+		return true
+	}
+	for _, pattern := range u.Keys {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies a single ACL SETUSER rule. It supports a subset of Valkey's
+// rules: on, off, nopass, resetpass, >password, <password, #hash, allkeys,
+// ~pattern, resetkeys, allcommands, +@all, nocommands, -@all, +command,
+// -command, and reset, along with the Valthree-specific namespace:name and
+// resetnamespace.
+func (u *aclUser) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.Enabled = true
+	case lower == "off":
+		u.Enabled = false
+	case lower == "nopass":
+		u.NoPass = true
+		u.Passwords = nil
+	case lower == "resetpass":
+		u.NoPass = false
+		u.Passwords = nil
+	case lower == "allkeys" || rule == "~*":
+		u.AllKeys = true
+		u.Keys = nil
+	case lower == "resetkeys":
+		u.AllKeys = false
+		u.Keys = nil
+	case lower == "allcommands" || lower == "+@all":
+		u.AllCommands = true
+		u.Allowed = nil
+		u.Denied = nil
+	case lower == "nocommands" || lower == "-@all":
+		u.AllCommands = false
+		u.Allowed = nil
+		u.Denied = nil
+	case lower == "reset":
+		*u = aclUser{}
+	case lower == "resetnamespace":
+		u.Namespace = ""
+	case strings.HasPrefix(lower, "namespace:"):
+		name := rule[len("namespace:"):]
+		if !validNamespace(name) {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': namespaces must be printable ASCII, without spaces or colons", rule)
+		}
+		u.Namespace = name
+	case strings.HasPrefix(rule, ">"):
+		u.NoPass = false
+		if hash := hashPassword(rule[1:]); !slices.Contains(u.Passwords, hash) {
+			u.Passwords = append(u.Passwords, hash)
+		}
+	case strings.HasPrefix(rule, "<"):
+		hash := hashPassword(rule[1:])
+		if !slices.Contains(u.Passwords, hash) {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': no such password", rule)
+		}
+		u.Passwords = slices.DeleteFunc(u.Passwords, func(p string) bool { return p == hash })
+	case strings.HasPrefix(rule, "#"):
+		hash := strings.ToLower(rule[1:])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters", rule)
+		}
+		u.NoPass = false
+		if !slices.Contains(u.Passwords, hash) {
+			u.Passwords = append(u.Passwords, hash)
+		}
+	case strings.HasPrefix(rule, "~"):
+		if !u.AllKeys && !slices.Contains(u.Keys, rule[1:]) {
+			u.Keys = append(u.Keys, rule[1:])
+		}
+	case len(rule) > 1 && (rule[0] == '+' || rule[0] == '-') && rule[1] != '@':
+		name := lower[1:]
+		u.Allowed = slices.DeleteFunc(u.Allowed, func(c string) bool { return c == name })
+		u.Denied = slices.DeleteFunc(u.Denied, func(c string) bool { return c == name })
+		if rule[0] == '+' && !u.AllCommands {
+			u.Allowed = append(u.Allowed, name)
+		} else if rule[0] == '-' && u.AllCommands {
+			u.Denied = append(u.Denied, name)
+		}
+	default:
+		return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+	}
+	return nil
+}
+
+// describe formats the user's permissions as ACL rules, as in ACL LIST.
+func (u *aclUser) describe() []string {
+	var rules []string
+	if u.Enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.NoPass {
+		rules = append(rules, "nopass")
+	}
+	for _, p := range u.Passwords {
+		rules = append(rules, "#"+p)
+	}
+	if u.AllKeys {
+		rules = append(rules, "~*")
+	} else {
+		rules = append(rules, "resetkeys")
+		for _, pattern := range u.Keys {
+			rules = append(rules, "~"+pattern)
+		}
+	}
+	if u.Namespace != "" {
+		rules = append(rules, "namespace:"+u.Namespace)
+	}
+	return append(rules, u.describeCommands())
+}
+
+func (u *aclUser) describeCommands() string {
+	rules := []string{"-@all"}
+	if u.AllCommands {
+		rules = []string{"+@all"}
+	}
+	for _, name := range u.Allowed {
+		rules = append(rules, "+"+name)
+	}
+	for _, name := range u.Denied {
+		rules = append(rules, "-"+name)
+	}
+	return strings.Join(rules, " ")
+}
+
+// aclObject is the stored form of the access control list.
+type aclObject struct {
+	Users map[string]*aclUser `json:"users"`
+}
+
+// aclStore caches the access control list object.
+type aclStore struct {
+	store *storage
+	key   string // object key
+
+	mu      sync.Mutex
+	users   map[string]*aclUser // never modified in place
+	etag    string
+	fetched time.Time
+}
+
+// User returns the named user, or false if no such user is configured.
+func (a *aclStore) User(name string) (*aclUser, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(false); err != nil {
+		return nil, false, err
+	}
+	u, ok := a.users[name]
+	return u, ok, nil
+}
+
+// Users returns all the configured users.
+func (a *aclStore) Users() (map[string]*aclUser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.refresh(false); err != nil {
+		return nil, err
+	}
+	return a.users, nil
+}
+
+// Invalidate drops the cached users, so the next lookup downloads them in
+// full.
+func (a *aclStore) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.etag = ""
+	a.fetched = time.Time{}
+}
+
+// refresh revalidates the cached users if they're stale (or if force is
+// set). If object storage is unavailable, it keeps serving stale users
+// rather than failing every command. The caller must hold mu.
+func (a *aclStore) refresh(force bool) error {
+	if !force && !a.fetched.IsZero() && time.Since(a.fetched) < aclRefreshInterval {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.store.timeout)
+	defer cancel()
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(a.store.bucket),
+		Key:    aws.String(a.key),
+	}
+	if a.etag != "" {
+		input.IfNoneMatch = aws.String(a.etag)
+	}
+	res, err := a.store.client.GetObject(ctx, input)
+	var (
+		respErr  *awshttp.ResponseError
+		errNoKey *types.NoSuchKey
+	)
+	switch {
+	case errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified:
+	case errors.As(err, &errNoKey):
+		a.users = make(map[string]*aclUser)
+		a.etag = ""
+	case err != nil:
+		a.store.stats.storageErrors.Add(1)
+		if a.fetched.IsZero() || force {
+			return fmt.Errorf("%w: get ACL: %v", ErrStorageUnavailable, err)
+		}
+		// Try again after another interval.
+	default:
+		defer res.Body.Close()
+		var obj aclObject
+		if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
+			return fmt.Errorf("unmarshal ACL: %v", err)
+		}
+		if obj.Users == nil {
+			obj.Users = make(map[string]*aclUser)
+		}
+		a.users = obj.Users
+		a.etag = aws.ToString(res.ETag)
+	}
+	a.fetched = time.Now()
+	return nil
+}
+
+// Mutate atomically updates the access control list, retrying if another
+// node updates it concurrently.
+func (a *aclStore) Mutate(f func(users map[string]*aclUser) error) error {
+	if a.store.unsafe != nil || a.store.emulate {
+		return errors.New("changing ACLs requires conditional writes")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for {
+		if err := a.refresh(true); err != nil {
+			return err
+		}
+		// Cached users are never modified in place, so f gets a deep copy.
+		bs, err := json.Marshal(aclObject{Users: a.users})
+		if err != nil {
+			return fmt.Errorf("marshal ACL: %v", err)
+		}
+		var obj aclObject
+		if err := json.Unmarshal(bs, &obj); err != nil {
+			return fmt.Errorf("unmarshal ACL: %v", err)
+		}
+		if err := f(obj.Users); err != nil {
+			return err
+		}
+		if bs, err = json.Marshal(obj); err != nil {
+			return fmt.Errorf("marshal ACL: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.store.timeout)
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(a.store.bucket),
+			Key:    aws.String(a.key),
+			Body:   bytes.NewReader(bs),
+		}
+		if a.etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = aws.String(a.etag)
+		}
+		res, err := a.store.client.PutObject(ctx, input)
+		cancel()
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			a.store.stats.conflicts.Add(1)
+			continue
+		} else if err != nil {
+			a.store.stats.storageErrors.Add(1)
+			return fmt.Errorf("%w: put ACL: %v", ErrStorageUnavailable, err)
+		}
+		a.users = obj.Users
+		a.etag = aws.ToString(res.ETag)
+		a.fetched = time.Now()
+		return nil
+	}
+}
+
+// checkPermissions reports whether the connection's user may run the command
+// on the keys. If not, it replies with an error.
+func (s *Server) checkPermissions(conn redcon.Conn, name op.Op, keys []string) bool {
+	switch name {
+	case op.Auth, op.Hello, op.Quit, op.Reset:
+		return true
+	}
+	denied, err := s.permission(stateOf(conn).user, name, keys)
+	if err != nil {
+		writeErr(conn, err)
+		return false
+	}
+	if denied != "" {
+		conn.WriteError(denied)
+		return false
+	}
+	return true
+}
+
+// accessible returns a function reporting whether the named user may access a
+// key, for commands like RANGE that choose which keys to read themselves
+// rather than naming them.
+func (s *Server) accessible(user string) (func(key string) bool, error) {
+	u, ok, err := s.acl.User(user)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || u.AllKeys {
+		// Users that don't exist can't run commands at all.
+		return func(string) bool { return true }, nil
+	}
+	return u.canAccess, nil
+}
+
+// permission checks whether the named user may run the command on the keys,
+// returning the NOPERM error to reply with if not.
+func (s *Server) permission(user string, name op.Op, keys []string) (string, error) {
+	u, ok, err := s.acl.User(user)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		if user == "default" {
+			return "", nil
+		}
+		return fmt.Sprintf("NOPERM User %s no longer exists", user), nil
+	}
+	if !u.canRun(name) {
+		return fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", user, name), nil
+	}
+	for _, key := range keys {
+		if !u.canAccess(key) {
+			return "NOPERM No permissions to access a key", nil
+		}
+	}
+	return "", nil
+}
+
+// aclCmd handles ACL SETUSER username [rule ...], ACL GETUSER username,
+// ACL LIST, and ACL WHOAMI.
+func (s *Server) aclCmd(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.ACL)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "setuser" && len(args) >= 1:
+		name, rules := args[0], args[1:]
+		err := s.acl.Mutate(func(users map[string]*aclUser) error {
+			u, ok := users[name]
+			if !ok {
+				u = &aclUser{}
+				if name == "default" {
+					// Start from the default user's implicit permissions.
+					u = &aclUser{Enabled: true, NoPass: s.password == "", AllCommands: true, AllKeys: true}
+					if s.password != "" {
+						u.Passwords = []string{hashPassword(s.password)}
+					}
+				}
+				users[name] = u
+			}
+			for _, rule := range rules {
+				if err := u.apply(rule); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case sub == "getuser" && len(args) == 1:
+		u, ok, err := s.acl.User(args[0])
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		flags := []string{"off"}
+		if u.Enabled {
+			flags[0] = "on"
+		}
+		if u.NoPass {
+			flags = append(flags, "nopass")
+		}
+		keys := make([]string, len(u.Keys))
+		for i, pattern := range u.Keys {
+			keys[i] = "~" + pattern
+		}
+		if u.AllKeys {
+			keys = []string{"~*"}
+		}
+		writeMap(conn, 4)
+		conn.WriteBulkString("flags")
+		conn.WriteArray(len(flags))
+		for _, flag := range flags {
+			conn.WriteBulkString(flag)
+		}
+		conn.WriteBulkString("passwords")
+		conn.WriteArray(len(u.Passwords))
+		for _, p := range u.Passwords {
+			conn.WriteBulkString(p)
+		}
+		conn.WriteBulkString("commands")
+		conn.WriteBulkString(u.describeCommands())
+		conn.WriteBulkString("keys")
+		conn.WriteBulkString(strings.Join(keys, " "))
+	case sub == "list" && len(args) == 0:
+		users, err := s.acl.Users()
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		lines := []string{"user default on nopass ~* +@all"}
+		if _, ok := users["default"]; ok {
+			lines = nil
+		} else if s.password != "" {
+			lines = []string{"user default on #" + hashPassword(s.password) + " ~* +@all"}
+		}
+		for name, u := range users {
+			lines = append(lines, "user "+name+" "+strings.Join(u.describe(), " "))
+		}
+		slices.Sort(lines)
+		conn.WriteArray(len(lines))
+		for _, line := range lines {
+			conn.WriteBulkString(line)
+		}
+	case sub == "whoami" && len(args) == 0:
+		conn.WriteBulkString(stateOf(conn).user)
+	case sub == "setuser" || sub == "getuser" || sub == "list" || sub == "whoami":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'acl|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown ACL subcommand '%s'", sub))
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"go.akshayshah.org/attest"
+)
+
+func TestACLRules(t *testing.T) {
+	secret := "#" + hashPassword("secret")
+	tests := []struct {
+		rules []string
+		want  string // as in ACL LIST
+	}{
+		{nil, "off resetkeys -@all"},
+		{[]string{"on", "nopass", "~*", "+@all"}, "on nopass ~* +@all"},
+		{[]string{"on", "off"}, "off resetkeys -@all"},
+		{[]string{"allkeys", "allcommands"}, "off ~* +@all"},
+		{[]string{">secret", ">secret"}, "off " + secret + " resetkeys -@all"},
+		{[]string{">secret", "nopass"}, "off nopass resetkeys -@all"},
+		{[]string{"nopass", ">secret"}, "off " + secret + " resetkeys -@all"},
+		{[]string{">secret", "<secret"}, "off resetkeys -@all"},
+		{[]string{">secret", "resetpass"}, "off resetkeys -@all"},
+		{[]string{strings.ToUpper(secret)}, "off " + secret + " resetkeys -@all"},
+		{[]string{"~app:*", "~cache:*", "~app:*"}, "off resetkeys ~app:* ~cache:* -@all"},
+		{[]string{"~*", "~app:*"}, "off ~* -@all"},
+		{[]string{"~app:*", "resetkeys", "~cache:*"}, "off resetkeys ~cache:* -@all"},
+		{[]string{"~app:*", "allkeys"}, "off ~* -@all"},
+		{[]string{"+GET", "+set", "+get"}, "off resetkeys -@all +set +get"},
+		{[]string{"+get", "-get"}, "off resetkeys -@all"},
+		{[]string{"-get"}, "off resetkeys -@all"},
+		{[]string{"+@all", "-flushall", "-FLUSHDB"}, "off resetkeys +@all -flushall -flushdb"},
+		{[]string{"+@all", "-flushall", "+flushall"}, "off resetkeys +@all"},
+		{[]string{"+@all", "+get"}, "off resetkeys +@all"},
+		{[]string{"+get", "+@all", "-@all"}, "off resetkeys -@all"},
+		{[]string{"+get", "nocommands", "+set"}, "off resetkeys -@all +set"},
+		{[]string{"namespace:app", "~*"}, "off ~* namespace:app -@all"},
+		{[]string{"namespace:app", "resetnamespace"}, "off resetkeys -@all"},
+		{[]string{"on", ">secret", "~*", "+@all", "reset"}, "off resetkeys -@all"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.rules, " "), func(t *testing.T) {
+			var u aclUser
+			for _, rule := range tt.rules {
+				attest.Ok(t, u.apply(rule))
+			}
+			attest.Equal(t, strings.Join(u.describe(), " "), tt.want)
+		})
+	}
+}
+
+func TestACLRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"bogus",
+		"+",
+		"+@read", // only @all is supported
+		"-@write",
+		"<secret", // not one of the user's passwords
+		"#secret",
+		"#" + strings.Repeat("0", 63),
+		"namespace:",
+		"namespace:a:b",
+		"namespace:a b",
+	} {
+		var u aclUser
+		attest.Error(t, u.apply(rule), attest.Sprintf("rule %q", rule))
+	}
+}
+
+func TestACLChecks(t *testing.T) {
+	var u aclUser
+	for _, rule := range []string{"on", ">secret", ">other", "~app:*", "~cache:?", "+get", "+set"} {
+		attest.Ok(t, u.apply(rule))
+	}
+	attest.True(t, u.checkPassword("secret"))
+	attest.True(t, u.checkPassword("other"))
+	attest.False(t, u.checkPassword("wrong"))
+	attest.False(t, u.checkPassword(""))
+	attest.True(t, u.canRun(op.Get))
+	attest.True(t, u.canRun(op.Set))
+	attest.False(t, u.canRun(op.Del))
+	attest.True(t, u.canAccess("app:1"))
+	attest.True(t, u.canAccess("cache:a"))
+	attest.False(t, u.canAccess("cache:ab"))
+	attest.False(t, u.canAccess("other"))
+
+	attest.Ok(t, u.apply("nopass"))
+	attest.True(t, u.checkPassword("anything"))
+	attest.Ok(t, u.apply("+@all"))
+	attest.Ok(t, u.apply("-del"))
+	attest.True(t, u.canRun(op.FlushAll))
+	attest.False(t, u.canRun(op.Del))
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+const (
+	adminPageSize    = 50
+	adminSlowEntries = 20
+	adminLargestKeys = 10
+	adminPeerTimeout = 2 * time.Second
+)
+
+//go:embed admin.html
+var adminHTML string
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(adminHTML))
+
+// nodeStatus is the JSON-serializable status of a single node, exchanged
+// between nodes so that every dashboard can show the whole cluster.
+type nodeStatus struct {
+	Name          string        `json:"name"`
+	Addr          string        `json:"addr,omitempty"`
+	Uptime        time.Duration `json:"uptime"`
+	Commands      int64         `json:"commands"`
+	Reads         int64         `json:"reads"`
+	Writes        int64         `json:"writes"`
+	Conflicts     int64         `json:"conflicts"`
+	StorageErrors int64         `json:"storage_errors"`
+	ConflictRate  float64       `json:"conflict_rate"`
+	QueueWait     time.Duration `json:"mean_queue_wait"`
+	Err           string        `json:"-"`
+}
+
+// ConflictPercent is used by the HTML template.
+func (n nodeStatus) ConflictPercent() float64 {
+	return 100 * n.ConflictRate
+}
+
+// admin is a frontend serving a small, read-only web dashboard for operators.
+// The dashboard shows keys, so it asks for the same credentials as a Valkey
+// connection, with HTTP basic authentication, and shows only the keys the
+// user may read. Requests without credentials act as the default user, if it
+// needs no password. The node status that dashboards fetch from each other
+// holds no keys, so it's served to anyone.
+type admin struct {
+	srv    *Server
+	http   *http.Server
+	client *http.Client
+}
+
+func newAdmin(srv *Server) *admin {
+	a := &admin{
+		srv:    srv,
+		client: &http.Client{Timeout: adminPeerTimeout},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", a.dashboard)
+	mux.HandleFunc("GET /api/node", a.node)
+	a.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a
+}
+
+// Serve implements frontend.
+func (a *admin) Serve(ln net.Listener) error {
+	if err := a.http.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close implements frontend.
+func (a *admin) Close() error {
+	return a.http.Close()
+}
+
+func (a *admin) status() nodeStatus {
+	st := a.srv.stats
+	return nodeStatus{
+		Name:          a.srv.nodeName,
+		Uptime:        time.Since(st.started).Truncate(time.Second),
+		Commands:      st.commands.Load(),
+		Reads:         st.reads.Load(),
+		Writes:        st.writes.Load(),
+		Conflicts:     st.conflicts.Load(),
+		StorageErrors: st.storageErrors.Load(),
+		ConflictRate:  st.ConflictRate(),
+		QueueWait:     st.MeanQueueWait(),
+	}
+}
+
+func (a *admin) node(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// peers fetches the status of every other node in parallel. Unreachable
+// nodes are reported rather than omitted, since an operator looking at the
+// dashboard during an incident needs to see them.
+func (a *admin) peers(ctx context.Context) []nodeStatus {
+	statuses := make([]nodeStatus, len(a.srv.adminPeers))
+	var wg sync.WaitGroup
+	for i, addr := range a.srv.adminPeers {
+		wg.Go(func() {
+			statuses[i] = a.fetchPeer(ctx, addr)
+		})
+	}
+	wg.Wait()
+	return statuses
+}
+
+func (a *admin) fetchPeer(ctx context.Context, addr string) nodeStatus {
+	status := nodeStatus{Addr: addr}
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/node", nil)
+	if err != nil {
+		status.Err = err.Error()
+		return status
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		status.Err = err.Error()
+		return status
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		status.Err = fmt.Sprintf("unexpected status %s", res.Status)
+		return status
+	}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		status.Err = fmt.Sprintf("decode status: %v", err)
+	}
+	return status
+}
+
+type adminEntry struct {
+	Key   string
+	Type  string
+	Value string
+}
+
+// adminValue renders a key's value for the key browser, according to its
+// type: lists in order, sets sorted, hashes sorted by field, and sorted sets
+// in score order.
+func adminValue(db *database, key string) string {
+	var parts []string
+	switch db.typeOf(key) {
+	case "string":
+		return db.Items[key]
+	case "hash":
+		hash := db.Hashes[key]
+		for _, field := range slices.Sorted(maps.Keys(hash)) {
+			parts = append(parts, field+": "+hash[field])
+		}
+	case "list":
+		parts = db.Lists[key]
+	case "set":
+		parts = db.Sets[key].Sorted()
+	case "zset":
+		for _, m := range db.ZSets[key] {
+			parts = append(parts, m.Member+": "+formatScore(m.Score))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readCommands are the commands a user must be allowed to run to see the
+// values of each type on the dashboard.
+var readCommands = map[string]op.Op{
+	"string": op.Get,
+	"hash":   op.HGetAll,
+	"list":   op.LRange,
+	"set":    op.SMembers,
+	"zset":   op.ZRange,
+}
+
+// slowEntries returns the slow commands the named user, with ACL entry u (or
+// nil, if it has none), may see. Commands' arguments hold keys and values, so
+// users whose access is restricted only see their own.
+func slowEntries(entries []slowEntry, user string, u *aclUser) []slowEntry {
+	if u == nil || (u.AllKeys && u.AllCommands && u.Namespace == "") {
+		return entries
+	}
+	return slices.DeleteFunc(entries, func(e slowEntry) bool { return e.User != user })
+}
+
+// user authenticates a dashboard request, returning the user it acts as.
+func (a *admin) user(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		user, password = "default", ""
+	}
+	return user, a.srv.authenticate(user, password)
+}
+
+// visible returns the part of db, read from the user's keyspace, that the
+// user may read, or an error explaining why it may read none of it.
+func (a *admin) visible(user string, db *database) (*database, error) {
+	denied, err := a.srv.permission(user, op.Keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	if denied != "" {
+		return nil, errors.New(denied)
+	}
+	u, ok, err := a.srv.acl.User(user)
+	if err != nil || !ok || u.AllKeys {
+		return db, err
+	}
+	var keys []string
+	for key := range db.keys() {
+		if u.canAccess(key) {
+			keys = append(keys, key)
+		}
+	}
+	return db.subset(keys), nil
+}
+
+func (a *admin) dashboard(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.user(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="valthree", charset="UTF-8"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	self := a.status()
+	data := struct {
+		Node        nodeStatus
+		Nodes       []nodeStatus
+		Keyspace    keyspaceSummary
+		KeyspaceErr error
+		Slow        []slowEntry
+		DB          int
+		Databases   []int
+		Prefix      string
+		Keys        []adminEntry
+		Next        string
+		KeysErr     error
+	}{
+		Node:   self,
+		Nodes:  append([]nodeStatus{self}, a.peers(r.Context())...),
+		Prefix: r.URL.Query().Get("prefix"),
+	}
+	// Without an ACL entry, the user is the default user, which may do
+	// anything.
+	u, _, err := a.srv.acl.User(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Slow = slowEntries(a.srv.stats.slowlog.Recent(adminSlowEntries), user, u)
+	for n := range a.srv.dbs {
+		data.Databases = append(data.Databases, n)
+	}
+
+	ns, err := a.srv.namespace(user)
+	if s := r.URL.Query().Get("db"); s != "" && err == nil {
+		data.DB, err = strconv.Atoi(s)
+		if err != nil || data.DB < 0 || data.DB >= len(a.srv.dbs) {
+			data.DB, err = 0, errDBIndex
+		}
+	}
+	var db *database
+	if err == nil {
+		db, err = a.srv.connKeyspace(r.Context(), &connState{}, ns, data.DB, false /* stale */).GetDB()
+	}
+	if err == nil {
+		db, err = a.visible(user, db)
+	}
+	if err != nil {
+		data.KeyspaceErr = err
+		data.KeysErr = err
+	} else {
+		data.Keyspace = summarizeKeyspace(db, adminLargestKeys)
+		keys, next := scanKeys(db.keys(), r.URL.Query().Get("after"), data.Prefix, adminPageSize)
+		for _, key := range keys {
+			e := adminEntry{Key: key, Type: db.typeOf(key)}
+			if u == nil || u.canRun(readCommands[e.Type]) {
+				e.Value = adminValue(db, key)
+			}
+			data.Keys = append(data.Keys, e)
+		}
+		data.Next = next
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
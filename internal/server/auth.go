@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/subtle"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	errNoAuth    = "NOAUTH Authentication required."
+	errWrongPass = "WRONGPASS invalid username-password pair or user is disabled."
+)
+
+// authenticate reports whether the credentials are valid. Users configured
+// with ACL SETUSER must be enabled and supply one of their passwords.
+// Otherwise, the only user is "default", and if no password is configured,
+// any password is accepted.
+func (s *Server) authenticate(user, password string) bool {
+	if u, ok, err := s.acl.User(user); err != nil {
+		return false
+	} else if ok {
+		return u.Enabled && u.checkPassword(password)
+	}
+	if user != "default" {
+		return false
+	}
+	if s.password == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+}
+
+// auth handles AUTH [username] password, which authenticates the connection.
+// Until a connection authenticates, it may only run AUTH, HELLO, and QUIT.
+func (s *Server) auth(conn redcon.Conn, args []string) {
+	user := "default"
+	var password string
+	switch len(args) {
+	case 1:
+		if s.password == "" {
+			conn.WriteError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+			return
+		}
+		password = args[0]
+	case 2:
+		user, password = args[0], args[1]
+	default:
+		writeErrArity(conn, op.Auth)
+		return
+	}
+	if !s.authenticate(user, password) {
+		conn.WriteError(errWrongPass)
+		return
+	}
+	st := stateOf(conn)
+	st.authed = true
+	st.user = user
+	conn.WriteString("OK")
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/cron"
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/antithesishq/valthree/internal/property"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tidwall/redcon"
+)
+
+// snapshotTimeFormat names snapshots so that lexicographic and chronological
+// order agree.
+const snapshotTimeFormat = "20060102T150405Z"
+
+var (
+	errSnapshotExists = errors.New("snapshot already exists")
+	errNoSnapshot     = errors.New("snapshot doesn't exist")
+	errSaveInProgress = errors.New("Background save already in progress")
+)
+
+// A Snapshot is a point-in-time copy of the database. Each logical database
+// is copied to its own object, named like its other snapshots, but only
+// database 0's object is listed; the others are found from its name.
+type Snapshot struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// snapshotPrefix is the common prefix of all the database's snapshots.
+func (s *storage) snapshotPrefix(prefix string) string {
+	return prefix + s.name + "/"
+}
+
+// Snapshot copies the current database to a new object named for the supplied
+// time. The copy is written with If-None-Match, so when several nodes try to
+// take the same scheduled snapshot, exactly one succeeds and the others get
+// errSnapshotExists.
+func (s *storage) Snapshot(prefix string, at time.Time) (string, error) {
+	// Snapshots are always unsharded, and they never refer to a write-ahead
+	// log, so they're easy to inspect and restore. Since shards are read one
+	// at a time, a sharded database's snapshot isn't from a single point in
+	// time. Snapshots of a database that was never written are empty
+	// databases.
+	db, err := s.GetDB()
+	if err != nil {
+		return "", err
+	}
+	db.Format = dbFormat
+	db.LogID, db.Sequence = "", 0
+	body, err := json.Marshal(db)
+	if err != nil {
+		return "", fmt.Errorf("marshal JSON: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.putSnapshot(ctx, prefix, at, body)
+}
+
+func (s *storage) putSnapshot(ctx context.Context, prefix string, at time.Time, body []byte) (string, error) {
+	key := s.snapshotPrefix(prefix) + at.UTC().Format(snapshotTimeFormat) + ".json"
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		IfNoneMatch: aws.String("*"),
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			property.ConcurrentSnapshotsReached()
+			return key, errSnapshotExists
+		}
+		s.stats.storageErrors.Add(1)
+		return "", fmt.Errorf("put object: %v", err)
+	}
+	return key, nil
+}
+
+// ListSnapshots returns all the database's snapshots, oldest first.
+func (s *storage) ListSnapshots(prefix string) ([]Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var snapshots []Snapshot
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.snapshotPrefix(prefix)),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			s.stats.storageErrors.Add(1)
+			return nil, fmt.Errorf("list objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			at, err := time.Parse(snapshotTimeFormat, s.snapshotID(prefix, key))
+			if err != nil {
+				continue // not a snapshot
+			}
+			snapshots = append(snapshots, Snapshot{
+				Key:  key,
+				Time: at,
+				Size: aws.ToInt64(obj.Size),
+			})
+		}
+	}
+	slices.SortFunc(snapshots, func(a, b Snapshot) int {
+		return a.Time.Compare(b.Time)
+	})
+	return snapshots, nil
+}
+
+// DeleteObject deletes an auxiliary object, like a snapshot.
+func (s *storage) DeleteObject(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return fmt.Errorf("delete object: %v", err)
+	}
+	return nil
+}
+
+// replace replaces the database with db, which is unsharded. To everything
+// else, replacing is one more write to each shard: generations keep
+// increasing, since they're fencing tokens, and every key gets a new
+// version, so transactions watching keys abort. Locks are coordination
+// rather than data, so the current leases stand and db's are ignored.
+//
+// Shards are replaced one after another, so a failure may leave some
+// replaced; replacing again finishes the job. Nodes' caches are revalidated
+// on every read, but replace still invalidates them, in case a node cached
+// anything else derived from the old database.
+func (s *storage) replace(db *database) error {
+	shards := s.shards()
+	parts := split(shards, db)
+	for _, sh := range shards {
+		if err := sh.restore(parts[sh]); err != nil {
+			return fmt.Errorf("restore %s: %w", sh.key, err)
+		}
+	}
+	return s.Invalidate()
+}
+
+func (s *storage) getSnapshot(key string) (*database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var errNoKey *types.NoSuchKey
+	if errors.As(err, &errNoKey) {
+		return nil, fmt.Errorf("%w: %s", errNoSnapshot, key)
+	}
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return nil, fmt.Errorf("get object: %v", err)
+	}
+	defer res.Body.Close()
+	db, err := decodeDatabase(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %v", key, err)
+	}
+	return db, nil
+}
+
+// restore replaces the shard with db, one of a snapshot's parts.
+func (sh *shard) restore(db *database) error {
+	ctx := context.Background()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for {
+		current, etag, err := sh.getDB(ctx)
+		if err == nil {
+			err = sh.check(current)
+		}
+		if err != nil {
+			return err
+		}
+		next := db.clone()
+		next.Generation = max(current.Generation, db.Generation) + 1
+		next.Deleted = next.Generation
+		clear(next.Versions)
+		for key := range next.keys() {
+			next.Versions[key] = next.Generation
+		}
+		next.Leases = maps.Clone(current.Leases)
+		if sh.store.wal && !sh.store.emulate {
+			next.startLog()
+		}
+		if err := sh.setDB(ctx, next, etag); errors.Is(err, errMismatchedETag) {
+			continue // a write raced with us, so start over
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// backupStatus is the outcome of the most recent scheduled backup.
+type backupStatus struct {
+	Time time.Time
+	Key  string
+	Err  error
+	// Peer is true if another node took the scheduled snapshot first.
+	Peer bool
+}
+
+// backups takes snapshots of every logical database on a schedule, or when
+// BGSAVE asks for one, and prunes old ones.
+type backups struct {
+	dbs       []*storage // database 0 first
+	logger    *slog.Logger
+	schedule  cron.Schedule
+	expr      string // empty if there's no schedule
+	prefix    string
+	retention int // zero keeps every snapshot
+
+	saving atomic.Bool // a BGSAVE is in progress
+	mu     sync.Mutex
+	last   backupStatus
+	saved  time.Time // the last successful backup
+}
+
+// Run takes scheduled backups until the context is canceled.
+func (b *backups) Run(ctx context.Context) {
+	for {
+		next := b.schedule.Next(time.Now())
+		if next.IsZero() {
+			b.logger.Error("backup schedule never fires", "schedule", b.expr)
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		b.backup(next)
+	}
+}
+
+func (b *backups) backup(at time.Time) {
+	logger := b.logger.With("scheduled_at", at)
+	key, err := b.snapshot(at)
+	status := backupStatus{Time: time.Now(), Key: key, Err: err}
+	if errors.Is(err, errSnapshotExists) {
+		// Another node took this snapshot, and it's responsible for pruning.
+		status.Err = nil
+		status.Peer = true
+		logger.Debug("backup taken by another node", "key", key)
+	} else if err != nil {
+		logger.Error("backup failed", "err", err)
+	} else {
+		logger.Info("backup complete", "key", key)
+		if err := b.prune(); err != nil {
+			logger.Error("prune backups failed", "err", err)
+		}
+	}
+
+	b.mu.Lock()
+	b.last = status
+	if status.Err == nil {
+		b.saved = status.Time
+	}
+	b.mu.Unlock()
+}
+
+// snapshot snapshots every logical database as of at, returning the key of
+// database 0's snapshot. Database 0 is copied last, since its snapshot is
+// the one that's listed: a snapshot isn't seen until every database is in
+// it.
+func (b *backups) snapshot(at time.Time) (string, error) {
+	for _, db := range b.dbs[1:] {
+		// Another node taking the same scheduled snapshot may have copied
+		// this database first, which is just as good.
+		if _, err := db.Snapshot(b.prefix, at); err != nil && !errors.Is(err, errSnapshotExists) {
+			return "", fmt.Errorf("snapshot %s: %w", db.name, err)
+		}
+	}
+	return b.dbs[0].Snapshot(b.prefix, at)
+}
+
+// parts returns the keys of each logical database's part of the snapshot
+// whose database 0 part is key.
+func (b *backups) parts(key string) ([]string, error) {
+	id, ok := strings.CutPrefix(key, b.dbs[0].snapshotPrefix(b.prefix))
+	if !ok && len(b.dbs) > 1 {
+		return nil, fmt.Errorf("%s isn't one of the database's snapshots", key)
+	}
+	keys := []string{key}
+	for _, db := range b.dbs[1:] {
+		keys = append(keys, db.snapshotPrefix(b.prefix)+id)
+	}
+	return keys, nil
+}
+
+// restore replaces every logical database with its part of the snapshot
+// whose database 0 part is key. Every part is read before any database is
+// replaced, so a snapshot that can't be read leaves them all alone. A
+// snapshot taken with fewer logical databases restores the rest empty.
+func (b *backups) restore(key string) error {
+	keys, err := b.parts(key)
+	if err != nil {
+		return err
+	}
+	snaps := make([]*database, len(b.dbs))
+	for n, db := range b.dbs {
+		snaps[n], err = db.getSnapshot(keys[n])
+		if n > 0 && errors.Is(err, errNoSnapshot) {
+			snaps[n], err = newDatabase(), nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for n, db := range b.dbs {
+		if err := db.replace(snaps[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backups) prune() error {
+	if b.retention <= 0 {
+		return nil
+	}
+	snapshots, err := b.dbs[0].ListSnapshots(b.prefix)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) <= b.retention {
+		return nil
+	}
+	var errs []error
+	for _, snap := range snapshots[:len(snapshots)-b.retention] {
+		keys, err := b.parts(snap.Key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Delete database 0's part last, so that a snapshot that's
+		// listed is still whole.
+		for n := len(keys) - 1; n >= 0; n-- {
+			errs = append(errs, b.dbs[n].DeleteObject(keys[n]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Last returns the status of the most recent backup.
+func (b *backups) Last() backupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+// Saved returns the time of the last successful backup, or the zero time if
+// there hasn't been one.
+func (b *backups) Saved() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saved
+}
+
+// bgsave handles BGSAVE, which takes a snapshot in the background, just like
+// a scheduled backup.
+func (s *Server) bgsave(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.BgSave)
+		return
+	}
+	if !s.backups.saving.CompareAndSwap(false, true) {
+		writeErr(conn, errSaveInProgress)
+		return
+	}
+	go func() {
+		defer s.backups.saving.Store(false)
+		s.backups.backup(time.Now())
+	}()
+	conn.WriteString("Background saving started")
+}
+
+// lastsave handles LASTSAVE, which replies with the Unix time of this node's
+// last successful backup, or zero if it hasn't taken one.
+func (s *Server) lastsave(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.LastSave)
+		return
+	}
+	var at int64
+	if saved := s.backups.Saved(); !saved.IsZero() {
+		at = saved.Unix()
+	}
+	conn.WriteInt64(at)
+}
+
+// TakeSnapshot snapshots every logical database now, without a running
+// server, and returns the snapshot's key.
+func TakeSnapshot(cfg Config) (string, error) {
+	b := &backups{dbs: openDatabases(cfg), prefix: cfg.BackupPrefix}
+	return b.snapshot(time.Now())
+}
+
+// ListSnapshots returns the database's snapshots, oldest first.
+func ListSnapshots(cfg Config) ([]Snapshot, error) {
+	store := openStorage(cfg)
+	return store.ListSnapshots(cfg.BackupPrefix)
+}
+
+// Restore replaces every logical database with the contents of the snapshot
+// stored under key, without a running server. Running servers notice within
+// invalidateCheckInterval.
+func Restore(cfg Config, key string) error {
+	b := &backups{dbs: openDatabases(cfg), prefix: cfg.BackupPrefix}
+	return b.restore(key)
+}
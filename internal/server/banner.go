@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+)
+
+// logStartup logs a single record describing how the server is configured
+// and what it found out about object storage, so that one line of a node's
+// logs is enough to diagnose most misconfigurations.
+func (s *Server) logStartup(logger *slog.Logger, cfg Config) {
+	mode := "standalone"
+	if s.topology != nil {
+		mode = "cluster"
+	}
+	role := "primary"
+	if s.replica != nil {
+		role = "replica"
+	}
+	layout := "single"
+	if len(s.store.shards()) > 1 {
+		layout = "sharded"
+	}
+	// Shards switch to the log when they're next written, so this is the
+	// layout the database is converging on.
+	if cfg.WriteAheadLog {
+		layout += "+wal"
+	}
+	conditionalWrites := "honored"
+	switch {
+	case s.replica != nil:
+		conditionalWrites = "unprobed" // replicas don't write
+	case s.store.emulate:
+		conditionalWrites = "emulated"
+	case s.store.unsafe != nil:
+		conditionalWrites = "unsupported"
+	}
+	charset := cfg.KeyCharset
+	if charset == "" {
+		charset = KeyCharsetAny
+	}
+	attrs := []any{
+		"version", buildVersion(),
+		"go_version", runtime.Version(),
+		"node", s.nodeName,
+		"mode", mode,
+		"role", role,
+		slog.Group("storage",
+			"backend", "s3",
+			"endpoint", cfg.S3Endpoint,
+			"region", cfg.S3Region,
+			"bucket", cfg.S3Bucket,
+			"database", cfg.DatabaseName,
+			"backup_prefix", cfg.BackupPrefix,
+			"layout", layout,
+			"shards", len(s.store.shards()),
+			"auto_shards", cfg.AutoShards,
+			"databases", len(s.dbs),
+			"conditional_writes", conditionalWrites,
+			"timeout", cfg.S3Timeout,
+		),
+		slog.Group("limits",
+			"max_keys", cfg.MaxItems,
+			"max_key_length", cfg.MaxKeyLength,
+			"key_charset", charset,
+			"quotas", len(cfg.Quotas),
+			"max_clients", cfg.MaxClients,
+			"max_command_rate", cfg.MaxCommandRate,
+			"max_output_buffer", cfg.MaxOutputBuffer,
+			"read_timeout", cfg.CommandTimeouts.Read,
+			"write_timeout", cfg.CommandTimeouts.Write,
+			"admin_timeout", cfg.CommandTimeouts.Admin,
+			"write_max_attempts", cfg.WriteMaxAttempts,
+		),
+		"auth", cfg.Password != "",
+	}
+	// These only make sense in tests, so they're worth calling out if
+	// they're set anywhere else.
+	if cfg.ClockSkew != 0 {
+		attrs = append(attrs, "clock_skew", cfg.ClockSkew)
+	}
+	if cfg.StorageLatency != 0 {
+		attrs = append(attrs, "storage_latency", cfg.StorageLatency)
+	}
+	logger.Info("server ready", attrs...)
+}
+
+// buildVersion returns the version of the running binary: the module
+// version if it was installed with go install, and otherwise the commit it
+// was built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return "(devel)"
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
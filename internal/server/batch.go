@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A pendingWrite is a mutation waiting to be applied to a shard.
+type pendingWrite struct {
+	ctx    context.Context // the writing command's
+	keys   []string
+	f      func(*database) (int, error)
+	n      int
+	err    error
+	events []event       // caused by the write, published once it's durable
+	lead   chan struct{} // closed when the write leads the next batch
+	done   chan struct{}
+	// span is the writing command's span, and batch is the span of the
+	// batch that applied the write, so traces link them both ways.
+	span, batch trace.SpanContext
+}
+
+// mutate atomically applies f to the shard. Keys are the keys f writes, if
+// known; they're only used to track conflicts.
+//
+// Writes are combined into batches (group commit). The first write to arrive
+// becomes the batch's leader: it waits for the batch interval (if any) and
+// for the shard's write slot, and then applies every write that queued in
+// the meantime with a single PUT. Even without an interval, writes that
+// arrive while a PUT is in flight share the next one, so concurrent writers
+// on one node no longer take turns through separate conditional writes.
+//
+// A write whose context ends while it waits is withdrawn, and fails with
+// ErrTimeout if it passed its deadline; if it was leading, the next write
+// waiting takes over. Once a batch has started, its writes wait for it to
+// finish, since they can no longer be taken back.
+func (sh *shard) mutate(ctx context.Context, keys []string, f func(*database) (int, error)) (int, error) {
+	w := &pendingWrite{
+		ctx:  ctx,
+		keys: keys,
+		f:    f,
+		lead: make(chan struct{}),
+		done: make(chan struct{}),
+		span: trace.SpanContextFromContext(ctx),
+	}
+	sh.pendingMu.Lock()
+	sh.pending = append(sh.pending, w)
+	if len(sh.pending) == 1 {
+		close(w.lead)
+	}
+	sh.pendingMu.Unlock()
+
+	led := false
+	select {
+	case <-w.lead:
+		if led = sh.lead(ctx, w); !led {
+			return 0, interrupted(ctx)
+		}
+	case <-w.done:
+	case <-ctx.Done():
+		if sh.withdraw(w) {
+			return 0, interrupted(ctx)
+		}
+	}
+	<-w.done
+	if !led {
+		trace.SpanFromContext(ctx).AddLink(trace.Link{SpanContext: w.batch})
+	}
+	return w.n, w.err
+}
+
+// lead applies the batch that w leads, once the shard's write slot is free.
+// It returns false, having withdrawn w, if ctx ends first.
+func (sh *shard) lead(ctx context.Context, w *pendingWrite) bool {
+	ctx, span := tracer.Start(ctx, "write batch", trace.WithAttributes(attribute.String("valthree.shard", sh.key)))
+	defer span.End()
+	if sh.store.batchInterval > 0 {
+		timer := time.NewTimer(sh.store.batchInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	start := time.Now()
+	if err := sh.mu.LockContext(ctx); err != nil {
+		sh.withdraw(w)
+		return false
+	}
+	sh.store.stats.observeQueueWait(time.Since(start))
+	sh.pendingMu.Lock()
+	batch := sh.pending
+	sh.pending = nil
+	sh.pendingMu.Unlock()
+	span.SetAttributes(attribute.Int("valthree.batch.writes", len(batch)))
+	for _, other := range batch[1:] {
+		span.AddLink(trace.Link{SpanContext: other.span})
+	}
+	ctx, cancel := batchContext(ctx, batch)
+	sh.apply(ctx, batch)
+	cancel()
+	sh.mu.Unlock()
+	for _, bw := range batch {
+		bw.batch = span.SpanContext()
+		close(bw.done)
+	}
+	return true
+}
+
+// withdraw removes w from the writes waiting for the next batch, reporting
+// whether it was still waiting. If w was leading, the next write takes over.
+func (sh *shard) withdraw(w *pendingWrite) bool {
+	sh.pendingMu.Lock()
+	defer sh.pendingMu.Unlock()
+	i := slices.Index(sh.pending, w)
+	if i < 0 {
+		return false
+	}
+	sh.pending = slices.Delete(sh.pending, i, i+1)
+	if i == 0 && len(sh.pending) > 0 {
+		close(sh.pending[0].lead)
+	}
+	return true
+}
+
+// batchContext returns the context a batch is applied in. The batch shares
+// its leader's trace, but it isn't abandoned until every write in it is:
+// otherwise, a leader whose client disconnected would fail the other writes.
+func batchContext(leader context.Context, batch []*pendingWrite) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(leader))
+	var remaining atomic.Int64
+	remaining.Store(int64(len(batch)))
+	stops := make([]func() bool, len(batch))
+	for i, w := range batch {
+		stops[i] = context.AfterFunc(w.ctx, func() {
+			if remaining.Add(-1) == 0 {
+				cancel()
+			}
+		})
+	}
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// maxBitOffset matches Valkey's limit of 512MiB strings.
+const maxBitOffset = 1<<32 - 1
+
+var (
+	errBitfieldType   = errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitOffset      = errors.New("bit offset is not an integer or out of range")
+	errOverflowType   = errors.New("Invalid OVERFLOW type specified")
+	errNotAnInteger   = errors.New("value is not an integer or out of range")
+	errBitfieldFailed = errors.New("overflow") // reported to clients as a null
+	errBitfieldRO     = errors.New("BITFIELD_RO only supports the GET subcommand")
+)
+
+// A bitfieldOp is a single GET, SET, or INCRBY subcommand of BITFIELD.
+type bitfieldOp struct {
+	name     string
+	signed   bool
+	width    uint
+	offset   uint64
+	arg      int64  // SET's value or INCRBY's increment
+	overflow string // "wrap", "sat", or "fail"
+}
+
+// parseBitfield parses BITFIELD's subcommands. It also reports whether any of
+// them write.
+func parseBitfield(args []string) ([]bitfieldOp, bool, error) {
+	var (
+		ops      []bitfieldOp
+		write    bool
+		overflow = "wrap"
+	)
+	for i := 0; i < len(args); {
+		sub := strings.ToLower(args[i])
+		switch sub {
+		case "overflow":
+			if i+1 >= len(args) {
+				return nil, false, errSyntax
+			}
+			overflow = strings.ToLower(args[i+1])
+			if overflow != "wrap" && overflow != "sat" && overflow != "fail" {
+				return nil, false, errOverflowType
+			}
+			i += 2
+			continue
+		case "get", "set", "incrby":
+		default:
+			return nil, false, errSyntax
+		}
+		nargs := 3
+		if sub == "get" {
+			nargs = 2
+		}
+		if i+nargs >= len(args) {
+			return nil, false, errSyntax
+		}
+		o := bitfieldOp{name: sub, overflow: overflow}
+		var err error
+		o.signed, o.width, err = parseBitfieldType(args[i+1])
+		if err != nil {
+			return nil, false, err
+		}
+		o.offset, err = parseBitOffset(args[i+2], o.width)
+		if err != nil {
+			return nil, false, err
+		}
+		if sub != "get" {
+			o.arg, err = strconv.ParseInt(args[i+3], 10, 64)
+			if err != nil {
+				return nil, false, errNotAnInteger
+			}
+			write = true
+		}
+		ops = append(ops, o)
+		i += nargs + 1
+	}
+	return ops, write, nil
+}
+
+func parseBitfieldType(s string) (bool, uint, error) {
+	if len(s) < 2 {
+		return false, 0, errBitfieldType
+	}
+	signed := s[0] == 'i' || s[0] == 'I'
+	if !signed && s[0] != 'u' && s[0] != 'U' {
+		return false, 0, errBitfieldType
+	}
+	width, err := strconv.Atoi(s[1:])
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, errBitfieldType
+	}
+	return signed, uint(width), nil
+}
+
+// parseBitOffset parses a bit offset, which may be prefixed with '#' to
+// multiply it by the field's width.
+func parseBitOffset(s string, width uint) (uint64, error) {
+	scale := uint64(1)
+	if rest, ok := strings.CutPrefix(s, "#"); ok {
+		s = rest
+		scale = uint64(width)
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > maxBitOffset/scale || n*scale+uint64(width)-1 > maxBitOffset {
+		return 0, errBitOffset
+	}
+	return n * scale, nil
+}
+
+// apply runs the subcommand against buf, growing it if necessary. For GET and
+// INCRBY it returns the field's new value, and for SET the old value. If the
+// field would overflow and the overflow mode is "fail", it leaves buf
+// unchanged and returns errBitfieldFailed.
+func (o bitfieldOp) apply(buf []byte) ([]byte, int64, error) {
+	old := o.decode(getBits(buf, o.offset, o.width))
+	if o.name == "get" {
+		return buf, old, nil
+	}
+
+	var (
+		target   int64
+		overflow int // -1 for underflow, 1 for overflow
+	)
+	lo, hi := o.bounds()
+	switch o.name {
+	case "set":
+		target = o.arg
+		if target < lo {
+			overflow = -1
+		} else if target > hi {
+			overflow = 1
+		}
+	case "incrby":
+		// Wrapping arithmetic in uint64 produces the right low bits for both
+		// signed and unsigned fields.
+		target = int64(uint64(old) + uint64(o.arg))
+		if o.arg > 0 && old > hi-o.arg {
+			overflow = 1
+		} else if o.arg < 0 && (old < lo-o.arg || o.arg == math.MinInt64 && !o.signed) {
+			// For unsigned fields, lo-o.arg itself overflows when o.arg is
+			// MinInt64, but any such decrement underflows.
+			overflow = -1
+		}
+	}
+	if overflow != 0 {
+		switch o.overflow {
+		case "fail":
+			return buf, 0, errBitfieldFailed
+		case "sat":
+			target = hi
+			if overflow < 0 {
+				target = lo
+			}
+		}
+	}
+
+	if need := int((o.offset + uint64(o.width) + 7) / 8); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	bits := uint64(target) & o.mask()
+	setBits(buf, o.offset, o.width, bits)
+	if o.name == "set" {
+		return buf, old, nil
+	}
+	return buf, o.decode(bits), nil
+}
+
+func (o bitfieldOp) mask() uint64 {
+	return math.MaxUint64 >> (64 - o.width)
+}
+
+// bounds returns the smallest and largest values the field can hold.
+func (o bitfieldOp) bounds() (int64, int64) {
+	if o.signed {
+		return -1 << (o.width - 1), int64(o.mask() >> 1)
+	}
+	return 0, int64(o.mask())
+}
+
+// decode interprets the field's raw bits, sign-extending signed fields.
+func (o bitfieldOp) decode(bits uint64) int64 {
+	if o.signed && o.width < 64 && bits&(1<<(o.width-1)) != 0 {
+		bits |= ^o.mask()
+	}
+	return int64(bits)
+}
+
+// getBits reads a big-endian field of width bits. Bits past the end of buf
+// are zero.
+func getBits(buf []byte, offset uint64, width uint) uint64 {
+	var v uint64
+	for i := range uint64(width) {
+		v <<= 1
+		bit := offset + i
+		if byteIdx := bit / 8; byteIdx < uint64(len(buf)) && buf[byteIdx]&(0x80>>(bit%8)) != 0 {
+			v |= 1
+		}
+	}
+	return v
+}
+
+func setBits(buf []byte, offset uint64, width uint, v uint64) {
+	for i := range uint64(width) {
+		bit := offset + i
+		mask := byte(0x80 >> (bit % 8))
+		if v&(1<<(uint64(width)-1-i)) != 0 {
+			buf[bit/8] |= mask
+		} else {
+			buf[bit/8] &^= mask
+		}
+	}
+}
+
+// bitfield handles BITFIELD key [GET enc off] [SET enc off val]
+// [INCRBY enc off incr] [OVERFLOW WRAP|SAT|FAIL]. All the subcommands are
+// applied in a single atomic write. BITFIELD_RO only allows GET, so it's a
+// read.
+func (s *Server) bitfield(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) < 1 {
+		writeErrArity(conn, name)
+		return
+	}
+	key := args[0]
+	ops, write, err := parseBitfield(args[1:])
+	if err == nil && write && name == op.BitFieldRO {
+		err = errBitfieldRO
+	}
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+
+	results := make([]*int64, len(ops))
+	run := func(val string) string {
+		buf := []byte(val)
+		for i, o := range ops {
+			var (
+				n   int64
+				err error
+			)
+			buf, n, err = o.apply(buf)
+			if err == nil {
+				results[i] = &n
+			}
+		}
+		return string(buf)
+	}
+
+	if !write {
+		db, err := s.kv.GetKey(key)
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		if err := db.checkType(key, "string"); err != nil {
+			writeErr(conn, err)
+			return
+		}
+		run(db.Items[key])
+	} else {
+		_, err = s.kv.MutateKey(key, func(db *database) (int, error) {
+			clear(results)
+			if err := db.checkType(key, "string"); err != nil {
+				return 0, err
+			}
+			val, ok := db.Items[key]
+			if !ok && db.stored() >= s.maxItems() {
+				return 0, s.errAtCapacity()
+			}
+			if val = run(val); val != "" {
+				db.setItem(key, val)
+			}
+			return 0, nil
+		})
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+	}
+
+	conn.WriteArray(len(results))
+	for _, n := range results {
+		if n == nil {
+			conn.WriteNull()
+			continue
+		}
+		conn.WriteInt64(*n)
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errNoSuchClient = errors.New("No such client")
+
+// A clientInfo describes a connection to other connections, for CLIENT LIST
+// and CLIENT KILL. The connection's own state lives in its connState, which
+// only it may touch; after each command, the parts of the state that others
+// may see are copied here, guarded by mu.
+type clientInfo struct {
+	id      int64
+	addr    string
+	laddr   string
+	created time.Time
+	conn    net.Conn // closed by CLIENT KILL
+	// ctx is the connection's context, which its commands' contexts are
+	// derived from. It's canceled when the connection closes, or as soon as
+	// the client disconnects (see watchDisconnect).
+	ctx    context.Context
+	cancel context.CancelFunc
+	// commandStarted tells the disconnect watcher a command started.
+	commandStarted func()
+
+	mu       sync.Mutex
+	name     string
+	user     string
+	protocol int
+	db       int
+	multi    int // queued commands, or -1 outside a transaction
+	cmd      op.Op
+	active   time.Time // when the last command started
+}
+
+// A clientRegistry tracks the open connections to a server.
+type clientRegistry struct {
+	ctx   context.Context // canceled when the server closes
+	mu    sync.Mutex
+	conns map[int64]*clientInfo
+}
+
+// add registers a newly accepted connection.
+func (c *clientRegistry) add(conn redcon.Conn, id int64) *clientInfo {
+	now := time.Now()
+	info := &clientInfo{
+		id:      id,
+		addr:    conn.RemoteAddr(),
+		created: now,
+		multi:   -1,
+		active:  now,
+	}
+	info.ctx, info.cancel = context.WithCancel(c.ctx)
+	if info.conn = conn.NetConn(); info.conn != nil {
+		info.laddr = info.conn.LocalAddr().String()
+	}
+	info.commandStarted = watchDisconnect(info.ctx, info.conn, info.cancel)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[int64]*clientInfo)
+	}
+	c.conns[id] = info
+	return info
+}
+
+// remove forgets a closed connection.
+func (c *clientRegistry) remove(id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, ok := c.conns[id]; ok {
+		info.cancel()
+		delete(c.conns, id)
+	}
+}
+
+// kill closes a connection. It's forgotten right away, rather than once the
+// server notices that it's closed, so that it's gone from CLIENT LIST as soon
+// as CLIENT KILL replies.
+func (c *clientRegistry) kill(info *clientInfo) {
+	info.conn.Close()
+	c.remove(info.id)
+}
+
+// list returns the open connections, in the order they were accepted.
+func (c *clientRegistry) list() []*clientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.SortedFunc(maps.Values(c.conns), func(a, b *clientInfo) int {
+		return cmp.Compare(a.id, b.id)
+	})
+}
+
+// begin records that the connection started running a command.
+func (info *clientInfo) begin(name op.Op) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.cmd = name
+	info.active = time.Now()
+}
+
+// update copies the connection's state after a command.
+func (info *clientInfo) update(st *connState) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.name = st.name
+	info.user = st.user
+	info.protocol = st.protocol
+	info.db = st.db
+	info.multi = -1
+	if st.multi {
+		info.multi = len(st.queued)
+	}
+}
+
+// String formats the connection as a line of CLIENT LIST. No connection has
+// more flags than N (normal) or x (in a transaction).
+func (info *clientInfo) String() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	now := time.Now()
+	flags := "N"
+	if info.multi >= 0 {
+		flags = "x"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d multi=%d cmd=%s user=%s resp=%d",
+		info.id, info.addr, info.laddr, info.name,
+		int(now.Sub(info.created).Seconds()), int(now.Sub(info.active).Seconds()),
+		flags, info.db, info.multi, info.cmd, info.user, info.protocol)
+}
+
+// client handles the CLIENT subcommands: ID, GETNAME, SETNAME name, LIST [ID
+// id [id ...]], and KILL.
+func (s *Server) client(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Client)
+		return
+	}
+	st := stateOf(conn)
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "id" && len(args) == 0:
+		conn.WriteInt64(st.id)
+	case sub == "getname" && len(args) == 0:
+		if st.name == "" {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(st.name)
+	case sub == "setname" && len(args) == 1:
+		if !validClientName(args[0]) {
+			writeErr(conn, errClientName)
+			return
+		}
+		st.name = args[0] // an empty name clears it
+		conn.WriteString("OK")
+	case sub == "list":
+		s.clientList(conn, args)
+	case sub == "kill" && len(args) > 0:
+		s.clientKill(conn, args)
+	case sub == "id" || sub == "getname" || sub == "setname" || sub == "kill":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'client|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown CLIENT subcommand '%s'", sub))
+	}
+}
+
+// clientList handles CLIENT LIST [ID id [id ...]].
+func (s *Server) clientList(conn redcon.Conn, args []string) {
+	var ids map[int64]bool
+	if len(args) > 0 {
+		if !strings.EqualFold(args[0], "id") || len(args) == 1 {
+			writeErr(conn, errSyntax)
+			return
+		}
+		ids = make(map[int64]bool, len(args)-1)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || id <= 0 {
+				writeErr(conn, errors.New("Invalid client ID"))
+				return
+			}
+			ids[id] = true
+		}
+	}
+	var b strings.Builder
+	for _, info := range s.clients.list() {
+		if ids == nil || ids[info.id] {
+			b.WriteString(info.String())
+			b.WriteString("\n")
+		}
+	}
+	conn.WriteBulkString(b.String())
+}
+
+// clientKill handles CLIENT KILL, which closes connections. The old form,
+// CLIENT KILL addr, closes the connection from addr and replies OK. The new
+// form takes filters, ID id, ADDR addr, LADDR addr, USER user, and SKIPME
+// yes|no, closes every connection matching all of them, and replies with the
+// number closed. As in Valkey, SKIPME defaults to yes.
+func (s *Server) clientKill(conn redcon.Conn, args []string) {
+	st := stateOf(conn)
+	if len(args) == 1 {
+		for _, info := range s.clients.list() {
+			if info.addr == args[0] {
+				s.clients.kill(info)
+				conn.WriteString("OK")
+				return
+			}
+		}
+		writeErr(conn, errNoSuchClient)
+		return
+	}
+	if len(args)%2 != 0 {
+		writeErr(conn, errSyntax)
+		return
+	}
+	var filters []func(*clientInfo) bool
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		val := args[i+1]
+		switch strings.ToLower(args[i]) {
+		case "id":
+			id, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || id <= 0 {
+				writeErr(conn, errors.New("client-id should be greater than 0"))
+				return
+			}
+			filters = append(filters, func(info *clientInfo) bool { return info.id == id })
+		case "addr":
+			filters = append(filters, func(info *clientInfo) bool { return info.addr == val })
+		case "laddr":
+			filters = append(filters, func(info *clientInfo) bool { return info.laddr == val })
+		case "user":
+			filters = append(filters, func(info *clientInfo) bool {
+				info.mu.Lock()
+				defer info.mu.Unlock()
+				return info.user == val
+			})
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				writeErr(conn, errSyntax)
+				return
+			}
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+	var killed int
+	for _, info := range s.clients.list() {
+		if skipMe && info.id == st.id {
+			continue
+		}
+		matched := true
+		for _, f := range filters {
+			matched = matched && f(info)
+		}
+		if matched {
+			s.clients.kill(info)
+			killed++
+		}
+	}
+	conn.WriteInt(killed)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errClusterDisabled = errors.New("This instance has cluster support disabled")
+
+// cluster handles the read-only CLUSTER subcommands cluster-aware clients use
+// to discover the topology: INFO, MYID, KEYSLOT key, SLOTS, and NODES. As in
+// Valkey, they fail on nodes started without a topology.
+func (s *Server) cluster(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Cluster)
+		return
+	}
+	if s.topology == nil {
+		writeErr(conn, errClusterDisabled)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "info" && len(args) == 0:
+		var size int
+		for _, node := range s.topology.Nodes {
+			if len(node.Slots) > 0 {
+				size++
+			}
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "cluster_state:ok\r\n")
+		fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", numSlots)
+		fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", numSlots)
+		fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(s.topology.Nodes))
+		fmt.Fprintf(&b, "cluster_size:%d\r\n", size)
+		conn.WriteBulkString(b.String())
+	case sub == "myid" && len(args) == 0:
+		conn.WriteBulkString(s.nodeName)
+	case sub == "keyslot" && len(args) == 1:
+		conn.WriteInt(keySlot(args[0]))
+	case sub == "slots" && len(args) == 0:
+		var n int
+		for _, node := range s.topology.Nodes {
+			n += len(node.Slots)
+		}
+		conn.WriteArray(n)
+		for _, node := range s.topology.Nodes {
+			host, port, _ := splitAddr(node.Addr) // validated when loaded
+			for _, r := range node.Slots {
+				conn.WriteArray(3)
+				conn.WriteInt(r[0])
+				conn.WriteInt(r[1])
+				conn.WriteArray(3)
+				conn.WriteBulkString(host)
+				conn.WriteInt(port)
+				conn.WriteBulkString(node.ID)
+			}
+		}
+	case sub == "nodes" && len(args) == 0:
+		// Nodes don't gossip, so every node is always connected, and
+		// there are no epochs or replicas.
+		var b strings.Builder
+		for _, node := range s.topology.Nodes {
+			flags := "master"
+			if node.ID == s.nodeName {
+				flags = "myself,master"
+			}
+			fmt.Fprintf(&b, "%s %s %s - 0 0 0 connected", node.ID, node.Addr, flags)
+			for _, r := range node.Slots {
+				fmt.Fprintf(&b, " %s", r)
+			}
+			b.WriteString("\n")
+		}
+		conn.WriteBulkString(b.String())
+	case sub == "info" || sub == "myid" || sub == "keyslot" || sub == "slots" || sub == "nodes":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown CLUSTER subcommand '%s'", sub))
+	}
+}
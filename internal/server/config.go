@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// A configParam is a setting that CONFIG GET and CONFIG SET can read and
+// change at runtime. Like in Valkey, settings are per-node: CONFIG SET only
+// changes the node that runs it.
+type configParam struct {
+	get func(s *Server) string
+	set func(s *Server, value string) error
+}
+
+var configParams = map[string]configParam{
+	"notify-keyspace-events": {
+		get: func(s *Server) string { return s.notifier.Flags().String() },
+		set: func(s *Server, value string) error {
+			flags, err := parseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+			s.notifier.SetFlags(flags)
+			return nil
+		},
+	},
+}
+
+// config handles CONFIG GET pattern [pattern ...] and CONFIG SET parameter
+// value [parameter value ...].
+func (s *Server) config(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Config)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "get" && len(args) > 0:
+		var names []string
+		for name := range configParams {
+			if slices.ContainsFunc(args, func(pattern string) bool {
+				return globMatch(strings.ToLower(pattern), name)
+			}) {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		writeMap(conn, len(names))
+		for _, name := range names {
+			conn.WriteBulkString(name)
+			conn.WriteBulkString(configParams[name].get(s))
+		}
+	case sub == "set" && len(args) > 0 && len(args)%2 == 0:
+		// Like Valkey, check that every parameter exists before changing any.
+		for i := 0; i < len(args); i += 2 {
+			if _, ok := configParams[strings.ToLower(args[i])]; !ok {
+				conn.WriteError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+				return
+			}
+		}
+		for i := 0; i < len(args); i += 2 {
+			if err := configParams[strings.ToLower(args[i])].set(s, args[i+1]); err != nil {
+				conn.WriteError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", args[i], err))
+				return
+			}
+		}
+		conn.WriteString("OK")
+	case sub == "get" || sub == "set":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'config|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown CONFIG subcommand '%s'", sub))
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// connState is the server's per-connection state, stored in the redcon
+// connection's context. Anything a command needs to remember between
+// requests on the same connection belongs here, rather than in the Server,
+// so that connections can't observe each other's state.
+//
+// Connections are served one command at a time, so connState needs no
+// locking.
+type connState struct {
+	id       int64
+	client   *clientInfo // what other connections see of this one
+	protocol int         // 2 or 3
+	name     string
+	user     string // authenticated user
+	authed   bool
+
+	// Transaction state, between MULTI and EXEC or DISCARD.
+	multi   bool
+	dirty   bool // a command was refused, so EXEC will fail
+	queued  []queuedCommand
+	watched map[string]watchedKey
+
+	// pinned is the snapshot the connection reads from, if any, after
+	// SNAPSHOT PIN.
+	pinned *snapshotView
+	// stale is set by READONLY, so that reads on a replica may come from
+	// its copy of the database (see replica.go).
+	stale bool
+	// db is the logical database the connection works in (see select.go).
+	db int
+
+	// Resource limits (see limits.go), which survive RESET.
+	limiter   rateLimiter
+	output    int  // bytes of replies waiting to be sent
+	overLimit bool // output passed MaxOutputBuffer
+}
+
+// newConnState returns the state of a newly accepted connection. If the
+// server has no password, connections start out authenticated as the default
+// user.
+func (s *Server) newConnState(client *clientInfo) *connState {
+	return &connState{
+		id:       client.id,
+		client:   client,
+		protocol: 2,
+		user:     "default",
+		authed:   s.password == "",
+	}
+}
+
+var errClientName = errors.New("Client names cannot contain spaces, newlines or special characters.")
+
+// validClientName reports whether a connection name is allowed. Like Valkey,
+// names may only contain printable ASCII characters other than spaces.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func stateOf(conn redcon.Conn) *connState {
+	if st, ok := conn.Context().(*connState); ok {
+		return st
+	}
+	// Connections are given state when they're accepted, so this is only
+	// reachable in tests that construct connections by hand.
+	st := &connState{client: &clientInfo{multi: -1}, protocol: 2}
+	conn.SetContext(st)
+	return st
+}
+
+// reset handles RESET, which returns the connection to the state it was
+// accepted in: it discards any transaction, unwatches every key, switches
+// back to RESP2 and database 0, forgets the connection's name, and
+// deauthenticates. The connection keeps its ID and its place in the rate
+// limit, so that RESET can't be used to escape the limit.
+func (s *Server) reset(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Reset)
+		return
+	}
+	old := stateOf(conn)
+	st := s.newConnState(old.client)
+	st.limiter, st.output, st.overLimit = old.limiter, old.output, old.overLimit
+	conn.SetContext(st)
+	conn.WriteString("RESET")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// Every RESP command runs in a context that ends when its deadline passes,
+// when its client disconnects or is killed, or when the server closes.
+// Calls to object storage made in that context are abandoned, so a slow or
+// unreachable bucket can't hang the connection, and commands whose clients
+// are gone stop using storage on their behalf.
+
+// errClientGone is returned by commands whose connection closed while they
+// ran. Nobody sees it, but it stops the command.
+var errClientGone = errors.New("client disconnected")
+
+// CommandTimeouts are the deadlines for each class of command, including
+// any retries. Zero durations are unlimited.
+type CommandTimeouts struct {
+	// Read bounds commands that only read keys, like GET and SCAN.
+	Read time.Duration
+	// Write bounds commands that write keys, including EXEC, and any other
+	// command that isn't a read or an administrative command.
+	Write time.Duration
+	// Admin bounds commands that manage the server or the whole database,
+	// like FLUSHALL, LOAD, and INVALIDATE, which may take much longer.
+	Admin time.Duration
+}
+
+// timeout returns the deadline for a command.
+func (t CommandTimeouts) timeout(name op.Op) time.Duration {
+	switch name {
+	case op.Get, op.MGet, op.VGet, op.Type, op.Exists, op.Dump,
+		op.Strlen, op.GetRange, op.Object, op.BitFieldRO,
+		op.TTL, op.PTTL,
+		op.HGet, op.HGetAll, op.HExists, op.HLen, op.HRandField,
+		op.LLen, op.LRange,
+		op.SMembers, op.SIsMember, op.SCard, op.SRandMember,
+		op.ZScore, op.ZCard, op.ZRange,
+		op.DBSize, op.Keys, op.Scan, op.Range, op.Generation, op.GetAt:
+		return t.Read
+	case op.FlushAll, op.FlushDB, op.Load, op.LoadIf, op.BgSave, op.LastSave,
+		op.Debug, op.Config, op.Cluster, op.Client, op.ACL, op.Info, op.Stats,
+		op.HotKeys, op.Invalidate, op.Resume, op.Snapshot, op.Script, op.Function:
+		return t.Admin
+	}
+	return t.Write
+}
+
+// commandContext returns the context for a command run by a connection. The
+// returned function releases it and must be called when the command is done.
+func (s *Server) commandContext(info *clientInfo, name op.Op) (context.Context, context.CancelFunc) {
+	parent := info.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	// Disconnecting cancels the connection's context, and so the command,
+	// and so does the deadline.
+	if info.commandStarted != nil {
+		info.commandStarted()
+	}
+	if d := s.timeouts.timeout(name); d > 0 {
+		return context.WithTimeout(parent, d)
+	}
+	return context.WithCancel(parent)
+}
+
+// interrupted returns the error a command gets when its context ends.
+func interrupted(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return errClientGone
+}
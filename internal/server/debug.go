@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errDebugDisabled = errors.New("DEBUG command not allowed. If the --enable-debug-commands option is not set, you can't use this command")
+
+// debug handles DEBUG subcommands, which give tests explicit control over
+// the node and expose its internals. They're only available if the server
+// was started with EnableDebugCommands.
+//
+//   - DEBUG RELOAD drops any state the node holds and re-reads the database
+//     from object storage.
+//   - DEBUG QUICKSAVE writes the current database back to object storage,
+//     even if nothing has changed.
+//   - DEBUG SLEEP seconds stalls the connection, as if the node were
+//     unresponsive, and then replies OK. Like other commands, it gives up
+//     when it times out or the client disconnects.
+//   - DEBUG OBJECT key describes how a key is stored.
+//   - DEBUG CACHE describes what the node holds in memory for each shard.
+//   - DEBUG SET-ACTIVE-EXPIRE 0|1 pauses or resumes the background sweep
+//     that removes expired keys from object storage. Expired keys stay
+//     invisible to clients either way.
+func (s *Server) debug(conn redcon.Conn, args []string) {
+	if !s.debugging {
+		writeErr(conn, errDebugDisabled)
+		return
+	}
+	if len(args) == 0 {
+		writeErrArity(conn, op.Debug)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	var err error
+	switch {
+	case sub == "reload" && len(args) == 0:
+		// Dropping the cache forces a full download, which verifies that the
+		// stored database is readable.
+		s.store.DropCache()
+		_, err = s.store.GetDB()
+	case sub == "quicksave" && len(args) == 0:
+		_, err = s.store.MutateDB(func(db *database) (int, error) {
+			return 0, nil
+		})
+	case sub == "sleep" && len(args) == 1:
+		secs, perr := strconv.ParseFloat(args[0], 64)
+		if perr != nil || secs < 0 {
+			err = errors.New("value is not a valid float")
+			break
+		}
+		timer := time.NewTimer(time.Duration(secs * float64(time.Second)))
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			err = interrupted(s.ctx)
+		}
+	case sub == "set-active-expire" && len(args) == 1:
+		switch args[0] {
+		case "0":
+			s.activeExpire.Store(false)
+		case "1":
+			s.activeExpire.Store(true)
+		default:
+			err = errNotAnInteger
+		}
+	case sub == "object" && len(args) == 1:
+		s.debugObject(conn, args[0])
+		return
+	case sub == "cache" && len(args) == 0:
+		s.debugCache(conn)
+		return
+	case sub == "reload" || sub == "quicksave" || sub == "sleep" || sub == "object" || sub == "cache" || sub == "set-active-expire":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'debug|%s' command", sub))
+		return
+	default:
+		err = fmt.Errorf("unknown DEBUG subcommand '%s'", sub)
+	}
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// debugObject handles DEBUG OBJECT key, which replies with a line of
+// space-separated fields describing the key, like Valkey's.
+func (s *Server) debugObject(conn redcon.Conn, key string) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if !db.exists(key) {
+		writeErr(conn, errors.New("no such key"))
+		return
+	}
+	fields := []string{
+		"type:" + db.typeOf(key),
+		"shard:" + s.store.shardFor(key).key,
+		fmt.Sprintf("version:%d", db.Versions[key]),
+		fmt.Sprintf("generation:%d", db.Generation),
+		fmt.Sprintf("serializedlength:%d", db.size(key)),
+	}
+	if at, ok := db.Expires[key]; ok {
+		fields = append(fields, fmt.Sprintf("expires_at_ms:%d", at))
+	}
+	conn.WriteString(strings.Join(fields, " "))
+}
+
+// debugCache handles DEBUG CACHE, which replies with a line for each shard
+// describing the copy of it this node holds: the ETag and size of the cached
+// object, and in log mode, the log entry the node has replayed up to.
+func (s *Server) debugCache(conn redcon.Conn) {
+	conn.WriteArray(len(s.store.shards()))
+	for _, sh := range s.store.shards() {
+		sh.mu.Lock()
+		fields := []string{
+			"shard:" + sh.key,
+			"etag:" + sh.cached.etag,
+			fmt.Sprintf("bytes:%d", len(sh.cached.body)),
+		}
+		if sh.state != nil {
+			fields = append(fields,
+				"log_id:"+sh.state.LogID,
+				fmt.Sprintf("sequence:%d", sh.state.Sequence),
+				fmt.Sprintf("generation:%d", sh.state.Generation),
+			)
+		}
+		sh.mu.Unlock()
+		fields = append(fields, fmt.Sprintf("log_entries:%d", sh.logEntries.Load()))
+		conn.WriteBulkString(strings.Join(fields, " "))
+	}
+}
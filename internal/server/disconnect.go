@@ -0,0 +1,75 @@
+//go:build linux || darwin
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// watchDisconnect calls cancel if conn's peer closes it, until ctx ends. The
+// returned function must be called whenever a command starts.
+//
+// redcon only reads from a connection between commands, so a client that
+// disconnects mid-command would otherwise go unnoticed until the command
+// finished. Instead, a single watcher for the connection waits for the
+// socket to become readable and peeks at it, without consuming anything
+// redcon should read: end of file or an error means the client is gone.
+// Data means it's still there, and it may be the next command, so the
+// watcher pauses until that command starts rather than waking again and
+// again for the same data.
+func watchDisconnect(ctx context.Context, conn net.Conn, cancel func()) (commandStarted func()) {
+	for {
+		// TLS connections wrap the TCP connection.
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+	started := make(chan struct{}, 1)
+	go func() {
+		var buf [1]byte
+		for {
+			gone := false
+			// Read waits for the socket to become readable whenever the
+			// function returns false, and fails once the connection closes.
+			err := raw.Read(func(fd uintptr) bool {
+				n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+				switch {
+				case err == syscall.EAGAIN || err == syscall.EINTR:
+					return false
+				case err != nil || n == 0:
+					gone = true
+				}
+				return true
+			})
+			if gone {
+				cancel()
+			}
+			if gone || err != nil {
+				return
+			}
+			select {
+			case <-started:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin)
+
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// watchDisconnect would cancel the commands of a client that disconnects,
+// but peeking at sockets isn't supported on this platform, so commands only
+// stop at their deadline or when their connection is killed.
+func watchDisconnect(ctx context.Context, conn net.Conn, cancel func()) (commandStarted func()) {
+	return func() {}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/dump"
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errBusyKey     = errors.New("Target key name already exists.")
+	errBadPayload  = errors.New("DUMP payload version or checksum are wrong")
+	errNegativeTTL = errors.New("Invalid TTL value, must be >= 0")
+	errInvalidIdle = errors.New("Invalid IDLETIME value, must be >= 0")
+	errInvalidFreq = errors.New("Invalid FREQ value, must be >= 0 and <= 255")
+)
+
+// dumpKey handles DUMP key, which replies with the key's value serialized in
+// the same format as Valkey's DUMP, or null if the key doesn't exist. The
+// serialization doesn't include the key's TTL.
+func (s *Server) dumpKey(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Dump)
+		return
+	}
+	key := args[0]
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if !db.exists(key) {
+		conn.WriteNull()
+		return
+	}
+	payload, err := dump.Serialize(db.entry(key))
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteBulk(payload)
+}
+
+// restoreKey handles RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency], which creates a key from the output
+// of DUMP, whether Valthree's or Valkey's. The TTL is in milliseconds, and
+// zero means none; with ABSTTL, it's a Unix time in milliseconds. Without
+// REPLACE, an existing key is an error. Valthree doesn't track idle time or
+// access frequency, so IDLETIME and FREQ are checked but otherwise ignored.
+func (s *Server) restoreKey(conn redcon.Conn, args []string) {
+	if len(args) < 3 {
+		writeErrArity(conn, op.Restore)
+		return
+	}
+	key := args[0]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	var replace, absTTL bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(args) {
+				writeErr(conn, errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				writeErr(conn, errNotAnInteger)
+				return
+			}
+			if opt == "IDLETIME" && n < 0 {
+				writeErr(conn, errInvalidIdle)
+				return
+			}
+			if opt == "FREQ" && (n < 0 || n > 255) {
+				writeErr(conn, errInvalidFreq)
+				return
+			}
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+	if ttl < 0 {
+		writeErr(conn, errNegativeTTL)
+		return
+	}
+	e, err := dump.Deserialize([]byte(args[2]))
+	if err != nil {
+		writeErr(conn, errBadPayload)
+		return
+	}
+	e.Key = key
+
+	_, err = s.kv.MutateKey(key, func(db *database) (int, error) {
+		if db.exists(key) && !replace {
+			return 0, errBusyKey
+		}
+		now := s.store.now()
+		switch {
+		case ttl > 0 && absTTL:
+			e.ExpireAt = time.UnixMilli(ttl)
+		case ttl > 0:
+			e.ExpireAt = now.Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if !e.ExpireAt.IsZero() && !e.ExpireAt.After(now) {
+			// Like Valkey, restoring an already-expired key only deletes
+			// the key it would have replaced.
+			if db.exists(key) {
+				db.deleteItem(key)
+				db.notify('g', "del", key)
+			}
+			return 0, nil
+		}
+		if !db.exists(key) && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		db.setEntry(e)
+		db.notify('g', "restore", key)
+		return 1, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteString("OK")
+}
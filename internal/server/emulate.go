@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Some S3-compatible stores ignore If-Match and If-None-Match. For them,
+// Valthree can optionally emulate conditional writes: the writer takes a
+// short-lived lock object, reads the database object to check its ETag, and
+// only then writes unconditionally.
+//
+// This is much weaker than real conditional writes. Taking the lock is itself
+// a race, which we narrow (but can't close) by waiting and reading the lock
+// back. Locks expire by the writer's wall clock, so a writer that stalls
+// longer than the lock's lifetime can overwrite a newer database. Use this
+// only for development and testing against stores that need it.
+
+// emulatedLockSettle is how long a writer waits after writing the lock object
+// before reading it back to see whether another writer overwrote it.
+const emulatedLockSettle = 20 * time.Millisecond
+
+// emulatedPut writes the database object, emulating the If-Match or
+// If-None-Match precondition in input.
+func (sh *shard) emulatedPut(ctx context.Context, input *s3.PutObjectInput, etag string) error {
+	input.IfMatch = nil
+	input.IfNoneMatch = nil
+
+	release, err := sh.lockObject(ctx)
+	if err != nil {
+		sh.store.stats.storageErrors.Add(1)
+		return err
+	}
+	defer release()
+
+	res, err := sh.store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(sh.store.bucket),
+		Key:    aws.String(sh.key),
+	})
+	var current string
+	var errNotFound *types.NotFound
+	switch {
+	case errors.As(err, &errNotFound):
+	case err != nil:
+		sh.store.stats.storageErrors.Add(1)
+		return fmt.Errorf("%w: head object: %v", ErrStorageUnavailable, err)
+	default:
+		current = aws.ToString(res.ETag)
+	}
+	if current != etag {
+		sh.store.stats.conflicts.Add(1)
+		return errMismatchedETag
+	}
+
+	if _, err := sh.store.client.PutObject(ctx, input); err != nil {
+		sh.store.stats.storageErrors.Add(1)
+		return fmt.Errorf("%w: put object: %v", ErrStorageUnavailable, err)
+	}
+	sh.store.stats.writes.Add(1)
+	return nil
+}
+
+// lockObject takes the shard's lock object, waiting for other writers to
+// release it. The returned function releases the lock.
+func (sh *shard) lockObject(ctx context.Context) (func(), error) {
+	key := sh.key + ".lock"
+	token := rand.Text()
+	read := func() (string, time.Time, error) {
+		res, err := sh.store.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(sh.store.bucket),
+			Key:    aws.String(key),
+		})
+		var errNoKey *types.NoSuchKey
+		if errors.As(err, &errNoKey) {
+			return "", time.Time{}, nil
+		} else if err != nil {
+			return "", time.Time{}, fmt.Errorf("%w: get lock object: %v", ErrStorageUnavailable, err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("%w: read lock object: %v", ErrStorageUnavailable, err)
+		}
+		owner, expiresStr, _ := strings.Cut(string(body), " ")
+		expires, _ := strconv.ParseInt(expiresStr, 10, 64)
+		return owner, time.UnixMilli(expires), nil
+	}
+
+	for {
+		owner, expires, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" && time.Now().Before(expires) {
+			if err := sleepCtx(ctx, emulatedLockSettle); err != nil {
+				return nil, fmt.Errorf("wait for lock object: %v", err)
+			}
+			continue
+		}
+		expires = time.Now().Add(sh.store.timeout)
+		body := token + " " + strconv.FormatInt(expires.UnixMilli(), 10)
+		_, err = sh.store.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(sh.store.bucket),
+			Key:    aws.String(key),
+			Body:   strings.NewReader(body),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: put lock object: %v", ErrStorageUnavailable, err)
+		}
+		// Concurrent writers may have overwritten our lock. Give them time to
+		// land, then check who won.
+		if err := sleepCtx(ctx, emulatedLockSettle); err != nil {
+			return nil, fmt.Errorf("wait for lock object: %v", err)
+		}
+		owner, _, err = read()
+		if err != nil {
+			return nil, err
+		}
+		if owner == token {
+			break
+		}
+	}
+
+	return func() {
+		// Don't use ctx, which may have expired.
+		ctx, cancel := context.WithTimeout(context.Background(), sh.store.timeout)
+		defer cancel()
+		_, _ = sh.store.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(sh.store.bucket),
+			Key:    aws.String(key),
+		})
+	}, nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors that commands may fail with. Handlers and the storage layer wrap
+// them with details, so embedders can classify failures with errors.Is.
+// Each is also sent to clients with its own error code instead of ERR.
+var (
+	// ErrContention means a write collided with concurrent writes to object
+	// storage and wasn't applied. Retrying may succeed.
+	ErrContention = errors.New("write conflicted with concurrent writes")
+	// ErrStorageUnavailable means object storage couldn't be read or written.
+	// The command may or may not have taken effect.
+	ErrStorageUnavailable = errors.New("object storage unavailable")
+	// ErrCapacity means a write would exceed the server's key limit or a
+	// quota.
+	ErrCapacity = errors.New("capacity exceeded")
+	// ErrWrongType means a command was used on a key holding another type of
+	// value.
+	ErrWrongType = errors.New("Operation against a key holding the wrong kind of value")
+	// ErrTimeout means a command passed its deadline (see
+	// Config.CommandTimeouts). The command may or may not have taken
+	// effect.
+	ErrTimeout = errors.New("command timed out")
+)
+
+// errorCodes are the codes that replace ERR for typed errors. WRONGTYPE, OOM,
+// BUSYKEY, NOSCRIPT, and READONLY match Valkey, and BUSY is Valkey's code for
+// a script that ran too long; the others are specific to Valthree.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrWrongType, "WRONGTYPE"},
+	{ErrCapacity, "OOM"},
+	{ErrContention, "TRYAGAIN"},
+	{ErrStorageUnavailable, "STORAGEDOWN"},
+	{errBusyKey, "BUSYKEY"},
+	{errPinnedSnapshot, "READONLY"},
+	{errReadOnlyReplica, "READONLY"},
+	{ErrTimeout, "BUSY"},
+	{errNoScript, "NOSCRIPT"},
+}
+
+// errorCode returns the code clients see for an error.
+func errorCode(err error) string {
+	var moved *movedError
+	if errors.As(err, &moved) {
+		return "MOVED"
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return "ERR"
+}
+
+// errAtCapacity is returned by writes that would add a key to a full
+// database.
+func (s *Server) errAtCapacity() error {
+	return fmt.Errorf("%w: at most %d keys", ErrCapacity, s.maxItems())
+}
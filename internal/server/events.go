@@ -0,0 +1,140 @@
+package server
+
+import (
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/antithesishq/valthree/internal/dump"
+)
+
+// eventKind identifies what an event describes.
+type eventKind int
+
+const (
+	// eventKeyWritten means a write created or modified a key.
+	eventKeyWritten eventKind = iota + 1
+	// eventKeyDeleted means a write deleted a key.
+	eventKeyDeleted
+	// eventFlush means FLUSHALL emptied a shard. Sharded databases publish
+	// one for each shard, and publish no per-key events.
+	eventFlush
+	// eventConflict means a write lost a race with another node and will be
+	// retried. Keys are the keys the write touched, if known.
+	eventConflict
+	// eventLeaderChange means a lock was granted to a new owner.
+	eventLeaderChange
+	// eventNotification is a keyspace notification recorded by a command.
+	eventNotification
+)
+
+// An event describes something that happened in the storage layer. Features
+// that react to changes, like metrics and notifications, subscribe to events
+// rather than each hooking into the write path.
+type event struct {
+	Kind eventKind
+	// Key is the key written or deleted, or the name of the lock that
+	// changed hands.
+	Key   string
+	Keys  []string // for conflicts
+	Owner string   // the lock's new owner, for leader changes
+	// Notification is the keyspace notification, for notification events.
+	Notification notification
+	// Value is the key's new value, for writes, if the storage layer was
+	// asked to record values. It's a copy, so later writes don't change it.
+	Value *dump.Entry
+	// Generation is the generation of the write that caused the event. It's
+	// zero for conflicts, since the write didn't happen.
+	Generation uint64
+}
+
+// eventBus delivers events to subscribers. Events are only published for
+// writes made by this node, after they're durable in object storage, and
+// each shard's events are published in the order its writes were applied.
+//
+// Delivery is synchronous and happens on the write path while the shard is
+// locked, so subscribers must be quick and must not read or write the
+// database themselves.
+type eventBus struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]func(event)
+}
+
+// Subscribe registers f to receive every subsequent event. Calling the
+// returned function stops delivery.
+func (b *eventBus) Subscribe(f func(event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[int]func(event))
+	}
+	id := b.next
+	b.next++
+	b.subs[id] = f
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish delivers events to every subscriber.
+func (b *eventBus) Publish(events ...event) {
+	if len(events) == 0 {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, f := range b.subs {
+		for _, e := range events {
+			f(e)
+		}
+	}
+}
+
+// changes returns the events caused by a write, given the versions and
+// leases from before it was applied. If values is set, write events include
+// the keys' new values.
+func changes(versions map[string]uint64, leases map[string]lease, db *database, values bool) []event {
+	if db.flushed {
+		return []event{{Kind: eventFlush, Generation: db.Generation}}
+	}
+	var events []event
+	for key, version := range db.Versions {
+		if version == db.Generation {
+			e := event{Kind: eventKeyWritten, Key: key, Generation: db.Generation}
+			if values {
+				e.Value = db.entryCopy(key)
+			}
+			events = append(events, e)
+		}
+	}
+	for key := range versions {
+		if _, ok := db.Versions[key]; !ok {
+			events = append(events, event{Kind: eventKeyDeleted, Key: key, Generation: db.Generation})
+		}
+	}
+	for name, l := range db.Leases {
+		if old, ok := leases[name]; !ok || old.Owner != l.Owner {
+			events = append(events, event{Kind: eventLeaderChange, Key: name, Owner: l.Owner, Generation: db.Generation})
+		}
+	}
+	for _, e := range db.notifications {
+		e.Generation = db.Generation
+		events = append(events, e)
+	}
+	return events
+}
+
+// entryCopy returns a key and its value, which must exist, sharing nothing
+// with db.
+func (db *database) entryCopy(key string) *dump.Entry {
+	e := db.entry(key)
+	e.List = slices.Clone(e.List)
+	if e.Set != nil {
+		e.Set = e.Set.Clone()
+	}
+	e.Hash = maps.Clone(e.Hash)
+	return &e
+}
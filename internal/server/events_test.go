@@ -0,0 +1,97 @@
+package server
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestEventBus(t *testing.T) {
+	var (
+		bus       eventBus
+		got1      []string
+		got2      []string
+		published = []event{
+			{Kind: eventKeyWritten, Key: "a"},
+			{Kind: eventKeyDeleted, Key: "b"},
+		}
+	)
+	bus.Publish(published...) // no subscribers yet
+	unsubscribe1 := bus.Subscribe(func(e event) { got1 = append(got1, e.Key) })
+	unsubscribe2 := bus.Subscribe(func(e event) { got2 = append(got2, e.Key) })
+
+	// Every subscriber gets every event, in order.
+	bus.Publish(published...)
+	bus.Publish()
+	bus.Publish(event{Kind: eventFlush, Key: "c"})
+	attest.Equal(t, got1, []string{"a", "b", "c"})
+	attest.Equal(t, got2, []string{"a", "b", "c"})
+
+	// Unsubscribing stops delivery to that subscriber only, and is
+	// idempotent.
+	unsubscribe1()
+	unsubscribe1()
+	bus.Publish(event{Kind: eventKeyWritten, Key: "d"})
+	attest.Equal(t, got1, []string{"a", "b", "c"})
+	attest.Equal(t, got2, []string{"a", "b", "c", "d"})
+	unsubscribe2()
+	bus.Publish(event{Kind: eventKeyWritten, Key: "e"})
+	attest.Equal(t, got2, []string{"a", "b", "c", "d"})
+
+	// Subscribing again after unsubscribing works.
+	var got3 []string
+	bus.Subscribe(func(e event) { got3 = append(got3, e.Key) })
+	bus.Publish(event{Kind: eventKeyWritten, Key: "f"})
+	attest.Equal(t, got3, []string{"f"})
+}
+
+func TestChanges(t *testing.T) {
+	db := newDatabase()
+	db.Generation = 1
+	db.setItem("kept", "1")
+	db.setItem("written", "1")
+	db.setItem("deleted", "1")
+	versions := maps.Clone(db.Versions)
+	leases := maps.Clone(db.Leases)
+
+	db.Generation = 2
+	db.setItem("written", "2")
+	db.setItem("created", "2")
+	db.deleteItem("deleted")
+	db.Leases["leader"] = lease{Owner: "node1"}
+	events := changes(versions, leases, db, true /* values */)
+	slices.SortFunc(events, func(a, b event) int {
+		return cmp.Or(cmp.Compare(a.Kind, b.Kind), strings.Compare(a.Key, b.Key))
+	})
+
+	attest.Equal(t, len(events), 4)
+	for _, e := range events {
+		attest.Equal(t, e.Generation, uint64(2))
+	}
+	attest.Equal(t, events[0].Kind, eventKeyWritten)
+	attest.Equal(t, events[0].Key, "created")
+	attest.Equal(t, events[1].Kind, eventKeyWritten)
+	attest.Equal(t, events[1].Key, "written")
+	attest.Equal(t, events[1].Value.String, "2")
+	attest.Equal(t, events[2].Kind, eventKeyDeleted)
+	attest.Equal(t, events[2].Key, "deleted")
+	attest.Equal(t, events[3].Kind, eventLeaderChange)
+	attest.Equal(t, events[3].Owner, "node1")
+
+	// Values are copies, so later writes don't change them.
+	db.setItem("written", "3")
+	attest.Equal(t, events[1].Value.String, "2")
+	for _, e := range changes(versions, leases, db, false /* values */) {
+		attest.Zero(t, e.Value)
+	}
+
+	// Flushes replace per-key events.
+	db.flushed = true
+	events = changes(versions, leases, db, true /* values */)
+	attest.Equal(t, len(events), 1)
+	attest.Equal(t, events[0].Kind, eventFlush)
+}
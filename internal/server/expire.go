@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// Keys expire according to the wall clock of whichever node next reads the
+// database. As with lock leases, clock skew between nodes makes expiration
+// approximate.
+//
+// Expired keys are removed lazily, whenever a node reads the database, so no
+// command ever observes them. A background sweeper also periodically writes
+// the database back without expired keys, so they don't linger in object
+// storage (or count against quotas) on an idle cluster.
+//
+// Expired lock leases are removed the same way, so that locks that are taken
+// once and never released don't accumulate in the database.
+
+// expire removes expired keys and lock leases from the database and returns
+// how many it removed.
+func (db *database) expire(now time.Time) int {
+	var n int
+	ms := now.UnixMilli()
+	for key, at := range db.Expires {
+		if ms < at {
+			continue
+		}
+		db.deleteItem(key)
+		n++
+	}
+	for name, l := range db.Leases {
+		if l.expired(now) {
+			delete(db.Leases, name)
+			n++
+		}
+	}
+	return n
+}
+
+// sweepExpired periodically persists the removal of expired keys until the
+// context is canceled. DEBUG SET-ACTIVE-EXPIRE 0 pauses it, leaving expired
+// keys in object storage until a write to their shard removes them.
+func (s *Server) sweepExpired(ctx context.Context, logger *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.activeExpire.Load() {
+			continue
+		}
+		for _, store := range s.dbs {
+			db, err := store.GetDB()
+			if err != nil {
+				logger.Warn("read database to sweep expired keys", "database", store.name, "err", err)
+				continue
+			}
+			if db.expired == 0 {
+				continue
+			}
+			// MutateDB re-reads the database, which expires the keys again.
+			n, err := store.MutateDB(func(db *database) (int, error) {
+				return db.expired, nil
+			})
+			if err != nil {
+				logger.Warn("sweep expired keys", "database", store.name, "err", err)
+				continue
+			}
+			logger.Debug("swept expired keys", "database", store.name, "count", n)
+		}
+	}
+}
+
+// expireCmd handles EXPIRE key seconds [NX | XX | GT | LT] and PEXPIRE key
+// milliseconds [NX | XX | GT | LT], which reply with 1 if the key's
+// expiration was set and 0 otherwise. A non-positive timeout deletes the key
+// immediately.
+//
+// The options make the update conditional: NX only sets an expiration on a
+// key that has none, XX only replaces an existing one, GT only extends it,
+// and LT only shortens it. As in Valkey, keys without an expiration are
+// treated as living forever, so GT never applies to them and LT always does.
+func (s *Server) expireCmd(conn redcon.Conn, name op.Op, args []string, unit time.Duration) {
+	if len(args) < 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	key := args[0]
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			writeErr(conn, fmt.Errorf("Unsupported option %s", arg))
+			return
+		}
+	}
+	if nx && (xx || gt || lt) {
+		writeErr(conn, errors.New("NX and XX, GT or LT options at the same time are not compatible"))
+		return
+	}
+	if gt && lt {
+		writeErr(conn, errors.New("GT and LT options at the same time are not compatible"))
+		return
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	if n > int64(math.MaxInt64/unit) {
+		writeErr(conn, fmt.Errorf("invalid expire time in '%s' command", name))
+		return
+	}
+	ttl := time.Duration(max(n, 0)) * unit
+
+	found, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if !db.exists(key) {
+			return 0, errNotApplied
+		}
+		// Unexpired keys expire in the future, so comparing against a
+		// clamped timeout orders past times correctly.
+		at := s.store.now().Add(ttl).UnixMilli()
+		current, volatile := db.Expires[key]
+		switch {
+		case nx && volatile, xx && !volatile:
+			return 0, errNotApplied
+		case gt && (!volatile || at <= current), lt && volatile && at >= current:
+			return 0, errNotApplied
+		}
+		if ttl <= 0 {
+			db.deleteItem(key)
+			db.notify('g', "del", key)
+			return 1, nil
+		}
+		db.Expires[key] = at
+		db.notify('g', "expire", key)
+		return 1, nil
+	})
+	if err != nil && !errors.Is(err, errNotApplied) {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(found)
+}
+
+// ttl handles TTL key and PTTL key, which reply with the key's remaining time
+// to live, -1 if the key exists but doesn't expire, or -2 if it doesn't
+// exist.
+func (s *Server) ttl(conn redcon.Conn, name op.Op, args []string, unit time.Duration) {
+	if len(args) != 1 {
+		writeErrArity(conn, name)
+		return
+	}
+	key := args[0]
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if !db.exists(key) {
+		conn.WriteInt(-2)
+		return
+	}
+	at, ok := db.Expires[key]
+	if !ok {
+		conn.WriteInt(-1)
+		return
+	}
+	remaining := time.UnixMilli(at).Sub(s.store.now())
+	// Like Valkey, round to the nearest unit.
+	conn.WriteInt64(int64((remaining + unit/2) / unit))
+}
+
+// persist handles PERSIST key, which removes the key's expiration and replies
+// with 1 if it had one and 0 otherwise.
+func (s *Server) persist(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Persist)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if _, ok := db.Expires[key]; !ok {
+			return 0, nil
+		}
+		delete(db.Expires, key)
+		return 1, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// getex handles GETEX key [EX seconds | PX milliseconds | EXAT timestamp |
+// PXAT timestamp | PERSIST], which replies with a string's value like GET and
+// optionally sets or removes its expiration. A timestamp in the past deletes
+// the key after reading it.
+func (s *Server) getex(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.GetEx)
+		return
+	}
+	key := args[0]
+	if len(args) == 1 {
+		s.get(conn, args)
+		return
+	}
+	var (
+		persist bool
+		at      time.Time
+	)
+	switch opt := strings.ToUpper(args[1]); opt {
+	case "PERSIST":
+		if len(args) != 2 {
+			writeErr(conn, errSyntax)
+			return
+		}
+		persist = true
+	case "EX", "PX", "EXAT", "PXAT":
+		if len(args) != 3 {
+			writeErr(conn, errSyntax)
+			return
+		}
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		unit := time.Second
+		if opt == "PX" || opt == "PXAT" {
+			unit = time.Millisecond
+		}
+		if n <= 0 || n > int64(math.MaxInt64/unit) {
+			writeErr(conn, fmt.Errorf("invalid expire time in '%s' command", op.GetEx))
+			return
+		}
+		if opt == "EX" || opt == "PX" {
+			at = s.store.now().Add(time.Duration(n) * unit)
+		} else {
+			at = time.UnixMilli(n * int64(unit/time.Millisecond))
+		}
+	default:
+		writeErr(conn, errSyntax)
+		return
+	}
+
+	var val string
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		var ok bool
+		if val, ok = db.Items[key]; !ok {
+			return 0, errNotApplied
+		}
+		switch {
+		case persist:
+			delete(db.Expires, key)
+		case !at.After(s.store.now()):
+			db.deleteItem(key)
+			db.notify('g', "del", key)
+		default:
+			db.Expires[key] = at.UnixMilli()
+			db.notify('g', "expire", key)
+		}
+		return 0, nil
+	})
+	switch {
+	case errors.Is(err, errNotApplied):
+		conn.WriteNull()
+	case err != nil:
+		writeErr(conn, err)
+	default:
+		conn.WriteBulkString(val)
+	}
+}
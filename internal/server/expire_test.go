@@ -0,0 +1,27 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	db := newDatabase()
+	db.setItem("kept", "v")
+	db.setItem("expired", "v")
+	db.Expires["expired"] = now.UnixMilli()
+	db.Leases["held"] = lease{Owner: "a", Expires: now.Add(time.Minute).UnixMilli()}
+	db.Leases["abandoned"] = lease{Owner: "b", Expires: now.UnixMilli()}
+
+	// Expired keys and leases are both removed.
+	attest.Equal(t, db.expire(now), 2)
+	attest.Equal(t, slices.Sorted(db.keys()), []string{"kept"})
+	_, ok := db.Leases["held"]
+	attest.True(t, ok)
+	_, ok = db.Leases["abandoned"]
+	attest.False(t, ok)
+}
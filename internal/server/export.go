@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/dump"
+)
+
+// ExportFormats are the formats Export writes and Import reads: "json" is
+// Valthree's own format, the same as a snapshot's; "rdb" is the format of
+// Redis and Valkey snapshots; and "resp" is a stream of commands, like an
+// append-only file.
+var ExportFormats = []string{"json", "rdb", "resp"}
+
+var errDatabaseNotEmpty = errors.New("database isn't empty")
+
+// Export writes the whole of logical database n to w, without a running
+// server. Like snapshots, exports of sharded databases aren't from a single
+// point in time. Locks aren't data, so only the JSON format includes them.
+func Export(cfg Config, n int, format string, w io.Writer) error {
+	store, err := openDatabase(cfg, n)
+	if err != nil {
+		return err
+	}
+	db, err := store.GetDB()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		db.Format = dbFormat
+		db.LogID, db.Sequence = "", 0
+		return json.NewEncoder(w).Encode(db)
+	case "rdb":
+		return dump.WriteRDB(w, db.entries())
+	case "resp":
+		return dump.WriteRESP(w, db.entries())
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Import replaces logical database n with the contents of r, without a
+// running server. Unless replace is set, it refuses to overwrite a database
+// that has any keys. Importing is like restoring a snapshot: running servers
+// notice within invalidateCheckInterval, and the current locks are kept.
+func Import(cfg Config, n int, format string, r io.Reader, replace bool) error {
+	store, err := openDatabase(cfg, n)
+	if err != nil {
+		return err
+	}
+	var db *database
+	switch format {
+	case "json":
+		if db, err = decodeDatabase(r); err != nil {
+			return err
+		}
+	case "rdb", "resp":
+		read := dump.ReadRDB
+		if format == "resp" {
+			read = dump.ReadRESP
+		}
+		entries, err := read(r)
+		if err != nil {
+			return err
+		}
+		db = newDatabase()
+		for _, e := range entries {
+			db.setEntry(e)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	// Valkey allows empty strings, so its dumps may hold some, but Valthree
+	// can't store them (see setString). Empty lists, sets, sorted sets, and
+	// hashes don't exist in either, so setEntry skips them.
+	for key, val := range db.Items {
+		if val == "" {
+			return fmt.Errorf("key %q holds an empty string, which Valthree can't store", key)
+		}
+	}
+	db.expire(store.now())
+
+	if !replace {
+		current, err := store.GetDB()
+		if err != nil {
+			return err
+		}
+		if current.len() > 0 {
+			return errDatabaseNotEmpty
+		}
+	}
+	return store.replace(db)
+}
+
+// entries returns the database's keys and values, sorted by key.
+func (db *database) entries() []dump.Entry {
+	var entries []dump.Entry
+	for _, key := range slices.Sorted(db.keys()) {
+		entries = append(entries, db.entry(key))
+	}
+	return entries
+}
+
+// entry returns a key and its value, which must exist.
+func (db *database) entry(key string) dump.Entry {
+	e := dump.Entry{Key: key, Type: db.typeOf(key)}
+	if at, ok := db.Expires[key]; ok {
+		e.ExpireAt = time.UnixMilli(at)
+	}
+	switch e.Type {
+	case dump.TypeString:
+		e.String = db.Items[key]
+	case dump.TypeList:
+		e.List = db.Lists[key]
+	case dump.TypeSet:
+		e.Set = db.Sets[key]
+	case dump.TypeZSet:
+		e.ZSet = make(map[string]float64, len(db.ZSets[key]))
+		for _, m := range db.ZSets[key] {
+			e.ZSet[m.Member] = m.Score
+		}
+	case dump.TypeHash:
+		e.Hash = db.Hashes[key]
+	}
+	return e
+}
+
+// setEntry replaces a key with an imported entry.
+func (db *database) setEntry(e dump.Entry) {
+	db.deleteItem(e.Key)
+	switch e.Type {
+	case dump.TypeString:
+		db.setItem(e.Key, e.String)
+	case dump.TypeList:
+		db.setList(e.Key, e.List)
+	case dump.TypeSet:
+		if e.Set.Len() > 0 {
+			db.Sets[e.Key] = e.Set
+			db.touch(e.Key)
+		}
+	case dump.TypeZSet:
+		z := make(zset, 0, len(e.ZSet))
+		for _, m := range e.SortedZSet() {
+			z = append(z, zmember{m.Member, m.Score})
+		}
+		db.setZSet(e.Key, z)
+	case dump.TypeHash:
+		if len(e.Hash) > 0 {
+			db.Hashes[e.Key] = e.Hash
+			db.touch(e.Key)
+		}
+	}
+	if !e.ExpireAt.IsZero() && db.exists(e.Key) {
+		db.Expires[e.Key] = e.ExpireAt.UnixMilli()
+	}
+}
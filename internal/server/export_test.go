@@ -0,0 +1,52 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/dump"
+	"github.com/antithesishq/valthree/internal/set"
+	"github.com/antithesishq/valthree/internal/simstore"
+	"go.akshayshah.org/attest"
+)
+
+func TestImportEmptyValues(t *testing.T) {
+	cfg := Config{
+		DatabaseName:     "test",
+		S3Endpoint:       simstore.Endpoint,
+		S3Region:         "us-east-1",
+		S3User:           "test",
+		S3Password:       "password",
+		S3Bucket:         "valthree",
+		S3Timeout:        time.Second,
+		StorageTransport: simstore.New(simstore.Options{}),
+	}
+	attest.Ok(t, openStorage(cfg).EnsureBucketExists())
+	encode := func(entries ...dump.Entry) *bytes.Buffer {
+		var buf bytes.Buffer
+		attest.Ok(t, dump.WriteRESP(&buf, entries))
+		return &buf
+	}
+
+	// Empty strings would make later reads fail, so they're refused.
+	err := Import(cfg, 0, "resp", encode(
+		dump.Entry{Key: "full", Type: dump.TypeString, String: "v"},
+		dump.Entry{Key: "empty", Type: dump.TypeString, String: ""},
+	), false /* replace */)
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), `"empty"`)
+
+	// Empty collections don't exist, so they're skipped.
+	attest.Ok(t, Import(cfg, 0, "resp", encode(
+		dump.Entry{Key: "full", Type: dump.TypeString, String: "v"},
+		dump.Entry{Key: "list", Type: dump.TypeList},
+		dump.Entry{Key: "set", Type: dump.TypeSet, Set: set.Set[string]{}},
+		dump.Entry{Key: "zset", Type: dump.TypeZSet, ZSet: map[string]float64{}},
+		dump.Entry{Key: "hash", Type: dump.TypeHash, Hash: map[string]string{}},
+	), false /* replace */))
+	db, err := openStorage(cfg).GetDB()
+	attest.Ok(t, err)
+	attest.Equal(t, slices.Sorted(db.keys()), []string{"full"})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// fifoMutex is a mutex that's granted in the order it was requested.
+// sync.Mutex makes no ordering guarantees, so under heavy contention a slow
+// caller can lose the race for the lock indefinitely.
+type fifoMutex struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []chan struct{}
+}
+
+func (m *fifoMutex) Lock() {
+	m.LockContext(context.Background())
+}
+
+// LockContext is like Lock, but it gives up and returns ctx's error if ctx
+// ends first, leaving its place in line to the callers behind it.
+func (m *fifoMutex) LockContext(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.locked {
+		m.locked = true
+		m.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	m.waiters = append(m.waiters, ready)
+	m.mu.Unlock()
+	select {
+	case <-ready: // Unlock hands ownership directly to us
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := slices.Index(m.waiters, ready); i >= 0 {
+		m.waiters = slices.Delete(m.waiters, i, i+1)
+	} else {
+		// Unlock handed us ownership just as ctx ended, so pass it on.
+		m.unlock()
+	}
+	return ctx.Err()
+}
+
+func (m *fifoMutex) Unlock() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unlock()
+}
+
+// unlock releases the mutex, handing it to the longest waiter if there is
+// one. The caller must hold m.mu.
+func (m *fifoMutex) unlock() {
+	if !m.locked {
+		panic("unlock of unlocked fifoMutex")
+	}
+	if len(m.waiters) == 0 {
+		m.locked = false
+		return
+	}
+	next := m.waiters[0]
+	m.waiters[0] = nil
+	m.waiters = m.waiters[1:]
+	close(next)
+}
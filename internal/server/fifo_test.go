@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+// waitForWaiters blocks until n callers are waiting for m.
+func waitForWaiters(t *testing.T, m *fifoMutex, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mu.Lock()
+		waiting := len(m.waiters)
+		m.mu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFIFOMutexOrder(t *testing.T) {
+	const callers = 50
+	var (
+		m     fifoMutex
+		wg    sync.WaitGroup
+		order []int // guarded by m
+	)
+	m.Lock()
+	for i := range callers {
+		wg.Go(func() {
+			m.Lock()
+			defer m.Unlock()
+			order = append(order, i)
+		})
+		waitForWaiters(t, &m, i+1)
+	}
+	m.Unlock()
+	wg.Wait()
+
+	attest.Equal(t, len(order), callers)
+	for i, got := range order {
+		attest.Equal(t, got, i, attest.Sprintf("caller granted the lock %dth", i))
+	}
+	// Once everyone's done, the mutex is free again.
+	attest.Ok(t, m.LockContext(context.Background()))
+	m.Unlock()
+}
+
+func TestFIFOMutexContext(t *testing.T) {
+	var (
+		m     fifoMutex
+		wg    sync.WaitGroup
+		order []int // guarded by m
+	)
+	m.Lock()
+	lock := func(i int) {
+		m.Lock()
+		defer m.Unlock()
+		order = append(order, i)
+	}
+	wg.Go(func() { lock(0) })
+	waitForWaiters(t, &m, 1)
+
+	// A caller that gives up leaves the line without disturbing it.
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error, 1)
+	go func() { abandoned <- m.LockContext(ctx) }()
+	waitForWaiters(t, &m, 2)
+	wg.Go(func() { lock(2) })
+	waitForWaiters(t, &m, 3)
+	cancel()
+	attest.ErrorIs(t, <-abandoned, context.Canceled)
+	waitForWaiters(t, &m, 2)
+
+	m.Unlock()
+	wg.Wait()
+	attest.Equal(t, order, []int{0, 2})
+
+	// A caller whose context is already done doesn't get the lock.
+	m.Lock()
+	attest.ErrorIs(t, m.LockContext(ctx), context.Canceled)
+	m.Unlock()
+	attest.Panics(t, m.Unlock)
+}
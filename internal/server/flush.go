@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FLUSHDB and FLUSHALL normally empty a shard like any other write: they
+// read it, clear it, and write it back. That costs as much as the shard is
+// large, which is wasteful when none of it is kept. With ASYNC, each shard is
+// emptied without being read. In Valkey, an asynchronous flush swaps in an
+// empty keyspace and frees the old one in the background; object storage
+// can't rename objects, so Valthree does the same by writing in place:
+//
+//   - A shard that isn't logged is replaced with an empty one, conditional
+//     on the ETag the shard object has when it's looked up with HEAD. Object
+//     storage discards the old contents.
+//   - A logged shard gets a log entry that empties it, which is as small as
+//     any other entry. The snapshot and older entries become garbage, and a
+//     compaction is started in the background to collect them.
+//
+// Either way, the new version's generation must follow the old one's, which
+// is why setDB records the generation (and the log position) in the shard
+// object's metadata, where HEAD can read it. Objects written before that,
+// and shards that don't exist yet, are flushed the usual way.
+
+// Metadata keys of shard objects.
+const (
+	metaGeneration = "generation"
+	metaShards     = "shards"
+	metaLogID      = "log-id"
+	metaSequence   = "sequence"
+	metaEntry      = "entry"
+)
+
+// flusher is implemented by keyspaces that can be emptied without reading
+// them.
+type flusher interface {
+	FlushAsync() error
+}
+
+// flushDB empties db. It's passed to MutateDB.
+func flushDB(db *database) (int, error) {
+	db.clear()
+	db.Deleted = db.Generation
+	db.flushed = true
+	return 0, nil
+}
+
+// clear deletes every key and lease.
+func (db *database) clear() {
+	for key := range db.keys() {
+		db.noteChange(key)
+	}
+	clear(db.Items)
+	clear(db.Hashes)
+	clear(db.Lists)
+	clear(db.Sets)
+	clear(db.ZSets)
+	clear(db.Leases)
+	clear(db.Expires)
+	clear(db.Versions)
+}
+
+// metadata returns the object metadata recorded along with db.
+func (db *database) metadata() map[string]string {
+	meta := map[string]string{
+		metaGeneration: strconv.FormatUint(db.Generation, 10),
+	}
+	if db.Shards != 0 {
+		meta[metaShards] = strconv.Itoa(db.Shards)
+	}
+	if db.LogID != "" {
+		meta[metaLogID] = db.LogID
+		meta[metaSequence] = strconv.FormatUint(db.Sequence, 10)
+		if db.Entry != "" {
+			meta[metaEntry] = db.Entry
+		}
+	}
+	return meta
+}
+
+// FlushAsync empties every shard without reading them. Like MutateDB, it
+// updates each shard atomically, but not the database as a whole.
+func (s scopedStorage) FlushAsync() error {
+	_, err := followMoves(s, func() (int, error) {
+		for _, sh := range s.store.shards() {
+			ok, err := sh.flushAsync(s.ctx)
+			if err == nil && !ok {
+				_, err = sh.mutate(s.ctx, nil, flushDB)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	})
+	return err
+}
+
+// flushAsync empties the shard without reading it, retrying as the store's
+// retry policy allows if it loses a race with another write. It returns false
+// if the shard object doesn't record its generation, or if the database may
+// be promoted to shards, so the caller must flush it the usual way.
+func (sh *shard) flushAsync(ctx context.Context) (bool, error) {
+	if sh.count == 1 && sh.store.autoShards > 1 {
+		// Only the usual way reads the shard, which notices if the
+		// database was promoted to shards.
+		return false, nil
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for attempts := 1; ; attempts++ {
+		head, etag, err := sh.headDB(ctx)
+		if err != nil || head == nil {
+			return false, err
+		}
+		if err := sh.check(head); err != nil {
+			return false, err
+		}
+		var generation uint64
+		if head.LogID == "" {
+			generation, err = sh.flushObject(ctx, head, etag)
+		} else {
+			generation, err = sh.flushLog(ctx, head, etag)
+		}
+		if errors.Is(err, errMismatchedETag) {
+			if sh.store.retries.exhausted(attempts) {
+				sh.store.stats.writeRetriesExhausted.Add(1)
+				return false, fmt.Errorf("%w (%d attempts)", ErrTooMuchContention, attempts)
+			}
+			if err := sh.store.retries.backoff(ctx, attempts); err != nil {
+				return false, err
+			}
+			sh.store.stats.writeRetries.Add(1)
+			trace.SpanFromContext(ctx).AddEvent("write conflict, retrying")
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		sh.store.stats.mutations.Add(1)
+		sh.store.events.Publish(event{Kind: eventFlush, Generation: generation})
+		return true, nil
+	}
+}
+
+// flushObject replaces head, a shard that isn't logged, with an empty shard,
+// returning the new generation. The caller must hold mu.
+func (sh *shard) flushObject(ctx context.Context, head *database, etag string) (uint64, error) {
+	db := newDatabase()
+	db.Generation = head.Generation + 1
+	db.Deleted = db.Generation
+	if sh.store.wal && !sh.store.emulate {
+		db.startLog()
+	}
+	if err := sh.setDB(ctx, db, etag); err != nil {
+		return 0, err
+	}
+	// The cached copy is now useless, and may be large.
+	sh.cached = cachedObject{}
+	return db.Generation, nil
+}
+
+// flushLog appends a log entry that empties head, a logged shard, returning
+// the new generation. Only the entries written since the snapshot are read,
+// to find the latest generation. The caller must hold mu.
+func (sh *shard) flushLog(ctx context.Context, head *database, etag string) (uint64, error) {
+	if sh.store.emulate {
+		return 0, errLogNeedsConditionalWrites
+	}
+	generation, seq := head.Generation, head.Sequence
+	if st := sh.state; st != nil && st.LogID == head.LogID && st.Sequence >= seq {
+		generation, seq = st.Generation, st.Sequence
+	}
+	for {
+		e, ok, err := sh.getEntry(ctx, head.LogID, seq+1)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		generation = e.Generation
+		seq++
+	}
+	// As in replay, the entry may be missing because it was compacted.
+	current, err := sh.objectETag(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if current != etag {
+		return 0, errMismatchedETag
+	}
+	e := &logEntry{
+		Generation: generation + 1,
+		Deleted:    generation + 1,
+		Flushed:    true,
+		Put:        newDatabase(),
+	}
+	if err := sh.putEntry(ctx, head.LogID, seq+1, e); err != nil {
+		return 0, err
+	}
+	if err := sh.confirmEntry(ctx, head.LogID, seq+1, e.ID, etag); err != nil {
+		return 0, err
+	}
+	// Compacting replaces the snapshot with an empty one and deletes the
+	// entries, so it collects the flushed keys. It waits for mu, so it
+	// starts once the flush has returned.
+	sh.store.tasks.Go(func() { sh.compactIfNeeded(1) })
+	return e.Generation, nil
+}
+
+// headDB looks up the shard object's metadata, returning a database with only
+// the fields it records, and the object's ETag. It returns nil if the object
+// doesn't exist or was written without the metadata. The caller must hold
+// mu.
+func (sh *shard) headDB(ctx context.Context) (*database, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sh.store.timeout)
+	defer cancel()
+
+	res, err := sh.store.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(sh.store.bucket),
+		Key:    aws.String(sh.key),
+	})
+	var errNotFound *types.NotFound
+	if errors.As(err, &errNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		sh.store.stats.storageErrors.Add(1)
+		return nil, "", fmt.Errorf("%w: head object: %v", ErrStorageUnavailable, err)
+	}
+	meta := res.Metadata
+	generation, err := strconv.ParseUint(meta[metaGeneration], 10, 64)
+	if err != nil {
+		return nil, "", nil
+	}
+	db := newDatabase()
+	db.Generation = generation
+	db.Shards, _ = strconv.Atoi(meta[metaShards])
+	if logID := meta[metaLogID]; logID != "" {
+		seq, err := strconv.ParseUint(meta[metaSequence], 10, 64)
+		if err != nil {
+			return nil, "", nil
+		}
+		db.LogID, db.Sequence, db.Entry = logID, seq, meta[metaEntry]
+	}
+	return db, aws.ToString(res.ETag), nil
+}
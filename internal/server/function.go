@@ -0,0 +1,599 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Functions are scripts that are loaded once, in libraries, and called by
+// name with FCALL. Unlike the scripts cache, libraries are part of the
+// database: like access control lists, they're stored in their own object
+// next to the database, so every node in the cluster shares them. Nodes
+// cache the libraries and revalidate the cache at most once per
+// functionRefreshInterval.
+//
+// A library's code registers its functions with redis.register_function
+// when it's loaded. Only the code is stored, along with the functions it
+// registered, so FCALL loads the library again to call a function. Functions
+// run like scripts (see script.go): atomically, in one shard.
+const functionRefreshInterval = time.Second
+
+// functionFlags are the flags a function may be registered with. They're
+// reported by FUNCTION LIST, and FCALL_RO only calls functions with
+// no-writes.
+var functionFlags = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+var (
+	errNoFunction        = errors.New("Function not found")
+	errNoLibrary         = errors.New("Library not found")
+	errNoFunctions       = errors.New("No functions registered")
+	errLibraryMetadata   = errors.New("Missing library metadata")
+	errLibraryName       = errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	errFunctionName      = errors.New("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	errFunctionPayload   = errors.New("payload version or checksum are wrong")
+	errFunctionWriteFlag = errors.New("Can not execute a script with write flag using *_ro command.")
+)
+
+// A library is a loaded function library.
+type library struct {
+	Name      string            `json:"name"`
+	Code      string            `json:"code"`
+	Functions []libraryFunction `json:"functions"`
+}
+
+// A libraryFunction describes a function registered by a library.
+type libraryFunction struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Flags       []string `json:"flags,omitempty"`
+}
+
+// functionsObject is the stored form of the libraries. FUNCTION DUMP
+// replies with it too.
+type functionsObject struct {
+	Libraries map[string]*library `json:"libraries"`
+}
+
+// functionStore caches the libraries object.
+type functionStore struct {
+	store *storage
+	key   string // object key
+
+	mu      sync.Mutex
+	libs    map[string]*library // never modified in place
+	etag    string
+	fetched time.Time
+}
+
+// Libraries returns all the loaded libraries.
+func (f *functionStore) Libraries() (map[string]*library, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.refresh(false); err != nil {
+		return nil, err
+	}
+	return f.libs, nil
+}
+
+// Function returns the named function and the library that registered it.
+func (f *functionStore) Function(name string) (*library, *libraryFunction, error) {
+	libs, err := f.Libraries()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, lib := range libs {
+		for i := range lib.Functions {
+			if lib.Functions[i].Name == name {
+				return lib, &lib.Functions[i], nil
+			}
+		}
+	}
+	return nil, nil, errNoFunction
+}
+
+// Invalidate drops the cached libraries, so the next lookup downloads them
+// in full.
+func (f *functionStore) Invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.etag = ""
+	f.fetched = time.Time{}
+}
+
+// refresh revalidates the cached libraries if they're stale (or if force is
+// set), like aclStore.refresh. The caller must hold mu.
+func (f *functionStore) refresh(force bool) error {
+	if !force && !f.fetched.IsZero() && time.Since(f.fetched) < functionRefreshInterval {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.store.timeout)
+	defer cancel()
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(f.store.bucket),
+		Key:    aws.String(f.key),
+	}
+	if f.etag != "" {
+		input.IfNoneMatch = aws.String(f.etag)
+	}
+	res, err := f.store.client.GetObject(ctx, input)
+	var (
+		respErr  *awshttp.ResponseError
+		errNoKey *types.NoSuchKey
+	)
+	switch {
+	case errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified:
+	case errors.As(err, &errNoKey):
+		f.libs = make(map[string]*library)
+		f.etag = ""
+	case err != nil:
+		f.store.stats.storageErrors.Add(1)
+		if f.fetched.IsZero() || force {
+			return fmt.Errorf("%w: get functions: %v", ErrStorageUnavailable, err)
+		}
+		// Try again after another interval.
+	default:
+		defer res.Body.Close()
+		var obj functionsObject
+		if err := json.NewDecoder(res.Body).Decode(&obj); err != nil {
+			return fmt.Errorf("unmarshal functions: %v", err)
+		}
+		if obj.Libraries == nil {
+			obj.Libraries = make(map[string]*library)
+		}
+		f.libs = obj.Libraries
+		f.etag = aws.ToString(res.ETag)
+	}
+	f.fetched = time.Now()
+	return nil
+}
+
+// Mutate atomically updates the libraries, retrying if another node updates
+// them concurrently. Libraries are never modified in place, so mutate
+// replaces the entries it changes.
+func (f *functionStore) Mutate(mutate func(libs map[string]*library) error) error {
+	if f.store.unsafe != nil || f.store.emulate {
+		return errors.New("changing functions requires conditional writes")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		if err := f.refresh(true); err != nil {
+			return err
+		}
+		libs := make(map[string]*library, len(f.libs))
+		for name, lib := range f.libs {
+			libs[name] = lib
+		}
+		if err := mutate(libs); err != nil {
+			return err
+		}
+		bs, err := json.Marshal(functionsObject{Libraries: libs})
+		if err != nil {
+			return fmt.Errorf("marshal functions: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), f.store.timeout)
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(f.store.bucket),
+			Key:    aws.String(f.key),
+			Body:   bytes.NewReader(bs),
+		}
+		if f.etag == "" {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = aws.String(f.etag)
+		}
+		res, err := f.store.client.PutObject(ctx, input)
+		cancel()
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			f.store.stats.conflicts.Add(1)
+			continue
+		} else if err != nil {
+			f.store.stats.storageErrors.Add(1)
+			return fmt.Errorf("%w: put functions: %v", ErrStorageUnavailable, err)
+		}
+		f.libs = libs
+		f.etag = aws.ToString(res.ETag)
+		f.fetched = time.Now()
+		return nil
+	}
+}
+
+// addLibrary adds lib to libs, replacing any library with the same name if
+// replace is set. No other library may register the same functions.
+func addLibrary(libs map[string]*library, lib *library, replace bool) error {
+	if _, ok := libs[lib.Name]; ok && !replace {
+		return fmt.Errorf("Library '%s' already exists", lib.Name)
+	}
+	for _, other := range libs {
+		if other.Name == lib.Name {
+			continue
+		}
+		for _, fn := range lib.Functions {
+			if slices.ContainsFunc(other.Functions, func(f libraryFunction) bool { return f.Name == fn.Name }) {
+				return fmt.Errorf("Function %s already exists", fn.Name)
+			}
+		}
+	}
+	libs[lib.Name] = lib
+	return nil
+}
+
+// parseLibrary checks a library's code and loads it to find the functions
+// it registers.
+func parseLibrary(code string) (*library, error) {
+	header, _, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(strings.TrimPrefix(header, "#!"))
+	if !strings.HasPrefix(header, "#!") || len(fields) == 0 {
+		return nil, errLibraryMetadata
+	}
+	if !strings.EqualFold(fields[0], "lua") {
+		return nil, fmt.Errorf("Engine '%s' not found", fields[0])
+	}
+	lib := &library{Code: code}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if key != "name" {
+			return nil, fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		lib.Name = value
+	}
+	if !validFunctionName(lib.Name) {
+		return nil, errLibraryName
+	}
+
+	L, done := newLuaState()
+	defer done()
+	redis := L.NewTable()
+	L.SetGlobal("redis", redis)
+	fns, err := loadLibrary(L, redis, lib.Code)
+	if err != nil {
+		return nil, err
+	}
+	if len(fns) == 0 {
+		return nil, errNoFunctions
+	}
+	for _, fn := range fns {
+		lib.Functions = append(lib.Functions, fn.libraryFunction)
+	}
+	return lib, nil
+}
+
+// A registeredFunction is a function registered by a library as it loads.
+type registeredFunction struct {
+	libraryFunction
+	callback *lua.LFunction
+}
+
+// loadLibrary runs a library's code, with register_function added to the
+// redis table, and returns the functions it registers in order.
+func loadLibrary(L *lua.LState, redis *lua.LTable, code string) ([]registeredFunction, error) {
+	var fns []registeredFunction
+	L.SetField(redis, "register_function", L.NewFunction(func(L *lua.LState) int {
+		var fn registeredFunction
+		switch arg := L.Get(1).(type) {
+		case lua.LString:
+			fn.Name, fn.callback = string(arg), L.CheckFunction(2)
+		case *lua.LTable:
+			name, ok := arg.RawGetString("function_name").(lua.LString)
+			if !ok {
+				L.RaiseError("function_name argument given to server.register_function must be a string")
+			}
+			fn.Name = string(name)
+			if fn.callback, ok = arg.RawGetString("callback").(*lua.LFunction); !ok {
+				L.RaiseError("callback argument given to server.register_function must be a function")
+			}
+			if desc, ok := arg.RawGetString("description").(lua.LString); ok {
+				fn.Description = string(desc)
+			}
+			if flags, ok := arg.RawGetString("flags").(*lua.LTable); ok {
+				for i := 1; i <= flags.Len(); i++ {
+					flag := flags.RawGetInt(i).String()
+					if !slices.Contains(functionFlags, flag) {
+						L.RaiseError("unknown flag given")
+					}
+					fn.Flags = append(fn.Flags, flag)
+				}
+			}
+		default:
+			L.RaiseError("wrong number of arguments to server.register_function")
+		}
+		if !validFunctionName(fn.Name) {
+			L.RaiseError("%s", errFunctionName)
+		}
+		if slices.ContainsFunc(fns, func(f registeredFunction) bool { return f.Name == fn.Name }) {
+			L.RaiseError("Function already exists in the library")
+		}
+		fns = append(fns, fn)
+		return 0
+	}))
+
+	// The header isn't Lua, but blanking it keeps the line numbers in errors.
+	_, body, _ := strings.Cut(code, "\n")
+	chunk, err := L.LoadString("\n" + body)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %v", err)
+	}
+	L.Push(chunk)
+	if _, err := callLua(L, 0); err != nil {
+		return nil, err
+	}
+	return fns, nil
+}
+
+// validFunctionName reports whether name is a valid library or function name.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// fcall handles FCALL function numkeys [key ...] [arg ...] and FCALL_RO,
+// which call a function with its keys and arguments. FCALL_RO only calls
+// functions registered with the no-writes flag.
+func (s *Server) fcall(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	lib, fn, err := s.functions.Function(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	readOnly := name == op.FCallRO
+	if readOnly && !slices.Contains(fn.Flags, "no-writes") {
+		writeErr(conn, errFunctionWriteFlag)
+		return
+	}
+	// Like EVAL, a function that may write can't run on a replica.
+	if s.replica != nil && !slices.Contains(fn.Flags, "no-writes") {
+		writeErr(conn, errReadOnlyReplica)
+		return
+	}
+	keys, argv, err := scriptArgs(args[1:])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	s.runAtomically(conn, keys, readOnly, func(srv *Server) (lua.LValue, error) {
+		L, done := newLuaState()
+		defer done()
+		redis := srv.redisTable(L, conn)
+		L.SetGlobal("redis", redis)
+		fns, err := loadLibrary(L, redis, lib.Code)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(fns, func(f registeredFunction) bool { return f.Name == fn.Name })
+		if i < 0 {
+			return nil, errNoFunction
+		}
+		L.Push(fns[i].callback)
+		L.Push(stringTable(L, keys))
+		L.Push(stringTable(L, argv))
+		return callLua(L, 2)
+	})
+}
+
+// function handles the FUNCTION subcommands: LOAD [REPLACE] code, DELETE
+// library, FLUSH [ASYNC|SYNC], LIST [LIBRARYNAME pattern] [WITHCODE], DUMP,
+// and RESTORE payload [FLUSH|APPEND|REPLACE].
+func (s *Server) function(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Function)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "load" && len(args) >= 1 && len(args) <= 2:
+		replace := len(args) == 2
+		if replace && !strings.EqualFold(args[0], "replace") {
+			writeErr(conn, fmt.Errorf("Unknown option given: %s", args[0]))
+			return
+		}
+		lib, err := parseLibrary(args[len(args)-1])
+		if err == nil {
+			err = s.functions.Mutate(func(libs map[string]*library) error {
+				return addLibrary(libs, lib, replace)
+			})
+		}
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteBulkString(lib.Name)
+	case sub == "delete" && len(args) == 1:
+		err := s.functions.Mutate(func(libs map[string]*library) error {
+			if _, ok := libs[args[0]]; !ok {
+				return errNoLibrary
+			}
+			delete(libs, args[0])
+			return nil
+		})
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case sub == "flush" && len(args) <= 1:
+		if len(args) == 1 && !strings.EqualFold(args[0], "async") && !strings.EqualFold(args[0], "sync") {
+			writeErr(conn, errSyntax)
+			return
+		}
+		err := s.functions.Mutate(func(libs map[string]*library) error {
+			clear(libs)
+			return nil
+		})
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteString("OK")
+	case sub == "list":
+		s.functionList(conn, args)
+	case sub == "dump" && len(args) == 0:
+		libs, err := s.functions.Libraries()
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		bs, err := json.Marshal(functionsObject{Libraries: libs})
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteBulk(bs)
+	case sub == "restore" && len(args) >= 1 && len(args) <= 2:
+		s.functionRestore(conn, args)
+	case sub == "load" || sub == "delete" || sub == "flush" || sub == "dump" || sub == "restore":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'function|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown FUNCTION subcommand '%s'", sub))
+	}
+}
+
+// functionList handles FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE], which
+// replies with the libraries, sorted by name, and their functions.
+func (s *Server) functionList(conn redcon.Conn, args []string) {
+	pattern := "*"
+	var withCode bool
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) {
+				writeErr(conn, errSyntax)
+				return
+			}
+			i++
+			pattern = args[i]
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+	libs, err := s.functions.Libraries()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	var names []string
+	for name := range libs {
+		if globMatch(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	conn.WriteArray(len(names))
+	for _, name := range names {
+		lib := libs[name]
+		if withCode {
+			writeMap(conn, 4)
+		} else {
+			writeMap(conn, 3)
+		}
+		conn.WriteBulkString("library_name")
+		conn.WriteBulkString(lib.Name)
+		conn.WriteBulkString("engine")
+		conn.WriteBulkString("LUA")
+		conn.WriteBulkString("functions")
+		conn.WriteArray(len(lib.Functions))
+		for _, fn := range lib.Functions {
+			writeMap(conn, 3)
+			conn.WriteBulkString("name")
+			conn.WriteBulkString(fn.Name)
+			conn.WriteBulkString("description")
+			if fn.Description == "" {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulkString(fn.Description)
+			}
+			conn.WriteBulkString("flags")
+			writeSet(conn, len(fn.Flags))
+			for _, flag := range fn.Flags {
+				conn.WriteBulkString(flag)
+			}
+		}
+		if withCode {
+			conn.WriteBulkString("library_code")
+			conn.WriteBulkString(lib.Code)
+		}
+	}
+}
+
+// functionRestore handles FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE],
+// which loads the libraries in a FUNCTION DUMP payload. APPEND, the default,
+// fails if a library already exists; REPLACE replaces it; and FLUSH deletes
+// every library first. Each library is loaded again rather than trusted.
+func (s *Server) functionRestore(conn redcon.Conn, args []string) {
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1])
+	}
+	if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+		writeErr(conn, errSyntax)
+		return
+	}
+	var obj functionsObject
+	if err := json.Unmarshal([]byte(args[0]), &obj); err != nil {
+		writeErr(conn, errFunctionPayload)
+		return
+	}
+	restored := make([]*library, 0, len(obj.Libraries))
+	for _, lib := range obj.Libraries {
+		if lib == nil {
+			writeErr(conn, errFunctionPayload)
+			return
+		}
+		parsed, err := parseLibrary(lib.Code)
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		restored = append(restored, parsed)
+	}
+	err := s.functions.Mutate(func(libs map[string]*library) error {
+		if policy == "FLUSH" {
+			clear(libs)
+		}
+		for _, lib := range restored {
+			if err := addLibrary(libs, lib, policy == "REPLACE"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteString("OK")
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// hash returns the hash stored at key, or nil if the key doesn't exist. It
+// returns ErrWrongType if the key holds a value of another type.
+func (db *database) hash(key string) (map[string]string, error) {
+	if err := db.checkType(key, "hash"); err != nil {
+		return nil, err
+	}
+	return db.Hashes[key], nil
+}
+
+// hset handles HSET key field value [field value ...], which replies with the
+// number of fields that were added rather than updated.
+func (s *Server) hset(conn redcon.Conn, args []string) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		writeErrArity(conn, op.HSet)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		hash, err := db.hash(key)
+		if err != nil {
+			return 0, err
+		}
+		if hash == nil {
+			if db.stored() >= s.maxItems() {
+				return 0, s.errAtCapacity()
+			}
+			hash = make(map[string]string)
+			db.Hashes[key] = hash
+		}
+		var added int
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		db.touch(key)
+		return added, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// hget handles HGET key field, which replies with the field's value or null.
+func (s *Server) hget(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.HGet)
+		return
+	}
+	hash, err := s.getHash(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	val, ok := hash[args[1]]
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteBulkString(val)
+}
+
+// hdel handles HDEL key field [field ...], which replies with the number of
+// fields removed. Like Valkey, it deletes the key along with its last field.
+func (s *Server) hdel(conn redcon.Conn, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, op.HDel)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		hash, err := db.hash(key)
+		if err != nil || hash == nil {
+			return 0, err
+		}
+		var removed int
+		for _, field := range args[1:] {
+			if _, ok := hash[field]; ok {
+				delete(hash, field)
+				removed++
+			}
+		}
+		if len(hash) == 0 {
+			db.deleteItem(key)
+		} else if removed > 0 {
+			db.touch(key)
+		}
+		return removed, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// hgetall handles HGETALL key, which replies with a map of every field to its
+// value (in RESP2, a flat array of alternating fields and values). Fields are
+// sorted so that replies are deterministic.
+func (s *Server) hgetall(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.HGetAll)
+		return
+	}
+	hash, err := s.getHash(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	writeMap(conn, len(hash))
+	for _, field := range slices.Sorted(maps.Keys(hash)) {
+		conn.WriteBulkString(field)
+		conn.WriteBulkString(hash[field])
+	}
+}
+
+// hrandfield handles HRANDFIELD key [count [WITHVALUES]], which picks fields
+// at random like SRANDMEMBER picks members. WITHVALUES includes each field's
+// value: in RESP2, the reply alternates fields and values, and in RESP3, it's
+// an array of pairs.
+func (s *Server) hrandfield(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.HRandField)
+		return
+	}
+	if len(args) > 3 || (len(args) == 3 && !strings.EqualFold(args[2], "withvalues")) {
+		writeErr(conn, errSyntax)
+		return
+	}
+	var (
+		count    int
+		distinct bool
+	)
+	if len(args) > 1 {
+		var err error
+		if count, distinct, err = parseRandomCount(args[1]); err != nil {
+			writeErr(conn, err)
+			return
+		}
+	}
+	hash, err := s.getHash(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	fields := slices.Sorted(maps.Keys(hash))
+	if len(args) == 1 {
+		if len(fields) == 0 {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(fields[rand.N(len(fields))])
+		return
+	}
+	withValues := len(args) == 3
+	_, resp3 := conn.(resp3Conn)
+	n, picks := randomPicks(len(fields), count, distinct)
+	if withValues && !resp3 {
+		n *= 2
+	}
+	conn.WriteArray(n)
+	for i := range picks {
+		switch {
+		case withValues && resp3:
+			conn.WriteArray(2)
+			fallthrough
+		case withValues:
+			conn.WriteBulkString(fields[i])
+			conn.WriteBulkString(hash[fields[i]])
+		default:
+			conn.WriteBulkString(fields[i])
+		}
+	}
+}
+
+// hexists handles HEXISTS key field, which replies with 1 if the field exists
+// and 0 otherwise.
+func (s *Server) hexists(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.HExists)
+		return
+	}
+	hash, err := s.getHash(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if _, ok := hash[args[1]]; ok {
+		conn.WriteInt(1)
+		return
+	}
+	conn.WriteInt(0)
+}
+
+// hlen handles HLEN key, which replies with the number of fields in the hash.
+func (s *Server) hlen(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.HLen)
+		return
+	}
+	hash, err := s.getHash(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(len(hash))
+}
+
+// getHash reads the hash stored at key. Missing keys are empty hashes.
+func (s *Server) getHash(key string) (map[string]string, error) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return db.hash(key)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errPinnedSnapshot = errors.New("You can't write against a pinned snapshot")
+	errNoSuchSnapshot = errors.New("no such snapshot")
+)
+
+// snapshotCacheSize is the number of snapshots each node keeps decoded.
+// Snapshots never change, so they're only read once, but they may be large;
+// forensics sessions rarely compare more than a few at a time.
+const snapshotCacheSize = 4
+
+// snapshotID returns the ID clients use for a snapshot: the time it was
+// taken, in its object's name.
+func (s *storage) snapshotID(prefix, key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, s.snapshotPrefix(prefix)), ".json")
+}
+
+// A snapshotView is the read-only keyspace seen by connections pinned to a
+// snapshot with SNAPSHOT PIN. Keys expire as they would have when the
+// snapshot was taken, so it shows exactly what the database held then.
+type snapshotView struct {
+	key string // of the logical database's part of the snapshot
+	db  *database
+}
+
+// Readers may modify the databases they're given, so each gets a copy.
+func (v *snapshotView) GetKey(key string) (*database, error)     { return v.db.clone(), nil }
+func (v *snapshotView) GetKeys(keys []string) (*database, error) { return v.db.clone(), nil }
+func (v *snapshotView) GetDB() (*database, error)                { return v.db.clone(), nil }
+
+func (v *snapshotView) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	return 0, errPinnedSnapshot
+}
+
+func (v *snapshotView) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	return 0, errPinnedSnapshot
+}
+
+func (v *snapshotView) MutateDB(f func(*database) (int, error)) (int, error) {
+	return 0, errPinnedSnapshot
+}
+
+// snapshotCache holds the most recently read snapshots.
+type snapshotCache struct {
+	mu    sync.Mutex
+	views []*snapshotView // most recently used first
+}
+
+// snapshotView returns a read-only view of the snapshot with the supplied ID.
+func (s *Server) snapshotView(id string) (*snapshotView, error) {
+	// IDs are times, so they can't name any other object in the bucket.
+	at, err := time.Parse(snapshotTimeFormat, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s'", errNoSuchSnapshot, id)
+	}
+	key := s.store.snapshotPrefix(s.backups.prefix) + id + ".json"
+	c := s.snapshots
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range c.views {
+		if v.key == key {
+			copy(c.views[1:i+1], c.views[:i])
+			c.views[0] = v
+			return v, nil
+		}
+	}
+	db, err := s.store.getSnapshot(key)
+	if err != nil {
+		return nil, err
+	}
+	db.expire(at)
+	v := &snapshotView{key: key, db: db}
+	c.views = append([]*snapshotView{v}, c.views[:min(len(c.views), snapshotCacheSize-1)]...)
+	return v, nil
+}
+
+// pinnable reports whether a command may run on a connection pinned to a
+// snapshot. Only commands that read keys through the keyspace, and those
+// that don't touch keys at all, are allowed; TTLs are relative to the
+// present, so they're meaningless in a snapshot.
+func pinnable(name op.Op) bool {
+	switch name {
+	case op.Get, op.MGet, op.VGet, op.Type, op.Exists, op.Dump,
+		op.Strlen, op.GetRange, op.BitFieldRO,
+		op.HGet, op.HGetAll, op.HExists, op.HLen, op.HRandField,
+		op.LLen, op.LRange,
+		op.SMembers, op.SIsMember, op.SCard, op.SRandMember,
+		op.ZScore, op.ZCard, op.ZRange,
+		op.DBSize, op.Keys, op.Scan, op.Range, op.Generation,
+		op.GetAt, op.Snapshot, op.Wait,
+		op.Ping, op.Quit, op.Reset, op.Hello, op.Auth, op.Client, op.Info:
+		return true
+	}
+	return false
+}
+
+// getat handles GETAT key snapshot-id, which replies with the value the key
+// held in a snapshot, or null if it didn't exist then.
+func (s *Server) getat(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.GetAt)
+		return
+	}
+	key := args[0]
+	v, err := s.snapshotView(args[1])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if err := v.db.checkType(key, "string"); err != nil {
+		writeErr(conn, err)
+		return
+	}
+	val, ok := v.db.Items[key]
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteBulkString(val)
+}
+
+// snapshotCmd handles SNAPSHOT LIST, SNAPSHOT PIN snapshot-id, and SNAPSHOT
+// UNPIN. LIST replies with the IDs of the database's snapshots, oldest
+// first. PIN makes the connection's reads see the snapshot rather than the
+// live database, and refuses writes, until UNPIN or RESET.
+func (s *Server) snapshotCmd(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Snapshot)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	st := stateOf(conn)
+	switch {
+	case sub == "list" && len(args) == 0:
+		snapshots, err := s.store.ListSnapshots(s.backups.prefix)
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteArray(len(snapshots))
+		for _, snap := range snapshots {
+			conn.WriteBulkString(s.store.snapshotID(s.backups.prefix, snap.Key))
+		}
+	case sub == "pin" && len(args) == 1:
+		v, err := s.snapshotView(args[0])
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		st.pinned = v
+		conn.WriteString("OK")
+	case sub == "unpin" && len(args) == 0:
+		st.pinned = nil
+		conn.WriteString("OK")
+	case sub == "list" || sub == "pin" || sub == "unpin":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'snapshot|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown SNAPSHOT subcommand '%s'", sub))
+	}
+}
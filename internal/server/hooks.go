@@ -0,0 +1,41 @@
+package server
+
+import "github.com/antithesishq/valthree/internal/dump"
+
+// Hooks are callbacks that let an application embedding the server follow
+// changes to the database, for example to maintain a derived index or a
+// cache, without polling. Any of them may be nil.
+//
+// Like keyspace notifications, hooks only report writes made through this
+// server, after they're durable in object storage; writes made through other
+// nodes aren't reported. Each shard's changes are reported in the order its
+// writes were applied. Hooks are called synchronously on the write path, so
+// they must be quick and must not run commands on the server themselves.
+// Every hook is passed the logical database that changed (see select.go).
+type Hooks struct {
+	// OnWrite is called when a write creates or modifies a key, with the key
+	// and its new value. The entry is a copy, so the hook may keep it.
+	OnWrite func(db int, entry dump.Entry)
+	// OnDelete is called when a write deletes a key, including when an
+	// expired key is removed.
+	OnDelete func(db int, key string)
+	// OnFlush is called when FLUSHDB or FLUSHALL empties the database,
+	// instead of OnDelete for each key. A sharded database calls it once per
+	// shard.
+	OnFlush func(db int)
+}
+
+// observer returns a function that calls the hook for each event in logical
+// database db, if there is one. It's subscribed to the database's event bus.
+func (h Hooks) observer(db int) func(event) {
+	return func(e event) {
+		switch {
+		case e.Kind == eventKeyWritten && h.OnWrite != nil:
+			h.OnWrite(db, *e.Value)
+		case e.Kind == eventKeyDeleted && h.OnDelete != nil:
+			h.OnDelete(db, e.Key)
+		case e.Kind == eventFlush && h.OnFlush != nil:
+			h.OnFlush(db)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// hotKeysHalfLife is how long it takes a key's conflict score to halve,
+	// so HOTKEYS reflects recent contention rather than all of history.
+	hotKeysHalfLife = time.Minute
+	// maxHotKeys bounds the number of keys tracked. When it's exceeded, the
+	// coldest keys are forgotten.
+	maxHotKeys = 1024
+	// defaultHotKeys is the number of keys HOTKEYS reports by default.
+	defaultHotKeys = 10
+)
+
+// hotKeys tracks which keys are most often written by commands whose
+// conditional writes conflict. Each conflict adds one to the key's score, and
+// scores decay exponentially over time.
+type hotKeys struct {
+	mu     sync.Mutex
+	scores map[string]hotKey
+}
+
+type hotKey struct {
+	score float64
+	at    time.Time // when score was last updated
+}
+
+// decayed returns the key's score at the supplied time.
+func (h hotKey) decayed(now time.Time) float64 {
+	return h.score * math.Exp2(-float64(now.Sub(h.at))/float64(hotKeysHalfLife))
+}
+
+// Add records a conflict on each of the keys.
+func (h *hotKeys) Add(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.scores == nil {
+		h.scores = make(map[string]hotKey)
+	}
+	for _, key := range keys {
+		h.scores[key] = hotKey{score: h.scores[key].decayed(now) + 1, at: now}
+	}
+	if len(h.scores) <= maxHotKeys {
+		return
+	}
+	for _, ks := range h.top(now, len(h.scores))[maxHotKeys/2:] {
+		delete(h.scores, ks.key)
+	}
+}
+
+type keyScore struct {
+	key   string
+	score float64
+}
+
+// Top returns the n hottest keys, hottest first.
+func (h *hotKeys) Top(n int) []keyScore {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.top(time.Now(), n)
+}
+
+func (h *hotKeys) top(now time.Time, n int) []keyScore {
+	all := make([]keyScore, 0, len(h.scores))
+	for key, hk := range h.scores {
+		all = append(all, keyScore{key, hk.decayed(now)})
+	}
+	slices.SortFunc(all, func(a, b keyScore) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	return all[:min(n, len(all))]
+}
+
+// hotKeysCmd handles HOTKEYS [COUNT n], which replies with the keys most
+// often involved in conflicting writes on this node, as pairs of keys and
+// their decaying conflict scores. Persistently hot keys are a sign that the
+// data should be spread over more shards or keys.
+func (s *Server) hotKeysCmd(conn redcon.Conn, args []string) {
+	n := defaultHotKeys
+	switch len(args) {
+	case 0:
+	case 2:
+		count, err := strconv.Atoi(args[1])
+		if !strings.EqualFold(args[0], "count") || err != nil || count < 0 {
+			writeErr(conn, errSyntax)
+			return
+		}
+		n = count
+	default:
+		writeErrArity(conn, op.HotKeys)
+		return
+	}
+	top := s.stats.hotKeys.Top(n)
+	conn.WriteArray(len(top))
+	for _, ks := range top {
+		conn.WriteArray(2)
+		conn.WriteBulkString(ks.key)
+		conn.WriteBulkString(fmt.Sprintf("%.2f", ks.score))
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// An infoSection is one section of the INFO command's output.
+type infoSection struct {
+	name   string
+	fields func(s *Server) [][2]string
+	// Like Valkey, INFO leaves extra sections out unless they're asked for
+	// by name, or with "all" or "everything".
+	extra bool
+}
+
+// infoSections are reported by INFO, in order.
+var infoSections = []infoSection{
+	{"server", (*Server).infoServer, false},
+	{"clients", (*Server).infoClients, false},
+	{"memory", (*Server).infoMemory, false},
+	{"persistence", (*Server).infoPersistence, false},
+	{"stats", (*Server).infoStats, false},
+	{"storage", (*Server).infoStorage, false},
+	{"compaction", (*Server).infoCompaction, false},
+	{"commandstats", (*Server).infoCommandStats, true},
+	{"replication", (*Server).infoReplication, false},
+	{"cluster", (*Server).infoCluster, false},
+	{"keyspace", (*Server).infoKeyspace, false},
+}
+
+// info handles INFO [section ...], which replies with human-readable server
+// statistics in Valkey's format, as monitoring tools like redis_exporter
+// expect.
+func (s *Server) info(conn redcon.Conn, args []string) {
+	want := make(map[string]bool)
+	for _, arg := range args {
+		want[strings.ToLower(arg)] = true
+	}
+	all := want["all"] || want["everything"]
+	defaults := all || len(want) == 0 || want["default"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !want[section.name] && !all && (section.extra || !defaults) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		for _, field := range section.fields(s) {
+			fmt.Fprintf(&b, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+	conn.WriteBulkString(b.String())
+}
+
+func (s *Server) infoServer() [][2]string {
+	uptime := time.Since(s.stats.started)
+	mode := "standalone"
+	if s.topology != nil {
+		mode = "cluster"
+	}
+	return [][2]string{
+		{"redis_version", version},
+		{"redis_mode", mode},
+		{"node_name", s.nodeName},
+		{"database_name", s.dbs[0].name},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", fmt.Sprint(strconv.IntSize)},
+		{"go_version", runtime.Version()},
+		{"process_id", fmt.Sprint(os.Getpid())},
+		{"uptime_in_seconds", fmt.Sprint(int64(uptime.Seconds()))},
+		{"uptime_in_days", fmt.Sprint(int64(uptime.Hours() / 24))},
+	}
+}
+
+func (s *Server) infoClients() [][2]string {
+	return [][2]string{
+		{"connected_clients", fmt.Sprint(s.stats.connections.Load())},
+	}
+}
+
+func (s *Server) infoMemory() [][2]string {
+	// Reading memory statistics briefly stops the world, which is fine at
+	// the rate monitoring tools poll.
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	rss := mem.Sys - mem.HeapReleased
+	return [][2]string{
+		{"used_memory", fmt.Sprint(mem.HeapAlloc)},
+		{"used_memory_human", humanBytes(mem.HeapAlloc)},
+		{"used_memory_rss", fmt.Sprint(rss)},
+		{"used_memory_rss_human", humanBytes(rss)},
+		{"mem_allocator", "go"},
+	}
+}
+
+func (s *Server) infoPersistence() [][2]string {
+	last := s.backups.Last()
+	status := "ok"
+	switch {
+	case last.Time.IsZero():
+		status = "none"
+	case last.Err != nil:
+		status = "err"
+	}
+	var lastTime int64
+	if !last.Time.IsZero() {
+		lastTime = last.Time.Unix()
+	}
+	fields := [][2]string{
+		{"backup_enabled", boolField(s.backups.expr != "")},
+		{"backup_schedule", s.backups.expr},
+		{"bgsave_in_progress", boolField(s.backups.saving.Load())},
+		{"backup_retention", fmt.Sprint(s.backups.retention)},
+		{"backup_last_status", status},
+		{"backup_last_time", fmt.Sprint(lastTime)},
+		{"backup_last_key", last.Key},
+		{"backup_last_by_peer", boolField(last.Peer)},
+	}
+	if last.Err != nil {
+		msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(last.Err.Error())
+		fields = append(fields, [2]string{"backup_last_error", msg})
+	}
+	return fields
+}
+
+func (s *Server) infoStats() [][2]string {
+	st := s.stats
+	return [][2]string{
+		{"total_connections_received", fmt.Sprint(st.connectionsReceived.Load())},
+		{"total_commands_processed", fmt.Sprint(st.commands.Load())},
+		{"rejected_connections", fmt.Sprint(st.rejectedConnections.Load())},
+		{"rate_limited_commands", fmt.Sprint(st.rateLimited.Load())},
+		{"client_output_buffer_limit_disconnections", fmt.Sprint(st.outputLimitDisconnections.Load())},
+	}
+}
+
+func (s *Server) infoStorage() [][2]string {
+	st := s.stats
+	return [][2]string{
+		{"storage_requests", fmt.Sprint(st.StorageRequests())},
+		{"storage_get_requests", fmt.Sprint(st.storageGets.Load())},
+		{"storage_put_requests", fmt.Sprint(st.storagePuts.Load())},
+		{"storage_head_requests", fmt.Sprint(st.storageHeads.Load())},
+		{"storage_delete_requests", fmt.Sprint(st.storageDeletes.Load())},
+		{"storage_request_mean_usec", fmt.Sprint(st.MeanStorageTime().Microseconds())},
+		{"storage_reads", fmt.Sprint(st.reads.Load())},
+		{"storage_cache_hits", fmt.Sprint(st.cacheHits.Load())},
+		{"storage_writes", fmt.Sprint(st.writes.Load())},
+		{"storage_conflicts", fmt.Sprint(st.conflicts.Load())},
+		{"storage_write_retries", fmt.Sprint(st.writeRetries.Load())},
+		{"storage_write_retries_exhausted", fmt.Sprint(st.writeRetriesExhausted.Load())},
+		{"storage_errors", fmt.Sprint(st.storageErrors.Load())},
+		{"storage_shards", fmt.Sprint(len(s.store.shards()))},
+		{"write_queue_wait_mean_usec", fmt.Sprint(st.MeanQueueWait().Microseconds())},
+		{"write_batch_interval_usec", fmt.Sprint(s.store.batchInterval.Microseconds())},
+		{"write_batch_mean_size", fmt.Sprintf("%.2f", st.MeanBatchSize())},
+	}
+}
+
+func (s *Server) infoCompaction() [][2]string {
+	st, policy := s.stats, s.store.compaction
+	var pending uint64
+	for _, store := range s.dbs {
+		for _, sh := range store.shards() {
+			pending += sh.logEntries.Load()
+		}
+	}
+	return [][2]string{
+		{"write_ahead_log", boolField(s.store.wal)},
+		{"compact_interval_usec", fmt.Sprint(policy.interval.Microseconds())},
+		{"compact_min_entries", fmt.Sprint(policy.minEntries)},
+		{"compact_max_entries", fmt.Sprint(policy.maxEntries)},
+		{"log_entries_pending", fmt.Sprint(pending)},
+		{"compactions", fmt.Sprint(st.compactions.Load())},
+		{"compacted_entries", fmt.Sprint(st.compactedEntries.Load())},
+		{"compaction_errors", fmt.Sprint(st.compactionErrors.Load())},
+		{"compaction_mean_usec", fmt.Sprint(st.MeanCompactionTime().Microseconds())},
+		{"compaction_last_time", fmt.Sprint(st.lastCompaction.Load())},
+		{"log_divergences", fmt.Sprint(st.logDivergences.Load())},
+	}
+}
+
+func (s *Server) infoCommandStats() [][2]string {
+	stats := s.stats.CommandStats()
+	var fields [][2]string
+	for _, name := range slices.Sorted(maps.Keys(stats)) {
+		cs := stats[name]
+		usec := cs.time.Microseconds()
+		fields = append(fields, [2]string{
+			"cmdstat_" + string(name),
+			fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f", cs.calls, usec, float64(usec)/float64(cs.calls)),
+		})
+	}
+	return fields
+}
+
+// infoKeyspace reports the size of each logical database that has keys.
+// Unlike the other sections, it reads object storage; databases that can't
+// be read are left out.
+func (s *Server) infoCluster() [][2]string {
+	return [][2]string{
+		{"cluster_enabled", boolField(s.topology != nil)},
+	}
+}
+
+func (s *Server) infoKeyspace() [][2]string {
+	var fields [][2]string
+	for n, store := range s.dbs {
+		db, err := store.GetDB()
+		if err != nil || db.len() == 0 {
+			continue
+		}
+		// Valkey estimates the average TTL by sampling, but we have every key.
+		now := store.now().UnixMilli()
+		var ttl int64
+		for _, at := range db.Expires {
+			ttl += max(at-now, 0)
+		}
+		var avg int64
+		if len(db.Expires) > 0 {
+			avg = ttl / int64(len(db.Expires))
+		}
+		fields = append(fields, [2]string{
+			fmt.Sprintf("db%d", n),
+			fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", db.len(), len(db.Expires), avg),
+		})
+	}
+	return fields
+}
+
+// humanBytes formats a number of bytes like Valkey, as in "1.50M".
+func humanBytes(n uint64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.2f%c", f, units[i])
+}
+
+func boolField(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tidwall/redcon"
+)
+
+// Each node caches what it reads from object storage: the shards' bodies
+// (revalidated by ETag on every read) and the access control list
+// (revalidated at most once per aclRefreshInterval). Both assume that only
+// Valthree writes the bucket. When something else does, like a restore
+// tool, INVALIDATE tells every node to drop its caches.
+//
+// Nodes share nothing but the bucket, so INVALIDATE overwrites an
+// invalidation object, and every node checks the object's ETag once per
+// invalidateCheckInterval. Tools that modify the bucket directly can write
+// anything to the object instead of running INVALIDATE.
+const invalidateCheckInterval = time.Second
+
+// invalidationKey is the object that INVALIDATE overwrites.
+func (s *storage) invalidationKey() string {
+	return s.name + ".invalidate"
+}
+
+// Invalidate overwrites the invalidation object, so that every node drops
+// its caches within invalidateCheckInterval.
+func (s *storage) Invalidate() error {
+	body, err := json.Marshal(struct {
+		Token string    `json:"token"` // makes every body, and so every ETag, unique
+		Time  time.Time `json:"time"`
+	}{rand.Text(), time.Now()})
+	if err != nil {
+		return fmt.Errorf("marshal JSON: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.invalidationKey()),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return fmt.Errorf("%w: put object: %v", ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+// invalidation returns the ETag of the invalidation object, or an empty
+// string if nothing has invalidated the caches yet.
+func (s *storage) invalidation() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	res, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.invalidationKey()),
+	})
+	var errNotFound *types.NotFound
+	switch {
+	case errors.As(err, &errNotFound):
+		return "", nil
+	case err != nil:
+		s.stats.storageErrors.Add(1)
+		return "", fmt.Errorf("head object: %v", err)
+	}
+	return aws.ToString(res.ETag), nil
+}
+
+// dropCaches forgets everything this node has cached from object storage.
+func (s *Server) dropCaches() {
+	for _, store := range s.dbs {
+		store.DropCache()
+	}
+	s.acl.Invalidate()
+	s.functions.Invalidate()
+}
+
+// watchInvalidations drops this node's caches whenever the invalidation
+// object changes, until the context is canceled.
+func (s *Server) watchInvalidations(ctx context.Context, logger *slog.Logger) {
+	ticker := time.NewTicker(invalidateCheckInterval)
+	defer ticker.Stop()
+	// Until the first successful check, there's nothing to compare against.
+	var (
+		last  string
+		known bool
+	)
+	for {
+		etag, err := s.store.invalidation()
+		switch {
+		case err != nil:
+			logger.Warn("check for cache invalidation", "err", err)
+		case known && etag != last:
+			logger.Info("caches invalidated")
+			s.dropCaches()
+			fallthrough
+		default:
+			last, known = etag, true
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// invalidate handles INVALIDATE, which makes every node in the cluster drop
+// its caches. This node drops its own immediately; the others follow within
+// invalidateCheckInterval.
+func (s *Server) invalidate(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Invalidate)
+		return
+	}
+	if err := s.store.Invalidate(); err != nil {
+		writeErr(conn, err)
+		return
+	}
+	s.dropCaches()
+	conn.WriteString("OK")
+}
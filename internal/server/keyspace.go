@@ -0,0 +1,187 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+const defaultLargestKeys = 10
+
+// keyspaceSummary describes the contents of the database as a whole.
+type keyspaceSummary struct {
+	Keys            int
+	ValueBytes      int
+	SerializedBytes int // size of the database object
+	Largest         []keySize
+	Types           map[string]int
+}
+
+type keySize struct {
+	Key  string
+	Size int
+}
+
+// summarizeKeyspace describes the database, including the largest n keys.
+func summarizeKeyspace(db *database, n int) keyspaceSummary {
+	summary := keyspaceSummary{
+		Keys:  db.len(),
+		Types: make(map[string]int),
+	}
+	sizes := make([]keySize, 0, db.len())
+	for key := range db.keys() {
+		size := db.size(key)
+		summary.ValueBytes += size
+		summary.Types[db.typeOf(key)]++
+		sizes = append(sizes, keySize{Key: key, Size: len(key) + size})
+	}
+	slices.SortFunc(sizes, func(a, b keySize) int {
+		if c := cmp.Compare(b.Size, a.Size); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	summary.Largest = sizes[:min(n, len(sizes))]
+	if bs, err := json.Marshal(db); err == nil {
+		summary.SerializedBytes = len(bs)
+	}
+	return summary
+}
+
+// statsCmd handles STATS KEYSPACE [COUNT n], which describes the whole database
+// (or the user's namespace) without exporting it. It replies with a map (in
+// RESP2, a flat array of alternating names and values).
+func (s *Server) statsCmd(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Stats)
+		return
+	}
+	if !strings.EqualFold(args[0], "keyspace") {
+		writeErr(conn, fmt.Errorf("unknown STATS subcommand '%s'", args[0]))
+		return
+	}
+	n := defaultLargestKeys
+	switch len(args) {
+	case 1:
+	case 3:
+		count, err := strconv.Atoi(args[2])
+		if !strings.EqualFold(args[1], "count") || err != nil || count < 0 {
+			writeErr(conn, errSyntax)
+			return
+		}
+		n = count
+	default:
+		writeErr(conn, errSyntax)
+		return
+	}
+
+	db, err := s.kv.GetDB()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	summary := summarizeKeyspace(db, n)
+
+	writeMap(conn, 5)
+	conn.WriteBulkString("keys")
+	conn.WriteInt(summary.Keys)
+	conn.WriteBulkString("value_bytes")
+	conn.WriteInt(summary.ValueBytes)
+	conn.WriteBulkString("serialized_bytes")
+	conn.WriteInt(summary.SerializedBytes)
+	conn.WriteBulkString("largest_keys")
+	conn.WriteArray(len(summary.Largest))
+	for _, ks := range summary.Largest {
+		conn.WriteArray(2)
+		conn.WriteBulkString(ks.Key)
+		conn.WriteInt(ks.Size)
+	}
+	conn.WriteBulkString("types")
+	types := slices.Sorted(maps.Keys(summary.Types))
+	writeMap(conn, len(types))
+	for _, typ := range types {
+		conn.WriteBulkString(typ)
+		conn.WriteInt(summary.Types[typ])
+	}
+}
+
+// scanKeys returns up to count keys with the supplied prefix, in lexicographic
+// order, starting after the cursor key. It also returns the cursor for the
+// next page, which is empty when there are no more keys.
+//
+// Because cursors are keys rather than positions, pagination remains stable
+// even when other clients add and remove keys between pages: every key that
+// exists for the whole scan is returned exactly once.
+func scanKeys(all iter.Seq[string], cursor, prefix string, count int) ([]string, string) {
+	var keys []string
+	for key := range all {
+		if key > cursor && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) <= count {
+		return keys, ""
+	}
+	keys = keys[:count]
+	return keys, keys[len(keys)-1]
+}
+
+// exists handles EXISTS key [key ...], which replies with the number of keys
+// that exist. Like Valkey, it counts repeated keys once per mention.
+func (s *Server) exists(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Exists)
+		return
+	}
+	db, err := s.kv.GetKeys(args)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	var n int
+	for _, key := range args {
+		if db.exists(key) {
+			n++
+		}
+	}
+	conn.WriteInt(n)
+}
+
+// typeCmd handles TYPE key, which replies with the type of the key's value,
+// or "none" if the key doesn't exist.
+func (s *Server) typeCmd(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Type)
+		return
+	}
+	db, err := s.kv.GetKey(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteString(db.typeOf(args[0]))
+}
+
+// dbsize handles DBSIZE, which replies with the number of keys in the
+// database.
+func (s *Server) dbsize(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.DBSize)
+		return
+	}
+	db, err := s.kv.GetDB()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(db.len())
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errMaxClients  = errors.New("max number of clients reached")
+	errRateLimited = errors.New("max command rate exceeded")
+)
+
+// Each connection's resources are limited, so that a single misbehaving
+// client can't flood object storage with conditional writes or exhaust the
+// server's memory. Every limit is per node: like the other statistics,
+// counting cluster-wide would mean writing to object storage.
+
+// admit reserves a connection slot, returning false if the server already
+// has MaxClients connections. Connections that are admitted must release
+// their slot when they close.
+func (s *Server) admit() bool {
+	n := s.stats.connections.Add(1)
+	if s.maxClients > 0 && n > int64(s.maxClients) {
+		s.stats.connections.Add(-1)
+		s.stats.rejectedConnections.Add(1)
+		return false
+	}
+	return true
+}
+
+// A rateLimiter is a token bucket limiting a connection's command rate. The
+// bucket holds a second's worth of commands, so clients may burst up to the
+// limit after idling.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+// allow reports whether the connection may run another command, given a
+// limit of rate commands per second. A rate of zero is unlimited.
+func (l *rateLimiter) allow(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := max(rate, 1)
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+rate*now.Sub(l.last).Seconds())
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// limitedConn caps the size of the replies buffered for a connection. redcon
+// buffers the replies to every command in a pipeline and sends them once the
+// last one is done, so a client pipelining large reads without reading the
+// replies could otherwise make the server hold all of them at once. Once the
+// buffered replies pass the limit, the rest are discarded and the connection
+// is closed, as in Valkey.
+type limitedConn struct {
+	redcon.Conn
+	limit   int
+	scratch []byte
+}
+
+// limitOutput wraps conn so that its buffered replies are limited to
+// MaxOutputBuffer bytes. It should be wrapped with withProtocol, so that
+// RESP3 replies are counted too.
+func (s *Server) limitOutput(conn redcon.Conn) redcon.Conn {
+	if s.maxOutput <= 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, limit: s.maxOutput}
+}
+
+// write buffers an encoded reply, unless the connection is over its limit.
+func (c *limitedConn) write(b []byte) {
+	c.scratch = b[:0]
+	st := stateOf(c.Conn)
+	if st.overLimit {
+		return
+	}
+	st.output += len(b)
+	if st.output > c.limit {
+		st.overLimit = true
+		return
+	}
+	c.Conn.WriteRaw(b)
+}
+
+func (c *limitedConn) WriteError(msg string)  { c.write(redcon.AppendError(c.scratch, msg)) }
+func (c *limitedConn) WriteString(str string) { c.write(redcon.AppendString(c.scratch, str)) }
+func (c *limitedConn) WriteBulk(bulk []byte)  { c.write(redcon.AppendBulk(c.scratch, bulk)) }
+func (c *limitedConn) WriteBulkString(bulk string) {
+	c.write(redcon.AppendBulkString(c.scratch, bulk))
+}
+func (c *limitedConn) WriteInt(num int)       { c.write(redcon.AppendInt(c.scratch, int64(num))) }
+func (c *limitedConn) WriteInt64(num int64)   { c.write(redcon.AppendInt(c.scratch, num)) }
+func (c *limitedConn) WriteUint64(num uint64) { c.write(redcon.AppendUint(c.scratch, num)) }
+func (c *limitedConn) WriteArray(count int)   { c.write(redcon.AppendArray(c.scratch, count)) }
+func (c *limitedConn) WriteNull()             { c.write(redcon.AppendNull(c.scratch)) }
+func (c *limitedConn) WriteRaw(data []byte)   { c.write(append(c.scratch, data...)) }
+func (c *limitedConn) WriteAny(v any)         { c.write(redcon.AppendAny(c.scratch, v)) }
+
+// checkOutput runs after each command. If the connection went over its
+// output limit, it drops the rest of the pipeline and closes the connection
+// without sending the replies. Otherwise, once the pipeline is exhausted,
+// redcon sends the buffered replies, so the count starts again from zero.
+func (s *Server) checkOutput(conn redcon.Conn, st *connState) {
+	if s.maxOutput <= 0 {
+		return
+	}
+	if st.overLimit {
+		conn.ReadPipeline()
+		s.stats.outputLimitDisconnections.Add(1)
+		s.clients.kill(st.client)
+		return
+	}
+	if len(conn.PeekPipeline()) == 0 {
+		st.output = 0
+	}
+}
+
+// unwrapConn returns the connection redcon handed to the server, without
+// the wrappers that encode and limit replies.
+func unwrapConn(conn redcon.Conn) redcon.Conn {
+	if c, ok := conn.(resp3Conn); ok {
+		conn = c.Conn
+	}
+	if c, ok := conn.(*limitedConn); ok {
+		conn = c.Conn
+	}
+	return conn
+}
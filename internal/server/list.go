@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errNegativeCount = errors.New("value is out of range, must be positive")
+
+// list returns the list stored at key, or nil if the key doesn't exist. It
+// returns ErrWrongType if the key holds a value of another type.
+func (db *database) list(key string) ([]string, error) {
+	if err := db.checkType(key, "list"); err != nil {
+		return nil, err
+	}
+	return db.Lists[key], nil
+}
+
+// setList replaces the list stored at key. Like Valkey, it deletes the key
+// when the list is empty.
+func (db *database) setList(key string, list []string) {
+	if len(list) == 0 {
+		db.deleteItem(key)
+		return
+	}
+	db.Lists[key] = list
+	db.touch(key)
+}
+
+// push handles LPUSH and RPUSH key element [element ...], which insert the
+// elements one after another at the head or tail of the list and reply with
+// its new length. LPUSH a b c therefore leaves c at the head.
+func (s *Server) push(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		list, err := db.list(key)
+		if err != nil {
+			return 0, err
+		}
+		if list == nil && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		if name == op.LPush {
+			elements := slices.Clone(args[1:])
+			slices.Reverse(elements)
+			list = append(elements, list...)
+		} else {
+			list = append(list, args[1:]...)
+		}
+		db.setList(key, list)
+		return len(list), nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// pop handles LPOP and RPOP key [count], which remove and reply with elements
+// from the head or tail of the list. Without a count, they reply with a single
+// element; with one, they reply with an array of up to count elements. Either
+// way, they reply with null if the key doesn't exist.
+func (s *Server) pop(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	key := args[0]
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			writeErr(conn, errNegativeCount)
+			return
+		}
+		count = n
+	}
+	var popped []string
+	found, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		list, err := db.list(key)
+		if err != nil || list == nil {
+			return 0, err
+		}
+		n := min(count, len(list))
+		if name == op.LPop {
+			popped = slices.Clone(list[:n])
+			list = list[n:]
+		} else {
+			popped = slices.Clone(list[len(list)-n:])
+			slices.Reverse(popped)
+			list = list[:len(list)-n]
+		}
+		if n > 0 {
+			db.setList(key, list)
+		}
+		return 1, nil
+	})
+	switch {
+	case err != nil:
+		writeErr(conn, err)
+	case found == 0 && len(args) == 2:
+		conn.WriteArray(-1)
+	case found == 0:
+		conn.WriteNull()
+	case len(args) == 2:
+		conn.WriteArray(len(popped))
+		for _, val := range popped {
+			conn.WriteBulkString(val)
+		}
+	default:
+		conn.WriteBulkString(popped[0])
+	}
+}
+
+// llen handles LLEN key, which replies with the length of the list.
+func (s *Server) llen(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.LLen)
+		return
+	}
+	list, err := s.getList(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(len(list))
+}
+
+// lrange handles LRANGE key start stop, which replies with the elements
+// between the inclusive offsets. Negative offsets count from the tail, so
+// LRANGE key 0 -1 replies with the whole list.
+func (s *Server) lrange(conn redcon.Conn, args []string) {
+	if len(args) != 3 {
+		writeErrArity(conn, op.LRange)
+		return
+	}
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	list, err := s.getList(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if start < 0 {
+		start = max(len(list)+start, 0)
+	}
+	if stop < 0 {
+		stop = len(list) + stop
+	}
+	stop = min(stop, len(list)-1)
+	if start > stop {
+		conn.WriteArray(0)
+		return
+	}
+	conn.WriteArray(stop - start + 1)
+	for _, val := range list[start : stop+1] {
+		conn.WriteBulkString(val)
+	}
+}
+
+// getList reads the list stored at key. Missing keys are empty lists.
+func (s *Server) getList(key string) ([]string, error) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return db.list(key)
+}
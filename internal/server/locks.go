@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errInvalidTTL = errors.New("invalid lease duration")
+
+// A lease is a lock held by a single owner until it expires.
+//
+// Leases expire according to the wall clock of whichever node next reads the
+// database, like keys (see expire), and clocks across the cluster are never perfectly synchronized.
+// A lease alone therefore can't guarantee mutual exclusion. Instead, each
+// lease carries a fencing token: the database generation of the write that
+// granted it. Generations increase with every write, so tokens for a given
+// lock strictly increase, and a resource guarded by the lock can reject any
+// request carrying a token older than the newest it has seen.
+type lease struct {
+	Owner   string `json:"owner"`
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"` // Unix milliseconds
+}
+
+func (l lease) expired(now time.Time) bool {
+	return now.UnixMilli() >= l.Expires
+}
+
+// lock handles LOCK name owner milliseconds, which replies with a fencing
+// token if the lock was acquired and null if another owner holds it. Calling
+// LOCK again before the lease expires extends it without changing the token.
+func (s *Server) lock(conn redcon.Conn, args []string) {
+	if len(args) != 3 {
+		writeErrArity(conn, op.Lock)
+		return
+	}
+	name, owner := args[0], args[1]
+	ms, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ms <= 0 {
+		writeErr(conn, errInvalidTTL)
+		return
+	}
+
+	var token uint64
+	_, err = s.kv.MutateKey(name, func(db *database) (int, error) {
+		now := s.store.now()
+		token = 0
+		held, ok := db.Leases[name]
+		if ok && held.Owner != owner && !held.expired(now) {
+			return 0, nil
+		}
+		l := lease{
+			Owner:   owner,
+			Token:   db.Generation,
+			Expires: now.Add(time.Duration(ms) * time.Millisecond).UnixMilli(),
+		}
+		if ok && held.Owner == owner && !held.expired(now) {
+			l.Token = held.Token
+		}
+		db.Leases[name] = l
+		token = l.Token
+		return 0, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if token == 0 {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteUint64(token)
+}
+
+// unlock handles UNLOCK name owner, which replies with 1 if the owner held the
+// lock and 0 otherwise.
+func (s *Server) unlock(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.Unlock)
+		return
+	}
+	name, owner := args[0], args[1]
+
+	n, err := s.kv.MutateKey(name, func(db *database) (int, error) {
+		held, ok := db.Leases[name]
+		if !ok || held.Owner != owner || held.expired(s.store.now()) {
+			return 0, nil
+		}
+		delete(db.Leases, name)
+		return 1, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
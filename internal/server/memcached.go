@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+const (
+	// memcachedMaxValue bounds the size of a single SET payload. Without a
+	// limit, a malformed length prefix would make us allocate arbitrarily
+	// large buffers.
+	memcachedMaxValue = 1 << 20
+	// memcachedMaxLine bounds the length of a command line, for the same
+	// reason. It's plenty for a GET of many keys.
+	memcachedMaxLine = 16 << 10
+	// memcachedMaxRelative is the longest expiration time memcached treats
+	// as relative; longer ones are Unix times.
+	memcachedMaxRelative = 30 * 24 * 60 * 60
+	// memcachedUser is the user memcached connections act as. The text
+	// protocol can't authenticate, so like Valkey connections to a server
+	// without a password, they're the default user.
+	memcachedUser = "default"
+)
+
+var (
+	errMemcachedNotFound   = errors.New("not found")
+	errMemcachedNonNumeric = errors.New("cannot increment or decrement non-numeric value")
+)
+
+// memcached is a frontend for the memcached text protocol, which lets legacy
+// memcached clients use Valthree's durable storage. It maps a small subset of
+// memcached's commands onto the same operations as the Valkey frontend, run
+// in the same keyspace: the default user's, so its permissions and namespace
+// apply, and on a replica writes are refused.
+//
+// An item's CAS unique, which GETS reports and CAS checks, is its key's
+// version (see VGET), so CAS and VSET guard against the same writes.
+type memcached struct {
+	srv *Server
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newMemcached(srv *Server) *memcached {
+	return &memcached{
+		srv:   srv,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve implements frontend.
+func (m *memcached) Serve(ln net.Listener) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ln.Close()
+	}
+	m.ln = ln
+	m.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			m.mu.Lock()
+			closed := m.closed
+			m.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		m.conns[conn] = struct{}{}
+		m.mu.Unlock()
+		m.srv.stats.connections.Add(1)
+		m.srv.stats.connectionsReceived.Add(1)
+		m.wg.Go(func() {
+			defer func() {
+				m.mu.Lock()
+				delete(m.conns, conn)
+				m.mu.Unlock()
+				conn.Close()
+				m.srv.stats.connections.Add(-1)
+			}()
+			m.handle(conn)
+		})
+	}
+}
+
+// Close implements frontend.
+func (m *memcached) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	var err error
+	if m.ln != nil {
+		err = m.ln.Close()
+	}
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	return err
+}
+
+func (m *memcached) handle(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, memcachedMaxLine)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// The rest of the line can't be told apart from the next
+			// command, so give up on the connection, as memcached does.
+			fmt.Fprint(w, "CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if quit := m.run(r, w, fields); quit {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			// Flush only once the client's pipeline is drained.
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// run dispatches a command, unless the server is shutting down, in which case
+// it closes the connection: the text protocol has no error a client would
+// retry elsewhere, and a refused SET's data block would be read as commands.
+func (m *memcached) run(r *bufio.Reader, w *bufio.Writer, fields []string) (quit bool) {
+	if !m.srv.commands.begin() {
+		return true
+	}
+	defer m.srv.commands.end()
+	return m.dispatch(r, w, fields)
+}
+
+func (m *memcached) dispatch(r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	switch strings.ToLower(fields[0]) {
+	case "get":
+		m.get(w, fields[1:], false /* cas */)
+	case "gets":
+		m.get(w, fields[1:], true /* cas */)
+	case "set":
+		m.set(r, w, fields[1:])
+	case "cas":
+		m.cas(r, w, fields[1:])
+	case "delete":
+		m.delete(w, fields[1:])
+	case "incr":
+		m.incr(w, fields[1:])
+	case "version":
+		fmt.Fprint(w, "VERSION valthree\r\n")
+	case "quit":
+		return true
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return false
+}
+
+// get handles "get <key>*", and "gets <key>*" if cas is set, which also
+// replies with each item's CAS unique.
+func (m *memcached) get(w *bufio.Writer, keys []string, cas bool) {
+	if len(keys) == 0 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	name := op.Get
+	if cas {
+		name = op.VGet
+	}
+	srv, done := m.command(w, name, keys...)
+	if srv == nil {
+		return
+	}
+	defer done()
+	for _, key := range keys {
+		db, err := srv.kv.GetKey(key)
+		if err == nil {
+			err = db.checkType(key, "string")
+		}
+		if err != nil {
+			writeMemcachedErr(w, err)
+			return
+		}
+		val, ok := db.Items[key]
+		if !ok {
+			continue
+		}
+		// Valthree doesn't store memcached's opaque client flags, and SET
+		// refuses any but zero.
+		if cas {
+			fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(val), db.Versions[key], val)
+		} else {
+			fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", key, len(val), val)
+		}
+	}
+	fmt.Fprint(w, "END\r\n")
+}
+
+// readData reads the data block of a storage command whose first four
+// arguments are "<key> <flags> <exptime> <bytes>", and returns the block and
+// the expiration time. If the command is malformed, it writes an error to the
+// client and returns false.
+func readData(r *bufio.Reader, w *bufio.Writer, args []string) (string, int64, bool) {
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return "", 0, false
+	}
+	if size > memcachedMaxValue {
+		// Like memcached, skip the data block, so that it isn't read as
+		// commands.
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return "", 0, false
+		}
+		fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+		return "", 0, false
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", 0, false
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return "", 0, false
+	}
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return "", 0, false
+	}
+	if flags != 0 {
+		// Clients use flags to say how they encoded the value, so storing
+		// the value without them would hand it back misread.
+		fmt.Fprint(w, "CLIENT_ERROR nonzero flags aren't supported\r\n")
+		return "", 0, false
+	}
+	exptime, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return "", 0, false
+	}
+	return string(data[:size]), exptime, true
+}
+
+// set handles "set <key> <flags> <exptime> <bytes> [noreply]", followed by a
+// data block.
+func (m *memcached) set(r *bufio.Reader, w *bufio.Writer, args []string) {
+	if len(args) != 4 && len(args) != 5 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	data, exptime, ok := readData(r, w, args)
+	if !ok {
+		return
+	}
+	noreply := len(args) == 5 && args[4] == "noreply"
+	srv, done := m.command(w, op.Set, args[0])
+	if srv == nil {
+		return
+	}
+	defer done()
+
+	var err error
+	ttl, expired := srv.memcachedTTL(exptime)
+	if expired {
+		// The item would expire as soon as it was stored.
+		_, err = srv.delKey(args[0])
+	} else {
+		_, _, err = srv.setString(args[0], data, setOptions{ttl: ttl})
+	}
+	if noreply {
+		return
+	}
+	if err != nil {
+		writeMemcachedErr(w, err)
+		return
+	}
+	fmt.Fprint(w, "STORED\r\n")
+}
+
+// cas handles "cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]",
+// followed by a data block. Like SET, it stores the item, but only if the
+// item exists and its CAS unique still matches; otherwise, it replies with
+// NOT_FOUND or EXISTS.
+func (m *memcached) cas(r *bufio.Reader, w *bufio.Writer, args []string) {
+	if len(args) != 5 && len(args) != 6 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	data, exptime, ok := readData(r, w, args)
+	if !ok {
+		return
+	}
+	unique, err := strconv.ParseUint(args[4], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	noreply := len(args) == 6 && args[5] == "noreply"
+	srv, done := m.command(w, op.VSet, args[0])
+	if srv == nil {
+		return
+	}
+	defer done()
+
+	key := args[0]
+	ttl, expired := srv.memcachedTTL(exptime)
+	if data == "" && !expired {
+		err = errors.New("empty value") // see setString
+	} else {
+		_, err = srv.kv.MutateKey(key, func(db *database) (int, error) {
+			if err := db.checkType(key, "string"); err != nil {
+				return 0, err
+			}
+			if _, ok := db.Items[key]; !ok {
+				return 0, errMemcachedNotFound
+			}
+			if db.Versions[key] != unique {
+				return 0, errNotApplied
+			}
+			if expired {
+				// The item would expire as soon as it was stored.
+				db.deleteItem(key)
+				db.notify('g', "del", key)
+				return 0, nil
+			}
+			db.setItem(key, data)
+			db.notify('$', "set", key)
+			if ttl > 0 {
+				db.Expires[key] = srv.store.now().Add(ttl).UnixMilli()
+				db.notify('g', "expire", key)
+			} else {
+				delete(db.Expires, key)
+			}
+			return 0, nil
+		})
+	}
+	if noreply {
+		return
+	}
+	switch {
+	case errors.Is(err, errMemcachedNotFound):
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+	case errors.Is(err, errNotApplied):
+		fmt.Fprint(w, "EXISTS\r\n")
+	case err != nil:
+		writeMemcachedErr(w, err)
+	default:
+		fmt.Fprint(w, "STORED\r\n")
+	}
+}
+
+func (m *memcached) delete(w *bufio.Writer, args []string) {
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+	srv, done := m.command(w, op.Del, args[0])
+	if srv == nil {
+		return
+	}
+	defer done()
+
+	ok, err := srv.delKey(args[0])
+	if noreply {
+		return
+	}
+	if err != nil {
+		writeMemcachedErr(w, err)
+		return
+	}
+	if !ok {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+	fmt.Fprint(w, "DELETED\r\n")
+}
+
+// incr handles "incr <key> <value> [noreply]". Unlike Valkey's INCR, memcached
+// treats values as unsigned 64-bit integers that wrap on overflow, and it
+// refuses to increment missing keys.
+func (m *memcached) incr(w *bufio.Writer, args []string) {
+	if len(args) != 2 && len(args) != 3 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+	noreply := len(args) == 3 && args[2] == "noreply"
+	srv, done := m.command(w, op.IncrBy, args[0])
+	if srv == nil {
+		return
+	}
+	defer done()
+
+	var result uint64
+	_, err = srv.kv.MutateKey(args[0], func(db *database) (int, error) {
+		if err := db.checkType(args[0], "string"); err != nil {
+			return 0, err
+		}
+		val, ok := db.Items[args[0]]
+		if !ok {
+			return 0, errMemcachedNotFound
+		}
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, errMemcachedNonNumeric
+		}
+		result = n + delta
+		db.setItem(args[0], strconv.FormatUint(result, 10))
+		db.notify('$', "incrby", args[0])
+		return 0, nil
+	})
+	if noreply {
+		return
+	}
+	if errors.Is(err, errMemcachedNotFound) {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+	if err != nil {
+		writeMemcachedErr(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%d\r\n", result)
+}
+
+// command prepares to run a command on the keys, as handle does for Valkey
+// connections. It applies the server's key validation rules and checks the
+// default user's permissions, and returns the Server as the command sees it:
+// working in the default user's keyspace, with the command's deadline. If the
+// command may not run, it writes an error to the client and returns nil.
+// Otherwise, the caller must call done once the command has finished.
+func (m *memcached) command(w *bufio.Writer, name op.Op, keys ...string) (srv *Server, done func()) {
+	for _, key := range keys {
+		if err := m.srv.validateKey(key); err != nil {
+			fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+			return nil, nil
+		}
+	}
+	denied, err := m.srv.permission(memcachedUser, name, keys)
+	if err == nil && denied != "" {
+		fmt.Fprintf(w, "CLIENT_ERROR %s\r\n", denied)
+		return nil, nil
+	}
+	var ns string
+	if err == nil {
+		ns, err = m.srv.namespace(memcachedUser)
+	}
+	if err != nil {
+		writeMemcachedErr(w, err)
+		return nil, nil
+	}
+	ctx, cancel := context.Background(), func() {}
+	if d := m.srv.timeouts.timeout(name); d > 0 {
+		ctx, cancel = context.WithTimeout(ctx, d)
+	}
+	srv = m.srv.withKeyspace(m.srv.connKeyspace(ctx, &connState{}, ns, 0, false /* stale */))
+	srv.ctx = ctx
+	return srv, cancel
+}
+
+// memcachedTTL converts a memcached expiration time into a TTL. Zero means
+// the item never expires, times up to 30 days are relative, and longer ones
+// are Unix times. It reports whether the item has already expired, which
+// negative times and Unix times in the past mean.
+func (s *Server) memcachedTTL(exptime int64) (time.Duration, bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= memcachedMaxRelative:
+		return time.Duration(exptime) * time.Second, false
+	}
+	ttl := time.Unix(exptime, 0).Sub(s.store.now())
+	return ttl, ttl <= 0
+}
+
+func writeMemcachedErr(w *bufio.Writer, err error) {
+	if errors.Is(err, errMemcachedNonNumeric) || errors.Is(err, ErrWrongType) {
+		fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+		return
+	}
+	fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+}
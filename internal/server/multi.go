@@ -0,0 +1,409 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNestedMulti  = errors.New("MULTI calls can not be nested")
+	errExecNoMulti  = errors.New("EXEC without MULTI")
+	errDiscardMulti = errors.New("DISCARD without MULTI")
+	errWatchInMulti = errors.New("WATCH inside MULTI is not allowed")
+	errCrossDB      = errors.New("transaction uses more than one database")
+	// errWatchChanged aborts a transaction whose watched keys were written
+	// after WATCH.
+	errWatchChanged = errors.New("watched key changed")
+)
+
+// A keyspace is the storage that command handlers read and write. Normally
+// it's the server's storage, but commands queued by MULTI run against a
+// transaction instead, so that EXEC applies all of them in a single write.
+type keyspace interface {
+	GetKey(key string) (*database, error)
+	GetKeys(keys []string) (*database, error)
+	GetDB() (*database, error)
+	MutateKey(key string, f func(*database) (int, error)) (int, error)
+	MutateKeys(keys []string, f func(*database) (int, error)) (int, error)
+	MutateDB(f func(*database) (int, error)) (int, error)
+}
+
+// txn is the keyspace seen by the commands in a transaction: the database
+// being built by a single write to one shard. Each command's mutations are
+// applied in place, so later commands see the effects of earlier ones. Like
+// the rest of a batch, a failed mutation is rolled back without affecting the
+// others.
+type txn struct {
+	store *storage
+	shard *shard
+	db    *database
+	wrote bool
+}
+
+func (t *txn) check(keys ...string) error {
+	if t.shard.count == 1 {
+		return nil
+	}
+	for _, key := range keys {
+		if t.store.shardFor(key) != t.shard {
+			return errCrossShard
+		}
+	}
+	return nil
+}
+
+// checkDB rejects commands on the whole database, since the transaction can
+// only see one shard of it.
+func (t *txn) checkDB() error {
+	if t.shard.count > 1 {
+		return errCrossShard
+	}
+	return nil
+}
+
+func (t *txn) GetKey(key string) (*database, error) {
+	return t.GetKeys([]string{key})
+}
+
+func (t *txn) GetKeys(keys []string) (*database, error) {
+	if err := t.check(keys...); err != nil {
+		return nil, err
+	}
+	return t.db, nil
+}
+
+func (t *txn) GetDB() (*database, error) {
+	if err := t.checkDB(); err != nil {
+		return nil, err
+	}
+	return t.db, nil
+}
+
+func (t *txn) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	return t.MutateKeys([]string{key}, f)
+}
+
+func (t *txn) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	if err := t.check(keys...); err != nil {
+		return 0, err
+	}
+	return t.mutate(f)
+}
+
+func (t *txn) MutateDB(f func(*database) (int, error)) (int, error) {
+	if err := t.checkDB(); err != nil {
+		return 0, err
+	}
+	return t.mutate(f)
+}
+
+func (t *txn) mutate(f func(*database) (int, error)) (int, error) {
+	before := t.db.clone()
+	n, err := t.shard.applyOne(t.db, f)
+	if err != nil {
+		*t.db = *before
+		return 0, err
+	}
+	t.wrote = true
+	return n, nil
+}
+
+// A watchedKey is the state of a key when it was watched.
+type watchedKey struct {
+	db         int    // the logical database it was watched in
+	version    uint64 // zero if the key was missing
+	generation uint64 // of the shard
+}
+
+// changed reports whether the key has been written since it was watched.
+// Deleting a key removes its version, so a key that was missing when it was
+// watched may have been created and deleted since; if any key in the shard
+// has been deleted since, it's assumed to have changed.
+func (w watchedKey) changed(db *database, key string) bool {
+	if db.Versions[key] != w.version {
+		return true
+	}
+	return w.version == 0 && db.Deleted > w.generation
+}
+
+// A queuedCommand is a command sent between MULTI and EXEC.
+type queuedCommand struct {
+	name op.Op
+	args []string
+}
+
+// queueable reports whether a command may be sent between MULTI and EXEC.
+// Only commands whose handlers use the keyspace can run inside a
+// transaction; the rest either talk to object storage directly or change
+// the connection.
+func queueable(name op.Op) bool {
+	switch name {
+	case op.Get, op.GetDel, op.GetEx, op.Set, op.Del, op.MGet, op.MSet, op.BitField, op.BitFieldRO,
+		op.GetSet, op.Append, op.Strlen, op.SetRange, op.GetRange,
+		op.SetEx, op.PSetEx, op.SetNX, op.Rename, op.RenameNX, op.Copy,
+		op.Incr, op.Decr, op.IncrBy, op.DecrBy,
+		op.Expire, op.PExpire, op.TTL, op.PTTL, op.Persist,
+		op.VGet, op.VSet, op.Type, op.Exists,
+		op.Dump, op.Restore,
+		op.HSet, op.HGet, op.HDel, op.HGetAll, op.HExists, op.HLen, op.HRandField,
+		op.LPush, op.RPush, op.LPop, op.RPop, op.LLen, op.LRange,
+		op.SAdd, op.SRem, op.SMembers, op.SIsMember, op.SCard, op.SRandMember,
+		op.ZAdd, op.ZRem, op.ZScore, op.ZCard, op.ZRange, op.ZPopMin, op.ZPopMax,
+		op.FlushAll, op.FlushDB, op.DBSize, op.Keys, op.Scan, op.Range,
+		op.Generation, op.Ping, op.Wait, op.Select:
+		return true
+	}
+	return false
+}
+
+// multi handles MULTI, which starts queueing commands until EXEC or DISCARD.
+func (s *Server) multi(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Multi)
+		return
+	}
+	st := stateOf(conn)
+	if st.multi {
+		writeErr(conn, errNestedMulti)
+		return
+	}
+	st.multi = true
+	conn.WriteString("OK")
+}
+
+// queue adds a command to the connection's transaction and replies QUEUED.
+// Commands that can't run inside a transaction are refused, and refusing one
+// makes EXEC discard the whole transaction, as in Valkey.
+func (s *Server) queue(conn redcon.Conn, name op.Op, args []string) {
+	st := stateOf(conn)
+	if !queueable(name) {
+		st.dirty = true
+		conn.WriteError(fmt.Sprintf("ERR command '%s' is not allowed in transactions", name))
+		return
+	}
+	st.queued = append(st.queued, queuedCommand{name: name, args: args})
+	conn.WriteString("QUEUED")
+}
+
+// discard handles DISCARD, which drops the queued commands and unwatches
+// every key.
+func (s *Server) discard(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Discard)
+		return
+	}
+	st := stateOf(conn)
+	if !st.multi {
+		writeErr(conn, errDiscardMulti)
+		return
+	}
+	st.resetMulti()
+	conn.WriteString("OK")
+}
+
+// watch handles WATCH key [key ...], which makes the next EXEC abort if any
+// of the keys is written in the meantime. Writes are detected with the
+// per-key versions, so even a write that restores a key's old value aborts
+// the transaction.
+func (s *Server) watch(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Watch)
+		return
+	}
+	st := stateOf(conn)
+	if st.multi {
+		writeErr(conn, errWatchInMulti)
+		return
+	}
+	db, err := s.kv.GetKeys(args)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if st.watched == nil {
+		st.watched = make(map[string]watchedKey)
+	}
+	for _, key := range args {
+		if _, ok := st.watched[key]; !ok {
+			st.watched[key] = watchedKey{db: st.db, version: db.Versions[key], generation: db.Generation}
+		}
+	}
+	conn.WriteString("OK")
+}
+
+// unwatch handles UNWATCH, which forgets every watched key.
+func (s *Server) unwatch(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Unwatch)
+		return
+	}
+	stateOf(conn).watched = nil
+	conn.WriteString("OK")
+}
+
+// exec handles EXEC, which runs the queued commands atomically and replies
+// with an array of their replies. It replies with a null array, running
+// nothing, if a watched key was written since WATCH.
+//
+// Every key the transaction watches or uses must be on the same shard of the
+// same logical database. The commands run inside a single mutation of that
+// shard, so they're applied with one conditional PUT, and a conflicting
+// write from another node makes the whole transaction retry: watched
+// versions are checked again on every attempt. SELECT takes effect for the
+// commands after it, and for the connection once the transaction is written.
+func (s *Server) exec(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.Exec)
+		return
+	}
+	st := stateOf(conn)
+	if !st.multi {
+		writeErr(conn, errExecNoMulti)
+		return
+	}
+	queued, watched, dirty := st.queued, st.watched, st.dirty
+	st.resetMulti()
+	if dirty {
+		conn.WriteError("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	keys := make([]string, 0, len(watched))
+	used := make(map[int]bool) // logical databases
+	for key, w := range watched {
+		keys = append(keys, key)
+		used[w.db] = true
+	}
+	selected, flushAll := st.db, false
+	for _, cmd := range queued {
+		switch cmd.name {
+		case op.Select:
+			if len(cmd.args) == 1 {
+				if n, err := s.selectable(cmd.args[0]); err == nil {
+					selected = n
+				}
+			}
+			continue
+		case op.Ping, op.Wait:
+			continue // no database
+		case op.FlushAll:
+			flushAll = true
+		}
+		used[selected] = true
+		keys = append(keys, commandKeys(cmd.name, cmd.args)...)
+	}
+	if len(used) > 1 {
+		writeErr(conn, errCrossDB)
+		return
+	}
+	n := selected // if no command uses a database
+	for m := range used {
+		n = m
+	}
+	store := s.dbs[n]
+	if _, err := store.shardForAll(keys); err != nil {
+		writeErr(conn, err)
+		return
+	}
+
+	replies := buffered(conn)
+	_, err := s.kvIn(n).MutateKeys(keys, func(db *database) (int, error) {
+		for key, w := range watched {
+			if w.changed(db, key) {
+				return 0, errWatchChanged
+			}
+		}
+		replies.buf = replies.buf[:0]
+		// The database may have been promoted to shards since the keys
+		// were checked (see promote.go).
+		sh, err := store.shardForAll(keys)
+		if err != nil {
+			return 0, err
+		}
+		t := &txn{store: store, shard: sh, db: db}
+		srv := s.withKeyspace(t)
+		srv.store = store
+		for _, cmd := range queued {
+			srv.dispatch(withProtocol(replies), cmd.name, cmd.args)
+		}
+		if !t.wrote {
+			return 0, errNotApplied
+		}
+		return 0, nil
+	})
+	switch {
+	case errors.Is(err, errWatchChanged):
+		conn.WriteArray(-1)
+		return
+	case err != nil && !errors.Is(err, errNotApplied):
+		writeErr(conn, err)
+		return
+	}
+	st.db = selected
+	if flushAll {
+		// The transaction only emptied its own database.
+		for m := range s.dbs {
+			if m == n {
+				continue
+			}
+			if _, err := s.kvIn(m).MutateDB(flushDB); err != nil {
+				writeErr(conn, err)
+				return
+			}
+		}
+	}
+	conn.WriteArray(len(queued))
+	conn.WriteRaw(replies.buf)
+}
+
+// withKeyspace returns a copy of the server whose commands use kv.
+func (s *Server) withKeyspace(kv keyspace) *Server {
+	c := *s
+	c.kv = kv
+	return &c
+}
+
+// inTxn reports whether the server's commands are running inside a
+// transaction or script, which only see one shard of one database.
+func (s *Server) inTxn() bool {
+	_, ok := s.kv.(*txn)
+	return ok
+}
+
+func (st *connState) resetMulti() {
+	st.multi = false
+	st.dirty = false
+	st.queued = nil
+	st.watched = nil
+}
+
+// bufferedConn collects replies instead of sending them, so that EXEC can
+// send the replies to queued commands once the transaction is durable.
+type bufferedConn struct {
+	redcon.Conn
+	buf []byte
+}
+
+// buffered returns a bufferedConn for conn's connection. The caller should
+// wrap it with withProtocol, so that replies are encoded the same way.
+func buffered(conn redcon.Conn) *bufferedConn {
+	if c, ok := conn.(resp3Conn); ok {
+		conn = c.Conn
+	}
+	return &bufferedConn{Conn: conn}
+}
+
+func (c *bufferedConn) WriteError(msg string)       { c.buf = redcon.AppendError(c.buf, msg) }
+func (c *bufferedConn) WriteString(str string)      { c.buf = redcon.AppendString(c.buf, str) }
+func (c *bufferedConn) WriteBulk(bulk []byte)       { c.buf = redcon.AppendBulk(c.buf, bulk) }
+func (c *bufferedConn) WriteBulkString(bulk string) { c.buf = redcon.AppendBulkString(c.buf, bulk) }
+func (c *bufferedConn) WriteInt(num int)            { c.buf = redcon.AppendInt(c.buf, int64(num)) }
+func (c *bufferedConn) WriteInt64(num int64)        { c.buf = redcon.AppendInt(c.buf, num) }
+func (c *bufferedConn) WriteUint64(num uint64)      { c.buf = redcon.AppendUint(c.buf, num) }
+func (c *bufferedConn) WriteArray(count int)        { c.buf = redcon.AppendArray(c.buf, count) }
+func (c *bufferedConn) WriteNull()                  { c.buf = redcon.AppendNull(c.buf) }
+func (c *bufferedConn) WriteRaw(data []byte)        { c.buf = append(c.buf, data...) }
+func (c *bufferedConn) WriteAny(v any)              { c.buf = redcon.AppendAny(c.buf, v) }
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"errors"
+	"maps"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// Namespaces let one cluster serve several applications. An ACL user may be
+// assigned a namespace (with the Valthree-specific ACL rule
+// namespace:name), and then every key its commands name is stored under the
+// namespace's prefix. The user sees only the keys in its namespace, without
+// the prefix: DBSIZE counts them, FLUSHALL deletes them, SCAN lists them,
+// and so on. Users without a namespace see every key, prefixes and all.
+//
+// Namespaced keys share the reserved prefix, so nobody can name them
+// directly, and a namespace's prefix doesn't change which shard its keys
+// are in, so keys that would share a shard outside a namespace still do.
+// Quotas on a namespace's prefix (see NamespacePrefix) limit its size.
+//
+// Pub/sub channels and keyspace notifications aren't namespaced:
+// notifications name the prefixed keys.
+
+const namespacePrefix = ReservedPrefix + "ns:"
+
+var errNamespacedCommand = errors.New("command not available to users with a namespace")
+
+// NamespacePrefix returns the prefix of the keys in a namespace.
+func NamespacePrefix(name string) string {
+	return namespacePrefix + name + ":"
+}
+
+// validNamespace reports whether a namespace name is allowed. Names can't
+// contain colons, so that no namespace's prefix is a prefix of another's.
+func validNamespace(name string) bool {
+	return name != "" && validClientName(name) && !strings.Contains(name, ":")
+}
+
+// unnamespaced returns a key without its namespace prefix, if any.
+func unnamespaced(key string) string {
+	rest, ok := strings.CutPrefix(key, namespacePrefix)
+	if !ok {
+		return key
+	}
+	if _, key, ok := strings.Cut(rest, ":"); ok {
+		return key
+	}
+	return rest
+}
+
+// namespaceable reports whether a user with a namespace may run a command.
+// Commands that read or write the database without going through the
+// connection's keyspace would see other namespaces, so they're refused. So
+// are FUNCTION and SCRIPT, since libraries and the scripts cache are shared
+// by every namespace.
+func namespaceable(name op.Op) bool {
+	switch name {
+	case op.Load, op.GetAt, op.Snapshot, op.HotKeys, op.Debug, op.BgSave, op.Invalidate,
+		op.Function, op.Script:
+		return false
+	}
+	return true
+}
+
+// namespace returns the namespace of the named user, if any.
+func (s *Server) namespace(user string) (string, error) {
+	u, ok, err := s.acl.User(user)
+	if err != nil || !ok {
+		return "", err
+	}
+	return u.Namespace, nil
+}
+
+// A namespaceView is the keyspace seen by a user with a namespace. Each
+// database it hands out holds only the namespace's keys, without their
+// prefix, and mutations to it are copied back under the prefix. Commands on
+// particular keys only see those keys, so that they don't pay to copy the
+// rest of the namespace.
+type namespaceView struct {
+	kv     keyspace
+	prefix string
+}
+
+func (v namespaceView) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = v.prefix + key
+	}
+	return prefixed
+}
+
+func (v namespaceView) GetKey(key string) (*database, error) {
+	db, err := v.kv.GetKey(v.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+	return v.project(db, []string{key}), nil
+}
+
+func (v namespaceView) GetKeys(keys []string) (*database, error) {
+	db, err := v.kv.GetKeys(v.keys(keys))
+	if err != nil {
+		return nil, err
+	}
+	return v.project(db, keys), nil
+}
+
+func (v namespaceView) GetDB() (*database, error) {
+	db, err := v.kv.GetDB()
+	if err != nil {
+		return nil, err
+	}
+	return v.project(db, nil /* keys */), nil
+}
+
+func (v namespaceView) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	return v.kv.MutateKey(v.prefix+key, v.wrap(f, []string{key}))
+}
+
+func (v namespaceView) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	return v.kv.MutateKeys(v.keys(keys), v.wrap(f, keys))
+}
+
+func (v namespaceView) MutateDB(f func(*database) (int, error)) (int, error) {
+	return v.kv.MutateDB(v.wrap(f, nil /* keys */))
+}
+
+// wrap adapts a mutation of the namespace's keys to a mutation of the
+// database. Nil keys means every key in the namespace.
+func (v namespaceView) wrap(f func(*database) (int, error), keys []string) func(*database) (int, error) {
+	return func(db *database) (int, error) {
+		view := v.project(db, keys)
+		n, err := f(view)
+		if err != nil {
+			return n, err
+		}
+		v.store(db, view, keys)
+		return n, nil
+	}
+}
+
+// project returns the supplied keys of the namespace's part of db, without
+// the prefix, or every key in the namespace if keys is nil. Other
+// bookkeeping, like the generation, is shared with the whole database, and
+// the rest of db's keys still count towards the shard's capacity (see
+// database.stored).
+func (v namespaceView) project(db *database, keys []string) *database {
+	view := newDatabase()
+	view.Format = db.Format
+	view.Generation = db.Generation
+	view.Deleted = db.Deleted
+	view.Shards = db.Shards
+	view.expired = db.expired
+	if keys == nil {
+		copyKeys(view, db, func(key string) (string, bool) {
+			return strings.CutPrefix(key, v.prefix)
+		})
+	} else {
+		for _, key := range keys {
+			copyKey(view, db, v.prefix+key, key)
+		}
+	}
+	view.others = db.stored() - view.len()
+	return view
+}
+
+// store replaces the namespace's part of db with view, which project made
+// with the same keys.
+func (v namespaceView) store(db, view *database, keys []string) {
+	if keys == nil {
+		deletePrefix(db.Items, v.prefix)
+		deletePrefix(db.Hashes, v.prefix)
+		deletePrefix(db.Lists, v.prefix)
+		deletePrefix(db.Sets, v.prefix)
+		deletePrefix(db.ZSets, v.prefix)
+		deletePrefix(db.Expires, v.prefix)
+		deletePrefix(db.Versions, v.prefix)
+		deletePrefix(db.Leases, v.prefix)
+	} else {
+		for _, key := range keys {
+			deleteKey(db, v.prefix+key)
+		}
+	}
+	copyKeys(db, view, func(key string) (string, bool) {
+		return v.prefix + key, true
+	})
+	db.Deleted = max(db.Deleted, view.Deleted)
+	for key := range view.changed {
+		db.noteChange(v.prefix + key)
+	}
+	// A flush of the namespace deletes its keys one by one, rather than
+	// flushing the whole database.
+	for _, e := range view.notifications {
+		e.Key = v.prefix + e.Key
+		db.notifications = append(db.notifications, e)
+	}
+}
+
+// copyKeys copies the keys, values, and per-key bookkeeping that rename
+// accepts from src to dst, renaming them as it goes. Values are shared, not
+// copied.
+func copyKeys(dst, src *database, rename func(string) (string, bool)) {
+	copyMap(dst.Items, src.Items, rename)
+	copyMap(dst.Hashes, src.Hashes, rename)
+	copyMap(dst.Lists, src.Lists, rename)
+	copyMap(dst.Sets, src.Sets, rename)
+	copyMap(dst.ZSets, src.ZSets, rename)
+	copyMap(dst.Expires, src.Expires, rename)
+	copyMap(dst.Versions, src.Versions, rename)
+	copyMap(dst.Leases, src.Leases, rename)
+}
+
+// copyKey copies one key, with its value and per-key bookkeeping, from src to
+// dst, renaming it as it goes.
+func copyKey(dst, src *database, from, to string) {
+	copyEntry(dst.Items, src.Items, from, to)
+	copyEntry(dst.Hashes, src.Hashes, from, to)
+	copyEntry(dst.Lists, src.Lists, from, to)
+	copyEntry(dst.Sets, src.Sets, from, to)
+	copyEntry(dst.ZSets, src.ZSets, from, to)
+	copyEntry(dst.Expires, src.Expires, from, to)
+	copyEntry(dst.Versions, src.Versions, from, to)
+	copyEntry(dst.Leases, src.Leases, from, to)
+}
+
+// deleteKey deletes one key, with its per-key bookkeeping, from db. Unlike
+// deleteItem, it doesn't record a deletion.
+func deleteKey(db *database, key string) {
+	delete(db.Items, key)
+	delete(db.Hashes, key)
+	delete(db.Lists, key)
+	delete(db.Sets, key)
+	delete(db.ZSets, key)
+	delete(db.Expires, key)
+	delete(db.Versions, key)
+	delete(db.Leases, key)
+}
+
+func copyEntry[V any](dst, src map[string]V, from, to string) {
+	if val, ok := src[from]; ok {
+		dst[to] = val
+	}
+}
+
+func copyMap[V any](dst, src map[string]V, rename func(string) (string, bool)) {
+	for key, val := range src {
+		if key, ok := rename(key); ok {
+			dst[key] = val
+		}
+	}
+}
+
+func deletePrefix[V any](m map[string]V, prefix string) {
+	maps.DeleteFunc(m, func(key string, _ V) bool { return strings.HasPrefix(key, prefix) })
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// Keyspace notifications tell pub/sub subscribers about writes, as in
+// Valkey: a SET of foo in database 0 publishes "set" to __keyspace@0__:foo
+// and "foo" to __keyevent@0__:set. They're published through the relay, so subscribers on
+// every node receive them, but each node only notifies about its own writes,
+// using its own notify-keyspace-events setting. Like other published
+// messages, notifications are best-effort.
+//
+// Commands record notifications as they write, and the notifier publishes
+// them once the write is durable. So far, SET, MSET, DEL, EXPIRE, PEXPIRE,
+// and the INCR family record them; the other classes are accepted for
+// compatibility but never published.
+
+// notifyClasses are the notification classes, in the order Valkey reports
+// them.
+const notifyClasses = "g$lshzxetd"
+
+// notifyFlags are the parsed form of notify-keyspace-events, with a bit for
+// each of notifyFlagChars: the classes, then K (publish to keyspace
+// channels), E (publish to keyevent channels), m (key misses), and n (new
+// keys).
+type notifyFlags uint32
+
+const notifyFlagChars = notifyClasses + "KEmn"
+
+// notifyFlag returns the bit for one of notifyFlagChars.
+func notifyFlag(c byte) notifyFlags {
+	return 1 << strings.IndexByte(notifyFlagChars, c)
+}
+
+// allNotifyClasses is the "A" alias.
+const allNotifyClasses = 1<<len(notifyClasses) - 1
+
+// parseNotifyFlags parses a notify-keyspace-events setting.
+func parseNotifyFlags(s string) (notifyFlags, error) {
+	var flags notifyFlags
+	for _, c := range []byte(s) {
+		switch {
+		case c == 'A':
+			flags |= allNotifyClasses
+		case strings.IndexByte(notifyFlagChars, c) >= 0:
+			flags |= notifyFlag(c)
+		default:
+			return 0, fmt.Errorf("invalid notify-keyspace-events flag '%c'", c)
+		}
+	}
+	return flags, nil
+}
+
+func (f notifyFlags) has(c byte) bool {
+	return f&notifyFlag(c) != 0
+}
+
+func (f notifyFlags) String() string {
+	var b strings.Builder
+	if f&allNotifyClasses == allNotifyClasses {
+		b.WriteByte('A')
+	} else {
+		for _, c := range []byte(notifyClasses) {
+			if f.has(c) {
+				b.WriteByte(c)
+			}
+		}
+	}
+	for _, c := range []byte("KEmn") {
+		if f.has(c) {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// notify records a keyspace notification of the given class about a key.
+// It's published if the write succeeds.
+func (db *database) notify(class byte, name, key string) {
+	db.notifications = append(db.notifications, event{
+		Kind:         eventNotification,
+		Key:          key,
+		Notification: notification{Class: class, Name: name},
+	})
+}
+
+// A notification is what a command recorded about a key it wrote.
+type notification struct {
+	Class byte   // as in notify-keyspace-events
+	Name  string // the event, like "set" or "del"
+	DB    int    // the logical database, filled in when it's queued
+}
+
+// notifyQueueSize bounds the notifications waiting to be published. Events
+// are delivered on the write path, so when publishing falls behind, further
+// notifications are dropped rather than slowing down writes.
+const notifyQueueSize = 1024
+
+// notifier publishes keyspace notifications.
+type notifier struct {
+	relay  *relay
+	logger *slog.Logger
+	flags  atomic.Uint32
+	queue  chan event
+}
+
+func newNotifier(relay *relay, logger *slog.Logger, flags notifyFlags) *notifier {
+	n := &notifier{
+		relay:  relay,
+		logger: logger,
+		queue:  make(chan event, notifyQueueSize),
+	}
+	n.flags.Store(uint32(flags))
+	return n
+}
+
+// Flags returns the current notify-keyspace-events setting.
+func (n *notifier) Flags() notifyFlags {
+	return notifyFlags(n.flags.Load())
+}
+
+// SetFlags changes the notify-keyspace-events setting.
+func (n *notifier) SetFlags(flags notifyFlags) {
+	n.flags.Store(uint32(flags))
+}
+
+// observer returns a function that queues logical database db's
+// notification events for publishing, if they're enabled. It's subscribed to
+// the database's event bus.
+func (n *notifier) observer(db int) func(event) {
+	return func(e event) {
+		if e.Kind != eventNotification {
+			return
+		}
+		flags := n.Flags()
+		if !flags.has(e.Notification.Class) || !(flags.has('K') || flags.has('E')) {
+			return
+		}
+		e.Notification.DB = db
+		select {
+		case n.queue <- e:
+		default:
+			n.logger.Warn("dropped keyspace notification", "key", e.Key, "event", e.Notification.Name)
+		}
+	}
+}
+
+// run publishes queued notifications until the context is canceled.
+func (n *notifier) run(ctx context.Context) {
+	for {
+		var e event
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-n.queue:
+		}
+		flags := n.Flags()
+		if flags.has('K') {
+			n.publish(fmt.Sprintf("__keyspace@%d__:%s", e.Notification.DB, e.Key), e.Notification.Name)
+		}
+		if flags.has('E') {
+			n.publish(fmt.Sprintf("__keyevent@%d__:%s", e.Notification.DB, e.Notification.Name), e.Key)
+		}
+	}
+}
+
+func (n *notifier) publish(channel, message string) {
+	if _, err := n.relay.publish(channel, message); err != nil {
+		n.logger.Warn("publish keyspace notification", "channel", channel, "err", err)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// OBJECT reports how Valkey would store a key, how long ago it was last used,
+// and how often it's used. Valthree stores every value the same way, but tools
+// like redis-cli --bigkeys and --memkeys use the encodings to size keys, so
+// OBJECT ENCODING reports the encoding Valkey would pick with its default
+// settings.
+//
+// Each node tracks when its commands use each key, alongside the cached
+// shards: every key a command reads or writes through the keyspace counts as
+// an access. Like Valkey's LRU and LFU metadata, it's approximate and it's
+// never stored, so each node only knows about its own commands, and a node
+// that restarts forgets it. Keys the node hasn't used since it started are
+// treated as last used when it started.
+
+const (
+	// maxTrackedKeys bounds the number of keys whose accesses are tracked.
+	// When it's exceeded, the least recently used half is forgotten.
+	maxTrackedKeys = 1 << 16
+	// lfuInitVal, lfuLogFactor, and lfuDecayTime match Valkey's defaults for
+	// its logarithmic access counters: new keys start at lfuInitVal, each
+	// access is less likely to increment the counter than the last, and the
+	// counter drops by one for every lfuDecayTime that the key goes unused.
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// Valkey's default limits for its compact encodings.
+const (
+	embstrMaxLen       = 44
+	listpackMaxEntries = 128
+	listpackMaxValue   = 64
+	listpackMaxBytes   = 8 << 10 // for lists
+	intsetMaxEntries   = 512
+)
+
+// A keyAccess records when a key was last used and how often.
+type keyAccess struct {
+	at      time.Time
+	counter uint8
+}
+
+// decayed returns the access counter at the supplied time.
+func (a keyAccess) decayed(now time.Time) uint8 {
+	periods := now.Sub(a.at) / lfuDecayTime
+	if periods >= time.Duration(a.counter) {
+		return 0
+	}
+	return a.counter - uint8(periods)
+}
+
+// accessTracker tracks the keys a node's commands use in one logical
+// database.
+type accessTracker struct {
+	mu    sync.Mutex
+	keys  map[string]keyAccess
+	since time.Time // when tracking started, set by newStorage
+}
+
+// touch records an access to each of the keys.
+func (t *accessTracker) touch(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.keys == nil {
+		t.keys = make(map[string]keyAccess)
+	}
+	for _, key := range keys {
+		a, ok := t.keys[key]
+		if !ok {
+			t.keys[key] = keyAccess{at: now, counter: lfuInitVal}
+			continue
+		}
+		counter := a.decayed(now)
+		base := max(int(counter)-lfuInitVal, 0)
+		if counter < 255 && rand.Float64() < 1/float64(base*lfuLogFactor+1) {
+			counter++
+		}
+		t.keys[key] = keyAccess{at: now, counter: counter}
+	}
+	if len(t.keys) <= maxTrackedKeys {
+		return
+	}
+	accesses := make([]keyAccessAt, 0, len(t.keys))
+	for key, a := range t.keys {
+		accesses = append(accesses, keyAccessAt{key, a.at})
+	}
+	slices.SortFunc(accesses, func(a, b keyAccessAt) int { return a.at.Compare(b.at) })
+	for _, a := range accesses[:len(accesses)-maxTrackedKeys/2] {
+		delete(t.keys, a.key)
+	}
+}
+
+type keyAccessAt struct {
+	key string
+	at  time.Time
+}
+
+// get returns a key's access metadata without counting an access.
+func (t *accessTracker) get(key string) keyAccess {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.keys[key]; ok {
+		return a
+	}
+	return keyAccess{at: t.since}
+}
+
+// An inspector is a keyspace that can read a key without counting an access,
+// and report the key's access metadata.
+type inspector interface {
+	Inspect(key string) (*database, keyAccess, error)
+}
+
+func (s scopedStorage) Inspect(key string) (*database, keyAccess, error) {
+	db, err := followMoves(s, func() (*database, error) {
+		return s.store.shardFor(key).get(s.ctx)
+	})
+	if err != nil {
+		return nil, keyAccess{}, err
+	}
+	return db, s.store.access.get(key), nil
+}
+
+func (v namespaceView) Inspect(key string) (*database, keyAccess, error) {
+	db, a, err := inspect(v.kv, v.prefix+key)
+	if err != nil {
+		return nil, a, err
+	}
+	return v.project(db, []string{key}), a, nil
+}
+
+// inspect reads key from kv, without counting an access if kv is an
+// inspector, and returns its access metadata. Other keyspaces don't track
+// accesses, so their keys are always fresh.
+func inspect(kv keyspace, key string) (*database, keyAccess, error) {
+	if in, ok := kv.(inspector); ok {
+		return in.Inspect(key)
+	}
+	db, err := kv.GetKey(key)
+	return db, keyAccess{at: time.Now(), counter: lfuInitVal}, err
+}
+
+// object handles the OBJECT subcommands: ENCODING key, IDLETIME key, FREQ
+// key, and REFCOUNT key. Each replies with null if the key doesn't exist.
+// IDLETIME is in seconds, and FREQ is Valkey's logarithmic access counter.
+func (s *Server) object(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Object)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch sub {
+	case "encoding", "idletime", "freq", "refcount":
+	default:
+		writeErr(conn, fmt.Errorf("unknown OBJECT subcommand '%s'", sub))
+		return
+	}
+	if len(args) != 1 {
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'object|%s' command", sub))
+		return
+	}
+	key := args[0]
+	db, a, err := inspect(s.kv, key)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if !db.exists(key) {
+		conn.WriteNull()
+		return
+	}
+	now := time.Now()
+	switch sub {
+	case "encoding":
+		conn.WriteBulkString(db.encoding(key))
+	case "idletime":
+		conn.WriteInt64(int64(now.Sub(a.at) / time.Second))
+	case "freq":
+		conn.WriteInt(int(a.decayed(now)))
+	case "refcount":
+		conn.WriteInt(1)
+	}
+}
+
+// encoding returns the encoding Valkey would use for a key's value. The key
+// must exist.
+func (db *database) encoding(key string) string {
+	switch db.typeOf(key) {
+	case "string":
+		val := db.Items[key]
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil && strconv.FormatInt(n, 10) == val {
+			return "int"
+		}
+		if len(val) <= embstrMaxLen {
+			return "embstr"
+		}
+		return "raw"
+	case "hash":
+		hash := db.Hashes[key]
+		compact := len(hash) <= listpackMaxEntries
+		for field, val := range hash {
+			compact = compact && len(field) <= listpackMaxValue && len(val) <= listpackMaxValue
+		}
+		if compact {
+			return "listpack"
+		}
+		return "hashtable"
+	case "list":
+		if db.size(key) <= listpackMaxBytes {
+			return "listpack"
+		}
+		return "quicklist"
+	case "set":
+		members := db.Sets[key]
+		ints, compact := len(members) <= intsetMaxEntries, len(members) <= listpackMaxEntries
+		for m := range members {
+			n, err := strconv.ParseInt(m, 10, 64)
+			ints = ints && err == nil && strconv.FormatInt(n, 10) == m
+			compact = compact && len(m) <= listpackMaxValue
+		}
+		switch {
+		case ints:
+			return "intset"
+		case compact:
+			return "listpack"
+		}
+		return "hashtable"
+	default:
+		z := db.ZSets[key]
+		compact := len(z) <= listpackMaxEntries
+		for _, m := range z {
+			compact = compact && len(m.Member) <= listpackMaxValue
+		}
+		if compact {
+			return "listpack"
+		}
+		return "skiplist"
+	}
+}
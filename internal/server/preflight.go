@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/antithesishq/valthree/internal/cron"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// A CheckStatus is the outcome of a Check.
+type CheckStatus string
+
+const (
+	CheckOK      CheckStatus = "ok"
+	CheckWarning CheckStatus = "warning" // the server would start, but degraded
+	CheckFailed  CheckStatus = "failed"
+	CheckSkipped CheckStatus = "skipped" // an earlier check didn't pass
+)
+
+// A Check is the result of one of Validate's checks.
+type Check struct {
+	Name   string      `json:"name"`
+	Status CheckStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// Validate checks that a server with this configuration could start and
+// serve requests, without starting one: that the configuration is
+// consistent, that the bucket is reachable with the configured credentials,
+// that object storage enforces conditional writes, and that any existing
+// database matches the configured number of shards.
+//
+// Unlike New, Validate doesn't retry, and it doesn't create the bucket or
+// the database. It does write and delete a probe object, like New.
+func Validate(cfg Config) []Check {
+	checks := []Check{validateConfig(cfg)}
+	store := openStorage(cfg)
+
+	bucket := validateBucket(store)
+	checks = append(checks, bucket)
+	if bucket.Status != CheckOK {
+		return append(checks,
+			Check{Name: "conditional-writes", Status: CheckSkipped},
+			Check{Name: "database", Status: CheckSkipped},
+		)
+	}
+	checks = append(checks, validateConditionalWrites(store, cfg.EmulateConditionalWrites))
+	return append(checks, validateDatabase(store))
+}
+
+func validateConfig(cfg Config) Check {
+	err := func() error {
+		switch {
+		case cfg.DatabaseName == "":
+			return errors.New("database name is empty")
+		case cfg.MaxItems <= 0:
+			return errors.New("maximum number of keys must be positive")
+		case cfg.Shards > 1 && len(cfg.Quotas) > 0:
+			return errors.New("quotas aren't supported in sharded databases")
+		case cfg.AutoShards > 1 && len(cfg.Quotas) > 0:
+			return errors.New("quotas aren't supported in databases that may be promoted to shards")
+		case cfg.AutoShards > 1 && cfg.Shards > 1:
+			return errors.New("automatic sharding only applies to unsharded databases")
+		case cfg.S3Timeout <= 0:
+			return errors.New("object storage timeout must be positive")
+		case cfg.CompactMaxEntries > 0 && cfg.CompactMinEntries > cfg.CompactMaxEntries:
+			return errors.New("compaction's minimum number of log entries exceeds its maximum")
+		}
+		if _, err := parseNotifyFlags(cfg.NotifyKeyspaceEvents); err != nil {
+			return err
+		}
+		if cfg.BackupSchedule != "" {
+			if _, err := cron.Parse(cfg.BackupSchedule); err != nil {
+				return fmt.Errorf("backup schedule: %v", err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return Check{Name: "config", Status: CheckFailed, Detail: err.Error()}
+	}
+	return Check{Name: "config", Status: CheckOK}
+}
+
+// validateBucket checks the credentials and the bucket with a HEAD request.
+// A missing bucket is only a warning, since New creates it.
+func validateBucket(s *storage) Check {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	check := Check{Name: "bucket"}
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	var errNotFound *types.NotFound
+	switch {
+	case errors.As(err, &errNotFound):
+		check.Status = CheckWarning
+		check.Detail = fmt.Sprintf("bucket %s doesn't exist yet; the server will create it", s.bucket)
+	case err != nil:
+		check.Status = CheckFailed
+		check.Detail = err.Error()
+	default:
+		check.Status = CheckOK
+	}
+	return check
+}
+
+func validateConditionalWrites(s *storage, emulate bool) Check {
+	check := Check{Name: "conditional-writes", Status: CheckOK}
+	err := s.Probe()
+	switch {
+	case errors.Is(err, errNoConditionalWrites) && emulate:
+		check.Status = CheckWarning
+		check.Detail = fmt.Sprintf("%v; the server will emulate them", err)
+	case errors.Is(err, errNoConditionalWrites):
+		check.Status = CheckFailed
+		check.Detail = fmt.Sprintf("%v; the server will refuse writes", err)
+	case err != nil:
+		check.Status = CheckFailed
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+// validateDatabase reads every shard, which verifies that the stored
+// database is readable and was written with the configured number of shards.
+func validateDatabase(s *storage) Check {
+	check := Check{Name: "database", Status: CheckOK}
+	keys, err := countKeys(s.shards())
+	if errors.Is(err, errDatabaseMoved) {
+		// Servers follow a database that was promoted to shards.
+		keys, err = countKeys(*newShards(s, s.autoShards))
+	}
+	if err != nil {
+		check.Status = CheckFailed
+		check.Detail = err.Error()
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d keys", keys)
+	return check
+}
+
+// countKeys reads the shards and returns the number of keys they hold.
+func countKeys(shards []*shard) (int, error) {
+	var keys int
+	for _, sh := range shards {
+		db, err := sh.get(context.Background())
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", sh.key, err)
+		}
+		keys += db.len()
+	}
+	return keys, nil
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := Config{DatabaseName: "db", MaxItems: 1024, S3Timeout: time.Second}
+	attest.Equal(t, validateConfig(valid), Check{Name: "config", Status: CheckOK})
+	for _, tt := range []struct {
+		change func(*Config)
+		detail string
+	}{
+		{func(c *Config) { c.DatabaseName = "" }, "database name is empty"},
+		{func(c *Config) { c.MaxItems = 0 }, "maximum number of keys"},
+		{func(c *Config) { c.S3Timeout = 0 }, "timeout must be positive"},
+		{func(c *Config) { c.Shards, c.Quotas = 2, []Quota{{Prefix: "a:"}} }, "quotas aren't supported"},
+		{func(c *Config) { c.AutoShards, c.Quotas = 2, []Quota{{Prefix: "a:"}} }, "quotas aren't supported"},
+		{func(c *Config) { c.Shards, c.AutoShards = 2, 4 }, "only applies to unsharded databases"},
+		{func(c *Config) { c.CompactMinEntries, c.CompactMaxEntries = 8, 4 }, "minimum number of log entries"},
+		{func(c *Config) { c.NotifyKeyspaceEvents = "Kq" }, "flag 'q'"},
+		{func(c *Config) { c.BackupSchedule = "every day" }, "backup schedule"},
+	} {
+		cfg := valid
+		tt.change(&cfg)
+		check := validateConfig(cfg)
+		attest.Equal(t, check.Status, CheckFailed)
+		attest.Subsequence(t, check.Detail, tt.detail)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// probePrefix holds the objects written by Probe. It's separate from the
+// database and its shards.
+const probePrefix = "valthree-probe/"
+
+// errNoConditionalWrites is returned by Probe when object storage accepts
+// writes it should have rejected.
+var errNoConditionalWrites = errors.New("object storage doesn't enforce If-Match and If-None-Match")
+
+// Probe verifies that object storage honors conditional writes, which
+// Valthree's consistency depends on. Some S3-compatible stores silently
+// ignore If-Match and If-None-Match, so every write would succeed and
+// concurrent writers would overwrite each other.
+//
+// Probe returns an error wrapping errNoConditionalWrites if conditional
+// writes are broken, and other errors if it couldn't complete the probe.
+func (s *storage) Probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key := probePrefix + s.name + "/" + rand.Text()
+	defer s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	put := func(body string, match, noneMatch *string) (string, bool, error) {
+		res, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader([]byte(body)),
+			IfMatch:     match,
+			IfNoneMatch: noneMatch,
+		})
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+				return "", false, nil
+			}
+			return "", false, fmt.Errorf("put probe object: %v", err)
+		}
+		return aws.ToString(res.ETag), true, nil
+	}
+
+	etag, ok, err := put("1", nil, aws.String("*"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: If-None-Match rejected a new object", errNoConditionalWrites)
+	}
+	if etag == "" {
+		return fmt.Errorf("%w: no ETag for new object", errNoConditionalWrites)
+	}
+	if _, ok, err := put("2", nil, aws.String("*")); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%w: If-None-Match allowed overwriting an object", errNoConditionalWrites)
+	}
+	if _, ok, err := put("3", aws.String(`"`+rand.Text()+`"`), nil); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%w: If-Match allowed a write with the wrong ETag", errNoConditionalWrites)
+	}
+	if _, ok, err := put("4", aws.String(etag), nil); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%w: If-Match rejected a write with the right ETag", errNoConditionalWrites)
+	}
+	return nil
+}
+
+// CanWrite reports whether object storage accepts writes made with the
+// server's credentials, by trying to create a probe object. Replicas use it to
+// check that their credentials are read-only.
+func (s *storage) CanWrite() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	key := probePrefix + s.name + "/" + rand.Text()
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(nil),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied":
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("put probe object: %v", err)
+	}
+	s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return true, nil
+}
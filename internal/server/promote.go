@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A database that starts as a single object may outgrow it: every write
+// rewrites the whole object, and every write from every node races for its
+// ETag. Servers configured with Config.AutoShards watch the object's size and
+// how often their writes to it conflict, and once either crosses its
+// threshold, they promote the database to that many shards while it's in
+// use.
+//
+// Promotion works just like Migrate, online. The node promoting the database
+// rewrites the unsharded object in movedFormat, conditionally, so it's the
+// final version of the unsharded database: every later write to it fails its
+// check, and every earlier one is included. It then creates each shard from
+// its part of that version. Other nodes notice the move the next time they
+// read the unsharded object, and follow it: they create any shards that don't
+// exist yet from the same final version (so it doesn't matter if the node that
+// moved the database crashed), switch to the shards, and run the command
+// again. Until then, the unsharded object is still read, so the cutover needs
+// no downtime.
+//
+// Sharding restricts multi-key commands to keys in the same shard, so
+// promotion changes what clients may do, which is why it's opt-in. Every node
+// must be configured with the same AutoShards, and quotas aren't supported,
+// as in any sharded database.
+
+// errDatabaseMoved means the database was promoted to shards since the
+// command looked up its keys. It wraps ErrContention, since the command
+// didn't run and may simply be retried.
+var errDatabaseMoved = fmt.Errorf("%w: database was moved into shards", ErrContention)
+
+// minPromotionPuts is the number of writes a check needs to see before it
+// promotes the database because of conflicts, so that a few unlucky writes to
+// an idle database don't promote it.
+const minPromotionPuts = 10
+
+// A promotePolicy decides when an unsharded database is promoted to shards.
+type promotePolicy struct {
+	// shards is the number of shards to promote to.
+	shards int
+	// interval is how often the database is checked.
+	interval time.Duration
+	// bytes is the object size that promotes the database. Zero disables
+	// the check.
+	bytes int
+	// conflictRate is the fraction of writes conflicting since the last
+	// check that promotes the database. Zero disables the check.
+	conflictRate float64
+}
+
+// promoteCounts are a shard's write counts as of the last check.
+type promoteCounts struct {
+	puts, conflicts uint64
+}
+
+// reason returns why sh, an unsharded database, should be promoted, or an
+// empty string if it shouldn't. last holds the shard's counts as of the last
+// check, and is updated.
+func (p promotePolicy) reason(sh *shard, last *promoteCounts) string {
+	sh.mu.Lock()
+	size := len(sh.cached.body)
+	sh.mu.Unlock()
+	puts, conflicts := sh.puts.Load(), sh.conflicts.Load()
+	dp, dc := puts-last.puts, conflicts-last.conflicts
+	last.puts, last.conflicts = puts, conflicts
+	switch {
+	case p.bytes > 0 && size >= p.bytes:
+		return fmt.Sprintf("object is %d bytes", size)
+	case p.conflictRate > 0 && dp >= minPromotionPuts && float64(dc)/float64(dp) >= p.conflictRate:
+		return fmt.Sprintf("%d of %d writes conflicted", dc, dp)
+	}
+	return ""
+}
+
+// promoteShards periodically checks whether each unsharded database should
+// be promoted to shards, and promotes it, until the context is canceled.
+func (s *Server) promoteShards(ctx context.Context, logger *slog.Logger, policy promotePolicy) {
+	ticker := time.NewTicker(policy.interval)
+	defer ticker.Stop()
+	last := make(map[*shard]*promoteCounts)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, store := range s.dbs {
+			shards := store.shards()
+			if len(shards) > 1 {
+				continue
+			}
+			sh := shards[0]
+			if last[sh] == nil {
+				last[sh] = &promoteCounts{}
+			}
+			reason := policy.reason(sh, last[sh])
+			if reason == "" {
+				continue
+			}
+			if err := store.Promote(ctx, policy.shards); err != nil {
+				logger.Warn("promote database to shards", "database", store.name, "err", err)
+				continue
+			}
+			logger.Info("promoted database to shards", "database", store.name, "shards", policy.shards, "reason", reason)
+		}
+	}
+}
+
+// Promote moves an unsharded database into n shards while servers keep
+// using it. It does nothing if the database is already sharded, and it's safe
+// for several nodes to promote the database at once.
+func (s *storage) Promote(ctx context.Context, n int) error {
+	shards := s.shards()
+	if len(shards) > 1 {
+		return nil
+	}
+	db, err := shards[0].markMoved(ctx, n)
+	if err != nil || db == nil {
+		return err
+	}
+	return s.follow(ctx)
+}
+
+// follow switches the storage to the shards that the unsharded database was
+// moved into, creating any that don't exist yet.
+func (s *storage) follow(ctx context.Context) error {
+	s.moveMu.Lock()
+	defer s.moveMu.Unlock()
+
+	current := s.shards()
+	if len(current) > 1 {
+		return nil // another command followed first
+	}
+	legacy := current[0]
+	legacy.mu.Lock()
+	db, _, err := legacy.getDB(ctx)
+	legacy.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if db.Format != movedFormat {
+		return nil
+	}
+	if db.Shards != s.autoShards {
+		return fmt.Errorf("database was moved into %d shards, but the server is configured with %d", db.Shards, s.autoShards)
+	}
+	shards := *newShards(s, db.Shards)
+	if s.unsafe == nil {
+		if err := createParts(shards, db); err != nil {
+			return err
+		}
+	} else {
+		// Nodes that can't write wait for another node to create the
+		// shards, rather than reading missing shards as empty.
+		for _, sh := range shards {
+			sh.mu.Lock()
+			_, etag, err := sh.getDB(ctx)
+			sh.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			if etag == "" {
+				return fmt.Errorf("%w: database is being moved into shards", ErrStorageUnavailable)
+			}
+		}
+	}
+	s.layout.Store(&shards)
+	return nil
+}
+
+// followMoves calls op, and if it found that the database was promoted to
+// shards, follows the database into them and calls op again.
+func followMoves[T any](s scopedStorage, op func() (T, error)) (T, error) {
+	v, err := op()
+	if errors.Is(err, errDatabaseMoved) {
+		if err = s.store.follow(s.ctx); err == nil {
+			v, err = op()
+		}
+	}
+	return v, s.check(err)
+}
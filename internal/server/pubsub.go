@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	// relayLookback is how far back each poll looks for messages. Publishers'
+	// clocks may disagree, and a message may become visible in a listing
+	// after later ones, so polls overlap rather than starting where the last
+	// one ended.
+	relayLookback = 10 * time.Second
+	// relayRetention is how long messages stay in object storage.
+	relayRetention = time.Minute
+)
+
+// A relay delivers published messages between the nodes of a cluster. Nodes
+// share nothing but the bucket, so it uses the bucket as a mailbox: each
+// PUBLISH writes the message to an object, and nodes with subscribers poll
+// for other nodes' messages. Each message object's name starts with the
+// publish time, so a listing returns messages roughly in publish order, and
+// polls only need to list recent ones.
+//
+// Delivery is best-effort, as in Valkey: subscribers on other nodes receive
+// messages after up to a poll interval, and miss messages published while
+// object storage is unavailable.
+type relay struct {
+	ctx      context.Context // stops polling
+	store    *storage
+	logger   *slog.Logger
+	pubsub   redcon.PubSub // this node's subscribers
+	node     string        // distinguishes this process's messages
+	interval time.Duration // zero disables relaying
+	seq      atomic.Uint64
+	poll     sync.Once   // polling starts with the first subscription
+	shards   shardPubSub // this node's shard channel subscribers
+}
+
+// relayedMessage is the body of a message object.
+type relayedMessage struct {
+	Channel []byte `json:"channel"`
+	Message []byte `json:"message"`
+	// Shard is set for messages published to shard channels.
+	Shard bool `json:"shard,omitempty"`
+}
+
+func newRelay(ctx context.Context, store *storage, logger *slog.Logger, interval time.Duration) *relay {
+	return &relay{
+		ctx:      ctx,
+		store:    store,
+		logger:   logger,
+		node:     rand.Text(),
+		interval: interval,
+	}
+}
+
+// subscribe subscribes the connection to a channel or pattern. From then on,
+// redcon serves the connection's commands itself, so only SUBSCRIBE,
+// UNSUBSCRIBE, their pattern variants, PING, and QUIT are allowed.
+func (r *relay) subscribe(conn redcon.Conn, pattern bool, channel string) {
+	if r.interval > 0 {
+		r.poll.Do(func() { go r.run() })
+	}
+	conn = unwrapConn(conn)
+	if pattern {
+		r.pubsub.Psubscribe(conn, channel)
+	} else {
+		r.pubsub.Subscribe(conn, channel)
+	}
+}
+
+// publish delivers a message to this node's subscribers and leaves it for
+// the other nodes to find. It returns the number of local subscribers that
+// received it; like Valkey in cluster mode, subscribers on other nodes
+// aren't counted. (redcon over-counts pattern subscribers: it counts every
+// pattern subscription, even those that don't match.)
+func (r *relay) publish(channel, message string) (int, error) {
+	n := r.pubsub.Publish(channel, message)
+	if r.interval == 0 {
+		return n, nil
+	}
+	return n, r.put(relayedMessage{Channel: []byte(channel), Message: []byte(message)})
+}
+
+// subscribeShard subscribes the connection to shard channels. If relayed is
+// set, messages published to them on other nodes are delivered too.
+func (r *relay) subscribeShard(conn redcon.Conn, channels []string, relayed bool, check func([]string) error) {
+	if r.interval > 0 && relayed {
+		r.poll.Do(func() { go r.run() })
+	}
+	r.shards.subscribe(unwrapConn(conn), channels, check)
+}
+
+// publishShard is like publish, for a shard channel. The message is only
+// left for other nodes if relayed is set.
+func (r *relay) publishShard(channel, message string, relayed bool) (int, error) {
+	n := r.shards.publish(channel, message)
+	if r.interval == 0 || !relayed {
+		return n, nil
+	}
+	return n, r.put(relayedMessage{Channel: []byte(channel), Message: []byte(message), Shard: true})
+}
+
+// put leaves a message for the other nodes to find.
+func (r *relay) put(msg relayedMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal JSON: %v", err)
+	}
+	name := fmt.Sprintf("%019d-%s-%d", time.Now().UnixNano(), r.node, r.seq.Add(1))
+	return r.store.putMessage(name, body)
+}
+
+// run polls for other nodes' messages until the relay's context is canceled.
+func (r *relay) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	// Only messages published after the first subscription are delivered.
+	since := time.Now()
+	seen := make(map[string]time.Time)
+	var cleaned time.Time
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		names, err := r.store.listMessages(now.Add(-relayLookback))
+		if err != nil {
+			r.logger.Warn("list published messages", "err", err)
+			continue
+		}
+		for _, name := range names {
+			at, node, ok := parseMessageName(name)
+			if _, dup := seen[name]; !ok || dup {
+				continue
+			}
+			seen[name] = at
+			if node == r.node || at.Before(since) {
+				continue
+			}
+			msg, err := r.store.getMessage(name)
+			if err != nil {
+				r.logger.Warn("read published message", "name", name, "err", err)
+				continue
+			}
+			if msg.Shard {
+				r.shards.publish(string(msg.Channel), string(msg.Message))
+			} else {
+				r.pubsub.Publish(string(msg.Channel), string(msg.Message))
+			}
+		}
+		// Messages older than the lookback won't be listed again.
+		for name, at := range seen {
+			if now.Sub(at) > relayLookback {
+				delete(seen, name)
+			}
+		}
+		if now.Sub(cleaned) > relayRetention {
+			cleaned = now
+			if err := r.store.deleteMessages(now.Add(-relayRetention)); err != nil {
+				r.logger.Warn("delete old published messages", "err", err)
+			}
+		}
+	}
+}
+
+// parseMessageName returns the publish time and node of a message object.
+func parseMessageName(name string) (time.Time, string, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 3 {
+		return time.Time{}, "", false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), parts[1], true
+}
+
+// messagePrefix is the common prefix of all the database's message objects.
+func (s *storage) messagePrefix() string {
+	return s.name + ".pubsub/"
+}
+
+func (s *storage) putMessage(name string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.messagePrefix() + name),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return fmt.Errorf("%w: put object: %v", ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+func (s *storage) getMessage(name string) (relayedMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var msg relayedMessage
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.messagePrefix() + name),
+	})
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return msg, fmt.Errorf("get object: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		s.stats.storageErrors.Add(1)
+		return msg, fmt.Errorf("read object: %v", err)
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return msg, fmt.Errorf("unmarshal JSON: %v", err)
+	}
+	return msg, nil
+}
+
+// listMessages returns the names of the messages published after a time,
+// oldest first.
+func (s *storage) listMessages(after time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var names []string
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		Prefix:     aws.String(s.messagePrefix()),
+		StartAfter: aws.String(fmt.Sprintf("%s%019d", s.messagePrefix(), after.UnixNano())),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			s.stats.storageErrors.Add(1)
+			return nil, fmt.Errorf("list objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(obj.Key), s.messagePrefix()))
+		}
+	}
+	return names, nil
+}
+
+// deleteMessages deletes the messages published before a time. Every node
+// with subscribers does this, so deletes may race, but deleting a message
+// twice is harmless.
+func (s *storage) deleteMessages(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.messagePrefix()),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			s.stats.storageErrors.Add(1)
+			return fmt.Errorf("list objects: %v", err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), s.messagePrefix())
+			if at, _, ok := parseMessageName(name); ok && !at.Before(before) {
+				return nil
+			}
+			if err := s.DeleteObject(aws.ToString(obj.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subscribeCmd handles SUBSCRIBE channel [channel ...] and PSUBSCRIBE pattern
+// [pattern ...].
+func (s *Server) subscribeCmd(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, name)
+		return
+	}
+	for _, channel := range args {
+		s.relay.subscribe(conn, name == op.PSubscribe, channel)
+	}
+}
+
+// unsubscribeCmd handles UNSUBSCRIBE [channel ...], PUNSUBSCRIBE
+// [pattern ...], and SUNSUBSCRIBE [shardchannel ...] on connections that
+// aren't subscribed to anything; once a connection subscribes, redcon (or
+// shardPubSub) handles them. Each channel is confirmed with
+// a count of zero remaining subscriptions.
+func (s *Server) unsubscribeCmd(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) == 0 {
+		conn.WriteArray(3)
+		conn.WriteBulkString(string(name))
+		conn.WriteNull()
+		conn.WriteInt(0)
+		return
+	}
+	for _, channel := range args {
+		conn.WriteArray(3)
+		conn.WriteBulkString(string(name))
+		conn.WriteBulkString(channel)
+		conn.WriteInt(0)
+	}
+}
+
+// publish handles PUBLISH channel message, which replies with the number of
+// subscribers on this node that received the message.
+func (s *Server) publish(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.Publish)
+		return
+	}
+	n, err := s.relay.publish(args[0], args[1])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
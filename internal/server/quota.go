@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A Quota limits the keys stored under a prefix. Zero limits are unlimited.
+type Quota struct {
+	Prefix   string
+	MaxKeys  int
+	MaxBytes int // total size of the values stored under the prefix
+}
+
+// ParseQuota parses a quota written as PREFIX=MAX_KEYS:MAX_BYTES, as used on
+// the command line. Either limit may be omitted or zero to leave it unlimited.
+func ParseQuota(s string) (Quota, error) {
+	idx := strings.LastIndex(s, "=")
+	if idx < 0 {
+		return Quota{}, fmt.Errorf("quota %q: expected PREFIX=MAX_KEYS:MAX_BYTES", s)
+	}
+	q := Quota{Prefix: s[:idx]}
+	keys, bytes, _ := strings.Cut(s[idx+1:], ":")
+	if keys != "" {
+		if _, err := fmt.Sscan(keys, &q.MaxKeys); err != nil || q.MaxKeys < 0 {
+			return Quota{}, fmt.Errorf("quota %q: invalid key limit %q", s, keys)
+		}
+	}
+	if bytes != "" {
+		if _, err := fmt.Sscan(bytes, &q.MaxBytes); err != nil || q.MaxBytes < 0 {
+			return Quota{}, fmt.Errorf("quota %q: invalid byte limit %q", s, bytes)
+		}
+	}
+	return q, nil
+}
+
+type quotaUsage struct {
+	keys  int
+	bytes int
+}
+
+// A quotaCounter keeps a running count of each quota's usage in a version of
+// a shard, so that a write is checked against the quotas by looking at the
+// keys it changed (see database.noteChange), not the whole database. Between
+// writes, the shard keeps the count for the version it last wrote, and only
+// counts from scratch if another node has written since.
+type quotaCounter struct {
+	quotas     []Quota
+	logID      string // with generation, the version counted
+	generation uint64
+	used       []quotaUsage
+	sizes      map[string]int // of the keys under any quota's prefix
+	// journal undoes the changes made by the current write to the shard, so
+	// that failed mutations can be rolled back.
+	journal []quotaChange
+}
+
+// A quotaChange is a key's previous size, if it was counted.
+type quotaChange struct {
+	key     string
+	size    int
+	counted bool
+}
+
+func newQuotaCounter(quotas []Quota, db *database) *quotaCounter {
+	c := &quotaCounter{
+		quotas:     quotas,
+		logID:      db.LogID,
+		generation: db.Generation,
+		used:       make([]quotaUsage, len(quotas)),
+		sizes:      make(map[string]int),
+	}
+	for key := range db.keys() {
+		c.add(key, db.size(key))
+	}
+	return c
+}
+
+func (c *quotaCounter) add(key string, size int) {
+	for i, q := range c.quotas {
+		if strings.HasPrefix(key, q.Prefix) {
+			c.used[i].keys++
+			c.used[i].bytes += size
+			c.sizes[key] = size
+		}
+	}
+}
+
+func (c *quotaCounter) remove(key string) {
+	size, ok := c.sizes[key]
+	if !ok {
+		return
+	}
+	for i, q := range c.quotas {
+		if strings.HasPrefix(key, q.Prefix) {
+			c.used[i].keys--
+			c.used[i].bytes -= size
+		}
+	}
+	delete(c.sizes, key)
+}
+
+// update counts the changes to the keys db.changed records, and forgets them.
+func (c *quotaCounter) update(db *database) {
+	for key := range db.changed {
+		size, counted := c.sizes[key]
+		if !counted && !slices.ContainsFunc(c.quotas, func(q Quota) bool { return strings.HasPrefix(key, q.Prefix) }) {
+			continue
+		}
+		c.journal = append(c.journal, quotaChange{key: key, size: size, counted: counted})
+		c.remove(key)
+		if db.exists(key) {
+			c.add(key, db.size(key))
+		}
+	}
+	db.changed = nil
+}
+
+// rollback undoes the changes counted since the journal had mark entries.
+func (c *quotaCounter) rollback(mark int) {
+	for i := len(c.journal) - 1; i >= mark; i-- {
+		change := c.journal[i]
+		c.remove(change.key)
+		if change.counted {
+			c.add(change.key, change.size)
+		}
+	}
+	c.journal = c.journal[:mark]
+}
+
+// checkQuotas returns an error if a mutation took any quota's usage from
+// before to after, exceeding its limits. Mutations that reduce usage are
+// always allowed, even if the prefix remains over quota (for example, because
+// an operator lowered the limit).
+func checkQuotas(quotas []Quota, before, after []quotaUsage) error {
+	for i, q := range quotas {
+		if q.MaxKeys > 0 && after[i].keys > q.MaxKeys && after[i].keys > before[i].keys {
+			return fmt.Errorf("%w: quota for prefix %q allows at most %d keys", ErrCapacity, q.Prefix, q.MaxKeys)
+		}
+		if q.MaxBytes > 0 && after[i].bytes > q.MaxBytes && after[i].bytes > before[i].bytes {
+			return fmt.Errorf("%w: quota for prefix %q allows at most %d bytes", ErrCapacity, q.Prefix, q.MaxBytes)
+		}
+	}
+	return nil
+}
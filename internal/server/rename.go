@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// RENAME, RENAMENX, and COPY read the source and write the destination in a
+// single mutation, so both keys change together: another node's write to
+// either key lands entirely before or entirely after. Like MSET, that needs
+// both keys in the same shard. COPY to another logical database can't be
+// atomic, since each database has its own objects, but it doesn't change the
+// source, so it copies the value the source had when it was read.
+
+var (
+	errNoSuchKey  = errors.New("no such key")
+	errSameObject = errors.New("source and destination objects are the same")
+	errCopyInTxn  = errors.New("COPY with DB is not allowed in transactions")
+)
+
+// rename handles RENAME source destination and RENAMENX source destination,
+// which move a key, along with its TTL. RENAME replaces the destination, and
+// RENAMENX replies with 0 instead of writing if it exists.
+func (s *Server) rename(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	src, dst := args[0], args[1]
+	nx := name == op.RenameNX
+	_, err := s.kv.MutateKeys([]string{src, dst}, func(db *database) (int, error) {
+		if !db.exists(src) {
+			return 0, errNoSuchKey
+		}
+		if src == dst || (nx && db.exists(dst)) {
+			return 0, errNotApplied
+		}
+		e := db.entryCopy(src)
+		e.Key = dst
+		db.deleteItem(src)
+		db.setEntry(*e)
+		db.notify('g', "rename_from", src)
+		db.notify('g', "rename_to", dst)
+		return 0, nil
+	})
+	switch {
+	case errors.Is(err, errNotApplied) && nx:
+		conn.WriteInt(0)
+	case errors.Is(err, errNotApplied):
+		conn.WriteString("OK")
+	case err != nil:
+		writeErr(conn, err)
+	case nx:
+		conn.WriteInt(1)
+	default:
+		conn.WriteString("OK")
+	}
+}
+
+// copyKey handles COPY source destination [DB destination-db] [REPLACE],
+// which copies a key, along with its TTL, and replies with 1 if it did or 0
+// if the source doesn't exist or the destination does (without REPLACE).
+func (s *Server) copyKey(conn redcon.Conn, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, op.Copy)
+		return
+	}
+	src, dst := args[0], args[1]
+	target := stateOf(conn).db
+	var replace bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				writeErr(conn, errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				writeErr(conn, errNotAnInteger)
+				return
+			}
+			if n < 0 || n >= len(s.dbs) {
+				writeErr(conn, errDBIndex)
+				return
+			}
+			target = n
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+
+	var n int
+	var err error
+	if target == stateOf(conn).db {
+		if src == dst {
+			writeErr(conn, errSameObject)
+			return
+		}
+		n, err = s.kv.MutateKeys([]string{src, dst}, func(db *database) (int, error) {
+			if !db.exists(src) {
+				return 0, errNotApplied
+			}
+			return s.copyEntry(db, db, src, dst, replace)
+		})
+	} else {
+		n, err = s.copyAcross(target, src, dst, replace)
+	}
+	switch {
+	case errors.Is(err, errNotApplied):
+		conn.WriteInt(0)
+	case err != nil:
+		writeErr(conn, err)
+	default:
+		conn.WriteInt(n)
+	}
+}
+
+// copyAcross copies src in the connection's database to dst in another
+// logical database.
+func (s *Server) copyAcross(n int, src, dst string, replace bool) (int, error) {
+	if s.inTxn() {
+		// Transactions only see the selected database.
+		return 0, errCopyInTxn
+	}
+	if n != 0 && s.topology != nil {
+		return 0, errClusterSelect
+	}
+	from, err := s.kv.GetKey(src)
+	if err != nil {
+		return 0, err
+	}
+	if !from.exists(src) {
+		return 0, errNotApplied
+	}
+	return s.kvIn(n).MutateKey(dst, func(to *database) (int, error) {
+		return s.copyEntry(from, to, src, dst, replace)
+	})
+}
+
+// copyEntry copies src in from to dst in to, which may be the same
+// database. The source must exist.
+func (s *Server) copyEntry(from, to *database, src, dst string, replace bool) (int, error) {
+	exists := to.exists(dst)
+	if exists && !replace {
+		return 0, errNotApplied
+	}
+	if !exists && to.stored() >= s.maxItems() {
+		return 0, s.errAtCapacity()
+	}
+	e := from.entryCopy(src)
+	e.Key = dst
+	to.setEntry(*e)
+	to.notify('g', "copy_to", dst)
+	return 1, nil
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// Read replicas are nodes that serve reads but refuse writes, so that reads
+// can be scaled out without adding writers that contend for the database's
+// objects. Every node reads the same objects, so by default reads on a
+// replica are exactly as fresh as on any other node. Connections that send
+// READONLY accept stale reads instead: they're served from a copy of the
+// whole database that the replica refreshes in the background, without any
+// calls to object storage, so they may be up to Config.ReplicaRefresh behind.
+// READWRITE (or RESET) switches back to fresh reads. A single read command
+// can accept a stale read too, without changing the connection's mode, by
+// ending with the hint !stale-ok (see staleHinted).
+//
+// Stale reads never cost a connection its read-your-writes guarantee, so
+// connections don't need to track their last write. Other nodes accept
+// READONLY, but their reads revalidate any cached object with object storage
+// (see getObject), so they're never stale; and a connection to a replica,
+// where reads may be stale, can't write at all.
+//
+// Replicas refuse writes in storage as well as in commands, so they don't
+// need to be allowed to write at all. Given their own read-only credentials,
+// a compromised replica can't corrupt the database either.
+
+var errReadOnlyReplica = errors.New("You can't write against a read only replica.")
+
+// How a replica's credentials for object storage were checked at startup (see
+// Config.ReplicaS3User).
+const (
+	credentialsShared   = "shared" // not separate, so not checked
+	credentialsReadOnly = "read-only"
+	credentialsWritable = "writable"
+)
+
+// A replica holds a read replica's copy of the database.
+type replica struct {
+	store   *storage
+	logger  *slog.Logger
+	refresh time.Duration
+	// credentials is how the replica's credentials were checked.
+	credentials string
+
+	mu sync.RWMutex
+	db *database // nil until the first refresh succeeds
+	at time.Time // when db was read
+}
+
+// run refreshes the copy until the context is canceled. Failed refreshes
+// leave the previous copy in place, since stale reads are better than none.
+func (r *replica) run(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		if err := r.load(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Warn("refresh replica failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *replica) load(ctx context.Context) error {
+	at := time.Now()
+	db, err := r.store.withContext(ctx).GetDB()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.db, r.at = db, at
+	r.mu.Unlock()
+	return nil
+}
+
+// copy returns the current copy of the database and when it was read, or nil
+// if there isn't one yet. Callers mustn't modify it.
+func (r *replica) copy() (*database, time.Time) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.db, r.at
+}
+
+// replicable reports whether a replica may run a command. Writes that go
+// through the connection's keyspace are refused by replicaView. Commands that
+// write object storage directly, like LOAD, BGSAVE, INVALIDATE, ACL SETUSER,
+// and FUNCTION LOAD, are refused up front, and so is SCRIPT FLUSH, which
+// changes what the node's clients can run.
+func replicable(name op.Op, args []string) bool {
+	var sub string
+	if len(args) > 0 {
+		sub = strings.ToLower(args[0])
+	}
+	switch name {
+	case op.Load, op.BgSave, op.Invalidate:
+		return false
+	case op.ACL:
+		return sub != "setuser" && sub != "deluser"
+	case op.Script:
+		return sub != "flush"
+	case op.Function:
+		return sub != "load" && sub != "delete" && sub != "flush" && sub != "restore"
+	}
+	return true
+}
+
+// A replicaView is the keyspace seen by connections to a replica. Writes
+// fail, and if stale is set, reads come from the replica's copy of the
+// database, when it has one.
+type replicaView struct {
+	kv    keyspace
+	r     *replica
+	stale bool
+}
+
+// cached returns the replica's copy of the named keys (or every key, if keys
+// is nil), with expired keys removed, or nil if reads should go to object
+// storage.
+func (v replicaView) cached(keys []string) *database {
+	if !v.stale {
+		return nil
+	}
+	db, _ := v.r.copy()
+	if db == nil {
+		return nil
+	}
+	if keys == nil {
+		db = db.clone()
+	} else {
+		db = db.subset(keys)
+	}
+	db.expired = db.expire(v.r.store.now())
+	return db
+}
+
+func (v replicaView) GetKey(key string) (*database, error) {
+	if db := v.cached([]string{key}); db != nil {
+		return db, nil
+	}
+	return v.kv.GetKey(key)
+}
+
+func (v replicaView) GetKeys(keys []string) (*database, error) {
+	if db := v.cached(keys); db != nil {
+		return db, nil
+	}
+	return v.kv.GetKeys(keys)
+}
+
+func (v replicaView) GetDB() (*database, error) {
+	if db := v.cached(nil); db != nil {
+		return db, nil
+	}
+	return v.kv.GetDB()
+}
+
+func (v replicaView) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	return 0, errReadOnlyReplica
+}
+
+func (v replicaView) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	return 0, errReadOnlyReplica
+}
+
+func (v replicaView) MutateDB(f func(*database) (int, error)) (int, error) {
+	return 0, errReadOnlyReplica
+}
+
+// subset returns a deep copy of the named keys' part of the database. Only
+// the keys' values and bookkeeping are copied, so it's much cheaper than
+// clone for large databases.
+func (db *database) subset(keys []string) *database {
+	c := newDatabase()
+	c.Format = db.Format
+	c.Generation = db.Generation
+	c.Deleted = db.Deleted
+	c.Shards = db.Shards
+	for _, key := range keys {
+		if val, ok := db.Items[key]; ok {
+			c.Items[key] = val
+		}
+		if hash, ok := db.Hashes[key]; ok {
+			c.Hashes[key] = maps.Clone(hash)
+		}
+		if list, ok := db.Lists[key]; ok {
+			c.Lists[key] = slices.Clone(list)
+		}
+		if members, ok := db.Sets[key]; ok {
+			c.Sets[key] = members.Clone()
+		}
+		// Sorted sets are never modified in place, so they can be shared.
+		if zs, ok := db.ZSets[key]; ok {
+			c.ZSets[key] = zs
+		}
+		if l, ok := db.Leases[key]; ok {
+			c.Leases[key] = l
+		}
+		if at, ok := db.Expires[key]; ok {
+			c.Expires[key] = at
+		}
+		if version, ok := db.Versions[key]; ok {
+			c.Versions[key] = version
+		}
+	}
+	return c
+}
+
+// staleHint ends a read command that accepts a stale read.
+const staleHint = "!stale-ok"
+
+// staleHinted strips a trailing stale hint from a read command's arguments,
+// reporting whether there was one. A command that takes no other arguments
+// can't be hinted, so GET !stale-ok reads the key named !stale-ok; but in
+// MGET and EXISTS, a last key named !stale-ok is always taken as the hint.
+// In a transaction, the hint is ignored, since queued commands read as the
+// connection does when it runs EXEC.
+func staleHinted(name op.Op, args []string) ([]string, bool) {
+	if len(args) < 2 || args[len(args)-1] != staleHint {
+		return args, false
+	}
+	switch name {
+	case op.Get, op.MGet, op.VGet, op.Type, op.Exists, op.Strlen, op.GetRange,
+		op.HGet, op.HGetAll, op.HExists, op.HLen,
+		op.LLen, op.LRange,
+		op.SMembers, op.SIsMember, op.SCard,
+		op.ZScore, op.ZCard, op.ZRange:
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// readonly handles READONLY, which lets the connection read stale data from
+// a replica's copy of the database. Other nodes accept it, but their reads
+// stay fresh.
+func (s *Server) readonly(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.ReadOnly)
+		return
+	}
+	stateOf(conn).stale = true
+	conn.WriteString("OK")
+}
+
+// readwrite handles READWRITE, which undoes READONLY.
+func (s *Server) readwrite(conn redcon.Conn, args []string) {
+	if len(args) != 0 {
+		writeErrArity(conn, op.ReadWrite)
+		return
+	}
+	stateOf(conn).stale = false
+	conn.WriteString("OK")
+}
+
+func (s *Server) infoReplication() [][2]string {
+	if s.replica == nil {
+		return [][2]string{{"role", "master"}}
+	}
+	// Valkey calls replicas slaves in INFO, and monitoring tools expect it.
+	fields := [][2]string{{"role", "slave"}}
+	age := int64(-1)
+	var generation uint64
+	if db, at := s.replica.copy(); db != nil {
+		age = time.Since(at).Milliseconds()
+		generation = db.Generation
+	}
+	return append(fields,
+		[2]string{"replica_refresh_ms", fmt.Sprint(s.replica.refresh.Milliseconds())},
+		[2]string{"replica_copy_age_ms", fmt.Sprint(age)},
+		[2]string{"replica_copy_generation", fmt.Sprint(generation)},
+		[2]string{"replica_credentials", s.replica.credentials},
+	)
+}
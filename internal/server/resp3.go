@@ -0,0 +1,151 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// resp3Conn encodes replies using RESP3. redcon only speaks RESP2, so we
+// override the writers whose encoding differs.
+type resp3Conn struct {
+	redcon.Conn
+}
+
+func (c resp3Conn) WriteNull() {
+	c.WriteRaw([]byte("_\r\n"))
+}
+
+// withProtocol wraps conn so that replies use the protocol it negotiated.
+func withProtocol(conn redcon.Conn) redcon.Conn {
+	if c, ok := conn.(resp3Conn); ok {
+		conn = c.Conn
+	}
+	if stateOf(conn).protocol == 3 {
+		return resp3Conn{conn}
+	}
+	return conn
+}
+
+// writeMap starts a reply of n key-value pairs. In RESP2, maps are flat
+// arrays of alternating keys and values.
+func writeMap(conn redcon.Conn, n int) {
+	if _, ok := conn.(resp3Conn); ok {
+		conn.WriteRaw([]byte("%" + strconv.Itoa(n) + "\r\n"))
+		return
+	}
+	conn.WriteArray(2 * n)
+}
+
+// writeDouble writes a floating-point number. RESP2 has no type for them, so
+// they're written as bulk strings.
+func writeDouble(conn redcon.Conn, f float64) {
+	if _, ok := conn.(resp3Conn); ok {
+		conn.WriteRaw([]byte("," + formatScore(f) + "\r\n"))
+		return
+	}
+	conn.WriteBulkString(formatScore(f))
+}
+
+// writeSet starts a reply of n unordered elements. In RESP2, sets are arrays.
+func writeSet(conn redcon.Conn, n int) {
+	if _, ok := conn.(resp3Conn); ok {
+		conn.WriteRaw([]byte("~" + strconv.Itoa(n) + "\r\n"))
+		return
+	}
+	conn.WriteArray(n)
+}
+
+// hello handles HELLO [protover [AUTH username password] [SETNAME name]],
+// which switches the connection's protocol and replies with a description of
+// the server. Clients use it to authenticate, name the connection, and pick
+// a protocol in a single round trip, so it's all or nothing: if any part
+// fails, the connection is left as it was. Connections that never send HELLO
+// speak RESP2.
+func (s *Server) hello(conn redcon.Conn, args []string) {
+	st := stateOf(conn)
+	protocol := st.protocol
+	var (
+		name   *string
+		authed = st.authed
+		user   = st.user
+	)
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		if v != 2 && v != 3 {
+			conn.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		protocol = v
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "auth":
+				if i+2 >= len(args) {
+					writeErr(conn, errSyntax)
+					return
+				}
+				if !s.authenticate(args[i+1], args[i+2]) {
+					conn.WriteError(errWrongPass)
+					return
+				}
+				authed = true
+				user = args[i+1]
+				i += 2
+			case "setname":
+				if i+1 >= len(args) {
+					writeErr(conn, errSyntax)
+					return
+				}
+				if !validClientName(args[i+1]) {
+					writeErr(conn, errClientName)
+					return
+				}
+				name = &args[i+1]
+				i++
+			default:
+				writeErr(conn, errSyntax)
+				return
+			}
+		}
+	}
+	if !authed {
+		conn.WriteError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	st.authed = true
+	st.user = user
+	st.protocol = protocol
+	if name != nil {
+		st.name = *name
+	}
+
+	conn = withProtocol(conn)
+	writeMap(conn, 7)
+	conn.WriteBulkString("server")
+	conn.WriteBulkString("valthree")
+	conn.WriteBulkString("version")
+	conn.WriteBulkString(version)
+	conn.WriteBulkString("proto")
+	conn.WriteInt(st.protocol)
+	conn.WriteBulkString("id")
+	conn.WriteInt64(st.id)
+	conn.WriteBulkString("mode")
+	conn.WriteBulkString("standalone")
+	conn.WriteBulkString("role")
+	if s.replica != nil {
+		conn.WriteBulkString("replica")
+	} else {
+		conn.WriteBulkString("master")
+	}
+	conn.WriteBulkString("modules")
+	conn.WriteArray(0)
+}
+
+// version is reported by HELLO. Valthree implements a subset of Valkey 7, so
+// clients that check the version should enable Valkey 7 behavior.
+const version = "7.2.0"
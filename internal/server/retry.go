@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrTooMuchContention means a write collided with concurrent writes every
+// time it was retried, until it ran out of attempts (see
+// Config.WriteMaxAttempts). It wasn't applied. It wraps ErrContention, so
+// clients see TRYAGAIN.
+var ErrTooMuchContention = fmt.Errorf("%w: too many retries", ErrContention)
+
+// A retryPolicy decides how shards retry batches of writes whose conditional
+// PUTs lost a race with another node. Without backoff, nodes writing the same
+// shard retry in lockstep and keep colliding, so each retry waits a random
+// delay up to an exponentially growing limit ("full jitter").
+type retryPolicy struct {
+	// maxAttempts is the number of PUTs each batch may attempt. Zero is
+	// unlimited.
+	maxAttempts int
+	// baseDelay is the limit on the delay before the first retry, which
+	// doubles with each further retry. Zero retries immediately.
+	baseDelay time.Duration
+	// maxDelay caps the limit on the delay. Zero leaves it uncapped.
+	maxDelay time.Duration
+}
+
+// exhausted reports whether a batch that has made attempts PUTs may not
+// make another.
+func (p retryPolicy) exhausted(attempts int) bool {
+	return p.maxAttempts > 0 && attempts >= p.maxAttempts
+}
+
+// delay returns how long to wait before retrying a batch that has made
+// attempts PUTs.
+func (p retryPolicy) delay(attempts int) time.Duration {
+	if p.baseDelay <= 0 || attempts <= 0 {
+		return 0
+	}
+	shift := min(attempts-1, 30)
+	limit := p.baseDelay << shift
+	if limit>>shift != p.baseDelay {
+		limit = math.MaxInt64 // overflowed
+	}
+	if p.maxDelay > 0 {
+		limit = min(limit, p.maxDelay)
+	}
+	return rand.N(limit)
+}
+
+// backoff waits before retrying a batch that has made attempts PUTs. It
+// returns the context's error if the context is canceled first.
+func (p retryPolicy) backoff(ctx context.Context, attempts int) error {
+	d := p.delay(attempts)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"hash/fnv"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+const defaultScanCount = 10
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// keys handles KEYS pattern, which replies with every key matching the
+// glob-style pattern. Like Valkey's, it's meant for debugging: it reads the
+// whole database and replies with one array, so applications should use SCAN.
+func (s *Server) keys(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Keys)
+		return
+	}
+	db, err := s.kv.GetDB()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	var keys []string
+	for key := range db.keys() {
+		if globMatch(args[0], key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+// rangeCmd handles RANGE start end [LIMIT count], which replies with the
+// string keys from start (inclusive) to end (exclusive), and their values,
+// as a flat array of pairs in lexicographic order of the keys. An empty end
+// is unbounded, so RANGE user:123: user:123; returns every key with the
+// prefix user:123:. Keys holding other types are skipped, as in MGET. To
+// page through a range, start the next call just after the last key
+// returned, by appending a zero byte to it. Unlike KEYS, which only names
+// keys, RANGE replies with values, so it skips keys the connection's user
+// can't access.
+//
+// Like KEYS, RANGE reads the whole database, but it replies in one round
+// trip, and it only sorts the keys in the range.
+func (s *Server) rangeCmd(conn redcon.Conn, args []string) {
+	if len(args) != 2 && len(args) != 4 {
+		writeErrArity(conn, op.Range)
+		return
+	}
+	start, end := args[0], args[1]
+	limit := -1
+	if len(args) == 4 {
+		if !strings.EqualFold(args[2], "limit") {
+			writeErr(conn, errSyntax)
+			return
+		}
+		n, err := strconv.Atoi(args[3])
+		if err != nil || n < 0 {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		limit = n
+	}
+	accessible, err := s.accessible(stateOf(conn).user)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	db, err := s.kv.GetDB()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	var keys []string
+	for key := range db.Items {
+		if key >= start && (end == "" || key < end) && accessible(key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if limit >= 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	conn.WriteArray(2 * len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+		conn.WriteBulkString(db.Items[key])
+	}
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT n]. It replies with the
+// cursor for the next call, which is 0 after the last page, and an array of
+// keys. As in Valkey, MATCH filters each page after it's chosen, so pages may
+// be short or even empty before the scan is complete.
+func (s *Server) scan(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Scan)
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		writeErr(conn, errInvalidCursor)
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			writeErr(conn, errSyntax)
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				writeErr(conn, errNotAnInteger)
+				return
+			}
+			if n < 1 {
+				writeErr(conn, errSyntax)
+				return
+			}
+			count = n
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+
+	db, err := s.kv.GetDB()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	page, next := scanPage(db.keys(), cursor, count)
+	page = slices.DeleteFunc(page, func(key string) bool {
+		return !globMatch(pattern, key)
+	})
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(next, 10))
+	conn.WriteArray(len(page))
+	for _, key := range page {
+		conn.WriteBulkString(key)
+	}
+}
+
+// scanHash positions a key in SCAN order.
+func scanHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// scanPage returns about count of the keys whose hashes are at least cursor, in hash
+// order, and the cursor for the next page, which is 0 when there are no more
+// keys. Keys with the same hash are never split across pages, so a page may
+// hold a few more than count keys.
+//
+// Valkey's cursors are positions in its hash table, which clients expect to
+// be integers. Ordering keys by a hash of their names gives us integer
+// cursors with the same stability as scanKeys: every key that exists for the
+// whole scan is returned exactly once, however the database changes between
+// pages.
+func scanPage(keys iter.Seq[string], cursor uint64, count int) ([]string, uint64) {
+	type entry struct {
+		hash uint64
+		key  string
+	}
+	var entries []entry
+	for key := range keys {
+		if h := scanHash(key); h >= cursor {
+			entries = append(entries, entry{h, key})
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		if c := cmp.Compare(a.hash, b.hash); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	n := min(count, len(entries))
+	for n < len(entries) && entries[n].hash == entries[n-1].hash {
+		n++
+	}
+	page := make([]string, n)
+	for i, e := range entries[:n] {
+		page[i] = e.key
+	}
+	if n == len(entries) {
+		return page, 0
+	}
+	return page, entries[n-1].hash + 1
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts run like transactions: EVAL runs the script inside a single
+// mutation of the shard holding its keys, and every command it calls with
+// redis.call sees and changes the database being built by that mutation, so
+// the whole script is applied with one conditional PUT. If another node's
+// write gets there first, the script runs again against the new database, so
+// scripts must only depend on the database and their arguments. Unlike
+// Valkey, a script that fails writes nothing, even if it called commands
+// that wrote before failing.
+//
+// Like a transaction, a script may only use keys in one shard, and a script
+// without keys runs against the first shard. The scripts cache is kept in
+// memory, so each node has its own, as in Valkey.
+
+// scriptTimeout bounds how long a script may run. The shard can't be written
+// while a script runs, so scripts that run too long are stopped, like
+// Valkey's busy scripts.
+const scriptTimeout = 5 * time.Second
+
+var (
+	errNoScript      = errors.New("No matching script. Please use EVAL.")
+	errNegativeKeys  = errors.New("Number of keys can't be negative")
+	errTooManyKeys   = errors.New("Number of keys can't be greater than number of args")
+	errScriptTimeout = fmt.Errorf("%w: script ran for more than %v", ErrTimeout, scriptTimeout)
+	errScriptCommand = errors.New("This command is not allowed from script")
+	errScriptWrite   = errors.New("Write commands are not allowed from read-only scripts")
+)
+
+// A scriptCache holds the scripts that EVALSHA can run, by SHA1 digest.
+type scriptCache struct {
+	mu      sync.Mutex
+	scripts map[string]string
+}
+
+// add caches a script and returns its digest.
+func (c *scriptCache) add(src string) string {
+	sum := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(sum[:])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.scripts == nil {
+		c.scripts = make(map[string]string)
+	}
+	c.scripts[sha] = src
+	return sha
+}
+
+func (c *scriptCache) get(sha string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, ok := c.scripts[strings.ToLower(sha)]
+	return src, ok
+}
+
+func (c *scriptCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scripts = nil
+}
+
+// A scriptError is an error reply raised by a script, with its code.
+type scriptError struct {
+	msg string
+}
+
+func (e *scriptError) Error() string { return e.msg }
+
+// eval handles EVAL script numkeys [key ...] [arg ...] and EVALSHA sha1
+// numkeys [key ...] [arg ...].
+func (s *Server) eval(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, name)
+		return
+	}
+	src := args[0]
+	if name == op.EvalSha {
+		var ok bool
+		if src, ok = s.scripts.get(args[0]); !ok {
+			writeErr(conn, errNoScript)
+			return
+		}
+	} else {
+		s.scripts.add(src)
+	}
+	keys, argv, err := scriptArgs(args[1:])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	s.runAtomically(conn, keys, false, func(srv *Server) (lua.LValue, error) {
+		L, done := newLuaState()
+		defer done()
+		L.SetGlobal("KEYS", stringTable(L, keys))
+		L.SetGlobal("ARGV", stringTable(L, argv))
+		L.SetGlobal("redis", srv.redisTable(L, conn))
+		fn, err := L.LoadString(src)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling script: %v", err)
+		}
+		L.Push(fn)
+		return callLua(L, 0)
+	})
+}
+
+// scriptArgs splits numkeys [key ...] [arg ...] into keys and arguments.
+func scriptArgs(args []string) (keys, argv []string, err error) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, errNotAnInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, errNegativeKeys
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, errTooManyKeys
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// runAtomically calls run, which runs a script, inside a single mutation of
+// the shard holding keys, and replies with the value the script returned.
+// The server passed to run uses the mutation's database. If readOnly is set,
+// a script that writes fails.
+func (s *Server) runAtomically(conn redcon.Conn, keys []string, readOnly bool, run func(*Server) (lua.LValue, error)) {
+	if _, err := s.store.shardForAll(keys); err != nil {
+		writeErr(conn, err)
+		return
+	}
+
+	var reply lua.LValue
+	_, err := s.kv.MutateKeys(keys, func(db *database) (int, error) {
+		sh, err := s.store.shardForAll(keys)
+		if err != nil {
+			return 0, err
+		}
+		t := &txn{store: s.store, shard: sh, db: db}
+		reply, err = run(s.withKeyspace(t))
+		switch {
+		case err != nil:
+			return 0, err
+		case t.wrote && readOnly:
+			return 0, errScriptWrite
+		case !t.wrote:
+			return 0, errNotApplied
+		}
+		return 0, nil
+	})
+	var scriptErr *scriptError
+	switch {
+	case errors.As(err, &scriptErr):
+		conn.WriteError(scriptErr.msg)
+	case err != nil && !errors.Is(err, errNotApplied):
+		writeErr(conn, err)
+	default:
+		writeLua(conn, reply)
+	}
+}
+
+// newLuaState returns an interpreter for running a script, which stops the
+// script once scriptTimeout passes. Scripts get no access to files or the
+// rest of the system. The caller must call the returned function when it's
+// done with the interpreter.
+func newLuaState() (*lua.LState, func()) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	L.SetContext(ctx)
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	return L, func() {
+		L.Close()
+		cancel()
+	}
+}
+
+// redisTable returns the redis library, whose commands use s's keyspace and
+// run as conn's user.
+func (s *Server) redisTable(L *lua.LState, conn redcon.Conn) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return s.scriptCall(L, conn, false) },
+		"pcall": func(L *lua.LState) int { return s.scriptCall(L, conn, true) },
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			sum := sha1.Sum([]byte(L.CheckString(1)))
+			L.Push(lua.LString(hex.EncodeToString(sum[:])))
+			return 1
+		},
+	})
+}
+
+// callLua calls the function on the stack below its nargs arguments, and
+// returns the value it returned. An error table raised by the script, as by
+// redis.call, becomes a scriptError.
+func callLua(L *lua.LState, nargs int) (lua.LValue, error) {
+	if err := L.PCall(nargs, 1, nil); err != nil {
+		if L.Context().Err() != nil {
+			return nil, errScriptTimeout
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return nil, &scriptError{msg: string(msg)}
+				}
+			}
+			return nil, fmt.Errorf("error running script: %s", apiErr.Object)
+		}
+		return nil, fmt.Errorf("error running script: %v", err)
+	}
+	return L.Get(-1), nil
+}
+
+// scriptCall runs a command called by a script with redis.call or, if
+// protect is set, redis.pcall. An error reply raises a Lua error from
+// redis.call, and is returned as a table with an err field by redis.pcall.
+func (s *Server) scriptCall(L *lua.LState, conn redcon.Conn, protect bool) int {
+	if L.GetTop() == 0 {
+		L.RaiseError("Please specify at least one argument for this call")
+	}
+	args := make([]string, L.GetTop())
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString, lua.LNumber:
+			args[i] = v.String()
+		default:
+			L.RaiseError("Command arguments must be strings or integers")
+		}
+	}
+	name, args := op.New([]byte(args[0])), args[1:]
+	c := &scriptConn{Conn: conn, L: L}
+	if !queueable(name) {
+		writeErr(c, errScriptCommand)
+	} else if s.checkKeys(c, name, args) {
+		s.dispatch(c, name, args)
+	}
+	if t, ok := c.value.(*lua.LTable); ok && !protect && t.RawGetString("err") != lua.LNil {
+		L.Error(t, 1)
+	}
+	L.Push(c.value)
+	return 1
+}
+
+// script handles the SCRIPT subcommands: LOAD script, EXISTS sha1 [sha1
+// ...], and FLUSH [ASYNC|SYNC].
+func (s *Server) script(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.Script)
+		return
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "load" && len(args) == 1:
+		conn.WriteBulkString(s.scripts.add(args[0]))
+	case sub == "exists" && len(args) > 0:
+		conn.WriteArray(len(args))
+		for _, sha := range args {
+			if _, ok := s.scripts.get(sha); ok {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	case sub == "flush" && len(args) <= 1:
+		if len(args) == 1 && !strings.EqualFold(args[0], "async") && !strings.EqualFold(args[0], "sync") {
+			writeErr(conn, errSyntax)
+			return
+		}
+		s.scripts.flush()
+		conn.WriteString("OK")
+	case sub == "load" || sub == "exists" || sub == "flush":
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for 'script|%s' command", sub))
+	default:
+		writeErr(conn, fmt.Errorf("unknown SCRIPT subcommand '%s'", sub))
+	}
+}
+
+// stringTable returns a Lua array of strings.
+func stringTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// replyTable returns a table with a single field, which is how scripts
+// represent status and error replies.
+func replyTable(L *lua.LState, field, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	return t
+}
+
+// writeLua replies with a value returned by a script, converted as in
+// Valkey: numbers become integers (truncated), tables become arrays (up to
+// the first nil), and false becomes null.
+func writeLua(conn redcon.Conn, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		conn.WriteInt64(int64(v))
+	case lua.LString:
+		conn.WriteBulkString(string(v))
+	case lua.LBool:
+		if v {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteNull()
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			conn.WriteString(string(msg))
+			return
+		}
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			conn.WriteError(string(msg))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		conn.WriteArray(n)
+		for i := 1; i <= n; i++ {
+			writeLua(conn, v.RawGetInt(i))
+		}
+	default:
+		conn.WriteNull()
+	}
+}
+
+// scriptConn collects the reply to a command called by a script as a Lua
+// value, converted as in Valkey: status and error replies become tables
+// with an ok or err field, and nulls become false.
+type scriptConn struct {
+	redcon.Conn
+	L     *lua.LState
+	value lua.LValue
+	// arrays are the arrays being filled, innermost last.
+	arrays []*scriptArray
+}
+
+type scriptArray struct {
+	t    *lua.LTable
+	left int
+}
+
+// put adds a value to the reply.
+func (c *scriptConn) put(v lua.LValue) {
+	for len(c.arrays) > 0 {
+		a := c.arrays[len(c.arrays)-1]
+		a.t.Append(v)
+		if a.left--; a.left > 0 {
+			return
+		}
+		c.arrays = c.arrays[:len(c.arrays)-1]
+		v = a.t
+	}
+	c.value = v
+}
+
+func (c *scriptConn) WriteError(msg string)       { c.put(replyTable(c.L, "err", msg)) }
+func (c *scriptConn) WriteString(str string)      { c.put(replyTable(c.L, "ok", str)) }
+func (c *scriptConn) WriteBulk(bulk []byte)       { c.put(lua.LString(bulk)) }
+func (c *scriptConn) WriteBulkString(bulk string) { c.put(lua.LString(bulk)) }
+func (c *scriptConn) WriteInt(num int)            { c.put(lua.LNumber(num)) }
+func (c *scriptConn) WriteInt64(num int64)        { c.put(lua.LNumber(num)) }
+func (c *scriptConn) WriteUint64(num uint64)      { c.put(lua.LNumber(num)) }
+func (c *scriptConn) WriteNull()                  { c.put(lua.LFalse) }
+func (c *scriptConn) WriteAny(v any)              { c.put(lua.LString(fmt.Sprint(v))) }
+func (c *scriptConn) WriteRaw(data []byte)        { c.WriteError("ERR reply can't be converted for scripts") }
+
+func (c *scriptConn) WriteArray(count int) {
+	switch {
+	case count < 0:
+		c.put(lua.LFalse)
+	case count == 0:
+		c.put(c.L.NewTable())
+	default:
+		c.arrays = append(c.arrays, &scriptArray{t: c.L.CreateTable(count, 0), left: count})
+	}
+}
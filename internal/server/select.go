@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// Like Valkey, a server may have several logical databases, numbered from
+// zero, and each connection works in one of them, database 0 until it sends
+// SELECT. Each logical database is stored in its own objects: database 0
+// under DatabaseName, exactly as before logical databases existed, and
+// database N under DatabaseName/dbN, sharded and logged the same way. Since
+// they're separate objects, writes to different databases never contend.
+//
+// FLUSHDB empties the selected database and FLUSHALL empties them all.
+// Transactions may SELECT, but they're written to a single shard, so every
+// command in one must use the same database; FLUSHALL in a transaction
+// empties the others once it's written. Backups include every database, and
+// hooks report them all. Everything else that isn't a command on the
+// connection's keys, like LOAD, replica copies, and memcached, works on
+// database 0.
+
+var (
+	errDBIndex       = errors.New("DB index is out of range")
+	errClusterSelect = errors.New("SELECT is not allowed in cluster mode")
+)
+
+// logicalName returns the name of the objects that hold logical database n.
+func logicalName(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s/db%d", name, n)
+}
+
+// newDatabases returns the storage of each of the configured logical
+// databases, starting with store, which is database 0. They share store's
+// client and what Probe found out about object storage.
+func newDatabases(store *storage, cfg Config, stats *stats) []*storage {
+	dbs := []*storage{store}
+	for n := 1; n < cfg.Databases; n++ {
+		c := cfg
+		c.DatabaseName = logicalName(cfg.DatabaseName, n)
+		db := newStorage(store.client, c, stats)
+		db.unsafe, db.emulate = store.unsafe, store.emulate
+		dbs = append(dbs, db)
+	}
+	return dbs
+}
+
+// openDatabase is like openStorage, but it returns logical database n.
+func openDatabase(cfg Config, n int) (*storage, error) {
+	if n < 0 || n >= max(cfg.Databases, 1) {
+		return nil, errDBIndex
+	}
+	cfg.DatabaseName = logicalName(cfg.DatabaseName, n)
+	return openStorage(cfg), nil
+}
+
+// openDatabases is like openStorage, but it returns every logical database.
+func openDatabases(cfg Config) []*storage {
+	store := openStorage(cfg)
+	return newDatabases(store, cfg, store.stats)
+}
+
+// selectDB handles SELECT index, which switches the connection to another
+// logical database.
+func (s *Server) selectDB(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Select)
+		return
+	}
+	n, err := s.selectable(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	// In a transaction, EXEC switches databases once every command has run.
+	if !s.inTxn() {
+		stateOf(conn).db = n
+	}
+	conn.WriteString("OK")
+}
+
+// selectable returns the logical database that SELECT index switches to.
+func (s *Server) selectable(index string) (int, error) {
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		return 0, errNotAnInteger
+	}
+	if n < 0 || n >= len(s.dbs) {
+		return 0, errDBIndex
+	}
+	if n != 0 && s.topology != nil {
+		return 0, errClusterSelect
+	}
+	return n, nil
+}
@@ -2,13 +2,22 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/antithesishq/valthree/internal/cron"
 	"github.com/antithesishq/valthree/internal/op"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
@@ -21,6 +30,171 @@ type Config struct {
 	DatabaseName string
 	MaxItems     int
 
+	// NodeName identifies this server in operator-facing output, like the admin
+	// dashboard. It defaults to the host name.
+	NodeName string
+	// SlowThreshold is the minimum duration of a command recorded in the slow
+	// operation log. Zero disables the log.
+	SlowThreshold time.Duration
+	// AdminPeers are the admin dashboard addresses of the other nodes in the
+	// cluster, used to show cluster-wide status. They default to the admin
+	// addresses in the Topology.
+	AdminPeers []string
+	// Topology, if set, describes every node in the cluster and the hash
+	// slots each owns, which CLUSTER reports to cluster-aware clients. It
+	// must include a node whose ID is NodeName.
+	Topology *Topology
+	// Quotas limit the number of keys and bytes stored under particular key
+	// prefixes, so that tenants sharing a database can't starve each other.
+	Quotas []Quota
+	// MaxKeyLength limits the length of keys, in bytes. Zero is unlimited.
+	MaxKeyLength int
+	// KeyCharset restricts the characters allowed in keys. The zero value
+	// allows any bytes.
+	KeyCharset KeyCharset
+	// Password, if set, must be supplied with AUTH (or HELLO's AUTH option)
+	// before a connection may run other commands.
+	Password string
+
+	// MaxClients limits the number of open connections. Once it's reached,
+	// new connections are refused with an error, as in Valkey. Zero is
+	// unlimited.
+	MaxClients int
+	// MaxCommandRate limits each connection to this many commands per
+	// second, on average; commands over the limit fail without running.
+	// Zero is unlimited.
+	MaxCommandRate float64
+	// MaxOutputBuffer limits the bytes of replies waiting to be sent to each
+	// connection. Connections that exceed it are closed, as with Valkey's
+	// client-output-buffer-limit. Zero is unlimited.
+	MaxOutputBuffer int
+	// CommandTimeouts bound how long each class of RESP command may run
+	// before it fails with ErrTimeout and its calls to object storage are
+	// abandoned.
+	CommandTimeouts CommandTimeouts
+	// EnableDebugCommands allows DEBUG, whose subcommands reload or rewrite
+	// the database, stall connections, and expose the node's internals (see
+	// debug.go). They're meant for tests and local debugging.
+	EnableDebugCommands bool
+
+	// Replica makes the node a read replica, which refuses writes and runs
+	// no background tasks that write. Connections that send READONLY read
+	// from a copy of the database that it refreshes every ReplicaRefresh, so
+	// their reads may be stale (see replica.go). A zero ReplicaRefresh keeps
+	// no copy, so every read goes to object storage.
+	Replica        bool
+	ReplicaRefresh time.Duration
+	// ReplicaS3User and ReplicaS3Password, if set, are the credentials a
+	// replica uses in place of S3User and S3Password. They should only allow
+	// reads, so that a compromised replica can't write the database; the
+	// replica checks at startup that they do, and reports it in INFO.
+	ReplicaS3User     string
+	ReplicaS3Password string
+
+	// Shards is the number of objects the database is split across. Values
+	// less than two store the database as a single object. In a sharded
+	// database, MaxItems is divided evenly between the shards, and quotas
+	// aren't supported. Changing the number of shards after the database is
+	// sharded isn't supported either.
+	Shards int
+	// AutoShards, if at least two, lets an unsharded database be promoted
+	// to that many shards while it's in use (see promote.go). Every
+	// AutoShardInterval, each node that writes checks whether the database
+	// object has grown to AutoShardBytes, or whether at least
+	// AutoShardConflictRate of its writes since the last check conflicted,
+	// and if so, promotes it. A zero threshold is never crossed, and a zero
+	// interval never checks, though the node still follows a promotion made
+	// by another node. Every node must use the same AutoShards. With a
+	// write-ahead log, the object is the snapshot as of the last
+	// compaction.
+	AutoShards            int
+	AutoShardBytes        int
+	AutoShardConflictRate float64
+	AutoShardInterval     time.Duration
+
+	// Databases is the number of logical databases connections can switch
+	// between with SELECT, each stored in its own objects (see select.go).
+	// Values less than two leave only database 0.
+	Databases int
+
+	// EmulateConditionalWrites lets the server run against object storage
+	// that ignores If-Match and If-None-Match, by emulating them with lock
+	// objects. The emulation is much weaker than real conditional writes and
+	// may lose writes. It's only used if object storage fails the startup
+	// probe.
+	EmulateConditionalWrites bool
+
+	// ExpireSweepInterval controls how often the server removes expired keys
+	// from object storage. Zero disables the sweeper, so expired keys are
+	// only removed by the next write.
+	ExpireSweepInterval time.Duration
+
+	// WriteBatchInterval delays each write by up to this long, so that more
+	// concurrent writes to the same shard can share a single PUT. Even when
+	// it's zero, writes that queue behind an in-flight PUT share the next one.
+	WriteBatchInterval time.Duration
+	// WriteMaxAttempts limits the conditional PUTs a batch of writes makes
+	// when it keeps losing races with other nodes; the writes then fail with
+	// ErrTooMuchContention. Zero retries forever. WriteRetryBaseDelay and
+	// WriteRetryMaxDelay bound the random, exponentially growing delay
+	// before each retry. A zero base delay retries immediately; a zero
+	// maximum leaves the delay uncapped.
+	WriteMaxAttempts    int
+	WriteRetryBaseDelay time.Duration
+	WriteRetryMaxDelay  time.Duration
+
+	// WriteAheadLog makes shards record writes in a log of small objects,
+	// rather than rewriting the whole shard for every write (see wal.go).
+	// Once a shard switches to the log, every server uses it, regardless of
+	// this setting.
+	WriteAheadLog bool
+	// CompactInterval controls how often the server checks whether shards'
+	// logs need compacting into new snapshots. Zero disables background
+	// compaction.
+	CompactInterval time.Duration
+	// CompactMinEntries is the number of log entries a shard needs before
+	// background compaction rewrites its snapshot.
+	CompactMinEntries int
+	// CompactMaxEntries bounds the length of shards' logs if background
+	// compaction falls behind: the write that reaches it compacts the log
+	// before replying. Zero leaves the logs unbounded.
+	CompactMaxEntries int
+
+	// PubSubPollInterval controls how often nodes with subscribers check
+	// object storage for messages published on other nodes. Zero disables
+	// relaying, so messages only reach subscribers on the node they were
+	// published to.
+	PubSubPollInterval time.Duration
+	// NotifyKeyspaceEvents is the initial notify-keyspace-events setting,
+	// which CONFIG SET can change on each node. Empty disables keyspace
+	// notifications.
+	NotifyKeyspaceEvents string
+	// Hooks are called when this server changes the database, so that
+	// applications embedding it can follow changes without polling.
+	Hooks Hooks
+
+	// BackupSchedule is a cron-like expression (see package cron) controlling
+	// when the server snapshots the database. Empty disables scheduled
+	// backups, but BGSAVE still takes them on demand.
+	BackupSchedule string
+	// BackupPrefix is prepended to the names of snapshot objects.
+	BackupPrefix string
+	// BackupRetention is the number of snapshots to keep. Zero keeps all of
+	// them.
+	BackupRetention int
+
+	// ClockSkew offsets this server's clock, which decides when keys and
+	// lock leases expire, and StorageLatency delays every call it makes to
+	// object storage. They let tests simulate nodes whose clocks disagree
+	// and slow object storage without Antithesis; production servers should
+	// leave them zero.
+	ClockSkew      time.Duration
+	StorageLatency time.Duration
+	// StorageTransport, if set, carries every call to object storage in
+	// place of the network, so that tests can simulate object storage (see
+	// package simstore).
+	StorageTransport http.RoundTripper
+
 	S3Endpoint string
 	S3Region   string
 	S3Bucket   string
@@ -32,11 +206,64 @@ type Config struct {
 // Server is the Valthree server: a clustered, Valkey-compatible key-value
 // store backed by object storage.
 type Server struct {
-	maxItems int
-	store    storage
+	totalItems   int
+	maxKeyLength int
+	keyCharset   KeyCharset
+	password     string
+	maxClients   int
+	maxRate      float64
+	maxOutput    int
+	timeouts     CommandTimeouts
+	debugging    bool
+	nodeName     string
+	adminPeers   []string
+	topology     *Topology // nil unless running in cluster mode
+	store        *storage  // database 0, or the connection's database in commands
+	dbs          []*storage
+	kv           keyspace // store, except inside transactions
+	acl          *aclStore
+	stats        *stats
+	backups      *backups
+	relay        *relay
+	notifier     *notifier
+	clients      *clientRegistry
+	sessions     *sessionKey
+	snapshots    *snapshotCache
+	replica      *replica // nil unless the node is a read replica
+	scripts      *scriptCache
+	functions    *functionStore
+	nextConnID   *atomic.Int64
+	activeExpire *atomic.Bool // cleared by DEBUG SET-ACTIVE-EXPIRE 0
+
+	// ctx is the running command's context, canceled when it times out or the
+	// client disconnects. Like kvIn, it's only set while running a command.
+	ctx context.Context
+
+	// kvIn returns the connection's keyspace in each logical database, for
+	// commands like FLUSHALL that work on them all. It's only set while
+	// running a command; transactions ignore it (see inTxn).
+	kvIn func(db int) keyspace
+
+	stop     context.CancelFunc // stops background tasks
+	tasks    *sync.WaitGroup    // background tasks
+	commands *commands          // running commands, for Shutdown
+	serving  *serving           // frontends, for Close and Shutdown
+}
+
+// serving holds the frontends a server is serving and their listeners.
+type serving struct {
+	mu        sync.Mutex
+	frontends []frontend
+	listeners []*drainListener
+}
 
-	mu    sync.Mutex
-	close func() error
+// A frontend accepts connections speaking one wire protocol and translates
+// their requests into operations on the Server's storage. All frontends share
+// the same database, so a key written over one protocol is visible over all
+// the others.
+type frontend interface {
+	Serve(net.Listener) error
+	Close() error
 }
 
 // New constructs a Server.
@@ -45,27 +272,25 @@ type Server struct {
 // ready to use; under adversarial conditions, it will retry bucket creation
 // indefinitely.
 func New(cfg Config, logger *slog.Logger) *Server {
-	s3client := s3.New(s3.Options{
-		Region:                     cfg.S3Region,
-		BaseEndpoint:               aws.String(cfg.S3Endpoint),
-		DefaultsMode:               aws.DefaultsModeStandard,
-		Credentials:                credentials.NewStaticCredentialsProvider(cfg.S3User, cfg.S3Password, "" /* session */),
-		UsePathStyle:               true,
-		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenSupported,
-		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenSupported,
-		HTTPClient: &http.Client{
-			Transport: &http.Transport{},
-		},
-	})
-	store := storage{
-		timeout: cfg.S3Timeout,
-		bucket:  cfg.S3Bucket,
-		name:    cfg.DatabaseName,
-		client:  s3client,
+	nodeName := cfg.NodeName
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	adminPeers := cfg.AdminPeers
+	if len(adminPeers) == 0 && cfg.Topology != nil {
+		adminPeers = cfg.Topology.peerAdminAddrs(nodeName)
+	}
+	stats := newStats(cfg.SlowThreshold)
+	store := newStorage(newS3Client(cfg, stats), cfg, stats)
+	// Replicas may not be allowed to create the bucket, so they wait for it
+	// instead.
+	ready := store.EnsureBucketExists
+	if cfg.Replica {
+		ready = store.BucketExists
 	}
 	for {
 		logger := logger.With("bucket", cfg.S3Bucket)
-		if err := store.EnsureBucketExists(); err != nil {
+		if err := ready(); err != nil {
 			backoff := time.Second
 			logger.Error("bucket not ready", "err", err, "retry_after", backoff)
 			time.Sleep(backoff)
@@ -74,39 +299,286 @@ func New(cfg Config, logger *slog.Logger) *Server {
 		logger.Info("bucket ready")
 		break
 	}
+	var creds string // how the replica's credentials were checked
+	if cfg.Replica {
+		// Replicas never write, so conditional writes don't matter to
+		// them, and refusing writes in storage too means no bug can let
+		// one through.
+		store.unsafe = errReadOnlyReplica
+		creds = credentialsShared
+	}
+	for cfg.Replica && cfg.ReplicaS3User != "" {
+		writable, err := store.CanWrite()
+		if err != nil {
+			backoff := time.Second
+			logger.Error("check replica credentials failed", "err", err, "retry_after", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		creds = credentialsReadOnly
+		if writable {
+			creds = credentialsWritable
+			logger.Error("replica credentials allow writes to object storage, so a compromised replica could corrupt the database")
+		}
+		break
+	}
+	for !cfg.Replica {
+		err := store.Probe()
+		if errors.Is(err, errNoConditionalWrites) && cfg.EmulateConditionalWrites {
+			logger.Warn("object storage is unsafe, emulating conditional writes", "err", err)
+			store.emulate = true
+			break
+		}
+		if errors.Is(err, errNoConditionalWrites) {
+			logger.Error("object storage is unsafe, refusing writes", "err", err)
+			store.unsafe = err
+			break
+		}
+		if err != nil {
+			backoff := time.Second
+			logger.Error("probe object storage failed", "err", err, "retry_after", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		logger.Debug("object storage supports conditional writes")
+		break
+	}
+	dbs := newDatabases(store, cfg, stats)
+	// Replicas leave migrating to the nodes that write.
+	for _, db := range dbs {
+		for db.unsafe == nil && !cfg.Replica {
+			if err := db.Migrate(); err != nil {
+				backoff := time.Second
+				logger.Error("migrate to sharded database failed", "database", db.name, "err", err, "retry_after", backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			break
+		}
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	tasks := new(sync.WaitGroup)
+	for _, db := range dbs {
+		db.tasks = tasks
+	}
+	// Without a schedule, backups are only taken by BGSAVE.
+	bk := &backups{
+		dbs:       dbs,
+		logger:    logger.With("component", "backups"),
+		prefix:    cfg.BackupPrefix,
+		retention: cfg.BackupRetention,
+	}
+	if cfg.BackupSchedule != "" && !cfg.Replica {
+		// Callers should validate the schedule with cron.Parse first.
+		if sched, err := cron.Parse(cfg.BackupSchedule); err != nil {
+			logger.Error("invalid backup schedule, scheduled backups disabled", "err", err)
+		} else {
+			bk.schedule, bk.expr = sched, cfg.BackupSchedule
+			tasks.Go(func() { bk.Run(ctx) })
+		}
+	}
 
-	return &Server{
-		maxItems: cfg.MaxItems,
-		store: storage{
-			timeout: cfg.S3Timeout,
-			bucket:  cfg.S3Bucket,
-			name:    cfg.DatabaseName,
-			client:  s3client,
+	relay := newRelay(ctx, store, logger.With("component", "pubsub"), cfg.PubSubPollInterval)
+	flags, err := parseNotifyFlags(cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		logger.Error("invalid keyspace notification setting, notifications disabled", "err", err)
+	}
+	notifier := newNotifier(relay, logger.With("component", "notify"), flags)
+	for n, db := range dbs {
+		db.events.Subscribe(stats.observeEvent)
+		db.events.Subscribe(notifier.observer(n))
+		db.events.Subscribe(cfg.Hooks.observer(n))
+	}
+	tasks.Go(func() { notifier.run(ctx) })
+
+	s := &Server{
+		totalItems:   cfg.MaxItems,
+		maxKeyLength: cfg.MaxKeyLength,
+		keyCharset:   cfg.KeyCharset,
+		password:     cfg.Password,
+		maxClients:   cfg.MaxClients,
+		maxRate:      cfg.MaxCommandRate,
+		maxOutput:    cfg.MaxOutputBuffer,
+		timeouts:     cfg.CommandTimeouts,
+		debugging:    cfg.EnableDebugCommands,
+		nodeName:     nodeName,
+		adminPeers:   adminPeers,
+		topology:     cfg.Topology,
+		store:        store,
+		dbs:          dbs,
+		kv:           store,
+		acl:          &aclStore{store: store, key: cfg.DatabaseName + ".acl"},
+		stats:        stats,
+		backups:      bk,
+		relay:        relay,
+		notifier:     notifier,
+		clients:      &clientRegistry{ctx: ctx},
+		sessions:     &sessionKey{store: store, name: cfg.DatabaseName + ".session-key"},
+		snapshots:    &snapshotCache{},
+		scripts:      &scriptCache{},
+		functions:    &functionStore{store: store, key: cfg.DatabaseName + ".functions"},
+		nextConnID:   new(atomic.Int64),
+		activeExpire: new(atomic.Bool),
+		stop:         stop,
+		tasks:        tasks,
+		commands:     &commands{},
+		serving:      &serving{},
+	}
+	s.activeExpire.Store(true)
+	if cfg.Replica {
+		s.replica = &replica{store: store, logger: logger.With("component", "replica"), refresh: cfg.ReplicaRefresh, credentials: creds}
+		if cfg.ReplicaRefresh > 0 {
+			tasks.Go(func() { s.replica.run(ctx) })
+		}
+	}
+	if cfg.ExpireSweepInterval > 0 && !cfg.Replica {
+		tasks.Go(func() { s.sweepExpired(ctx, logger.With("component", "expire"), cfg.ExpireSweepInterval) })
+	}
+	tasks.Go(func() { s.watchInvalidations(ctx, logger.With("component", "invalidate")) })
+	if store.compaction.interval > 0 && !cfg.Replica {
+		tasks.Go(func() { s.compactLogs(ctx, logger.With("component", "compact"), store.compaction) })
+	}
+	if cfg.AutoShards > 1 && cfg.AutoShardInterval > 0 && !cfg.Replica {
+		policy := promotePolicy{
+			shards:       cfg.AutoShards,
+			interval:     cfg.AutoShardInterval,
+			bytes:        cfg.AutoShardBytes,
+			conflictRate: cfg.AutoShardConflictRate,
+		}
+		tasks.Go(func() { s.promoteShards(ctx, logger.With("component", "promote"), policy) })
+	}
+	s.checkLogs(ctx, logger.With("component", "wal"))
+	s.logStartup(logger, cfg)
+	return s
+}
+
+// maxItems is each shard's share of totalItems, which changes if the
+// database is promoted to shards.
+func (s *Server) maxItems() int {
+	n := len(s.store.shards())
+	return (s.totalItems + n - 1) / n
+}
+
+func newS3Client(cfg Config, st *stats) *s3.Client {
+	user, password := cfg.S3User, cfg.S3Password
+	if cfg.Replica && cfg.ReplicaS3User != "" {
+		user, password = cfg.ReplicaS3User, cfg.ReplicaS3Password
+	}
+	transport := cfg.StorageTransport
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+	return s3.New(s3.Options{
+		Region:                     cfg.S3Region,
+		BaseEndpoint:               aws.String(cfg.S3Endpoint),
+		DefaultsMode:               aws.DefaultsModeStandard,
+		Credentials:                credentials.NewStaticCredentialsProvider(user, password, "" /* session */),
+		UsePathStyle:               true,
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenSupported,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenSupported,
+		HTTPClient: &http.Client{
+			Transport: storageTransport{transport, cfg.StorageLatency, st},
 		},
+	})
+}
+
+// storageTransport delays every request to object storage (see
+// Config.StorageLatency), counts it in stats, and traces it.
+type storageTransport struct {
+	http.RoundTripper
+	delay time.Duration
+	stats *stats
+}
+
+func (t storageTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	start := time.Now()
+	req, span := startRequest(req)
+	defer func() {
+		t.stats.observeRequest(req.Method, time.Since(start))
+		endRequest(span, res, err)
+	}()
+	if t.delay > 0 {
+		timer := time.NewTimer(t.delay)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
 	}
+	return t.RoundTripper.RoundTrip(req)
 }
 
 // ServeTCP accepts connections and serves Valkey requests.
 func (s *Server) ServeTCP(ln net.Listener) error {
 	rs := redcon.NewServerNetwork("tcp", ln.Addr().String(), s.handle, s.accept, s.onClosed)
-	s.mu.Lock()
-	s.close = rs.Close
-	s.mu.Unlock()
-	return rs.Serve(ln)
+	return s.serve(rs, ln)
+}
+
+// ServeTLS is like ServeTCP, but it accepts only TLS connections.
+func (s *Server) ServeTLS(ln net.Listener, cfg *tls.Config) error {
+	return s.ServeTCP(tls.NewListener(ln, cfg))
 }
 
-// Close shuts the server down.
+// ServeMemcached accepts connections and serves requests in the memcached
+// text protocol. Only GET, SET, DELETE, and INCR are supported. The text
+// protocol has no authentication, so it's unavailable if the server requires
+// a password.
+func (s *Server) ServeMemcached(ln net.Listener) error {
+	if s.password != "" {
+		ln.Close()
+		return errors.New("memcached protocol doesn't support authentication")
+	}
+	return s.serve(newMemcached(s), ln)
+}
+
+// ServeAdmin accepts HTTP connections and serves a read-only web dashboard
+// for operators.
+func (s *Server) ServeAdmin(ln net.Listener) error {
+	return s.serve(newAdmin(s), ln)
+}
+
+func (s *Server) serve(f frontend, ln net.Listener) error {
+	dl := newDrainListener(ln)
+	s.serving.mu.Lock()
+	s.serving.frontends = append(s.serving.frontends, f)
+	s.serving.listeners = append(s.serving.listeners, dl)
+	s.serving.mu.Unlock()
+	return f.Serve(dl)
+}
+
+// Close shuts the server down immediately, closing every connection even if
+// it's running a command. Shutdown is more graceful.
 func (s *Server) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.close == nil {
-		return nil
+	s.stop()
+	s.serving.mu.Lock()
+	defer s.serving.mu.Unlock()
+	var errs []error
+	for _, f := range s.serving.frontends {
+		errs = append(errs, f.Close())
 	}
-	return s.close()
+	s.serving.frontends = nil
+	return errors.Join(errs...)
 }
 
 func (s *Server) handle(conn redcon.Conn, cmd redcon.Command) {
+	raw := conn
+	defer func() { s.checkOutput(raw, stateOf(raw)) }()
+	conn = withProtocol(s.limitOutput(conn))
+	if !s.commands.begin() {
+		writeErr(conn, errShuttingDown)
+		return
+	}
+	defer s.commands.end()
+	start := time.Now()
+	defer func() { s.stats.observe(stateOf(raw).user, cmd.Args, time.Since(start)) }()
+
 	name := op.New(cmd.Args[0])
+	st := stateOf(conn)
+	ctx, cancel := s.commandContext(st.client, name)
+	defer cancel()
+	ctx, span := s.startCommand(ctx, conn, name)
+	defer span.End()
 	var args []string
 	if len(cmd.Args) > 1 {
 		args = make([]string, 0, len(cmd.Args))
@@ -114,29 +586,317 @@ func (s *Server) handle(conn redcon.Conn, cmd redcon.Command) {
 			args = append(args, string(arg))
 		}
 	}
+	args, hinted := staleHinted(name, args)
+	st.client.begin(name)
+	// RESET replaces the connection's state, so look it up again.
+	defer func() { st.client.update(stateOf(conn)) }()
+	if !st.limiter.allow(s.maxRate, time.Now()) {
+		s.stats.rateLimited.Add(1)
+		writeErr(conn, errRateLimited)
+		st.dirty = st.multi
+		return
+	}
+	if !st.authed && name != op.Auth && name != op.Hello && name != op.Quit && name != op.Reset {
+		conn.WriteError(errNoAuth)
+		return
+	}
+	if !s.checkKeys(conn, name, args) {
+		// Like Valkey, a command refused inside MULTI makes EXEC fail.
+		st.dirty = st.multi
+		return
+	}
+	if s.replica != nil && !replicable(name, args) {
+		writeErr(conn, errReadOnlyReplica)
+		st.dirty = st.multi
+		return
+	}
+	if st.pinned != nil && !pinnable(name) {
+		writeErr(conn, errPinnedSnapshot)
+		return
+	}
+	ns, err := s.namespace(st.user)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if ns != "" && !namespaceable(name) {
+		writeErr(conn, errNamespacedCommand)
+		st.dirty = st.multi
+		return
+	}
+	stale := st.stale || hinted
+	s = s.withKeyspace(s.connKeyspace(ctx, st, ns, st.db, stale))
+	s.store = s.dbs[st.db]
+	s.ctx = ctx
+	s.kvIn = func(db int) keyspace { return s.connKeyspace(ctx, st, ns, db, stale) }
+	switch name {
+	case op.Multi, op.Exec, op.Discard, op.Watch, op.Quit, op.Reset:
+	default:
+		if st.multi {
+			s.queue(conn, name, args)
+			return
+		}
+	}
+	s.dispatch(conn, name, args)
+}
+
+// connKeyspace returns the keyspace a connection's commands see in a logical
+// database: the database, as seen through the connection's replica,
+// snapshot, and namespace views. If stale is set, reads on a replica may come
+// from its copy of the database.
+func (s *Server) connKeyspace(ctx context.Context, st *connState, ns string, db int, stale bool) keyspace {
+	var kv keyspace = s.dbs[db].withContext(ctx)
+	if s.replica != nil {
+		// The replica's copy is of database 0.
+		kv = replicaView{kv: kv, r: s.replica, stale: stale && db == 0}
+	}
+	if st.pinned != nil {
+		kv = st.pinned
+	}
+	if ns != "" {
+		kv = namespaceView{kv: kv, prefix: NamespacePrefix(ns)}
+	}
+	return kv
+}
+
+// checkKeys validates a command's keys and checks that the connection's user
+// may run it, replying with an error if not.
+func (s *Server) checkKeys(conn redcon.Conn, name op.Op, args []string) bool {
+	keys := commandKeys(name, args)
+	for _, key := range keys {
+		if err := s.validateKey(key); err != nil {
+			writeErr(conn, err)
+			return false
+		}
+	}
+	return s.checkPermissions(conn, name, keys)
+}
+
+// dispatch runs a command.
+func (s *Server) dispatch(conn redcon.Conn, name op.Op, args []string) {
 	switch name {
 	case op.Get:
 		s.get(conn, args)
+	case op.GetDel:
+		s.getdel(conn, args)
+	case op.GetEx:
+		s.getex(conn, args)
+	case op.GetSet:
+		s.getset(conn, args)
+	case op.Append:
+		s.appendCmd(conn, args)
+	case op.Strlen:
+		s.strlen(conn, args)
+	case op.SetRange:
+		s.setrange(conn, args)
+	case op.GetRange:
+		s.getrange(conn, args)
+	case op.SetEx:
+		s.setex(conn, name, args, time.Second)
+	case op.PSetEx:
+		s.setex(conn, name, args, time.Millisecond)
+	case op.SetNX:
+		s.setnx(conn, args)
+	case op.Rename, op.RenameNX:
+		s.rename(conn, name, args)
+	case op.Copy:
+		s.copyKey(conn, args)
+	case op.Eval, op.EvalSha:
+		s.eval(conn, name, args)
+	case op.Script:
+		s.script(conn, args)
+	case op.FCall, op.FCallRO:
+		s.fcall(conn, name, args)
+	case op.Function:
+		s.function(conn, args)
+	case op.Object:
+		s.object(conn, args)
 	case op.Set:
 		s.set(conn, args)
 	case op.Del:
 		s.del(conn, args)
-	case op.FlushAll:
-		s.flushAll(conn, args)
+	case op.Incr, op.Decr, op.IncrBy, op.DecrBy:
+		s.incr(conn, name, args)
+	case op.MGet:
+		s.mget(conn, args)
+	case op.MSet:
+		s.mset(conn, args)
+	case op.FlushAll, op.FlushDB:
+		s.flushAll(conn, name, args)
 	case op.Ping:
 		s.ping(conn, args)
 	case op.Quit:
 		s.quit(conn, args)
+	case op.Reset:
+		s.reset(conn, args)
+	case op.Subscribe, op.PSubscribe:
+		s.subscribeCmd(conn, name, args)
+	case op.Unsubscribe, op.PUnsubscribe, op.SUnsubscribe:
+		s.unsubscribeCmd(conn, name, args)
+	case op.Publish:
+		s.publish(conn, args)
+	case op.SSubscribe:
+		s.ssubscribe(conn, args)
+	case op.SPublish:
+		s.spublish(conn, args)
+	case op.Lock:
+		s.lock(conn, args)
+	case op.Unlock:
+		s.unlock(conn, args)
+	case op.Info:
+		s.info(conn, args)
+	case op.Auth:
+		s.auth(conn, args)
+	case op.ACL:
+		s.aclCmd(conn, args)
+	case op.Hello:
+		s.hello(conn, args)
+	case op.Stats:
+		s.statsCmd(conn, args)
+	case op.BitField, op.BitFieldRO:
+		s.bitfield(conn, name, args)
+	case op.Debug:
+		s.debug(conn, args)
+	case op.Config:
+		s.config(conn, args)
+	case op.Cluster:
+		s.cluster(conn, args)
+	case op.Client:
+		s.client(conn, args)
+	case op.BgSave:
+		s.bgsave(conn, args)
+	case op.LastSave:
+		s.lastsave(conn, args)
+	case op.Generation:
+		s.generation(conn, args)
+	case op.Invalidate:
+		s.invalidate(conn, args)
+	case op.Resume:
+		s.resume(conn, args)
+	case op.GetAt:
+		s.getat(conn, args)
+	case op.Snapshot:
+		s.snapshotCmd(conn, args)
+	case op.HotKeys:
+		s.hotKeysCmd(conn, args)
+	case op.HSet:
+		s.hset(conn, args)
+	case op.HGet:
+		s.hget(conn, args)
+	case op.HDel:
+		s.hdel(conn, args)
+	case op.HGetAll:
+		s.hgetall(conn, args)
+	case op.HExists:
+		s.hexists(conn, args)
+	case op.HLen:
+		s.hlen(conn, args)
+	case op.HRandField:
+		s.hrandfield(conn, args)
+	case op.LPush, op.RPush:
+		s.push(conn, name, args)
+	case op.LPop, op.RPop:
+		s.pop(conn, name, args)
+	case op.LLen:
+		s.llen(conn, args)
+	case op.LRange:
+		s.lrange(conn, args)
+	case op.SAdd:
+		s.sadd(conn, args)
+	case op.SRem:
+		s.srem(conn, args)
+	case op.SMembers:
+		s.smembers(conn, args)
+	case op.SIsMember:
+		s.sismember(conn, args)
+	case op.SCard:
+		s.scard(conn, args)
+	case op.SRandMember:
+		s.srandmember(conn, args)
+	case op.ZAdd:
+		s.zadd(conn, args)
+	case op.ZRem:
+		s.zrem(conn, args)
+	case op.ZPopMin, op.ZPopMax:
+		s.zpop(conn, name, args)
+	case op.ZScore:
+		s.zscore(conn, args)
+	case op.ZCard:
+		s.zcard(conn, args)
+	case op.ZRange:
+		s.zrange(conn, args)
+	case op.Exists:
+		s.exists(conn, args)
+	case op.Type:
+		s.typeCmd(conn, args)
+	case op.DBSize:
+		s.dbsize(conn, args)
+	case op.Keys:
+		s.keys(conn, args)
+	case op.Scan:
+		s.scan(conn, args)
+	case op.Range:
+		s.rangeCmd(conn, args)
+	case op.VGet:
+		s.vget(conn, args)
+	case op.VSet:
+		s.vset(conn, args)
+	case op.Load:
+		s.load(conn, args)
+	case op.LoadIf:
+		s.loadif(conn, args)
+	case op.Expire:
+		s.expireCmd(conn, name, args, time.Second)
+	case op.PExpire:
+		s.expireCmd(conn, name, args, time.Millisecond)
+	case op.TTL:
+		s.ttl(conn, name, args, time.Second)
+	case op.PTTL:
+		s.ttl(conn, name, args, time.Millisecond)
+	case op.Persist:
+		s.persist(conn, args)
+	case op.Dump:
+		s.dumpKey(conn, args)
+	case op.Restore:
+		s.restoreKey(conn, args)
+	case op.Multi:
+		s.multi(conn, args)
+	case op.Exec:
+		s.exec(conn, args)
+	case op.Discard:
+		s.discard(conn, args)
+	case op.Watch:
+		s.watch(conn, args)
+	case op.Unwatch:
+		s.unwatch(conn, args)
+	case op.ReadOnly:
+		s.readonly(conn, args)
+	case op.ReadWrite:
+		s.readwrite(conn, args)
+	case op.Select:
+		s.selectDB(conn, args)
+	case op.Wait:
+		s.wait(conn, args)
 	default:
 		conn.WriteError(fmt.Sprintf("ERR unknown command '%s'", name))
 	}
 }
 
 func (s *Server) accept(conn redcon.Conn) bool {
+	s.stats.connectionsReceived.Add(1)
+	if !s.admit() {
+		// redcon flushes the error before closing the connection.
+		writeErr(conn, errMaxClients)
+		return false
+	}
+	conn.SetContext(s.newConnState(s.clients.add(conn, s.nextConnID.Add(1))))
 	return true
 }
 
+// onClosed runs when an accepted connection closes.
 func (s *Server) onClosed(conn redcon.Conn, err error) {
+	s.clients.remove(stateOf(conn).id)
+	s.stats.connections.Add(-1)
 }
 
 func (s *Server) get(conn redcon.Conn, args []string) {
@@ -145,52 +905,206 @@ func (s *Server) get(conn redcon.Conn, args []string) {
 		return
 	}
 
-	items, err := s.store.GetDB()
+	val, ok, err := s.getString(args[0])
 	if err != nil {
 		writeErr(conn, err)
 		return
 	}
-	val, ok := items[args[0]]
 	if !ok {
 		conn.WriteNull()
 		return
 	}
-	if val == "" {
-		// See set: explicitly storing empty values is forbidden.
-		writeErr(conn, fmt.Errorf("database contains empty value for string %s", args[0])) // unreachable
+	conn.WriteBulkString(val)
+}
+
+// getdel handles GETDEL key, which deletes a string and replies with its
+// value, or null if it didn't exist.
+func (s *Server) getdel(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.GetDel)
 		return
 	}
-	conn.WriteBulkString(val)
+	key := args[0]
+	var val string
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		var ok bool
+		if val, ok = db.Items[key]; !ok {
+			return 0, errNotApplied
+		}
+		db.deleteItem(key)
+		db.notify('g', "del", key)
+		return 0, nil
+	})
+	switch {
+	case errors.Is(err, errNotApplied):
+		conn.WriteNull()
+	case err != nil:
+		writeErr(conn, err)
+	default:
+		conn.WriteBulkString(val)
+	}
 }
 
+// set handles SET key value [NX | XX] [GET] [EX seconds | PX milliseconds].
+// NX and XX make the write conditional, replying with null if it doesn't
+// apply; GET instead replies with the previous value (or null).
 func (s *Server) set(conn redcon.Conn, args []string) {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		writeErrArity(conn, op.Set)
 		return
 	}
-	// Valkey allows SET'ing values to the empty string, but this makes our test
-	// model more complex - we can't model the allowable values for a key as a
-	// set of strings, because we don't have a value to represent the key being
-	// absent. This is a demo project, so we'll disallow empty values to keep
-	// the model simple.
-	if args[1] == "" {
-		writeErr(conn, fmt.Errorf("empty value"))
+	var opts setOptions
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "EX", "PX":
+			unit := time.Second
+			if strings.EqualFold(args[i], "PX") {
+				unit = time.Millisecond
+			}
+			if opts.ttl != 0 || i+1 >= len(args) {
+				writeErr(conn, errSyntax)
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				writeErr(conn, errNotAnInteger)
+				return
+			}
+			if n <= 0 || n > int64(math.MaxInt64/unit) {
+				writeErr(conn, fmt.Errorf("invalid expire time in '%s' command", op.Set))
+				return
+			}
+			opts.ttl = time.Duration(n) * unit
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+	if opts.nx && opts.xx {
+		writeErr(conn, errSyntax)
 		return
 	}
 
-	_, err := s.store.MutateDB(func(items map[string]string) (int, error) {
-		if len(items) >= s.maxItems {
-			return 0, fmt.Errorf("at max capacity of %d keys", s.maxItems)
+	old, applied, err := s.setString(args[0], args[1], opts)
+	switch {
+	case err != nil:
+		writeErr(conn, err)
+	case opts.get && old == "":
+		conn.WriteNull()
+	case opts.get:
+		conn.WriteBulkString(old)
+	case !applied:
+		conn.WriteNull()
+	default:
+		conn.WriteString("OK")
+	}
+}
+
+// incr handles INCR key, DECR key, INCRBY key delta, and DECRBY key delta.
+// Missing keys are treated as zero.
+func (s *Server) incr(conn redcon.Conn, name op.Op, args []string) {
+	want := 1
+	if name == op.IncrBy || name == op.DecrBy {
+		want = 2
+	}
+	if len(args) != want {
+		writeErrArity(conn, name)
+		return
+	}
+	delta := int64(1)
+	if want == 2 {
+		var err error
+		delta, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			writeErr(conn, errNotAnInteger)
+			return
 		}
-		items[args[0]] = args[1]
-		return 0, nil // int doesn't matter
+	}
+	if name == op.Decr || name == op.DecrBy {
+		if delta == math.MinInt64 {
+			writeErr(conn, errOverflow)
+			return
+		}
+		delta = -delta
+	}
+	n, err := s.incrBy(args[0], delta)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt64(n)
+}
+
+// mget handles MGET key [key ...]. All the keys are read from a single
+// version of the database.
+func (s *Server) mget(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.MGet)
+		return
+	}
+	db, err := s.kv.GetKeys(args)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteArray(len(args))
+	for _, key := range args {
+		if val, ok := db.Items[key]; ok {
+			conn.WriteBulkString(val)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// mset handles MSET key value [key value ...], which sets all the keys in a
+// single write.
+func (s *Server) mset(conn redcon.Conn, args []string) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		writeErrArity(conn, op.MSet)
+		return
+	}
+	keys := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		if args[i+1] == "" {
+			// See setString.
+			writeErr(conn, fmt.Errorf("empty value"))
+			return
+		}
+		keys = append(keys, args[i])
+	}
+	_, err := s.kv.MutateKeys(keys, func(db *database) (int, error) {
+		added := 0
+		for i := 0; i < len(args); i += 2 {
+			if !db.exists(args[i]) {
+				added++
+			}
+		}
+		if added > 0 && db.stored()+added > s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		for i := 0; i < len(args); i += 2 {
+			db.setItem(args[i], args[i+1])
+			delete(db.Expires, args[i])
+			db.notify('$', "set", args[i])
+		}
+		return 0, nil
 	})
 	if err != nil {
 		writeErr(conn, err)
 		return
 	}
 	conn.WriteString("OK")
-
 }
 
 func (s *Server) del(conn redcon.Conn, args []string) {
@@ -202,37 +1116,103 @@ func (s *Server) del(conn redcon.Conn, args []string) {
 		return
 	}
 
-	n, err := s.store.MutateDB(func(items map[string]string) (int, error) {
-		_, ok := items[args[0]]
-		delete(items, args[0])
-		if ok {
-			return 1, nil
+	ok, err := s.delKey(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if ok {
+		conn.WriteInt(1)
+		return
+	}
+	conn.WriteInt(0)
+}
+
+// flushAll handles FLUSHALL [ASYNC|SYNC] and FLUSHDB [ASYNC|SYNC]. FLUSHDB
+// empties the connection's logical database, and FLUSHALL empties every
+// one, a database at a time. Either way, each shard is emptied atomically
+// before the command returns. With ASYNC, shards are emptied without being
+// read first, so the command takes as long however many keys there are (see
+// flush.go).
+func (s *Server) flushAll(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) > 1 {
+		writeErrArity(conn, name)
+		return
+	}
+	if len(args) == 1 && !strings.EqualFold(args[0], "async") && !strings.EqualFold(args[0], "sync") {
+		writeErr(conn, errSyntax)
+		return
+	}
+	async := len(args) == 1 && strings.EqualFold(args[0], "async")
+
+	kvs := []keyspace{s.kv}
+	if name == op.FlushAll && !s.inTxn() {
+		kvs = kvs[:0]
+		for n := range s.dbs {
+			kvs = append(kvs, s.kvIn(n))
 		}
-		return 0, nil
-	})
+	}
+	for _, kv := range kvs {
+		var err error
+		// Views of part of the keyspace, like transactions and namespaces,
+		// flush the usual way.
+		if f, ok := kv.(flusher); ok && async {
+			err = f.FlushAsync()
+		} else {
+			_, err = kv.MutateDB(flushDB)
+		}
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+	}
+	conn.WriteString("OK")
+}
 
-	if err != nil {
+// load handles LOAD key value [key value ...], which populates an empty
+// database in a single write.
+func (s *Server) load(conn redcon.Conn, args []string) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		writeErrArity(conn, op.Load)
+		return
+	}
+	items := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		if args[i+1] == "" {
+			// See setString.
+			writeErr(conn, fmt.Errorf("empty value"))
+			return
+		}
+		items[args[i]] = args[i+1]
+	}
+	// The items are spread across the shards, so they're only limited by
+	// the total.
+	if len(items) > s.totalItems {
+		writeErr(conn, fmt.Errorf("%w: at most %d keys", ErrCapacity, s.totalItems))
+		return
+	}
+	if err := s.store.BulkLoad(items); err != nil {
 		writeErr(conn, err)
 		return
 	}
-	conn.WriteInt(n)
+	conn.WriteString("OK")
 }
 
-func (s *Server) flushAll(conn redcon.Conn, args []string) {
+// generation handles GENERATION, which replies with the database's current
+// generation. Generations increase with every write, so clients can detect
+// changes by comparing them, without relying on ETags (whose semantics vary
+// across object storage providers).
+func (s *Server) generation(conn redcon.Conn, args []string) {
 	if len(args) > 0 {
-		writeErrArity(conn, op.FlushAll)
+		writeErrArity(conn, op.Generation)
 		return
 	}
-
-	_, err := s.store.MutateDB(func(items map[string]string) (int, error) {
-		clear(items)
-		return 0, nil
-	})
+	db, err := s.kv.GetDB()
 	if err != nil {
 		writeErr(conn, err)
 		return
 	}
-	conn.WriteString("OK")
+	conn.WriteUint64(db.Generation)
 }
 
 func (s *Server) ping(conn redcon.Conn, args []string) {
@@ -244,10 +1224,136 @@ func (s *Server) quit(conn redcon.Conn, args []string) {
 	conn.Close()
 }
 
+// getString, setString, incrBy, and delKey implement the core key-value operations
+// independently of any wire protocol, so that every frontend shares the same
+// semantics.
+
+func (s *Server) getString(key string) (string, bool, error) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		return "", false, err
+	}
+	if err := db.checkType(key, "string"); err != nil {
+		return "", false, err
+	}
+	val, ok := db.Items[key]
+	if !ok {
+		return "", false, nil
+	}
+	if val == "" {
+		// See setString: explicitly storing empty values is forbidden.
+		return "", false, fmt.Errorf("database contains empty value for string %s", key) // unreachable
+	}
+	return val, true, nil
+}
+
+// setOptions are the options to setString.
+type setOptions struct {
+	nx  bool          // only set the key if it doesn't exist
+	xx  bool          // only set the key if it already exists
+	ttl time.Duration // if positive, the key's new TTL
+	get bool          // return the previous value, which must be a string
+}
+
+// setString sets a key, returning its previous value (or "" if it didn't
+// exist) and whether the write applied. Like Valkey, it discards any TTL
+// unless opts supplies a new one.
+func (s *Server) setString(key, val string, opts setOptions) (string, bool, error) {
+	// Valkey allows SET'ing values to the empty string, but this makes our test
+	// model more complex - we can't model the allowable values for a key as a
+	// set of strings, because we don't have a value to represent the key being
+	// absent. This is a demo project, so we'll disallow empty values to keep
+	// the model simple.
+	if val == "" {
+		return "", false, fmt.Errorf("empty value")
+	}
+
+	var old string
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if opts.get {
+			if err := db.checkType(key, "string"); err != nil {
+				return 0, err
+			}
+		}
+		old = db.Items[key]
+		ok := db.exists(key)
+		if (opts.nx && ok) || (opts.xx && !ok) {
+			return 0, errNotApplied
+		}
+		if db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		db.setItem(key, val)
+		db.notify('$', "set", key)
+		if opts.ttl > 0 {
+			db.Expires[key] = s.store.now().Add(opts.ttl).UnixMilli()
+			db.notify('g', "expire", key)
+		} else {
+			delete(db.Expires, key)
+		}
+		return 0, nil // int doesn't matter
+	})
+	if errors.Is(err, errNotApplied) {
+		return old, false, nil
+	}
+	return old, err == nil, err
+}
+
+// incrBy adds delta to the integer stored at key. Like SET, it's subject to
+// the key limit, but like Valkey it keeps any TTL.
+func (s *Server) incrBy(key string, delta int64) (int64, error) {
+	var result int64
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		val, ok := db.Items[key]
+		var n int64
+		if ok {
+			var err error
+			n, err = strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return 0, errNotAnInteger
+			}
+		} else if db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return 0, errOverflow
+		}
+		result = n + delta
+		db.setItem(key, strconv.FormatInt(result, 10))
+		db.notify('$', "incrby", key)
+		return 0, nil
+	})
+	return result, err
+}
+
+func (s *Server) delKey(key string) (bool, error) {
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		ok := db.exists(key)
+		db.deleteItem(key)
+		if ok {
+			db.notify('g', "del", key)
+			return 1, nil
+		}
+		return 0, nil
+	})
+	return n == 1, err
+}
+
+var (
+	errSyntax   = errors.New("syntax error")
+	errOverflow = errors.New("increment or decrement would overflow")
+	// errNotApplied aborts a conditional write without writing to object
+	// storage.
+	errNotApplied = errors.New("condition not met")
+)
+
 func writeErrArity(conn redcon.Conn, op op.Op) {
 	conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", op))
 }
 
 func writeErr(conn redcon.Conn, err error) {
-	conn.WriteError(fmt.Sprintf("ERR %v", err))
+	conn.WriteError(errorCode(err) + " " + err.Error())
 }
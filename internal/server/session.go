@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/tidwall/redcon"
+)
+
+// Connections to a cluster churn, especially when faults are injected, and a
+// reconnecting client loses its connection's state. RESUME (with no
+// arguments) returns a token describing the state: the connection's name,
+// protocol, selected database, and watched keys. Presenting the token with RESUME token, on a
+// new connection to any node, restores the state. Clients should fetch a new
+// token whenever they change the state.
+//
+// Tokens are self-contained, so nodes needn't store sessions: a token is the
+// session, signed with a key that every node reads from object storage.
+// Presenting a token doesn't authenticate a connection; it must already be
+// authenticated as the user the token was issued to. Tokens may be used more
+// than once, which only lets their owner restore the same state again.
+const sessionTTL = 10 * time.Minute
+
+var (
+	errInvalidToken = errors.New("invalid or expired session token")
+	errTokenUser    = errors.New("session token belongs to another user")
+)
+
+// A session is the stored form of a connection's state.
+type session struct {
+	User     string                  `json:"user"`
+	Name     string                  `json:"name,omitempty"`
+	Protocol int                     `json:"protocol"`
+	DB       int                     `json:"db,omitempty"`
+	Watched  map[string]watchedToken `json:"watched,omitempty"`
+	Expires  int64                   `json:"expires"` // Unix milliseconds
+}
+
+// A watchedToken is the stored form of a watchedKey.
+type watchedToken struct {
+	Version    uint64 `json:"version,omitempty"`
+	Generation uint64 `json:"generation"`
+}
+
+// sessionKey caches the key that signs session tokens. Every node must sign
+// with the same key, so the first node to need it creates it in object
+// storage with a conditional write, and the rest read it.
+type sessionKey struct {
+	store *storage
+	name  string // object key
+
+	mu  sync.Mutex
+	key []byte // never changes once loaded
+}
+
+// Get returns the signing key, creating it if necessary.
+func (k *sessionKey) Get() ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for k.key == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), k.store.timeout)
+		key, err := k.load(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		k.key = key
+	}
+	return k.key, nil
+}
+
+// load reads the signing key, or creates it if it doesn't exist. It returns
+// nil if another node created the key concurrently, so the caller should try
+// again.
+func (k *sessionKey) load(ctx context.Context) ([]byte, error) {
+	res, err := k.store.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(k.store.bucket),
+		Key:    aws.String(k.name),
+	})
+	var errNoKey *types.NoSuchKey
+	switch {
+	case errors.As(err, &errNoKey):
+	case err != nil:
+		k.store.stats.storageErrors.Add(1)
+		return nil, fmt.Errorf("%w: get session key: %v", ErrStorageUnavailable, err)
+	default:
+		defer res.Body.Close()
+		key, err := io.ReadAll(res.Body)
+		if err != nil {
+			k.store.stats.storageErrors.Add(1)
+			return nil, fmt.Errorf("%w: read session key: %v", ErrStorageUnavailable, err)
+		}
+		return key, nil
+	}
+
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	_, err = k.store.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(k.store.bucket),
+		Key:         aws.String(k.name),
+		Body:        bytes.NewReader(key),
+		IfNoneMatch: aws.String("*"),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed":
+		return nil, nil
+	case err != nil:
+		k.store.stats.storageErrors.Add(1)
+		return nil, fmt.Errorf("%w: put session key: %v", ErrStorageUnavailable, err)
+	}
+	return key, nil
+}
+
+// encodeToken signs a session, returning its token.
+func encodeToken(key []byte, sess session) (string, error) {
+	body, err := json.Marshal(sess)
+	if err != nil {
+		return "", fmt.Errorf("marshal session: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(body) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+// decodeToken checks a token's signature and expiry, returning its session.
+func decodeToken(key []byte, token string, now time.Time) (session, error) {
+	enc := base64.RawURLEncoding
+	b64body, b64sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return session{}, errInvalidToken
+	}
+	body, err := enc.DecodeString(b64body)
+	if err != nil {
+		return session{}, errInvalidToken
+	}
+	sig, err := enc.DecodeString(b64sig)
+	if err != nil {
+		return session{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return session{}, errInvalidToken
+	}
+	var sess session
+	if err := json.Unmarshal(body, &sess); err != nil {
+		return session{}, errInvalidToken
+	}
+	if now.UnixMilli() >= sess.Expires {
+		return session{}, errInvalidToken
+	}
+	return sess, nil
+}
+
+// resume handles RESUME, which returns a token for the connection's state,
+// and RESUME token, which restores the state a token describes.
+func (s *Server) resume(conn redcon.Conn, args []string) {
+	if len(args) > 1 {
+		writeErrArity(conn, op.Resume)
+		return
+	}
+	key, err := s.sessions.Get()
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	st := stateOf(conn)
+	if len(args) == 0 {
+		sess := session{
+			User:     st.user,
+			Name:     st.name,
+			Protocol: st.protocol,
+			DB:       st.db,
+			Expires:  time.Now().Add(sessionTTL).UnixMilli(),
+		}
+		if len(st.watched) > 0 {
+			sess.Watched = make(map[string]watchedToken, len(st.watched))
+			for k, w := range st.watched {
+				sess.Watched[k] = watchedToken{Version: w.version, Generation: w.generation}
+			}
+		}
+		token, err := encodeToken(key, sess)
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		conn.WriteBulkString(token)
+		return
+	}
+
+	sess, err := decodeToken(key, args[0], time.Now())
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if sess.User != st.user {
+		writeErr(conn, errTokenUser)
+		return
+	}
+	if sess.DB >= len(s.dbs) {
+		// The token came from a node with more databases.
+		writeErr(conn, errDBIndex)
+		return
+	}
+	st.name = sess.Name
+	st.protocol = sess.Protocol
+	st.db = sess.DB
+	st.watched = nil
+	if len(sess.Watched) > 0 {
+		st.watched = make(map[string]watchedKey, len(sess.Watched))
+		for k, w := range sess.Watched {
+			st.watched[k] = watchedKey{version: w.Version, generation: w.Generation}
+		}
+	}
+	conn.WriteString("OK")
+}
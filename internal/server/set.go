@@ -0,0 +1,234 @@
+package server
+
+import (
+	"iter"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/antithesishq/valthree/internal/set"
+	"github.com/tidwall/redcon"
+)
+
+// set returns the set stored at key, or nil if the key doesn't exist. It
+// returns ErrWrongType if the key holds a value of another type.
+func (db *database) set(key string) (set.Set[string], error) {
+	if err := db.checkType(key, "set"); err != nil {
+		return nil, err
+	}
+	return db.Sets[key], nil
+}
+
+// sadd handles SADD key member [member ...], which replies with the number of
+// members that weren't already in the set.
+func (s *Server) sadd(conn redcon.Conn, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, op.SAdd)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		members, err := db.set(key)
+		if err != nil {
+			return 0, err
+		}
+		if members == nil {
+			if db.stored() >= s.maxItems() {
+				return 0, s.errAtCapacity()
+			}
+			members = set.New[string]()
+			db.Sets[key] = members
+		}
+		var added int
+		for _, m := range args[1:] {
+			if members.Add(m) {
+				added++
+			}
+		}
+		if added > 0 {
+			db.touch(key)
+		}
+		return added, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// srem handles SREM key member [member ...], which replies with the number of
+// members removed. Like Valkey, it deletes the key along with its last member.
+func (s *Server) srem(conn redcon.Conn, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, op.SRem)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		members, err := db.set(key)
+		if err != nil || members == nil {
+			return 0, err
+		}
+		var removed int
+		for _, m := range args[1:] {
+			if members.Remove(m) {
+				removed++
+			}
+		}
+		if members.Len() == 0 {
+			db.deleteItem(key)
+		} else if removed > 0 {
+			db.touch(key)
+		}
+		return removed, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// smembers handles SMEMBERS key, which replies with every member of the set.
+// Members are sorted so that replies are deterministic.
+func (s *Server) smembers(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.SMembers)
+		return
+	}
+	members, err := s.getSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	writeSet(conn, members.Len())
+	for _, m := range members.Sorted() {
+		conn.WriteBulkString(m)
+	}
+}
+
+// sismember handles SISMEMBER key member, which replies with 1 if the member
+// is in the set and 0 otherwise.
+func (s *Server) sismember(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.SIsMember)
+		return
+	}
+	members, err := s.getSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if members.Contains(args[1]) {
+		conn.WriteInt(1)
+		return
+	}
+	conn.WriteInt(0)
+}
+
+// scard handles SCARD key, which replies with the number of members in the
+// set.
+func (s *Server) scard(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.SCard)
+		return
+	}
+	members, err := s.getSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(members.Len())
+}
+
+// srandmember handles SRANDMEMBER key [count]. Without a count, it replies
+// with a random member, or nil if the set doesn't exist. With a count, it
+// replies with an array of random members: up to count distinct ones if the
+// count is positive, or exactly -count, possibly repeated, if it's negative.
+func (s *Server) srandmember(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.SRandMember)
+		return
+	}
+	if len(args) > 2 {
+		writeErr(conn, errSyntax)
+		return
+	}
+	var (
+		count    int
+		distinct bool
+	)
+	if len(args) == 2 {
+		var err error
+		if count, distinct, err = parseRandomCount(args[1]); err != nil {
+			writeErr(conn, err)
+			return
+		}
+	}
+	members, err := s.getSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	sorted := members.Sorted()
+	if len(args) == 1 {
+		if len(sorted) == 0 {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteBulkString(sorted[rand.N(len(sorted))])
+		return
+	}
+	n, picks := randomPicks(len(sorted), count, distinct)
+	conn.WriteArray(n)
+	for i := range picks {
+		conn.WriteBulkString(sorted[i])
+	}
+}
+
+// parseRandomCount parses the count given to SRANDMEMBER or HRANDFIELD. A
+// negative count asks for that many elements, which may repeat.
+func parseRandomCount(arg string) (count int, distinct bool, err error) {
+	n, err := strconv.Atoi(arg)
+	// Like Valkey, refuse counts whose replies couldn't be encoded.
+	if err != nil || n < -math.MaxInt/2 || n > math.MaxInt/2 {
+		return 0, false, errNotAnInteger
+	}
+	if n < 0 {
+		return -n, false, nil
+	}
+	return n, true, nil
+}
+
+// randomPicks chooses count random indexes into a collection of n elements.
+// If distinct is set, it chooses each index at most once, so it may choose
+// fewer than count. It returns the number of indexes chosen, and the
+// indexes themselves.
+func randomPicks(n, count int, distinct bool) (int, iter.Seq[int]) {
+	if n == 0 {
+		return 0, func(func(int) bool) {}
+	}
+	if distinct {
+		picks := rand.Perm(n)[:min(count, n)]
+		return len(picks), slices.Values(picks)
+	}
+	return count, func(yield func(int) bool) {
+		for range count {
+			if !yield(rand.N(n)) {
+				return
+			}
+		}
+	}
+}
+
+// getSet reads the set stored at key. Missing keys are empty sets.
+func (s *Server) getSet(key string) (set.Set[string], error) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return db.set(key)
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storing the whole database in one object serializes every write on a single
+// ETag. Sharding hash-partitions keys across several objects, each with its
+// own conditional writes, so writes to different shards don't conflict.
+//
+// Each shard is linearizable on its own, but operations spanning shards
+// aren't atomic. Commands that touch several keys, like MSET, require all
+// their keys to be in the same shard. As in Valkey Cluster, only the part of
+// a key inside the first {...} is hashed, so related keys can be grouped with
+// hash tags like {user1000}.name and {user1000}.email.
+//
+// Databases are sharded from the start, or migrated when servers configured
+// with shards first start. An unsharded database may also be promoted to
+// shards while it's in use (see promote.go).
+
+var errCrossShard = errors.New("CROSSSLOT Keys in request don't hash to the same shard")
+
+// newStorage creates the database's storage.
+func newStorage(client *s3.Client, cfg Config, stats *stats) *storage {
+	store := &storage{
+		timeout: cfg.S3Timeout,
+		bucket:  cfg.S3Bucket,
+		name:    cfg.DatabaseName,
+		quotas:  cfg.Quotas,
+		client:  client,
+		stats:   stats,
+
+		batchInterval: cfg.WriteBatchInterval,
+		wal:           cfg.WriteAheadLog,
+		skew:          cfg.ClockSkew,
+		values:        cfg.Hooks.OnWrite != nil,
+		autoShards:    cfg.AutoShards,
+		access:        accessTracker{since: time.Now()},
+		tasks:         new(sync.WaitGroup),
+		compaction: compactPolicy{
+			interval:   cfg.CompactInterval,
+			minEntries: uint64(max(cfg.CompactMinEntries, 0)),
+			maxEntries: uint64(max(cfg.CompactMaxEntries, 0)),
+		},
+		retries: retryPolicy{
+			maxAttempts: max(cfg.WriteMaxAttempts, 0),
+			baseDelay:   cfg.WriteRetryBaseDelay,
+			maxDelay:    cfg.WriteRetryMaxDelay,
+		},
+	}
+	store.layout.Store(newShards(store, cfg.Shards))
+	return store
+}
+
+// newShards returns the shards of a database split across n objects. With
+// one shard, the database is a single object named for the database, exactly
+// as it was before sharding existed.
+func newShards(store *storage, n int) *[]*shard {
+	if n <= 1 {
+		return &[]*shard{{store: store, key: store.name, count: 1}}
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{
+			store: store,
+			key:   fmt.Sprintf("%s.shard-%03d", store.name, i),
+			count: n,
+		}
+	}
+	return &shards
+}
+
+// openStorage creates the database's storage for commands that work on
+// object storage directly, without a running server.
+func openStorage(cfg Config) *storage {
+	st := newStats(0)
+	return newStorage(newS3Client(cfg, st), cfg, st)
+}
+
+// hashTag returns the part of the key that determines its shard.
+func hashTag(key string) string {
+	if _, rest, ok := strings.Cut(key, "{"); ok {
+		if tag, _, ok := strings.Cut(rest, "}"); ok && tag != "" {
+			return tag
+		}
+	}
+	return key
+}
+
+// shards returns the database's shards. Their number only changes if the
+// database is promoted to shards (see promote.go), so callers that look up
+// several keys should use the same result for all of them.
+func (s *storage) shards() []*shard {
+	return *s.layout.Load()
+}
+
+func (s *storage) shardFor(key string) *shard {
+	return shardIn(s.shards(), key)
+}
+
+// shardIn returns the shard holding key among shards.
+func shardIn(shards []*shard, key string) *shard {
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hashTag(unnamespaced(key))))
+	return shards[h.Sum32()%uint32(len(shards))]
+}
+
+// shardForAll returns the shard holding all the keys, or errCrossShard if
+// they're spread across several shards.
+func (s *storage) shardForAll(keys []string) (*shard, error) {
+	shards := s.shards()
+	if len(keys) == 0 {
+		return shards[0], nil
+	}
+	sh := shardIn(shards, keys[0])
+	for _, key := range keys[1:] {
+		if shardIn(shards, key) != sh {
+			return nil, errCrossShard
+		}
+	}
+	return sh, nil
+}
+
+// GetKey reads the shard holding key.
+func (s *storage) GetKey(key string) (*database, error) {
+	return s.withContext(context.Background()).GetKey(key)
+}
+
+// GetKeys reads the shard holding all the keys.
+func (s *storage) GetKeys(keys []string) (*database, error) {
+	return s.withContext(context.Background()).GetKeys(keys)
+}
+
+// MutateKey atomically updates the shard holding key. The database passed to
+// f contains only that shard's items.
+func (s *storage) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	return s.withContext(context.Background()).MutateKey(key, f)
+}
+
+// MutateKeys atomically updates the shard holding all the keys.
+func (s *storage) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	return s.withContext(context.Background()).MutateKeys(keys, f)
+}
+
+// MutateDB applies f to every shard, summing the results. Each shard is
+// updated atomically, but the database as a whole isn't: if one shard fails,
+// earlier shards stay updated.
+func (s *storage) MutateDB(f func(*database) (int, error)) (int, error) {
+	return s.withContext(context.Background()).MutateDB(f)
+}
+
+// GetDB reads the whole database. Shards are read one after another, so for
+// sharded databases the result may combine shards from different points in
+// time. The merged generation is the sum of the shards' generations, which
+// still increases by one with every write.
+func (s *storage) GetDB() (*database, error) {
+	return s.withContext(context.Background()).GetDB()
+}
+
+// scopedStorage is the keyspace seen by a single command: the storage, with
+// every call to object storage made in the command's context, so that it's
+// traced as part of the command and abandoned if the command is.
+type scopedStorage struct {
+	store *storage
+	ctx   context.Context
+}
+
+func (s *storage) withContext(ctx context.Context) scopedStorage {
+	return scopedStorage{store: s, ctx: ctx}
+}
+
+// check replaces a failure caused by the command's context ending with the
+// reason it ended: object storage reports it as just another failed request.
+func (s scopedStorage) check(err error) error {
+	if s.ctx.Err() == nil {
+		return err
+	}
+	if errors.Is(err, ErrStorageUnavailable) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return interrupted(s.ctx)
+	}
+	return err
+}
+
+func (s scopedStorage) GetKey(key string) (*database, error) {
+	s.store.access.touch(key)
+	return followMoves(s, func() (*database, error) {
+		return s.store.shardFor(key).get(s.ctx)
+	})
+}
+
+func (s scopedStorage) GetKeys(keys []string) (*database, error) {
+	if _, err := s.store.shardForAll(keys); err != nil {
+		return nil, err
+	}
+	s.store.access.touch(keys...)
+	return followMoves(s, func() (*database, error) {
+		sh, err := s.store.shardForAll(keys)
+		if err != nil {
+			return nil, err
+		}
+		return sh.get(s.ctx)
+	})
+}
+
+func (s scopedStorage) MutateKey(key string, f func(*database) (int, error)) (int, error) {
+	s.store.access.touch(key)
+	return followMoves(s, func() (int, error) {
+		return s.store.shardFor(key).mutate(s.ctx, []string{key}, f)
+	})
+}
+
+func (s scopedStorage) MutateKeys(keys []string, f func(*database) (int, error)) (int, error) {
+	if _, err := s.store.shardForAll(keys); err != nil {
+		return 0, err
+	}
+	s.store.access.touch(keys...)
+	return followMoves(s, func() (int, error) {
+		sh, err := s.store.shardForAll(keys)
+		if err != nil {
+			return 0, err
+		}
+		return sh.mutate(s.ctx, keys, f)
+	})
+}
+
+func (s scopedStorage) MutateDB(f func(*database) (int, error)) (int, error) {
+	return followMoves(s, func() (int, error) {
+		var total int
+		for _, sh := range s.store.shards() {
+			n, err := sh.mutate(s.ctx, nil, f)
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+		return total, nil
+	})
+}
+
+func (s scopedStorage) GetDB() (*database, error) {
+	return followMoves(s, func() (*database, error) {
+		shards := s.store.shards()
+		if len(shards) == 1 {
+			return shards[0].get(s.ctx)
+		}
+		merged := newDatabase()
+		for _, sh := range shards {
+			db, err := sh.get(s.ctx)
+			if err != nil {
+				return nil, err
+			}
+			merged.Generation += db.Generation
+			merged.Deleted = max(merged.Deleted, db.Deleted)
+			merged.expired += db.expired
+			maps.Copy(merged.Items, db.Items)
+			maps.Copy(merged.Hashes, db.Hashes)
+			maps.Copy(merged.Lists, db.Lists)
+			maps.Copy(merged.Sets, db.Sets)
+			maps.Copy(merged.ZSets, db.ZSets)
+			maps.Copy(merged.Leases, db.Leases)
+			maps.Copy(merged.Expires, db.Expires)
+			maps.Copy(merged.Versions, db.Versions)
+		}
+		return merged, nil
+	})
+}
+
+// DropCache forgets the cached copies of every shard, so the next read
+// downloads them in full.
+func (s *storage) DropCache() {
+	for _, sh := range s.shards() {
+		sh.mu.Lock()
+		sh.cached = cachedObject{}
+		sh.state = nil
+		sh.quota = nil
+		sh.mu.Unlock()
+	}
+}
+
+// BulkLoad creates the database with the supplied items, using a single write
+// per shard. It's much faster than setting keys one at a time, but it only
+// works on a cold start: if any shard already exists, it returns
+// errDatabaseExists. Shards are loaded one after another, and if one fails,
+// the ones already loaded are left in place: deleting them could destroy
+// writes acknowledged since. Instead, loads are resumable. Retrying the same
+// load skips the shards that hold exactly what it would write, as long as
+// nothing has written them since. Changes are only published once every
+// shard is loaded.
+func (s *storage) BulkLoad(items map[string]string) error {
+	if len(s.quotas) > 0 {
+		loaded := newDatabase()
+		loaded.Items = items
+		before := make([]quotaUsage, len(s.quotas))
+		if err := checkQuotas(s.quotas, before, newQuotaCounter(s.quotas, loaded).used); err != nil {
+			return err
+		}
+	}
+	shards := s.shards()
+	parts := make(map[*shard]*database, len(shards))
+	for _, sh := range shards {
+		parts[sh] = newDatabase()
+		parts[sh].Generation = 1
+	}
+	for key, val := range items {
+		parts[shardIn(shards, key)].setItem(key, val)
+	}
+	for _, sh := range shards {
+		err := sh.create(parts[sh])
+		if errors.Is(err, errDatabaseExists) {
+			err = sh.checkLoaded(parts[sh])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, sh := range shards {
+		s.events.Publish(changes(nil, nil, parts[sh], s.values)...)
+	}
+	return nil
+}
+
+// create writes the shard if it doesn't already exist.
+func (sh *shard) create(db *database) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.store.wal && !sh.store.emulate {
+		db.startLog()
+	}
+	// With an empty ETag, setDB writes with If-None-Match.
+	if err := sh.setDB(context.Background(), db, ""); errors.Is(err, errMismatchedETag) {
+		return errDatabaseExists
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkLoaded returns errDatabaseExists unless the shard holds exactly db, a
+// freshly loaded part, and hasn't been written since it was loaded.
+func (sh *shard) checkLoaded(db *database) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	current, _, err := sh.getDB(context.Background())
+	if err != nil {
+		return err
+	}
+	// Every write increments the generation, and loading sets it to 1.
+	if current.Generation != db.Generation || len(current.Versions) != len(db.Versions) || !maps.Equal(current.Items, db.Items) {
+		return errDatabaseExists
+	}
+	return nil
+}
+
+// Migrate moves an unsharded database into shards. It first rewrites the
+// unsharded object in movedFormat, which stops servers that aren't sharded
+// from using it, and then copies its contents into any shards that don't
+// exist yet. Every sharded server migrates before serving, so if a server
+// crashes partway through, the next one to start finishes the job.
+func (s *storage) Migrate() error {
+	shards := s.shards()
+	if len(shards) == 1 {
+		return nil
+	}
+	ctx := context.Background()
+	legacy := &shard{store: s, key: s.name, count: 1}
+	db, err := legacy.markMoved(ctx, len(shards))
+	if err != nil || db == nil {
+		return err
+	}
+	if db.Shards != len(shards) {
+		return fmt.Errorf("database was moved into %d shards, but the server is configured with %d", db.Shards, len(shards))
+	}
+	return createParts(shards, db)
+}
+
+// markMoved rewrites the unsharded database object in movedFormat, recording
+// that its contents belong in n shards, and returns the final version of it.
+// If the object was already moved, it's left as it is, even if it was moved
+// into a different number of shards. It returns nil if there's no object.
+func (sh *shard) markMoved(ctx context.Context, n int) (*database, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for {
+		base, etag, err := sh.getDB(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if etag == "" {
+			return nil, nil // nothing to move
+		}
+		if base.Format == movedFormat {
+			return base, nil
+		}
+		db := base.clone()
+		db.Format = movedFormat
+		db.Shards = n
+		if err := sh.putDB(ctx, base, db, etag); errors.Is(err, errMismatchedETag) {
+			continue // a write raced with us, so start over
+		} else if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+}
+
+// createParts copies db, the final version of an unsharded database, into
+// any of the shards that don't exist yet. Shards that exist already hold the
+// same copy, perhaps updated since.
+func createParts(shards []*shard, db *database) error {
+	parts := split(shards, db)
+	for _, sh := range shards {
+		if err := sh.create(parts[sh]); err != nil && !errors.Is(err, errDatabaseExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// split divides an unsharded database into the parts belonging to each
+// shard. Every part keeps the database's generation, since fencing tokens
+// are generations, and they must keep increasing.
+func split(shards []*shard, db *database) map[*shard]*database {
+	parts := make(map[*shard]*database, len(shards))
+	for _, sh := range shards {
+		part := newDatabase()
+		part.Generation = db.Generation
+		part.Deleted = db.Deleted
+		parts[sh] = part
+	}
+	for key, val := range db.Items {
+		parts[shardIn(shards, key)].Items[key] = val
+	}
+	for key, hash := range db.Hashes {
+		parts[shardIn(shards, key)].Hashes[key] = hash
+	}
+	for key, list := range db.Lists {
+		parts[shardIn(shards, key)].Lists[key] = list
+	}
+	for key, members := range db.Sets {
+		parts[shardIn(shards, key)].Sets[key] = members
+	}
+	for key, z := range db.ZSets {
+		parts[shardIn(shards, key)].ZSets[key] = z
+	}
+	for key, at := range db.Expires {
+		parts[shardIn(shards, key)].Expires[key] = at
+	}
+	for key, v := range db.Versions {
+		parts[shardIn(shards, key)].Versions[key] = v
+	}
+	for name, l := range db.Leases {
+		parts[shardIn(shards, name)].Leases[name] = l
+	}
+	return parts
+}
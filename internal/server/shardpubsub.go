@@ -0,0 +1,249 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// Sharded pub/sub (SSUBSCRIBE, SUNSUBSCRIBE, and SPUBLISH) works as in Valkey
+// Cluster: each shard channel belongs to the hash slot of its name, and only
+// the node that owns the slot in the Topology accepts its subscribers and
+// messages, redirecting clients to it with MOVED. Since publishers and
+// subscribers meet on that node, messages are delivered directly, without the
+// relay's trip through object storage. Without a topology, every node owns
+// every slot, so messages are relayed between nodes just like PUBLISH's.
+//
+// redcon's PubSub only pushes "message" and "pmessage", so shard channels
+// have their own subscriptions. As with redcon's, a subscribed connection is
+// detached from the server, and from then on only SSUBSCRIBE, SUNSUBSCRIBE,
+// PING, and QUIT are allowed.
+
+var errCrossSlot = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+
+// A movedError redirects the client to the node that owns a hash slot.
+type movedError struct {
+	slot int
+	addr string
+}
+
+func (e *movedError) Error() string {
+	return fmt.Sprintf("%d %s", e.slot, e.addr)
+}
+
+// shardPubSub holds this node's subscriptions to shard channels.
+type shardPubSub struct {
+	mu    sync.Mutex
+	chans map[string]map[*shardSubscriber]bool
+}
+
+// A shardSubscriber is a connection subscribed to shard channels.
+type shardSubscriber struct {
+	conn redcon.DetachedConn
+	// chans are the connection's channels, guarded by the shardPubSub's
+	// mu. mu serializes writes to the connection.
+	chans map[string]bool
+	mu    sync.Mutex
+}
+
+// subscribe detaches the connection and subscribes it to the channels. From
+// then on, it serves the connection's commands itself, using check to
+// validate the channels of later subscriptions.
+func (ps *shardPubSub) subscribe(conn redcon.Conn, channels []string, check func([]string) error) {
+	sub := &shardSubscriber{conn: conn.Detach(), chans: make(map[string]bool)}
+	ps.add(sub, channels)
+	go ps.serve(sub, check)
+}
+
+func (ps *shardPubSub) add(sub *shardSubscriber, channels []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if ps.chans == nil {
+		ps.chans = make(map[string]map[*shardSubscriber]bool)
+	}
+	for _, channel := range channels {
+		if ps.chans[channel] == nil {
+			ps.chans[channel] = make(map[*shardSubscriber]bool)
+		}
+		ps.chans[channel][sub] = true
+		sub.chans[channel] = true
+		sub.conn.WriteArray(3)
+		sub.conn.WriteBulkString(string(op.SSubscribe))
+		sub.conn.WriteBulkString(channel)
+		sub.conn.WriteInt(len(sub.chans))
+	}
+	sub.conn.Flush()
+}
+
+// remove unsubscribes the connection from the channels, or from every
+// channel if there are none.
+func (ps *shardPubSub) remove(sub *shardSubscriber, channels []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if len(channels) == 0 {
+		channels = slices.Sorted(maps.Keys(sub.chans))
+	}
+	if len(channels) == 0 {
+		sub.conn.WriteArray(3)
+		sub.conn.WriteBulkString(string(op.SUnsubscribe))
+		sub.conn.WriteNull()
+		sub.conn.WriteInt(0)
+	}
+	for _, channel := range channels {
+		ps.drop(sub, channel)
+		sub.conn.WriteArray(3)
+		sub.conn.WriteBulkString(string(op.SUnsubscribe))
+		sub.conn.WriteBulkString(channel)
+		sub.conn.WriteInt(len(sub.chans))
+	}
+	sub.conn.Flush()
+}
+
+// drop unsubscribes the connection from a channel. The caller must hold mu.
+func (ps *shardPubSub) drop(sub *shardSubscriber, channel string) {
+	delete(sub.chans, channel)
+	delete(ps.chans[channel], sub)
+	if len(ps.chans[channel]) == 0 {
+		delete(ps.chans, channel)
+	}
+}
+
+// publish delivers a message to the channel's subscribers on this node,
+// returning how many received it.
+func (ps *shardPubSub) publish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for sub := range ps.chans[channel] {
+		sub.mu.Lock()
+		sub.conn.WriteArray(3)
+		sub.conn.WriteBulkString("smessage")
+		sub.conn.WriteBulkString(channel)
+		sub.conn.WriteBulkString(message)
+		sub.conn.Flush()
+		sub.mu.Unlock()
+	}
+	return len(ps.chans[channel])
+}
+
+// serve runs a subscribed connection's commands until it's closed.
+func (ps *shardPubSub) serve(sub *shardSubscriber, check func([]string) error) {
+	defer func() {
+		ps.mu.Lock()
+		for channel := range sub.chans {
+			ps.drop(sub, channel)
+		}
+		ps.mu.Unlock()
+		sub.conn.Close()
+	}()
+	// reply writes a reply to the connection, apart from any messages.
+	reply := func(write func(conn redcon.Conn)) {
+		sub.mu.Lock()
+		defer sub.mu.Unlock()
+		write(sub.conn)
+		sub.conn.Flush()
+	}
+	for {
+		cmd, err := sub.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		if len(cmd.Args) == 0 {
+			continue
+		}
+		name := op.New(cmd.Args[0])
+		args := make([]string, len(cmd.Args)-1)
+		for i, arg := range cmd.Args[1:] {
+			args[i] = string(arg)
+		}
+		switch {
+		case name == op.SSubscribe && len(args) == 0:
+			reply(func(conn redcon.Conn) { writeErrArity(conn, name) })
+		case name == op.SSubscribe:
+			if err := check(args); err != nil {
+				reply(func(conn redcon.Conn) { writeErr(conn, err) })
+				continue
+			}
+			ps.add(sub, args)
+		case name == op.SUnsubscribe:
+			ps.remove(sub, args)
+		case name == op.Ping && len(args) <= 1:
+			reply(func(conn redcon.Conn) {
+				conn.WriteArray(2)
+				conn.WriteBulkString("pong")
+				conn.WriteBulkString(strings.Join(args, ""))
+			})
+		case name == op.Ping:
+			reply(func(conn redcon.Conn) { writeErrArity(conn, name) })
+		case name == op.Quit:
+			reply(func(conn redcon.Conn) { conn.WriteString("OK") })
+			return
+		default:
+			reply(func(conn redcon.Conn) {
+				conn.WriteError(fmt.Sprintf("ERR Can't execute '%s': only SSUBSCRIBE / SUNSUBSCRIBE / PING / QUIT are allowed in this context", name))
+			})
+		}
+	}
+}
+
+// checkShardChannels returns an error unless the shard channels all belong to
+// the same hash slot, and this node owns it.
+func (s *Server) checkShardChannels(channels []string) error {
+	slot := keySlot(channels[0])
+	for _, channel := range channels[1:] {
+		if keySlot(channel) != slot {
+			return errCrossSlot
+		}
+	}
+	if s.topology == nil {
+		return nil
+	}
+	if owner := s.topology.owner(slot); owner.ID != s.nodeName {
+		return &movedError{slot: slot, addr: owner.Addr}
+	}
+	return nil
+}
+
+// ssubscribe handles SSUBSCRIBE shardchannel [shardchannel ...].
+func (s *Server) ssubscribe(conn redcon.Conn, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, op.SSubscribe)
+		return
+	}
+	if err := s.checkShardChannels(args); err != nil {
+		writeErr(conn, err)
+		return
+	}
+	s.relay.subscribeShard(conn, args, s.topology == nil, s.checkShardChannels)
+}
+
+// spublish handles SPUBLISH shardchannel message, which replies with the
+// number of subscribers on this node that received the message.
+func (s *Server) spublish(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.SPublish)
+		return
+	}
+	if err := s.checkShardChannels(args[:1]); err != nil {
+		writeErr(conn, err)
+		return
+	}
+	n, err := s.relay.publishShard(args[0], args[1], s.topology == nil)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
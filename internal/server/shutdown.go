@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// Shutdown shuts the server down gracefully. It stops accepting connections
+// and refuses new commands, but it leaves open connections alone until the
+// commands already running on them, including any retries of conflicting
+// writes, have finished and replied. It then stops background tasks, like
+// expiring keys and compacting logs, and waits for them too, so that no
+// write is abandoned between reading the database and conditionally writing
+// it back. Finally, it closes every connection.
+//
+// If ctx is done before everything finishes, Shutdown closes the server
+// abruptly, like Close, and returns ctx's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	idle := s.commands.drain()
+	s.serving.mu.Lock()
+	for _, ln := range s.serving.listeners {
+		ln.drain()
+	}
+	s.serving.mu.Unlock()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.stop()
+	if err == nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.tasks.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	return errors.Join(err, s.Close())
+}
+
+// commands tracks the commands running on a server, so that Shutdown can
+// wait for them.
+type commands struct {
+	mu       sync.Mutex
+	running  int
+	draining bool
+	idle     chan struct{} // closed when draining and nothing is running
+}
+
+// begin records that a command started, unless the server is shutting down.
+func (c *commands) begin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return false
+	}
+	c.running++
+	return true
+}
+
+// end records that a command finished.
+func (c *commands) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+	if c.draining && c.running == 0 {
+		close(c.idle)
+	}
+}
+
+// drain refuses new commands, returning a channel that's closed once the
+// running ones finish.
+func (c *commands) drain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.draining {
+		c.draining = true
+		c.idle = make(chan struct{})
+		if c.running == 0 {
+			close(c.idle)
+		}
+	}
+	return c.idle
+}
+
+// A drainListener lets Shutdown stop accepting connections without closing
+// the ones already accepted, which frontends do as soon as their listeners
+// fail. Draining closes the underlying listener, but Accept then blocks
+// until Close.
+type drainListener struct {
+	net.Listener
+	drained   chan struct{}
+	closed    chan struct{}
+	drainOnce sync.Once
+	closeOnce sync.Once
+}
+
+func newDrainListener(ln net.Listener) *drainListener {
+	return &drainListener{
+		Listener: ln,
+		drained:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener.
+func (l *drainListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.drained:
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+	}
+	return conn, err
+}
+
+// drain stops accepting connections.
+func (l *drainListener) drain() error {
+	var err error
+	l.drainOnce.Do(func() {
+		close(l.drained)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// Close implements net.Listener.
+func (l *drainListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.drain()
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// Limits on the slow operation log, which mirror Valkey's SLOWLOG defaults.
+const (
+	slowlogMaxEntries = 128
+	slowlogMaxArgs    = 32
+	slowlogMaxArgLen  = 128
+)
+
+// maxCommandStats limits the number of distinct commands INFO commandstats
+// reports. Unknown commands are counted too, so without a limit a client
+// sending random names could grow the table without bound.
+const maxCommandStats = 256
+
+// stats collects counters describing a single node's activity. They're
+// per-node rather than cluster-wide: nodes share only object storage, and
+// writing statistics there would add contention to the very write path
+// they're meant to measure.
+type stats struct {
+	started time.Time
+
+	connections         atomic.Int64 // currently open
+	connectionsReceived atomic.Int64
+	commands            atomic.Int64
+
+	// Enforcement of the per-connection limits (see limits.go).
+	rejectedConnections       atomic.Int64 // refused by MaxClients
+	rateLimited               atomic.Int64 // commands refused by MaxCommandRate
+	outputLimitDisconnections atomic.Int64 // closed by MaxOutputBuffer
+
+	// Round trips to object storage, by HTTP method. These count every
+	// request, including retries by the S3 client, whether it succeeded or
+	// not.
+	storageGets    atomic.Int64
+	storagePuts    atomic.Int64
+	storageHeads   atomic.Int64
+	storageDeletes atomic.Int64
+	storageOther   atomic.Int64
+	storageTime    atomic.Int64 // total nanoseconds spent on round trips
+
+	reads         atomic.Int64 // successful reads from object storage
+	cacheHits     atomic.Int64 // reads that found the cached database unchanged
+	writes        atomic.Int64 // successful conditional writes
+	mutations     atomic.Int64 // commands applied by successful writes
+	conflicts     atomic.Int64 // conditional writes rejected due to ETag mismatch
+	storageErrors atomic.Int64 // any other failed call to object storage
+	queuedWrites  atomic.Int64 // writes that waited for the node's write slot
+	queueWait     atomic.Int64 // total nanoseconds spent waiting for the slot
+	writeRetries  atomic.Int64 // batches reapplied after a conflict
+	// batches that failed with ErrTooMuchContention
+	writeRetriesExhausted atomic.Int64
+
+	// Write-ahead log compaction (see wal.go).
+	compactions      atomic.Int64 // snapshots written by compaction
+	compactedEntries atomic.Int64 // log entries folded into those snapshots
+	compactionErrors atomic.Int64 // failed compactions, other than conflicts
+	compactionTime   atomic.Int64 // total nanoseconds spent writing snapshots
+	lastCompaction   atomic.Int64 // Unix time of the last compaction
+	logDivergences   atomic.Int64 // shards whose log diverged from their snapshot
+
+	slowlog slowlog
+	hotKeys hotKeys // keys written by conflicting writes
+
+	cmdMu    sync.Mutex
+	cmdStats map[op.Op]*commandStat
+}
+
+// A commandStat is the number of calls to a single command and the time
+// they took.
+type commandStat struct {
+	calls int64
+	time  time.Duration
+}
+
+func newStats(slowThreshold time.Duration) *stats {
+	return &stats{
+		started:  time.Now(),
+		slowlog:  slowlog{threshold: slowThreshold},
+		cmdStats: make(map[op.Op]*commandStat),
+	}
+}
+
+// ConflictRate returns the fraction of conditional writes rejected by object
+// storage because another writer got there first.
+func (s *stats) ConflictRate() float64 {
+	conflicts := s.conflicts.Load()
+	attempts := s.writes.Load() + conflicts
+	if attempts == 0 {
+		return 0
+	}
+	return float64(conflicts) / float64(attempts)
+}
+
+// MeanQueueWait returns the average time writes spent waiting for this
+// node's write slot.
+func (s *stats) MeanQueueWait() time.Duration {
+	n := s.queuedWrites.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.queueWait.Load() / n)
+}
+
+// MeanBatchSize is the average number of commands applied by each write to
+// object storage.
+func (s *stats) MeanBatchSize() float64 {
+	n := s.writes.Load()
+	if n == 0 {
+		return 0
+	}
+	return float64(s.mutations.Load()) / float64(n)
+}
+
+func (s *stats) observeQueueWait(d time.Duration) {
+	s.queuedWrites.Add(1)
+	s.queueWait.Add(int64(d))
+}
+
+func (s *stats) observeCompaction(entries int64, d time.Duration) {
+	s.compactions.Add(1)
+	s.compactedEntries.Add(entries)
+	s.compactionTime.Add(int64(d))
+	s.lastCompaction.Store(time.Now().Unix())
+}
+
+// MeanCompactionTime returns the average time compaction took to write a
+// snapshot.
+func (s *stats) MeanCompactionTime() time.Duration {
+	n := s.compactions.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.compactionTime.Load() / n)
+}
+
+// observeEvent updates the statistics that depend on what writes did.
+func (s *stats) observeEvent(e event) {
+	if e.Kind == eventConflict {
+		s.hotKeys.Add(e.Keys)
+	}
+}
+
+// StorageRequests returns the number of round trips to object storage.
+func (s *stats) StorageRequests() int64 {
+	return s.storageGets.Load() + s.storagePuts.Load() + s.storageHeads.Load() +
+		s.storageDeletes.Load() + s.storageOther.Load()
+}
+
+// MeanStorageTime returns the average duration of a round trip to object
+// storage.
+func (s *stats) MeanStorageTime() time.Duration {
+	n := s.StorageRequests()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.storageTime.Load() / n)
+}
+
+// observeRequest records a round trip to object storage.
+func (s *stats) observeRequest(method string, d time.Duration) {
+	switch method {
+	case http.MethodGet:
+		s.storageGets.Add(1)
+	case http.MethodPut:
+		s.storagePuts.Add(1)
+	case http.MethodHead:
+		s.storageHeads.Add(1)
+	case http.MethodDelete:
+		s.storageDeletes.Add(1)
+	default:
+		s.storageOther.Add(1)
+	}
+	s.storageTime.Add(int64(d))
+}
+
+// observe records the execution of a single command by the named user.
+func (s *stats) observe(user string, args [][]byte, elapsed time.Duration) {
+	s.commands.Add(1)
+	name := op.New(args[0])
+	s.slowlog.Add(user, redact(name, args), elapsed)
+
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	cs, ok := s.cmdStats[name]
+	if !ok {
+		if len(s.cmdStats) >= maxCommandStats {
+			return
+		}
+		cs = &commandStat{}
+		s.cmdStats[name] = cs
+	}
+	cs.calls++
+	cs.time += elapsed
+}
+
+// CommandStats returns the calls to each command so far.
+func (s *stats) CommandStats() map[op.Op]commandStat {
+	s.cmdMu.Lock()
+	defer s.cmdMu.Unlock()
+	stats := make(map[op.Op]commandStat, len(s.cmdStats))
+	for name, cs := range s.cmdStats {
+		stats[name] = *cs
+	}
+	return stats
+}
+
+// A slowEntry is a single command that took longer than the slow log's
+// threshold.
+type slowEntry struct {
+	ID       int64
+	Time     time.Time
+	Duration time.Duration
+	User     string
+	Args     []string
+}
+
+// redact returns the arguments of a command to record in the slow log,
+// without any secrets: passwords in AUTH, HELLO, and ACL SETUSER, and
+// session tokens in RESUME.
+func redact(name op.Op, args [][]byte) [][]byte {
+	switch name {
+	case op.Auth, op.Hello, op.Resume:
+		return args[:1]
+	case op.ACL:
+		if len(args) > 3 && strings.EqualFold(string(args[1]), "setuser") {
+			return args[:3] // the user's name, but none of its rules
+		}
+	}
+	return args
+}
+
+// slowlog is a bounded, in-memory log of recent slow commands.
+type slowlog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	nextID  int64
+	entries []slowEntry // ring buffer, oldest entry at entries[nextID%len]
+}
+
+func (l *slowlog) Add(user string, args [][]byte, elapsed time.Duration) {
+	if l.threshold <= 0 || elapsed < l.threshold {
+		return
+	}
+	// Like Valkey, truncate the recorded arguments so that a handful of huge
+	// commands can't consume unbounded memory.
+	n := min(len(args), slowlogMaxArgs)
+	recorded := make([]string, n)
+	for i := range recorded {
+		arg := args[i]
+		if len(arg) > slowlogMaxArgLen {
+			arg = arg[:slowlogMaxArgLen]
+		}
+		recorded[i] = string(arg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := slowEntry{
+		ID:       l.nextID,
+		Time:     time.Now(),
+		Duration: elapsed,
+		User:     user,
+		Args:     recorded,
+	}
+	if len(l.entries) < slowlogMaxEntries {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.nextID%slowlogMaxEntries] = entry
+	}
+	l.nextID++
+}
+
+// Recent returns up to n slow log entries, newest first.
+func (l *slowlog) Recent(n int) []slowEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = min(n, len(l.entries))
+	recent := make([]slowEntry, 0, n)
+	for i := range n {
+		idx := (l.nextID - 1 - int64(i)) % int64(len(l.entries))
+		recent = append(recent, l.entries[idx])
+	}
+	return recent
+}
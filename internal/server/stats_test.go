@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"go.akshayshah.org/attest"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := slowlog{threshold: time.Millisecond}
+	for _, tt := range []struct {
+		user string
+		args []string
+	}{
+		{"alice", []string{"AUTH", "alice", "secret"}},
+		{"default", []string{"HELLO", "3", "AUTH", "alice", "secret"}},
+		{"admin", []string{"ACL", "SETUSER", "bob", "on", ">secret"}},
+		{"admin", []string{"ACL", "LIST"}},
+		{"bob", []string{"RESUME", "token"}},
+		{"bob", []string{"SET", "k", "v"}},
+	} {
+		args := make([][]byte, len(tt.args))
+		for i, arg := range tt.args {
+			args[i] = []byte(arg)
+		}
+		l.Add(tt.user, redact(op.New(args[0]), args), time.Second)
+	}
+	l.Add("bob", [][]byte{[]byte("GET"), []byte("fast")}, time.Microsecond)
+
+	entries := l.Recent(slowlogMaxEntries)
+	var recorded [][]string
+	for _, e := range entries {
+		recorded = append(recorded, e.Args)
+	}
+	attest.Equal(t, recorded, [][]string{
+		{"SET", "k", "v"},
+		{"RESUME"},
+		{"ACL", "LIST"},
+		{"ACL", "SETUSER", "bob"},
+		{"HELLO"},
+		{"AUTH"},
+	})
+
+	// Users whose access is restricted only see their own commands.
+	attest.Equal(t, len(slowEntries(l.Recent(slowlogMaxEntries), "admin", nil)), 6)
+	admin := &aclUser{AllKeys: true, AllCommands: true}
+	attest.Equal(t, len(slowEntries(l.Recent(slowlogMaxEntries), "admin", admin)), 6)
+	bob := &aclUser{AllKeys: true, AllCommands: true, Namespace: "bob"}
+	var mine []int64
+	for _, e := range slowEntries(l.Recent(slowlogMaxEntries), "bob", bob) {
+		mine = append(mine, e.ID)
+	}
+	attest.Equal(t, mine, []int64{5, 4})
+}
@@ -6,25 +6,611 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/antithesishq/valthree/internal/property"
+	"github.com/antithesishq/valthree/internal/set"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var errMismatchedETag = fmt.Errorf("mismatched ETags")
+var (
+	errMismatchedETag = fmt.Errorf("mismatched ETags")
+	errDatabaseExists = errors.New("database already exists")
+)
+
+// dbFormat identifies the current layout of the database object. Databases
+// written before the layout was versioned are a flat JSON object mapping keys
+// to values.
+const dbFormat = 1
+
+// movedFormat marks the unsharded database object after its contents have
+// been moved into shards. Servers that predate sharding refuse to read it,
+// so they can't keep writing to the old object.
+const movedFormat = 2
+
+// database is the whole Valthree database, stored as a single JSON object.
+type database struct {
+	Format int `json:"format"`
+	// Generation increases by one with every successful write, so it totally
+	// orders all the versions of the database (or, in a sharded database, of
+	// the shard).
+	Generation uint64 `json:"generation"`
+	// Items holds string values. Values of other types are kept in their own
+	// fields, and a key appears in at most one of them.
+	Items  map[string]string            `json:"items"`
+	Hashes map[string]map[string]string `json:"hashes,omitempty"`
+	Lists  map[string][]string          `json:"lists,omitempty"`
+	Sets   map[string]set.Set[string]   `json:"sets,omitempty"`
+	ZSets  map[string]zset              `json:"zsets,omitempty"`
+	Leases map[string]lease             `json:"leases,omitempty"`
+	// Expires maps keys to their expiration times, in Unix milliseconds.
+	Expires map[string]int64 `json:"expires,omitempty"`
+	// Versions maps keys to the generation of the write that last modified
+	// them. Deleting and recreating a key gives it a new, larger version.
+	Versions map[string]uint64 `json:"versions,omitempty"`
+	// Deleted is the generation of the last write that deleted a key.
+	// Deleted keys have no version, so WATCH needs it to notice a key that
+	// was created and then deleted again.
+	Deleted uint64 `json:"deleted,omitempty"`
+	// Shards is the number of shards in the database. It's omitted from
+	// unsharded databases.
+	Shards int `json:"shards,omitempty"`
+	// LogID is set once the shard's writes go to a write-ahead log (see
+	// wal.go). The object is then a snapshot as of log entry Sequence, and
+	// Entry is that entry's ID.
+	LogID    string `json:"log_id,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	Entry    string `json:"entry,omitempty"`
+
+	expired int  // keys expired when the database was read
+	flushed bool // set by FLUSHALL, so that it's reported as a flush event
+	// notifications are the keyspace notifications recorded by the current
+	// write (see notify.go).
+	notifications []event
+	// snapshot is the log entry that the shard object included when this
+	// version of the shard was read, in log mode.
+	snapshot uint64
+	// others is the number of the shard's keys that a view of only some of
+	// them leaves out (see stored).
+	others int
+	// changed are the keys modified by the current write, and quota is the
+	// running count of the quotas' usage, if the shard has any (see
+	// quotaCounter).
+	changed map[string]struct{}
+	quota   *quotaCounter
+}
+
+// binaryZMember is the stored form of a sorted set member that isn't valid
+// UTF-8.
+type binaryZMember struct {
+	Member []byte `json:"member"`
+	Score  string `json:"score"`
+}
+
+// MarshalJSON implements json.Marshaler. JSON strings must be valid UTF-8, so
+// values that aren't (like those written by BITFIELD) are stored separately
+// as base64.
+func (db *database) MarshalJSON() ([]byte, error) {
+	type plain database // no methods, so no recursion
+	out := struct {
+		*plain
+		Items        map[string]string            `json:"items"`
+		Binary       map[string][]byte            `json:"binary,omitempty"`
+		Hashes       map[string]map[string]string `json:"hashes,omitempty"`
+		BinaryHashes map[string]map[string][]byte `json:"binary_hashes,omitempty"`
+		Lists        map[string][]string          `json:"lists,omitempty"`
+		BinaryLists  map[string][][]byte          `json:"binary_lists,omitempty"`
+		Sets         map[string]set.Set[string]   `json:"sets,omitempty"`
+		BinarySets   map[string][][]byte          `json:"binary_sets,omitempty"`
+		ZSets        map[string]zset              `json:"zsets,omitempty"`
+		BinaryZSets  map[string][]binaryZMember   `json:"binary_zsets,omitempty"`
+	}{
+		plain:  (*plain)(db),
+		Items:  make(map[string]string, len(db.Items)),
+		Hashes: make(map[string]map[string]string, len(db.Hashes)),
+		Lists:  make(map[string][]string, len(db.Lists)),
+		Sets:   make(map[string]set.Set[string], len(db.Sets)),
+		ZSets:  make(map[string]zset, len(db.ZSets)),
+	}
+	for key, val := range db.Items {
+		if utf8.ValidString(val) {
+			out.Items[key] = val
+			continue
+		}
+		if out.Binary == nil {
+			out.Binary = make(map[string][]byte)
+		}
+		out.Binary[key] = []byte(val)
+	}
+	for key, hash := range db.Hashes {
+		out.Hashes[key] = make(map[string]string, len(hash))
+		for field, val := range hash {
+			if utf8.ValidString(val) {
+				out.Hashes[key][field] = val
+				continue
+			}
+			if out.BinaryHashes == nil {
+				out.BinaryHashes = make(map[string]map[string][]byte)
+			}
+			if out.BinaryHashes[key] == nil {
+				out.BinaryHashes[key] = make(map[string][]byte)
+			}
+			out.BinaryHashes[key][field] = []byte(val)
+		}
+	}
+	for key, list := range db.Lists {
+		if !slices.ContainsFunc(list, func(val string) bool { return !utf8.ValidString(val) }) {
+			out.Lists[key] = list
+			continue
+		}
+		if out.BinaryLists == nil {
+			out.BinaryLists = make(map[string][][]byte)
+		}
+		for _, val := range list {
+			out.BinaryLists[key] = append(out.BinaryLists[key], []byte(val))
+		}
+	}
+	for key, members := range db.Sets {
+		sorted := members.Sorted()
+		if !slices.ContainsFunc(sorted, func(m string) bool { return !utf8.ValidString(m) }) {
+			out.Sets[key] = members
+			continue
+		}
+		if out.BinarySets == nil {
+			out.BinarySets = make(map[string][][]byte)
+		}
+		for _, m := range sorted {
+			out.BinarySets[key] = append(out.BinarySets[key], []byte(m))
+		}
+	}
+	for key, z := range db.ZSets {
+		if !slices.ContainsFunc(z, func(m zmember) bool { return !utf8.ValidString(m.Member) }) {
+			out.ZSets[key] = z
+			continue
+		}
+		if out.BinaryZSets == nil {
+			out.BinaryZSets = make(map[string][]binaryZMember)
+		}
+		for _, m := range z {
+			out.BinaryZSets[key] = append(out.BinaryZSets[key], binaryZMember{[]byte(m.Member), formatScore(m.Score)})
+		}
+	}
+	return json.Marshal(out)
+}
+
+func newDatabase() *database {
+	return &database{
+		Format:   dbFormat,
+		Items:    make(map[string]string),
+		Hashes:   make(map[string]map[string]string),
+		Lists:    make(map[string][]string),
+		Sets:     make(map[string]set.Set[string]),
+		ZSets:    make(map[string]zset),
+		Leases:   make(map[string]lease),
+		Expires:  make(map[string]int64),
+		Versions: make(map[string]uint64),
+	}
+}
+
+// setItem sets the value of a key and records the current generation as its
+// version. Like SET, it replaces a value of any type, but it leaves any TTL in
+// place.
+func (db *database) setItem(key, val string) {
+	delete(db.Hashes, key)
+	delete(db.Lists, key)
+	delete(db.Sets, key)
+	delete(db.ZSets, key)
+	db.Items[key] = val
+	db.touch(key)
+}
 
+// touch records that the current write modified key, giving it the write's
+// generation as its version.
+func (db *database) touch(key string) {
+	db.Versions[key] = db.Generation
+	db.noteChange(key)
+}
+
+// noteChange records that the current write modified or deleted key, so that
+// quota usage can be updated without scanning the database (see
+// quotaCounter).
+func (db *database) noteChange(key string) {
+	if db.changed == nil {
+		db.changed = make(map[string]struct{})
+	}
+	db.changed[key] = struct{}{}
+}
+
+// typeOf returns the type of a key's value, as reported by TYPE, or "none" if
+// the key doesn't exist.
+func (db *database) typeOf(key string) string {
+	if _, ok := db.Items[key]; ok {
+		return "string"
+	}
+	if _, ok := db.Hashes[key]; ok {
+		return "hash"
+	}
+	if _, ok := db.Lists[key]; ok {
+		return "list"
+	}
+	if _, ok := db.Sets[key]; ok {
+		return "set"
+	}
+	if _, ok := db.ZSets[key]; ok {
+		return "zset"
+	}
+	return "none"
+}
+
+// checkType returns ErrWrongType if the key holds a value that isn't of the
+// wanted type. Missing keys have every type.
+func (db *database) checkType(key, want string) error {
+	if typ := db.typeOf(key); typ != want && typ != "none" {
+		return ErrWrongType
+	}
+	return nil
+}
+
+// exists reports whether a key holds a value of any type.
+func (db *database) exists(key string) bool {
+	return db.typeOf(key) != "none"
+}
+
+// len returns the number of keys, of all types, in the database.
+func (db *database) len() int {
+	return len(db.Items) + len(db.Hashes) + len(db.Lists) + len(db.Sets) + len(db.ZSets)
+}
+
+// stored returns the number of keys in the shard that db is part of, which
+// is what MaxItems limits. It's len, unless db is a view of only some of the
+// shard's keys, like a namespace's.
+func (db *database) stored() int {
+	return db.len() + db.others
+}
+
+// keys iterates over the keys of all types, in no particular order.
+func (db *database) keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range db.Items {
+			if !yield(key) {
+				return
+			}
+		}
+		for key := range db.Hashes {
+			if !yield(key) {
+				return
+			}
+		}
+		for key := range db.Lists {
+			if !yield(key) {
+				return
+			}
+		}
+		for key := range db.Sets {
+			if !yield(key) {
+				return
+			}
+		}
+		for key := range db.ZSets {
+			if !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// size returns the number of bytes in a key's value. For hashes, that's the
+// total size of the fields and their values, for lists and sets it's the
+// total size of the elements, and for sorted sets it's the total size of the
+// members and their 8-byte scores.
+func (db *database) size(key string) int {
+	if val, ok := db.Items[key]; ok {
+		return len(val)
+	}
+	var n int
+	for field, val := range db.Hashes[key] {
+		n += len(field) + len(val)
+	}
+	for _, val := range db.Lists[key] {
+		n += len(val)
+	}
+	for m := range db.Sets[key] {
+		n += len(m)
+	}
+	for _, m := range db.ZSets[key] {
+		n += len(m.Member) + 8
+	}
+	return n
+}
+
+// clone returns a deep copy of the database.
+func (db *database) clone() *database {
+	c := *db
+	c.Items = maps.Clone(db.Items)
+	c.Hashes = make(map[string]map[string]string, len(db.Hashes))
+	for key, hash := range db.Hashes {
+		c.Hashes[key] = maps.Clone(hash)
+	}
+	c.Lists = make(map[string][]string, len(db.Lists))
+	for key, list := range db.Lists {
+		c.Lists[key] = slices.Clone(list)
+	}
+	c.Sets = make(map[string]set.Set[string], len(db.Sets))
+	for key, members := range db.Sets {
+		c.Sets[key] = members.Clone()
+	}
+	// Sorted sets are never modified in place, so they can be shared.
+	c.ZSets = maps.Clone(db.ZSets)
+	c.Leases = maps.Clone(db.Leases)
+	c.Expires = maps.Clone(db.Expires)
+	c.Versions = maps.Clone(db.Versions)
+	c.notifications = slices.Clone(db.notifications)
+	c.changed = maps.Clone(db.changed)
+	return &c
+}
+
+// deleteItem removes a key, along with its TTL and version.
+func (db *database) deleteItem(key string) {
+	delete(db.Items, key)
+	delete(db.Hashes, key)
+	delete(db.Lists, key)
+	delete(db.Sets, key)
+	delete(db.ZSets, key)
+	delete(db.Expires, key)
+	delete(db.Versions, key)
+	db.Deleted = db.Generation
+	db.noteChange(key)
+}
+
+// decodeDatabase parses the database object, transparently upgrading
+// databases written in the legacy, unversioned format.
+func decodeDatabase(r io.Reader) (*database, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	db := newDatabase()
+	var format int
+	if err := json.Unmarshal(raw["format"], &format); err != nil || format == 0 {
+		// Legacy databases only contain string values, so a "format" key (if
+		// present) won't parse as an integer.
+		for key, val := range raw {
+			var s string
+			if err := json.Unmarshal(val, &s); err != nil {
+				return nil, fmt.Errorf("legacy key %q: %v", key, err)
+			}
+			db.Items[key] = s
+		}
+		return db, nil
+	}
+	if format != dbFormat && format != movedFormat {
+		return nil, fmt.Errorf("unknown database format %d", format)
+	}
+	db.Format = format
+	for field, dst := range map[string]any{
+		"shards":     &db.Shards,
+		"generation": &db.Generation,
+		"items":      &db.Items,
+		"hashes":     &db.Hashes,
+		"lists":      &db.Lists,
+		"sets":       &db.Sets,
+		"zsets":      &db.ZSets,
+		"leases":     &db.Leases,
+		"expires":    &db.Expires,
+		"versions":   &db.Versions,
+		"deleted":    &db.Deleted,
+		"log_id":     &db.LogID,
+		"sequence":   &db.Sequence,
+		"entry":      &db.Entry,
+	} {
+		if val, ok := raw[field]; ok {
+			if err := json.Unmarshal(val, dst); err != nil {
+				return nil, fmt.Errorf("%s: %v", field, err)
+			}
+		}
+	}
+	if db.Items == nil {
+		db.Items = make(map[string]string)
+	}
+	if val, ok := raw["binary"]; ok {
+		var binary map[string][]byte
+		if err := json.Unmarshal(val, &binary); err != nil {
+			return nil, fmt.Errorf("binary: %v", err)
+		}
+		for key, val := range binary {
+			db.Items[key] = string(val)
+		}
+	}
+	if db.Hashes == nil {
+		db.Hashes = make(map[string]map[string]string)
+	}
+	if val, ok := raw["binary_hashes"]; ok {
+		var binary map[string]map[string][]byte
+		if err := json.Unmarshal(val, &binary); err != nil {
+			return nil, fmt.Errorf("binary_hashes: %v", err)
+		}
+		for key, fields := range binary {
+			if db.Hashes[key] == nil {
+				db.Hashes[key] = make(map[string]string, len(fields))
+			}
+			for field, val := range fields {
+				db.Hashes[key][field] = string(val)
+			}
+		}
+	}
+	if db.Lists == nil {
+		db.Lists = make(map[string][]string)
+	}
+	if val, ok := raw["binary_lists"]; ok {
+		var binary map[string][][]byte
+		if err := json.Unmarshal(val, &binary); err != nil {
+			return nil, fmt.Errorf("binary_lists: %v", err)
+		}
+		for key, vals := range binary {
+			list := make([]string, len(vals))
+			for i, val := range vals {
+				list[i] = string(val)
+			}
+			db.Lists[key] = list
+		}
+	}
+	if db.Sets == nil {
+		db.Sets = make(map[string]set.Set[string])
+	}
+	if val, ok := raw["binary_sets"]; ok {
+		var binary map[string][][]byte
+		if err := json.Unmarshal(val, &binary); err != nil {
+			return nil, fmt.Errorf("binary_sets: %v", err)
+		}
+		for key, members := range binary {
+			s := make(set.Set[string], len(members))
+			for _, m := range members {
+				s.Add(string(m))
+			}
+			db.Sets[key] = s
+		}
+	}
+	if db.ZSets == nil {
+		db.ZSets = make(map[string]zset)
+	}
+	if val, ok := raw["binary_zsets"]; ok {
+		var binary map[string][]binaryZMember
+		if err := json.Unmarshal(val, &binary); err != nil {
+			return nil, fmt.Errorf("binary_zsets: %v", err)
+		}
+		for key, members := range binary {
+			z := make(zset, len(members))
+			for i, m := range members {
+				score, err := parseScore(m.Score)
+				if err != nil {
+					return nil, fmt.Errorf("binary_zsets: %v", err)
+				}
+				z[i] = zmember{string(m.Member), score}
+			}
+			db.ZSets[key] = z
+		}
+	}
+	if db.Leases == nil {
+		db.Leases = make(map[string]lease)
+	}
+	if db.Expires == nil {
+		db.Expires = make(map[string]int64)
+	}
+	if db.Versions == nil {
+		db.Versions = make(map[string]uint64)
+	}
+	// Keys written before versions were tracked were last modified no later
+	// than the current generation, and any later write gets a larger one.
+	for key := range db.keys() {
+		if _, ok := db.Versions[key]; !ok {
+			db.Versions[key] = db.Generation
+		}
+	}
+	return db, nil
+}
+
+// storage is the S3-backed database. Small databases are stored as a single
+// object, but the database may also be split into shards (see shard.go).
 type storage struct {
 	timeout time.Duration
 	bucket  string
 	name    string
+	quotas  []Quota
 
-	mu     sync.Mutex // serializing ops reduces retries
 	client *s3.Client
+	stats  *stats
+	events eventBus
+	// layout holds the shards. It's only replaced if the database is
+	// promoted to shards (see promote.go).
+	layout atomic.Pointer[[]*shard]
+	// autoShards is the number of shards an unsharded database may be
+	// promoted to, or zero if it may not be. moveMu serializes following
+	// a promotion.
+	autoShards int
+	moveMu     sync.Mutex
+	// unsafe is set if object storage failed Probe. Conditional writes are
+	// the basis of Valthree's consistency, so without them we refuse to
+	// write at all, unless emulate is set.
+	unsafe error
+	// emulate is set if object storage failed Probe but the server is
+	// configured to emulate conditional writes (see emulate.go).
+	emulate bool
+	// batchInterval is how long writes wait to be batched together.
+	batchInterval time.Duration
+	// wal is set if shards should switch to a write-ahead log (see wal.go).
+	wal        bool
+	compaction compactPolicy
+	// retries decides how conflicting writes are retried.
+	retries retryPolicy
+	// skew is added to the wall clock (see Config.ClockSkew).
+	skew time.Duration
+	// values is set if write events should include the keys' new values,
+	// which only Hooks need.
+	values bool
+	// access tracks this node's use of each key (see object.go).
+	access accessTracker
+	// tasks tracks the work that writes leave running in the background,
+	// like compacting a log. In a server, it's the server's own tasks, so
+	// Shutdown waits for it.
+	tasks *sync.WaitGroup
+}
+
+// now returns the time as this node perceives it, which decides when keys
+// and lock leases expire.
+func (s *storage) now() time.Time {
+	return time.Now().Add(s.skew)
+}
+
+// A shard is a single database object. Each shard serializes its own writes,
+// so writes to different shards proceed independently.
+type shard struct {
+	store *storage
+	key   string // object key
+	count int    // number of shards in the database
+
+	// Serializing ops reduces retries, and granting the lock in FIFO order
+	// keeps slow clients from starving. This only orders writers on one
+	// node; writers on different nodes still race via conditional writes.
+	mu fifoMutex
+	// cached is the body of the shard object as of the last read, guarded by
+	// mu. Reads revalidate it with a conditional GET, so an unchanged shard
+	// isn't downloaded again.
+	cached cachedObject
+	// state is the latest version of the shard this node has read or
+	// written, in log mode, guarded by mu. Replaying continues from it.
+	state *database
+	// logEntries is the number of log entries since the snapshot, as of
+	// state, for reporting.
+	logEntries atomic.Uint64
+	// quota counts the quotas' usage in the version of the shard this node
+	// last wrote, guarded by mu (see quotaCounter).
+	quota *quotaCounter
+	// puts and conflicts count this node's attempts to write the shard and
+	// those that lost a race, which decide whether to promote it to shards.
+	puts      atomic.Uint64
+	conflicts atomic.Uint64
+
+	// pending are the writes waiting for the next batch (see batch.go).
+	pendingMu sync.Mutex
+	pending   []*pendingWrite
+}
+
+type cachedObject struct {
+	etag string
+	body []byte
 }
 
 func (s *storage) EnsureBucketExists() error {
@@ -40,46 +626,233 @@ func (s *storage) EnsureBucketExists() error {
 	return err
 }
 
-func (s *storage) MutateDB(f func(map[string]string) (int, error)) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// BucketExists returns an error if the bucket doesn't exist yet. Unlike
+// EnsureBucketExists, it doesn't need permission to write.
+func (s *storage) BucketExists() error {
+	_, err := s.client.HeadBucket(context.Background(), &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
 
-	for {
-		items, etag, err := s.getDB()
+// apply runs a batch of mutations, in order, and writes the result to object
+// storage in a single conditional PUT. Mutations that fail are rolled back
+// without affecting the rest of the batch. If the PUT loses a race with
+// another node, the batch is reapplied to the new database, as the store's
+// retry policy allows. The caller must hold mu.
+func (sh *shard) apply(ctx context.Context, batch []*pendingWrite) {
+	for attempts := 1; ; attempts++ {
+		base, etag, err := sh.getDB(ctx)
+		if err == nil {
+			err = sh.check(base)
+		}
 		if err != nil {
-			return 0, err
+			for _, w := range batch {
+				w.n, w.err = 0, err
+			}
+			return
+		}
+		db := base
+		if base.LogID != "" {
+			// Log entries record the difference from base.
+			db = base.clone()
 		}
+		db.quota = sh.countQuotas(db)
+		// Keys that expired are deleted by this write, so the first write
+		// that succeeds reports their deletion.
+		versions := maps.Clone(db.Versions)
+		db.expired = db.expire(sh.store.now())
+		if db.quota != nil {
+			db.quota.update(db)
+		}
+		db.changed = nil
 
-		n, err := f(items)
-		if err != nil {
-			return 0, err
+		var applied int64
+		for _, w := range batch {
+			var before *database
+			if len(batch) > 1 {
+				before = db.clone()
+			}
+			if versions == nil {
+				versions = maps.Clone(db.Versions)
+			}
+			leases := maps.Clone(db.Leases)
+			db.flushed = false
+			db.notifications = nil
+			// Callers may rely on the generation of the write they're making
+			// (for example, to issue fencing tokens), so increment it before
+			// calling f.
+			db.Generation++
+			w.n, w.err = sh.applyOne(db, w.f)
+			if w.err != nil {
+				if before != nil {
+					db = before
+				}
+				continue
+			}
+			w.events = changes(versions, leases, db, sh.store.values)
+			versions = nil
+			applied++
+		}
+		if applied == 0 {
+			// Every write was rolled back, so the count is still of the
+			// version read.
+			sh.quota = db.quota
+			return
+		}
+
+		err = sh.putDB(ctx, base, db, etag)
+		sh.puts.Add(1)
+		if err == nil && db.quota != nil {
+			db.quota.logID, db.quota.generation = db.LogID, db.Generation
+			sh.quota = db.quota
 		}
+		if errors.Is(err, errMismatchedETag) {
+			sh.conflicts.Add(1)
+			for _, w := range batch {
+				if w.err == nil {
+					sh.store.events.Publish(event{Kind: eventConflict, Keys: w.keys})
+				}
+			}
+			if sh.store.retries.exhausted(attempts) {
+				sh.store.stats.writeRetriesExhausted.Add(1)
+				err = fmt.Errorf("%w (%d attempts)", ErrTooMuchContention, attempts)
+			} else if err = sh.store.retries.backoff(ctx, attempts); err == nil {
+				sh.store.stats.writeRetries.Add(1)
+				trace.SpanFromContext(ctx).AddEvent("write conflict, retrying")
+				continue
+			}
+		}
+		for _, w := range batch {
+			if w.err == nil && err != nil {
+				w.n, w.err = 0, err
+			}
+		}
+		if err == nil {
+			sh.store.stats.mutations.Add(applied)
+			for _, w := range batch {
+				if w.err == nil {
+					sh.store.events.Publish(w.events...)
+				}
+			}
+		}
+		return
+	}
+}
 
-		err = s.setDB(items, etag)
-		if err != nil && !errors.Is(err, errMismatchedETag) {
-			return 0, err
-		} else if err == nil {
-			return n, nil
+func (sh *shard) applyOne(db *database, f func(*database) (int, error)) (int, error) {
+	var mark int
+	var before []quotaUsage
+	if db.quota != nil {
+		mark = len(db.quota.journal)
+		before = slices.Clone(db.quota.used)
+	}
+	n, err := f(db)
+	// Enforcing quotas here, rather than in each command, guarantees that no
+	// write path can bypass them.
+	if err == nil && db.quota != nil {
+		db.quota.update(db)
+		err = checkQuotas(sh.store.quotas, before, db.quota.used)
+	}
+	db.changed = nil
+	if err != nil {
+		if db.quota != nil {
+			// Transactions apply each command in turn, so this may undo the
+			// changes they counted too.
+			db.quota.rollback(mark)
 		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// countQuotas returns the running count of the quotas' usage in db, a
+// version of the shard that was just read: the count kept since this node's
+// last write, if it's of the same version, or a new one. The shard doesn't
+// keep the count again until a write succeeds. The caller must hold mu.
+func (sh *shard) countQuotas(db *database) *quotaCounter {
+	if len(sh.store.quotas) == 0 {
+		return nil
 	}
+	c := sh.quota
+	sh.quota = nil
+	if c == nil || c.logID != db.LogID || c.generation != db.Generation {
+		c = newQuotaCounter(sh.store.quotas, db)
+	}
+	c.journal = nil
+	return c
 }
 
-func (s *storage) GetDB() (map[string]string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (sh *shard) get(ctx context.Context) (*database, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	items, _, err := s.getDB()
-	return items, err
+	db, _, err := sh.getDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db.expired = db.expire(sh.store.now())
+	return db, sh.check(db)
 }
 
-func (s *storage) getDB() (map[string]string, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+// check verifies that the database object was written with the same number
+// of shards that the server is configured to use. An unsharded database that
+// was promoted to shards is reported with errDatabaseMoved, if the server
+// can follow it.
+func (sh *shard) check(db *database) error {
+	if sh.count == 1 && db.Shards > 1 && sh.store.autoShards > 1 {
+		return errDatabaseMoved
+	}
+	if n := max(db.Shards, 1); n != sh.count {
+		return fmt.Errorf("database has %d shards, but the server is configured with %d", n, sh.count)
+	}
+	return nil
+}
+
+// getDB reads the shard and returns it, along with the ETag of its object
+// (or an empty string if there's no object yet). Expired keys are still
+// present. The caller must hold mu.
+func (sh *shard) getDB(ctx context.Context) (*database, string, error) {
+	for {
+		db, etag, err := sh.getObject(ctx)
+		if err != nil || db.LogID == "" {
+			return db, etag, err
+		}
+		db, ok, err := sh.replay(ctx, db, etag)
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			return db, etag, nil
+		}
+	}
+}
+
+// getObject reads the shard object. The caller must hold mu.
+func (sh *shard) getObject(ctx context.Context) (*database, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, sh.store.timeout)
 	defer cancel()
 
-	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.name),
-	})
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(sh.store.bucket),
+		Key:    aws.String(sh.key),
+	}
+	if sh.cached.etag != "" {
+		input.IfNoneMatch = aws.String(sh.cached.etag)
+	}
+	res, err := sh.store.client.GetObject(ctx, input)
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified {
+		// The database hasn't changed since we last read it. Decoding
+		// mustn't fail, since it succeeded before.
+		db, err := decodeDatabase(bytes.NewReader(sh.cached.body))
+		if err != nil {
+			return nil, "", fmt.Errorf("unmarshal cached: %v", err)
+		}
+		sh.store.stats.reads.Add(1)
+		sh.store.stats.cacheHits.Add(1)
+		return db, sh.cached.etag, nil
+	}
 	if err != nil {
 		var errNoKey *types.NoSuchKey
 		if errors.As(err, &errNoKey) {
@@ -89,55 +862,79 @@ func (s *storage) getDB() (map[string]string, string, error) {
 			//
 			// If our random workload hasn't exercised this logic, it's not thorough
 			// enough and we should fail the Antithesis run.
-			assert.Reachable("Exercised GET or DEL before database creation", nil)
-			return make(map[string]string), "", nil
+			property.MissingDatabaseReached()
+			sh.cached = cachedObject{}
+			sh.store.stats.reads.Add(1)
+			db := newDatabase()
+			if sh.count > 1 {
+				db.Shards = sh.count
+			}
+			return db, "", nil
 		}
 		// Adequate fault injection would make reads from object storage fail
 		// sometimes, even if the object exists.
-		assert.Reachable("Exercised failures reading from object storage", nil)
-		return nil, "", fmt.Errorf("get object: %v", err)
+		property.ReadFailureReached()
+		sh.store.stats.storageErrors.Add(1)
+		return nil, "", fmt.Errorf("%w: get object: %v", ErrStorageUnavailable, err)
 	}
 	defer res.Body.Close()
 	if res.ETag == nil || *res.ETag == "" {
 		// With our client configuration, we believe that this branch is
 		// unreachable. If Antithesis can force us into this branch, fail the run.
-		assert.Unreachable("Database always has an ETag", nil)
+		property.ETagMissing()
 		return nil, "", errors.New("response has no etag")
 	}
-	items := make(map[string]string)
-	if err := json.NewDecoder(res.Body).Decode(&items); err != nil {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		sh.store.stats.storageErrors.Add(1)
+		return nil, "", fmt.Errorf("%w: read object: %v", ErrStorageUnavailable, err)
+	}
+	db, err := decodeDatabase(bytes.NewReader(body))
+	if err != nil {
 		// If we reach this branch, the write path is broken - we should never have
 		// invalid JSON in object storage.
-		assert.Unreachable("Database in object storage is always valid JSON", nil)
+		property.StoredDatabaseInvalid(map[string]any{"error": err.Error()})
 		return nil, "", fmt.Errorf("unmarshal: %v", err)
 	}
-	return items, *res.ETag, nil
+	sh.store.stats.reads.Add(1)
+	sh.cached = cachedObject{etag: *res.ETag, body: body}
+	return db, *res.ETag, nil
 }
 
-func (s *storage) setDB(items map[string]string, etag string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+func (sh *shard) setDB(ctx context.Context, db *database, etag string) error {
+	if err := sh.store.unsafe; err != nil {
+		return fmt.Errorf("refusing writes: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, sh.store.timeout)
 	defer cancel()
 
-	bs, err := json.Marshal(items)
+	if sh.count > 1 {
+		db.Shards = sh.count
+	}
+	bs, err := json.Marshal(db)
 	if err != nil {
 		// Our tests and workloads only send valid UTF-8, so this should be
 		// unreachable.
-		assert.Unreachable("Database in memory is always valid JSON", nil)
+		property.DatabaseUnencodable(map[string]any{"error": err.Error()})
 		return fmt.Errorf("marshal JSON: %v", err)
 	}
 
 	input := &s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.name),
-		Body:   bytes.NewReader(bs),
+		Bucket:   aws.String(sh.store.bucket),
+		Key:      aws.String(sh.key),
+		Body:     bytes.NewReader(bs),
+		Metadata: db.metadata(),
 	}
 	if etag == "" {
 		input.IfNoneMatch = aws.String("*")
 	} else {
 		input.IfMatch = aws.String(etag)
 	}
+	if sh.store.emulate {
+		return sh.emulatedPut(ctx, input, etag)
+	}
 
-	_, err = s.client.PutObject(ctx, input)
+	_, err = sh.store.client.PutObject(ctx, input)
 	if err != nil {
 		var apiErr smithy.APIError
 		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
@@ -145,12 +942,23 @@ func (s *storage) setDB(items map[string]string, etag string) error {
 			// branch, we must set the If-None-Match or If-Match headers properly,
 			// which ensures that writes are serialized. Antithesis must exercise
 			// this code path.
-			assert.Reachable("Exercised optimistic concurrency control rollback", nil)
+			property.ConflictReached()
+			sh.store.stats.conflicts.Add(1)
+			return errMismatchedETag
+		}
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ConditionalRequestConflict" {
+			// S3 rejects conditional writes that race with another in-flight
+			// write to the same object, rather than deciding between them.
+			// This write didn't apply, so it's retried like one that lost
+			// the race.
+			sh.store.stats.conflicts.Add(1)
 			return errMismatchedETag
 		}
 		// Of course, we should also exercise other errors in the write path.
-		assert.Reachable("Exercised failures writing to object storage", nil)
-		return fmt.Errorf("put object: %v", err)
+		property.WriteFailureReached()
+		sh.store.stats.storageErrors.Add(1)
+		return fmt.Errorf("%w: put object: %v", ErrStorageUnavailable, err)
 	}
+	sh.store.stats.writes.Add(1)
 	return nil
 }
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// maxStringSize matches Valkey's limit of 512MiB strings.
+const maxStringSize = 512 << 20
+
+var (
+	errOffsetRange = errors.New("offset is out of range")
+	errStringSize  = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+)
+
+// getset handles GETSET key value, which is SET key value GET: it replaces
+// the key's value, and any TTL, and replies with the previous value.
+func (s *Server) getset(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.GetSet)
+		return
+	}
+	old, _, err := s.setString(args[0], args[1], setOptions{get: true})
+	switch {
+	case err != nil:
+		writeErr(conn, err)
+	case old == "":
+		conn.WriteNull()
+	default:
+		conn.WriteBulkString(old)
+	}
+}
+
+// setex handles SETEX key seconds value and PSETEX key milliseconds value,
+// which are SET key value EX seconds and SET key value PX milliseconds.
+func (s *Server) setex(conn redcon.Conn, name op.Op, args []string, unit time.Duration) {
+	if len(args) != 3 {
+		writeErrArity(conn, name)
+		return
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	if n <= 0 || n > int64(math.MaxInt64/unit) {
+		writeErr(conn, fmt.Errorf("invalid expire time in '%s' command", name))
+		return
+	}
+	_, _, err = s.setString(args[0], args[2], setOptions{ttl: time.Duration(n) * unit})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteString("OK")
+}
+
+// setnx handles SETNX key value, which is SET key value NX, except that it
+// replies with 1 if it set the key and 0 if it didn't.
+func (s *Server) setnx(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.SetNX)
+		return
+	}
+	_, applied, err := s.setString(args[0], args[1], setOptions{nx: true})
+	switch {
+	case err != nil:
+		writeErr(conn, err)
+	case applied:
+		conn.WriteInt(1)
+	default:
+		conn.WriteInt(0)
+	}
+}
+
+// appendCmd handles APPEND key value, which appends to a string, creating it
+// if it doesn't exist, and replies with its new length. Like Valkey, it keeps
+// any TTL.
+func (s *Server) appendCmd(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.Append)
+		return
+	}
+	key, suffix := args[0], args[1]
+	var n int
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		val, ok := db.Items[key]
+		if !ok && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		if len(val)+len(suffix) > maxStringSize {
+			return 0, errStringSize
+		}
+		val += suffix
+		if val == "" {
+			// See setString.
+			return 0, errors.New("empty value")
+		}
+		n = len(val)
+		db.setItem(key, val)
+		db.notify('$', "append", key)
+		return 0, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// strlen handles STRLEN key, which replies with the length of a string, or
+// zero if it doesn't exist.
+func (s *Server) strlen(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.Strlen)
+		return
+	}
+	val, _, err := s.getString(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(len(val))
+}
+
+// setrange handles SETRANGE key offset value, which overwrites part of a
+// string starting at offset, padding it with zero bytes if it's too short,
+// and replies with its new length. Like APPEND, it keeps any TTL.
+func (s *Server) setrange(conn redcon.Conn, args []string) {
+	if len(args) != 3 {
+		writeErrArity(conn, op.SetRange)
+		return
+	}
+	key, patch := args[0], args[2]
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	if offset < 0 {
+		writeErr(conn, errOffsetRange)
+		return
+	}
+	if patch != "" && offset+int64(len(patch)) > maxStringSize {
+		writeErr(conn, errStringSize)
+		return
+	}
+
+	var n int
+	_, err = s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		val, ok := db.Items[key]
+		n = len(val)
+		if patch == "" {
+			// Nothing changes, and a missing key isn't created.
+			return 0, errNotApplied
+		}
+		if !ok && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		end := int(offset) + len(patch)
+		if end > len(val) {
+			val += strings.Repeat("\x00", end-len(val))
+		}
+		val = val[:offset] + patch + val[end:]
+		n = len(val)
+		db.setItem(key, val)
+		db.notify('$', "setrange", key)
+		return 0, nil
+	})
+	if err != nil && !errors.Is(err, errNotApplied) {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// getrange handles GETRANGE key start end, which replies with the bytes of a
+// string from start to end, inclusive. Negative offsets count back from the
+// end of the string. Missing keys are empty strings.
+func (s *Server) getrange(conn redcon.Conn, args []string) {
+	if len(args) != 3 {
+		writeErrArity(conn, op.GetRange)
+		return
+	}
+	start, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	end, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	val, _, err := s.getString(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteBulkString(substring(val, start, end))
+}
+
+// substring returns the bytes of val from start to end, inclusive, with
+// Valkey's rules for negative and out-of-range offsets.
+func substring(val string, start, end int64) string {
+	n := int64(len(val))
+	if start < 0 && end < 0 && start > end {
+		return ""
+	}
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+	if start > end || n == 0 {
+		return ""
+	}
+	return val[start : end+1]
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Every node shares the whole database through object storage, so any node
+// can serve any key. A Topology still assigns each hash slot to one node, as
+// in Valkey Cluster, so that cluster-aware clients send each key's commands
+// to the same node, where concurrent writes share PUTs instead of racing on
+// ETags. Shard channels are the exception: a node only serves the shard
+// channels in its own slots (see shardpubsub.go). Until nodes can join and
+// leave a running cluster, the topology is static: every node loads the same
+// file at startup.
+
+// numSlots is the number of hash slots, the same as in Valkey Cluster.
+const numSlots = 16384
+
+// A Topology describes the nodes of a cluster and the slots each one owns.
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+}
+
+// A TopologyNode is one node in a Topology.
+type TopologyNode struct {
+	// ID identifies the node. Each node finds itself in the topology by
+	// its NodeName.
+	ID string `json:"id"`
+	// Addr is the address clients connect to, as host:port.
+	Addr string `json:"addr"`
+	// AdminAddr is the node's admin dashboard address, if it has one.
+	AdminAddr string `json:"admin_addr,omitempty"`
+	// Slots are the hash slots the node owns. Nodes may own no slots.
+	Slots []SlotRange `json:"slots,omitempty"`
+}
+
+// A SlotRange is an inclusive range of hash slots, written in JSON as a
+// two-element array like [0, 8191].
+type SlotRange [2]int
+
+func (r SlotRange) String() string {
+	if r[0] == r[1] {
+		return strconv.Itoa(r[0])
+	}
+	return fmt.Sprintf("%d-%d", r[0], r[1])
+}
+
+// LoadTopology reads a Topology from a JSON file and validates it.
+func LoadTopology(path string) (*Topology, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var t Topology
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("parse cluster config %s: %v", path, err)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config %s: %v", path, err)
+	}
+	return &t, nil
+}
+
+// Validate checks that every node has a unique ID and a valid address, and
+// that every slot is owned by exactly one node.
+func (t *Topology) Validate() error {
+	if len(t.Nodes) == 0 {
+		return errors.New("no nodes")
+	}
+	ids := make(map[string]bool, len(t.Nodes))
+	owners := make([]string, numSlots)
+	for _, node := range t.Nodes {
+		if node.ID == "" || strings.ContainsAny(node.ID, " \t\r\n") {
+			return fmt.Errorf("invalid node ID %q", node.ID)
+		}
+		if ids[node.ID] {
+			return fmt.Errorf("duplicate node ID %q", node.ID)
+		}
+		ids[node.ID] = true
+		if _, _, err := splitAddr(node.Addr); err != nil {
+			return fmt.Errorf("node %s: %v", node.ID, err)
+		}
+		for _, r := range node.Slots {
+			if r[0] < 0 || r[1] >= numSlots || r[0] > r[1] {
+				return fmt.Errorf("node %s: invalid slot range %v", node.ID, r)
+			}
+			for slot := r[0]; slot <= r[1]; slot++ {
+				if owners[slot] != "" {
+					return fmt.Errorf("slot %d is owned by both %s and %s", slot, owners[slot], node.ID)
+				}
+				owners[slot] = node.ID
+			}
+		}
+	}
+	for slot, owner := range owners {
+		if owner == "" {
+			return fmt.Errorf("slot %d isn't owned by any node", slot)
+		}
+	}
+	return nil
+}
+
+// Node returns the node with the given ID.
+func (t *Topology) Node(id string) (TopologyNode, bool) {
+	for _, node := range t.Nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return TopologyNode{}, false
+}
+
+// owner returns the node that owns a hash slot.
+func (t *Topology) owner(slot int) TopologyNode {
+	for _, node := range t.Nodes {
+		for _, r := range node.Slots {
+			if r[0] <= slot && slot <= r[1] {
+				return node
+			}
+		}
+	}
+	return TopologyNode{} // unreachable in a valid topology
+}
+
+// peerAdminAddrs returns the admin dashboard addresses of every node but
+// self.
+func (t *Topology) peerAdminAddrs(self string) []string {
+	var addrs []string
+	for _, node := range t.Nodes {
+		if node.ID != self && node.AdminAddr != "" {
+			addrs = append(addrs, node.AdminAddr)
+		}
+	}
+	return addrs
+}
+
+// splitAddr splits a node's address into its host and port.
+func splitAddr(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in address %q", addr)
+	}
+	return host, port, nil
+}
+
+// keySlot returns a key's hash slot, computed as in Valkey Cluster so that
+// clients route keys the same way for both.
+func keySlot(key string) int {
+	return int(crc16(hashTag(key)) % numSlots)
+}
+
+// crc16 computes the CRC-16/XMODEM checksum Valkey Cluster uses for slots.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
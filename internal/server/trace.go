@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The server traces its work with OpenTelemetry, using whichever tracer
+// provider is registered globally (by default, one that discards spans).
+// Every RESP command has a span, and each request to object storage is a
+// child span of the command that made it, so retries and timeouts show up in
+// the command's trace. Writes batched together share one PUT, made by the
+// first command in the batch: the PUT's "write batch" span links to the
+// other commands' spans, and theirs link back.
+var tracer = otel.Tracer("github.com/antithesishq/valthree/internal/server")
+
+// startCommand starts the span for a RESP command in the command's context.
+func (s *Server) startCommand(ctx context.Context, conn redcon.Conn, name op.Op) (context.Context, trace.Span) {
+	operation := strings.ToUpper(string(name))
+	return tracer.Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "valkey"),
+			attribute.String("db.operation.name", operation),
+			attribute.String("db.namespace", s.store.name),
+			attribute.String("client.address", conn.RemoteAddr()),
+			attribute.String("valthree.node", s.nodeName),
+		),
+	)
+}
+
+// startRequest starts the span for a request to object storage, returning
+// the request to send in its context.
+func startRequest(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "S3 "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	return req.WithContext(ctx), span
+}
+
+// endRequest ends a request's span with its outcome.
+func endRequest(span trace.Span, res *http.Response, err error) {
+	defer span.End()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode >= 400 {
+		// Some of these are expected, like 412 Precondition Failed when a
+		// conditional write loses a race, but they're still failed requests.
+		span.SetStatus(codes.Error, res.Status)
+	}
+}
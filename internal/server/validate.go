@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/antithesishq/valthree/internal/op"
+)
+
+// ReservedPrefix is reserved for Valthree's internal bookkeeping (locks,
+// leases, change data capture, and the like). Clients may not read or write
+// keys with this prefix, so internal objects can never collide with user
+// data.
+const ReservedPrefix = "valthree:"
+
+// A KeyCharset restricts the characters allowed in keys.
+type KeyCharset string
+
+const (
+	// KeyCharsetAny allows arbitrary bytes, like Valkey.
+	KeyCharsetAny KeyCharset = "any"
+	// KeyCharsetUTF8 allows any valid UTF-8.
+	KeyCharsetUTF8 KeyCharset = "utf8"
+	// KeyCharsetPrintable allows printable, non-space ASCII.
+	KeyCharsetPrintable KeyCharset = "printable"
+)
+
+// ParseKeyCharset validates a user-supplied charset name.
+func ParseKeyCharset(s string) (KeyCharset, error) {
+	switch cs := KeyCharset(s); cs {
+	case "", KeyCharsetAny:
+		return KeyCharsetAny, nil
+	case KeyCharsetUTF8, KeyCharsetPrintable:
+		return cs, nil
+	default:
+		return "", fmt.Errorf("unknown key charset %q", s)
+	}
+}
+
+// validateKey checks a key against the server's validation rules.
+func (s *Server) validateKey(key string) error {
+	if strings.HasPrefix(key, ReservedPrefix) {
+		return fmt.Errorf("key uses reserved prefix '%s'", ReservedPrefix)
+	}
+	if s.maxKeyLength > 0 && len(key) > s.maxKeyLength {
+		return fmt.Errorf("key longer than %d bytes", s.maxKeyLength)
+	}
+	switch s.keyCharset {
+	case KeyCharsetUTF8:
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("key is not valid UTF-8")
+		}
+	case KeyCharsetPrintable:
+		for _, r := range key {
+			if r > unicode.MaxASCII || !unicode.IsPrint(r) || r == ' ' {
+				return fmt.Errorf("key contains non-printable or non-ASCII characters")
+			}
+		}
+	}
+	return nil
+}
+
+// commandKeys returns the arguments of a command that are keys. Like the key
+// specifications in Valkey's COMMAND output, this lets the server apply
+// key-based policies in one place rather than in every handler.
+func commandKeys(name op.Op, args []string) []string {
+	switch name {
+	case op.Get, op.GetDel, op.GetEx, op.GetAt, op.Set, op.Del, op.BitField, op.BitFieldRO,
+		op.GetSet, op.Append, op.Strlen, op.SetRange, op.GetRange,
+		op.SetEx, op.PSetEx, op.SetNX,
+		op.Incr, op.Decr, op.IncrBy, op.DecrBy,
+		op.Expire, op.PExpire, op.TTL, op.PTTL, op.Persist,
+		op.VGet, op.VSet, op.Type,
+		op.Dump, op.Restore,
+		op.HSet, op.HGet, op.HDel, op.HGetAll, op.HExists, op.HLen, op.HRandField,
+		op.LPush, op.RPush, op.LPop, op.RPop, op.LLen, op.LRange,
+		op.SAdd, op.SRem, op.SMembers, op.SIsMember, op.SCard, op.SRandMember,
+		op.ZAdd, op.ZRem, op.ZScore, op.ZCard, op.ZRange, op.ZPopMin, op.ZPopMax,
+		op.Lock, op.Unlock:
+		if len(args) > 0 {
+			return args[:1]
+		}
+	case op.MGet, op.Exists, op.Watch:
+		return args
+	case op.Rename, op.RenameNX, op.Copy:
+		if len(args) > 1 {
+			return args[:2]
+		}
+	case op.Object:
+		if len(args) > 1 {
+			return args[1:2]
+		}
+	case op.Eval, op.EvalSha, op.FCall, op.FCallRO:
+		if len(args) > 1 {
+			if n, err := strconv.Atoi(args[1]); err == nil && n >= 0 && n <= len(args)-2 {
+				return args[2 : 2+n]
+			}
+		}
+	case op.Load, op.MSet:
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case op.LoadIf:
+		keys := make([]string, 0, len(args)/3)
+		for i := 0; i < len(args); i += 3 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		maxLength int
+		charset   KeyCharset
+		key       string
+		valid     bool
+	}{
+		{0, KeyCharsetAny, "", true},
+		{0, KeyCharsetAny, strings.Repeat("k", 1<<20), true},
+		{0, KeyCharsetAny, "\x00\xff \n", true},
+		{0, KeyCharsetAny, "valthree:lock", false},
+		{0, KeyCharsetAny, "VALTHREE:lock", true},
+		{0, KeyCharsetAny, "valthree", true},
+		{4, KeyCharsetAny, "", true},
+		{4, KeyCharsetAny, "four", true},
+		{4, KeyCharsetAny, "fives", false},
+		{4, KeyCharsetAny, "é", true}, // two bytes
+		{4, KeyCharsetAny, "éé", true},
+		{4, KeyCharsetAny, "ééé", false},
+		{0, KeyCharsetUTF8, "", true},
+		{0, KeyCharsetUTF8, "ключ 🔑", true},
+		{0, KeyCharsetUTF8, "\xff", false},
+		{0, KeyCharsetUTF8, "\xc3", false}, // truncated
+		{0, KeyCharsetPrintable, "", true},
+		{0, KeyCharsetPrintable, "user:{1}~!", true},
+		{0, KeyCharsetPrintable, "a b", false},
+		{0, KeyCharsetPrintable, "a\tb", false},
+		{0, KeyCharsetPrintable, "a\x7f", false},
+		{0, KeyCharsetPrintable, "é", false},
+		{0, KeyCharsetPrintable, "\xff", false},
+		{1, KeyCharsetPrintable, "valthree:", false},
+	}
+	for _, tt := range tests {
+		s := &Server{maxKeyLength: tt.maxLength, keyCharset: tt.charset}
+		err := s.validateKey(tt.key)
+		opt := attest.Sprintf("key %q with max length %d and charset %s", tt.key, tt.maxLength, tt.charset)
+		if tt.valid {
+			attest.Ok(t, err, opt)
+		} else {
+			attest.Error(t, err, opt)
+		}
+	}
+}
+
+func TestParseKeyCharset(t *testing.T) {
+	for in, want := range map[string]KeyCharset{
+		"":          KeyCharsetAny,
+		"any":       KeyCharsetAny,
+		"utf8":      KeyCharsetUTF8,
+		"printable": KeyCharsetPrintable,
+	} {
+		got, err := ParseKeyCharset(in)
+		attest.Ok(t, err)
+		attest.Equal(t, got, want)
+	}
+	for _, in := range []string{"ascii", "UTF8", "utf-8"} {
+		_, err := ParseKeyCharset(in)
+		attest.Error(t, err, attest.Sprintf("charset %q", in))
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+// vget handles VGET key, which replies with the key's value and version, or
+// null if the key doesn't exist. A key's version is the generation of the
+// write that last modified it, so it changes whenever the value does.
+func (s *Server) vget(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.VGet)
+		return
+	}
+	key := args[0]
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	if err := db.checkType(key, "string"); err != nil {
+		writeErr(conn, err)
+		return
+	}
+	val, ok := db.Items[key]
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(2)
+	conn.WriteBulkString(val)
+	conn.WriteUint64(db.Versions[key])
+}
+
+// vset handles VSET key version value, which sets the key only if its current
+// version matches. Version 0 means that the key must not exist. On success,
+// it replies with the key's new version; otherwise, it replies with null and
+// leaves the key unchanged. Together with VGET, this lets clients implement
+// optimistic concurrency control without server-side WATCH bookkeeping.
+func (s *Server) vset(conn redcon.Conn, args []string) {
+	if len(args) != 3 {
+		writeErrArity(conn, op.VSet)
+		return
+	}
+	key, val := args[0], args[2]
+	want, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	if val == "" {
+		writeErr(conn, fmt.Errorf("empty value")) // see setString
+		return
+	}
+
+	var version uint64
+	_, err = s.kv.MutateKey(key, func(db *database) (int, error) {
+		if err := db.checkType(key, "string"); err != nil {
+			return 0, err
+		}
+		_, ok := db.Items[key]
+		var current uint64
+		if ok {
+			current = db.Versions[key]
+		}
+		if current != want {
+			return 0, errNotApplied
+		}
+		if !ok && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		db.setItem(key, val)
+		delete(db.Expires, key) // like SET
+		version = db.Generation
+		return 0, nil
+	})
+	if errors.Is(err, errNotApplied) {
+		conn.WriteNull()
+		return
+	} else if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteUint64(version)
+}
+
+// A loadItem is one key of a LOADIF batch.
+type loadItem struct {
+	key     string
+	version uint64
+	val     string
+}
+
+// loadif handles LOADIF key version value [key version value ...], which sets
+// each key only if its current version matches, as in VSET: version 0 means
+// that the key must not exist. Unlike LOAD, it works on databases that
+// already have keys, and unlike a transaction of VSETs, a mismatch only skips
+// that key. It replies with a map from each skipped key to its current
+// version (0 if it doesn't exist), so running the same batch again reports
+// every key as a conflict and writes nothing. Keys holding other types are
+// always skipped.
+//
+// Keys on the same shard are checked and set atomically, in a single write.
+// A batch spanning shards is applied one shard at a time, so if one shard's
+// write fails, the others may still have been applied.
+func (s *Server) loadif(conn redcon.Conn, args []string) {
+	if len(args) == 0 || len(args)%3 != 0 {
+		writeErrArity(conn, op.LoadIf)
+		return
+	}
+	var (
+		items  []loadItem
+		shards []*shard
+		groups = make(map[*shard][]loadItem)
+	)
+	for i := 0; i < len(args); i += 3 {
+		version, err := strconv.ParseUint(args[i+1], 10, 64)
+		if err != nil {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		if args[i+2] == "" {
+			writeErr(conn, fmt.Errorf("empty value")) // see setString
+			return
+		}
+		item := loadItem{key: args[i], version: version, val: args[i+2]}
+		items = append(items, item)
+		sh := s.store.shardFor(item.key)
+		if _, ok := groups[sh]; !ok {
+			shards = append(shards, sh)
+		}
+		groups[sh] = append(groups[sh], item)
+	}
+
+	conflicts := make(map[string]uint64)
+	for _, sh := range shards {
+		group := groups[sh]
+		keys := make([]string, len(group))
+		for i, item := range group {
+			keys[i] = item.key
+		}
+		var skipped map[string]uint64
+		_, err := s.kv.MutateKeys(keys, func(db *database) (int, error) {
+			// Start over on every attempt, since a conflicting write may
+			// have changed the versions.
+			skipped = make(map[string]uint64)
+			var applied int
+			for _, item := range group {
+				var current uint64
+				if db.exists(item.key) {
+					current = db.Versions[item.key]
+				}
+				if current != item.version || db.checkType(item.key, "string") != nil {
+					skipped[item.key] = current
+					continue
+				}
+				if current == 0 && db.stored() >= s.maxItems() {
+					return 0, s.errAtCapacity()
+				}
+				db.setItem(item.key, item.val)
+				delete(db.Expires, item.key) // like SET
+				db.notify('$', "set", item.key)
+				applied++
+			}
+			if applied == 0 {
+				return 0, errNotApplied // nothing to write
+			}
+			return 0, nil
+		})
+		if err != nil && !errors.Is(err, errNotApplied) {
+			writeErr(conn, err)
+			return
+		}
+		maps.Copy(conflicts, skipped)
+	}
+
+	// Report conflicts in the order the keys were supplied.
+	writeMap(conn, len(conflicts))
+	for _, item := range items {
+		if current, ok := conflicts[item.key]; ok {
+			conn.WriteBulkString(item.key)
+			conn.WriteUint64(current)
+			delete(conflicts, item.key) // in case the key is repeated
+		}
+	}
+}
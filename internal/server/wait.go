@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var errNegativeTimeout = errors.New("timeout is negative")
+
+// wait handles WAIT numreplicas timeout, which in Valkey blocks until the
+// connection's earlier writes have reached numreplicas replicas, and replies
+// with how many did. Valthree replies to a write only once object storage
+// has acknowledged it, with a conditional PUT of the database or shard, or of
+// a write-ahead log entry, so by the time WAIT runs every earlier write is
+// durable and visible to every primary. Replicas, though, refresh from object
+// storage on their own schedule without telling primaries, so no primary
+// knows which replicas have seen a write. Like a Valkey primary without
+// replicas, WAIT therefore always replies with 0, and since waiting would
+// never change that, it replies at once.
+func (s *Server) wait(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.Wait)
+		return
+	}
+	if _, err := strconv.ParseInt(args[0], 10, 64); err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	timeout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeErr(conn, errNotAnInteger)
+		return
+	}
+	if timeout < 0 {
+		writeErr(conn, errNegativeTimeout)
+		return
+	}
+	conn.WriteInt(0)
+}
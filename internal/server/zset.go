@@ -0,0 +1,511 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/antithesishq/valthree/internal/op"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	errNotAFloat      = errors.New("value is not a valid float")
+	errBoundNotAFloat = errors.New("min or max is not a float")
+	errNXAndXX        = errors.New("XX and NX options at the same time are not compatible")
+	errNXAndGTOrLT    = errors.New("GT, LT, and/or NX options at the same time are not compatible")
+	errLimitNeedsBy   = errors.New("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errNotPositive    = errors.New("value is out of range, must be positive")
+)
+
+// zmember is a member of a sorted set and its score.
+type zmember struct {
+	Member string
+	Score  float64
+}
+
+// zmemberJSON is the stored form of a zmember. Scores are strings because
+// JSON numbers can't represent the infinite scores Valkey allows.
+type zmemberJSON struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m zmember) MarshalJSON() ([]byte, error) {
+	return json.Marshal(zmemberJSON{m.Member, formatScore(m.Score)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *zmember) UnmarshalJSON(data []byte) error {
+	var raw zmemberJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	score, err := parseScore(raw.Score)
+	if err != nil {
+		return fmt.Errorf("member %q: %v", raw.Member, err)
+	}
+	*m = zmember{raw.Member, score}
+	return nil
+}
+
+// zset is a sorted set, stored as its members in order. Like Valkey, it
+// orders members by score and breaks ties by comparing the members
+// themselves. Looking up a member scans the whole set, which is fine for
+// the small sets Valthree is meant to hold.
+//
+// Methods never modify a zset in place, since it may be shared with a
+// previous version of the database.
+type zset []zmember
+
+func compareZMembers(a, b zmember) int {
+	return cmp.Or(cmp.Compare(a.Score, b.Score), strings.Compare(a.Member, b.Member))
+}
+
+// score returns a member's score, reporting whether it's in the set.
+func (z zset) score(member string) (float64, bool) {
+	for _, m := range z {
+		if m.Member == member {
+			return m.Score, true
+		}
+	}
+	return 0, false
+}
+
+// with returns the set with the member's score updated or, if the member
+// isn't already in the set, with the member added.
+func (z zset) with(member string, score float64) zset {
+	out := z.without(member)
+	m := zmember{member, score}
+	i, _ := slices.BinarySearchFunc(out, m, compareZMembers)
+	return slices.Insert(out, i, m)
+}
+
+// without returns the set without a member.
+func (z zset) without(member string) zset {
+	return slices.DeleteFunc(slices.Clone(z), func(m zmember) bool {
+		return m.Member == member
+	})
+}
+
+// formatScore formats a score the way Valkey replies with it.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a score, which may be infinite but not NaN.
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errNotAFloat
+	}
+	return score, nil
+}
+
+// zset returns the sorted set stored at key, or nil if the key doesn't
+// exist. It returns ErrWrongType if the key holds a value of another type.
+func (db *database) zset(key string) (zset, error) {
+	if err := db.checkType(key, "zset"); err != nil {
+		return nil, err
+	}
+	return db.ZSets[key], nil
+}
+
+// setZSet replaces the sorted set stored at key. Like Valkey, it deletes the
+// key when the set is empty.
+func (db *database) setZSet(key string, z zset) {
+	if len(z) == 0 {
+		db.deleteItem(key)
+		return
+	}
+	db.ZSets[key] = z
+	db.touch(key)
+}
+
+// zadd handles ZADD key [NX|XX] [GT|LT] [CH] score member [score member ...],
+// which replies with the number of members added or, with CH, the number
+// added or updated. NX only adds new members and XX only updates existing
+// ones; GT and LT only update scores that would increase or decrease.
+func (s *Server) zadd(conn redcon.Conn, args []string) {
+	if len(args) < 3 {
+		writeErrArity(conn, op.ZAdd)
+		return
+	}
+	key := args[0]
+	var nx, xx, gt, lt, ch bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		writeErr(conn, errSyntax)
+		return
+	case nx && xx:
+		writeErr(conn, errNXAndXX)
+		return
+	case nx && (gt || lt), gt && lt:
+		writeErr(conn, errNXAndGTOrLT)
+		return
+	}
+	scores := make([]float64, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := parseScore(pairs[i])
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		scores = append(scores, score)
+	}
+
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		z, err := db.zset(key)
+		if err != nil {
+			return 0, err
+		}
+		if z == nil && !xx && db.stored() >= s.maxItems() {
+			return 0, s.errAtCapacity()
+		}
+		var added, changed int
+		for i, score := range scores {
+			member := pairs[2*i+1]
+			old, ok := z.score(member)
+			switch {
+			case ok && (nx || old == score || gt && score < old || lt && score > old):
+				continue
+			case !ok && xx:
+				continue
+			case !ok:
+				added++
+			}
+			changed++
+			z = z.with(member, score)
+		}
+		if changed > 0 {
+			db.setZSet(key, z)
+		}
+		if ch {
+			return changed, nil
+		}
+		return added, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// zrem handles ZREM key member [member ...], which replies with the number of
+// members removed. Like Valkey, it deletes the key along with its last member.
+func (s *Server) zrem(conn redcon.Conn, args []string) {
+	if len(args) < 2 {
+		writeErrArity(conn, op.ZRem)
+		return
+	}
+	key := args[0]
+	n, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		z, err := db.zset(key)
+		if err != nil || z == nil {
+			return 0, err
+		}
+		var removed int
+		for _, member := range args[1:] {
+			if _, ok := z.score(member); ok {
+				z = z.without(member)
+				removed++
+			}
+		}
+		if removed > 0 {
+			db.setZSet(key, z)
+		}
+		return removed, nil
+	})
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(n)
+}
+
+// zpop handles ZPOPMIN key [count] and ZPOPMAX key [count], which remove up
+// to count members (by default, one) with the lowest or highest scores. They
+// reply with the members and their scores, lowest first for ZPOPMIN and
+// highest first for ZPOPMAX, alternating in a flat array. In RESP3, a reply
+// to a command with a count pairs each member with its score instead, as in
+// Valkey. Like ZREM, they delete the key along with its last member.
+func (s *Server) zpop(conn redcon.Conn, name op.Op, args []string) {
+	if len(args) == 0 {
+		writeErrArity(conn, name)
+		return
+	}
+	if len(args) > 2 {
+		writeErr(conn, errSyntax)
+		return
+	}
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		if n < 0 {
+			writeErr(conn, errNotPositive)
+			return
+		}
+		count = n
+	}
+	key := args[0]
+
+	var popped zset
+	_, err := s.kv.MutateKey(key, func(db *database) (int, error) {
+		popped = nil
+		z, err := db.zset(key)
+		if err != nil {
+			return 0, err
+		}
+		n := min(count, len(z))
+		if n == 0 {
+			return 0, errNotApplied
+		}
+		if name == op.ZPopMin {
+			popped = slices.Clone(z[:n])
+			db.setZSet(key, z[n:])
+		} else {
+			popped = slices.Clone(z[len(z)-n:])
+			slices.Reverse(popped)
+			db.setZSet(key, z[:len(z)-n])
+		}
+		return n, nil
+	})
+	if err != nil && !errors.Is(err, errNotApplied) {
+		writeErr(conn, err)
+		return
+	}
+
+	if _, resp3 := conn.(resp3Conn); resp3 && len(args) == 2 {
+		conn.WriteArray(len(popped))
+		for _, m := range popped {
+			conn.WriteArray(2)
+			conn.WriteBulkString(m.Member)
+			writeDouble(conn, m.Score)
+		}
+		return
+	}
+	conn.WriteArray(2 * len(popped))
+	for _, m := range popped {
+		conn.WriteBulkString(m.Member)
+		writeDouble(conn, m.Score)
+	}
+}
+
+// zscore handles ZSCORE key member, which replies with the member's score or
+// null.
+func (s *Server) zscore(conn redcon.Conn, args []string) {
+	if len(args) != 2 {
+		writeErrArity(conn, op.ZScore)
+		return
+	}
+	z, err := s.getZSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	score, ok := z.score(args[1])
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	writeDouble(conn, score)
+}
+
+// zcard handles ZCARD key, which replies with the number of members in the
+// sorted set.
+func (s *Server) zcard(conn redcon.Conn, args []string) {
+	if len(args) != 1 {
+		writeErrArity(conn, op.ZCard)
+		return
+	}
+	z, err := s.getZSet(args[0])
+	if err != nil {
+		writeErr(conn, err)
+		return
+	}
+	conn.WriteInt(len(z))
+}
+
+// zrange handles ZRANGE key start stop [BYSCORE] [REV] [LIMIT offset count]
+// [WITHSCORES]. By default, start and stop are inclusive offsets into the
+// sorted set, and negative offsets count from the end. With BYSCORE, they're
+// the minimum and maximum scores instead, which are exclusive if prefixed
+// with "(" and may be "-inf" or "+inf". REV reverses the order, so with both
+// REV and BYSCORE, start is the maximum score and stop is the minimum.
+func (s *Server) zrange(conn redcon.Conn, args []string) {
+	if len(args) < 3 {
+		writeErrArity(conn, op.ZRange)
+		return
+	}
+	var byScore, rev, withScores, limited bool
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE":
+			byScore = true
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				writeErr(conn, errSyntax)
+				return
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				writeErr(conn, errNotAnInteger)
+				return
+			}
+			limited = true
+			i += 2
+		default:
+			writeErr(conn, errSyntax)
+			return
+		}
+	}
+	if limited && !byScore {
+		writeErr(conn, errLimitNeedsBy)
+		return
+	}
+
+	var members zset
+	if byScore {
+		lo, hi := args[1], args[2]
+		if rev {
+			lo, hi = hi, lo
+		}
+		minScore, minExcl, err1 := parseBound(lo)
+		maxScore, maxExcl, err2 := parseBound(hi)
+		if err1 != nil || err2 != nil {
+			writeErr(conn, errBoundNotAFloat)
+			return
+		}
+		z, err := s.getZSet(args[0])
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		for _, m := range z {
+			if m.Score > minScore || m.Score == minScore && !minExcl {
+				if m.Score < maxScore || m.Score == maxScore && !maxExcl {
+					members = append(members, m)
+				}
+			}
+		}
+		if rev {
+			slices.Reverse(members)
+		}
+		if offset < 0 || offset >= len(members) {
+			members = nil
+		} else {
+			members = members[offset:]
+			if count >= 0 && count < len(members) {
+				members = members[:count]
+			}
+		}
+	} else {
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			writeErr(conn, errNotAnInteger)
+			return
+		}
+		z, err := s.getZSet(args[0])
+		if err != nil {
+			writeErr(conn, err)
+			return
+		}
+		if rev {
+			z = slices.Clone(z)
+			slices.Reverse(z)
+		}
+		if start < 0 {
+			start = max(len(z)+start, 0)
+		}
+		if stop < 0 {
+			stop = len(z) + stop
+		}
+		stop = min(stop, len(z)-1)
+		if start <= stop {
+			members = z[start : stop+1]
+		}
+	}
+
+	switch _, resp3 := conn.(resp3Conn); {
+	case !withScores:
+		conn.WriteArray(len(members))
+		for _, m := range members {
+			conn.WriteBulkString(m.Member)
+		}
+	case resp3:
+		// RESP3 pairs each member with its score.
+		conn.WriteArray(len(members))
+		for _, m := range members {
+			conn.WriteArray(2)
+			conn.WriteBulkString(m.Member)
+			writeDouble(conn, m.Score)
+		}
+	default:
+		conn.WriteArray(2 * len(members))
+		for _, m := range members {
+			conn.WriteBulkString(m.Member)
+			writeDouble(conn, m.Score)
+		}
+	}
+}
+
+// parseBound parses a score range bound for ZRANGE BYSCORE, reporting whether
+// it's exclusive.
+func parseBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	score, err := parseScore(strings.TrimPrefix(s, "("))
+	return score, exclusive, err
+}
+
+// getZSet reads the sorted set stored at key. Missing keys are empty sets.
+func (s *Server) getZSet(key string) (zset, error) {
+	db, err := s.kv.GetKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return db.zset(key)
+}
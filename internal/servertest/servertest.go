@@ -2,92 +2,507 @@
 package servertest
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/antithesishq/valthree/internal/client"
 	"github.com/antithesishq/valthree/internal/server"
+	"github.com/antithesishq/valthree/internal/simstore"
 	"github.com/testcontainers/testcontainers-go/modules/minio"
 	"go.akshayshah.org/attest"
 )
 
+// CompactMaxEntries is the length at which the cluster's servers compact a
+// shard's write-ahead log as part of the write that reaches it.
+const CompactMaxEntries = 32
+
+// An Option configures a cluster created by NewCluster.
+type Option func(*clusterConfig)
+
+type clusterConfig struct {
+	tls      bool
+	password string
+	wal      bool
+	skews    []time.Duration
+	latency  time.Duration
+	topology bool
+	hooks    []server.Hooks
+	limits   Limits
+	attempts int
+	timeouts server.CommandTimeouts
+	debug    bool
+	sweep    time.Duration
+	quotas   []server.Quota
+	replicas []int
+	refresh  time.Duration
+	sim      *simstore.Store
+	dbs      int
+	shards   int
+	// autoShards, autoBytes, and autoInterval configure automatic
+	// promotion to shards (see WithAutoShards).
+	autoShards   int
+	autoBytes    int
+	autoInterval time.Duration
+	// frontends serves the memcached protocol and the admin dashboard too
+	// (see NewNodes).
+	frontends bool
+	// replicaUser and replicaPassword are the replicas' own credentials
+	// for object storage, if any.
+	replicaUser     string
+	replicaPassword string
+}
+
+// Limits are the per-node connection limits set by WithLimits. Zero values
+// are unlimited.
+type Limits struct {
+	MaxClients      int
+	MaxCommandRate  float64
+	MaxOutputBuffer int
+}
+
+// WithPassword makes the cluster's servers require a password, which the
+// clients supply when they connect.
+func WithPassword(password string) Option {
+	return func(cfg *clusterConfig) {
+		cfg.password = password
+	}
+}
+
+// WithWriteAheadLog makes the cluster's servers record writes in a
+// write-ahead log.
+func WithWriteAheadLog() Option {
+	return func(cfg *clusterConfig) {
+		cfg.wal = true
+	}
+}
+
+// WithClockSkew offsets the clocks of the cluster's servers, which decide
+// when keys and lock leases expire: server i's clock is off by skews[i], and
+// any further servers' clocks are accurate. Client i talks to server i modulo
+// the number of servers.
+func WithClockSkew(skews ...time.Duration) Option {
+	return func(cfg *clusterConfig) {
+		cfg.skews = skews
+	}
+}
+
+// WithStorageLatency delays every call the cluster's servers make to object
+// storage.
+func WithStorageLatency(d time.Duration) Option {
+	return func(cfg *clusterConfig) {
+		cfg.latency = d
+	}
+}
+
+// WithTopology starts the cluster in cluster mode, with a static topology
+// that splits the hash slots evenly between the servers. Server i's node ID
+// is "node<i>".
+func WithTopology() Option {
+	return func(cfg *clusterConfig) {
+		cfg.topology = true
+	}
+}
+
+// WithLimits limits every server's connections. NewCluster's clients count
+// towards MaxClients.
+func WithLimits(limits Limits) Option {
+	return func(cfg *clusterConfig) {
+		cfg.limits = limits
+	}
+}
+
+// WithWriteAttempts limits the conditional PUTs each batch of writes makes
+// when it conflicts with writes from other servers, so tests can see writes
+// fail with contention. By default, servers retry until they succeed.
+func WithWriteAttempts(n int) Option {
+	return func(cfg *clusterConfig) {
+		cfg.attempts = n
+	}
+}
+
+// WithCommandTimeouts sets the deadlines for the servers' commands. By
+// default, commands have no deadline.
+func WithCommandTimeouts(timeouts server.CommandTimeouts) Option {
+	return func(cfg *clusterConfig) {
+		cfg.timeouts = timeouts
+	}
+}
+
+// WithDebugCommands enables the DEBUG subcommands that stall connections
+// and expose the servers' internals.
+func WithDebugCommands() Option {
+	return func(cfg *clusterConfig) {
+		cfg.debug = true
+	}
+}
+
+// WithExpireSweep makes the servers remove expired keys from object storage
+// every interval.
+func WithExpireSweep(interval time.Duration) Option {
+	return func(cfg *clusterConfig) {
+		cfg.sweep = interval
+	}
+}
+
+// WithQuotas limits the keys and bytes the servers store under each quota's
+// prefix.
+func WithQuotas(quotas ...server.Quota) Option {
+	return func(cfg *clusterConfig) {
+		cfg.quotas = quotas
+	}
+}
+
+// WithReplicas makes the servers with the supplied indexes read replicas,
+// which refresh their copies of the database every refresh.
+func WithReplicas(refresh time.Duration, servers ...int) Option {
+	return func(cfg *clusterConfig) {
+		cfg.refresh = refresh
+		cfg.replicas = servers
+	}
+}
+
+// WithReplicaCredentials gives the cluster's read replicas their own
+// credentials for object storage. Only simulated storage knows users other
+// than the cluster's own, so it's meant for use with WithSimulatedStorage.
+func WithReplicaCredentials(user, password string) Option {
+	return func(cfg *clusterConfig) {
+		cfg.replicaUser = user
+		cfg.replicaPassword = password
+	}
+}
+
+// WithDatabases gives the servers n logical databases, which clients can
+// switch between with SELECT. By default, they only have database 0.
+func WithDatabases(n int) Option {
+	return func(cfg *clusterConfig) {
+		cfg.dbs = n
+	}
+}
+
+// WithShards splits the servers' database across n objects.
+func WithShards(n int) Option {
+	return func(cfg *clusterConfig) {
+		cfg.shards = n
+	}
+}
+
+// WithAutoShards lets the servers promote their unsharded database to n
+// shards once its object grows to the given size, checking every interval.
+func WithAutoShards(n, bytes int, interval time.Duration) Option {
+	return func(cfg *clusterConfig) {
+		cfg.autoShards, cfg.autoBytes, cfg.autoInterval = n, bytes, interval
+	}
+}
+
+// WithSimulatedStorage backs the cluster with simulated object storage
+// rather than MinIO, so that tests can inject storage faults reproducibly
+// and don't need Docker. Faults in the objects servers read at startup may
+// keep them from starting, so stores should usually confine their faults to
+// DatabaseObject.
+func WithSimulatedStorage(store *simstore.Store) Option {
+	return func(cfg *clusterConfig) {
+		cfg.sim = store
+	}
+}
+
+// WithHooks registers hooks with the cluster's servers: server i calls
+// hooks[i], and any further servers have no hooks. Client i talks to server i
+// modulo the number of servers.
+func WithHooks(hooks ...server.Hooks) Option {
+	return func(cfg *clusterConfig) {
+		cfg.hooks = hooks
+	}
+}
+
 // NewCluster creates a Valthree cluster and returns ready-to-use clients. The
 // clients, Valthree servers, and backing MinIO storage are automatically
 // cleaned up when the test completes. As long as numClients is greater than
 // one, the Valthree cluster has multiple nodes.
-func NewCluster(tb testing.TB, numClients int) []*client.Client {
+func NewCluster(tb testing.TB, numClients int, opts ...Option) []*client.Client {
 	tb.Helper()
 	attest.True(tb, numClients > 0, attest.Sprintf("num clients must be positive"))
-
-	const user, password = "admin", "password"
-	// The MinIO testcontainers module includes verbose test logs by default.
-	mc, err := minio.Run(
-		tb.Context(),
-		"minio/minio:RELEASE.2025-07-23T15-54-02Z",
-		minio.WithUsername(user),
-		minio.WithPassword(password),
-	)
-	attest.Ok(tb, err, attest.Sprint("start MinIO container"))
-	addr, err := mc.ConnectionString(tb.Context())
-	attest.Ok(tb, err, attest.Sprint("get MinIO conn str"))
+	var cfg clusterConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	var serverTLS *tls.Config
+	var clientOpts []client.Option
+	if cfg.tls {
+		var clientTLS *tls.Config
+		serverTLS, clientTLS = newTLSConfigs(tb)
+		clientOpts = append(clientOpts, client.WithTLS(clientTLS))
+	}
+	if cfg.password != "" {
+		clientOpts = append(clientOpts, client.WithPassword(cfg.password))
+	}
 
 	numServers := 1
 	if numClients > 1 {
 		numServers = numClients / 2
 	}
+	nodes := startServers(tb, cfg, numServers, serverTLS)
+
+	logger := NewLogger(tb)
+	clients := make([]*client.Client, numClients)
+	for i := range clients {
+		addr := nodes[i%len(nodes)].Addr
+		client, err := client.New(addr, clientOpts...)
+		attest.Ok(tb, err, attest.Sprint("client dial"))
+		tb.Cleanup(func() {
+			attest.Ok(tb, client.Close(), attest.Sprint("client close"))
+		})
+		for {
+			if err := client.Ping(); err == nil {
+				break
+			}
+			backoff := 100 * time.Millisecond
+			logger.Debug("redcon server not ready", "addr", addr, "retry_after", backoff)
+			time.Sleep(backoff)
+		}
+		clients[i] = client
+	}
+	return clients
+}
+
+// NewServers creates a Valthree cluster of numServers nodes and returns their
+// addresses, for tests that talk to the servers directly rather than through
+// a Client. Like NewCluster, it cleans everything up when the test
+// completes. It doesn't support WithTLS.
+func NewServers(tb testing.TB, numServers int, opts ...Option) []net.Addr {
+	tb.Helper()
+	attest.True(tb, numServers > 0, attest.Sprintf("num servers must be positive"))
+	var cfg clusterConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	attest.False(tb, cfg.tls, attest.Sprint("NewServers doesn't support TLS"))
+	var addrs []net.Addr
+	for _, node := range startServers(tb, cfg, numServers, nil /* tls */) {
+		addrs = append(addrs, node.Addr)
+	}
+	return addrs
+}
+
+// A Node is one of the servers started by NewNodes.
+type Node struct {
+	Server *server.Server
+	Addr   net.Addr // speaks the Valkey protocol
+	// MemcachedAddr speaks the memcached text protocol. It's nil if the
+	// servers require a password, which the protocol can't supply.
+	MemcachedAddr net.Addr
+	AdminAddr     net.Addr // serves the admin dashboard
+}
+
+// NewNodes is like NewServers, but it returns the servers themselves, and
+// each one also serves the memcached protocol and the admin dashboard.
+func NewNodes(tb testing.TB, numServers int, opts ...Option) []Node {
+	tb.Helper()
+	attest.True(tb, numServers > 0, attest.Sprintf("num servers must be positive"))
+	cfg := clusterConfig{frontends: true}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	attest.False(tb, cfg.tls, attest.Sprint("NewNodes doesn't support TLS"))
+	return startServers(tb, cfg, numServers, nil /* tls */)
+}
+
+// startServers starts object storage and numServers Valthree servers using
+// it.
+func startServers(tb testing.TB, cfg clusterConfig, numServers int, serverTLS *tls.Config) []Node {
+	tb.Helper()
+	const user, password = "admin", "password"
+	endpoint, transport := startStorage(tb, cfg, user, password)
 
 	logger := NewLogger(tb)
-	serverAddrs := make([]net.Addr, numServers)
-	for i := range serverAddrs {
+	// Listen before starting any servers, so that the topology can include
+	// every server's address.
+	listeners := make([]net.Listener, numServers)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "localhost:0") // closed by redcon server
+		attest.Ok(tb, err, attest.Sprint("listen on ephemeral port"))
+		listeners[i] = ln
+	}
+	var topology *server.Topology
+	if cfg.topology {
+		topology = newTopology(listeners)
+	}
+
+	// Compact often, so that tests exercise reads and writes racing with
+	// both background and inline compaction.
+	compactInterval, s3Timeout := 100*time.Millisecond, time.Second
+	if cfg.sim != nil {
+		// Simulated faults should depend only on the seed, not on timing.
+		// Background compaction reads the database on a timer, and the S3
+		// client backs off for random intervals before retrying failed
+		// requests, so don't compact in the background, and let the
+		// retries finish before calls time out.
+		compactInterval, s3Timeout = 0, 10*time.Second
+	}
+
+	nodes := make([]Node, numServers)
+	for i := range nodes {
+		var skew time.Duration
+		if i < len(cfg.skews) {
+			skew = cfg.skews[i]
+		}
+		var hooks server.Hooks
+		if i < len(cfg.hooks) {
+			hooks = cfg.hooks[i]
+		}
 		srv := server.New(server.Config{
 			DatabaseName: "test",
 			MaxItems:     1024,
-			S3Endpoint:   fmt.Sprintf("http://%s", addr),
+			S3Endpoint:   endpoint,
 			S3Region:     "us-east-1",
 			S3User:       user,
 			S3Password:   password,
 			S3Bucket:     "valthree",
-			S3Timeout:    time.Second,
-		}, NewLogger(tb))
+			S3Timeout:    s3Timeout,
+			Password:     cfg.password,
+			MaxClients:   cfg.limits.MaxClients,
+			NodeName:     fmt.Sprintf("node%d", i),
+			Topology:     topology,
 
-		ln, err := net.Listen("tcp", "localhost:0") // closed by redcon server
-		attest.Ok(tb, err, attest.Sprint("listen on ephemeral port"))
+			WriteAheadLog:     cfg.wal,
+			CompactInterval:   compactInterval,
+			CompactMinEntries: 4,
+			CompactMaxEntries: CompactMaxEntries,
+
+			// Back off briefly, so that conflicting writes are retried
+			// with jitter without slowing tests down much.
+			WriteMaxAttempts:    cfg.attempts,
+			WriteRetryBaseDelay: time.Millisecond,
+			WriteRetryMaxDelay:  20 * time.Millisecond,
+
+			// Poll often, so that tests needn't wait long for published
+			// messages to reach other nodes.
+			PubSubPollInterval: 50 * time.Millisecond,
+
+			ClockSkew:      skew,
+			StorageLatency: cfg.latency,
+			Hooks:          hooks,
+
+			MaxCommandRate:  cfg.limits.MaxCommandRate,
+			MaxOutputBuffer: cfg.limits.MaxOutputBuffer,
+			CommandTimeouts: cfg.timeouts,
 
+			EnableDebugCommands: cfg.debug,
+			ExpireSweepInterval: cfg.sweep,
+			Quotas:              cfg.quotas,
+			StorageTransport:    transport,
+			Replica:             slices.Contains(cfg.replicas, i),
+			ReplicaRefresh:      cfg.refresh,
+			ReplicaS3User:       cfg.replicaUser,
+			ReplicaS3Password:   cfg.replicaPassword,
+			Databases:           cfg.dbs,
+			Shards:              cfg.shards,
+			AutoShards:          cfg.autoShards,
+			AutoShardBytes:      cfg.autoBytes,
+			AutoShardInterval:   cfg.autoInterval,
+		}, NewLogger(tb))
+
+		ln := listeners[i]
 		var wg sync.WaitGroup
 		logger.Debug("starting redcon server", "server_id", i, "addr", ln.Addr())
 		wg.Go(func() {
+			if serverTLS != nil {
+				attest.Ok(tb, srv.ServeTLS(ln, serverTLS), attest.Sprint("redcon serve"))
+				return
+			}
 			attest.Ok(tb, srv.ServeTCP(ln), attest.Sprint("redcon serve"))
 		})
+		nodes[i] = Node{Server: srv, Addr: ln.Addr()}
+		if cfg.frontends {
+			if cfg.password == "" {
+				mln, err := net.Listen("tcp", "localhost:0")
+				attest.Ok(tb, err, attest.Sprint("listen on ephemeral port"))
+				wg.Go(func() { attest.Ok(tb, srv.ServeMemcached(mln), attest.Sprint("memcached serve")) })
+				nodes[i].MemcachedAddr = mln.Addr()
+			}
+			aln, err := net.Listen("tcp", "localhost:0")
+			attest.Ok(tb, err, attest.Sprint("listen on ephemeral port"))
+			wg.Go(func() { attest.Ok(tb, srv.ServeAdmin(aln), attest.Sprint("admin serve")) })
+			nodes[i].AdminAddr = aln.Addr()
+		}
 		tb.Cleanup(func() {
-			attest.Ok(tb, srv.Close(), attest.Sprint("redcon close"))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			attest.Ok(tb, srv.Shutdown(ctx), attest.Sprint("redcon shutdown"))
 			wg.Wait()
 		})
-		serverAddrs[i] = ln.Addr()
 	}
+	return nodes
+}
 
-	clients := make([]*client.Client, numClients)
-	for i := range clients {
-		addr := serverAddrs[i%len(serverAddrs)]
-		client, err := client.New(addr)
-		attest.Ok(tb, err, attest.Sprint("client dial"))
-		tb.Cleanup(func() {
-			attest.Ok(tb, client.Close(), attest.Sprint("client close"))
+// startStorage starts the object storage a cluster's servers share: a MinIO
+// container, or simulated storage with WithSimulatedStorage. It returns the
+// storage's endpoint and, for simulated storage, the transport that reaches
+// it.
+func startStorage(tb testing.TB, cfg clusterConfig, user, password string) (string, http.RoundTripper) {
+	tb.Helper()
+	if cfg.sim != nil {
+		return simstore.Endpoint, cfg.sim
+	}
+	// The MinIO testcontainers module includes verbose test logs by default.
+	mc, err := minio.Run(
+		tb.Context(),
+		"minio/minio:RELEASE.2025-07-23T15-54-02Z",
+		minio.WithUsername(user),
+		minio.WithPassword(password),
+	)
+	attest.Ok(tb, err, attest.Sprint("start MinIO container"))
+	addr, err := mc.ConnectionString(tb.Context())
+	attest.Ok(tb, err, attest.Sprint("get MinIO conn str"))
+	return fmt.Sprintf("http://%s", addr), nil
+}
+
+// DatabaseObject reports whether an object holds the test database's keys: a
+// shard, or an entry in a shard's write-ahead log.
+func DatabaseObject(key string) bool {
+	const name = "test" // see startServers
+	return key == name || strings.HasPrefix(key, name+".shard-") || strings.HasPrefix(key, name+".log/")
+}
+
+// LogEntry reports whether an object is an entry in the write-ahead log of
+// one of the test database's shards, and if so, its sequence number.
+func LogEntry(key string) (uint64, bool) {
+	if !DatabaseObject(key) {
+		return 0, false
+	}
+	_, entry, ok := strings.Cut(key, ".log/")
+	if !ok {
+		return 0, false
+	}
+	_, seq, _ := strings.Cut(entry, "/")
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// newTopology assigns each listener's server an equal share of the hash
+// slots.
+func newTopology(listeners []net.Listener) *server.Topology {
+	const numSlots = 16384
+	var t server.Topology
+	for i, ln := range listeners {
+		start := numSlots * i / len(listeners)
+		end := numSlots*(i+1)/len(listeners) - 1
+		t.Nodes = append(t.Nodes, server.TopologyNode{
+			ID:    fmt.Sprintf("node%d", i),
+			Addr:  ln.Addr().String(),
+			Slots: []server.SlotRange{{start, end}},
 		})
-		for {
-			if err := client.Ping(); err == nil {
-				break
-			}
-			backoff := 100 * time.Millisecond
-			logger.Debug("redcon server not ready", "addr", addr, "retry_after", backoff)
-			time.Sleep(backoff)
-		}
-		clients[i] = client
 	}
-	return clients
+	return &t
 }
 
 // NewLogger creates a structured logger that writes to the supplied
@@ -0,0 +1,57 @@
+package servertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"go.akshayshah.org/attest"
+)
+
+// WithTLS makes the cluster's servers accept only TLS connections, using a
+// self-signed certificate that the clients trust.
+func WithTLS() Option {
+	return func(cfg *clusterConfig) {
+		cfg.tls = true
+	}
+}
+
+// newTLSConfigs creates a self-signed certificate for localhost and returns
+// matching server and client configurations.
+func newTLSConfigs(tb testing.TB) (*tls.Config, *tls.Config) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	attest.Ok(tb, err, attest.Sprint("generate TLS key"))
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "valthree"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	attest.Ok(tb, err, attest.Sprint("create TLS certificate"))
+	cert, err := x509.ParseCertificate(der)
+	attest.Ok(tb, err, attest.Sprint("parse TLS certificate"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	client := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	return server, client
+}
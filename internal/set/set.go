@@ -0,0 +1,84 @@
+// Package set provides a generic, unordered set.
+package set
+
+import (
+	"cmp"
+	"encoding/json"
+	"maps"
+	"slices"
+)
+
+// A Set is an unordered collection of distinct elements. The zero value is an
+// empty set that can be read but not added to; use New to make a set that can
+// hold elements.
+//
+// Sets are encoded as sorted JSON arrays, so equal sets always have the same
+// encoding.
+type Set[T cmp.Ordered] map[T]struct{}
+
+// New makes a set containing the supplied elements.
+func New[T cmp.Ordered](elements ...T) Set[T] {
+	s := make(Set[T], len(elements))
+	for _, e := range elements {
+		s[e] = struct{}{}
+	}
+	return s
+}
+
+// Add adds an element, reporting whether it was absent.
+func (s Set[T]) Add(e T) bool {
+	if _, ok := s[e]; ok {
+		return false
+	}
+	s[e] = struct{}{}
+	return true
+}
+
+// Remove removes an element, reporting whether it was present.
+func (s Set[T]) Remove(e T) bool {
+	if _, ok := s[e]; !ok {
+		return false
+	}
+	delete(s, e)
+	return true
+}
+
+// Contains reports whether the set contains an element.
+func (s Set[T]) Contains(e T) bool {
+	_, ok := s[e]
+	return ok
+}
+
+// Len returns the number of elements in the set.
+func (s Set[T]) Len() int {
+	return len(s)
+}
+
+// Sorted returns the elements in ascending order.
+func (s Set[T]) Sorted() []T {
+	return slices.Sorted(maps.Keys(s))
+}
+
+// Clone returns a copy of the set.
+func (s Set[T]) Clone() Set[T] {
+	c := make(Set[T], len(s))
+	for e := range s {
+		c[e] = struct{}{}
+	}
+	return c
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s Set[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Sorted())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Set[T]) UnmarshalJSON(data []byte) error {
+	var elements []T
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+	*s = New(elements...)
+	return nil
+}
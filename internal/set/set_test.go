@@ -0,0 +1,26 @@
+package set
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.akshayshah.org/attest"
+)
+
+func TestSet(t *testing.T) {
+	s := New("b", "a")
+	attest.True(t, s.Add("c"))
+	attest.False(t, s.Add("a"))
+	attest.True(t, s.Remove("b"))
+	attest.False(t, s.Remove("b"))
+	attest.True(t, s.Contains("a"))
+	attest.False(t, s.Contains("b"))
+	attest.Equal(t, s.Sorted(), []string{"a", "c"})
+
+	data, err := json.Marshal(s)
+	attest.Ok(t, err)
+	attest.Equal(t, string(data), `["a","c"]`)
+	var decoded Set[string]
+	attest.Ok(t, json.Unmarshal(data, &decoded))
+	attest.Equal(t, decoded, s)
+}
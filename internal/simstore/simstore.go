@@ -0,0 +1,427 @@
+// Package simstore simulates object storage in memory, for tests that need
+// slow, flaky, or contended storage but not Docker.
+//
+// A Store speaks just enough of the S3 protocol for the Valthree server: it's
+// an http.RoundTripper, so the AWS SDK talks to it exactly as it would talk
+// to a real endpoint. Every simulated delay and fault is drawn from a
+// pseudorandom generator seeded with Options.Seed. Each object has its own
+// generator, so the faults a sequence of requests for one object sees depend
+// only on the seed and that sequence, not on requests for other objects
+// (like the ones servers make in the background). Tests that drive a single
+// connection are therefore repeatable: running them again with the same seed
+// injects the same faults in the same places.
+package simstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is the S3 endpoint servers using a Store should be configured
+// with. Requests never leave the process, so it's only used to build URLs.
+const Endpoint = "http://simstore.invalid"
+
+// Options control a Store's simulated faults. The zero value is fast,
+// reliable storage.
+type Options struct {
+	// Seed seeds the pseudorandom generators that decide every delay and
+	// fault.
+	Seed uint64
+	// MinLatency and MaxLatency bound the delay before each request is
+	// served, which is drawn uniformly between them.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// ErrorRate is the fraction of requests that fail with a 500 Internal
+	// Error, without taking effect.
+	ErrorRate float64
+	// RaceRate is the fraction of conditional PUTs to existing objects that
+	// lose a race with a simulated writer on another node: just before the
+	// PUT is served, the object is rewritten with a new ETag, so the PUT
+	// fails with 412 Precondition Failed.
+	RaceRate float64
+	// ConflictRate is the fraction of conditional PUTs that fail with 409
+	// Conditional Request Conflict, without taking effect, as S3's do when
+	// they overlap another PUT of the same object.
+	ConflictRate float64
+	// Faulty decides which objects, by key, the faults apply to. Requests
+	// for other objects are served promptly and reliably. Nil means every
+	// object.
+	Faulty func(key string) bool
+	// ReadOnlyUsers are access keys that may only read. Their other
+	// requests fail with 403 Access Denied, without taking effect.
+	ReadOnlyUsers []string
+	// Before and After, if set, are called with each request's method and
+	// object key just before the request is served and just after. They're
+	// called without the Store's lock held, so tests can use them to pause
+	// requests and force servers' requests to interleave in a particular
+	// way.
+	Before func(method, key string)
+	After  func(method, key string)
+}
+
+// Stats count the requests a Store has served and the faults it injected.
+type Stats struct {
+	Requests  int
+	Errors    int
+	Races     int
+	Conflicts int
+}
+
+// A Store is simulated object storage. It's safe for concurrent use.
+type Store struct {
+	opts Options
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	rngs    map[string]*rand.Rand // by bucket and key
+	version uint64                // makes every ETag unique
+	stats   Stats
+}
+
+type object struct {
+	body     []byte
+	etag     string
+	modified time.Time
+	metadata http.Header // the x-amz-meta- headers it was written with
+}
+
+// New creates an empty Store.
+func New(opts Options) *Store {
+	return &Store{
+		opts:    opts,
+		buckets: make(map[string]map[string]*object),
+		rngs:    make(map[string]*rand.Rand),
+	}
+}
+
+// Stats returns the counts of requests and injected faults so far.
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// A fault is what a request's generator decided to do to it.
+type fault struct {
+	delay    time.Duration
+	fail     bool
+	race     bool
+	conflict bool
+}
+
+// decide draws a request's fault from its object's generator. The caller
+// must hold mu.
+func (s *Store) decide(bucket, key string, conditional bool) fault {
+	if s.opts.Faulty != nil && !s.opts.Faulty(key) {
+		return fault{}
+	}
+	id := bucket + "/" + key
+	rng, ok := s.rngs[id]
+	if !ok {
+		h := fnv.New64a()
+		io.WriteString(h, id)
+		rng = rand.New(rand.NewPCG(s.opts.Seed, h.Sum64()))
+		s.rngs[id] = rng
+	}
+	// Always draw the same number of values, so that one decision doesn't
+	// change how the next is drawn.
+	var f fault
+	jitter, fail, race := rng.Float64(), rng.Float64(), rng.Float64()
+	if spread := s.opts.MaxLatency - s.opts.MinLatency; spread > 0 {
+		f.delay = s.opts.MinLatency + time.Duration(jitter*float64(spread))
+	} else {
+		f.delay = s.opts.MinLatency
+	}
+	f.fail = fail < s.opts.ErrorRate
+	f.race = conditional && race < s.opts.RaceRate
+	f.conflict = conditional && !f.race && race < s.opts.RaceRate+s.opts.ConflictRate
+	return f
+}
+
+// RoundTrip serves a request.
+func (s *Store) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = readBody(req)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	key, _ = url.PathUnescape(key)
+	conditional := req.Method == http.MethodPut && (req.Header.Get("If-Match") != "" || req.Header.Get("If-None-Match") != "")
+
+	s.mu.Lock()
+	s.stats.Requests++
+	f := s.decide(bucket, key, conditional)
+	s.mu.Unlock()
+
+	if f.delay > 0 {
+		t := time.NewTimer(f.delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	if s.opts.Before != nil {
+		s.opts.Before(req.Method, key)
+	}
+	res := s.serve(req, bucket, key, body, f)
+	if s.opts.After != nil {
+		s.opts.After(req.Method, key)
+	}
+	return res, nil
+}
+
+// serve serves a request, after its delay, as its fault dictates.
+func (s *Store) serve(req *http.Request, bucket, key string, body []byte, f fault) *http.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f.fail {
+		s.stats.Errors++
+		return s.errorResponse(req, http.StatusInternalServerError, "InternalError")
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && slices.Contains(s.opts.ReadOnlyUsers, accessKey(req)) {
+		return s.errorResponse(req, http.StatusForbidden, "AccessDenied")
+	}
+	if key == "" {
+		return s.serveBucket(req, bucket)
+	}
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		return s.errorResponse(req, http.StatusNotFound, "NoSuchBucket")
+	}
+	obj := objects[key]
+	if f.conflict {
+		s.stats.Conflicts++
+		return s.errorResponse(req, http.StatusConflict, "ConditionalRequestConflict")
+	}
+	if f.race && obj != nil && req.Header.Get("If-Match") != "" {
+		s.stats.Races++
+		objects[key] = s.newObject(obj.body, obj.metadata)
+		obj = objects[key]
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if obj == nil {
+			return s.errorResponse(req, http.StatusNotFound, "NoSuchKey")
+		}
+		if match := req.Header.Get("If-None-Match"); match != "" && match == obj.etag {
+			return s.response(req, http.StatusNotModified, objectHeader(obj), nil)
+		}
+		h := objectHeader(obj)
+		h.Set("Content-Length", strconv.Itoa(len(obj.body)))
+		h.Set("Content-Type", "application/octet-stream")
+		return s.response(req, http.StatusOK, h, obj.body)
+	case http.MethodPut:
+		if match := req.Header.Get("If-Match"); match != "" && (obj == nil || match != obj.etag) {
+			return s.errorResponse(req, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		if req.Header.Get("If-None-Match") == "*" && obj != nil {
+			return s.errorResponse(req, http.StatusPreconditionFailed, "PreconditionFailed")
+		}
+		obj = s.newObject(body, metadata(req.Header))
+		objects[key] = obj
+		return s.response(req, http.StatusOK, objectHeader(obj), nil)
+	case http.MethodDelete:
+		delete(objects, key)
+		return s.response(req, http.StatusNoContent, nil, nil)
+	}
+	return s.errorResponse(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+}
+
+// serveBucket serves requests for a bucket, rather than an object. The
+// caller must hold mu.
+func (s *Store) serveBucket(req *http.Request, bucket string) *http.Response {
+	objects, ok := s.buckets[bucket]
+	switch req.Method {
+	case http.MethodPut:
+		if ok {
+			return s.errorResponse(req, http.StatusConflict, "BucketAlreadyOwnedByYou")
+		}
+		s.buckets[bucket] = make(map[string]*object)
+		return s.response(req, http.StatusOK, nil, nil)
+	case http.MethodHead:
+		if !ok {
+			return s.errorResponse(req, http.StatusNotFound, "NoSuchBucket")
+		}
+		return s.response(req, http.StatusOK, nil, nil)
+	case http.MethodGet:
+		if !ok {
+			return s.errorResponse(req, http.StatusNotFound, "NoSuchBucket")
+		}
+		return s.list(req, bucket, objects)
+	}
+	return s.errorResponse(req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+}
+
+type listResult struct {
+	XMLName     xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string        `xml:"Name"`
+	Prefix      string        `xml:"Prefix"`
+	KeyCount    int           `xml:"KeyCount"`
+	MaxKeys     int           `xml:"MaxKeys"`
+	IsTruncated bool          `xml:"IsTruncated"`
+	Contents    []listContent `xml:"Contents"`
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// list serves ListObjectsV2, in a single page.
+func (s *Store) list(req *http.Request, bucket string, objects map[string]*object) *http.Response {
+	query := req.URL.Query()
+	prefix, after := query.Get("prefix"), query.Get("start-after")
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		obj := objects[key]
+		res.Contents = append(res.Contents, listContent{
+			Key:          key,
+			LastModified: obj.modified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.etag,
+			Size:         len(obj.body),
+			StorageClass: "STANDARD",
+		})
+	}
+	res.KeyCount = len(res.Contents)
+	bs, err := xml.Marshal(res)
+	if err != nil {
+		return s.errorResponse(req, http.StatusInternalServerError, "InternalError")
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "application/xml")
+	return s.response(req, http.StatusOK, h, append([]byte(xml.Header), bs...))
+}
+
+// newObject creates a new version of an object. The caller must hold mu.
+func (s *Store) newObject(body []byte, metadata http.Header) *object {
+	s.version++
+	sum := md5.Sum(fmt.Appendf(slices.Clone(body), "%d", s.version))
+	return &object{
+		body:     body,
+		etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+		modified: time.Now(),
+		metadata: metadata,
+	}
+}
+
+// metadata returns the user-defined metadata headers of a PUT request.
+func metadata(req http.Header) http.Header {
+	h := make(http.Header)
+	for name, values := range req {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			h[name] = values
+		}
+	}
+	return h
+}
+
+func objectHeader(obj *object) http.Header {
+	h := obj.metadata.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set("ETag", obj.etag)
+	h.Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+	return h
+}
+
+func (s *Store) errorResponse(req *http.Request, status int, code string) *http.Response {
+	h := make(http.Header)
+	if req.Method == http.MethodHead {
+		// HEAD responses have no body, so clients go by the status alone.
+		return s.response(req, status, h, nil)
+	}
+	h.Set("Content-Type", "application/xml")
+	body := fmt.Sprintf("%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, http.StatusText(status))
+	return s.response(req, status, h, []byte(body))
+}
+
+func (s *Store) response(req *http.Request, status int, h http.Header, body []byte) *http.Response {
+	if h == nil {
+		h = make(http.Header)
+	}
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// accessKey returns the access key that signed a request.
+func accessKey(req *http.Request) string {
+	_, credential, _ := strings.Cut(req.Header.Get("Authorization"), "Credential=")
+	key, _, _ := strings.Cut(credential, "/")
+	return key
+}
+
+// readBody reads a request's body, decoding the aws-chunked encoding the SDK
+// uses to send checksums in trailers.
+func readBody(req *http.Request) ([]byte, error) {
+	if !strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(req.Body)
+	}
+	var body []byte
+	r := bufio.NewReader(req.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("read chunk size: %w", err)
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse chunk size: %w", err)
+		}
+		if n == 0 {
+			// The trailers follow, but nothing checks them.
+			return body, nil
+		}
+		chunk := make([]byte, n+2) // and CRLF
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, fmt.Errorf("read chunk: %w", err)
+		}
+		body = append(body, chunk[:n]...)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/antithesishq/antithesis-sdk-go/lifecycle"
+	"github.com/antithesishq/valthree/internal/property"
+	"github.com/antithesishq/valthree/internal/proptest"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(lockWorkloadCmd)
+
+	lockWorkloadCmd.Flags().StringSlice("addrs", []string{":6379"}, "Valthree cluster address(es)")
+}
+
+var lockWorkloadCmd = &cobra.Command{
+	Use:   "lock-workload",
+	Short: "Start a continuous workload exercising Valthree's distributed locks",
+	Run: func(cmd *cobra.Command, args []string) {
+		// Like the main workload, this runs indefinitely. Rather than checking
+		// linearizability, it checks that the fencing tokens issued with each
+		// lease make the lock safe to use.
+		logger := orFatal(newLogger(cmd.Flags()))
+		clusterAddrs := orFatal(cmd.Flags().GetStringSlice("addrs"))
+
+		addrs := make([]net.Addr, len(clusterAddrs))
+		for i, serverAddr := range clusterAddrs {
+			addr, err := net.ResolveTCPAddr("tcp", serverAddr)
+			if err != nil {
+				logger.Error("server addr misconfigured", "server_addr", serverAddr, "err", err)
+				os.Exit(1)
+			}
+			dial(logger, addr).CloseAndLog(logger) // blocks until cluster is ready
+			addrs[i] = addr
+		}
+		logger.Info("setup complete", "cluster_addrs", addrs)
+		lifecycle.SetupComplete(map[string]any{"cluster_addrs": addrs})
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		for {
+			select {
+			case <-sig:
+				os.Exit(0)
+			default:
+				exerciseLocks(logger, addrs)
+			}
+		}
+	},
+}
+
+func exerciseLocks(logger *slog.Logger, addrs []net.Addr) {
+	seeds := []uint64{rand.Uint64(), rand.Uint64()}
+	logger = logger.With("pcg_seeds", seeds, "cluster_addrs", addrs)
+
+	// Each client contends for a small number of locks, spread across all the
+	// nodes in the cluster. Owners are unique to each acquisition, so we don't
+	// need to flush the cluster between iterations.
+	r := rand.New(rand.NewPCG(seeds[0], seeds[1]))
+	workloads := proptest.GenLockWorkloads(r)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i, workload := range workloads {
+		wg.Go(func() {
+			addr := addrs[i%len(addrs)]
+			logger := logger.With("client_id", i, "addr", addr)
+			client := dial(logger, addr)
+			defer client.CloseAndLog(logger)
+			<-start
+			proptest.RunLockWorkload(logger, client, workload)
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	acquired, err := proptest.CheckLocks(workloads)
+	if err != nil {
+		var lerr *proptest.LockError
+		details := map[string]any{"error": err.Error()}
+		if errors.As(err, &lerr) {
+			details["lock"] = lerr.Lock
+		}
+		property.FencingTokensIncrease(false, details)
+		logger.Error("lock safety violated", "err", err)
+		return
+	}
+	property.FencingTokensIncrease(true, nil)
+	property.LockContention(acquired < 1, nil)
+	percent := strconv.FormatFloat(100*acquired, 'f', 1 /* precision */, 64 /* bitsize */)
+	logger.Info("lock safety verified", "percent_acquired", percent)
+}
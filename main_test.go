@@ -21,6 +21,19 @@ func TestStrongSerializable(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping testcontainers in short mode")
 	}
+	testStrongSerializable(t)
+}
+
+func TestStrongSerializableWriteAheadLog(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testcontainers in short mode")
+	}
+	// The write-ahead log changes how every write reaches object storage, so
+	// it must keep the same guarantee.
+	testStrongSerializable(t, servertest.WithWriteAheadLog())
+}
+
+func testStrongSerializable(t *testing.T, opts ...servertest.Option) {
 	// This is a property-based test. Rather than testing with hard-coded
 	// example inputs, we generate a random workload, execute it, and verify
 	// that the results do not violate Valthree's strong serializable
@@ -57,7 +70,7 @@ func TestStrongSerializable(t *testing.T) {
 	// Next, we start a MinIO object storage node, a cluster of Valthree nodes,
 	// and a few clients for each node. The servertest package orchestrates this
 	// and automatically shuts everything down at the end of the test.
-	clients := servertest.NewCluster(t, len(workloads))
+	clients := servertest.NewCluster(t, len(workloads), opts...)
 
 	// Then, we run the workload. As the clients execute their assigned
 	// operations, they collect timing information and store the result of each
@@ -95,3 +108,32 @@ func TestStrongSerializable(t *testing.T) {
 		attest.Ok(t, os.WriteFile(fname, perr.Visualization.Bytes(), 0644))
 	}
 }
+
+func TestLockSafety(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testcontainers in short mode")
+	}
+	// Like TestStrongSerializable, this test mirrors an Antithesis workload (in
+	// locks.go): clients contend for a few locks, and we verify that the
+	// fencing tokens they receive are safe to use.
+	seed0, seed1 := rand.Uint64(), rand.Uint64()
+	t.Logf("seeded with %v,%v", seed0, seed1)
+	r := rand.New(rand.NewPCG(seed0, seed1))
+	workloads := proptest.GenLockWorkloads(r)
+	clients := servertest.NewCluster(t, len(workloads))
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	logger := servertest.NewLogger(t)
+	for i, workload := range workloads {
+		wg.Go(func() {
+			<-start
+			proptest.RunLockWorkload(logger, clients[i], workload)
+		})
+	}
+	close(start)
+	wg.Wait()
+
+	_, err := proptest.CheckLocks(workloads)
+	attest.Ok(t, err, attest.Sprintf("lock safety violated"))
+}
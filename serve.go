@@ -1,30 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/antithesishq/valthree/internal/cron"
 	"github.com/antithesishq/valthree/internal/server"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
 )
 
 func init() {
 	rootCmd.AddCommand(serveCmd)
 
+	serveCmd.Flags().Bool("validate", false, "check the configuration, credentials, bucket, and TLS files, print a report, and exit")
 	serveCmd.Flags().String("addr", ":6379", "address to listen on")
-	serveCmd.Flags().String("name", "valthree", "database name")
+	serveCmd.Flags().String("tls-addr", "", "address to serve TLS connections on, like Valkey's tls-port (default disabled)")
+	serveCmd.Flags().String("tls-cert", "", "PEM-encoded TLS certificate file")
+	serveCmd.Flags().String("tls-key", "", "PEM-encoded TLS private key file")
+	serveCmd.Flags().String("tls-ca", "", "PEM-encoded CA certificates; if set, TLS clients must present a certificate signed by one of them")
+	serveCmd.Flags().String("memcached-addr", "", "address to serve the memcached text protocol on (default disabled)")
+	serveCmd.Flags().String("admin-addr", "", "address to serve the admin dashboard on (default disabled)")
+	serveCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "how long to wait for running commands to finish when shutting down")
+	serveCmd.Flags().StringSlice("admin-peers", nil, "admin dashboard addresses of the other cluster nodes (default from --cluster-config)")
+	serveCmd.Flags().String("cluster-config", "", "JSON file listing every node's ID, address, and hash slots, identical on all nodes (default standalone)")
+	serveCmd.Flags().String("password", "", "password clients must supply with AUTH (default none)")
+	serveCmd.Flags().String("node-name", "", "name of this node (default host name)")
+	serveCmd.Flags().Duration("slowlog-threshold", 250*time.Millisecond, "minimum duration of commands recorded in the slow log (0 disables)")
 	serveCmd.Flags().Int("max-keys", 16384, "maximum number of stored keys")
-	serveCmd.Flags().String("s3-addr", "http://minio:9000", "object storage address")
-	serveCmd.Flags().String("s3-region", "us-east-1", "object storage region")
-	serveCmd.Flags().String("s3-bucket", "valthree", "object storage bucket")
-	serveCmd.Flags().String("s3-user", "admin", "object storage user")
-	serveCmd.Flags().String("s3-pass", "password", "object storage password")
-	serveCmd.Flags().Duration("s3-timeout", time.Minute, "object storage timeout")
+	serveCmd.Flags().Int("max-clients", 10000, "maximum number of open connections, like Valkey's maxclients (0 is unlimited)")
+	serveCmd.Flags().Float64("max-command-rate", 0, "maximum commands per second on each connection (0 is unlimited)")
+	serveCmd.Flags().Int("max-output-buffer", 0, "maximum bytes of replies buffered for each connection before it's closed (0 is unlimited)")
+	serveCmd.Flags().Duration("read-command-timeout", 10*time.Second, "deadline for commands that only read keys (0 is unlimited)")
+	serveCmd.Flags().Duration("write-command-timeout", 30*time.Second, "deadline for commands that write keys (0 is unlimited)")
+	serveCmd.Flags().Duration("admin-command-timeout", 0, "deadline for administrative commands, like FLUSHALL and LOAD (0 is unlimited)")
+	serveCmd.Flags().Bool("replica", false, "serve reads but refuse writes; connections that send READONLY may read a periodically refreshed copy of the database")
+	serveCmd.Flags().Duration("replica-refresh", time.Second, "how often a replica refreshes its copy of the database (0 keeps no copy)")
+	serveCmd.Flags().String("replica-s3-user", "", "object storage user for a replica, in place of --s3-user; should only be allowed to read")
+	serveCmd.Flags().String("replica-s3-pass", "", "object storage password for --replica-s3-user")
+	serveCmd.Flags().Bool("enable-debug-commands", false, "allow DEBUG, whose subcommands reload the database, stall connections, and expose internals")
+	serveCmd.Flags().Int("max-key-length", 1024, "maximum key length in bytes (0 is unlimited)")
+	serveCmd.Flags().String("key-charset", "any", "characters allowed in keys: any, utf8, or printable")
+	serveCmd.Flags().StringArray("quota", nil, "limit keys and value bytes under a prefix, as PREFIX=MAX_KEYS:MAX_BYTES; a namespace's prefix is valthree:ns:NAME: (repeatable)")
+	serveCmd.Flags().Duration("expire-sweep-interval", time.Second, "how often to remove expired keys from object storage (0 disables)")
+	serveCmd.Flags().Duration("write-batch-interval", 0, "how long writes wait to share a PUT with concurrent writes (trades latency for throughput)")
+	serveCmd.Flags().Int("write-max-attempts", 100, "conditional PUTs a write attempts before failing with TRYAGAIN when it keeps conflicting with other nodes (0 is unlimited)")
+	serveCmd.Flags().Duration("write-retry-base-delay", 5*time.Millisecond, "maximum delay before the first retry of a conflicting write, doubling with each retry (0 retries immediately)")
+	serveCmd.Flags().Duration("write-retry-max-delay", 500*time.Millisecond, "cap on the delay between retries of a conflicting write (0 is uncapped)")
+	serveCmd.Flags().Duration("compact-interval", 10*time.Second, "how often to check whether write-ahead logs need compacting (0 disables background compaction)")
+	serveCmd.Flags().Int("compact-min-entries", 32, "number of write-ahead log entries that trigger background compaction")
+	serveCmd.Flags().Int("compact-max-entries", 256, "number of write-ahead log entries at which writes compact the log themselves (0 is unlimited)")
+	serveCmd.Flags().Int("auto-shards", 0, "number of shards to promote an unsharded database to once it grows too large or contended (0 never promotes; every node must agree)")
+	serveCmd.Flags().Int("auto-shard-bytes", 64<<20, "database object size that promotes it to --auto-shards shards (0 disables)")
+	serveCmd.Flags().Float64("auto-shard-conflict-rate", 0.5, "fraction of writes conflicting since the last check that promotes the database to --auto-shards shards (0 disables)")
+	serveCmd.Flags().Duration("auto-shard-interval", time.Minute, "how often to check whether the database should be promoted to --auto-shards shards (0 only follows other nodes)")
+	serveCmd.Flags().Duration("pubsub-poll-interval", 250*time.Millisecond, "how often to check for messages published on other nodes (0 delivers messages only on the node they're published to)")
+	serveCmd.Flags().String("notify-keyspace-events", "", "keyspace notifications to publish, as in Valkey's notify-keyspace-events (default disabled)")
+	serveCmd.Flags().String("backup-schedule", "", "cron-like schedule for database snapshots, like @daily (default disabled)")
+	serveCmd.Flags().Int("backup-retention", 7, "number of snapshots to keep (0 keeps all)")
+	serveCmd.Flags().Bool("s3-emulate-conditional-writes", false, "if object storage ignores If-Match, emulate it with lock objects (weaker; may lose writes)")
+	serveCmd.Flags().String("otlp-traces-endpoint", "", "OTLP/HTTP URL to export traces to, like http://collector:4318/v1/traces (default disabled)")
+	serveCmd.Flags().Float64("trace-sample-ratio", 1, "fraction of commands to trace, if exporting traces")
+	addStorageFlags(serveCmd.Flags())
 }
 
 var serveCmd = &cobra.Command{
@@ -38,17 +92,17 @@ var serveCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if orFatal(cmd.Flags().GetBool("validate")) {
+			os.Exit(validate(cmd.Flags()))
+		}
+		cfg := orFatal(serverConfig(cmd.Flags()))
+		shutdownTracing, err := setupTracing(cmd.Flags(), cfg.NodeName)
+		if err != nil {
+			logger.Error("set up tracing failed", "err", err)
+			os.Exit(1)
+		}
 		addr := orFatal(cmd.Flags().GetString("addr"))
-		srv := server.New(server.Config{
-			DatabaseName: orFatal(cmd.Flags().GetString("name")),
-			MaxItems:     orFatal(cmd.Flags().GetInt("max-keys")),
-			S3Endpoint:   orFatal(cmd.Flags().GetString("s3-addr")),
-			S3Region:     orFatal(cmd.Flags().GetString("s3-region")),
-			S3User:       orFatal(cmd.Flags().GetString("s3-user")),
-			S3Password:   orFatal(cmd.Flags().GetString("s3-pass")),
-			S3Bucket:     orFatal(cmd.Flags().GetString("s3-bucket")),
-			S3Timeout:    orFatal(cmd.Flags().GetDuration("s3-timeout")),
-		}, logger)
+		srv := server.New(cfg, logger)
 
 		ln, err := net.Listen("tcp", addr)
 		if err != nil {
@@ -62,12 +116,68 @@ var serveCmd = &cobra.Command{
 				logger.Error("serve failed", "err", err)
 			}
 		})
+		if tlsAddr := orFatal(cmd.Flags().GetString("tls-addr")); tlsAddr != "" {
+			cfg, err := loadTLSConfig(
+				orFatal(cmd.Flags().GetString("tls-cert")),
+				orFatal(cmd.Flags().GetString("tls-key")),
+				orFatal(cmd.Flags().GetString("tls-ca")),
+			)
+			if err != nil {
+				logger.Error("load TLS config failed", "err", err)
+				os.Exit(1)
+			}
+			tlsln, err := net.Listen("tcp", tlsAddr)
+			if err != nil {
+				logger.Error("listen failed", "addr", tlsAddr, "err", err)
+				os.Exit(1)
+			}
+			wg.Go(func() {
+				logger.Info("starting TLS server", "addr", tlsAddr)
+				if err := srv.ServeTLS(tlsln, cfg); err != nil {
+					logger.Error("serve TLS failed", "err", err)
+				}
+			})
+		}
+		if mcAddr := orFatal(cmd.Flags().GetString("memcached-addr")); mcAddr != "" {
+			mcln, err := net.Listen("tcp", mcAddr)
+			if err != nil {
+				logger.Error("listen failed", "addr", mcAddr, "err", err)
+				os.Exit(1)
+			}
+			wg.Go(func() {
+				logger.Info("starting memcached frontend", "addr", mcAddr)
+				if err := srv.ServeMemcached(mcln); err != nil {
+					logger.Error("serve memcached failed", "err", err)
+				}
+			})
+		}
+		if adminAddr := orFatal(cmd.Flags().GetString("admin-addr")); adminAddr != "" {
+			adminln, err := net.Listen("tcp", adminAddr)
+			if err != nil {
+				logger.Error("listen failed", "addr", adminAddr, "err", err)
+				os.Exit(1)
+			}
+			wg.Go(func() {
+				logger.Info("starting admin dashboard", "addr", adminAddr)
+				if err := srv.ServeAdmin(adminln); err != nil {
+					logger.Error("serve admin failed", "err", err)
+				}
+			})
+		}
 		defer func() {
-			if err := srv.Close(); err != nil {
-				logger.Error("close failed", "err", err)
+			// Finish running commands, so that none is interrupted between
+			// reading the database and conditionally writing it back.
+			ctx, cancel := context.WithTimeout(context.Background(), orFatal(cmd.Flags().GetDuration("shutdown-timeout")))
+			defer cancel()
+			logger.Info("shutting down")
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Error("shutdown failed", "err", err)
 				os.Exit(1)
 			}
 			wg.Wait()
+			if err := shutdownTracing(); err != nil {
+				logger.Error("flush traces failed", "err", err)
+			}
 		}()
 
 		sig := make(chan os.Signal, 1)
@@ -75,3 +185,249 @@ var serveCmd = &cobra.Command{
 		<-sig
 	},
 }
+
+// addStorageFlags adds the flags that locate the database in object storage,
+// which every command that reads or writes it directly needs.
+func addStorageFlags(flags *pflag.FlagSet) {
+	flags.String("name", "valthree", "database name")
+	flags.Int("shards", 1, "number of objects to split the database across")
+	flags.Int("databases", 16, "number of logical databases connections can SELECT, each stored in its own objects")
+	flags.Bool("write-ahead-log", false, "record writes in a log of small objects instead of rewriting the database for each write (can't be undone)")
+	flags.String("backup-prefix", "backups/", "object name prefix for database snapshots")
+	flags.String("s3-addr", "http://minio:9000", "object storage address")
+	flags.String("s3-region", "us-east-1", "object storage region")
+	flags.String("s3-bucket", "valthree", "object storage bucket")
+	flags.String("s3-user", "admin", "object storage user")
+	flags.String("s3-pass", "password", "object storage password")
+	flags.Duration("s3-timeout", time.Minute, "object storage timeout")
+}
+
+// storageConfig builds the parts of the server's configuration that locate
+// the database, for commands that don't start a server.
+func storageConfig(flags *pflag.FlagSet) server.Config {
+	return server.Config{
+		DatabaseName:  orFatal(flags.GetString("name")),
+		Shards:        orFatal(flags.GetInt("shards")),
+		Databases:     orFatal(flags.GetInt("databases")),
+		WriteAheadLog: orFatal(flags.GetBool("write-ahead-log")),
+		BackupPrefix:  orFatal(flags.GetString("backup-prefix")),
+		S3Endpoint:    orFatal(flags.GetString("s3-addr")),
+		S3Region:      orFatal(flags.GetString("s3-region")),
+		S3User:        orFatal(flags.GetString("s3-user")),
+		S3Password:    orFatal(flags.GetString("s3-pass")),
+		S3Bucket:      orFatal(flags.GetString("s3-bucket")),
+		S3Timeout:     orFatal(flags.GetDuration("s3-timeout")),
+	}
+}
+
+// serverConfig builds the server's configuration from the command-line
+// flags.
+func serverConfig(flags *pflag.FlagSet) (server.Config, error) {
+	backupSchedule := orFatal(flags.GetString("backup-schedule"))
+	if backupSchedule != "" {
+		if _, err := cron.Parse(backupSchedule); err != nil {
+			return server.Config{}, err
+		}
+	}
+	var quotas []server.Quota
+	for _, q := range orFatal(flags.GetStringArray("quota")) {
+		quota, err := server.ParseQuota(q)
+		if err != nil {
+			return server.Config{}, err
+		}
+		quotas = append(quotas, quota)
+	}
+	shards := orFatal(flags.GetInt("shards"))
+	if shards > 1 && len(quotas) > 0 {
+		return server.Config{}, errors.New("quotas aren't supported in sharded databases")
+	}
+	autoShards := orFatal(flags.GetInt("auto-shards"))
+	if autoShards > 1 && len(quotas) > 0 {
+		return server.Config{}, errors.New("quotas aren't supported in databases that may be promoted to shards")
+	}
+	password := orFatal(flags.GetString("password"))
+	if password != "" && orFatal(flags.GetString("memcached-addr")) != "" {
+		return server.Config{}, errors.New("the memcached protocol doesn't support passwords")
+	}
+	charset, err := server.ParseKeyCharset(orFatal(flags.GetString("key-charset")))
+	if err != nil {
+		return server.Config{}, err
+	}
+	nodeName := orFatal(flags.GetString("node-name"))
+	var topology *server.Topology
+	if path := orFatal(flags.GetString("cluster-config")); path != "" {
+		if topology, err = server.LoadTopology(path); err != nil {
+			return server.Config{}, err
+		}
+		id := nodeName
+		if id == "" {
+			id, _ = os.Hostname()
+		}
+		if _, ok := topology.Node(id); !ok {
+			return server.Config{}, fmt.Errorf("node %q isn't in the cluster config; set --node-name to its ID", id)
+		}
+	}
+	return server.Config{
+		DatabaseName:        orFatal(flags.GetString("name")),
+		MaxItems:            orFatal(flags.GetInt("max-keys")),
+		Shards:              shards,
+		NodeName:            nodeName,
+		SlowThreshold:       orFatal(flags.GetDuration("slowlog-threshold")),
+		AdminPeers:          orFatal(flags.GetStringSlice("admin-peers")),
+		Topology:            topology,
+		Quotas:              quotas,
+		MaxKeyLength:        orFatal(flags.GetInt("max-key-length")),
+		KeyCharset:          charset,
+		Password:            password,
+		MaxClients:          orFatal(flags.GetInt("max-clients")),
+		MaxCommandRate:      orFatal(flags.GetFloat64("max-command-rate")),
+		MaxOutputBuffer:     orFatal(flags.GetInt("max-output-buffer")),
+		ExpireSweepInterval: orFatal(flags.GetDuration("expire-sweep-interval")),
+		WriteBatchInterval:  orFatal(flags.GetDuration("write-batch-interval")),
+		PubSubPollInterval:  orFatal(flags.GetDuration("pubsub-poll-interval")),
+		BackupSchedule:      backupSchedule,
+		BackupPrefix:        orFatal(flags.GetString("backup-prefix")),
+		BackupRetention:     orFatal(flags.GetInt("backup-retention")),
+		S3Endpoint:          orFatal(flags.GetString("s3-addr")),
+		S3Region:            orFatal(flags.GetString("s3-region")),
+		S3User:              orFatal(flags.GetString("s3-user")),
+		S3Password:          orFatal(flags.GetString("s3-pass")),
+		S3Bucket:            orFatal(flags.GetString("s3-bucket")),
+		S3Timeout:           orFatal(flags.GetDuration("s3-timeout")),
+
+		EmulateConditionalWrites: orFatal(flags.GetBool("s3-emulate-conditional-writes")),
+		NotifyKeyspaceEvents:     orFatal(flags.GetString("notify-keyspace-events")),
+		WriteAheadLog:            orFatal(flags.GetBool("write-ahead-log")),
+		CompactInterval:          orFatal(flags.GetDuration("compact-interval")),
+		CompactMinEntries:        orFatal(flags.GetInt("compact-min-entries")),
+		CompactMaxEntries:        orFatal(flags.GetInt("compact-max-entries")),
+		WriteMaxAttempts:         orFatal(flags.GetInt("write-max-attempts")),
+		WriteRetryBaseDelay:      orFatal(flags.GetDuration("write-retry-base-delay")),
+		WriteRetryMaxDelay:       orFatal(flags.GetDuration("write-retry-max-delay")),
+		AutoShards:               autoShards,
+		AutoShardBytes:           orFatal(flags.GetInt("auto-shard-bytes")),
+		AutoShardConflictRate:    orFatal(flags.GetFloat64("auto-shard-conflict-rate")),
+		AutoShardInterval:        orFatal(flags.GetDuration("auto-shard-interval")),
+
+		CommandTimeouts: server.CommandTimeouts{
+			Read:  orFatal(flags.GetDuration("read-command-timeout")),
+			Write: orFatal(flags.GetDuration("write-command-timeout")),
+			Admin: orFatal(flags.GetDuration("admin-command-timeout")),
+		},
+		EnableDebugCommands: orFatal(flags.GetBool("enable-debug-commands")),
+		Replica:             orFatal(flags.GetBool("replica")),
+		ReplicaRefresh:      orFatal(flags.GetDuration("replica-refresh")),
+		ReplicaS3User:       orFatal(flags.GetString("replica-s3-user")),
+		ReplicaS3Password:   orFatal(flags.GetString("replica-s3-pass")),
+		Databases:           orFatal(flags.GetInt("databases")),
+	}, nil
+}
+
+// setupTracing registers a tracer provider that exports the server's spans
+// over OTLP/HTTP, if an endpoint is configured. The returned function flushes
+// any spans that haven't been exported yet.
+func setupTracing(flags *pflag.FlagSet, nodeName string) (func() error, error) {
+	endpoint := orFatal(flags.GetString("otlp-traces-endpoint"))
+	if endpoint == "" {
+		return func() error { return nil }, nil
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %v", err)
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(orFatal(flags.GetFloat64("trace-sample-ratio")))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("valthree"),
+			semconv.ServiceInstanceID(nodeName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}, nil
+}
+
+// validate checks the configuration and its environment without starting
+// the server, prints a report, and returns the exit code: zero if every
+// check passed, perhaps with warnings.
+func validate(flags *pflag.FlagSet) int {
+	var checks []server.Check
+	if cfg, err := serverConfig(flags); err != nil {
+		checks = append(checks, server.Check{Name: "flags", Status: server.CheckFailed, Detail: err.Error()})
+	} else {
+		checks = append(checks, server.Check{Name: "flags", Status: server.CheckOK})
+		checks = append(checks, server.Validate(cfg)...)
+	}
+	if orFatal(flags.GetString("tls-addr")) == "" {
+		checks = append(checks, server.Check{Name: "tls", Status: server.CheckOK, Detail: "disabled"})
+	} else if _, err := loadTLSConfig(
+		orFatal(flags.GetString("tls-cert")),
+		orFatal(flags.GetString("tls-key")),
+		orFatal(flags.GetString("tls-ca")),
+	); err != nil {
+		checks = append(checks, server.Check{Name: "tls", Status: server.CheckFailed, Detail: err.Error()})
+	} else {
+		checks = append(checks, server.Check{Name: "tls", Status: server.CheckOK})
+	}
+
+	ok := !slices.ContainsFunc(checks, func(c server.Check) bool {
+		return c.Status == server.CheckFailed
+	})
+	if orFatal(flags.GetBool("json")) {
+		report := struct {
+			OK     bool           `json:"ok"`
+			Checks []server.Check `json:"checks"`
+		}{ok, checks}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		orFatal(0, enc.Encode(report))
+	} else {
+		for _, c := range checks {
+			fmt.Printf("%-8s %-18s %s\n", c.Status, c.Name, c.Detail)
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// loadTLSConfig loads the server's certificate and, if caFile is set,
+// requires clients to present certificates signed by those CAs.
+func loadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS requires both --tls-cert and --tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -1,9 +1,29 @@
 package main_test
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/anishathalye/porcupine"
+	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/dump"
+	"github.com/antithesishq/valthree/internal/proptest"
+	"github.com/antithesishq/valthree/internal/server"
 	"github.com/antithesishq/valthree/internal/servertest"
+	"github.com/antithesishq/valthree/internal/simstore"
 	"go.akshayshah.org/attest"
 )
 
@@ -21,6 +41,3562 @@ func TestTraditional(t *testing.T) {
 	attest.Ok(t, err)
 	attest.Equal(t, val, "bar")
 
+	gen, err := c.Generation()
+	attest.Ok(t, err)
+
 	// DEL foo == OK
 	attest.Ok(t, c.Del("foo"))
+
+	// Every write increments the generation.
+	next, err := c.Generation()
+	attest.Ok(t, err)
+	attest.Equal(t, next, gen+1)
+
+	// Keys with the reserved prefix are rejected, as are lock names.
+	attest.Error(t, c.Set("valthree:foo", "bar"))
+	_, err = c.Lock("valthree:foo", "owner", time.Minute)
+	attest.Error(t, err)
+}
+
+func TestBulkLoad(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.Load(map[string]string{"foo": "bar", "baz": "quux"}))
+	val, err := c.Get("baz")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "quux")
+
+	// Loading only works on an empty database.
+	attest.Error(t, c.Load(map[string]string{"foo": "bar"}))
+}
+
+func TestBulkLoadSharded(t *testing.T) {
+	var failing atomic.Bool
+	store := simstore.New(simstore.Options{
+		ErrorRate: 1,
+		Faulty: func(key string) bool {
+			return failing.Load() && key == "test.shard-003"
+		},
+	})
+	addr := servertest.NewServers(t, 1, /* num servers */
+		servertest.WithSimulatedStorage(store),
+		servertest.WithShards(4),
+	)[0]
+	c, err := client.New(addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	items := func(n int) map[string]string {
+		items := make(map[string]string, n)
+		for i := range n {
+			items[fmt.Sprintf("key%d", i)] = "x"
+		}
+		return items
+	}
+
+	// The limit applies to the whole database, not to each shard.
+	attest.ErrorIs(t, c.Load(items(1025)), client.ErrCapacity)
+
+	// A load that fails partway leaves the shards it loaded in place, and
+	// retrying it loads the rest. Other loads can't use those shards.
+	failing.Store(true)
+	attest.Error(t, c.Load(items(1000)))
+	failing.Store(false)
+	n, err := c.DBSize()
+	attest.Ok(t, err)
+	attest.True(t, n > 0 && n < 1000, attest.Sprintf("%d keys loaded", n))
+	attest.Error(t, c.Load(map[string]string{"other": "x"}))
+	attest.Ok(t, c.Load(items(1000)))
+	n, err = c.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1000)
+
+	// Once a shard is written, the load can't be repeated.
+	attest.Ok(t, c.Set("key0", "y"))
+	attest.Error(t, c.Load(items(1000)))
+	val, err := c.Get("key0")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "y")
+}
+
+func TestAutoShards(t *testing.T) {
+	addrs := servertest.NewServers(t, 2, /* num servers */
+		servertest.WithSimulatedStorage(simstore.New(simstore.Options{})),
+		servertest.WithAutoShards(4, 1024 /* bytes */, 10*time.Millisecond),
+	)
+	var clients []*client.Client
+	for _, addr := range addrs {
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		clients = append(clients, c)
+	}
+	a, b := clients[0], clients[1]
+	shards := func(c *client.Client) string {
+		info, err := c.Info()
+		attest.Ok(t, err)
+		return info["storage_shards"]
+	}
+
+	items := make(map[string]string)
+	for i := range 20 {
+		items[fmt.Sprintf("key%d", i)] = strings.Repeat("x", 100)
+	}
+	before, err := a.Lock("before", "owner", time.Minute)
+	attest.Ok(t, err)
+	attest.Equal(t, shards(a), "1")
+	attest.Ok(t, a.MSet(items))
+
+	// Node a promotes the database once it has read the grown object.
+	deadline := time.Now().Add(10 * time.Second)
+	for shards(a) != "4" {
+		attest.True(t, time.Now().Before(deadline), attest.Sprintf("database wasn't promoted"))
+		_, err := a.Get("key0")
+		attest.Ok(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Both nodes see every key, and node b follows the move as it reads.
+	for _, c := range clients {
+		n, err := c.DBSize()
+		attest.Ok(t, err)
+		attest.Equal(t, n, len(items))
+		val, err := c.Get("key7")
+		attest.Ok(t, err)
+		attest.Equal(t, val, items["key7"])
+	}
+	attest.Equal(t, shards(b), "4")
+
+	// Writes carry on in the shards, fencing tokens keep increasing, and
+	// multi-key commands are now confined to a shard.
+	attest.Ok(t, b.Set("key0", "y"))
+	val, err := a.Get("key0")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "y")
+	after, err := b.Lock("after", "owner", time.Minute)
+	attest.Ok(t, err)
+	attest.True(t, after > before, attest.Sprintf("token %d after promotion, %d before", after, before))
+	attest.Error(t, a.MSet(items))
+	attest.Ok(t, a.MSet(map[string]string{"{tag}a": "1", "{tag}b": "2"}))
+}
+
+func TestVersions(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	// Version 0 creates the key only if it doesn't exist.
+	v1, err := c.VSet("foo", 0, "bar")
+	attest.Ok(t, err)
+	_, err = c.VSet("foo", 0, "baz")
+	attest.ErrorIs(t, err, client.ErrVersionMismatch)
+
+	val, version, err := c.VGet("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bar")
+	attest.Equal(t, version, v1)
+
+	// Writes to other keys don't change the version.
+	attest.Ok(t, c.Set("other", "x"))
+	v2, err := c.VSet("foo", v1, "baz")
+	attest.Ok(t, err)
+	attest.True(t, v2 > v1)
+	_, err = c.VSet("foo", v1, "quux")
+	attest.ErrorIs(t, err, client.ErrVersionMismatch)
+}
+
+func TestLoadIf(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.Set("existing", "x"))
+	_, version, err := c.VGet("existing")
+	attest.Ok(t, err)
+	_, err = c.LPush("list", "x")
+	attest.Ok(t, err)
+
+	batch := []client.LoadItem{
+		{Key: "new", Version: 0, Value: "a"},
+		{Key: "existing", Version: version, Value: "b"},
+		{Key: "list", Version: 0, Value: "c"},
+	}
+	conflicts, err := c.LoadIf(batch...)
+	attest.Ok(t, err)
+	attest.Equal(t, len(conflicts), 1)
+	attest.NotZero(t, conflicts["list"])
+	val, err := c.Get("existing")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "b")
+
+	// Running the batch again changes nothing and reports every key.
+	generation, err := c.Generation()
+	attest.Ok(t, err)
+	conflicts, err = c.LoadIf(batch...)
+	attest.Ok(t, err)
+	attest.Equal(t, len(conflicts), 3)
+	attest.True(t, conflicts["existing"] > version)
+	after, err := c.Generation()
+	attest.Ok(t, err)
+	attest.Equal(t, after, generation)
+	val, err = c.Get("new")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "a")
+}
+
+func TestTLS(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */, servertest.WithTLS())
+	c := clients[0]
+
+	attest.Ok(t, c.Set("foo", "bar"))
+	val, err := c.Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bar")
+}
+
+func TestAuth(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */, servertest.WithPassword("secret"))
+	c := clients[0]
+
+	attest.Ok(t, c.Set("foo", "bar"))
+	val, err := c.Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bar")
+}
+
+func TestHello(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	send := dialRESP(t, addr)
+
+	// Connections that never send HELLO speak RESP2.
+	attest.Equal(t, send("GET missing"), "$-1\r\n")
+	attest.Equal(t, send("HSET h f v"), ":1\r\n")
+	attest.Equal(t, send("HELLO 4"), "-NOPROTO unsupported protocol version\r\n")
+	attest.Subsequence(t, send("HELLO three"), "-ERR")
+	attest.Subsequence(t, send("HELLO 3 SETNAME"), "-ERR syntax error")
+	attest.Equal(t, send("GET missing"), "$-1\r\n")
+
+	hello := send("HELLO 3")
+	attest.True(t, strings.HasPrefix(hello, "%7\r\n$6\r\nserver\r\n$8\r\nvalthree\r\n"), attest.Sprintf("reply %q", hello))
+	attest.Subsequence(t, hello, "$5\r\nproto\r\n:3\r\n")
+	attest.Subsequence(t, hello, "$4\r\nrole\r\n$6\r\nmaster\r\n")
+	attest.Equal(t, send("GET missing"), "_\r\n")
+	attest.Equal(t, send("HGETALL h"), "%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+
+	// Clients can downgrade, too.
+	hello = send("HELLO 2")
+	attest.True(t, strings.HasPrefix(hello, "*14\r\n"), attest.Sprintf("reply %q", hello))
+	attest.Subsequence(t, hello, "$5\r\nproto\r\n:2\r\n")
+	attest.Equal(t, send("GET missing"), "$-1\r\n")
+	attest.Equal(t, send("HGETALL h"), "*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+}
+
+func TestHelloAuth(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */, servertest.WithPassword("secret"))[0]
+	send := dialRESP(t, addr)
+
+	attest.Subsequence(t, send("GET foo"), "-NOAUTH")
+	attest.Subsequence(t, send("HELLO 3"), "-NOAUTH")
+	attest.Subsequence(t, send("HELLO 3 AUTH default"), "-ERR syntax error")
+
+	// A failed handshake leaves the connection as it was: unauthenticated,
+	// unnamed, and speaking RESP2.
+	const wrongPass = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	attest.Equal(t, send("HELLO 3 AUTH default wrong SETNAME app"), wrongPass)
+	attest.Equal(t, send("HELLO 3 AUTH nobody secret"), wrongPass)
+	attest.Subsequence(t, send("HELLO 3 AUTH default secret SETNAME \"bad name\""), "-ERR Client names cannot contain spaces")
+	attest.Subsequence(t, send("GET foo"), "-NOAUTH")
+	attest.Subsequence(t, send("HELLO 4 AUTH default secret"), "-NOPROTO")
+	attest.Subsequence(t, send("GET foo"), "-NOAUTH")
+
+	// A successful one authenticates, names, and upgrades in one round trip.
+	hello := send("HELLO 3 AUTH default secret SETNAME app")
+	attest.True(t, strings.HasPrefix(hello, "%7\r\n"), attest.Sprintf("reply %q", hello))
+	attest.Equal(t, send("GET foo"), "_\r\n")
+	attest.Equal(t, send("CLIENT GETNAME"), "$3\r\napp\r\n")
+
+	// Once authenticated, HELLO doesn't need credentials, and a bad retry
+	// doesn't log the connection out.
+	attest.Equal(t, send("HELLO 3 AUTH default wrong"), wrongPass)
+	attest.Equal(t, send("GET foo"), "_\r\n")
+	hello = send("HELLO 2")
+	attest.True(t, strings.HasPrefix(hello, "*14\r\n"), attest.Sprintf("reply %q", hello))
+	attest.Equal(t, send("GET foo"), "$-1\r\n")
+	attest.Equal(t, send("CLIENT GETNAME"), "$3\r\napp\r\n")
+}
+
+func TestReset(t *testing.T) {
+	addr := servertest.NewServers(t, 1, /* num servers */
+		servertest.WithPassword("secret"),
+		servertest.WithDatabases(2),
+	)[0]
+	send := dialRESP(t, addr)
+
+	attest.Equal(t, send("AUTH secret"), "+OK\r\n")
+	id := send("CLIENT ID")
+	attest.Equal(t, send("SET key zero"), "+OK\r\n")
+	attest.Equal(t, send("CLIENT SETNAME app"), "+OK\r\n")
+	attest.True(t, strings.HasPrefix(send("HELLO 3"), "%7\r\n"))
+	attest.Equal(t, send("SELECT 1"), "+OK\r\n")
+	attest.Equal(t, send("SET key one"), "+OK\r\n")
+	attest.Equal(t, send("WATCH key"), "+OK\r\n")
+	attest.Equal(t, send("MULTI"), "+OK\r\n")
+	attest.Equal(t, send("SET key discarded"), "+QUEUED\r\n")
+
+	// RESET isn't queued, and it puts everything back the way it was when
+	// the connection was accepted, except for the connection's ID.
+	attest.Equal(t, send("RESET"), "+RESET\r\n")
+	attest.Subsequence(t, send("GET key"), "-NOAUTH")
+	attest.Equal(t, send("AUTH secret"), "+OK\r\n")
+	attest.Equal(t, send("CLIENT ID"), id)
+	attest.Equal(t, send("CLIENT GETNAME"), "$-1\r\n")
+	attest.Equal(t, send("GET key"), "$4\r\nzero\r\n")
+	attest.Equal(t, send("EXEC"), "-ERR EXEC without MULTI\r\n")
+	attest.Equal(t, send("SELECT 1"), "+OK\r\n")
+	attest.Equal(t, send("GET key"), "$3\r\none\r\n")
+
+	// The key is no longer watched, so another connection's write doesn't
+	// abort the next transaction.
+	other := dialRESP(t, addr)
+	attest.Equal(t, other("AUTH secret"), "+OK\r\n")
+	attest.Equal(t, other("SELECT 1"), "+OK\r\n")
+	attest.Equal(t, other("SET key other"), "+OK\r\n")
+	attest.Equal(t, send("MULTI"), "+OK\r\n")
+	attest.Equal(t, send("SET key two"), "+QUEUED\r\n")
+	attest.Equal(t, send("EXEC"), "*1\r\n+OK\r\n")
+	attest.Subsequence(t, send("RESET now"), "-ERR wrong number of arguments")
+}
+
+// dialRESP opens a raw connection to addr. The returned function sends an
+// inline command and returns the complete reply, exactly as encoded.
+func dialRESP(t *testing.T, addr net.Addr) func(cmd string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	attest.Ok(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	return func(cmd string) string {
+		t.Helper()
+		_, err := io.WriteString(conn, cmd+"\r\n")
+		attest.Ok(t, err)
+		reply, err := readRESP(r)
+		attest.Ok(t, err)
+		return reply
+	}
+}
+
+// readRESP reads one RESP2 or RESP3 reply, including any nested elements.
+func readRESP(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 {
+		return "", fmt.Errorf("malformed reply %q", line)
+	}
+	var elems int
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil || n < 0 {
+			return line, err
+		}
+		body := make([]byte, n+2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return "", err
+		}
+		return line + string(body), nil
+	case '*', '~':
+		elems, err = strconv.Atoi(strings.TrimSpace(line[1:]))
+	case '%':
+		elems, err = strconv.Atoi(strings.TrimSpace(line[1:]))
+		elems *= 2
+	default:
+		return line, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString(line)
+	for range elems {
+		elem, err := readRESP(r)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(elem)
+	}
+	return b.String(), nil
+}
+
+func TestScan(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	want := make(map[string]string)
+	for i := range 25 {
+		want[fmt.Sprintf("user:%d", i)] = "x"
+	}
+	want["other"] = "x"
+	attest.Ok(t, c.MSet(want))
+	delete(want, "other")
+
+	got := make(map[string]string)
+	for key, err := range c.Scan("user:*") {
+		attest.Ok(t, err)
+		_, dup := got[key]
+		attest.False(t, dup, attest.Sprintf("key %q returned twice", key))
+		got[key] = "x"
+	}
+	attest.Equal(t, got, want)
+}
+
+func TestStatsKeyspace(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	send := dialRESP(t, addr)
+
+	stats := send("STATS KEYSPACE")
+	attest.True(t, strings.HasPrefix(stats, "*10\r\n$4\r\nkeys\r\n:0\r\n$11\r\nvalue_bytes\r\n:0\r\n"), attest.Sprintf("reply %q", stats))
+	attest.True(t, strings.HasSuffix(stats, "$12\r\nlargest_keys\r\n*0\r\n$5\r\ntypes\r\n*0\r\n"), attest.Sprintf("reply %q", stats))
+
+	attest.Equal(t, send("SET big 0123456789"), "+OK\r\n")
+	attest.Equal(t, send("SET s x"), "+OK\r\n")
+	attest.Equal(t, send("HSET h field value"), ":1\r\n")
+	attest.Equal(t, send("RPUSH l a b c"), ":3\r\n")
+
+	// Sizes include the key, and ties are broken by name.
+	stats = send("STATS KEYSPACE COUNT 2")
+	before, after, ok := strings.Cut(stats, "$16\r\nserialized_bytes\r\n:")
+	attest.True(t, ok, attest.Sprintf("reply %q", stats))
+	attest.Equal(t, before, "*10\r\n"+
+		"$4\r\nkeys\r\n:4\r\n"+
+		"$11\r\nvalue_bytes\r\n:24\r\n")
+	serialized, after, _ := strings.Cut(after, "\r\n")
+	n, err := strconv.Atoi(serialized)
+	attest.Ok(t, err)
+	attest.True(t, n > 24)
+	attest.Equal(t, after, ""+
+		"$12\r\nlargest_keys\r\n*2\r\n"+
+		"*2\r\n$3\r\nbig\r\n:13\r\n"+
+		"*2\r\n$1\r\nh\r\n:11\r\n"+
+		"$5\r\ntypes\r\n*6\r\n"+
+		"$4\r\nhash\r\n:1\r\n"+
+		"$4\r\nlist\r\n:1\r\n"+
+		"$6\r\nstring\r\n:2\r\n")
+
+	// In RESP3, the reply and its types are maps.
+	send("HELLO 3")
+	stats = send("STATS keyspace count 0")
+	attest.True(t, strings.HasPrefix(stats, "%5\r\n$4\r\nkeys\r\n:4\r\n"), attest.Sprintf("reply %q", stats))
+	attest.Subsequence(t, stats, "$12\r\nlargest_keys\r\n*0\r\n")
+	attest.Subsequence(t, stats, "$5\r\ntypes\r\n%3\r\n$4\r\nhash\r\n:1\r\n")
+
+	attest.Subsequence(t, send("STATS"), "-ERR wrong number of arguments")
+	attest.Subsequence(t, send("STATS MEMORY"), "-ERR unknown STATS subcommand 'MEMORY'")
+	attest.Subsequence(t, send("STATS KEYSPACE COUNT -1"), "-ERR syntax error")
+	attest.Subsequence(t, send("STATS KEYSPACE LIMIT 1"), "-ERR syntax error")
+	attest.Subsequence(t, send("STATS KEYSPACE COUNT"), "-ERR syntax error")
+}
+
+func TestRange(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	for _, key := range []string{"user:2:b", "user:1:a", "user:1:b", "user:10:a", "other"} {
+		attest.Ok(t, c.Set(key, "v-"+key))
+	}
+	_, err := c.LPush("user:1:list", "skipped")
+	attest.Ok(t, err)
+
+	kvs, err := c.Range("user:1:", "user:1;", 0)
+	attest.Ok(t, err)
+	attest.Equal(t, kvs, []client.KeyValue{
+		{Key: "user:1:a", Value: "v-user:1:a"},
+		{Key: "user:1:b", Value: "v-user:1:b"},
+	})
+	// Keys are in byte order, so "user:10:a" sorts before "user:1:a".
+	kvs, err = c.Range("user:", "", 2)
+	attest.Ok(t, err)
+	attest.Equal(t, kvs, []client.KeyValue{
+		{Key: "user:10:a", Value: "v-user:10:a"},
+		{Key: "user:1:a", Value: "v-user:1:a"},
+	})
+	// The next page starts just after the last key.
+	kvs, err = c.Range("user:1:a\x00", "", 2)
+	attest.Ok(t, err)
+	attest.Equal(t, kvs, []client.KeyValue{
+		{Key: "user:1:b", Value: "v-user:1:b"},
+		{Key: "user:2:b", Value: "v-user:2:b"},
+	})
+	kvs, err = c.Range("x", "", 0)
+	attest.Ok(t, err)
+	attest.Zero(t, len(kvs))
+}
+
+func TestKeyspace(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+	attest.Ok(t, c.MSet(map[string]string{"a": "1", "b": "2"}))
+
+	n, err := c.Exists("a", "b", "a", "missing")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+
+	typ, err := c.Type("a")
+	attest.Ok(t, err)
+	attest.Equal(t, typ, "string")
+	typ, err = c.Type("missing")
+	attest.Ok(t, err)
+	attest.Equal(t, typ, "none")
+
+	size, err := c.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, size, 2)
+
+	keys, err := c.Keys("*")
+	attest.Ok(t, err)
+	attest.Equal(t, keys, []string{"a", "b"})
+}
+
+func TestRecorder(t *testing.T) {
+	// Application tests can check their own traffic for consistency violations
+	// by recording it.
+	clients := servertest.NewCluster(t, 2 /* num clients */)
+	recorders := []*proptest.Recorder{
+		proptest.NewRecorder(clients[0], 0),
+		proptest.NewRecorder(clients[1], 1),
+	}
+
+	var wg sync.WaitGroup
+	for i, r := range recorders {
+		wg.Go(func() {
+			for j := range 20 {
+				attest.Ok(t, r.Set("foo", fmt.Sprintf("%d-%d", i, j)))
+				_, err := r.Get("foo")
+				attest.Ok(t, err)
+				_, err = r.IncrBy("counter", 1)
+				attest.Ok(t, err)
+				attest.Ok(t, r.MSet(map[string]string{"{g}a": "x", "{g}b": "y"}))
+			}
+		})
+	}
+	wg.Wait()
+
+	_, err := proptest.CheckWorkloads(time.Minute, [][]porcupine.Operation{
+		recorders[0].History(),
+		recorders[1].History(),
+	})
+	attest.Ok(t, err)
+}
+
+func TestHashes(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	added, err := c.HSet("user", map[string]string{"name": "alice", "email": "a@example.com"})
+	attest.Ok(t, err)
+	attest.Equal(t, added, 2)
+
+	name, err := c.HGet("user", "name")
+	attest.Ok(t, err)
+	attest.Equal(t, name, "alice")
+	_, err = c.HGet("user", "phone")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	removed, err := c.HDel("user", "email", "phone")
+	attest.Ok(t, err)
+	attest.Equal(t, removed, 1)
+	ok, err := c.HExists("user", "email")
+	attest.Ok(t, err)
+	attest.False(t, ok)
+	n, err := c.HLen("user")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+
+	all, err := c.HGetAll("user")
+	attest.Ok(t, err)
+	attest.Equal(t, all, map[string]string{"name": "alice"})
+
+	// String commands reject hashes.
+	_, err = c.Get("user")
+	attest.Error(t, err)
+	typ, err := c.Type("user")
+	attest.Ok(t, err)
+	attest.Equal(t, typ, "hash")
+}
+
+func TestLists(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	n, err := c.LPush("queue", "b", "a")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 2)
+	n, err = c.RPush("queue", "c")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+
+	all, err := c.LRange("queue", 0, -1)
+	attest.Ok(t, err)
+	attest.Equal(t, all, []string{"a", "b", "c"})
+
+	first, err := c.LPop("queue")
+	attest.Ok(t, err)
+	attest.Equal(t, first, "a")
+	last, err := c.RPop("queue")
+	attest.Ok(t, err)
+	attest.Equal(t, last, "c")
+	n, err = c.LLen("queue")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+
+	// Popping the last element deletes the list.
+	_, err = c.LPop("queue")
+	attest.Ok(t, err)
+	_, err = c.LPop("queue")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestSets(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	n, err := c.SAdd("tags", "b", "a", "b")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 2)
+	n, err = c.SAdd("tags", "a", "c")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+
+	members, err := c.SMembers("tags")
+	attest.Ok(t, err)
+	attest.Equal(t, members, []string{"a", "b", "c"})
+	ok, err := c.SIsMember("tags", "b")
+	attest.Ok(t, err)
+	attest.True(t, ok)
+
+	n, err = c.SRem("tags", "b", "missing")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	n, err = c.SCard("tags")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 2)
+
+	// Sets are a distinct type.
+	_, err = c.Get("tags")
+	attest.ErrorIs(t, err, client.ErrWrongType)
+
+	// Removing the last member deletes the set.
+	_, err = c.SRem("tags", "a", "c")
+	attest.Ok(t, err)
+	exists, err := c.Exists("tags")
+	attest.Ok(t, err)
+	attest.Equal(t, exists, 0)
+}
+
+func TestRandomMembers(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	c, err := client.New(addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	_, err = c.SAdd("set", "a", "b", "c")
+	attest.Ok(t, err)
+	_, err = c.HSet("hash", map[string]string{"f1": "v1", "f2": "v2"})
+	attest.Ok(t, err)
+	attest.Ok(t, c.Set("string", "v"))
+	// random runs a command and returns its reply as strings, sorted.
+	random := func(name string, args ...any) []string {
+		t.Helper()
+		replies, err := c.Pipeline(client.Command{Name: name, Args: args})
+		attest.Ok(t, err)
+		var got []string
+		switch reply := replies[0].(type) {
+		case []byte:
+			got = []string{string(reply)}
+		case []any:
+			for _, elem := range reply {
+				got = append(got, string(elem.([]byte)))
+			}
+		case nil:
+		default:
+			return []string{fmt.Sprint(reply)}
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	// Single picks eventually return every member.
+	seen := make(map[string]bool)
+	for range 100 {
+		got := random("SRANDMEMBER", "set")
+		attest.Equal(t, len(got), 1)
+		seen[got[0]] = true
+	}
+	attest.Equal(t, seen, map[string]bool{"a": true, "b": true, "c": true})
+
+	// Positive counts pick distinct members, and negative counts may repeat.
+	got := random("SRANDMEMBER", "set", 2)
+	attest.Equal(t, len(got), 2)
+	attest.True(t, got[0] < got[1], attest.Sprintf("members %q aren't distinct", got))
+	for _, m := range got {
+		attest.True(t, m == "a" || m == "b" || m == "c", attest.Sprintf("member %q", m))
+	}
+	attest.Equal(t, random("SRANDMEMBER", "set", 5), []string{"a", "b", "c"})
+	attest.Zero(t, random("SRANDMEMBER", "set", 0))
+	got = random("SRANDMEMBER", "set", -10)
+	attest.Equal(t, len(got), 10)
+	for _, m := range got {
+		attest.True(t, m == "a" || m == "b" || m == "c", attest.Sprintf("member %q", m))
+	}
+	attest.Zero(t, random("SRANDMEMBER", "missing"))
+	attest.Zero(t, random("SRANDMEMBER", "missing", -3))
+	attest.Subsequence(t, random("SRANDMEMBER", "set", "two")[0], "not an integer")
+	attest.Subsequence(t, random("SRANDMEMBER", "set", math.MinInt64)[0], "out of range")
+	attest.Subsequence(t, random("SRANDMEMBER", "set", 1, 2)[0], "syntax error")
+	attest.Subsequence(t, random("SRANDMEMBER", "string")[0], "WRONGTYPE")
+
+	got = random("HRANDFIELD", "hash")
+	attest.True(t, slices.Equal(got, []string{"f1"}) || slices.Equal(got, []string{"f2"}), attest.Sprintf("reply %q", got))
+	attest.Equal(t, random("HRANDFIELD", "hash", 3), []string{"f1", "f2"})
+	attest.Equal(t, random("HRANDFIELD", "hash", 3, "withvalues"), []string{"f1", "f2", "v1", "v2"})
+	attest.Equal(t, len(random("HRANDFIELD", "hash", -5)), 5)
+	attest.Equal(t, len(random("HRANDFIELD", "hash", -5, "WITHVALUES")), 10)
+	attest.Zero(t, random("HRANDFIELD", "missing"))
+	attest.Zero(t, random("HRANDFIELD", "missing", 2, "WITHVALUES"))
+	attest.Subsequence(t, random("HRANDFIELD", "hash", 1, "WITHSCORES")[0], "syntax error")
+	attest.Subsequence(t, random("HRANDFIELD", "set")[0], "WRONGTYPE")
+
+	// In RESP2, fields alternate with their values, and in RESP3, they're
+	// paired.
+	send := dialRESP(t, addr)
+	pair := send("HRANDFIELD hash -1 WITHVALUES")
+	attest.True(t, pair == "*2\r\n$2\r\nf1\r\n$2\r\nv1\r\n" || pair == "*2\r\n$2\r\nf2\r\n$2\r\nv2\r\n", attest.Sprintf("reply %q", pair))
+	send("HELLO 3")
+	pair = send("HRANDFIELD hash -1 WITHVALUES")
+	attest.True(t, pair == "*1\r\n*2\r\n$2\r\nf1\r\n$2\r\nv1\r\n" || pair == "*1\r\n*2\r\n$2\r\nf2\r\n$2\r\nv2\r\n", attest.Sprintf("reply %q", pair))
+	attest.Equal(t, send("SRANDMEMBER missing"), "_\r\n")
+}
+
+func TestSortedSets(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	n, err := c.ZAdd("leaderboard",
+		client.ZMember{Member: "carol", Score: 30},
+		client.ZMember{Member: "alice", Score: 10},
+		client.ZMember{Member: "bob", Score: 20},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+	// Updating a score doesn't count as an addition.
+	n, err = c.ZAdd("leaderboard", client.ZMember{Member: "alice", Score: 40})
+	attest.Ok(t, err)
+	attest.Equal(t, n, 0)
+
+	members, err := c.ZRange("leaderboard", 0, -1)
+	attest.Ok(t, err)
+	attest.Equal(t, members, []string{"bob", "carol", "alice"})
+	scored, err := c.ZRangeByScore("leaderboard", 25, math.Inf(1))
+	attest.Ok(t, err)
+	attest.Equal(t, scored, []client.ZMember{{Member: "carol", Score: 30}, {Member: "alice", Score: 40}})
+
+	score, err := c.ZScore("leaderboard", "bob")
+	attest.Ok(t, err)
+	attest.Equal(t, score, 20.0)
+	_, err = c.ZScore("leaderboard", "dave")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	n, err = c.ZRem("leaderboard", "bob", "dave")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	n, err = c.ZCard("leaderboard")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 2)
+}
+
+func TestSortedSetUpdates(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	c, err := client.New(addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	attest.Ok(t, c.Set("string", "v"))
+
+	// Each step runs a command on the key "z" and checks its reply, and then
+	// checks the whole sorted set.
+	type errReply string
+	bulks := func(strs ...string) []any {
+		out := make([]any, len(strs))
+		for i, s := range strs {
+			out[i] = []byte(s)
+		}
+		return out
+	}
+	steps := []struct {
+		cmd  string
+		args []any // after the key
+		want any   // or an errReply, which the error must contain
+		set  []any // members and scores, lowest first
+	}{
+		{"ZADD", []any{"XX", 1, "a"}, int64(0), bulks()},
+		{"ZADD", []any{"NX", 1, "a", 2, "b"}, int64(2), bulks("a", "1", "b", "2")},
+		{"ZADD", []any{"NX", 5, "a", 3, "c"}, int64(1), bulks("a", "1", "b", "2", "c", "3")},
+		{"ZADD", []any{"XX", 5, "a", 4, "d"}, int64(0), bulks("b", "2", "c", "3", "a", "5")},
+		{"ZADD", []any{"XX", "CH", 6, "a", 4, "d"}, int64(1), bulks("b", "2", "c", "3", "a", "6")},
+		// GT and LT only restrict updates, not additions.
+		{"ZADD", []any{"GT", "CH", 1, "b", 4, "c", 0, "d"}, int64(2), bulks("d", "0", "b", "2", "c", "4", "a", "6")},
+		{"ZADD", []any{"LT", "CH", 5, "c", 1, "b", 9, "e"}, int64(2), bulks("d", "0", "b", "1", "c", "4", "a", "6", "e", "9")},
+		{"ZADD", []any{"GT", 0, "a"}, int64(0), bulks("d", "0", "b", "1", "c", "4", "a", "6", "e", "9")},
+		{"ZADD", []any{"GT", "lt", 10, "a"}, errReply("GT, LT, and/or NX options at the same time are not compatible"), nil},
+		{"ZADD", []any{"NX", "GT", 10, "a"}, errReply("GT, LT, and/or NX options at the same time are not compatible"), nil},
+		{"ZADD", []any{"NX", "XX", 10, "a"}, errReply("XX and NX options at the same time are not compatible"), nil},
+		{"ZADD", []any{"CH", 1, "a", 2}, errReply("syntax error"), nil},
+		{"ZADD", []any{"GT", "high", "a"}, errReply("not a valid float"), nil},
+
+		{"ZPOPMIN", nil, bulks("d", "0"), bulks("b", "1", "c", "4", "a", "6", "e", "9")},
+		{"ZPOPMAX", []any{2}, bulks("e", "9", "a", "6"), bulks("b", "1", "c", "4")},
+		{"ZPOPMAX", []any{0}, bulks(), bulks("b", "1", "c", "4")},
+		{"ZPOPMIN", []any{-1}, errReply("value is out of range, must be positive"), bulks("b", "1", "c", "4")},
+		{"ZPOPMIN", []any{"one"}, errReply("not an integer"), bulks("b", "1", "c", "4")},
+		{"ZPOPMIN", []any{1, 2}, errReply("syntax error"), bulks("b", "1", "c", "4")},
+		// Popping the last member deletes the key.
+		{"ZPOPMIN", []any{10}, bulks("b", "1", "c", "4"), bulks()},
+		{"EXISTS", nil, int64(0), bulks()},
+		{"ZPOPMIN", nil, bulks(), bulks()},
+		{"ZPOPMAX", []any{3}, bulks(), bulks()},
+	}
+	for _, step := range steps {
+		replies, err := c.Pipeline(
+			client.Command{Name: step.cmd, Args: append([]any{"z"}, step.args...)},
+			client.Command{Name: "ZRANGE", Args: []any{"z", 0, -1, "WITHSCORES"}},
+		)
+		attest.Ok(t, err)
+		desc := attest.Sprintf("%s %v", step.cmd, step.args)
+		if want, ok := step.want.(errReply); ok {
+			attest.Subsequence(t, fmt.Sprint(replies[0]), string(want), desc)
+		} else {
+			attest.Equal(t, replies[0], step.want, desc)
+		}
+		if step.set != nil {
+			attest.Equal(t, replies[1], any(step.set), desc)
+		}
+	}
+
+	replies, err := c.Pipeline(
+		client.Command{Name: "ZPOPMIN", Args: []any{"string"}},
+		client.Command{Name: "ZPOPMAX"},
+	)
+	attest.Ok(t, err)
+	attest.Subsequence(t, fmt.Sprint(replies[0]), "WRONGTYPE")
+	attest.Subsequence(t, fmt.Sprint(replies[1]), "wrong number of arguments")
+
+	// In RESP3, only replies to commands with a count are paired.
+	send := dialRESP(t, addr)
+	attest.Equal(t, send("ZADD q 1 a 2 b 3 c"), ":3\r\n")
+	send("HELLO 3")
+	attest.Equal(t, send("ZPOPMIN q"), "*2\r\n$1\r\na\r\n,1\r\n")
+	attest.Equal(t, send("ZPOPMAX q 1"), "*1\r\n*2\r\n$1\r\nc\r\n,3\r\n")
+	attest.Equal(t, send("ZPOPMAX q 1"), "*1\r\n*2\r\n$1\r\nb\r\n,2\r\n")
+	attest.Equal(t, send("ZPOPMAX q 1"), "*0\r\n")
+}
+
+func TestErrorKinds(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.Set("greeting", "hello"))
+	_, err := c.LPush("greeting", "world")
+	attest.ErrorIs(t, err, client.ErrWrongType)
+
+	// The test cluster holds at most 1024 keys.
+	items := make(map[string]string)
+	for i := range 1025 {
+		items[fmt.Sprintf("key%d", i)] = "value"
+	}
+	attest.ErrorIs(t, c.MSet(items), client.ErrCapacity)
+}
+
+func TestInvalidate(t *testing.T) {
+	clients := servertest.NewCluster(t, 2 /* num clients */)
+	c1, c2 := clients[0], clients[1]
+
+	attest.Ok(t, c1.Set("foo", "bar"))
+	attest.Ok(t, c2.Invalidate())
+
+	// Both nodes still read the database, now in full.
+	for _, c := range clients {
+		val, err := c.Get("foo")
+		attest.Ok(t, err)
+		attest.Equal(t, val, "bar")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	saved, err := c.LastSave()
+	attest.Ok(t, err)
+	attest.True(t, saved.IsZero())
+
+	attest.Ok(t, c.Set("foo", "bar"))
+	start := time.Now().Truncate(time.Second)
+	attest.Ok(t, c.BgSave())
+	// The snapshot is taken in the background.
+	for deadline := time.Now().Add(5 * time.Second); saved.IsZero() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		saved, err = c.LastSave()
+		attest.Ok(t, err)
+	}
+	attest.False(t, saved.IsZero())
+	attest.False(t, saved.Before(start))
+}
+
+func TestSnapshotReads(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.Set("foo", "old"))
+	attest.Ok(t, c.BgSave())
+	var ids []string
+	for deadline := time.Now().Add(5 * time.Second); len(ids) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		var err error
+		ids, err = c.Snapshots()
+		attest.Ok(t, err)
+	}
+	attest.Equal(t, len(ids), 1)
+	id := ids[0]
+	attest.Ok(t, c.Set("foo", "new"))
+	attest.Ok(t, c.Set("bar", "new"))
+
+	val, err := c.GetAt("foo", id)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "old")
+	_, err = c.GetAt("bar", id)
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	_, err = c.GetAt("foo", "../../secrets")
+	attest.Error(t, err)
+
+	// A pinned connection reads the snapshot and can't write.
+	attest.Ok(t, c.PinSnapshot(id))
+	val, err = c.Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "old")
+	n, err := c.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	err = c.Set("foo", "newer")
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "READONLY")
+	attest.Ok(t, c.UnpinSnapshot())
+	val, err = c.Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "new")
+}
+
+func TestDumpRestore(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	fields := map[string]string{"name": "ada", "lang": "go"}
+	_, err := c.HSet("user", fields)
+	attest.Ok(t, err)
+	payload, err := c.Dump("user")
+	attest.Ok(t, err)
+	_, err = c.Dump("missing")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	attest.Ok(t, c.Restore("copy", 0, payload, false))
+	got, err := c.HGetAll("copy")
+	attest.Ok(t, err)
+	attest.Equal(t, got, fields)
+
+	// Restoring over an existing key needs REPLACE, and it replaces values
+	// of any type.
+	attest.Ok(t, c.Set("str", "x"))
+	attest.Error(t, c.Restore("str", 0, payload, false))
+	attest.Ok(t, c.Restore("str", time.Hour, payload, true))
+	got, err = c.HGetAll("str")
+	attest.Ok(t, err)
+	attest.Equal(t, got, fields)
+
+	payload[0] ^= 1
+	attest.Error(t, c.Restore("corrupt", 0, payload, false))
+}
+
+func TestGetDelEx(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+	pttl := func() any {
+		replies, err := c.Pipeline(client.Command{Name: "PTTL", Args: []any{"k"}})
+		attest.Ok(t, err)
+		return replies[0]
+	}
+
+	attest.Ok(t, c.Set("k", "v"))
+	val, err := c.GetEx("k", time.Hour)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	attest.True(t, pttl().(int64) > 0)
+	val, err = c.GetEx("k", 0)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	attest.Equal(t, pttl(), any(int64(-1)))
+	_, err = c.GetEx("missing", time.Hour)
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	val, err = c.GetDel("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	_, err = c.Get("k")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	_, err = c.GetDel("k")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	// Like GET, both only apply to strings.
+	_, err = c.LPush("list", "a")
+	attest.Ok(t, err)
+	_, err = c.GetDel("list")
+	attest.Error(t, err)
+	_, err = c.GetEx("list", 0)
+	attest.Error(t, err)
+}
+
+func TestStrings(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+	pttl := func() any {
+		replies, err := c.Pipeline(client.Command{Name: "PTTL", Args: []any{"k"}})
+		attest.Ok(t, err)
+		return replies[0]
+	}
+
+	_, err := c.GetSet("k", "hello")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err := c.GetSet("k", "hi")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "hello")
+
+	// APPEND and SETRANGE keep the TTL, but GETSET removes it.
+	_, err = c.GetEx("k", time.Hour)
+	attest.Ok(t, err)
+	n, err := c.Append("k", " there")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 8)
+	n, err = c.SetRange("k", 3, "where")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 8)
+	attest.True(t, pttl().(int64) > 0)
+	val, err = c.Get("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "hi where")
+	n, err = c.Strlen("k")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 8)
+	val, err = c.GetRange("k", 3, -1)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "where")
+	val, err = c.GetRange("k", -5, 100)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "where")
+	val, err = c.GetRange("k", 5, 2)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "")
+	_, err = c.GetSet("k", "v")
+	attest.Ok(t, err)
+	attest.Equal(t, pttl(), any(int64(-1)))
+
+	// Missing keys are empty strings. APPEND and SETRANGE create them, except
+	// that SETRANGE with an empty value writes nothing.
+	n, err = c.Strlen("missing")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 0)
+	val, err = c.GetRange("missing", 0, -1)
+	attest.Ok(t, err)
+	attest.Equal(t, val, "")
+	n, err = c.SetRange("padded", 2, "")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 0)
+	_, err = c.Get("padded")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	n, err = c.SetRange("padded", 2, "x")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+	val, err = c.Get("padded")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "\x00\x00x")
+	n, err = c.Append("new", "abc")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+	_, err = c.SetRange("new", -1, "x")
+	attest.Error(t, err)
+
+	_, err = c.LPush("list", "a")
+	attest.Ok(t, err)
+	_, err = c.GetSet("list", "v")
+	attest.Error(t, err)
+	_, err = c.Append("list", "v")
+	attest.Error(t, err)
+	_, err = c.Strlen("list")
+	attest.Error(t, err)
+}
+
+func TestBitfield(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	// Each case runs its steps, in order, on a key that starts with the
+	// initial value (if any). Most expected results are from the examples in
+	// Valkey's BITFIELD documentation.
+	type errReply string
+	type step struct {
+		cmd  string
+		args []any // after the key
+		want any   // or an errReply, which the error must contain
+	}
+	tests := []struct {
+		name    string
+		initial string
+		steps   []step
+	}{
+		{"incrby and get", "", []step{
+			{"BITFIELD", []any{"INCRBY", "i5", 100, 1, "GET", "u4", 0}, []any{int64(1), int64(0)}},
+		}},
+		{"read only", "Hello World", []step{
+			{"BITFIELD_RO", []any{"GET", "i8", 16}, []any{int64(108)}},
+			{"BITFIELD_RO", []any{"SET", "i8", 16, 0}, errReply("BITFIELD_RO only supports the GET subcommand")},
+		}},
+		{"wrap and saturate", "", []step{
+			{"BITFIELD", []any{"INCRBY", "u2", 100, 1, "OVERFLOW", "SAT", "INCRBY", "u2", 102, 1}, []any{int64(1), int64(1)}},
+			{"BITFIELD", []any{"INCRBY", "u2", 100, 1, "OVERFLOW", "SAT", "INCRBY", "u2", 102, 1}, []any{int64(2), int64(2)}},
+			{"BITFIELD", []any{"INCRBY", "u2", 100, 1, "OVERFLOW", "SAT", "INCRBY", "u2", 102, 1}, []any{int64(3), int64(3)}},
+			{"BITFIELD", []any{"INCRBY", "u2", 100, 1, "OVERFLOW", "SAT", "INCRBY", "u2", 102, 1}, []any{int64(0), int64(3)}},
+		}},
+		{"fail", "", []step{
+			{"BITFIELD", []any{"SET", "u2", 102, 3}, []any{int64(0)}},
+			{"BITFIELD", []any{"OVERFLOW", "FAIL", "INCRBY", "u2", 102, 1, "GET", "u2", 102}, []any{nil, int64(3)}},
+			{"BITFIELD", []any{"OVERFLOW", "FAIL", "INCRBY", "u2", 102, -3}, []any{int64(0)}},
+		}},
+		{"signed", "", []step{
+			{"BITFIELD", []any{"SET", "i8", 0, 127, "INCRBY", "i8", 0, 1}, []any{int64(0), int64(-128)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "INCRBY", "i8", 0, -1000}, []any{int64(-128)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "INCRBY", "i8", 0, 1000}, []any{int64(127)}},
+			{"BITFIELD", []any{"GET", "u8", 0}, []any{int64(127)}},
+		}},
+		{"unsigned", "", []step{
+			{"BITFIELD", []any{"INCRBY", "u8", 0, -1}, []any{int64(255)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "INCRBY", "u8", 0, 10}, []any{int64(255)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "INCRBY", "u8", 0, -300}, []any{int64(0)}},
+			{"BITFIELD", []any{"SET", "u8", 0, 256, "GET", "u8", 0}, []any{int64(0), int64(0)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "SET", "u8", 0, 300, "GET", "u8", 0}, []any{int64(0), int64(255)}},
+		}},
+		{"multiplied offsets", "", []step{
+			{"BITFIELD", []any{"SET", "i8", "#0", 100, "SET", "i8", "#1", 200}, []any{int64(0), int64(0)}},
+			{"BITFIELD", []any{"GET", "i8", "#0", "GET", "u8", "#1", "GET", "i8", "#1"}, []any{int64(100), int64(200), int64(-56)}},
+			{"GET", nil, []byte("d\xc8")},
+		}},
+		{"unaligned", "\xff\x0f", []step{
+			{"BITFIELD", []any{"GET", "u4", 2, "GET", "u4", 6, "GET", "i4", 4, "GET", "u8", 4}, []any{int64(15), int64(12), int64(-1), int64(0xf0)}},
+			{"BITFIELD", []any{"GET", "u8", 100}, []any{int64(0)}},
+		}},
+		{"widest", "", []step{
+			{"BITFIELD", []any{"SET", "i64", 0, -1, "GET", "i64", 0, "GET", "u63", 0}, []any{int64(0), int64(-1), int64(math.MaxInt64)}},
+			{"BITFIELD", []any{"OVERFLOW", "SAT", "INCRBY", "i64", 0, math.MinInt64}, []any{int64(math.MinInt64)}},
+		}},
+		{"errors", "", []step{
+			{"BITFIELD", []any{"GET", "u64", 0}, errReply("Invalid bitfield type")},
+			{"BITFIELD", []any{"GET", "x8", 0}, errReply("Invalid bitfield type")},
+			{"BITFIELD", []any{"GET", "i65", 0}, errReply("Invalid bitfield type")},
+			{"BITFIELD", []any{"GET", "u8", -1}, errReply("bit offset is not an integer or out of range")},
+			{"BITFIELD", []any{"OVERFLOW", "MAYBE", "GET", "u8", 0}, errReply("Invalid OVERFLOW type")},
+			{"BITFIELD", []any{"INCRBY", "u8", 0, "one"}, errReply("value is not an integer")},
+			{"BITFIELD", []any{"GET", "u8"}, errReply("syntax error")},
+			// A failed command writes nothing.
+			{"BITFIELD", []any{"SET", "u8", 0, 1, "GET", "u64", 0}, errReply("Invalid bitfield type")},
+			{"EXISTS", nil, int64(0)},
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := fmt.Sprintf("bitfield:%d", i)
+			if tt.initial != "" {
+				attest.Ok(t, c.Set(key, tt.initial))
+			}
+			for _, step := range tt.steps {
+				replies, err := c.Pipeline(client.Command{Name: step.cmd, Args: append([]any{key}, step.args...)})
+				attest.Ok(t, err)
+				desc := attest.Sprintf("%s %v", step.cmd, step.args)
+				if want, ok := step.want.(errReply); ok {
+					attest.Subsequence(t, fmt.Sprint(replies[0]), string(want), desc)
+					continue
+				}
+				attest.Equal(t, replies[0], step.want, desc)
+			}
+		})
+	}
+}
+
+func TestLegacySet(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.SetEx("k", "v", time.Hour))
+	res, err := c.Pipeline(
+		client.Command{Name: "PTTL", Args: []any{"k"}},
+		client.Command{Name: "SETEX", Args: []any{"k", 60, "w"}},
+		client.Command{Name: "TTL", Args: []any{"k"}},
+		client.Command{Name: "SETEX", Args: []any{"k", 0, "x"}},
+		client.Command{Name: "PSETEX", Args: []any{"k", "soon", "x"}},
+		client.Command{Name: "SETNX", Args: []any{"k", "x"}},
+		client.Command{Name: "SETNX", Args: []any{"other", "x"}},
+	)
+	attest.Ok(t, err)
+	attest.True(t, res[0].(int64) > 60_000)
+	attest.Equal(t, res[1], any("OK"))
+	attest.Equal(t, res[2], any(int64(60)))
+	attest.Error(t, res[3].(error))
+	attest.Error(t, res[4].(error))
+	attest.Equal(t, res[5], any(int64(0)))
+	attest.Equal(t, res[6], any(int64(1)))
+	val, err := c.Get("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "w")
+	val, err = c.Get("other")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "x")
+}
+
+func TestExpireOptions(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+	attest.Ok(t, c.Set("k", "v"))
+
+	// Each step runs a command on k and checks its reply, and then checks
+	// k's TTL.
+	type errReply string
+	steps := []struct {
+		cmd  string
+		args []any // after the key
+		want any   // or an errReply, which the error must contain
+		ttl  int64
+	}{
+		// Keys without an expiration live forever, so GT never applies and
+		// LT always does.
+		{"EXPIRE", []any{100, "XX"}, int64(0), -1},
+		{"EXPIRE", []any{100, "GT"}, int64(0), -1},
+		{"EXPIRE", []any{100, "LT"}, int64(1), 100},
+		{"EXPIRE", []any{200, "NX"}, int64(0), 100},
+		{"EXPIRE", []any{50, "GT"}, int64(0), 100},
+		{"EXPIRE", []any{200, "gt"}, int64(1), 200},
+		{"EXPIRE", []any{300, "LT"}, int64(0), 200},
+		{"EXPIRE", []any{150, "XX", "LT"}, int64(1), 150},
+		{"PEXPIRE", []any{149_000, "GT"}, int64(0), 150},
+		{"PEXPIRE", []any{150_000, "LT"}, int64(0), 150},
+		{"PEXPIRE", []any{150_001, "GT", "XX"}, int64(1), 150},
+		{"PERSIST", nil, int64(1), -1},
+		{"EXPIRE", []any{10, "NX"}, int64(1), 10},
+		{"EXPIRE", []any{20}, int64(1), 20},
+		// Past expirations compare as earlier than any current one.
+		{"EXPIRE", []any{-1, "GT"}, int64(0), 20},
+		{"EXPIRE", []any{100, "NX", "XX"}, errReply("NX and XX, GT or LT options at the same time are not compatible"), 20},
+		{"EXPIRE", []any{100, "GT", "NX"}, errReply("NX and XX, GT or LT options at the same time are not compatible"), 20},
+		{"EXPIRE", []any{100, "GT", "LT"}, errReply("GT and LT options at the same time are not compatible"), 20},
+		{"EXPIRE", []any{100, "EX"}, errReply("Unsupported option EX"), 20},
+		{"EXPIRE", []any{"soon", "GT"}, errReply("not an integer"), 20},
+		{"EXPIRE", nil, errReply("wrong number of arguments"), 20},
+		{"EXPIRE", []any{-1, "LT"}, int64(1), -2},
+		{"EXPIRE", []any{100}, int64(0), -2},
+		{"EXPIRE", []any{100, "LT"}, int64(0), -2},
+	}
+	for _, step := range steps {
+		replies, err := c.Pipeline(
+			client.Command{Name: step.cmd, Args: append([]any{"k"}, step.args...)},
+			client.Command{Name: "TTL", Args: []any{"k"}},
+		)
+		attest.Ok(t, err)
+		desc := attest.Sprintf("%s %v", step.cmd, step.args)
+		if want, ok := step.want.(errReply); ok {
+			attest.Subsequence(t, fmt.Sprint(replies[0]), string(want), desc)
+		} else {
+			attest.Equal(t, replies[0], step.want, desc)
+		}
+		attest.Equal(t, replies[1], any(step.ttl), desc)
+	}
+}
+
+func TestRenameCopy(t *testing.T) {
+	addrs := servertest.NewServers(t, 1 /* num servers */, servertest.WithDatabases(2))
+	c, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	attest.Ok(t, c.SetEx("a", "1", time.Hour))
+	attest.Ok(t, c.Rename("a", "b"))
+	_, err = c.Get("a")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err := c.Get("b")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "1")
+	res, err := c.Pipeline(client.Command{Name: "PTTL", Args: []any{"b"}})
+	attest.Ok(t, err)
+	attest.True(t, res[0].(int64) > 0)
+	attest.Error(t, c.Rename("a", "b"))
+	attest.Ok(t, c.Rename("b", "b"))
+
+	_, err = c.SAdd("set", "x", "y")
+	attest.Ok(t, err)
+	ok, err := c.RenameNX("b", "set")
+	attest.Ok(t, err)
+	attest.False(t, ok)
+	ok, err = c.RenameNX("set", "set2")
+	attest.Ok(t, err)
+	attest.True(t, ok)
+
+	// Copies don't share their values with the source.
+	ok, err = c.Copy("set2", "set3", false /* replace */)
+	attest.Ok(t, err)
+	attest.True(t, ok)
+	_, err = c.SRem("set2", "x")
+	attest.Ok(t, err)
+	members, err := c.SMembers("set3")
+	attest.Ok(t, err)
+	attest.Equal(t, len(members), 2)
+	ok, err = c.Copy("b", "set3", false /* replace */)
+	attest.Ok(t, err)
+	attest.False(t, ok)
+	ok, err = c.Copy("b", "set3", true /* replace */)
+	attest.Ok(t, err)
+	attest.True(t, ok)
+	val, err = c.Get("set3")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "1")
+	ok, err = c.Copy("missing", "c", false /* replace */)
+	attest.Ok(t, err)
+	attest.False(t, ok)
+	_, err = c.Copy("b", "b", true /* replace */)
+	attest.Error(t, err)
+
+	res, err = c.Pipeline(
+		client.Command{Name: "COPY", Args: []any{"b", "b", "DB", 1}},
+		client.Command{Name: "COPY", Args: []any{"b", "b", "DB", 2}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, res[0], any(int64(1)))
+	attest.Error(t, res[1].(error))
+	attest.Ok(t, c.Select(1))
+	val, err = c.Get("b")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "1")
+}
+
+func TestScripts(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	const swap = `
+		local a = redis.call("GET", KEYS[1])
+		local b = redis.call("GET", KEYS[2])
+		redis.call("SET", KEYS[1], b)
+		redis.call("SET", KEYS[2], a)
+		return {a, b, tonumber(ARGV[1]) + 1}`
+	attest.Ok(t, c.Set("a", "1"))
+	attest.Ok(t, c.Set("b", "2"))
+	res, err := c.Eval(swap, []string{"a", "b"}, 41)
+	attest.Ok(t, err)
+	attest.Equal(t, res, any([]any{[]byte("1"), []byte("2"), int64(42)}))
+	val, err := c.Get("a")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "2")
+
+	sha, err := c.ScriptLoad(swap)
+	attest.Ok(t, err)
+	_, err = c.EvalSha(sha, []string{"a", "b"}, 0)
+	attest.Ok(t, err)
+	val, err = c.Get("a")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "1")
+	_, err = c.EvalSha("0000000000000000000000000000000000000000", nil)
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "NOSCRIPT")
+
+	// Replies convert like Valkey's: null is false, and status and error
+	// replies are tables.
+	res, err = c.Eval(`
+		local ok = redis.call("SET", KEYS[1], "v")
+		local missing = redis.call("GET", "missing")
+		local err = redis.pcall("INCR", KEYS[1])
+		return {ok.ok, missing == false, err.err ~= nil}`, []string{"c"})
+	attest.Ok(t, err)
+	attest.Equal(t, res, any([]any{[]byte("OK"), int64(1), int64(1)}))
+	res, err = c.Eval(`return redis.status_reply("DONE")`, nil)
+	attest.Ok(t, err)
+	attest.Equal(t, res, any("DONE"))
+
+	// A script that fails writes nothing.
+	_, err = c.Eval(`
+		redis.call("SET", KEYS[1], "changed")
+		return redis.call("INCR", KEYS[1])`, []string{"a"})
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "not an integer")
+	val, err = c.Get("a")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "1")
+	_, err = c.Eval(`error("boom")`, nil)
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "boom")
+	_, err = c.Eval(`return redis.call("CLIENT", "ID")`, nil)
+	attest.Error(t, err)
+	_, err = c.Eval(`return os.exit(1)`, nil)
+	attest.Error(t, err)
+
+	replies, err := c.Pipeline(
+		client.Command{Name: "SCRIPT", Args: []any{"EXISTS", sha, "missing"}},
+		client.Command{Name: "SCRIPT", Args: []any{"FLUSH"}},
+		client.Command{Name: "EVALSHA", Args: []any{sha, 0}},
+		client.Command{Name: "EVAL", Args: []any{"return 1", -1}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any([]any{int64(1), int64(0)}))
+	attest.Equal(t, replies[1], any("OK"))
+	attest.Error(t, replies[2].(error))
+	attest.Error(t, replies[3].(error))
+}
+
+func TestFunctions(t *testing.T) {
+	// Libraries are stored in the bucket, so every node sees them.
+	addrs := servertest.NewServers(t, 2 /* num servers */)
+	clients := make([]*client.Client, len(addrs))
+	for i, addr := range addrs {
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+	c, other := clients[0], clients[1]
+
+	const lib = `#!lua name=counters
+		redis.register_function("bump", function(keys, args)
+			return redis.call("INCRBY", keys[1], args[1])
+		end)
+		redis.register_function{
+			function_name = "peek",
+			callback = function(keys) return redis.call("GET", keys[1]) end,
+			flags = {"no-writes"},
+		}`
+	name, err := c.FunctionLoad(lib, false /* replace */)
+	attest.Ok(t, err)
+	attest.Equal(t, name, "counters")
+	_, err = c.FunctionLoad(lib, false /* replace */)
+	attest.Error(t, err)
+	_, err = c.FunctionLoad(lib, true /* replace */)
+	attest.Ok(t, err)
+
+	res, err := other.FCall("bump", []string{"n"}, 5)
+	attest.Ok(t, err)
+	attest.Equal(t, res, any(int64(5)))
+	replies, err := c.Pipeline(
+		client.Command{Name: "FCALL_RO", Args: []any{"peek", 1, "n"}},
+		client.Command{Name: "FCALL_RO", Args: []any{"bump", 1, "n", 1}},
+		client.Command{Name: "FCALL", Args: []any{"missing", 0}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any([]byte("5")))
+	attest.Error(t, replies[1].(error))
+	attest.Error(t, replies[2].(error))
+
+	// Libraries must register functions that don't exist yet.
+	_, err = c.FunctionLoad("#!lua name=empty\nlocal x = 1", false /* replace */)
+	attest.Error(t, err)
+	_, err = c.FunctionLoad("#!lua name=dup\nredis.register_function('bump', function() end)", false /* replace */)
+	attest.Error(t, err)
+	_, err = c.FunctionLoad("return 1", false /* replace */)
+	attest.Error(t, err)
+
+	payload, err := c.FunctionDump()
+	attest.Ok(t, err)
+	attest.Error(t, c.FunctionRestore(payload))
+	replies, err = c.Pipeline(
+		client.Command{Name: "FUNCTION", Args: []any{"DELETE", "counters"}},
+		client.Command{Name: "FUNCTION", Args: []any{"LIST"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any("OK"))
+	attest.Equal(t, replies[1], any([]any{}))
+	attest.Ok(t, other.FunctionRestore(payload))
+	replies, err = other.Pipeline(
+		client.Command{Name: "FUNCTION", Args: []any{"LIST", "LIBRARYNAME", "count*"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any([]any{[]any{
+		[]byte("library_name"), []byte("counters"),
+		[]byte("engine"), []byte("LUA"),
+		[]byte("functions"), []any{
+			[]any{[]byte("name"), []byte("bump"), []byte("description"), nil, []byte("flags"), []any{}},
+			[]any{[]byte("name"), []byte("peek"), []byte("description"), nil, []byte("flags"), []any{[]byte("no-writes")}},
+		},
+	}}))
+}
+
+func TestObject(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	attest.Ok(t, c.MSet(map[string]string{
+		"int":   "12345",
+		"short": "hello",
+		"long":  strings.Repeat("x", 100),
+	}))
+	_, err := c.SAdd("ints", "1", "2", "3")
+	attest.Ok(t, err)
+	_, err = c.SAdd("words", "a", "b")
+	attest.Ok(t, err)
+	_, err = c.HSet("hash", map[string]string{"f": "v"})
+	attest.Ok(t, err)
+	for key, want := range map[string]string{
+		"int":   "int",
+		"short": "embstr",
+		"long":  "raw",
+		"ints":  "intset",
+		"words": "listpack",
+		"hash":  "listpack",
+	} {
+		enc, err := c.ObjectEncoding(key)
+		attest.Ok(t, err)
+		attest.Equal(t, enc, want, attest.Sprintf("key %q", key))
+	}
+	_, err = c.ObjectEncoding("missing")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	// OBJECT itself doesn't count as an access.
+	freq, err := c.ObjectFreq("short")
+	attest.Ok(t, err)
+	attest.Equal(t, freq, 5)
+	_, err = c.Get("short")
+	attest.Ok(t, err)
+	freq, err = c.ObjectFreq("short")
+	attest.Ok(t, err)
+	attest.Equal(t, freq, 6)
+
+	time.Sleep(1100 * time.Millisecond)
+	idle, err := c.ObjectIdleTime("short")
+	attest.Ok(t, err)
+	attest.True(t, idle >= time.Second)
+	_, err = c.Get("short")
+	attest.Ok(t, err)
+	idle, err = c.ObjectIdleTime("short")
+	attest.Ok(t, err)
+	attest.Equal(t, idle, 0)
+}
+
+func TestInfo(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+
+	res, err := c.Pipeline(
+		client.Command{Name: "SET", Args: []any{"a", "1"}},
+		client.Command{Name: "SET", Args: []any{"b", "2", "EX", 3600}},
+		client.Command{Name: "INCR", Args: []any{"a", "extra"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, len(res), 3)
+	attest.Equal(t, res[1], any("OK"))
+	attest.Error(t, res[2].(error))
+	info, err := c.Info()
+	attest.Ok(t, err)
+	attest.Equal(t, info["redis_version"], "7.2.0")
+	attest.NotZero(t, info["connected_clients"])
+	attest.NotZero(t, info["used_memory"])
+	attest.NotEqual(t, info["storage_requests"], "0")
+	attest.NotEqual(t, info["storage_writes"], "0")
+	attest.True(t, strings.HasPrefix(info["db0"], "keys=2,expires=1,"))
+	attest.Equal(t, info["cluster_enabled"], "0")
+	_, ok := info["cmdstat_set"]
+	attest.False(t, ok, attest.Sprintf("commandstats isn't a default section"))
+
+	info, err = c.Info("commandstats")
+	attest.Ok(t, err)
+	attest.True(t, strings.HasPrefix(info["cmdstat_set"], "calls=2,"))
+	_, ok = info["redis_version"]
+	attest.False(t, ok)
+}
+
+func TestClusterTopology(t *testing.T) {
+	clients := servertest.NewCluster(t, 4 /* num clients */, servertest.WithTopology())
+	cluster := func(c *client.Client, args ...any) any {
+		res, err := c.Pipeline(client.Command{Name: "CLUSTER", Args: args})
+		attest.Ok(t, err)
+		return res[0]
+	}
+
+	// Clients 0 and 1 talk to different nodes, which share one topology.
+	attest.Equal(t, cluster(clients[0], "MYID"), any([]byte("node0")))
+	attest.Equal(t, cluster(clients[1], "MYID"), any([]byte("node1")))
+	slots := cluster(clients[1], "SLOTS").([]any)
+	attest.Equal(t, len(slots), 2)
+	attest.Equal(t, slots[0].([]any)[:2], []any{int64(0), int64(8191)})
+	attest.Equal(t, slots[1].([]any)[:2], []any{int64(8192), int64(16383)})
+	nodes := string(cluster(clients[1], "NODES").([]byte))
+	attest.Subsequence(t, nodes, "node0 ")
+	attest.Subsequence(t, nodes, "myself,master - 0 0 0 connected 8192-16383\n")
+
+	// Slots match Valkey Cluster's, including hash tags.
+	attest.Equal(t, cluster(clients[0], "KEYSLOT", "foo"), any(int64(12182)))
+	attest.Equal(t, cluster(clients[0], "KEYSLOT", "{foo}.bar"), any(int64(12182)))
+
+	info, err := clients[0].Info()
+	attest.Ok(t, err)
+	attest.Equal(t, info["redis_mode"], "cluster")
+	attest.Equal(t, info["cluster_enabled"], "1")
+
+	// Every node still serves every key.
+	attest.Ok(t, clients[0].Set("foo", "bar"))
+	val, err := clients[1].Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bar")
+}
+
+func TestHooks(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		changes []string
+	)
+	record := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+	hooks := server.Hooks{
+		OnWrite: func(db int, e dump.Entry) {
+			switch e.Type {
+			case dump.TypeString:
+				record("write %d %s=%s", db, e.Key, e.String)
+			case dump.TypeHash:
+				record("write %d %s=%v", db, e.Key, e.Hash)
+			default:
+				record("write %d %s (%s)", db, e.Key, e.Type)
+			}
+		},
+		OnDelete: func(db int, key string) { record("delete %d %s", db, key) },
+		OnFlush:  func(db int) { record("flush %d", db) },
+	}
+	addrs := servertest.NewServers(t, 1 /* num servers */, servertest.WithHooks(hooks), servertest.WithDatabases(2))
+	c, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	one, err := client.New(addrs[0], client.WithDatabase(1))
+	attest.Ok(t, err)
+	t.Cleanup(func() { one.Close() })
+
+	attest.Ok(t, c.Set("k", "v1"))
+	attest.Ok(t, c.Set("k", "v2"))
+	_, err = c.HSet("h", map[string]string{"f": "v"})
+	attest.Ok(t, err)
+	_, err = c.LPush("list", "a")
+	attest.Ok(t, err)
+	attest.Ok(t, c.Del("k"))
+	// Deleting a missing key doesn't change anything.
+	attest.ErrorIs(t, c.Del("k"), client.ErrNotFound)
+	// Expired keys are reported when the next write removes them.
+	_, err = c.Pipeline(client.Command{Name: "SET", Args: []any{"e", "v", "PX", 1}})
+	attest.Ok(t, err)
+	time.Sleep(10 * time.Millisecond)
+	attest.Ok(t, c.Set("k", "v3"))
+	// Every logical database is reported.
+	attest.Ok(t, one.Set("k", "one"))
+	attest.Ok(t, c.FlushAll())
+
+	// Hooks run before the server replies, so there's no need to wait.
+	mu.Lock()
+	defer mu.Unlock()
+	attest.Equal(t, changes, []string{
+		"write 0 k=v1",
+		"write 0 k=v2",
+		"write 0 h=map[f:v]",
+		"write 0 list (list)",
+		"delete 0 k",
+		"write 0 e=v",
+		"write 0 k=v3",
+		"delete 0 e",
+		"write 1 k=one",
+		"flush 0",
+		"flush 1",
+	})
+}
+
+func TestMemcached(t *testing.T) {
+	nodes := servertest.NewNodes(t, 1 /* num servers */)
+	c, err := client.New(nodes[0].Addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	conn, err := net.Dial("tcp", nodes[0].MemcachedAddr.String())
+	attest.Ok(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	// roundTrip sends requests and reads n lines of replies.
+	roundTrip := func(req string, n int) []string {
+		t.Helper()
+		_, err := io.WriteString(conn, req)
+		attest.Ok(t, err)
+		lines := make([]string, n)
+		for i := range lines {
+			line, err := r.ReadString('\n')
+			attest.Ok(t, err)
+			lines[i] = strings.TrimSuffix(line, "\r\n")
+		}
+		return lines
+	}
+	ttl := func(key string) time.Duration {
+		t.Helper()
+		res, err := c.Pipeline(client.Command{Name: "TTL", Args: []any{key}})
+		attest.Ok(t, err)
+		return time.Duration(res[0].(int64)) * time.Second
+	}
+
+	// Data blocks are framed by their length, so they may hold line breaks.
+	attest.Equal(t, roundTrip("set k 0 0 5\r\nhello\r\n", 1), []string{"STORED"})
+	attest.Equal(t, roundTrip("set lines 0 0 4\r\na\r\nb\r\n", 1), []string{"STORED"})
+	attest.Equal(t, roundTrip("get k missing lines\r\n", 6), []string{
+		"VALUE k 0 5", "hello",
+		"VALUE lines 0 4", "a", "b",
+		"END",
+	})
+	// Valkey connections see the same keys.
+	val, err := c.Get("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "hello")
+
+	// With noreply, the next reply is the next command's.
+	attest.Equal(t, roundTrip("set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", 3), []string{"VALUE quiet 0 1", "q", "END"})
+	// Flags aren't stored, so only zero is allowed.
+	attest.Equal(t, roundTrip("set flagged 1 0 1\r\nx\r\n", 1), []string{"CLIENT_ERROR nonzero flags aren't supported"})
+	// An oversized value's data block is skipped, not read as commands.
+	big := strings.Repeat("x", 1<<20+1)
+	attest.Equal(t, roundTrip("set big 0 0 "+strconv.Itoa(len(big))+"\r\n"+big+"\r\nget big\r\n", 2), []string{
+		"SERVER_ERROR object too large for cache",
+		"END",
+	})
+
+	// Expiration times up to 30 days are relative, longer ones are Unix
+	// times, and negative ones expire the item at once.
+	attest.Equal(t, roundTrip("set rel 0 100 1\r\nx\r\n", 1), []string{"STORED"})
+	attest.True(t, ttl("rel") > 90*time.Second && ttl("rel") <= 100*time.Second)
+	at := time.Now().Add(time.Hour).Unix()
+	attest.Equal(t, roundTrip("set abs 0 "+strconv.FormatInt(at, 10)+" 1\r\nx\r\n", 1), []string{"STORED"})
+	attest.True(t, ttl("abs") > 50*time.Minute && ttl("abs") <= time.Hour)
+	attest.Equal(t, roundTrip("set k 0 -1 1\r\nx\r\nget k\r\n", 2), []string{"STORED", "END"})
+
+	attest.Equal(t, roundTrip("delete quiet\r\n", 1), []string{"DELETED"})
+	attest.Equal(t, roundTrip("delete quiet\r\n", 1), []string{"NOT_FOUND"})
+	attest.Equal(t, roundTrip("delete lines noreply\r\nget lines\r\n", 1), []string{"END"})
+
+	// Values are unsigned 64-bit integers that wrap on overflow.
+	attest.Equal(t, roundTrip("set n 0 0 2\r\n41\r\nincr n 1\r\n", 2), []string{"STORED", "42"})
+	attest.Equal(t, roundTrip("incr n 1 noreply\r\nget n\r\n", 3), []string{"VALUE n 0 2", "43", "END"})
+	attest.Equal(t, roundTrip("set max 0 0 20\r\n18446744073709551615\r\nincr max 1\r\n", 2), []string{"STORED", "0"})
+	attest.Equal(t, roundTrip("incr missing 1\r\n", 1), []string{"NOT_FOUND"})
+	attest.Equal(t, roundTrip("set s 0 0 1\r\nx\r\nincr s 1\r\n", 2), []string{
+		"STORED",
+		"CLIENT_ERROR cannot increment or decrement non-numeric value",
+	})
+	attest.Equal(t, roundTrip("incr n -1\r\n", 1), []string{"CLIENT_ERROR invalid numeric delta argument"})
+	_, err = c.LPush("list", "1")
+	attest.Ok(t, err)
+	attest.Equal(t, roundTrip("incr list 1\r\n", 1), []string{
+		"CLIENT_ERROR Operation against a key holding the wrong kind of value",
+	})
+
+	// CAS uniques are key versions, so CAS fails after any other write.
+	_, version, err := c.VGet("n")
+	attest.Ok(t, err)
+	unique := strconv.FormatUint(version, 10)
+	attest.Equal(t, roundTrip("gets n\r\n", 3), []string{"VALUE n 0 2 " + unique, "43", "END"})
+	attest.Equal(t, roundTrip("cas n 0 0 1 "+unique+"\r\n7\r\ncas n 0 0 1 "+unique+"\r\n8\r\nget n\r\n", 5), []string{
+		"STORED",
+		"EXISTS",
+		"VALUE n 0 1", "7",
+		"END",
+	})
+	attest.Equal(t, roundTrip("cas missing 0 0 1 1\r\nx\r\n", 1), []string{"NOT_FOUND"})
+
+	// Overlong command lines are refused, and the connection is closed,
+	// since the rest of the line can't be told apart from commands.
+	attest.Equal(t, roundTrip("get "+strings.Repeat("k", 64<<10)+"\r\n", 1), []string{"CLIENT_ERROR line too long"})
+	_, err = r.ReadString('\n')
+	attest.Error(t, err)
+}
+
+func TestClients(t *testing.T) {
+	clients := servertest.NewCluster(t, 2 /* num clients */)
+	c, other := clients[0], clients[1]
+
+	replies, err := c.Pipeline(
+		client.Command{Name: "CLIENT", Args: []any{"GETNAME"}},
+		client.Command{Name: "CLIENT", Args: []any{"SETNAME", "worker-1"}},
+		client.Command{Name: "CLIENT", Args: []any{"GETNAME"}},
+		client.Command{Name: "CLIENT", Args: []any{"SETNAME", "bad name"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[:3], []any{nil, "OK", []byte("worker-1")})
+	attest.Subsequence(t, fmt.Sprint(replies[3]), "cannot contain spaces")
+
+	id, err := c.ClientID()
+	attest.Ok(t, err)
+	otherID, err := other.ClientID()
+	attest.Ok(t, err)
+	attest.NotEqual(t, id, otherID)
+
+	list, err := other.ClientList()
+	attest.Ok(t, err)
+	attest.Subsequence(t, list, fmt.Sprintf("id=%d ", id))
+	attest.Subsequence(t, list, "name=worker-1 ")
+	attest.Subsequence(t, list, fmt.Sprintf("id=%d ", otherID))
+	attest.Subsequence(t, list, "cmd=client ")
+
+	// By default, CLIENT KILL doesn't close the caller's own connection.
+	n, err := c.ClientKill(id)
+	attest.Ok(t, err)
+	attest.Equal(t, n, 0)
+
+	// The cluster's clients are closed when the test ends, so dial another
+	// connection to kill, using the address CLIENT LIST reports.
+	var laddr string
+	for field := range strings.FieldsSeq(list) {
+		if addr, ok := strings.CutPrefix(field, "laddr="); ok {
+			laddr = addr
+		}
+	}
+	addr, err := net.ResolveTCPAddr("tcp", laddr)
+	attest.Ok(t, err)
+	victim, err := client.New(addr)
+	attest.Ok(t, err)
+	victimID, err := victim.ClientID()
+	attest.Ok(t, err)
+	n, err = c.ClientKill(victimID)
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	attest.Error(t, victim.Ping())
+	list, err = c.ClientList()
+	attest.Ok(t, err)
+	attest.False(t, strings.Contains(list, fmt.Sprintf("id=%d ", victimID)))
+}
+
+func TestResume(t *testing.T) {
+	// With four clients, there are two servers, and clients 0 and 1 talk to
+	// different ones.
+	clients := servertest.NewCluster(t, 4 /* num clients */)
+	before, after, other := clients[0], clients[1], clients[2]
+
+	_, err := before.Pipeline(client.Command{Name: "CLIENT", Args: []any{"SETNAME", "resumed"}})
+	attest.Ok(t, err)
+	attest.Ok(t, before.Set("balance", "10"))
+	attest.Ok(t, before.Watch("balance"))
+	token, err := before.SessionToken()
+	attest.Ok(t, err)
+
+	attest.Ok(t, after.Resume(token))
+	replies, err := after.Pipeline(client.Command{Name: "CLIENT", Args: []any{"GETNAME"}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies, []any{[]byte("resumed")})
+	// The watch carries over, so a write since the original WATCH aborts the
+	// resumed connection's transaction.
+	attest.Ok(t, other.Set("balance", "11"))
+	_, err = after.Exec(client.Command{Name: "SET", Args: []any{"balance", "20"}})
+	attest.ErrorIs(t, err, client.ErrAborted)
+
+	// Tokens are signed, so they can't be forged.
+	attest.Error(t, after.Resume(token+"x"))
+	attest.Error(t, after.Resume("garbage"))
+}
+
+func TestTransactions(t *testing.T) {
+	clients := servertest.NewCluster(t, 2 /* num clients */)
+	c1, c2 := clients[0], clients[1]
+
+	res, err := c1.Exec(
+		client.Command{Name: "SET", Args: []any{"balance", "10"}},
+		client.Command{Name: "INCRBY", Args: []any{"balance", 5}},
+		client.Command{Name: "GET", Args: []any{"balance"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, res, []any{"OK", int64(15), []byte("15")})
+
+	// A write between WATCH and EXEC aborts the transaction, even if it
+	// doesn't change the value.
+	attest.Ok(t, c1.Watch("balance"))
+	attest.Ok(t, c2.Set("balance", "15"))
+	_, err = c1.Exec(client.Command{Name: "SET", Args: []any{"balance", "20"}})
+	attest.ErrorIs(t, err, client.ErrAborted)
+	val, err := c1.Get("balance")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "15")
+
+	// EXEC unwatches every key, so the next transaction applies.
+	attest.Ok(t, c2.Set("balance", "16"))
+	_, err = c1.Exec(client.Command{Name: "SET", Args: []any{"balance", "20"}})
+	attest.Ok(t, err)
+
+	// So do writes to keys that didn't exist when they were watched.
+	attest.Ok(t, c1.Watch("missing"))
+	attest.Ok(t, c2.Set("missing", "here"))
+	_, err = c1.Exec(client.Command{Name: "DEL", Args: []any{"missing"}})
+	attest.ErrorIs(t, err, client.ErrAborted)
+
+	// Even if the key is deleted again before EXEC.
+	attest.Ok(t, c2.Del("missing"))
+	attest.Ok(t, c1.Watch("missing"))
+	attest.Ok(t, c2.Set("missing", "back"))
+	attest.Ok(t, c2.Del("missing"))
+	_, err = c1.Exec(client.Command{Name: "SET", Args: []any{"missing", "here"}})
+	attest.ErrorIs(t, err, client.ErrAborted)
+
+	attest.Ok(t, c1.Watch("balance"))
+	attest.Ok(t, c1.Unwatch())
+	attest.Ok(t, c2.Set("balance", "21"))
+	_, err = c1.Exec(client.Command{Name: "SET", Args: []any{"balance", "22"}})
+	attest.Ok(t, err)
+}
+
+func TestPubSub(t *testing.T) {
+	// Clients 0 and 2 share a node, as do clients 1 and 3.
+	clients := servertest.NewCluster(t, 4 /* num clients */)
+	local, remote, publisher := clients[0], clients[1], clients[2]
+
+	attest.Ok(t, local.Subscribe("news"))
+	attest.Ok(t, remote.Subscribe("news"))
+
+	// Only subscribers on the publisher's node are counted.
+	n, err := publisher.Publish("news", "hello")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+
+	for _, c := range []*client.Client{local, remote} {
+		channel, msg, err := c.Receive(5 * time.Second)
+		attest.Ok(t, err)
+		attest.Equal(t, channel, "news")
+		attest.Equal(t, msg, "hello")
+	}
+}
+
+func TestShardedPubSub(t *testing.T) {
+	// Without a topology, every node serves every shard channel, and
+	// messages are relayed between nodes. Clients 0 and 2 share a node, as
+	// do clients 1 and 3.
+	clients := servertest.NewCluster(t, 4 /* num clients */)
+	local, remote, publisher := clients[0], clients[1], clients[2]
+	attest.Error(t, local.SSubscribe("foo", "bar")) // different slots
+	attest.Ok(t, local.SSubscribe("orders"))
+	attest.Ok(t, remote.SSubscribe("orders"))
+	n, err := publisher.SPublish("orders", "hello")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	for _, c := range []*client.Client{local, remote} {
+		channel, msg, err := c.Receive(5 * time.Second)
+		attest.Ok(t, err)
+		attest.Equal(t, channel, "orders")
+		attest.Equal(t, msg, "hello")
+	}
+
+	// With a topology, only the node owning a channel's slot serves it, so
+	// messages are delivered directly. Node 1 owns foo's slot, 12182.
+	clients = servertest.NewCluster(t, 4 /* num clients */, servertest.WithTopology())
+	other, subscriber, owner := clients[0], clients[1], clients[3]
+	_, err = other.SPublish("foo", "x")
+	attest.Error(t, err)
+	attest.True(t, strings.HasPrefix(err.Error(), "MOVED 12182 "), attest.Sprintf("got %v", err))
+	attest.Error(t, other.SSubscribe("foo"))
+	attest.Ok(t, subscriber.SSubscribe("foo", "{foo}.bar"))
+	n, err = owner.SPublish("{foo}.bar", "hello")
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+	channel, msg, err := subscriber.Receive(5 * time.Second)
+	attest.Ok(t, err)
+	attest.Equal(t, channel, "{foo}.bar")
+	attest.Equal(t, msg, "hello")
+
+	// Subscribed connections only accept pub/sub commands.
+	_, err = subscriber.Get("foo")
+	attest.Error(t, err)
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	// Clients 0 and 2 share a node, as do clients 1 and 3.
+	clients := servertest.NewCluster(t, 4 /* num clients */)
+	writer, remote, local := clients[0], clients[1], clients[2]
+
+	// Notifications are off by default, and only the writer's node needs
+	// them on.
+	attest.Error(t, writer.ConfigSet("notify-keyspace-events", "KEQ"))
+	attest.Ok(t, writer.ConfigSet("notify-keyspace-events", "KEg$"))
+	attest.Ok(t, remote.Subscribe("__keyspace@0__:foo"))
+	attest.Ok(t, local.Subscribe("__keyevent@0__:del"))
+
+	attest.Ok(t, writer.Set("foo", "bar"))
+	attest.Ok(t, writer.Del("foo"))
+
+	for _, event := range []string{"set", "del"} {
+		channel, msg, err := remote.Receive(5 * time.Second)
+		attest.Ok(t, err)
+		attest.Equal(t, channel, "__keyspace@0__:foo")
+		attest.Equal(t, msg, event)
+	}
+	channel, msg, err := local.Receive(5 * time.Second)
+	attest.Ok(t, err)
+	attest.Equal(t, channel, "__keyevent@0__:del")
+	attest.Equal(t, msg, "foo")
+}
+
+func TestClockSkew(t *testing.T) {
+	// Clients 0 and 2 share a node, as do clients 1 and 3. The second node's
+	// clock runs an hour ahead.
+	clients := servertest.NewCluster(t, 4 /* num clients */, servertest.WithClockSkew(0, time.Hour))
+	accurate, ahead := clients[0], clients[1]
+
+	// Keys expire according to the clock of the node reading them.
+	_, err := accurate.Exec(client.Command{Name: "SET", Args: []any{"session", "abc", "EX", 60}})
+	attest.Ok(t, err)
+	_, err = ahead.Get("session")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err := accurate.Get("session")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "abc")
+
+	// So do lock leases, so the node that's ahead can take over a lease
+	// that's still current elsewhere, locking out the original owner.
+	_, err = accurate.Lock("job", "first", time.Minute)
+	attest.Ok(t, err)
+	_, err = ahead.Lock("job", "second", time.Minute)
+	attest.Ok(t, err)
+	_, err = accurate.Lock("job", "first", time.Minute)
+	attest.ErrorIs(t, err, client.ErrLocked)
+}
+
+func TestStorageLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	clients := servertest.NewCluster(t, 1 /* num clients */, servertest.WithStorageLatency(latency))
+	c := clients[0]
+
+	// Every write reads and then writes object storage.
+	start := time.Now()
+	attest.Ok(t, c.Set("foo", "bar"))
+	attest.True(t, time.Since(start) >= 2*latency)
+}
+
+func TestLimits(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */, servertest.WithLimits(servertest.Limits{
+		MaxClients:      2,
+		MaxCommandRate:  20,
+		MaxOutputBuffer: 4096,
+	}))[0]
+	dial := func() *client.Client {
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	c, other := dial(), dial()
+	attest.Ok(t, other.Ping())
+	err := dial().Ping()
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "max number of clients reached")
+
+	// The rate limit allows bursts of a second's worth of commands.
+	cmds := make([]client.Command, 30)
+	for i := range cmds {
+		cmds[i] = client.Command{Name: "PING"}
+	}
+	replies, err := c.Pipeline(cmds...)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any("PONG"))
+	attest.Subsequence(t, fmt.Sprint(replies[len(replies)-1]), "max command rate exceeded")
+
+	// Pipelined replies that don't fit in the output buffer close the
+	// connection.
+	attest.Ok(t, other.Set("big", strings.Repeat("x", 3000)))
+	_, err = other.Pipeline(
+		client.Command{Name: "GET", Args: []any{"big"}},
+		client.Command{Name: "GET", Args: []any{"big"}},
+	)
+	attest.Error(t, err)
+}
+
+func TestWriteAttempts(t *testing.T) {
+	// With a single attempt, writes that conflict with another node's fail
+	// instead of retrying, and they're never applied.
+	clients := servertest.NewCluster(t, 4 /* num clients */, servertest.WithWriteAttempts(1))
+	var applied atomic.Int64
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Go(func() {
+			for range 25 {
+				_, err := c.IncrBy("counter", 1)
+				if err != nil {
+					attest.ErrorIs(t, err, client.ErrContention)
+					continue
+				}
+				applied.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	got, err := clients[0].Get("counter")
+	attest.Ok(t, err)
+	attest.Equal(t, got, fmt.Sprint(applied.Load()))
+}
+
+func TestCommandTimeouts(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	clients := servertest.NewCluster(t, 1, /* num clients */
+		servertest.WithStorageLatency(latency),
+		servertest.WithCommandTimeouts(server.CommandTimeouts{Read: latency / 2}),
+	)
+	c := clients[0]
+
+	// Writes have no deadline, but reads give up before object storage
+	// replies.
+	attest.Ok(t, c.Set("foo", "bar"))
+	_, err := c.Get("foo")
+	attest.ErrorIs(t, err, client.ErrTimeout)
+	// The connection is still usable.
+	attest.Ok(t, c.Set("foo", "baz"))
+}
+
+func TestQueuedWriteTimeout(t *testing.T) {
+	var (
+		armed  atomic.Bool
+		held   = make(chan struct{})
+		resume = make(chan struct{})
+		// If the test fails, shutting down mustn't wait for FLUSHALL
+		// forever.
+		release = sync.OnceFunc(func() { close(resume) })
+	)
+	t.Cleanup(release)
+	store := simstore.New(simstore.Options{
+		Before: func(_, key string) {
+			// Pause FLUSHALL's first call to object storage, which it
+			// makes while holding the shard.
+			if servertest.DatabaseObject(key) && armed.CompareAndSwap(true, false) {
+				close(held)
+				<-resume
+			}
+		},
+	})
+	clients := servertest.NewCluster(t, 2, /* num clients */
+		servertest.WithSimulatedStorage(store),
+		servertest.WithCommandTimeouts(server.CommandTimeouts{Write: 100 * time.Millisecond}),
+	)
+	slow, c := clients[0], clients[1]
+
+	// FLUSHALL has no deadline. A write queued behind it gives up at its
+	// own deadline, rather than once the shard is free.
+	armed.Store(true)
+	flushed := make(chan error, 1)
+	go func() { flushed <- slow.FlushAll() }()
+	<-held
+	attest.ErrorIs(t, c.Set("foo", "bar"), client.ErrTimeout)
+	release()
+	attest.Ok(t, <-flushed)
+	// The write was withdrawn, not applied late.
+	_, err := c.Get("foo")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestClientDisconnect(t *testing.T) {
+	const latency = 200 * time.Millisecond
+	addr := servertest.NewServers(t, 1 /* num servers */, servertest.WithStorageLatency(latency))[0]
+	c, err := client.New(addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	// The connection is watched between commands as well as during them.
+	conn, err := net.Dial("tcp", addr.String())
+	attest.Ok(t, err)
+	r := bufio.NewReader(conn)
+	for range 3 {
+		_, err = io.WriteString(conn, "PING\r\n")
+		attest.Ok(t, err)
+		line, err := r.ReadString('\n')
+		attest.Ok(t, err)
+		attest.Equal(t, line, "+PONG\r\n")
+	}
+
+	// A write whose client disconnects stops before it reaches object
+	// storage.
+	_, err = io.WriteString(conn, "SET foo bar\r\n")
+	attest.Ok(t, err)
+	time.Sleep(latency / 2)
+	attest.Ok(t, conn.Close())
+	time.Sleep(3 * latency)
+	_, err = c.Get("foo")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestShutdown(t *testing.T) {
+	const latency = 200 * time.Millisecond
+	nodes := servertest.NewNodes(t, 2 /* num servers */, servertest.WithStorageLatency(latency))
+	c, err := client.New(nodes[0].Addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	idle := dialRESP(t, nodes[0].Addr)
+	attest.Equal(t, idle("PING"), "+PONG\r\n")
+
+	set := make(chan error, 1)
+	go func() { set <- c.Set("foo", "bar") }()
+	time.Sleep(latency / 2)
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- nodes[0].Server.Shutdown(ctx)
+	}()
+	time.Sleep(latency / 4)
+
+	// While the write is still running, the server refuses new connections
+	// and new commands, but it keeps open connections open.
+	_, err = net.DialTimeout("tcp", nodes[0].Addr.String(), latency)
+	attest.Error(t, err)
+	attest.Equal(t, idle("PING"), "-ERR server is shutting down\r\n")
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the write finished: %v", err)
+	default:
+	}
+
+	// The write finishes and replies before the server closes.
+	attest.Ok(t, <-set)
+	attest.Ok(t, <-shutdown)
+	other, err := client.New(nodes[1].Addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { other.Close() })
+	val, err := other.Get("foo")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bar")
+}
+
+func TestDebug(t *testing.T) {
+	const sweep = 20 * time.Millisecond
+	clients := servertest.NewCluster(t, 1, /* num clients */
+		servertest.WithDebugCommands(),
+		servertest.WithExpireSweep(sweep),
+	)
+	c := clients[0]
+	debug := func(args ...any) any {
+		replies, err := c.Pipeline(client.Command{Name: "DEBUG", Args: args})
+		attest.Ok(t, err)
+		return replies[0]
+	}
+
+	attest.Ok(t, c.Set("greeting", "hello"))
+	object := fmt.Sprint(debug("OBJECT", "greeting"))
+	attest.Subsequence(t, object, "type:string")
+	attest.Subsequence(t, object, "serializedlength:5")
+	attest.Subsequence(t, fmt.Sprint(debug("OBJECT", "missing")), "no such key")
+
+	cache, ok := debug("CACHE").([]any)
+	attest.True(t, ok)
+	attest.Equal(t, len(cache), 1)
+	attest.Subsequence(t, fmt.Sprintf("%s", cache[0]), "shard:test")
+
+	// QUICKSAVE rewrites the shard even though nothing has changed, and
+	// RELOAD re-reads it. Neither changes the data.
+	storageCount := func(field string) int {
+		info, err := c.Info()
+		attest.Ok(t, err)
+		n, err := strconv.Atoi(info[field])
+		attest.Ok(t, err)
+		return n
+	}
+	writes := storageCount("storage_writes")
+	attest.Equal(t, debug("QUICKSAVE"), any("OK"))
+	attest.Equal(t, storageCount("storage_writes"), writes+1)
+	downloads := func() int {
+		return storageCount("storage_reads") - storageCount("storage_cache_hits")
+	}
+	before := downloads()
+	attest.Equal(t, debug("RELOAD"), any("OK"))
+	attest.Equal(t, downloads(), before+1)
+	val, err := c.Get("greeting")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "hello")
+	attest.Subsequence(t, fmt.Sprint(debug("RELOAD", "now")), "wrong number of arguments")
+
+	start := time.Now()
+	attest.Equal(t, debug("SLEEP", "0.1"), any("OK"))
+	attest.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// Pausing the sweep leaves expired keys in object storage, though
+	// clients can't see them. Resuming it removes them.
+	cachedBytes := func() int {
+		cache, ok := debug("CACHE").([]any)
+		attest.True(t, ok)
+		for _, field := range strings.Fields(fmt.Sprintf("%s", cache[0])) {
+			if n, ok := strings.CutPrefix(field, "bytes:"); ok {
+				bytes, err := strconv.Atoi(n)
+				attest.Ok(t, err)
+				return bytes
+			}
+		}
+		t.Fatalf("no bytes field in %q", cache[0])
+		return 0
+	}
+	attest.Equal(t, debug("SET-ACTIVE-EXPIRE", "0"), any("OK"))
+	replies, err := c.Pipeline(client.Command{Name: "SET", Args: []any{"doomed", strings.Repeat("x", 1024), "PX", 1}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any("OK"))
+	time.Sleep(10 * sweep)
+	_, err = c.Get("doomed")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	attest.True(t, cachedBytes() > 1024)
+	attest.Equal(t, debug("SET-ACTIVE-EXPIRE", "1"), any("OK"))
+	deadline := time.Now().Add(5 * time.Second)
+	for cachedBytes() > 1024 && time.Now().Before(deadline) {
+		time.Sleep(sweep)
+	}
+	attest.True(t, cachedBytes() < 1024)
+	attest.Subsequence(t, fmt.Sprint(debug("SET-ACTIVE-EXPIRE", "maybe")), "not an integer")
+}
+
+func TestDebugSleepTimeout(t *testing.T) {
+	clients := servertest.NewCluster(t, 1, /* num clients */
+		servertest.WithDebugCommands(),
+		servertest.WithCommandTimeouts(server.CommandTimeouts{Admin: 100 * time.Millisecond}),
+	)
+	c := clients[0]
+
+	// DEBUG SLEEP gives up at the command's deadline, like any other
+	// command, and the connection is still usable.
+	start := time.Now()
+	replies, err := c.Pipeline(client.Command{Name: "DEBUG", Args: []any{"SLEEP", 10}})
+	attest.Ok(t, err)
+	attest.Subsequence(t, fmt.Sprint(replies[0]), "timed out")
+	attest.True(t, time.Since(start) < 5*time.Second)
+	attest.Ok(t, c.Set("foo", "bar"))
+}
+
+func TestDebugDisabled(t *testing.T) {
+	clients := servertest.NewCluster(t, 1 /* num clients */)
+	c := clients[0]
+	attest.Ok(t, c.Set("greeting", "hello"))
+
+	// Every subcommand needs EnableDebugCommands.
+	for _, args := range [][]any{
+		{"RELOAD"},
+		{"QUICKSAVE"},
+		{"SLEEP", 0},
+		{"OBJECT", "greeting"},
+		{"CACHE"},
+		{"SET-ACTIVE-EXPIRE", 0},
+	} {
+		replies, err := c.Pipeline(client.Command{Name: "DEBUG", Args: args})
+		attest.Ok(t, err)
+		attest.Subsequence(t, fmt.Sprint(replies[0]), "DEBUG command not allowed", attest.Sprintf("DEBUG %v", args))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	dial := func(opts ...client.Option) *client.Client {
+		c, err := client.New(addr, opts...)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	admin := dial()
+	for _, app := range []string{"app1", "app2"} {
+		replies, err := admin.Pipeline(client.Command{
+			Name: "ACL",
+			Args: []any{"SETUSER", app, "on", ">" + app + "-secret", "~*", "+@all", "namespace:" + app},
+		})
+		attest.Ok(t, err)
+		attest.Equal(t, replies[0], any("OK"))
+	}
+	app1 := dial(client.WithUser("app1", "app1-secret"))
+	app2 := dial(client.WithUser("app2", "app2-secret"))
+
+	// Each namespace has its own keys.
+	attest.Ok(t, app1.Set("greeting", "hello"))
+	attest.Ok(t, app2.Set("greeting", "bonjour"))
+	attest.Ok(t, app2.Set("farewell", "au revoir"))
+	val, err := app1.Get("greeting")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "hello")
+	keys, err := app2.Keys("*")
+	attest.Ok(t, err)
+	slices.Sort(keys)
+	attest.Equal(t, keys, []string{"farewell", "greeting"})
+	n, err := app1.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1)
+
+	// Users without a namespace see every key, under the namespaces'
+	// prefixes.
+	n, err = admin.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 3)
+	_, err = admin.Get("greeting")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	// Flushing a namespace leaves the others alone.
+	attest.Ok(t, app1.FlushAll())
+	_, err = app1.Get("greeting")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err = app2.Get("greeting")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "bonjour")
+
+	// Libraries and scripts are shared, so namespaced users can't manage
+	// them.
+	replies, err := app1.Pipeline(
+		client.Command{Name: "FUNCTION", Args: []any{"FLUSH"}},
+		client.Command{Name: "SCRIPT", Args: []any{"FLUSH"}},
+	)
+	attest.Ok(t, err)
+	for _, reply := range replies {
+		err, ok := reply.(error)
+		attest.True(t, ok)
+		attest.Subsequence(t, err.Error(), "namespace")
+	}
+	replies, err = admin.Pipeline(client.Command{Name: "FUNCTION", Args: []any{"FLUSH"}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any("OK"))
+}
+
+func TestACL(t *testing.T) {
+	node := servertest.NewNodes(t, 1 /* num servers */)[0]
+	dial := func(opts ...client.Option) *client.Client {
+		c, err := client.New(node.Addr, opts...)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	setUser := func(c *client.Client, name string, rules ...any) {
+		t.Helper()
+		replies, err := c.Pipeline(client.Command{Name: "ACL", Args: append([]any{"SETUSER", name}, rules...)})
+		attest.Ok(t, err)
+		attest.Equal(t, replies[0], any("OK"))
+	}
+	noPerm := func(err error) {
+		t.Helper()
+		attest.Error(t, err)
+		attest.Subsequence(t, err.Error(), "NOPERM")
+	}
+	admin := dial()
+	setUser(admin, "root", "on", ">root-secret", "~*", "+@all")
+	setUser(admin, "app", "on", ">app-secret", "~app:*", "+@all", "-flushall")
+	setUser(admin, "reader", "on", ">reader-secret", "~app:*", "+get", "+keys", "+eval", "+multi", "+exec")
+	setUser(admin, "retired", "off", ">retired-secret", "~*", "+@all")
+	root := dial(client.WithUser("root", "root-secret"))
+	app := dial(client.WithUser("app", "app-secret"))
+	reader := dial(client.WithUser("reader", "reader-secret"))
+	for _, opts := range []client.Option{
+		client.WithUser("app", "wrong"),
+		client.WithUser("retired", "retired-secret"),
+		client.WithUser("nobody", "secret"),
+	} {
+		_, err := client.New(node.Addr, opts)
+		attest.Error(t, err)
+	}
+	attest.Ok(t, root.Set("hidden:1", "secret"))
+
+	// Users may only run their commands on their keys.
+	attest.Ok(t, app.Set("app:1", "v"))
+	noPerm(app.Set("hidden:1", "v"))
+	noPerm(app.MSet(map[string]string{"app:2": "v", "hidden:1": "v"}))
+	noPerm(app.FlushAll())
+	_, err := app.Lock("hidden:lock", "app", time.Minute)
+	noPerm(err)
+	_, err = app.Lock("app:lock", "app", time.Minute)
+	attest.Ok(t, err)
+	_, err = app.Get("app:2")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err := reader.Get("app:1")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	noPerm(reader.Set("app:1", "x"))
+	_, err = reader.Get("hidden:1")
+	noPerm(err)
+	// RANGE skips the keys a user may not read, rather than refusing.
+	kvs, err := app.Range("", "", 0)
+	attest.Ok(t, err)
+	attest.Equal(t, kvs, []client.KeyValue{{Key: "app:1", Value: "v"}})
+
+	// Scripts are checked both for the keys they declare and for each call
+	// they make.
+	res, err := reader.Eval(`return redis.call("GET", KEYS[1])`, []string{"app:1"})
+	attest.Ok(t, err)
+	attest.Equal(t, res, any([]byte("v")))
+	_, err = reader.Eval(`return redis.call("SET", KEYS[1], "x")`, []string{"app:1"})
+	noPerm(err)
+	_, err = app.Eval(`return redis.call("GET", KEYS[1])`, []string{"hidden:1"})
+	noPerm(err)
+	_, err = app.Eval(`return redis.call("GET", "hidden:1")`, nil)
+	noPerm(err)
+
+	// A refused command inside MULTI aborts the whole transaction.
+	_, err = app.Exec(
+		client.Command{Name: "SET", Args: []any{"app:3", "v"}},
+		client.Command{Name: "SET", Args: []any{"hidden:1", "v"}},
+	)
+	noPerm(err)
+	_, err = app.Get("app:3")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	_, err = reader.Exec(client.Command{Name: "DEL", Args: []any{"app:1"}})
+	noPerm(err)
+
+	// The dashboard only shows the keys the user may read, and only the
+	// values of types it may read.
+	_, err = app.HSet("app:h", map[string]string{"field": "hash-value"})
+	attest.Ok(t, err)
+	status, body := fetchDashboard(t, node.AdminAddr, "reader", "reader-secret", "")
+	attest.Equal(t, status, http.StatusOK)
+	attest.Subsequence(t, body, "app:1")
+	attest.Subsequence(t, body, "app:h")
+	attest.False(t, strings.Contains(body, "hidden:1"), attest.Sprint("dashboard shows a denied key"))
+	attest.False(t, strings.Contains(body, "hash-value"), attest.Sprint("dashboard shows a value of a type the user can't read"))
+	_, body = fetchDashboard(t, node.AdminAddr, "app", "app-secret", "")
+	attest.Subsequence(t, body, "hash-value")
+
+	// Memcached clients act as the default user.
+	setUser(root, "default", "resetkeys", "~cache:*")
+	conn, err := net.Dial("tcp", node.MemcachedAddr.String())
+	attest.Ok(t, err)
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	for _, tt := range []struct{ req, want string }{
+		{"set cache:1 0 0 1\r\nx\r\n", "STORED"},
+		{"set app:1 0 0 1\r\nx\r\n", "CLIENT_ERROR NOPERM"},
+		{"get hidden:1\r\n", "CLIENT_ERROR NOPERM"},
+		{"delete app:1\r\n", "CLIENT_ERROR NOPERM"},
+	} {
+		_, err := io.WriteString(conn, tt.req)
+		attest.Ok(t, err)
+		line, err := r.ReadString('\n')
+		attest.Ok(t, err)
+		attest.True(t, strings.HasPrefix(line, tt.want), attest.Sprintf("%q: got %q", tt.req, line))
+	}
+	val, err = root.Get("app:1")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+}
+
+func TestAdminDashboard(t *testing.T) {
+	const password = "secret"
+	node := servertest.NewNodes(t, 1, /* num servers */
+		servertest.WithPassword(password),
+		servertest.WithDatabases(2),
+	)[0]
+	dial := func(opts ...client.Option) *client.Client {
+		c, err := client.New(node.Addr, opts...)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	c := dial(client.WithPassword(password))
+	row := func(key, typ, value string) string {
+		return "<tr><td><code>" + key + "</code></td><td>" + typ + "</td><td><code>" + value + "</code></td></tr>"
+	}
+
+	// The dashboard needs the same credentials as the Valkey protocol.
+	for _, user := range [][2]string{{"", ""}, {"default", "wrong"}, {"nobody", password}} {
+		status, _ := fetchDashboard(t, node.AdminAddr, user[0], user[1], "")
+		attest.Equal(t, status, http.StatusUnauthorized, attest.Sprintf("user %q, password %q", user[0], user[1]))
+	}
+
+	// It shows every type of value.
+	attest.Ok(t, c.Set("str", "hello"))
+	_, err := c.HSet("hash", map[string]string{"b": "2", "a": "1"})
+	attest.Ok(t, err)
+	_, err = c.RPush("list", "x", "y", "x")
+	attest.Ok(t, err)
+	_, err = c.SAdd("set", "n", "m")
+	attest.Ok(t, err)
+	_, err = c.ZAdd("zset", client.ZMember{Member: "hi", Score: 2}, client.ZMember{Member: "lo", Score: 1.5})
+	attest.Ok(t, err)
+	status, body := fetchDashboard(t, node.AdminAddr, "default", password, "")
+	attest.Equal(t, status, http.StatusOK)
+	for _, want := range []string{
+		row("hash", "hash", "a: 1, b: 2"),
+		row("list", "list", "x, y, x"),
+		row("set", "set", "m, n"),
+		row("str", "string", "hello"),
+		row("zset", "zset", "lo: 1.5, hi: 2"),
+	} {
+		attest.Subsequence(t, body, want)
+	}
+
+	// Each logical database is browsed separately.
+	db1 := dial(client.WithPassword(password), client.WithDatabase(1))
+	attest.Ok(t, db1.Set("elsewhere", "there"))
+	_, body = fetchDashboard(t, node.AdminAddr, "default", password, "db=1")
+	attest.Subsequence(t, body, row("elsewhere", "string", "there"))
+	attest.False(t, strings.Contains(body, row("str", "string", "hello")), attest.Sprint("database 1 shows database 0's keys"))
+	_, body = fetchDashboard(t, node.AdminAddr, "default", password, "db=2")
+	attest.Subsequence(t, body, "DB index is out of range")
+
+	// Users only see the keys they may read, and nothing if they may not
+	// list keys at all.
+	for _, rules := range [][]any{
+		{"SETUSER", "strings", "on", ">strings-secret", "~str*", "+@all"},
+		{"SETUSER", "blind", "on", ">blind-secret", "~*", "+@all", "-keys"},
+	} {
+		replies, err := c.Pipeline(client.Command{Name: "ACL", Args: rules})
+		attest.Ok(t, err)
+		attest.Equal(t, replies[0], any("OK"))
+	}
+	_, body = fetchDashboard(t, node.AdminAddr, "strings", "strings-secret", "")
+	attest.Subsequence(t, body, row("str", "string", "hello"))
+	attest.False(t, strings.Contains(body, row("hash", "hash", "a: 1, b: 2")), attest.Sprint("dashboard shows a denied key"))
+	_, body = fetchDashboard(t, node.AdminAddr, "blind", "blind-secret", "")
+	attest.Subsequence(t, body, "NOPERM")
+	attest.False(t, strings.Contains(body, row("str", "string", "hello")), attest.Sprint("dashboard shows keys without KEYS permission"))
+}
+
+// fetchDashboard gets a page of the admin dashboard as the user, returning
+// the response's status and body.
+func fetchDashboard(t *testing.T, addr net.Addr, user, password, query string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr.String()+"/?"+query, nil)
+	attest.Ok(t, err)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	res, err := http.DefaultClient.Do(req)
+	attest.Ok(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	attest.Ok(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestQuotas(t *testing.T) {
+	clients := servertest.NewCluster(t, 4, /* num clients */
+		servertest.WithQuotas(
+			server.Quota{Prefix: "tenant:", MaxKeys: 3},
+			server.Quota{Prefix: "blob:", MaxBytes: 10},
+		),
+	)
+	c, other := clients[0], clients[1] // on different nodes
+
+	// Writes within a quota succeed, and writes that would exceed it are
+	// refused.
+	for i := range 3 {
+		attest.Ok(t, c.Set(fmt.Sprintf("tenant:%d", i), "v"))
+	}
+	attest.ErrorIs(t, c.Set("tenant:3", "v"), client.ErrCapacity)
+	attest.Ok(t, c.Set("tenant:0", "overwritten"))
+	attest.Ok(t, c.Set("untracked", "v"))
+	attest.Ok(t, c.Set("blob:a", "12345"))
+	attest.ErrorIs(t, c.Set("blob:b", "123456"), client.ErrCapacity)
+	attest.Ok(t, c.Set("blob:b", "12345"))
+	_, err := c.Append("blob:a", "x")
+	attest.ErrorIs(t, err, client.ErrCapacity)
+
+	// Other nodes see the same usage.
+	attest.ErrorIs(t, other.Set("tenant:3", "v"), client.ErrCapacity)
+	attest.Ok(t, other.Del("tenant:0"))
+	attest.Ok(t, c.Set("tenant:3", "v"))
+	attest.ErrorIs(t, other.Set("tenant:4", "v"), client.ErrCapacity)
+
+	// In a transaction, a command that would exceed the quota fails on its
+	// own, and deletions earlier in the transaction make room.
+	res, err := c.Exec(
+		client.Command{Name: "SET", Args: []any{"tenant:4", "v"}},
+		client.Command{Name: "DEL", Args: []any{"tenant:1"}},
+		client.Command{Name: "SET", Args: []any{"tenant:5", "v"}},
+		client.Command{Name: "SET", Args: []any{"tenant:6", "v"}},
+	)
+	attest.Ok(t, err)
+	attest.Subsequence(t, fmt.Sprint(res[0]), "OOM")
+	attest.Equal(t, res[1:3], []any{int64(1), "OK"})
+	attest.Subsequence(t, fmt.Sprint(res[3]), "OOM")
+	keys, err := c.Keys("tenant:*")
+	attest.Ok(t, err)
+	slices.Sort(keys)
+	attest.Equal(t, keys, []string{"tenant:2", "tenant:3", "tenant:5"})
+
+	// Expired keys don't count.
+	attest.Ok(t, c.Del("tenant:5"))
+	replies, err := c.Pipeline(client.Command{Name: "SET", Args: []any{"tenant:5", "v", "PX", 1}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies[0], any("OK"))
+	time.Sleep(10 * time.Millisecond)
+	attest.Ok(t, c.Set("tenant:6", "v"))
+	attest.ErrorIs(t, c.Set("tenant:7", "v"), client.ErrCapacity)
+
+	// Concurrent writes, which may be batched together, can't overshoot.
+	attest.Ok(t, c.FlushAll())
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	for i, c := range clients {
+		wg.Go(func() { errs[i] = c.Set(fmt.Sprintf("tenant:%d", i), "v") })
+	}
+	wg.Wait()
+	var stored int
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		} else {
+			attest.ErrorIs(t, err, client.ErrCapacity)
+		}
+	}
+	attest.Equal(t, stored, 3)
+	keys, err = c.Keys("tenant:*")
+	attest.Ok(t, err)
+	attest.Equal(t, len(keys), 3)
+}
+
+func TestNamespaceCapacity(t *testing.T) {
+	// MaxItems limits the whole database, not each namespace.
+	store := simstore.New(simstore.Options{})
+	addr := servertest.NewServers(t, 1 /* num servers */, servertest.WithSimulatedStorage(store))[0]
+	dial := func(opts ...client.Option) *client.Client {
+		c, err := client.New(addr, opts...)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	admin := dial()
+	for _, app := range []string{"app1", "app2"} {
+		replies, err := admin.Pipeline(client.Command{
+			Name: "ACL",
+			Args: []any{"SETUSER", app, "on", ">" + app + "-secret", "~*", "+@all", "namespace:" + app},
+		})
+		attest.Ok(t, err)
+		attest.Equal(t, replies[0], any("OK"))
+	}
+	app1 := dial(client.WithUser("app1", "app1-secret"))
+	app2 := dial(client.WithUser("app2", "app2-secret"))
+
+	items := make(map[string]string, 600)
+	for i := range 600 {
+		items[fmt.Sprintf("k%d", i)] = "v"
+	}
+	attest.Ok(t, app1.MSet(items))
+	attest.ErrorIs(t, app2.MSet(items), client.ErrCapacity)
+	attest.Ok(t, app2.MSet(map[string]string{"a": "1", "b": "2"}))
+	n, err := admin.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 602)
+
+	// Single-key writes count the other namespaces' keys too.
+	for i := range 1024 - 602 {
+		attest.Ok(t, app2.Set(fmt.Sprintf("k%d", i), "v"))
+	}
+	attest.ErrorIs(t, app2.Set("full", "v"), client.ErrCapacity)
+	_, err = app1.HSet("full", map[string]string{"field": "v"})
+	attest.ErrorIs(t, err, client.ErrCapacity)
+	n, err = admin.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 1024)
+}
+
+func TestBulkSet(t *testing.T) {
+	addr := servertest.NewServers(t, 1 /* num servers */)[0]
+	c, err := client.New(addr)
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	items := make(map[string]string)
+	for i := range 250 {
+		items[fmt.Sprintf("key-%03d", i)] = fmt.Sprint(i)
+	}
+	var progress []int
+	err = c.BulkSet(
+		items,
+		client.WithBatchSize(10),
+		client.WithWindow(4),
+		client.WithProgress(func(done, total int) {
+			attest.Equal(t, total, len(items))
+			progress = append(progress, done)
+		}),
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, progress, []int{40, 80, 120, 160, 200, 240, 250})
+	n, err := c.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, len(items))
+
+	// Keys in the reserved prefix fail their batch, and only their batch.
+	err = c.BulkSet(map[string]string{
+		"a":                "1",
+		"b":                "2",
+		"valthree:nope":    "3",
+		"valthree:nope-ii": "4",
+	}, client.WithBatchSize(2))
+	var berr *client.BulkError
+	attest.True(t, errors.As(err, &berr))
+	attest.Equal(t, len(berr.Failed), 2)
+	attest.NotZero(t, berr.Failed["valthree:nope"])
+	val, err := c.Get("b")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "2")
+}
+
+func TestReplica(t *testing.T) {
+	// The replica refreshes its copy of the database once, at startup, so
+	// that stale reads are predictably stale.
+	addrs := servertest.NewServers(t, 2 /* num servers */, servertest.WithReplicas(time.Hour, 1))
+	dial := func(addr net.Addr, opts ...client.Option) *client.Client {
+		c, err := client.New(addr, opts...)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	primary := dial(addrs[0])
+	replica := dial(addrs[1])
+	stale := dial(addrs[1], client.WithStaleReads())
+	for {
+		info, err := replica.Info("replication")
+		attest.Ok(t, err)
+		attest.Equal(t, info["role"], "slave")
+		attest.Equal(t, info["replica_credentials"], "shared")
+		if info["replica_copy_age_ms"] != "-1" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	attest.Ok(t, primary.Set("k", "v"))
+	// Replicas refuse writes, including in transactions.
+	attest.ErrorIs(t, replica.Set("k", "other"), client.ErrReadOnly)
+	attest.ErrorIs(t, stale.Del("k"), client.ErrReadOnly)
+	_, err := replica.Exec(client.Command{Name: "SET", Args: []any{"k", "other"}})
+	attest.ErrorIs(t, err, client.ErrReadOnly)
+	// So are commands that write object storage directly, or change what the
+	// node's clients can run.
+	for _, cmd := range []client.Command{
+		{Name: "ACL", Args: []any{"SETUSER", "alice", "on"}},
+		{Name: "ACL", Args: []any{"DELUSER", "alice"}},
+		{Name: "BGSAVE"},
+		{Name: "INVALIDATE"},
+		{Name: "SCRIPT", Args: []any{"FLUSH"}},
+		{Name: "FUNCTION", Args: []any{"LOAD", "#!lua name=other\nredis.register_function('f', function() end)"}},
+		{Name: "FUNCTION", Args: []any{"DELETE", "lib"}},
+		{Name: "FUNCTION", Args: []any{"FLUSH"}},
+		{Name: "FUNCTION", Args: []any{"RESTORE", "payload"}},
+	} {
+		replies, err := replica.Pipeline(cmd)
+		attest.Ok(t, err)
+		attest.Subsequence(t, fmt.Sprint(replies[0]), "READONLY", attest.Sprintf("%s %v", cmd.Name, cmd.Args))
+	}
+	// Functions that may write can't run either.
+	_, err = primary.FunctionLoad(`#!lua name=lib
+		redis.register_function("bump", function(keys) return redis.call("INCR", keys[1]) end)`, false /* replace */)
+	attest.Ok(t, err)
+	_, err = replica.FCall("bump", []string{"n"})
+	attest.ErrorIs(t, err, client.ErrReadOnly)
+
+	// Reads are fresh unless the connection accepts stale reads.
+	val, err := replica.Get("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	_, err = stale.Get("k")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	replies, err := stale.Pipeline(client.Command{Name: "READWRITE"}, client.Command{Name: "GET", Args: []any{"k"}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies, []any{"OK", []byte("v")})
+
+	// A single read can accept stale data with a hint, which other nodes
+	// ignore.
+	hinted := client.Command{Name: "GET", Args: []any{"k", "!stale-ok"}}
+	replies, err = replica.Pipeline(hinted, client.Command{Name: "GET", Args: []any{"k"}})
+	attest.Ok(t, err)
+	attest.Equal(t, replies, []any{nil, []byte("v")})
+	replies, err = primary.Pipeline(hinted)
+	attest.Ok(t, err)
+	attest.Equal(t, replies, []any{[]byte("v")})
+}
+
+func TestReadYourWrites(t *testing.T) {
+	// Connections always read their own writes, even when they accept stale
+	// reads and other nodes write in between, since only replicas serve
+	// stale reads.
+	addrs := servertest.NewServers(t, 2 /* num servers */)
+	c, err := client.New(addrs[0], client.WithStaleReads())
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	other, err := client.New(addrs[1])
+	attest.Ok(t, err)
+	t.Cleanup(func() { other.Close() })
+
+	for i := range 10 {
+		attest.Ok(t, other.Set("key", "other"))
+		want := strconv.Itoa(i + 1)
+		attest.Ok(t, c.Set("key", want))
+		val, err := c.Get("key")
+		attest.Ok(t, err)
+		attest.Equal(t, val, want)
+	}
+}
+
+func TestReplicaCredentials(t *testing.T) {
+	// Replicas can have their own credentials for object storage, which
+	// they check can't write.
+	store := simstore.New(simstore.Options{ReadOnlyUsers: []string{"reader"}})
+	start := func(user string) (primary, replica *client.Client) {
+		addrs := servertest.NewServers(
+			t,
+			2, /* num servers */
+			servertest.WithSimulatedStorage(store),
+			servertest.WithReplicas(0 /* refresh */, 1),
+			servertest.WithReplicaCredentials(user, "password"),
+		)
+		clients := make([]*client.Client, len(addrs))
+		for i, addr := range addrs {
+			c, err := client.New(addr)
+			attest.Ok(t, err)
+			t.Cleanup(func() { c.Close() })
+			clients[i] = c
+		}
+		return clients[0], clients[1]
+	}
+
+	// A replica that can only read starts up, since it doesn't create the
+	// bucket or probe conditional writes, and serves reads.
+	primary, replica := start("reader")
+	info, err := replica.Info("replication")
+	attest.Ok(t, err)
+	attest.Equal(t, info["replica_credentials"], "read-only")
+	attest.Ok(t, primary.Set("k", "v"))
+	val, err := replica.Get("k")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v")
+	attest.ErrorIs(t, replica.Set("k", "other"), client.ErrReadOnly)
+
+	_, replica = start("writer")
+	info, err = replica.Info("replication")
+	attest.Ok(t, err)
+	attest.Equal(t, info["replica_credentials"], "writable")
+}
+
+func TestConditionalRequestConflicts(t *testing.T) {
+	// S3 fails conditional PUTs that overlap another PUT of the same object
+	// with 409 Conflict. Those writes didn't apply, so they're retried like
+	// writes that lost a race, both to shards and to write-ahead logs.
+	for _, wal := range []bool{false, true} {
+		store := simstore.New(simstore.Options{
+			ConflictRate: 0.5,
+			Faulty:       servertest.DatabaseObject,
+		})
+		opts := []servertest.Option{servertest.WithSimulatedStorage(store)}
+		if wal {
+			opts = append(opts, servertest.WithWriteAheadLog())
+		}
+		c := servertest.NewCluster(t, 1 /* num clients */, opts...)[0]
+		for range 20 {
+			_, err := c.IncrBy("counter", 1)
+			attest.Ok(t, err)
+		}
+		val, err := c.Get("counter")
+		attest.Ok(t, err)
+		attest.Equal(t, val, "20")
+		attest.True(t, store.Stats().Conflicts > 0, attest.Sprintf("no conflicts injected"))
+	}
+}
+
+func TestSimulatedStorage(t *testing.T) {
+	// With simulated storage, a single client's workload sees the same
+	// faults every time it runs with the same seed, so its outcomes are
+	// repeatable.
+	const seed = 42
+	run := func() ([]string, simstore.Stats) {
+		store := simstore.New(simstore.Options{
+			Seed:       seed,
+			MaxLatency: 2 * time.Millisecond,
+			ErrorRate:  0.02,
+			RaceRate:   0.4,
+			Faulty:     servertest.DatabaseObject,
+		})
+		addr := servertest.NewServers(
+			t,
+			1, /* num servers */
+			servertest.WithSimulatedStorage(store),
+			servertest.WithWriteAttempts(2),
+		)[0]
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		defer c.Close()
+
+		var outcomes []string
+		var applied int64
+		for range 100 {
+			_, err := c.IncrBy("counter", 1)
+			switch {
+			case err == nil:
+				applied++
+				outcomes = append(outcomes, "ok")
+			case errors.Is(err, client.ErrContention):
+				outcomes = append(outcomes, "contention")
+			case errors.Is(err, client.ErrStorageUnavailable):
+				outcomes = append(outcomes, "unavailable")
+			default:
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		// Simulated races are rewrites of the same data, so every applied
+		// increment counts exactly once.
+		for {
+			val, err := c.Get("counter")
+			if errors.Is(err, client.ErrStorageUnavailable) {
+				continue
+			}
+			attest.Ok(t, err)
+			attest.Equal(t, val, fmt.Sprint(applied))
+			break
+		}
+		return outcomes, store.Stats()
+	}
+
+	outcomes, stats := run()
+	attest.True(t, stats.Races > 0, attest.Sprintf("no races injected"))
+	attest.True(t, stats.Errors > 0, attest.Sprintf("no errors injected"))
+	attest.Contains(t, outcomes, "contention")
+	again, againStats := run()
+	attest.Equal(t, again, outcomes)
+	attest.Equal(t, againStats.Races, stats.Races)
+	attest.Equal(t, againStats.Errors, stats.Errors)
+}
+
+func TestLogCompactionRace(t *testing.T) {
+	// A server that read a shard's log just before another server compacted
+	// it may create an entry whose sequence number the compaction freed. No
+	// reader would ever replay that entry, so the server has to notice and
+	// write it again.
+	const last = servertest.CompactMaxEntries // the entry that's compacted
+	var (
+		puts    atomic.Int32
+		paused  = make(chan struct{})
+		resume  = make(chan struct{})
+		deleted = make(chan struct{})
+	)
+	store := simstore.New(simstore.Options{
+		Before: func(method, key string) {
+			// Pause the first attempt to create the last entry.
+			seq, ok := servertest.LogEntry(key)
+			if ok && seq == last && method == http.MethodPut && puts.Add(1) == 1 {
+				close(paused)
+				<-resume
+			}
+		},
+		After: func(method, key string) {
+			seq, ok := servertest.LogEntry(key)
+			if ok && seq == last && method == http.MethodDelete {
+				close(deleted)
+			}
+		},
+	})
+	addrs := servertest.NewServers(
+		t,
+		3, /* num servers */
+		servertest.WithSimulatedStorage(store),
+		servertest.WithWriteAheadLog(),
+	)
+	clients := make([]*client.Client, len(addrs))
+	for i, addr := range addrs {
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+	a, b, fresh := clients[0], clients[1], clients[2]
+
+	// The first write starts the log, and the rest fill it up to just before
+	// the last entry.
+	for i := range last {
+		attest.Ok(t, a.Set(fmt.Sprintf("k%d", i), "a"))
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- b.Set("z", "b") }()
+	<-paused
+	// This write creates the last entry, compacts the log, and deletes the
+	// entries, so b's entry is created in an empty slot.
+	attest.Ok(t, a.Set("y", "a"))
+	<-deleted
+	close(resume)
+	attest.Ok(t, <-errs)
+
+	for key, want := range map[string]string{"y": "a", "z": "b"} {
+		val, err := fresh.Get(key)
+		attest.Ok(t, err)
+		attest.Equal(t, val, want)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	var puts, deletes atomic.Int32
+	store := simstore.New(simstore.Options{
+		After: func(method, key string) {
+			if _, ok := servertest.LogEntry(key); !ok {
+				return
+			}
+			switch method {
+			case http.MethodPut:
+				puts.Add(1)
+			case http.MethodDelete:
+				deletes.Add(1)
+			}
+		},
+	})
+	addrs := servertest.NewServers(
+		t,
+		3, /* num servers */
+		servertest.WithSimulatedStorage(store),
+		servertest.WithWriteAheadLog(),
+	)
+	clients := make([]*client.Client, len(addrs))
+	for i, addr := range addrs {
+		c, err := client.New(addr)
+		attest.Ok(t, err)
+		t.Cleanup(func() { c.Close() })
+		clients[i] = c
+	}
+	writer := clients[0]
+
+	// Write enough, and in enough ways, that the log is compacted more than
+	// once, with writes of every type on both sides of each compaction.
+	const n = 3 * servertest.CompactMaxEntries
+	for i := range n {
+		key := fmt.Sprintf("k%d", i)
+		switch i % 6 {
+		case 0, 1:
+			attest.Ok(t, writer.Set(key, fmt.Sprintf("v%d", i)))
+		case 2:
+			_, err := writer.HSet(key, map[string]string{"f": key})
+			attest.Ok(t, err)
+		case 3:
+			_, err := writer.RPush(key, key, "tail")
+			attest.Ok(t, err)
+		case 4:
+			_, err := writer.SAdd(key, key, "other")
+			attest.Ok(t, err)
+		case 5:
+			_, err := writer.ZAdd(key, client.ZMember{Member: key, Score: float64(i)})
+			attest.Ok(t, err)
+		}
+		if i%12 == 1 {
+			attest.Ok(t, writer.Del(fmt.Sprintf("k%d", i-1)))
+		}
+	}
+	info, err := writer.Info("compaction")
+	attest.Ok(t, err)
+	attest.NotEqual(t, info["compactions"], "0")
+	attest.Equal(t, info["compaction_errors"], "0")
+	attest.True(t, deletes.Load() > 0)
+	attest.True(t, puts.Load()-deletes.Load() < servertest.CompactMaxEntries)
+
+	// A node with a cold cache reads the compacted snapshot and the rest of
+	// the log, and sees exactly what was written.
+	check := func(c *client.Client) {
+		t.Helper()
+		size, err := c.DBSize()
+		attest.Ok(t, err)
+		attest.Equal(t, size, n-n/12)
+		for i := range n {
+			key := fmt.Sprintf("k%d", i)
+			switch i % 6 {
+			case 0:
+				if i%12 == 0 {
+					_, err := c.Get(key)
+					attest.ErrorIs(t, err, client.ErrNotFound, attest.Sprintf("key %s", key))
+					continue
+				}
+				fallthrough
+			case 1:
+				val, err := c.Get(key)
+				attest.Ok(t, err)
+				attest.Equal(t, val, fmt.Sprintf("v%d", i))
+			case 2:
+				hash, err := c.HGetAll(key)
+				attest.Ok(t, err)
+				attest.Equal(t, hash, map[string]string{"f": key})
+			case 3:
+				list, err := c.LRange(key, 0, -1)
+				attest.Ok(t, err)
+				attest.Equal(t, list, []string{key, "tail"})
+			case 4:
+				members, err := c.SMembers(key)
+				attest.Ok(t, err)
+				slices.Sort(members)
+				attest.Equal(t, members, []string{key, "other"})
+			case 5:
+				members, err := c.ZRangeByScore(key, math.Inf(-1), math.Inf(1))
+				attest.Ok(t, err)
+				attest.Equal(t, members, []client.ZMember{{Member: key, Score: float64(i)}})
+			}
+		}
+	}
+	check(clients[1])
+
+	// Writes after a compaction build on its snapshot.
+	attest.Ok(t, writer.Set("k0", "v0"))
+	attest.Ok(t, writer.Del("k1"))
+	val, err := clients[2].Get("k0")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "v0")
+	_, err = clients[2].Get("k1")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestLogCheck(t *testing.T) {
+	// Servers check each shard's log against its snapshot as they start, so
+	// a lost entry is reported even if nothing reads the keys it wrote.
+	var lost atomic.Value // the second entry's object key
+	store := simstore.New(simstore.Options{
+		After: func(method, key string) {
+			if seq, ok := servertest.LogEntry(key); ok && seq == 2 && method == http.MethodPut {
+				lost.Store(key)
+			}
+		},
+	})
+	opts := []servertest.Option{
+		servertest.WithSimulatedStorage(store),
+		servertest.WithWriteAheadLog(),
+	}
+	writer, err := client.New(servertest.NewServers(t, 1 /* num servers */, opts...)[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { writer.Close() })
+	// The first write starts the log, and the rest create entries.
+	for i := range 4 {
+		attest.Ok(t, writer.Set(fmt.Sprintf("k%d", i), "v"))
+	}
+	divergences := func() string {
+		t.Helper()
+		c, err := client.New(servertest.NewServers(t, 1 /* num servers */, opts...)[0])
+		attest.Ok(t, err)
+		defer c.Close()
+		info, err := c.Info("compaction")
+		attest.Ok(t, err)
+		return info["log_divergences"]
+	}
+	attest.Equal(t, divergences(), "0")
+
+	req, err := http.NewRequest(http.MethodDelete, "http://simstore/valthree/"+lost.Load().(string), nil)
+	attest.Ok(t, err)
+	res, err := store.RoundTrip(req)
+	attest.Ok(t, err)
+	attest.Equal(t, res.StatusCode, http.StatusNoContent)
+	attest.Equal(t, divergences(), "1")
+}
+
+func TestReadCache(t *testing.T) {
+	addrs := servertest.NewServers(t, 2 /* num servers */)
+	writer, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { writer.Close() })
+	reader, err := client.New(addrs[1])
+	attest.Ok(t, err)
+	t.Cleanup(func() { reader.Close() })
+	stats := func() (reads, hits int) {
+		t.Helper()
+		info, err := reader.Info("storage")
+		attest.Ok(t, err)
+		reads, err = strconv.Atoi(info["storage_reads"])
+		attest.Ok(t, err)
+		hits, err = strconv.Atoi(info["storage_cache_hits"])
+		attest.Ok(t, err)
+		return reads, hits
+	}
+	get := func(want string) {
+		t.Helper()
+		val, err := reader.Get("key")
+		attest.Ok(t, err)
+		attest.Equal(t, val, want)
+	}
+
+	attest.Ok(t, writer.Set("key", "v1"))
+	get("v1")
+
+	// While the database is unchanged, reads revalidate the cached copy
+	// rather than downloading it again.
+	reads, hits := stats()
+	get("v1")
+	get("v1")
+	attest.Equal(t, fmt.Sprint(stats()), fmt.Sprint(reads+2, hits+2))
+
+	// Once another node writes, the next read downloads the new version, so
+	// the cache is never stale.
+	attest.Ok(t, writer.Set("key", "v2"))
+	get("v2")
+	attest.Equal(t, fmt.Sprint(stats()), fmt.Sprint(reads+3, hits+2))
+	get("v2")
+	attest.Equal(t, fmt.Sprint(stats()), fmt.Sprint(reads+4, hits+3))
+	attest.Ok(t, writer.Del("key"))
+	_, err = reader.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	attest.Equal(t, fmt.Sprint(stats()), fmt.Sprint(reads+5, hits+3))
+}
+
+func TestHotKeys(t *testing.T) {
+	// Pause the first write to the database after startup, so another node
+	// can write in the meantime and the paused write conflicts.
+	var (
+		armed  atomic.Bool
+		puts   atomic.Int32
+		paused = make(chan struct{})
+		resume = make(chan struct{})
+	)
+	store := simstore.New(simstore.Options{
+		Before: func(method, key string) {
+			if armed.Load() && method == http.MethodPut && servertest.DatabaseObject(key) && puts.Add(1) == 1 {
+				close(paused)
+				<-resume
+			}
+		},
+	})
+	addrs := servertest.NewServers(t, 2 /* num servers */, servertest.WithSimulatedStorage(store))
+	slow := dialRESP(t, addrs[0])
+	fast := dialRESP(t, addrs[1])
+	attest.Equal(t, slow("HOTKEYS"), "*0\r\n")
+
+	armed.Store(true)
+	conflicted := make(chan string, 1)
+	go func() {
+		c, err := client.New(addrs[0])
+		if err != nil {
+			conflicted <- err.Error()
+			return
+		}
+		defer c.Close()
+		_, err = c.Exec(
+			client.Command{Name: "SET", Args: []any{"hot", "slow"}},
+			client.Command{Name: "SET", Args: []any{"warm", "slow"}},
+		)
+		conflicted <- fmt.Sprint(err)
+	}()
+	<-paused
+	attest.Equal(t, fast("SET hot fast"), "+OK\r\n")
+	close(resume)
+	attest.Equal(t, <-conflicted, "<nil>")
+
+	// Only the node whose write conflicted reports the keys it wrote.
+	attest.Equal(t, slow("GET hot"), "$4\r\nslow\r\n")
+	hot := "*2\r\n$3\r\nhot\r\n$4\r\n1.00\r\n"
+	warm := "*2\r\n$4\r\nwarm\r\n$4\r\n1.00\r\n"
+	attest.Equal(t, slow("HOTKEYS"), "*2\r\n"+hot+warm)
+	attest.Equal(t, slow("HOTKEYS COUNT 1"), "*1\r\n"+hot)
+	attest.Equal(t, slow("HOTKEYS count 0"), "*0\r\n")
+	attest.Equal(t, fast("HOTKEYS"), "*0\r\n")
+
+	attest.Subsequence(t, slow("HOTKEYS COUNT -1"), "-ERR syntax error")
+	attest.Subsequence(t, slow("HOTKEYS LIMIT 1"), "-ERR syntax error")
+	attest.Subsequence(t, slow("HOTKEYS COUNT"), "-ERR wrong number of arguments")
+}
+
+func TestWait(t *testing.T) {
+	addrs := servertest.NewServers(t, 2 /* num servers */)
+	writer, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { writer.Close() })
+	reader, err := client.New(addrs[1])
+	attest.Ok(t, err)
+	t.Cleanup(func() { reader.Close() })
+
+	// Acknowledged writes are already durable, so other nodes see the write,
+	// but primaries don't know which replicas have, so WAIT reports none at
+	// once, even with no timeout.
+	attest.Ok(t, writer.Set("key", "value"))
+	n, err := writer.Wait(2, 0)
+	attest.Ok(t, err)
+	attest.Equal(t, n, 0)
+	val, err := reader.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "value")
+
+	replies, err := writer.Exec(
+		client.Command{Name: "SET", Args: []any{"key", "other"}},
+		client.Command{Name: "WAIT", Args: []any{1, 100}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, replies[1], any(int64(0)))
+
+	_, err = writer.Wait(1, -time.Second)
+	attest.Error(t, err)
+	attest.Subsequence(t, err.Error(), "timeout is negative")
+}
+
+func TestSelect(t *testing.T) {
+	addrs := servertest.NewServers(t, 2 /* num servers */, servertest.WithDatabases(4))
+	zero, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { zero.Close() })
+	one, err := client.New(addrs[1], client.WithDatabase(1))
+	attest.Ok(t, err)
+	t.Cleanup(func() { one.Close() })
+
+	// Each database has its own keys, whichever node they're written on.
+	attest.Ok(t, zero.Set("key", "zero"))
+	attest.Ok(t, one.Set("key", "one"))
+	attest.Ok(t, one.Set("other", "one"))
+	val, err := zero.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "zero")
+	n, err := one.DBSize()
+	attest.Ok(t, err)
+	attest.Equal(t, n, 2)
+	info, err := zero.Info("keyspace")
+	attest.Ok(t, err)
+	attest.Subsequence(t, info["db0"], "keys=1,")
+	attest.Subsequence(t, info["db1"], "keys=2,")
+	list, err := one.ClientList()
+	attest.Ok(t, err)
+	attest.Subsequence(t, list, " db=1 ")
+
+	attest.Ok(t, zero.Select(1))
+	val, err = zero.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "one")
+	attest.Error(t, zero.Select(4))
+	attest.Error(t, zero.Select(-1))
+	attest.Ok(t, zero.Select(0))
+
+	// FLUSHDB empties only the connection's database, and FLUSHALL empties
+	// them all.
+	attest.Ok(t, one.FlushDB())
+	_, err = one.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err = zero.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "zero")
+	attest.Ok(t, one.Set("key", "one"))
+	attest.Ok(t, zero.FlushAll())
+	_, err = zero.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	_, err = one.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestSelectInMulti(t *testing.T) {
+	addrs := servertest.NewServers(t, 1 /* num servers */, servertest.WithDatabases(3))
+	c, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	one, err := client.New(addrs[0], client.WithDatabase(1))
+	attest.Ok(t, err)
+	t.Cleanup(func() { one.Close() })
+
+	// SELECT applies to the commands after it, and to the connection once
+	// the transaction is written.
+	res, err := c.Exec(
+		client.Command{Name: "SELECT", Args: []any{1}},
+		client.Command{Name: "SET", Args: []any{"key", "one"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, res, []any{"OK", "OK"})
+	val, err := one.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "one")
+	val, err = c.Get("key")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "one")
+	attest.Ok(t, c.Select(0))
+	_, err = c.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	// A transaction is written to a single database.
+	_, err = c.Exec(
+		client.Command{Name: "SET", Args: []any{"key", "zero"}},
+		client.Command{Name: "SELECT", Args: []any{1}},
+		client.Command{Name: "SET", Args: []any{"key", "one"}},
+	)
+	attest.Error(t, err)
+	_, err = c.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+
+	// FLUSHALL empties every database, not just the transaction's, but the
+	// commands after it still apply.
+	attest.Ok(t, c.Set("key", "zero"))
+	res, err = c.Exec(
+		client.Command{Name: "FLUSHALL"},
+		client.Command{Name: "SET", Args: []any{"after", "flush"}},
+	)
+	attest.Ok(t, err)
+	attest.Equal(t, res, []any{"OK", "OK"})
+	_, err = c.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	_, err = one.Get("key")
+	attest.ErrorIs(t, err, client.ErrNotFound)
+	val, err = c.Get("after")
+	attest.Ok(t, err)
+	attest.Equal(t, val, "flush")
+}
+
+func TestBackupDatabases(t *testing.T) {
+	addrs := servertest.NewServers(t, 1 /* num servers */, servertest.WithDatabases(2))
+	c, err := client.New(addrs[0])
+	attest.Ok(t, err)
+	t.Cleanup(func() { c.Close() })
+	one, err := client.New(addrs[0], client.WithDatabase(1))
+	attest.Ok(t, err)
+	t.Cleanup(func() { one.Close() })
+
+	// Snapshots include every logical database.
+	attest.Ok(t, c.Set("key", "zero"))
+	attest.Ok(t, one.Set("key", "one"))
+	attest.Ok(t, c.BgSave())
+	var ids []string
+	for deadline := time.Now().Add(5 * time.Second); len(ids) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		ids, err = c.Snapshots()
+		attest.Ok(t, err)
+	}
+	attest.Equal(t, len(ids), 1)
+	attest.Ok(t, one.Set("key", "new"))
+
+	val, err := one.GetAt("key", ids[0])
+	attest.Ok(t, err)
+	attest.Equal(t, val, "one")
+	val, err = c.GetAt("key", ids[0])
+	attest.Ok(t, err)
+	attest.Equal(t, val, "zero")
+}
+
+func TestFlushAsync(t *testing.T) {
+	for name, opts := range map[string][]servertest.Option{
+		"object": nil,
+		"log":    {servertest.WithWriteAheadLog()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts = append(opts, servertest.WithDatabases(2))
+			addrs := servertest.NewServers(t, 2 /* num servers */, opts...)
+			c1, err := client.New(addrs[0])
+			attest.Ok(t, err)
+			t.Cleanup(func() { c1.Close() })
+			c2, err := client.New(addrs[1])
+			attest.Ok(t, err)
+			t.Cleanup(func() { c2.Close() })
+
+			// Flushing a database that was never written works too.
+			attest.Ok(t, c1.FlushDBAsync())
+
+			attest.Ok(t, c1.Set("a", "1"))
+			attest.Ok(t, c1.Set("b", "2"))
+			attest.Ok(t, c1.Watch("a"))
+			attest.Ok(t, c2.FlushDBAsync())
+			_, err = c1.Exec(client.Command{Name: "SET", Args: []any{"a", "3"}})
+			attest.ErrorIs(t, err, client.ErrAborted)
+			_, err = c1.Get("a")
+			attest.ErrorIs(t, err, client.ErrNotFound)
+			n, err := c2.DBSize()
+			attest.Ok(t, err)
+			attest.Equal(t, n, 0)
+
+			// Writes after the flush build on it.
+			attest.Ok(t, c1.Set("a", "4"))
+			val, err := c2.Get("a")
+			attest.Ok(t, err)
+			attest.Equal(t, val, "4")
+
+			attest.Ok(t, c2.Select(1))
+			attest.Ok(t, c2.Set("c", "5"))
+			attest.Ok(t, c1.FlushAllAsync())
+			_, err = c2.Get("c")
+			attest.ErrorIs(t, err, client.ErrNotFound)
+			_, err = c1.Get("a")
+			attest.ErrorIs(t, err, client.ErrNotFound)
+			attest.Ok(t, c1.Set("a", "6"))
+			_, err = c2.Get("a")
+			attest.ErrorIs(t, err, client.ErrNotFound)
+			attest.Ok(t, c2.Select(0))
+			val, err = c2.Get("a")
+			attest.Ok(t, err)
+			attest.Equal(t, val, "6")
+		})
+	}
 }
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"math/rand/v2"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/antithesishq/antithesis-sdk-go/assert"
+	"github.com/anishathalye/porcupine"
 	"github.com/antithesishq/antithesis-sdk-go/lifecycle"
 	"github.com/antithesishq/valthree/internal/client"
+	"github.com/antithesishq/valthree/internal/property"
 	"github.com/antithesishq/valthree/internal/proptest"
 	"github.com/spf13/cobra"
 )
@@ -27,6 +32,11 @@ func init() {
 	workloadCmd.Flags().StringSlice("addrs", []string{":6379"}, "Valthree cluster address(es)")
 	workloadCmd.Flags().Duration("check-timeout", time.Hour, "model checking timeout")
 	workloadCmd.Flags().String("artifacts", ".", "directory for storing debugging artifacts")
+	workloadCmd.Flags().String("artifact-prefix", "consistency-failure", "filename prefix for debugging artifacts")
+	workloadCmd.Flags().Int("max-artifacts", 100, "maximum number of debugging artifacts to keep, deleting the oldest first (0 for unlimited)")
+	workloadCmd.Flags().String("summary", "workload-summary.jsonl", "file in the artifacts directory to which each iteration appends a JSON summary of its results (empty to disable)")
+	workloadCmd.Flags().Bool("trace", false, "when consistency is violated, also save a compressed trace of every command")
+	workloadCmd.Flags().StringArray("database", nil, "comma-separated address(es) of servers for an additional database, checked independently (repeatable)")
 }
 
 var workloadCmd = &cobra.Command{
@@ -39,30 +49,45 @@ var workloadCmd = &cobra.Command{
 		logger := orFatal(newLogger(cmd.Flags()))
 		clusterAddrs := orFatal(cmd.Flags().GetStringSlice("addrs"))
 		checkTimeout := orFatal(cmd.Flags().GetDuration("check-timeout"))
-		artifactDir := orFatal(cmd.Flags().GetString("artifacts"))
+		artifacts := artifactConfig{
+			dir:     orFatal(cmd.Flags().GetString("artifacts")),
+			prefix:  orFatal(cmd.Flags().GetString("artifact-prefix")),
+			max:     orFatal(cmd.Flags().GetInt("max-artifacts")),
+			trace:   orFatal(cmd.Flags().GetBool("trace")),
+			summary: orFatal(cmd.Flags().GetString("summary")),
+		}
+		// Each database is served by its own group of servers. Running
+		// workloads against several databases at once verifies that they're
+		// isolated from each other.
+		databases := [][]string{clusterAddrs}
+		for _, db := range orFatal(cmd.Flags().GetStringArray("database")) {
+			databases = append(databases, strings.Split(db, ","))
+		}
 
 		// Before injecting faults, the Antithesis platform lets us verify that our
 		// system is up and running. We'll check the cluster by waiting for each
 		// server to respond to a PING.
-		addrs := make([]net.Addr, len(clusterAddrs))
-		for i, serverAddr := range clusterAddrs {
-			logger := logger.With("server_addr", serverAddr)
-			addr, err := net.ResolveTCPAddr("tcp", serverAddr)
-			if err != nil {
-				logger.Error("server addr misconfigured", "err", err)
-				os.Exit(1)
-			}
-			logger.Debug("resolved server addr")
+		clusters := make([][]net.Addr, len(databases))
+		for i, serverAddrs := range databases {
+			for _, serverAddr := range serverAddrs {
+				logger := logger.With("server_addr", serverAddr)
+				addr, err := net.ResolveTCPAddr("tcp", serverAddr)
+				if err != nil {
+					logger.Error("server addr misconfigured", "err", err)
+					os.Exit(1)
+				}
+				logger.Debug("resolved server addr")
 
-			pinger := dial(logger, addr) // blocks until cluster is ready
-			logger.Debug("pinged server")
-			pinger.CloseAndLog(logger)
-			addrs[i] = addr
+				pinger := dial(logger, addr) // blocks until cluster is ready
+				logger.Debug("pinged server")
+				pinger.CloseAndLog(logger)
+				clusters[i] = append(clusters[i], addr)
+			}
 		}
 		// The cluster is up! Using the Antithesis SDK, we tell the platform that
 		// we're ready for fault injection.
-		logger.Info("setup complete", "cluster_addrs", addrs)
-		lifecycle.SetupComplete(map[string]any{"cluster_addrs": addrs})
+		logger.Info("setup complete", "cluster_addrs", clusters)
+		lifecycle.SetupComplete(map[string]any{"cluster_addrs": clusters})
 
 		// Until the workload gets a signal to stop, exercise the cluster. Each
 		// iteration generates a random, concurrent workload, records the results,
@@ -75,7 +100,7 @@ var workloadCmd = &cobra.Command{
 			case <-sig:
 				os.Exit(0)
 			default:
-				exerciseAndVerify(iterations, logger, addrs, checkTimeout, artifactDir)
+				exerciseAndVerify(iterations, logger, clusters, checkTimeout, artifacts)
 				iterations++
 			}
 		}
@@ -85,101 +110,316 @@ var workloadCmd = &cobra.Command{
 func exerciseAndVerify(
 	iteration int,
 	logger *slog.Logger,
-	addrs []net.Addr,
+	clusters [][]net.Addr,
 	timeout time.Duration,
-	artifactDir string,
+	artifacts artifactConfig,
 ) {
-	seeds := []uint64{rand.Uint64(), rand.Uint64()}
-	logger = logger.With("pcg_seeds", seeds, "cluster_addrs", addrs)
+	dbs := make([]*dbWorkload, len(clusters))
+	for i, addrs := range clusters {
+		seeds := []uint64{rand.Uint64(), rand.Uint64()}
+		dbs[i] = &dbWorkload{
+			iteration: iteration,
+			addrs:     addrs,
+			seeds:     seeds,
+			logger:    logger.With("pcg_seeds", seeds, "cluster_addrs", addrs),
+		}
+		if len(clusters) > 1 {
+			dbs[i].logger = dbs[i].logger.With("database", i)
+			dbs[i].name = fmt.Sprintf("db%d", i)
+		}
+	}
 
-	// Before running this workload, return the cluster to a known state by
+	// Before running this workload, return each database to a known state by
 	// flushing it. This prevents an unclean shutdown from poisoning subsequent
 	// runs.
-	logger.Debug("flushing cluster")
-	client := dial(logger, addrs[0])
-	for {
-		if err := client.FlushAll(); err != nil {
-			logger.Debug("flush failed", "retry_after", time.Second, "err", err)
-			time.Sleep(time.Second)
-			continue
+	for _, db := range dbs {
+		db.logger.Debug("flushing cluster")
+		client := dial(db.logger, db.addrs[0])
+		for {
+			if err := client.FlushAll(); err != nil {
+				db.logger.Debug("flush failed", "retry_after", time.Second, "err", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			db.logger.Debug("flushed cluster")
+			break
 		}
-		logger.Debug("flushed cluster")
-		break
+		client.CloseAndLog(db.logger)
 	}
 
-	// Next, generate a concurrent, randomized workload. The workload is a set of
-	// instructions, telling each client to execute a series of GET, PUT, and DEL
-	// commands on a small set of keys.
-	logger.Debug("generating new workload")
-	r := rand.New(rand.NewPCG(seeds[0], seeds[1]))
-	workloads := proptest.GenWorkloads(r)
-	// In each test run, start without concurrency. This is purely for
-	// demonstration purposes - real workloads don't need this!
-	const serialIterations = 16
-	if iteration < serialIterations && len(workloads) > 1 {
-		workloads = workloads[:1]
-	}
-	if iteration == serialIterations {
-		logger.Info("allowing concurrent workloads")
+	// Next, generate a concurrent, randomized workload for each database. The
+	// workload is a set of instructions, telling each client to execute a
+	// series of GET, PUT, and DEL commands on a small set of keys. Every
+	// database uses the same keys, so any leakage between them shows up as a
+	// consistency violation. Some clients pipeline their commands or send
+	// them in MULTI/EXEC transactions instead of one at a time.
+	for _, db := range dbs {
+		db.logger.Debug("generating new workload")
+		db.workloads = proptest.GenWorkloads(rand.New(rand.NewPCG(db.seeds[0], db.seeds[1])))
+		// In each test run, start without concurrency. This is purely for
+		// demonstration purposes - real workloads don't need this!
+		const serialIterations = 16
+		if iteration < serialIterations && len(db.workloads) > 1 {
+			db.workloads = db.workloads[:1]
+		}
+		if iteration == serialIterations {
+			db.logger.Info("allowing concurrent workloads")
+		}
 	}
 
-	// Run the workload, recording the timing and result of each operation. To
+	// Run the workloads, recording the timing and result of each operation. To
 	// maximize concurrent work, we block each client until all the clients are
 	// ready to begin.
 	logger.Debug("running workload")
 	var wg sync.WaitGroup
 	start := make(chan struct{})
-	for i, workload := range workloads {
-		wg.Go(func() {
-			addr := addrs[i%len(addrs)]
-			logger := logger.With("client_id", i, "addr", addr)
-			client := dial(logger, addr)
-			defer client.CloseAndLog(logger)
-			<-start
-			proptest.RunWorkload(logger, client, workload)
-		})
+	for _, db := range dbs {
+		for i, workload := range db.workloads {
+			wg.Go(func() {
+				addr := db.addrs[i%len(db.addrs)]
+				logger := db.logger.With("client_id", i, "addr", addr)
+				client := dial(logger, addr)
+				defer client.CloseAndLog(logger)
+				<-start
+				proptest.RunWorkload(logger, client, workload)
+			})
+		}
 	}
 	close(start)
 	wg.Wait()
 	logger.Debug("workload complete")
 
+	for _, db := range dbs {
+		db.verify(timeout, artifacts)
+	}
+}
+
+// artifactConfig controls where debugging artifacts are saved and how many
+// are kept.
+type artifactConfig struct {
+	dir     string
+	prefix  string
+	max     int    // zero means unlimited
+	trace   bool   // also save a trace of every command
+	summary string // file name for result summaries, empty to disable
+}
+
+// dbWorkload is the part of an iteration's workload that runs against a
+// single database.
+type dbWorkload struct {
+	iteration int
+	name      string // distinguishes artifacts when there are several databases
+	addrs     []net.Addr
+	seeds     []uint64
+	logger    *slog.Logger
+	workloads [][]porcupine.Operation
+}
+
+func (db *dbWorkload) verify(timeout time.Duration, artifacts artifactConfig) {
+	logger := db.logger
 	// We've run the workload and collected the results. Using the porcupine
 	// linearizability checker, verify that the operations on each key are
 	// linearizable - and therefore, that the Valthree key-value store is strong
 	// serializable. (Etcd, the strong serializable key-value store at the heart
 	// of Kubernetes, also uses porcupine to check linearizability!)
-	progress, err := proptest.CheckWorkloads(timeout, workloads)
+	checkStart := time.Now()
+	progress, err := proptest.CheckWorkloads(timeout, db.workloads)
+	checkDuration := time.Since(checkStart)
+	if artifacts.summary != "" {
+		fpath := filepath.Join(artifacts.dir, artifacts.summary)
+		if err := appendSummary(fpath, db.summarize(checkDuration, err)); err != nil {
+			logger.Error("write result summary failed", "err", err)
+		}
+	}
+	// Using the Antithesis SDK, tell the platform whether we've upheld
+	// Valthree's critical properties. The property package declares them all
+	// in one place, so that Antithesis reports group them by severity.
+	//
+	// If integrating the SDK is difficult, Antithesis can also look for the
+	// presence or absence of particular log lines.
+	var details map[string]any
+	if err != nil {
+		details = map[string]any{"error": err.Error()}
+	}
+	if errors.Is(err, proptest.ErrPartialWrite) {
+		// The checker stops at the first partial write, before checking
+		// any key for linearizability.
+		property.NoDirtyReads(false, details)
+	} else {
+		property.NoDirtyReads(true, nil)
+		property.NoLostUpdates(err == nil, details)
+	}
+	property.WorkloadProgress(proptest.CountOps(db.workloads).SuccessRate(), nil)
 	if err != nil {
 		// Antithesis reports may include debugging artifacts. In this case,
 		// porcupine produces an interactive visualization of the consistency bug
 		// which we'd like to surface.
 		var perr *proptest.Error
 		if errors.As(err, &perr) {
-			fname := fmt.Sprintf("consistency-failure-%s.html", perr.Key)
-			fpath := filepath.Join(artifactDir, fname)
+			stem := db.artifactStem(artifacts.prefix, perr.Key)
+			fpath := filepath.Join(artifacts.dir, stem+".html")
 			if err := os.WriteFile(fpath, perr.Visualization.Bytes(), 0644); err != nil {
 				logger.Error("write model visualization failed", "err", err, "key", perr.Key)
 			}
+			if artifacts.trace {
+				fpath := filepath.Join(artifacts.dir, stem+"-trace.jsonl.gz")
+				if err := writeTrace(fpath, db.workloads, db.addrs); err != nil {
+					logger.Error("write command trace failed", "err", err, "key", perr.Key)
+				}
+			}
+			if err := pruneArtifacts(artifacts); err != nil {
+				logger.Error("prune old artifacts failed", "err", err)
+			}
 		}
-		// Using the Antithesis SDK, tell the platform that we've violated a
-		// critical system property. Unreachable is the simplest assertion, so it
-		// just takes a message and loosely-typed details.
-		//
-		// If integrating the SDK is difficult, Antithesis can also look for the
-		// presence or absence of particular log lines.
-		assert.Unreachable(
-			// Formally, we've found a violation of strong serializability. But this
-			// string appears directly in the Antithesis UI, so we avoid academic
-			// terms to keep the demo accessible to a wide audience.
-			"Clients can always read their own writes",
-			map[string]any{"error": err.Error()},
-		)
 		logger.Error("strong serializability violated", "err", err)
 	} else {
 		percent := strconv.FormatFloat(100*progress, 'f', 1 /* precision */, 64 /* bitsize */)
 		logger.Info("strong serializability verified", "percent_success", percent)
 	}
+}
+
+// summary is the machine-readable result of one iteration's workload against
+// a single database. Dashboards can track workload health across runs from
+// these rather than parsing logs.
+type summary struct {
+	Iteration int       `json:"iteration"`
+	Database  string    `json:"database,omitempty"`
+	Time      time.Time `json:"time"`
+	// Seeds are strings because JSON numbers lose precision above 2^53 in
+	// many decoders.
+	Seeds         []string       `json:"seeds"`
+	Clients       int            `json:"clients"`
+	Ops           map[string]int `json:"ops"`
+	TotalOps      int            `json:"total_ops"`
+	SuccessRate   float64        `json:"success_rate"`
+	CheckDuration float64        `json:"check_duration_seconds"`
+	Outcome       string         `json:"outcome"` // "verified", "violated", or "timed_out"
+	Key           string         `json:"key,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
 
+// summarize describes the outcome of checking the workload, given the
+// error from CheckWorkloads.
+func (db *dbWorkload) summarize(checkDuration time.Duration, checkErr error) summary {
+	stats := proptest.CountOps(db.workloads)
+	s := summary{
+		Iteration:     db.iteration,
+		Database:      db.name,
+		Time:          time.Now().UTC(),
+		Clients:       len(db.workloads),
+		Ops:           stats.Ops,
+		TotalOps:      stats.Total,
+		SuccessRate:   stats.SuccessRate(),
+		CheckDuration: checkDuration.Seconds(),
+		Outcome:       "verified",
+	}
+	for _, seed := range db.seeds {
+		s.Seeds = append(s.Seeds, strconv.FormatUint(seed, 10))
+	}
+	if checkErr != nil {
+		s.Outcome = "violated"
+		s.Error = checkErr.Error()
+		var perr *proptest.Error
+		if errors.As(checkErr, &perr) {
+			s.Key = perr.Key
+			if perr.TimedOut {
+				s.Outcome = "timed_out"
+			}
+		}
+	}
+	return s
+}
+
+// appendSummary appends a summary to a JSON Lines file, creating it if
+// necessary. Appending keeps every iteration's results in one file, rather
+// than leaving one file per iteration for the length of a run.
+func appendSummary(fpath string, s summary) error {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// artifactStem names the artifacts for a consistency failure. Including the
+// iteration, time, and seeds keeps repeated failures in a long run from
+// overwriting each other, and lets developers regenerate the workload.
+func (db *dbWorkload) artifactStem(prefix, key string) string {
+	parts := []string{
+		prefix,
+		strconv.Itoa(db.iteration),
+		time.Now().UTC().Format("20060102T150405Z"),
+		strconv.FormatUint(db.seeds[0], 10),
+		strconv.FormatUint(db.seeds[1], 10),
+	}
+	if db.name != "" {
+		parts = append(parts, db.name)
+	}
+	return strings.Join(append(parts, key), "-")
+}
+
+// pruneArtifacts deletes the oldest artifacts until at most the configured
+// maximum remain.
+func pruneArtifacts(artifacts artifactConfig) error {
+	if artifacts.max <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(artifacts.dir)
+	if err != nil {
+		return err
+	}
+	type artifact struct {
+		path    string
+		modTime time.Time
+	}
+	var found []artifact
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), artifacts.prefix+"-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // deleted concurrently
+		}
+		found = append(found, artifact{filepath.Join(artifacts.dir, entry.Name()), info.ModTime()})
+	}
+	if len(found) <= artifacts.max {
+		return nil
+	}
+	slices.SortFunc(found, func(a, b artifact) int {
+		return b.modTime.Compare(a.modTime)
+	})
+	var errs []error
+	for _, a := range found[artifacts.max:] {
+		if err := os.Remove(a.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeTrace saves every command in the workloads to a file. Clients are
+// assigned to nodes just as they are in exerciseAndVerify.
+func writeTrace(fpath string, workloads [][]porcupine.Operation, addrs []net.Addr) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	err = proptest.WriteTrace(f, workloads, func(clientID int) string {
+		return addrs[clientID%len(addrs)].String()
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func dial(logger *slog.Logger, addr net.Addr) *client.Client {